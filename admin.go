@@ -0,0 +1,230 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/pkkemp/GoOCSPResponder/responder"
+)
+
+// role is what a caller may do: viewers see the dashboard, operators may
+// also act through the admin API.
+type role int
+
+const (
+	roleNone role = iota
+	roleViewer
+	roleOperator
+)
+
+func (r role) String() string {
+	switch r {
+	case roleViewer:
+		return "viewer"
+	case roleOperator:
+		return "operator"
+	}
+	return "none"
+}
+
+// principal is an authenticated caller.
+type principal struct {
+	name string
+	role role
+	// via is how the caller authenticated: token, mtls or oidc.
+	via string
+}
+
+// bearerPrincipal authenticates the admin bearer token, which acts as an
+// operator.
+func bearerPrincipal(r *http.Request) (principal, bool) {
+	token := currentState().cfg.adminToken
+	presented := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == "" || subtle.ConstantTimeCompare([]byte(presented), []byte(token)) != 1 {
+		return principal{}, false
+	}
+	return principal{name: "admin token", role: roleOperator, via: "token"}, true
+}
+
+// adminOnly wraps an /admin handler so it requires an operator: the
+// configured bearer token, or a dashboard user with the operator role.
+// Without either configured the admin API answers 404, as if it did not
+// exist. Every admin request is written to the audit log.
+func adminOnly(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if currentState().cfg.adminToken == "" && !dashboardAuthEnabled() {
+			http.NotFound(w, r)
+			return
+		}
+		p, ok := bearerPrincipal(r)
+		if !ok {
+			p, ok = dashboardPrincipal(r)
+		}
+		switch {
+		case !ok:
+			log.Printf("audit: denied %s %s from %s", r.Method, r.URL.Path, clientAddr(r))
+			w.Header().Set("WWW-Authenticate", `Bearer realm="goocsp-admin"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		case p.role < roleOperator:
+			log.Printf("audit: denied %s %s to %s %s (%s) from %s", r.Method, r.URL.Path, p.role, p.name, p.via, clientAddr(r))
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		case p.via != "token" && !sameOrigin(r):
+			// Browsers send client certificates and cookies on cross-site
+			// requests too.
+			log.Printf("audit: denied cross-site %s %s to %s (%s) from %s", r.Method, r.URL.Path, p.name, p.via, clientAddr(r))
+			http.Error(w, "cross-site request", http.StatusForbidden)
+			return
+		}
+		log.Printf("audit: %s %s?%s by %s (%s) from %s", r.Method, r.URL.Path, r.URL.RawQuery, p.name, p.via, clientAddr(r))
+		h(w, r)
+	}
+}
+
+// sameOrigin reports whether a state-changing request was made by a page
+// of this server. Safe methods always pass.
+func sameOrigin(r *http.Request) bool {
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return true
+	}
+	if site := r.Header.Get("Sec-Fetch-Site"); site != "" {
+		return site == "same-origin"
+	}
+	origin := r.Header.Get("Origin")
+	return origin != "" && strings.TrimPrefix(strings.TrimPrefix(origin, "https://"), "http://") == r.Host
+}
+
+// requirePost rejects requests other than POST.
+func requirePost(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return false
+	}
+	return true
+}
+
+// adminResult answers an admin action, as JSON for API clients and for the
+// dashboard's forms by redirecting back to it with msg.
+func adminResult(w http.ResponseWriter, r *http.Request, msg string, v interface{}) {
+	if r.FormValue("return") == "dashboard" {
+		http.Redirect(w, r, "/stats?done="+url.QueryEscape(msg), http.StatusSeeOther)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// refreshHandler serves POST /admin/v1/refresh?issuer=, which refreshes
+// the CRL of one issuer now, or of every issuer without the parameter.
+func refreshHandler(w http.ResponseWriter, r *http.Request) {
+	if !requirePost(w, r) {
+		return
+	}
+	st := currentState()
+	crls := st.crls
+	if param := r.FormValue("issuer"); param != "" {
+		crl, _, ok := st.findIssuer(param)
+		if !ok {
+			http.Error(w, fmt.Sprintf("no served issuer matches %q", param), http.StatusNotFound)
+			return
+		}
+		crls = []CRLInfo{crl}
+	}
+	result := make(map[string]string)
+	failed := 0
+	for _, crl := range crls {
+		result[crl.key()] = "refreshed"
+		if err := refreshCRL(crl); err != nil {
+			log.Printf("refresh %s: %v", crl.FileName, err)
+			result[crl.key()] = err.Error()
+			failed++
+		}
+	}
+	adminResult(w, r, fmt.Sprintf("refreshed %d of %d CRLs", len(crls)-failed, len(crls)), result)
+}
+
+// flushCacheHandler serves POST /admin/v1/cache/flush?issuer=&serial=&before_crl_number=,
+// which drops the cached responses of one issuer, or all of them without
+// the parameter. serial narrows it to the responses answering that
+// serial, and before_crl_number, which needs issuer, to those derived
+// from a CRL numbered below it or without a number.
+func flushCacheHandler(w http.ResponseWriter, r *http.Request) {
+	if !requirePost(w, r) {
+		return
+	}
+	var serial, before *big.Int
+	if param := r.FormValue("serial"); param != "" {
+		var ok bool
+		if serial, ok = parseSerial(param); !ok {
+			http.Error(w, fmt.Sprintf("serial %q is not a serial number", param), http.StatusBadRequest)
+			return
+		}
+	}
+	if param := r.FormValue("before_crl_number"); param != "" {
+		var ok bool
+		if before, ok = new(big.Int).SetString(param, 10); !ok {
+			http.Error(w, fmt.Sprintf("before_crl_number %q is not a decimal number", param), http.StatusBadRequest)
+			return
+		}
+		if r.FormValue("issuer") == "" {
+			http.Error(w, "before_crl_number needs issuer: CRL numbers are per issuer", http.StatusBadRequest)
+			return
+		}
+	}
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	old := currentState()
+	next := *old
+	issuer := ""
+	if param := r.FormValue("issuer"); param != "" {
+		crl, _, ok := old.findIssuer(param)
+		if !ok {
+			http.Error(w, fmt.Sprintf("no served issuer matches %q", param), http.StatusNotFound)
+			return
+		}
+		issuer = crl.key()
+	}
+	switch {
+	case serial == nil && before == nil && issuer != "":
+		next.cache = old.cache.without(issuer)
+	case serial == nil && before == nil:
+		next.cache = newResponseCache(old.cfg.Cache)
+	default:
+		next.cache = old.cache.except(func(req string, e *cachedResponse) bool {
+			if issuer != "" && e.issuer != issuer {
+				return false
+			}
+			if before != nil && e.crlNumber != nil && e.crlNumber.Cmp(before) >= 0 {
+				return false
+			}
+			return serial == nil || answersSerial(req, serial)
+		})
+	}
+	current.Store(&next)
+	flushed := old.cache.size() - next.cache.size()
+	adminResult(w, r, fmt.Sprintf("flushed %d cached responses", flushed), map[string]int{"flushed": flushed})
+}
+
+// answersSerial reports whether the cached request req asks about serial.
+// Requests are cached as they came, so they are parsed again; a flush is
+// rare enough for that.
+func answersSerial(req string, serial *big.Int) bool {
+	parsed, err := responder.ParseRequest([]byte(req))
+	if err != nil {
+		return false
+	}
+	for _, id := range parsed.CertIDs {
+		if id.SerialNumber.Cmp(serial) == 0 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestFlushCacheScopes(t *testing.T) {
+	newReq := benchState(t, defaultConfig().Cache)
+	base := currentState()
+	now := time.Now()
+	entries := map[int64]*cachedResponse{
+		0x1001: {issuer: "BENCHCA_1", crlNumber: big.NewInt(4)},
+		0x1002: {issuer: "BENCHCA_1", crlNumber: big.NewInt(5)},
+		0x1003: {issuer: "BENCHCA_1"},
+		0x1004: {issuer: "OTHERCA_1", crlNumber: big.NewInt(1)},
+	}
+
+	for _, tc := range []struct {
+		query string
+		code  int
+		// kept are the serials whose responses stay cached.
+		kept []int64
+	}{
+		{"", http.StatusOK, nil},
+		{"issuer=Bench+CA-1", http.StatusOK, []int64{0x1004}},
+		{"serial=0x1001", http.StatusOK, []int64{0x1002, 0x1003, 0x1004}},
+		{"issuer=BENCHCA_1&serial=4097", http.StatusOK, []int64{0x1002, 0x1003, 0x1004}},
+		{"issuer=BENCHCA_1&serial=0x1004", http.StatusOK, []int64{0x1001, 0x1002, 0x1003, 0x1004}},
+		{"issuer=BENCHCA_1&before_crl_number=5", http.StatusOK, []int64{0x1002, 0x1004}},
+		{"before_crl_number=5", http.StatusBadRequest, nil},
+		{"serial=-1", http.StatusBadRequest, nil},
+		{"issuer=No+Such+CA", http.StatusNotFound, nil},
+	} {
+		st := *base
+		st.cache = newResponseCache(base.cfg.Cache)
+		for serial, e := range entries {
+			e := *e
+			e.der, e.expires = []byte{0x30, 0}, now.Add(time.Hour)
+			st.cache.put(newReq(serial), &e, now)
+		}
+		current.Store(&st)
+
+		w := httptest.NewRecorder()
+		flushCacheHandler(w, httptest.NewRequest(http.MethodPost, "/admin/v1/cache/flush?"+tc.query, nil))
+		if w.Code != tc.code {
+			t.Errorf("%q: answered %d, want %d", tc.query, w.Code, tc.code)
+			continue
+		}
+		if tc.code != http.StatusOK {
+			continue
+		}
+		kept := make(map[int64]bool)
+		for _, serial := range tc.kept {
+			kept[serial] = true
+		}
+		for serial := range entries {
+			if got := currentState().cache.peek(newReq(serial), now) != nil; got != kept[serial] {
+				t.Errorf("%q: %#x cached %v, want %v", tc.query, serial, got, kept[serial])
+			}
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/pkkemp/GoOCSPResponder/responder"
+)
+
+// AIAConfig is where the responder and the certificates of its CAs are
+// published, for the AIA URLs CAs embed in the certificates they issue;
+// see responder.AIAURLFor.
+type AIAConfig struct {
+	// OCSPURLs are the public base URLs of the responder, preferred first.
+	// Issuers with a route get its path appended.
+	OCSPURLs []string `yaml:"ocsp_urls"`
+	// CAIssuers are the URLs of the issuers' certificates, with {name}
+	// standing for the CRL name, {ski} for the subject key identifier and
+	// {sha256} for the fingerprint.
+	CAIssuers []string `yaml:"ca_issuers"`
+}
+
+func (c AIAConfig) enabled() bool {
+	return len(c.OCSPURLs) > 0 || len(c.CAIssuers) > 0
+}
+
+func (c AIAConfig) validate() error {
+	for _, u := range append(append([]string(nil), c.OCSPURLs...), c.CAIssuers...) {
+		if parsed, err := url.Parse(u); err != nil || parsed.Scheme != "http" || parsed.Host == "" {
+			return fmt.Errorf("aia: %q must be an http URL", u)
+		}
+	}
+	return nil
+}
+
+// aiaReport is one issuer in GET /admin/v1/aia.
+type aiaReport struct {
+	Issuer  string `json:"issuer"`
+	Subject string `json:"subject"`
+	// Route is the path dedicated to the issuer, if any.
+	Route string `json:"route,omitempty"`
+	responder.AIAURLs
+	Error string `json:"error,omitempty"`
+}
+
+// aiaReports returns the AIA URLs of every issuer served.
+func (st *state) aiaReports() []aiaReport {
+	out := make([]aiaReport, 0, len(st.crls))
+	for _, crl := range st.crls {
+		r := aiaReport{Issuer: crl.key(), Subject: crl.CA.Subject.String()}
+		// The first route of the issuer is the canonical one.
+		for _, route := range st.cfg.Routes {
+			if st.routes[route.segment()] == crl.key() {
+				r.Route = "/" + route.segment()
+				break
+			}
+		}
+		urls, err := responder.AIAURLFor(crl.CA, responder.AIAOptions{
+			OCSP:      st.cfg.AIA.OCSPURLs,
+			Path:      r.Route,
+			CAIssuers: st.cfg.AIA.CAIssuers,
+			Name:      crl.key(),
+		})
+		if err != nil {
+			r.Error = strings.TrimPrefix(err.Error(), "responder: ")
+		}
+		r.AIAURLs = urls
+		out = append(out, r)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Issuer < out[j].Issuer })
+	return out
+}
+
+// aiaHandler serves GET /admin/v1/aia.
+func aiaHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(currentState().aiaReports())
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ArchiveConfig retains superseded CRLs so status can be queried as of a
+// past time, e.g. to validate signatures on archived documents.
+type ArchiveConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Dir holds one directory of CRL versions per issuer. Defaults to
+	// archive/ in the CRL cache.
+	Dir string `yaml:"dir"`
+	// Retention is how far back queries must be answerable. Versions
+	// only needed for earlier times are deleted.
+	Retention time.Duration `yaml:"retention"`
+}
+
+// archiveTimeLayout names archived versions by their thisUpdate, so names
+// sort chronologically.
+const archiveTimeLayout = "20060102T150405Z"
+
+func (c ArchiveConfig) dir() string {
+	if c.Dir != "" {
+		return c.Dir
+	}
+	return filepath.Join(rootDir, "archive")
+}
+
+// archiveCRL copies the cached CRL behind f into the archive, unless that
+// version is already there, and prunes versions past the retention.
+// Quarantined CRLs are not archived.
+func archiveCRL(cfg *Config, f CRLBloomFilter) error {
+	if !cfg.Archive.Enabled || f.quarantine != "" || readOnly {
+		return nil
+	}
+	dir := filepath.Join(cfg.Archive.dir(), f.crlInfo.key())
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	dst := filepath.Join(dir, f.thisUpdate.UTC().Format(archiveTimeLayout)+".crl")
+	if _, err := os.Stat(dst); os.IsNotExist(err) {
+		if err := copyFile(rootDir+f.crlInfo.FileName, dst); err != nil {
+			return err
+		}
+		log.Printf("archived %s as of %s", f.crlInfo.FileName, f.thisUpdate.UTC().Format(time.RFC3339))
+	}
+	return pruneArchive(dir, time.Now().Add(-cfg.Archive.Retention))
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst + ".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(out.Name())
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Rename(out.Name(), dst)
+}
+
+// archivedVersions returns the thisUpdate times archived in dir, oldest
+// first.
+func archivedVersions(dir string) ([]time.Time, error) {
+	names, err := filepath.Glob(filepath.Join(dir, "*.crl"))
+	if err != nil {
+		return nil, err
+	}
+	var versions []time.Time
+	for _, name := range names {
+		t, err := time.Parse(archiveTimeLayout, strings.TrimSuffix(filepath.Base(name), ".crl"))
+		if err == nil {
+			versions = append(versions, t)
+		}
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i].Before(versions[j]) })
+	return versions, nil
+}
+
+// pruneArchive deletes the versions that were superseded before cutoff.
+// The version in effect at cutoff is kept, so every time since cutoff
+// stays answerable.
+func pruneArchive(dir string, cutoff time.Time) error {
+	versions, err := archivedVersions(dir)
+	if err != nil {
+		return err
+	}
+	for i := 0; i+1 < len(versions); i++ {
+		if versions[i+1].After(cutoff) {
+			break
+		}
+		path := filepath.Join(dir, versions[i].Format(archiveTimeLayout)+".crl")
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// archiveCache keeps recently queried archived CRLs parsed; point-in-time
+// queries tend to repeat the same few versions.
+var archiveCache = struct {
+	sync.Mutex
+	indexes map[string]CRLBloomFilter
+}{indexes: make(map[string]CRLBloomFilter)}
+
+const archiveCacheSize = 8
+
+// archivedIndex returns the index of the version of crl's CRL that was
+// current at asOf, the newest one issued at or before it, and its path.
+func archivedIndex(cfg *Config, crl CRLInfo, asOf time.Time) (CRLBloomFilter, string, error) {
+	if !cfg.Archive.Enabled {
+		return CRLBloomFilter{}, "", fmt.Errorf("asOf needs the CRL archive, which is disabled")
+	}
+	dir := filepath.Join(cfg.Archive.dir(), crl.key())
+	versions, err := archivedVersions(dir)
+	if err != nil {
+		return CRLBloomFilter{}, "", err
+	}
+	i := sort.Search(len(versions), func(i int) bool { return versions[i].After(asOf) }) - 1
+	if i < 0 {
+		return CRLBloomFilter{}, "", fmt.Errorf("no archived CRL for %s covers %s", crl.key(), asOf.UTC().Format(time.RFC3339))
+	}
+	path := filepath.Join(dir, versions[i].Format(archiveTimeLayout)+".crl")
+
+	archiveCache.Lock()
+	defer archiveCache.Unlock()
+	if f, ok := archiveCache.indexes[path]; ok {
+		return f, path, nil
+	}
+	scanned, err := scanCRLFile(path)
+	if err != nil {
+		return CRLBloomFilter{}, "", err
+	}
+	f, err := indexCRL(cfg, crl, scanned, nil)
+	if err != nil {
+		return CRLBloomFilter{}, "", err
+	}
+	if len(archiveCache.indexes) >= archiveCacheSize {
+		for k := range archiveCache.indexes {
+			delete(archiveCache.indexes, k)
+			break
+		}
+	}
+	archiveCache.indexes[path] = f
+	return f, path, nil
+}
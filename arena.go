@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"encoding/asn1"
+	"encoding/binary"
+	"math/big"
+	"sort"
+
+	"github.com/pkkemp/GoOCSPResponder/responder"
+)
+
+// arenaIndex holds the revoked entries of an in-memory index in a single
+// byte slab of fixed-width records sorted by serial, rather than a map of
+// Entry values. A map of tens of millions of entries holds a big.Int, a
+// key string and an Entry per serial, all of which the garbage collector
+// must scan on every cycle; the slab holds no pointers, so it is never
+// scanned at all.
+//
+// Each record is the serial's big-endian magnitude, left-padded to the
+// width of the longest serial of the CRL, followed by a trailer laid out
+// as the on-disk index's records are (all integers big endian, times Unix
+// seconds):
+//
+//	0  revocation time
+//	8  invalidity date, or math.MinInt64 for none
+//	16 reason code
+//	17 hold instruction: last arc of an id-holdinstruction OID, 0 for none
+//	20 CRL position while building, 0 after
+//
+// Padded magnitudes of equal width sort as the numbers do, so lookups are
+// a binary search. Like the on-disk index, times keep whole seconds and
+// hold instructions outside id-holdinstruction are dropped.
+type arenaIndex struct {
+	data []byte
+	// width is the serial width of every record; the stride is width
+	// plus arenaTrailerSize.
+	width, count int
+}
+
+const arenaTrailerSize = 24
+
+// newArenaIndex returns the index of entries, in CRL order. A serial
+// listed twice keeps its last entry, as encodeIndex does.
+func newArenaIndex(entries []responder.Entry) *arenaIndex {
+	width := 0
+	for _, e := range entries {
+		if n := (e.Serial.BitLen() + 7) / 8; n > width {
+			width = n
+		}
+	}
+	a := newArenaBuilder(len(entries), width)
+	for i, e := range entries {
+		a.put(i, e.Serial.Bytes(), e)
+	}
+	return a.finish()
+}
+
+// arenaBuilder fills an arena index record by record.
+type arenaBuilder struct {
+	data  []byte
+	width int
+}
+
+// newArenaBuilder returns a builder for count entries whose serial
+// magnitudes are at most width bytes long.
+func newArenaBuilder(count, width int) *arenaBuilder {
+	return &arenaBuilder{data: make([]byte, count*(width+arenaTrailerSize)), width: width}
+}
+
+// put stores e, the entry at position i of the CRL, under serial, the
+// big-endian magnitude of its serial number; e.Serial is not read.
+func (a *arenaBuilder) put(i int, serial []byte, e responder.Entry) {
+	width := a.width
+	stride := width + arenaTrailerSize
+	rec := a.data[i*stride : (i+1)*stride]
+	copy(rec[width-len(serial):width], serial)
+	t := rec[width:]
+	putTime(t, e.RevokedAt)
+	putTime(t[8:], e.InvalidityDate)
+	t[16] = byte(e.Reason)
+	if len(e.HoldInstruction) == len(holdInstructionArc)+1 && e.HoldInstruction[:len(holdInstructionArc)].Equal(holdInstructionArc) {
+		t[17] = byte(e.HoldInstruction[len(holdInstructionArc)])
+	}
+	binary.BigEndian.PutUint32(t[20:], uint32(i))
+}
+
+// finish sorts the records and drops duplicate serials, keeping the last.
+func (a *arenaBuilder) finish() *arenaIndex {
+	data, width := a.data, a.width
+	stride := width + arenaTrailerSize
+	sort.Sort(arenaSorter{data: data, width: width})
+
+	n := 0
+	for i := 0; i < len(data); i += stride {
+		rec := data[i : i+stride]
+		if next := i + stride; next < len(data) && bytes.Equal(rec[:width], data[next:next+width]) {
+			continue
+		}
+		copy(data[n:], rec)
+		binary.BigEndian.PutUint32(data[n+width+20:], 0)
+		n += stride
+	}
+	if n < len(data) {
+		// Give back the space of the dropped duplicates.
+		data = append([]byte(nil), data[:n]...)
+	}
+	return &arenaIndex{data: data, width: width, count: n / stride}
+}
+
+// serialUint64 returns the low 64 bits of the serial of magnitude serial,
+// as big.Int.Uint64 does, for the bloom filter.
+func serialUint64(serial []byte) uint64 {
+	var v uint64
+	if len(serial) > 8 {
+		serial = serial[len(serial)-8:]
+	}
+	for _, c := range serial {
+		v = v<<8 | uint64(c)
+	}
+	return v
+}
+
+// arenaSorter sorts records by serial, then by the CRL position
+// newArenaIndex stores in their trailer.
+type arenaSorter struct {
+	data  []byte
+	width int
+}
+
+func (s arenaSorter) stride() int { return s.width + arenaTrailerSize }
+func (s arenaSorter) record(i int) []byte {
+	return s.data[i*s.stride() : (i+1)*s.stride()]
+}
+
+func (s arenaSorter) Len() int { return len(s.data) / s.stride() }
+func (s arenaSorter) Less(i, j int) bool {
+	a, b := s.record(i), s.record(j)
+	if c := bytes.Compare(a[:s.width], b[:s.width]); c != 0 {
+		return c < 0
+	}
+	return binary.BigEndian.Uint32(a[s.width+20:]) < binary.BigEndian.Uint32(b[s.width+20:])
+}
+func (s arenaSorter) Swap(i, j int) {
+	var tmp [64]byte
+	buf := tmp[:]
+	if s.stride() > len(tmp) {
+		buf = make([]byte, s.stride())
+	}
+	a, b := s.record(i), s.record(j)
+	copy(buf, a)
+	copy(a, b)
+	copy(b, buf)
+}
+
+// len returns the number of entries in idx, which may be nil.
+func (idx *arenaIndex) len() int {
+	if idx == nil {
+		return 0
+	}
+	return idx.count
+}
+
+// bytes returns the memory held by idx.
+func (idx *arenaIndex) bytes() uint64 {
+	if idx == nil {
+		return 0
+	}
+	return uint64(cap(idx.data))
+}
+
+func (idx *arenaIndex) record(i int) []byte {
+	stride := idx.width + arenaTrailerSize
+	return idx.data[i*stride : (i+1)*stride]
+}
+
+// lookup binary searches idx, which may be nil, for serial. The records
+// hold magnitudes, so a serial that is not positive is never found rather
+// than found as its positive twin.
+func (idx *arenaIndex) lookup(serial *big.Int) (responder.Entry, bool) {
+	n := (serial.BitLen() + 7) / 8
+	if idx == nil || serial.Sign() <= 0 || n > idx.width {
+		return responder.Entry{}, false
+	}
+	var buf [32]byte
+	var key []byte
+	if idx.width <= len(buf) {
+		key = buf[:idx.width]
+	} else {
+		key = make([]byte, idx.width)
+	}
+	serial.FillBytes(key)
+	lo, hi := 0, idx.count
+	for lo < hi {
+		mid := int(uint(lo+hi) >> 1)
+		if bytes.Compare(idx.record(mid)[:idx.width], key) < 0 {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+	if lo == idx.count || !bytes.Equal(idx.record(lo)[:idx.width], key) {
+		return responder.Entry{}, false
+	}
+	return idx.entryOf(lo, serial), true
+}
+
+// entry returns the i-th entry of idx, in serial order.
+func (idx *arenaIndex) entry(i int) responder.Entry {
+	return idx.entryOf(i, new(big.Int).SetBytes(idx.record(i)[:idx.width]))
+}
+
+// entryOf returns the i-th entry of idx, whose serial is serial.
+func (idx *arenaIndex) entryOf(i int, serial *big.Int) responder.Entry {
+	t := idx.record(i)[idx.width:]
+	e := responder.Entry{
+		Serial:         serial,
+		RevokedAt:      getTime(t),
+		InvalidityDate: getTime(t[8:]),
+		Reason:         int(t[16]),
+	}
+	if t[17] != 0 {
+		e.HoldInstruction = append(asn1.ObjectIdentifier{}, holdInstructionArc...)
+		e.HoldInstruction = append(e.HoldInstruction, int(t[17]))
+	}
+	return e
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"math/big"
+	"math/rand"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/pkkemp/GoOCSPResponder/responder"
+)
+
+// gcBenchEntries is the size of the indexes the GC benchmarks hold; large
+// CRLs run to tens of millions, which only scales the difference.
+const gcBenchEntries = 1 << 21
+
+// benchEntries returns n entries with random 16-byte serials, a quarter of
+// them with a reason and an invalidity date, as in a large CA's CRL.
+func benchEntries(n int) []responder.Entry {
+	rng := rand.New(rand.NewSource(1))
+	revokedAt := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	entries := make([]responder.Entry, n)
+	for i := range entries {
+		serial := make([]byte, 16)
+		rng.Read(serial)
+		e := responder.Entry{Serial: new(big.Int).SetBytes(serial), RevokedAt: revokedAt.Add(time.Duration(i) * time.Second)}
+		if i%4 == 0 {
+			e.Reason, e.InvalidityDate = 1, revokedAt
+		}
+		entries[i] = e
+	}
+	return entries
+}
+
+// mapIndex is the index as it was before arena.go, kept to compare
+// against.
+func mapIndex(entries []responder.Entry) map[string]responder.Entry {
+	m := make(map[string]responder.Entry, len(entries))
+	for _, e := range entries {
+		m[string(e.Serial.Bytes())] = e
+	}
+	return m
+}
+
+// benchmarkGC times full collections while index is live, reporting the
+// heap objects the collector has to trace and the stop-the-world pause
+// per cycle.
+func benchmarkGC(b *testing.B, index interface{}) {
+	runtime.GC()
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		runtime.GC()
+	}
+	b.StopTimer()
+	runtime.ReadMemStats(&after)
+	b.ReportMetric(float64(after.HeapObjects), "heap-objects")
+	b.ReportMetric(float64(after.PauseTotalNs-before.PauseTotalNs)/float64(after.NumGC-before.NumGC), "pause-ns/gc")
+	runtime.KeepAlive(index)
+}
+
+func BenchmarkGCMapIndex(b *testing.B) {
+	benchmarkGC(b, mapIndex(benchEntries(gcBenchEntries)))
+}
+
+func BenchmarkGCArenaIndex(b *testing.B) {
+	benchmarkGC(b, newArenaIndex(benchEntries(gcBenchEntries)))
+}
+
+// The lookup benchmarks show what the binary search costs against a map
+// probe, which allocates the serial's bytes for its key.
+func BenchmarkLookupMapIndex(b *testing.B) {
+	entries := benchEntries(1 << 20)
+	m := mapIndex(entries)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, ok := m[string(entries[i&(len(entries)-1)].Serial.Bytes())]; !ok {
+			b.Fatal("serial not found")
+		}
+	}
+}
+
+func BenchmarkLookupArenaIndex(b *testing.B) {
+	entries := benchEntries(1 << 20)
+	idx := newArenaIndex(entries)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, ok := idx.lookup(entries[i&(len(entries)-1)].Serial); !ok {
+			b.Fatal("serial not found")
+		}
+	}
+}
+
+func TestArenaIndexLookup(t *testing.T) {
+	revokedAt := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	idx := newArenaIndex([]responder.Entry{
+		{Serial: big.NewInt(0x666), RevokedAt: revokedAt, Reason: 1},
+		{Serial: new(big.Int).Lsh(big.NewInt(1), 100), RevokedAt: revokedAt},
+	})
+	for _, tc := range []struct {
+		serial  *big.Int
+		revoked bool
+	}{
+		{big.NewInt(0x666), true},
+		{new(big.Int).Lsh(big.NewInt(1), 100), true},
+		{big.NewInt(0x667), false},
+		{big.NewInt(0), false},
+		{big.NewInt(-0x666), false},
+		{new(big.Int).Neg(new(big.Int).Lsh(big.NewInt(1), 100)), false},
+		{new(big.Int).Lsh(big.NewInt(1), 200), false},
+	} {
+		e, ok := idx.lookup(tc.serial)
+		if ok != tc.revoked {
+			t.Errorf("lookup(%v) = %v, want %v", tc.serial, ok, tc.revoked)
+		}
+		if ok && (e.Serial.Cmp(tc.serial) != 0 || !e.RevokedAt.Equal(revokedAt)) {
+			t.Errorf("lookup(%v) = %+v", tc.serial, e)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"embed"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+// assets holds the page templates and the static files served under
+// /static/, so the binary needs nothing from the working directory.
+//
+//go:embed templates static
+var assets embed.FS
+
+// staticAsset is one embedded static file and its content-hashed name.
+type staticAsset struct {
+	data   []byte
+	hashed string
+}
+
+var (
+	// staticByName maps a file name in static/ to the asset.
+	staticByName = make(map[string]*staticAsset)
+	// staticByHash maps a hashed name (style.1a2b3c4d.css) to the asset.
+	staticByHash = make(map[string]*staticAsset)
+
+	templates = template.Must(template.New("").Funcs(template.FuncMap{
+		"asset": assetURL,
+		"bytes": formatBytes,
+	}).ParseFS(assets, "templates/*.html"))
+)
+
+func init() {
+	err := fs.WalkDir(assets, "static", func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := assets.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		name := strings.TrimPrefix(p, "static/")
+		sum := sha256.Sum256(data)
+		ext := path.Ext(name)
+		a := &staticAsset{data: data, hashed: fmt.Sprintf("%s.%x%s", strings.TrimSuffix(name, ext), sum[:4], ext)}
+		staticByName[name] = a
+		staticByHash[a.hashed] = a
+		return nil
+	})
+	if err != nil {
+		panic(err)
+	}
+}
+
+// assetURL is the cache-busting URL of a static file, for templates.
+func assetURL(name string) (string, error) {
+	a, ok := staticByName[name]
+	if !ok {
+		return "", fmt.Errorf("no static asset %q", name)
+	}
+	return "/static/" + a.hashed, nil
+}
+
+// staticHandler serves /static/. Hashed names never change content and are
+// cached indefinitely; plain names are served too but revalidated.
+func staticHandler(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/static/")
+	if a, ok := staticByHash[name]; ok {
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+		serveAsset(w, r, name, a)
+		return
+	}
+	if a, ok := staticByName[name]; ok {
+		w.Header().Set("Cache-Control", "no-cache")
+		serveAsset(w, r, name, a)
+		return
+	}
+	http.NotFound(w, r)
+}
+
+// rootAssetHandler serves a static file that clients expect at the root,
+// such as /favicon.ico and /robots.txt.
+func rootAssetHandler(name string) http.HandlerFunc {
+	a := staticByName[name]
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "public, max-age=86400")
+		serveAsset(w, r, name, a)
+	}
+}
+
+func serveAsset(w http.ResponseWriter, r *http.Request, name string, a *staticAsset) {
+	if ct := mime.TypeByExtension(path.Ext(name)); ct != "" {
+		w.Header().Set("Content-Type", ct)
+	}
+	w.Header().Set("ETag", `"`+a.hashed+`"`)
+	// Embedded files have no modification time; the ETag covers
+	// revalidation.
+	http.ServeContent(w, r, name, time.Time{}, bytes.NewReader(a.data))
+}
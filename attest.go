@@ -0,0 +1,279 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkkemp/GoOCSPResponder/responder"
+)
+
+// version is the software version reported by /attest, set at build time
+// with -ldflags "-X main.version=...".
+var version = ""
+
+func softwareVersion() string {
+	if version != "" {
+		return version
+	}
+	if bi, ok := debug.ReadBuildInfo(); ok && bi.Main.Version != "" {
+		return bi.Main.Version
+	}
+	return "devel"
+}
+
+// AttestationConfig enables GET /attest. Without a key of its own the
+// attestation is signed with the responder key.
+type AttestationConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	Cert    string `yaml:"cert"`
+	Key     string `yaml:"key"`
+	// Lifetime is how long a statement is valid for (exp - iat).
+	Lifetime time.Duration `yaml:"lifetime"`
+}
+
+func (c AttestationConfig) validate() error {
+	if (c.Cert == "") != (c.Key == "") {
+		return errors.New("attestation: cert and key must be set together")
+	}
+	if c.Enabled && c.Lifetime <= 0 {
+		return errors.New("attestation: lifetime must be positive")
+	}
+	return nil
+}
+
+// attestation is the signed statement: what data the responder is
+// serving, under which configuration and software, as of iat.
+type attestation struct {
+	Issuer       string           `json:"iss"`
+	IssuedAt     int64            `json:"iat"`
+	Expires      int64            `json:"exp"`
+	Nonce        string           `json:"nonce,omitempty"`
+	Software     attestedSoftware `json:"software"`
+	ConfigSHA256 string           `json:"config_sha256"`
+	Region       string           `json:"region,omitempty"`
+	Responder    string           `json:"responder_sha256,omitempty"`
+	// Manifest is the digest of the build manifest; see manifest.go.
+	Manifest string        `json:"manifest_sha256"`
+	CRLs     []attestedCRL `json:"crls"`
+}
+
+type attestedSoftware struct {
+	Version string     `json:"version"`
+	Go      string     `json:"go"`
+	FIPS    fipsStatus `json:"fips"`
+}
+
+type attestedCRL struct {
+	Issuer     string    `json:"issuer"`
+	Subject    string    `json:"subject"`
+	SHA256     string    `json:"sha256"`
+	Number     string    `json:"number,omitempty"`
+	ThisUpdate time.Time `json:"this_update"`
+	NextUpdate time.Time `json:"next_update"`
+	LoadedAt   time.Time `json:"loaded_at"`
+	Entries    int       `json:"entries"`
+	Quarantine string    `json:"quarantine,omitempty"`
+}
+
+// attest describes st as of now.
+func (st *state) attest(now time.Time, nonce string) attestation {
+	a := attestation{
+		IssuedAt:     now.Unix(),
+		Expires:      now.Add(st.cfg.Attestation.Lifetime).Unix(),
+		Nonce:        nonce,
+		Software:     attestedSoftware{Version: softwareVersion(), Go: runtime.Version(), FIPS: currentFIPSStatus(st.cfg)},
+		ConfigSHA256: hex.EncodeToString(st.cfg.hash[:]),
+		Region:       st.cfg.Region.Name,
+		Manifest:     st.manifest().SHA256,
+		CRLs:         []attestedCRL{},
+	}
+	a.Issuer, _ = os.Hostname()
+	if st.signer != nil {
+		fp := getSha256Fingerprint(st.signer.Cert)
+		a.Responder = hex.EncodeToString(fp[:])
+	}
+	for _, crl := range st.crls {
+		f := st.filters[crl.key()]
+		c := attestedCRL{
+			Issuer:     crl.key(),
+			Subject:    subjectDN(crl.CA),
+			SHA256:     hex.EncodeToString(f.crlHash[:]),
+			ThisUpdate: f.thisUpdate,
+			NextUpdate: f.nextUpdate,
+			LoadedAt:   f.loadedAt,
+			Entries:    f.size(),
+			Quarantine: f.quarantine,
+		}
+		if f.crlNumber != nil {
+			c.Number = f.crlNumber.String()
+		}
+		a.CRLs = append(a.CRLs, c)
+	}
+	return a
+}
+
+// attestationSigner returns the key /attest signs with.
+func (st *state) attestationSigner() (*responder.Signer, error) {
+	if st.cfg.Attestation.Cert == "" {
+		if st.signer == nil {
+			return nil, errors.New("no responder key to sign with")
+		}
+		return st.signer, nil
+	}
+	// A dedicated key is loaded once per configuration.
+	attestKeys.Lock()
+	defer attestKeys.Unlock()
+	if attestKeys.cfg == st.cfg {
+		return attestKeys.signer, attestKeys.err
+	}
+	attestKeys.cfg = st.cfg
+	attestKeys.signer, attestKeys.err = responder.LoadSigner(st.cfg.Attestation.Cert, st.cfg.Attestation.Key)
+	return attestKeys.signer, attestKeys.err
+}
+
+// attestHandler serves GET /attest[?nonce=…]: a JWS
+// (application/jwt) over the attestation of the current state. A nonce
+// chosen by the caller proves the statement is fresh.
+func attestHandler(w http.ResponseWriter, r *http.Request) {
+	st := currentState()
+	if !st.cfg.Attestation.Enabled {
+		http.NotFound(w, r)
+		return
+	}
+	nonce := r.URL.Query().Get("nonce")
+	if len(nonce) > 128 {
+		http.Error(w, "nonce is limited to 128 characters", http.StatusBadRequest)
+		return
+	}
+	signer, err := st.attestationSigner()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	// Signing shares the slow path's budget with OCSP responses.
+	if !st.acquireSlow() {
+		http.Error(w, "busy", http.StatusServiceUnavailable)
+		return
+	}
+	defer func() { <-st.slow }()
+	payload, _ := json.Marshal(st.attest(time.Now(), nonce))
+	jws, err := signJWS(signer, attestationType, payload)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/jwt")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write([]byte(jws))
+}
+
+// attestationType is the JWS typ of an attestation.
+const attestationType = "goocsp-attestation+jwt"
+
+// attestKeys caches the dedicated attestation key of one configuration.
+var attestKeys struct {
+	sync.Mutex
+	cfg    *Config
+	signer *responder.Signer
+	err    error
+}
+
+// attestationSkew is how far in the future an attestation's iat may be.
+const attestationSkew = 5 * time.Minute
+
+// verifyAttestation checks a JWS from /attest: its type and signature, that
+// it was not issued after now, and that its certificate chains to roots at
+// now. Statements live for minutes, so the time the signer claims is not
+// trusted to pick the validity the certificate is checked against. It
+// returns the statement and the signing certificate.
+func verifyAttestation(token string, roots *x509.CertPool, now time.Time) (*attestation, *x509.Certificate, error) {
+	raw, chain, err := parseJWS(token, attestationType)
+	if err != nil {
+		if len(chain) == 0 {
+			return nil, nil, err
+		}
+		return nil, chain[0], err
+	}
+	var a attestation
+	if err := json.Unmarshal(raw, &a); err != nil {
+		return nil, chain[0], err
+	}
+	if iat := time.Unix(a.IssuedAt, 0); iat.After(now.Add(attestationSkew)) {
+		return &a, chain[0], fmt.Errorf("issued in the future, at %s", iat.UTC().Format(time.RFC3339))
+	}
+	opts := x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: x509.NewCertPool(),
+		CurrentTime:   now,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}
+	for _, c := range chain[1:] {
+		opts.Intermediates.AddCert(c)
+	}
+	if _, err := chain[0].Verify(opts); err != nil {
+		return &a, chain[0], err
+	}
+	return &a, chain[0], nil
+}
+
+func verifyAttestationCommand(args []string) int {
+	fs := flag.NewFlagSet("verify-attestation", flag.ContinueOnError)
+	path := fs.String("attestation", "", "JWS returned by /attest")
+	rootsPath := fs.String("roots", "", "PEM certificates the attestation key must chain to")
+	nonce := fs.String("nonce", "", "nonce the attestation was requested with")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *path == "" || *rootsPath == "" {
+		fmt.Fprintln(os.Stderr, "verify-attestation: --attestation and --roots are required")
+		fs.Usage()
+		return 2
+	}
+	data, err := os.ReadFile(*path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "verify-attestation:", err)
+		return 2
+	}
+	certs, err := readCertificates(*rootsPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "verify-attestation:", err)
+		return 2
+	}
+	roots := x509.NewCertPool()
+	for _, c := range certs {
+		roots.AddCert(c)
+	}
+
+	a, signer, err := verifyAttestation(strings.TrimSpace(string(data)), roots, time.Now())
+	if signer != nil {
+		fmt.Printf("Signed by:     %s\n", signer.Subject)
+	}
+	if a != nil {
+		out, _ := json.MarshalIndent(a, "", "  ")
+		fmt.Println(string(out))
+	}
+	switch {
+	case err != nil:
+	case a.Nonce != *nonce:
+		err = fmt.Errorf("nonce %q, want %q", a.Nonce, *nonce)
+	case time.Now().After(time.Unix(a.Expires, 0)):
+		err = fmt.Errorf("expired at %s", time.Unix(a.Expires, 0).UTC().Format(time.RFC3339))
+	}
+	if err != nil {
+		fmt.Printf("Result:        INVALID: %v\n", err)
+		return 1
+	}
+	fmt.Printf("Result:        valid until %s\n", time.Unix(a.Expires, 0).UTC().Format(time.RFC3339))
+	return 0
+}
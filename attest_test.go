@@ -0,0 +1,56 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/pkkemp/GoOCSPResponder/responder"
+)
+
+// jwsSigner returns a self-signed key for JWS statements, valid from
+// notBefore to notAfter, and a pool trusting it.
+func jwsSigner(t *testing.T, notBefore, notAfter time.Time) (*responder.Signer, *x509.CertPool) {
+	t.Helper()
+	s := testCA(t, "Statement Signer", notBefore, notAfter)
+	roots := x509.NewCertPool()
+	roots.AddCert(s.Cert)
+	return s, roots
+}
+
+func TestVerifyAttestation(t *testing.T) {
+	now := time.Now()
+	valid, roots := jwsSigner(t, now.Add(-time.Hour), now.Add(time.Hour))
+	expired, expiredRoots := jwsSigner(t, now.Add(-48*time.Hour), now.Add(-24*time.Hour))
+	sign := func(s *responder.Signer, typ string, iat time.Time) string {
+		t.Helper()
+		payload, _ := json.Marshal(attestation{Issuer: "ocsp.example", IssuedAt: iat.Unix(), Expires: iat.Add(5 * time.Minute).Unix()})
+		token, err := signJWS(s, typ, payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+
+	if a, _, err := verifyAttestation(sign(valid, attestationType, now), roots, now); err != nil || a.Issuer != "ocsp.example" {
+		t.Fatalf("verifyAttestation = %+v, %v", a, err)
+	}
+	tests := []struct {
+		name  string
+		token string
+		roots *x509.CertPool
+	}{
+		{"other type", sign(valid, blocklistType, now), roots},
+		{"backdated into an expired signer's validity", sign(expired, attestationType, now.Add(-36*time.Hour)), expiredRoots},
+		{"issued in the future", sign(valid, attestationType, now.Add(time.Hour)), roots},
+		{"untrusted signer", sign(valid, attestationType, now), expiredRoots},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, err := verifyAttestation(tt.token, tt.roots, now); err == nil {
+				t.Error("verifyAttestation accepted the statement")
+			}
+		})
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkkemp/GoOCSPResponder/responder"
+)
+
+// BatchSigningConfig enables POST /api/v1/sign, through which external
+// pipelines, such as a CA's issuance pipeline attaching a first staple to
+// a new certificate, have responses signed by this responder in batches.
+// The responder stays the authority on status: each item names the status
+// the caller expects, and is signed only if the served CRL agrees.
+type BatchSigningConfig struct {
+	// TokenFile holds the bearer token callers must present. The endpoint
+	// is not served without it.
+	TokenFile string `yaml:"token_file"`
+	// MaxItems bounds the items of a batch.
+	MaxItems int `yaml:"max_items"`
+	// token is the contents of TokenFile.
+	token string
+}
+
+func (c BatchSigningConfig) validate() error {
+	if c.TokenFile != "" && c.MaxItems < 1 {
+		return errors.New("batch_signing.max_items must be at least 1")
+	}
+	return nil
+}
+
+// maxBatchItemSize bounds the JSON of one batch item, to bound a batch's
+// body.
+const maxBatchItemSize = 1 << 10
+
+// batchItem is one certificate of a POST /api/v1/sign batch.
+type batchItem struct {
+	Issuer string `json:"issuer"`
+	Serial string `json:"serial"`
+	// Status is the status the caller expects: good, revoked or unknown.
+	Status string `json:"status"`
+}
+
+// batchResult answers one batchItem: the signed response, or why there is
+// none.
+type batchResult struct {
+	Issuer     string     `json:"issuer"`
+	Serial     string     `json:"serial"`
+	Status     string     `json:"status,omitempty"`
+	ThisUpdate *time.Time `json:"this_update,omitempty"`
+	NextUpdate *time.Time `json:"next_update,omitempty"`
+	// Response is the DER OCSP response, base64 encoded in JSON.
+	Response []byte `json:"response,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// batchAuthorized reports whether r carries the batch signing token,
+// answering it otherwise.
+func batchAuthorized(w http.ResponseWriter, r *http.Request, st *state) bool {
+	presented := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if st.cfg.BatchSigning.token == "" || subtle.ConstantTimeCompare([]byte(presented), []byte(st.cfg.BatchSigning.token)) != 1 {
+		log.Printf("audit: denied %s %s from %s", r.Method, r.URL.Path, clientAddr(r))
+		w.Header().Set("WWW-Authenticate", `Bearer realm="goocsp-sign"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// signBatch answers every item of a batch, in order.
+func (st *state) signBatch(items []batchItem, now time.Time) []batchResult {
+	out := make([]batchResult, len(items))
+	for i, item := range items {
+		out[i] = st.signBatchItem(item, now)
+	}
+	return out
+}
+
+func (st *state) signBatchItem(item batchItem, now time.Time) batchResult {
+	res := batchResult{Issuer: item.Issuer, Serial: item.Serial}
+	switch item.Status {
+	case "good", "revoked", "unknown":
+	default:
+		res.Error = fmt.Sprintf("status %q is not good, revoked or unknown", item.Status)
+		return res
+	}
+	serial, ok := parseSerial(item.Serial)
+	if !ok {
+		res.Error = fmt.Sprintf("serial %q is not a serial number", item.Serial)
+		return res
+	}
+	res.Serial = fmt.Sprintf("%x", serial)
+	crl, _, ok := st.findIssuer(item.Issuer)
+	if !ok {
+		res.Error = fmt.Sprintf("no served issuer matches %q", item.Issuer)
+		return res
+	}
+	res.Issuer = crl.key()
+	req, err := certIDRequest(crl, serial)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	der := st.answer(req, now)
+	resp, err := responder.ParseResponse(der)
+	switch {
+	case err != nil:
+		res.Error = err.Error()
+		return res
+	case resp.Status != responder.Successful || len(resp.Responses) != 1:
+		res.Error = fmt.Sprintf("the responder answered %v", resp.Status)
+		return res
+	}
+	single := resp.Responses[0]
+	if got := single.Status.String(); got != item.Status {
+		res.Error = fmt.Sprintf("the served CRL says %s, not %s", got, item.Status)
+		return res
+	}
+	res.Status, res.ThisUpdate, res.Response = item.Status, &single.ThisUpdate, der
+	if !single.NextUpdate.IsZero() {
+		res.NextUpdate = &single.NextUpdate
+	}
+	return res
+}
+
+// bodyTooLarge reports whether err is http.MaxBytesReader refusing the
+// rest of a body, which has no error type of its own before Go 1.19.
+func bodyTooLarge(err error) bool {
+	return err != nil && strings.HasSuffix(err.Error(), "request body too large")
+}
+
+// batchSignHandler serves POST /api/v1/sign: a JSON object whose items are
+// the certificates to sign responses for. It answers each item in order,
+// with its signed response or an error; one refused item does not fail
+// the batch.
+func batchSignHandler(w http.ResponseWriter, r *http.Request) {
+	if !requirePost(w, r) {
+		return
+	}
+	st := currentState()
+	if !batchAuthorized(w, r, st) {
+		return
+	}
+	if standbyPassive() {
+		http.Error(w, "standby", http.StatusServiceUnavailable)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, int64(st.cfg.BatchSigning.MaxItems)*maxBatchItemSize)
+	var batch struct {
+		Items []batchItem `json:"items"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+		code := http.StatusBadRequest
+		if bodyTooLarge(err) {
+			code = http.StatusRequestEntityTooLarge
+		}
+		http.Error(w, "reading the batch: "+err.Error(), code)
+		return
+	}
+	switch n := len(batch.Items); {
+	case n == 0:
+		http.Error(w, "the batch has no items", http.StatusBadRequest)
+		return
+	case n > st.cfg.BatchSigning.MaxItems:
+		http.Error(w, fmt.Sprintf("the batch has %d items, over batch_signing.max_items (%d)", n, st.cfg.BatchSigning.MaxItems), http.StatusRequestEntityTooLarge)
+		return
+	}
+	results := st.signBatch(batch.Items, time.Now())
+	signed := 0
+	for _, res := range results {
+		if res.Error == "" {
+			signed++
+		}
+	}
+	log.Printf("audit: sign: %d of %d responses signed for %s", signed, len(results), clientAddr(r))
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(struct {
+		Items []batchResult `json:"items"`
+	}{results})
+}
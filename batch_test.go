@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkkemp/GoOCSPResponder/responder"
+)
+
+func TestBatchSign(t *testing.T) {
+	benchState(t, defaultConfig().Cache)
+	st := currentState()
+	st.cfg.BatchSigning.token, st.cfg.BatchSigning.MaxItems = "s3cret", 3
+	f := st.filters[st.crls[0].key()]
+	f.entries = newArenaIndex([]responder.Entry{{Serial: big.NewInt(0x666), RevokedAt: time.Now().Add(-time.Hour), Reason: 1}})
+	addItemToBloom(0x666, f.Filter)
+	st.filters[st.crls[0].key()] = f
+
+	sign := func(token, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/api/v1/sign", strings.NewReader(body))
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		batchSignHandler(w, r)
+		return w
+	}
+
+	w := sign("s3cret", `{"items": [
+		{"issuer": "Bench CA-1", "serial": "0x1001", "status": "good"},
+		{"issuer": "BENCHCA_1", "serial": "0x666", "status": "revoked"},
+		{"issuer": "Bench CA-1", "serial": "0x666", "status": "good"}
+	]}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("answered %d: %s", w.Code, w.Body)
+	}
+	var out struct {
+		Items []batchResult `json:"items"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &out); err != nil {
+		t.Fatal(err)
+	}
+	if len(out.Items) != 3 {
+		t.Fatalf("answered %d items, want 3", len(out.Items))
+	}
+	for i, want := range []responder.Status{responder.Good, responder.Revoked} {
+		res := out.Items[i]
+		if res.Error != "" {
+			t.Errorf("item %d: %s", i, res.Error)
+			continue
+		}
+		resp, err := responder.ParseResponse(res.Response)
+		if err != nil {
+			t.Fatalf("item %d: %v", i, err)
+		}
+		if err := resp.CheckSignatureFrom(st.signer.Cert); err != nil {
+			t.Errorf("item %d: %v", i, err)
+		}
+		if got := resp.Responses[0]; got.Status != want || fmt.Sprintf("%x", got.SerialNumber) != res.Serial {
+			t.Errorf("item %d: signed %x %v, want %s %v", i, got.SerialNumber, got.Status, res.Serial, want)
+		}
+	}
+	// The served CRL, not the caller, has the last word on status.
+	if res := out.Items[2]; res.Error == "" || res.Response != nil {
+		t.Errorf("a revoked serial was signed good: %+v", res)
+	}
+
+	for name, tc := range map[string]struct {
+		token, body string
+		code        int
+	}{
+		"no token":     {"", `{"items": [{"issuer": "Bench CA-1", "serial": "1", "status": "good"}]}`, http.StatusUnauthorized},
+		"wrong token":  {"s3cre", `{"items": [{"issuer": "Bench CA-1", "serial": "1", "status": "good"}]}`, http.StatusUnauthorized},
+		"no items":     {"s3cret", `{"items": []}`, http.StatusBadRequest},
+		"not JSON":     {"s3cret", `items`, http.StatusBadRequest},
+		"too many":     {"s3cret", `{"items": [{}, {}, {}, {}]}`, http.StatusRequestEntityTooLarge},
+		"body too big": {"s3cret", `{"items": [{"serial": "` + strings.Repeat("1", 3*maxBatchItemSize) + `"}]}`, http.StatusRequestEntityTooLarge},
+	} {
+		if w := sign(tc.token, tc.body); w.Code != tc.code {
+			t.Errorf("%s: answered %d, want %d", name, w.Code, tc.code)
+		}
+	}
+}
@@ -0,0 +1,475 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkkemp/GoOCSPResponder/responder"
+)
+
+// BlocklistConfig enables the emergency blocklist: serials answered revoked
+// before any CRL lists them, for when a CA compromise cannot wait for the
+// next CRL. The list is a JWS (see sign-blocklist) signed by a certificate
+// that chains to the trust store. An entry expires once a loaded CRL of
+// its issuer lists the serial. It is read at startup only.
+type BlocklistConfig struct {
+	// File holds the current signed list; it is loaded at startup and
+	// replaced through POST /admin/v1/blocklist/install.
+	File string `yaml:"file"`
+	// TrustStore is a PEM file of the certificates blocklist signers must
+	// chain to.
+	TrustStore string `yaml:"trust_store"`
+}
+
+func (c BlocklistConfig) enabled() bool {
+	return c.File != ""
+}
+
+func (c BlocklistConfig) validate() error {
+	if (c.File == "") != (c.TrustStore == "") {
+		return errors.New("blocklist.file and blocklist.trust_store must be set together")
+	}
+	return nil
+}
+
+// blocklistType is the JWS typ of a signed blocklist.
+const blocklistType = "goocsp-blocklist+jwt"
+
+// blocklistDoc is the signed payload of a blocklist.
+type blocklistDoc struct {
+	// IssuedAt orders lists; an older list than the installed one is
+	// refused, so a captured list cannot be replayed to undo a newer one.
+	IssuedAt int64            `json:"iat"`
+	Entries  []blocklistEntry `json:"entries"`
+}
+
+type blocklistEntry struct {
+	// Issuer is the SHA-256 fingerprint of the CA certificate, in hex.
+	Issuer string `json:"issuer"`
+	// Serial is decimal, 0x-prefixed hex or colon-separated hex.
+	Serial    string    `json:"serial"`
+	RevokedAt time.Time `json:"revoked_at"`
+	Reason    int       `json:"reason"`
+	// CoveredBy names the CRL that made the entry redundant; it is set in
+	// reports only.
+	CoveredBy string `json:"covered_by,omitempty"`
+}
+
+// blocklist is an installed list. It is never modified; expiring entries
+// installs a copy.
+type blocklist struct {
+	issuedAt time.Time
+	signer   string
+	// active maps issuer fingerprints to serial bytes to entries.
+	active  map[[sha256.Size]byte]map[string]blocklistEntry
+	expired []blocklistEntry
+}
+
+var (
+	// blocklistMu serializes changes to the installed blocklist; readers
+	// load it without locking.
+	blocklistMu     sync.Mutex
+	activeBlocklist atomic.Value // *blocklist
+)
+
+func currentBlocklist() *blocklist {
+	bl, _ := activeBlocklist.Load().(*blocklist)
+	return bl
+}
+
+func init() {
+	policyHooks = append(policyHooks, policyHook{name: "blocklist", apply: applyBlocklist})
+}
+
+// applyBlocklist answers a blocklisted serial revoked. Serials the CRL
+// already revokes keep the CRL's data.
+func applyBlocklist(f CRLBloomFilter, single *responder.SingleResponse) bool {
+	bl := currentBlocklist()
+	if bl == nil || len(bl.active) == 0 || single.Status == responder.Revoked {
+		return false
+	}
+	e, ok := bl.active[getSha256Fingerprint(f.crlInfo.CA)][string(single.CertID.SerialNumber.Bytes())]
+	if !ok {
+		return false
+	}
+	single.Status = responder.Revoked
+	single.RevokedAt = e.RevokedAt
+	single.RevocationReason = e.Reason
+	single.Extensions = nil
+	return true
+}
+
+// blocklistSkew is how far in the future a blocklist's iat may be.
+const blocklistSkew = 5 * time.Minute
+
+// parseBlocklist verifies a signed blocklist against roots at now and
+// checks its entries. The signer must be valid at now, not at the iat it
+// chose, so a key past its validity cannot sign a backdated list; and the
+// iat may not be in the future, where it would outrank every later list.
+func parseBlocklist(token string, roots *x509.CertPool, now time.Time) (*blocklist, error) {
+	payload, chain, err := parseJWS(strings.TrimSpace(token), blocklistType)
+	if err != nil {
+		return nil, err
+	}
+	var doc blocklistDoc
+	if err := json.Unmarshal(payload, &doc); err != nil {
+		return nil, err
+	}
+	if iat := time.Unix(doc.IssuedAt, 0); iat.After(now.Add(blocklistSkew)) {
+		return nil, fmt.Errorf("blocklist is issued in the future, at %s", iat.UTC().Format(time.RFC3339))
+	}
+	opts := x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: x509.NewCertPool(),
+		CurrentTime:   now,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}
+	for _, c := range chain[1:] {
+		opts.Intermediates.AddCert(c)
+	}
+	if _, err := chain[0].Verify(opts); err != nil {
+		return nil, fmt.Errorf("blocklist signer %s: %v", chain[0].Subject, err)
+	}
+	bl := &blocklist{
+		issuedAt: time.Unix(doc.IssuedAt, 0).UTC(),
+		signer:   subjectDN(chain[0]),
+		active:   make(map[[sha256.Size]byte]map[string]blocklistEntry),
+	}
+	for i, e := range doc.Entries {
+		raw, err := hex.DecodeString(strings.ToLower(strings.Replace(e.Issuer, ":", "", -1)))
+		if err != nil || len(raw) != sha256.Size {
+			return nil, fmt.Errorf("entry %d: issuer must be the CA's SHA-256 fingerprint", i)
+		}
+		serial, ok := parseSerial(e.Serial)
+		if !ok {
+			return nil, fmt.Errorf("entry %d: bad serial %q", i, e.Serial)
+		}
+		if e.RevokedAt.IsZero() {
+			e.RevokedAt = bl.issuedAt
+		}
+		if e.Reason < 0 || e.Reason > 10 || e.Reason == 7 {
+			return nil, fmt.Errorf("entry %d: bad reason %d", i, e.Reason)
+		}
+		e.Issuer = hex.EncodeToString(raw)
+		e.Serial = fmt.Sprintf("0x%x", serial)
+		var fp [sha256.Size]byte
+		copy(fp[:], raw)
+		if bl.active[fp] == nil {
+			bl.active[fp] = make(map[string]blocklistEntry)
+		}
+		bl.active[fp][string(serial.Bytes())] = e
+	}
+	return bl, nil
+}
+
+// unknownIssuers lists the issuers of bl that st does not serve.
+func (bl *blocklist) unknownIssuers(st *state) []string {
+	served := make(map[[sha256.Size]byte]bool, len(st.crls))
+	for _, crl := range st.crls {
+		served[getSha256Fingerprint(crl.CA)] = true
+	}
+	var unknown []string
+	for fp := range bl.active {
+		if !served[fp] {
+			unknown = append(unknown, hex.EncodeToString(fp[:]))
+		}
+	}
+	return unknown
+}
+
+// listedIssuers returns the keys of the issuers of st that any of lists
+// has entries under: the issuers whose answers installing a list changes.
+func listedIssuers(st *state, lists ...*blocklist) map[string]bool {
+	out := make(map[string]bool)
+	for _, crl := range st.crls {
+		fp := getSha256Fingerprint(crl.CA)
+		for _, bl := range lists {
+			if bl != nil && len(bl.active[fp]) > 0 {
+				out[crl.key()] = true
+			}
+		}
+	}
+	return out
+}
+
+// expireBlocklist drops the entries the CRLs of st list, logging each.
+// Callers hold stateMu, so the CRLs do not change underneath.
+func expireBlocklist(st *state) {
+	blocklistMu.Lock()
+	defer blocklistMu.Unlock()
+	bl := currentBlocklist()
+	if bl == nil || len(bl.active) == 0 {
+		return
+	}
+	next := &blocklist{issuedAt: bl.issuedAt, signer: bl.signer, active: bl.active, expired: bl.expired}
+	copied := false
+	for _, crl := range st.crls {
+		fp := getSha256Fingerprint(crl.CA)
+		entries := bl.active[fp]
+		if len(entries) == 0 {
+			continue
+		}
+		f := st.filters[crl.key()]
+		for k, e := range entries {
+			if !f.lookup(new(big.Int).SetBytes([]byte(k))).revoked {
+				continue
+			}
+			if !copied {
+				next.active = make(map[[sha256.Size]byte]map[string]blocklistEntry, len(bl.active))
+				for fp, entries := range bl.active {
+					m := make(map[string]blocklistEntry, len(entries))
+					for k, e := range entries {
+						m[k] = e
+					}
+					next.active[fp] = m
+				}
+				copied = true
+			}
+			delete(next.active[fp], k)
+			if len(next.active[fp]) == 0 {
+				delete(next.active, fp)
+			}
+			e.CoveredBy = crl.key()
+			if f.crlNumber != nil {
+				e.CoveredBy += " #" + f.crlNumber.String()
+			}
+			next.expired = append(next.expired, e)
+			log.Printf("blocklist: %s serial %s expired, listed by CRL %s", crl.key(), e.Serial, e.CoveredBy)
+		}
+	}
+	if copied {
+		activeBlocklist.Store(next)
+	}
+}
+
+// restoreBlocklist reinstalls was in place of is, the list expiring its
+// entries left, unless another list was installed since.
+func restoreBlocklist(is, was *blocklist) {
+	blocklistMu.Lock()
+	defer blocklistMu.Unlock()
+	if is != was && currentBlocklist() == is {
+		activeBlocklist.Store(was)
+	}
+}
+
+// loadBlocklist installs the list in cfg.Blocklist.File at startup. A
+// missing file is an empty list; an invalid one is fatal, rather than
+// silently answering blocklisted serials good.
+func loadBlocklist(cfg *Config) error {
+	if !cfg.Blocklist.enabled() {
+		return nil
+	}
+	data, err := os.ReadFile(cfg.Blocklist.File)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	roots, err := readCertPool(cfg.Blocklist.TrustStore)
+	if err != nil {
+		return err
+	}
+	bl, err := parseBlocklist(string(data), roots, time.Now())
+	if err != nil {
+		return fmt.Errorf("blocklist %s: %v", cfg.Blocklist.File, err)
+	}
+	activeBlocklist.Store(bl)
+	log.Printf("blocklist: %d issuers, signed by %s at %s", len(bl.active), bl.signer, bl.issuedAt.Format(time.RFC3339))
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	old := currentState()
+	next := *old
+	updateCascades(old, &next)
+	current.Store(&next)
+	expireBlocklist(&next)
+	return nil
+}
+
+func readCertPool(path string) (*x509.CertPool, error) {
+	certs, err := readCertificates(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	for _, c := range certs {
+		pool.AddCert(c)
+	}
+	return pool, nil
+}
+
+// maxBlocklistSize bounds an uploaded blocklist.
+const maxBlocklistSize = 4 << 20
+
+// blocklistInstallHandler serves POST /admin/v1/blocklist/install, whose
+// body is a signed blocklist replacing the installed one. The list takes
+// effect at once: the cached responses of the issuers it or the list it
+// replaces names are dropped.
+func blocklistInstallHandler(w http.ResponseWriter, r *http.Request) {
+	if !requirePost(w, r) {
+		return
+	}
+	data, err := io.ReadAll(io.LimitReader(r.Body, maxBlocklistSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	st := currentState()
+	roots, err := readCertPool(st.cfg.Blocklist.TrustStore)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	bl, err := parseBlocklist(string(data), roots, time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if unknown := bl.unknownIssuers(st); len(unknown) > 0 {
+		http.Error(w, "not served: "+strings.Join(unknown, ", "), http.StatusBadRequest)
+		return
+	}
+
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	blocklistMu.Lock()
+	replaced := currentBlocklist()
+	if replaced != nil && bl.issuedAt.Before(replaced.issuedAt) {
+		blocklistMu.Unlock()
+		http.Error(w, fmt.Sprintf("older than the installed list of %s", replaced.issuedAt.Format(time.RFC3339)), http.StatusConflict)
+		return
+	}
+	if err := writeFileAtomic(st.cfg.Blocklist.File, data, 0600); err != nil {
+		blocklistMu.Unlock()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	activeBlocklist.Store(bl)
+	blocklistMu.Unlock()
+
+	old := currentState()
+	next := *old
+	listed := listedIssuers(old, replaced, bl)
+	next.cache = old.cache.except(func(_ string, e *cachedResponse) bool { return listed[e.issuer] })
+	updateCascades(old, &next)
+	current.Store(&next)
+	expireBlocklist(&next)
+	alert(old.cfg, "blocklist installed: signed by %s at %s", bl.signer, bl.issuedAt.Format(time.RFC3339))
+	adminResult(w, r, "blocklist installed", currentBlocklist().report())
+}
+
+// writeFileAtomic replaces path with data, with the permissions perm, so
+// a crash leaves either the old or the new file.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// blocklistReport is the JSON form of the installed list.
+type blocklistReport struct {
+	IssuedAt *time.Time       `json:"issued_at,omitempty"`
+	Signer   string           `json:"signer,omitempty"`
+	Active   []blocklistEntry `json:"active"`
+	Expired  []blocklistEntry `json:"expired"`
+}
+
+func (bl *blocklist) report() blocklistReport {
+	r := blocklistReport{Active: []blocklistEntry{}, Expired: []blocklistEntry{}}
+	if bl == nil {
+		return r
+	}
+	r.IssuedAt, r.Signer = &bl.issuedAt, bl.signer
+	for _, entries := range bl.active {
+		for _, e := range entries {
+			r.Active = append(r.Active, e)
+		}
+	}
+	r.Expired = append(r.Expired, bl.expired...)
+	return r
+}
+
+// blocklistHandler serves /admin/v1/blocklist, the installed list with
+// its active and expired entries.
+func blocklistHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(currentBlocklist().report())
+}
+
+// signBlocklistCommand signs a blocklist for blocklist.file or the install
+// endpoint. The input is the JSON payload; iat defaults to now.
+func signBlocklistCommand(args []string) int {
+	fs := flag.NewFlagSet("sign-blocklist", flag.ContinueOnError)
+	in := fs.String("entries", "", `JSON {"entries": [{"issuer": sha256, "serial": ..., "revoked_at": ..., "reason": ...}]}`)
+	certPath := fs.String("cert", "", "PEM certificate of the signing key, chaining to blocklist.trust_store")
+	keyPath := fs.String("key", "", "PEM signing key")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *in == "" || *certPath == "" || *keyPath == "" {
+		fmt.Fprintln(os.Stderr, "sign-blocklist: --entries, --cert and --key are required")
+		fs.Usage()
+		return 2
+	}
+	data, err := os.ReadFile(*in)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "sign-blocklist:", err)
+		return 2
+	}
+	var doc blocklistDoc
+	if err := json.Unmarshal(data, &doc); err != nil {
+		fmt.Fprintln(os.Stderr, "sign-blocklist:", err)
+		return 2
+	}
+	if doc.IssuedAt == 0 {
+		doc.IssuedAt = time.Now().Unix()
+	}
+	signer, err := responder.LoadSigner(*certPath, *keyPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "sign-blocklist:", err)
+		return 2
+	}
+	payload, _ := json.Marshal(doc)
+	jws, err := signJWS(signer, blocklistType, payload)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "sign-blocklist:", err)
+		return 1
+	}
+	fmt.Println(jws)
+	return 0
+}
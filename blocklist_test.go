@@ -0,0 +1,182 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkkemp/GoOCSPResponder/responder"
+)
+
+// addTestIssuer serves one more issuer in the current state, cached as cn,
+// whose CRL revokes the serials revoked.
+func addTestIssuer(t *testing.T, cn string, revoked ...int64) CRLInfo {
+	t.Helper()
+	now := time.Now()
+	ca, _ := jwsSigner(t, now.Add(-time.Hour), now.Add(time.Hour))
+	crl := CRLInfo{CA: ca.Cert, FileName: strings.Replace(strings.ToUpper(cn), " ", "", -1) + ".crl"}
+	var entries []responder.Entry
+	for _, s := range revoked {
+		entries = append(entries, responder.Entry{Serial: big.NewInt(s), RevokedAt: now.Add(-time.Minute)})
+	}
+	st := *currentState()
+	st.crls = append(append([]CRLInfo(nil), st.crls...), crl)
+	st.filters = make(map[string]CRLBloomFilter, len(st.filters)+1)
+	for k, f := range currentState().filters {
+		st.filters[k] = f
+	}
+	st.filters[crl.key()] = CRLBloomFilter{
+		crlInfo:    crl,
+		entries:    newArenaIndex(entries),
+		thisUpdate: now,
+		nextUpdate: now.Add(time.Hour),
+	}
+	st.issuers = buildIssuerIndex(st.crls)
+	current.Store(&st)
+	return crl
+}
+
+// blocklistFingerprint is how a blocklist entry names the CA of crl.
+func blocklistFingerprint(crl CRLInfo) string {
+	fp := getSha256Fingerprint(crl.CA)
+	return hex.EncodeToString(fp[:])
+}
+
+func signTestBlocklist(t *testing.T, s *responder.Signer, iat time.Time, entries ...blocklistEntry) string {
+	t.Helper()
+	payload, _ := json.Marshal(blocklistDoc{IssuedAt: iat.Unix(), Entries: entries})
+	token, err := signJWS(s, blocklistType, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestParseBlocklistRefuses(t *testing.T) {
+	now := time.Now()
+	signer, roots := jwsSigner(t, now.Add(-time.Hour), now.Add(time.Hour))
+	expired, expiredRoots := jwsSigner(t, now.Add(-48*time.Hour), now.Add(-24*time.Hour))
+	untrusted, _ := jwsSigner(t, now.Add(-time.Hour), now.Add(time.Hour))
+	issuer := strings.Repeat("ab", 32)
+	entry := func(serial string) blocklistEntry {
+		return blocklistEntry{Issuer: issuer, Serial: serial, Reason: 1}
+	}
+
+	if bl, err := parseBlocklist(signTestBlocklist(t, signer, now, entry("0x1b")), roots, now); err != nil || len(bl.active) != 1 {
+		t.Fatalf("parseBlocklist = %+v, %v", bl, err)
+	}
+	payload, _ := json.Marshal(blocklistDoc{IssuedAt: now.Unix(), Entries: []blocklistEntry{entry("0x1b")}})
+	attestation, err := signJWS(signer, attestationType, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid := signTestBlocklist(t, signer, now, entry("0x1b"))
+	parts := strings.Split(valid, ".")
+	tampered, _ := json.Marshal(blocklistDoc{IssuedAt: now.Unix(), Entries: []blocklistEntry{entry("0x1c")}})
+
+	tests := []struct {
+		name  string
+		token string
+		roots *x509.CertPool
+	}{
+		{"zero serial", signTestBlocklist(t, signer, now, entry("0")), roots},
+		{"negative serial", signTestBlocklist(t, signer, now, entry("-5")), roots},
+		{"zero hex serial", signTestBlocklist(t, signer, now, entry("0x00")), roots},
+		{"bad serial", signTestBlocklist(t, signer, now, entry("zz")), roots},
+		{"issuer is no fingerprint", signTestBlocklist(t, signer, now, blocklistEntry{Issuer: "Bench CA-1", Serial: "5"}), roots},
+		{"bad reason", signTestBlocklist(t, signer, now, blocklistEntry{Issuer: issuer, Serial: "5", Reason: 7}), roots},
+		{"bad signature", parts[0] + "." + base64.RawURLEncoding.EncodeToString(tampered) + "." + parts[2], roots},
+		{"untrusted signer", signTestBlocklist(t, untrusted, now, entry("5")), roots},
+		{"expired signer", signTestBlocklist(t, expired, now.Add(-36*time.Hour), entry("5")), expiredRoots},
+		{"issued in the future", signTestBlocklist(t, signer, now.Add(time.Hour), entry("5")), roots},
+		{"attestation", attestation, roots},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := parseBlocklist(tt.token, tt.roots, now); err == nil {
+				t.Error("parseBlocklist accepted the list")
+			}
+		})
+	}
+}
+
+func TestBlocklistInstall(t *testing.T) {
+	benchState(t, defaultConfig().Cache)
+	bench := currentState().crls[0]
+	other := addTestIssuer(t, "Other CA-2", 7)
+	defer activeBlocklist.Store((*blocklist)(nil))
+
+	now := time.Now()
+	signer, _ := jwsSigner(t, now.Add(-time.Hour), now.Add(time.Hour))
+	dir := t.TempDir()
+	trust := filepath.Join(dir, "signers.pem")
+	if err := os.WriteFile(trust, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: signer.Cert.Raw}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	st := currentState()
+	st.cfg.Blocklist = BlocklistConfig{File: filepath.Join(dir, "blocklist.jws"), TrustStore: trust}
+
+	// One cached answer per issuer.
+	for i, crl := range []CRLInfo{bench, other} {
+		st.cache.put([]byte{byte(i)}, &cachedResponse{der: []byte{byte(i)}, expires: now.Add(time.Hour), issuer: crl.key()}, now)
+	}
+	cached := func() map[string]bool {
+		out := make(map[string]bool)
+		for _, e := range currentState().cache.live(time.Now()) {
+			out[e.issuer] = true
+		}
+		return out
+	}
+	install := func(token string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		blocklistInstallHandler(w, httptest.NewRequest(http.MethodPost, "/admin/v1/blocklist/install", strings.NewReader(token)))
+		return w
+	}
+
+	unknown := signTestBlocklist(t, signer, now, blocklistEntry{Issuer: strings.Repeat("ab", 32), Serial: "5"})
+	if w := install(unknown); w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "not served") {
+		t.Errorf("a list naming an issuer not served answered %d: %s", w.Code, w.Body)
+	}
+	if currentBlocklist() != nil {
+		t.Fatal("a refused list was installed")
+	}
+
+	// Serial 7 is on the CRL of other already, so its entry expires at once.
+	token := signTestBlocklist(t, signer, now,
+		blocklistEntry{Issuer: blocklistFingerprint(other), Serial: "5", Reason: 1},
+		blocklistEntry{Issuer: blocklistFingerprint(other), Serial: "7", Reason: 1})
+	if w := install(token); w.Code != http.StatusOK {
+		t.Fatalf("install answered %d: %s", w.Code, w.Body)
+	}
+	if got := cached(); got[other.key()] || !got[bench.key()] {
+		t.Errorf("cached issuers after the install: %v, want only %s", got, bench.key())
+	}
+	report := currentBlocklist().report()
+	if len(report.Active) != 1 || report.Active[0].Serial != "0x5" {
+		t.Errorf("active entries %+v", report.Active)
+	}
+	if len(report.Expired) != 1 || report.Expired[0].Serial != "0x7" || report.Expired[0].CoveredBy != other.key() {
+		t.Errorf("expired entries %+v", report.Expired)
+	}
+	single := responder.SingleResponse{CertID: responder.CertID{SerialNumber: big.NewInt(5)}}
+	if !applyBlocklist(currentState().filters[other.key()], &single) || single.Status != responder.Revoked {
+		t.Error("the blocklisted serial is not answered revoked")
+	}
+
+	if w := install(signTestBlocklist(t, signer, now.Add(-time.Minute))); w.Code != http.StatusConflict {
+		t.Errorf("an older list answered %d: %s", w.Code, w.Body)
+	}
+	if _, err := os.Stat(st.cfg.Blocklist.File); err != nil {
+		t.Errorf("the installed list was not written: %v", err)
+	}
+}
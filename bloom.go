@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+
+	"github.com/willf/bloom"
+)
+
+// BloomConfig bounds the bloom filters of in-memory indexes. A false
+// positive costs an exact lookup, not a wrong answer, but a filter that
+// hits on most serials no longer saves anything; with a ceiling set each
+// filter is sized for its CRL, and an issuer whose filter would not fit in
+// the memory budget is answered from the exact entries alone.
+type BloomConfig struct {
+	BloomLimits `yaml:",inline"`
+	// Issuers overrides the limits per issuer, by CRL name (DODEMAILCA_63).
+	Issuers map[string]BloomLimits `yaml:"issuers"`
+}
+
+// BloomLimits are the limits of one issuer's filter.
+type BloomLimits struct {
+	// MaxFalsePositiveRate is the highest acceptable false positive rate;
+	// 0 keeps the fixed default filter.
+	MaxFalsePositiveRate float64 `yaml:"max_false_positive_rate"`
+	// MaxBytes is the memory budget of one filter.
+	MaxBytes int64 `yaml:"max_bytes"`
+}
+
+func (c BloomConfig) validate() error {
+	if err := c.BloomLimits.validate(); err != nil {
+		return err
+	}
+	for name, l := range c.Issuers {
+		if err := l.validate(); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+func (l BloomLimits) validate() error {
+	if l.MaxFalsePositiveRate < 0 || l.MaxFalsePositiveRate >= 1 {
+		return errors.New("index.bloom.max_false_positive_rate must be in [0, 1)")
+	}
+	if l.MaxBytes < 0 {
+		return errors.New("index.bloom.max_bytes must not be negative")
+	}
+	return nil
+}
+
+// limits returns the limits for the CRL named key. An override inherits
+// whatever it leaves unset from the defaults.
+func (c BloomConfig) limits(key string) BloomLimits {
+	l, ok := c.Issuers[key]
+	if !ok {
+		return c.BloomLimits
+	}
+	if l.MaxFalsePositiveRate == 0 {
+		l.MaxFalsePositiveRate = c.MaxFalsePositiveRate
+	}
+	if l.MaxBytes == 0 {
+		l.MaxBytes = c.MaxBytes
+	}
+	return l
+}
+
+// bloomFalsePositiveRate estimates the false positive rate of a filter of
+// m bits and k hash functions holding n entries.
+func bloomFalsePositiveRate(m, k, n uint) float64 {
+	return math.Pow(1-math.Exp(-float64(k)*float64(n)/float64(m)), float64(k))
+}
+
+// newBloom returns a filter for the n entries of the CRL named key, or nil
+// if none meeting the limits fits in the budget, in which case every lookup
+// goes to the exact entries.
+func newBloom(cfg *Config, key string, n int) *bloom.BloomFilter {
+	l := cfg.Index.Bloom.limits(key)
+	if l.MaxFalsePositiveRate == 0 {
+		return createBloom(1000000)
+	}
+	if n < 1 {
+		n = 1
+	}
+	m, k := bloom.EstimateParameters(uint(n), l.MaxFalsePositiveRate)
+	if need := int64(m+7) / 8; l.MaxBytes > 0 && need > l.MaxBytes {
+		log.Printf("bloom filter disabled for %s: %d entries need %d bytes for a false positive rate of %g, over the budget of %d; using exact lookups only",
+			key, n, need, l.MaxFalsePositiveRate, l.MaxBytes)
+		return nil
+	}
+	return bloom.New(m, k)
+}
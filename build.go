@@ -0,0 +1,267 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// BuildConfig tunes index construction, which competes with serving for
+// CPU and memory on shared hosts. Operators can change it at runtime
+// through POST /admin/v1/builds/tune, trading rebuild speed against
+// serving latency during refreshes.
+type BuildConfig struct {
+	// Workers is how many indexes are built at once, by startup, reloads,
+	// refreshes and uploads together.
+	Workers int `yaml:"workers"`
+	// ChunkSize is how many entries are indexed between two progress
+	// updates, and two pauses.
+	ChunkSize int `yaml:"chunk_size"`
+	// Pause is slept after every chunk, leaving the CPU to serving.
+	Pause time.Duration `yaml:"pause"`
+}
+
+func (c BuildConfig) validate() error {
+	if c.Workers < 1 || c.ChunkSize < 1 || c.Pause < 0 {
+		return errors.New("index.build: workers and chunk_size must be positive and pause not negative")
+	}
+	return nil
+}
+
+// buildProgress is one index build, running or finished.
+type buildProgress struct {
+	Issuer string `json:"issuer"`
+	// Phase is hashing, parsing, indexing, encoding or sorting; indexing
+	// and encoding have a total.
+	Phase   string    `json:"phase"`
+	Done    int       `json:"done"`
+	Total   int       `json:"total"`
+	Percent float64   `json:"percent"`
+	Started time.Time `json:"started"`
+	// ETA is when the current phase should end, from its pace so far.
+	ETA *time.Time `json:"eta,omitempty"`
+	// Duration and Error are set once the build finished.
+	Duration string `json:"duration,omitempty"`
+	Error    string `json:"error,omitempty"`
+
+	phaseStart time.Time
+	// chunk is the chunk size in effect, read by the building goroutine
+	// alone.
+	chunk int
+}
+
+// maxRecentBuilds bounds the finished builds reported.
+const maxRecentBuilds = 32
+
+// buildPool admits index builds up to its worker count and tracks their
+// progress. The worker count can change while builds wait, so it is a
+// condition variable rather than a channel.
+type buildPool struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	cfg  BuildConfig
+	// tuned is set once an operator tuned the pool; configuration reloads
+	// leave it alone from then on.
+	tuned   bool
+	running int
+	waiting int
+	active  []*buildProgress
+	recent  []*buildProgress
+}
+
+var builds = newBuildPool()
+
+func newBuildPool() *buildPool {
+	p := &buildPool{cfg: defaultConfig().Index.Build}
+	p.cond = sync.NewCond(&p.mu)
+	return p
+}
+
+// configure applies the build settings of a configuration, unless an
+// operator tuned the pool.
+func (p *buildPool) configure(c BuildConfig) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.tuned {
+		p.cfg = c
+		p.cond.Broadcast()
+	}
+}
+
+// tune applies settings given by an operator.
+func (p *buildPool) tune(c BuildConfig) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.cfg, p.tuned = c, true
+	p.cond.Broadcast()
+}
+
+// start waits for a worker and returns the progress of the build of the
+// issuer key.
+func (p *buildPool) start(key string) *buildProgress {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.waiting++
+	for p.running >= p.cfg.Workers {
+		p.cond.Wait()
+	}
+	p.waiting--
+	p.running++
+	now := time.Now()
+	b := &buildProgress{Issuer: key, Phase: "hashing", Started: now, phaseStart: now, chunk: p.cfg.ChunkSize}
+	p.active = append(p.active, b)
+	return b
+}
+
+// finish releases the worker of b and records its outcome.
+func (p *buildPool) finish(b *buildProgress, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.running--
+	p.cond.Signal()
+	for i, a := range p.active {
+		if a == b {
+			p.active = append(p.active[:i], p.active[i+1:]...)
+			break
+		}
+	}
+	b.Duration = time.Since(b.Started).Round(time.Millisecond).String()
+	b.ETA = nil
+	if err != nil {
+		b.Error = err.Error()
+	}
+	if len(p.recent) == maxRecentBuilds {
+		p.recent = p.recent[1:]
+	}
+	p.recent = append(p.recent, b)
+}
+
+// phase starts the next phase of b, with total entries to go through or
+// 0 if it cannot be measured. b may be nil for builds that are not
+// tracked.
+func (b *buildProgress) phase(name string, total int) {
+	if b == nil {
+		return
+	}
+	builds.mu.Lock()
+	b.Phase, b.Done, b.Total, b.Percent, b.ETA = name, 0, total, 0, nil
+	b.phaseStart = time.Now()
+	builds.mu.Unlock()
+}
+
+// step records that entry i of the phase is done. At the end of each
+// chunk it publishes the progress, picks up retuning and pauses.
+func (b *buildProgress) step(i int) {
+	if b == nil || (i+1)%b.chunk != 0 {
+		return
+	}
+	builds.mu.Lock()
+	b.Done = i + 1
+	if b.Total > 0 {
+		b.Percent = float64(b.Done*1000/b.Total) / 10
+		elapsed := time.Since(b.phaseStart)
+		eta := time.Now().Add(time.Duration(float64(elapsed) / float64(b.Done) * float64(b.Total-b.Done)))
+		b.ETA = &eta
+	}
+	b.chunk = builds.cfg.ChunkSize
+	pause := builds.cfg.Pause
+	builds.mu.Unlock()
+	if pause > 0 {
+		time.Sleep(pause)
+	}
+}
+
+// buildStatus is what GET /admin/v1/builds reports.
+type buildStatus struct {
+	Workers   int             `json:"workers"`
+	ChunkSize int             `json:"chunk_size"`
+	Pause     string          `json:"pause"`
+	Tuned     bool            `json:"tuned"`
+	Waiting   int             `json:"waiting"`
+	Active    []buildProgress `json:"active"`
+	Recent    []buildProgress `json:"recent"`
+}
+
+func (p *buildPool) status() buildStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s := buildStatus{
+		Workers:   p.cfg.Workers,
+		ChunkSize: p.cfg.ChunkSize,
+		Pause:     p.cfg.Pause.String(),
+		Tuned:     p.tuned,
+		Waiting:   p.waiting,
+		Active:    make([]buildProgress, 0, len(p.active)),
+		Recent:    make([]buildProgress, 0, len(p.recent)),
+	}
+	for _, b := range p.active {
+		s.Active = append(s.Active, *b)
+	}
+	sort.Slice(s.Active, func(i, j int) bool { return s.Active[i].Started.Before(s.Active[j].Started) })
+	for i := len(p.recent) - 1; i >= 0; i-- {
+		s.Recent = append(s.Recent, *p.recent[i])
+	}
+	return s
+}
+
+// buildsHandler serves GET /admin/v1/builds.
+func buildsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(builds.status())
+}
+
+// buildTuneHandler serves POST /admin/v1/builds/tune, which changes the
+// worker count, chunk size or pause of index builds until the next
+// restart, running builds included. reset=true returns to the
+// configuration.
+func buildTuneHandler(w http.ResponseWriter, r *http.Request) {
+	if !requirePost(w, r) {
+		return
+	}
+	if r.FormValue("reset") == "true" {
+		builds.mu.Lock()
+		builds.tuned = false
+		builds.mu.Unlock()
+		builds.configure(currentState().cfg.Index.Build)
+		log.Printf("index builds: tuning reset to the configuration")
+		adminResult(w, r, "index builds follow the configuration again", builds.status())
+		return
+	}
+	builds.mu.Lock()
+	c := builds.cfg
+	builds.mu.Unlock()
+	for name, dst := range map[string]*int{"workers": &c.Workers, "chunk_size": &c.ChunkSize} {
+		if v := r.FormValue(name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("%s %q is not a number", name, v), http.StatusBadRequest)
+				return
+			}
+			*dst = n
+		}
+	}
+	if v := r.FormValue("pause"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("pause %q is not a duration", v), http.StatusBadRequest)
+			return
+		}
+		c.Pause = d
+	}
+	if err := c.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	builds.tune(c)
+	msg := fmt.Sprintf("index builds tuned to %d workers, chunks of %d, pause %v", c.Workers, c.ChunkSize, c.Pause)
+	log.Printf("%s", msg)
+	adminResult(w, r, msg, builds.status())
+}
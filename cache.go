@@ -0,0 +1,240 @@
+package main
+
+import (
+	"math/big"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// cachedResponse is a signed response ready to be served as is.
+type cachedResponse struct {
+	// hits and lastUsed are updated atomically on the fast path, for the
+	// cache policy; they come first to be 64-bit aligned.
+	hits     int64
+	lastUsed int64 // UnixNano
+
+	der     []byte
+	expires time.Time
+	// issuer is the key of the CRL the response was derived from, so a
+	// refresh of that CRL can drop it.
+	issuer string
+	// crlNumber is the cRLNumber of that CRL, nil if it has none, so
+	// responses derived from a bad CRL can be dropped.
+	crlNumber *big.Int
+	// next is the same response signed with signer.next, during a key
+	// migration.
+	next []byte
+}
+
+// response returns the response signed with the key being served.
+func (e *cachedResponse) response(next bool) []byte {
+	if next && e.next != nil {
+		return e.next
+	}
+	return e.der
+}
+
+// responseCache maps raw request bytes to pre-signed responses. Lookups go
+// to an immutable read map behind an atomic.Value and take no lock;
+// inserts go to a dirty map under mu, which is merged into a fresh read map
+// from time to time. This is the sync.Map scheme, but with string keys so
+// that looking up a []byte request does not allocate.
+type responseCache struct {
+	read atomic.Value // map[string]*cachedResponse
+
+	mu       sync.Mutex
+	dirty    map[string]*cachedResponse
+	promoted time.Time
+	max      int
+	ttl      time.Duration
+
+	// policy makes room once the cache is full; see cachepolicy.go.
+	policy     cachePolicy
+	policyName string
+	stats      *cacheStats
+	// flights coalesces concurrent identical misses; see coalesce.go.
+	flights *flightGroup
+}
+
+func newResponseCache(cfg CacheConfig) *responseCache {
+	name := cfg.Policy
+	if name == "" {
+		name = "none"
+	}
+	c := &responseCache{
+		dirty:      make(map[string]*cachedResponse),
+		max:        cfg.MaxEntries,
+		ttl:        cfg.TTL,
+		policy:     newCachePolicy(cfg),
+		policyName: name,
+		stats:      policyStats(name),
+	}
+	c.flights = newFlightGroup(c.stats)
+	c.read.Store(map[string]*cachedResponse{})
+	return c
+}
+
+func (c *responseCache) load() map[string]*cachedResponse {
+	return c.read.Load().(map[string]*cachedResponse)
+}
+
+// usable reports whether e can answer a request restricted to issuer, ""
+// meaning any.
+func (e *cachedResponse) usable(issuer string, now time.Time) bool {
+	return e != nil && now.Before(e.expires) && (issuer == "" || e.issuer == issuer)
+}
+
+// get is the fast path: it returns the cached response to req, or nil. A
+// non-empty issuer only accepts responses derived from that issuer.
+func (c *responseCache) get(req []byte, issuer string, now time.Time) *cachedResponse {
+	if e := c.load()[string(req)]; e.usable(issuer, now) {
+		c.hit(e, now)
+		return e
+	}
+	return nil
+}
+
+func (c *responseCache) hit(e *cachedResponse, now time.Time) {
+	atomic.AddInt64(&c.stats.hits, 1)
+	c.policy.touch(e, now)
+}
+
+// getDirty returns a cached response that has not reached the read map
+// yet, promoting the dirty map if it has waited long enough.
+func (c *responseCache) getDirty(req []byte, issuer string, now time.Time) *cachedResponse {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e := c.dirty[string(req)]
+	if !e.usable(issuer, now) {
+		atomic.AddInt64(&c.stats.misses, 1)
+		return nil
+	}
+	c.hit(e, now)
+	if now.Sub(c.promoted) > time.Second {
+		c.promote(now)
+	}
+	return e
+}
+
+// peek returns the cached entry for req from either map without promoting.
+func (c *responseCache) peek(req []byte, now time.Time) *cachedResponse {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e := c.load()[string(req)]
+	if e == nil {
+		e = c.dirty[string(req)]
+	}
+	if e == nil || !now.Before(e.expires) {
+		return nil
+	}
+	return e
+}
+
+// put caches e as the response to req. Once the cache is full, the
+// policy makes room or e is not cached.
+func (c *responseCache) put(req []byte, e *cachedResponse, now time.Time) {
+	if c.max == 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.load())+len(c.dirty) >= c.max && !c.evict(now) {
+		atomic.AddInt64(&c.stats.rejected, 1)
+		return
+	}
+	atomic.StoreInt64(&e.lastUsed, now.UnixNano())
+	c.dirty[string(req)] = e
+	atomic.AddInt64(&c.stats.inserts, 1)
+	read := c.load()
+	// Promote once the dirty map is large next to the read map, so the
+	// copy is amortized over many inserts, or once it has waited a second,
+	// so a few hot responses reach the fast path quickly.
+	if len(c.dirty) > len(read)/8 || now.Sub(c.promoted) > time.Second {
+		c.promote(now)
+	}
+}
+
+// promote merges the dirty map into a new read map, dropping expired
+// entries. c.mu must be held.
+func (c *responseCache) promote(now time.Time) {
+	c.read.Store(c.liveLocked(now))
+	c.dirty = make(map[string]*cachedResponse)
+	c.promoted = now
+}
+
+// evict makes room for a fraction of max_entries: expired entries go
+// first, then the policy's victims. It reports false if there is still no
+// room. c.mu must be held.
+func (c *responseCache) evict(now time.Time) bool {
+	live := c.liveLocked(now)
+	want := c.max / cacheEvictFraction
+	if want < 1 {
+		want = 1
+	}
+	if n := len(live) - (c.max - want); n > 0 {
+		victims := c.policy.victims(live, n)
+		for _, k := range victims {
+			delete(live, k)
+		}
+		atomic.AddInt64(&c.stats.evictions, int64(len(victims)))
+	}
+	c.read.Store(live)
+	c.dirty = make(map[string]*cachedResponse)
+	c.promoted = now
+	return len(live) < c.max
+}
+
+// liveLocked returns the unexpired entries of both maps. c.mu must be
+// held.
+func (c *responseCache) liveLocked(now time.Time) map[string]*cachedResponse {
+	read := c.load()
+	live := make(map[string]*cachedResponse, len(read)+len(c.dirty))
+	for _, m := range []map[string]*cachedResponse{read, c.dirty} {
+		for k, e := range m {
+			if now.Before(e.expires) {
+				live[k] = e
+			}
+		}
+	}
+	return live
+}
+
+// without returns a cache holding every live entry of c except those
+// derived from issuer, for use after that issuer's CRL changed.
+func (c *responseCache) without(issuer string) *responseCache {
+	return c.except(func(_ string, e *cachedResponse) bool { return e.issuer == issuer })
+}
+
+// except returns a cache holding every live entry of c but those drop
+// reports true for, given the request they answer.
+func (c *responseCache) except(drop func(req string, e *cachedResponse) bool) *responseCache {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	next := &responseCache{dirty: make(map[string]*cachedResponse), max: c.max, ttl: c.ttl, promoted: now, policy: c.policy, policyName: c.policyName, stats: c.stats, flights: newFlightGroup(c.stats)}
+	kept := make(map[string]*cachedResponse)
+	for _, m := range []map[string]*cachedResponse{c.load(), c.dirty} {
+		for k, e := range m {
+			if now.Before(e.expires) && !drop(k, e) {
+				kept[k] = e
+			}
+		}
+	}
+	next.read.Store(kept)
+	return next
+}
+
+// live returns every unexpired cached response, by request.
+func (c *responseCache) live(now time.Time) map[string]*cachedResponse {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.liveLocked(now)
+}
+
+// size returns the number of cached responses.
+func (c *responseCache) size() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.load()) + len(c.dirty)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"math/big"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/pkkemp/GoOCSPResponder/responder"
+)
+
+// benchState installs a state with one issuer and a signer, and returns a
+// request builder for serials under that issuer.
+func benchState(tb testing.TB, cache CacheConfig) func(serial int64) []byte {
+	tb.Helper()
+	now := time.Now()
+	signer := testCA(tb, "Bench CA-1", now.Add(-time.Hour), now.Add(time.Hour))
+	ca := signer.Cert
+
+	cfg := defaultConfig()
+	cfg.Cache = cache
+	crl := CRLInfo{CA: ca, FileName: "BENCHCA_1.crl"}
+	st := &state{
+		cfg:  cfg,
+		crls: []CRLInfo{crl},
+		filters: map[string]CRLBloomFilter{crl.key(): {
+			crlInfo:    crl,
+			Filter:     createBloom(1000),
+			entries:    newArenaIndex(nil),
+			thisUpdate: now,
+			nextUpdate: now.Add(time.Hour),
+		}},
+		signer:  signer,
+		cache:   newResponseCache(cache),
+		slow:    make(chan struct{}, cache.SlowPathConcurrency),
+		issuers: buildIssuerIndex([]CRLInfo{crl}),
+	}
+	current.Store(st)
+
+	nameHash, keyHash, err := responder.IssuerHashes(ca, crypto.SHA1)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return func(serial int64) []byte {
+		req, err := responder.CreateRequest(responder.CertID{
+			HashAlgorithm: crypto.SHA1,
+			NameHash:      nameHash,
+			KeyHash:       keyHash,
+			SerialNumber:  big.NewInt(serial),
+		})
+		if err != nil {
+			tb.Fatal(err)
+		}
+		return req
+	}
+}
+
+// discardWriter is a ResponseWriter that keeps its header map across
+// requests, so the benchmark measures the handler and not the recorder.
+type discardWriter struct {
+	header http.Header
+	n      int
+}
+
+func (w *discardWriter) Header() http.Header         { return w.header }
+func (w *discardWriter) Write(p []byte) (int, error) { w.n += len(p); return len(p), nil }
+func (w *discardWriter) WriteHeader(int)             {}
+
+type body struct{ *bytes.Reader }
+
+func (body) Close() error { return nil }
+
+// newPost returns a POST of req and a function that rewinds its body.
+func newPost(req []byte) (*http.Request, func()) {
+	rd := bytes.NewReader(req)
+	r, _ := http.NewRequest(http.MethodPost, "/", nil)
+	r.Body = body{rd}
+	return r, func() { rd.Reset(req) }
+}
+
+var fastCache = CacheConfig{MaxEntries: 1000, TTL: time.Hour, SlowPathConcurrency: 4, SlowPathWait: time.Second}
+
+// BenchmarkFastPath serves a cached response. It fails if the fast path
+// allocates, since that is what keeps it cheap under load.
+func BenchmarkFastPath(b *testing.B) {
+	req := benchState(b, fastCache)(0x1001)
+	r, rewind := newPost(req)
+	w := &discardWriter{header: http.Header{}}
+	serve := func() {
+		rewind()
+		ocspHandler(w, r)
+	}
+	// The first request takes the slow path and fills the cache; wait out
+	// the promotion delay so the entry reaches the read map.
+	serve()
+	time.Sleep(1100 * time.Millisecond)
+	serve()
+	if currentState().cache.get(req, "", time.Now()) == nil {
+		b.Fatal("response was not cached")
+	}
+	if allocs := testing.AllocsPerRun(100, serve); allocs > 0 {
+		b.Fatalf("fast path allocates %v times per request, want 0", allocs)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		serve()
+	}
+}
+
+func BenchmarkFastPathParallel(b *testing.B) {
+	req := benchState(b, fastCache)(0x1001)
+	r, rewind := newPost(req)
+	ocspHandler(&discardWriter{header: http.Header{}}, r)
+	time.Sleep(1100 * time.Millisecond)
+	rewind()
+	ocspHandler(&discardWriter{header: http.Header{}}, r)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		r, rewind := newPost(req)
+		w := &discardWriter{header: http.Header{}}
+		for pb.Next() {
+			rewind()
+			ocspHandler(w, r)
+		}
+	})
+}
+
+// BenchmarkSlowPath signs every response, as for a cold cache. Most of
+// its allocations are ECDSA's; see responder.BenchmarkCreateResponse for
+// the encoding alone.
+func BenchmarkSlowPath(b *testing.B) {
+	cfg := fastCache
+	cfg.MaxEntries = 0
+	req := benchState(b, cfg)(0x1001)
+	r, rewind := newPost(req)
+	w := &discardWriter{header: http.Header{}}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rewind()
+		ocspHandler(w, r)
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// cachePolicies are the values of cache.policy; empty is none.
+var cachePolicies = map[string]bool{"": true, "none": true, "lru": true, "lfu": true, "ttl": true}
+
+// cacheEvictFraction sizes an eviction: once the cache is full, a policy
+// that evicts makes room for a sixteenth of cache.max_entries at once, so
+// the copy of the read map is amortized over many inserts.
+const cacheEvictFraction = 16
+
+// ttlSegments is the number of expiry segments of the ttl policy per
+// cache.ttl.
+const ttlSegments = 8
+
+// cachePolicy decides which responses make room for new ones once the
+// cache is full.
+type cachePolicy interface {
+	// touch records a hit on e. It runs on the fast path, so it must not
+	// lock or allocate.
+	touch(e *cachedResponse, now time.Time)
+	// victims returns the keys of at least n of the live entries to
+	// evict, 0 < n <= len(live), or none to refuse new responses instead.
+	victims(live map[string]*cachedResponse, n int) []string
+}
+
+func newCachePolicy(cfg CacheConfig) cachePolicy {
+	switch cfg.Policy {
+	case "lru":
+		return lruPolicy{}
+	case "lfu":
+		return lfuPolicy{}
+	case "ttl":
+		return ttlPolicy{segment: cfg.TTL / ttlSegments}
+	}
+	return noEviction{}
+}
+
+// noEviction keeps the responses cached first and refuses new ones once
+// the cache is full, until they expire. It costs nothing on the fast path,
+// and suits a stable working set that fits.
+type noEviction struct{}
+
+func (noEviction) touch(*cachedResponse, time.Time)                 {}
+func (noEviction) victims(map[string]*cachedResponse, int) []string { return nil }
+
+// lruPolicy evicts the responses used least recently, to the second, for
+// browser-facing deployments whose hot set drifts.
+type lruPolicy struct{}
+
+func (lruPolicy) touch(e *cachedResponse, now time.Time) {
+	// Only write when the second changed, so a hot entry's cache line is
+	// not written by every request.
+	t := now.UnixNano()
+	if t-atomic.LoadInt64(&e.lastUsed) > int64(time.Second) {
+		atomic.StoreInt64(&e.lastUsed, t)
+	}
+}
+
+func (lruPolicy) victims(live map[string]*cachedResponse, n int) []string {
+	return lowest(live, func(e *cachedResponse) int64 { return atomic.LoadInt64(&e.lastUsed) })[:n]
+}
+
+// lfuPolicy evicts the responses used least often, for machine-to-machine
+// deployments that poll a fixed set of certificates at different rates.
+// Every eviction halves the counts of the responses it keeps, so one
+// popular long ago does not stay forever.
+type lfuPolicy struct{}
+
+func (lfuPolicy) touch(e *cachedResponse, _ time.Time) {
+	atomic.AddInt64(&e.hits, 1)
+}
+
+func (lfuPolicy) victims(live map[string]*cachedResponse, n int) []string {
+	keys := lowest(live, func(e *cachedResponse) int64 { return atomic.LoadInt64(&e.hits) })
+	for _, k := range keys[n:] {
+		e := live[k]
+		atomic.StoreInt64(&e.hits, atomic.LoadInt64(&e.hits)/2)
+	}
+	return keys[:n]
+}
+
+// ttlPolicy groups the responses in segments of cache.ttl/8 by expiry and
+// evicts whole segments, those expiring first first: the responses that
+// would soon be signed again anyway. It tracks nothing on the fast path.
+type ttlPolicy struct {
+	segment time.Duration
+}
+
+func (ttlPolicy) touch(*cachedResponse, time.Time) {}
+
+func (p ttlPolicy) victims(live map[string]*cachedResponse, n int) []string {
+	segment := int64(p.segment)
+	if segment <= 0 {
+		segment = 1
+	}
+	keys := lowest(live, func(e *cachedResponse) int64 { return e.expires.UnixNano() / segment })
+	for n < len(keys) && live[keys[n]].expires.UnixNano()/segment == live[keys[n-1]].expires.UnixNano()/segment {
+		n++
+	}
+	return keys[:n]
+}
+
+// lowest returns the keys of live by ascending score.
+func lowest(live map[string]*cachedResponse, score func(*cachedResponse) int64) []string {
+	type scored struct {
+		key   string
+		score int64
+	}
+	all := make([]scored, 0, len(live))
+	for k, e := range live {
+		all = append(all, scored{k, score(e)})
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].score < all[j].score })
+	keys := make([]string, len(all))
+	for i, s := range all {
+		keys[i] = s.key
+	}
+	return keys
+}
+
+// cacheStats are the counters of one policy, kept across reloads and
+// flushes so that policies can be compared on the same deployment.
+type cacheStats struct {
+	hits      int64
+	misses    int64
+	inserts   int64
+	evictions int64
+	// rejected counts responses not cached because the cache was full.
+	rejected int64
+	// coalesced counts misses answered with the response an identical
+	// concurrent miss signed.
+	coalesced int64
+	// prewarmed counts responses signed ahead of a CRL swap; see
+	// prewarm.go.
+	prewarmed int64
+}
+
+// cacheCounters holds the counters of every policy used since startup.
+var cacheCounters = struct {
+	sync.Mutex
+	since    time.Time
+	policies map[string]*cacheStats
+}{since: time.Now(), policies: make(map[string]*cacheStats)}
+
+// policyStats returns the counters of the named policy, creating them.
+func policyStats(name string) *cacheStats {
+	cacheCounters.Lock()
+	defer cacheCounters.Unlock()
+	s, ok := cacheCounters.policies[name]
+	if !ok {
+		s = new(cacheStats)
+		cacheCounters.policies[name] = s
+	}
+	return s
+}
+
+// cacheStatsReport is the JSON form of a policy's counters.
+type cacheStatsReport struct {
+	Hits      int64   `json:"hits"`
+	Misses    int64   `json:"misses"`
+	HitRatio  float64 `json:"hit_ratio"`
+	Inserts   int64   `json:"inserts"`
+	Evictions int64   `json:"evictions"`
+	Rejected  int64   `json:"rejected"`
+	Coalesced int64   `json:"coalesced"`
+	Prewarmed int64   `json:"prewarmed"`
+}
+
+func (s *cacheStats) report() cacheStatsReport {
+	r := cacheStatsReport{
+		Hits:      atomic.LoadInt64(&s.hits),
+		Misses:    atomic.LoadInt64(&s.misses),
+		Inserts:   atomic.LoadInt64(&s.inserts),
+		Evictions: atomic.LoadInt64(&s.evictions),
+		Rejected:  atomic.LoadInt64(&s.rejected),
+		Coalesced: atomic.LoadInt64(&s.coalesced),
+		Prewarmed: atomic.LoadInt64(&s.prewarmed),
+	}
+	if total := r.Hits + r.Misses; total > 0 {
+		r.HitRatio = float64(r.Hits) / float64(total)
+	}
+	return r
+}
+
+// cacheHandler serves GET /admin/v1/cache: the policy in use, the fill of
+// the cache and the counters of every policy used since startup.
+func cacheHandler(w http.ResponseWriter, r *http.Request) {
+	st := currentState()
+	report := struct {
+		Policy     string                      `json:"policy"`
+		Entries    int                         `json:"entries"`
+		MaxEntries int                         `json:"max_entries"`
+		Since      time.Time                   `json:"since"`
+		Policies   map[string]cacheStatsReport `json:"policies"`
+	}{Policy: st.cache.policyName, Entries: st.cache.size(), MaxEntries: st.cache.max, Policies: make(map[string]cacheStatsReport)}
+	cacheCounters.Lock()
+	report.Since = cacheCounters.since
+	for name, s := range cacheCounters.policies {
+		report.Policies[name] = s.report()
+	}
+	cacheCounters.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(report)
+}
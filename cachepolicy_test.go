@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fillCache returns a cache of policy holding max responses, k0 to k15,
+// the ith cached at now plus i seconds and expiring expires(i) later.
+func fillCache(policy string, now time.Time, expires func(i int) time.Duration) *responseCache {
+	c := newResponseCache(CacheConfig{Policy: policy, MaxEntries: 16, TTL: time.Hour})
+	for i := 0; i < 16; i++ {
+		at := now.Add(time.Duration(i) * time.Second)
+		c.put([]byte(fmt.Sprint("k", i)), &cachedResponse{der: []byte{byte(i)}, expires: at.Add(expires(i))}, at)
+	}
+	return c
+}
+
+func cached(c *responseCache, key string, now time.Time) bool {
+	return c.peek([]byte(key), now) != nil
+}
+
+func TestCachePolicies(t *testing.T) {
+	now := time.Now()
+	hour := func(int) time.Duration { return time.Hour }
+	later := now.Add(time.Minute)
+
+	t.Run("none", func(t *testing.T) {
+		c := fillCache("none", now, hour)
+		rejected := atomic.LoadInt64(&c.stats.rejected)
+		c.put([]byte("new"), &cachedResponse{expires: later.Add(time.Hour)}, later)
+		if cached(c, "new", later) || c.size() != 16 || atomic.LoadInt64(&c.stats.rejected) != rejected+1 {
+			t.Errorf("a full cache took a new response: %d cached", c.size())
+		}
+	})
+
+	t.Run("lru", func(t *testing.T) {
+		c := fillCache("lru", now, hour)
+		c.hit(c.peek([]byte("k0"), later), later)
+		c.put([]byte("new"), &cachedResponse{expires: later.Add(time.Hour)}, later)
+		if !cached(c, "new", later) || !cached(c, "k0", later) || cached(c, "k1", later) {
+			t.Error("lru did not evict the response used least recently")
+		}
+	})
+
+	t.Run("lfu", func(t *testing.T) {
+		c := fillCache("lfu", now, hour)
+		for i := 0; i < 16; i++ {
+			if i == 5 {
+				continue
+			}
+			e := c.peek([]byte(fmt.Sprint("k", i)), later)
+			for j := 0; j < 4; j++ {
+				c.hit(e, later)
+			}
+		}
+		c.put([]byte("new"), &cachedResponse{expires: later.Add(time.Hour)}, later)
+		if !cached(c, "new", later) || cached(c, "k5", later) {
+			t.Error("lfu did not evict the response used least often")
+		}
+		if hits := atomic.LoadInt64(&c.peek([]byte("k0"), later).hits); hits != 2 {
+			t.Errorf("a kept response has %d hits after the eviction, want 4 halved", hits)
+		}
+	})
+
+	t.Run("ttl", func(t *testing.T) {
+		// k0 to k3 expire in the first segment, the others an hour
+		// later.
+		c := fillCache("ttl", now.Truncate(time.Hour), func(i int) time.Duration {
+			if i < 4 {
+				return time.Minute
+			}
+			return time.Hour + time.Minute
+		})
+		at := now.Truncate(time.Hour).Add(30 * time.Second)
+		c.put([]byte("new"), &cachedResponse{expires: at.Add(time.Hour)}, at)
+		for i := 0; i < 16; i++ {
+			if got := cached(c, fmt.Sprint("k", i), at); got != (i >= 4) {
+				t.Errorf("k%d cached %v after the eviction, want the whole first segment evicted", i, got)
+			}
+		}
+		if !cached(c, "new", at) {
+			t.Error("the new response was not cached")
+		}
+	})
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// CadenceConfig sets the nextUpdate of answers from each issuer's CRL
+// publication cadence rather than from the CRL's own nextUpdate. CAs
+// publish well before their CRLs expire (daily CRLs valid for a week), so
+// clients holding an answer until the CRL's nextUpdate miss revocations
+// for days; answers that expire just before the next CRL is expected are
+// cached as long as they can be and no longer.
+type CadenceConfig struct {
+	// Enabled adapts the answers of every issuer.
+	Enabled bool `yaml:"enabled"`
+	// Issuers overrides Enabled per issuer, by CRL name (DODEMAILCA_63).
+	Issuers map[string]bool `yaml:"issuers"`
+	// MinSamples is how many publication intervals must have been seen
+	// before the cadence of an issuer is trusted.
+	MinSamples int `yaml:"min_samples"`
+	// Margin is how long before the expected publication answers expire.
+	Margin time.Duration `yaml:"margin"`
+	// MinValidity is the shortest time after the CRL's thisUpdate that
+	// answers stay valid, whatever the cadence.
+	MinValidity time.Duration `yaml:"min_validity"`
+}
+
+func (c CadenceConfig) validate() error {
+	if c.MinSamples < 1 || c.Margin < 0 || c.MinValidity < 0 {
+		return errors.New("cadence: min_samples must be positive, margin and min_validity not negative")
+	}
+	return nil
+}
+
+// enabledFor reports whether the answers of the issuer key are adapted.
+func (c CadenceConfig) enabledFor(key string) bool {
+	if on, ok := c.Issuers[key]; ok {
+		return on
+	}
+	return c.Enabled
+}
+
+// cadenceFile holds the publication history in the cache directory.
+const cadenceFile = "cadence.json"
+
+// maxPublications bounds the publications remembered per issuer.
+const maxPublications = 16
+
+// cadence is the thisUpdate of the last CRLs of each issuer, oldest first.
+var cadence = struct {
+	sync.Mutex
+	loaded  bool
+	history map[string][]time.Time
+}{history: make(map[string][]time.Time)}
+
+// observePublication records a CRL of the issuer key published at
+// thisUpdate and returns the issuer's history. The history is loaded
+// from the cache on first use, with the versions in the archive.
+func observePublication(cfg *Config, key string, thisUpdate time.Time) []time.Time {
+	cadence.Lock()
+	defer cadence.Unlock()
+	if !cadence.loaded {
+		if data, err := os.ReadFile(rootDir + cadenceFile); err == nil {
+			if err := json.Unmarshal(data, &cadence.history); err != nil {
+				log.Printf("%s: %v", cadenceFile, err)
+			}
+		}
+		cadence.loaded = true
+	}
+	history, changed := cadence.history[key], false
+	if len(history) == 0 && cfg.Archive.Enabled {
+		history, _ = archivedVersions(filepath.Join(cfg.Archive.dir(), key))
+		changed = len(history) > 0
+	}
+	thisUpdate = thisUpdate.UTC().Truncate(time.Second)
+	i := sort.Search(len(history), func(i int) bool { return !history[i].Before(thisUpdate) })
+	if i == len(history) || !history[i].Equal(thisUpdate) {
+		history = append(history, time.Time{})
+		copy(history[i+1:], history[i:])
+		history[i] = thisUpdate
+		changed = true
+	}
+	if !changed {
+		return append([]time.Time(nil), history...)
+	}
+	if len(history) > maxPublications {
+		history = history[len(history)-maxPublications:]
+	}
+	cadence.history[key] = history
+	if !readOnly {
+		data, _ := json.MarshalIndent(cadence.history, "", "  ")
+		if err := writeFileAtomic(rootDir+cadenceFile, data, 0o644); err != nil {
+			log.Printf("%s: %v", cadenceFile, err)
+		}
+	}
+	return append([]time.Time(nil), history...)
+}
+
+// publicationInterval is the median interval between the publications of
+// history, if there are at least minSamples of them.
+func publicationInterval(history []time.Time, minSamples int) (time.Duration, bool) {
+	if len(history)-1 < minSamples {
+		return 0, false
+	}
+	intervals := make([]time.Duration, 0, len(history)-1)
+	for i := 1; i < len(history); i++ {
+		intervals = append(intervals, history[i].Sub(history[i-1]))
+	}
+	sort.Slice(intervals, func(i, j int) bool { return intervals[i] < intervals[j] })
+	return intervals[len(intervals)/2], true
+}
+
+// adaptNextUpdate records the publication of the CRL behind f and, if
+// the issuer's answers are adapted and its cadence is known, sets the
+// nextUpdate of its answers just before the next CRL is expected, never
+// past the CRL's own nextUpdate.
+func adaptNextUpdate(cfg *Config, f *CRLBloomFilter) {
+	if f.quarantine != "" || f.thisUpdate.IsZero() {
+		return
+	}
+	key := f.crlInfo.key()
+	history := observePublication(cfg, key, f.thisUpdate)
+	if !cfg.Cadence.enabledFor(key) {
+		return
+	}
+	interval, ok := publicationInterval(history, cfg.Cadence.MinSamples)
+	if !ok {
+		return
+	}
+	next := f.thisUpdate.Add(interval - cfg.Cadence.Margin)
+	if floor := f.thisUpdate.Add(cfg.Cadence.MinValidity); next.Before(floor) {
+		next = floor
+	}
+	if !f.nextUpdate.IsZero() && !next.Before(f.nextUpdate) {
+		return
+	}
+	f.answerNextUpdate = next
+}
+
+// answersNextUpdate is the nextUpdate of answers from f: the one learned
+// from the cadence while it is ahead, and the CRL's once the next CRL is
+// overdue.
+func (f CRLBloomFilter) answersNextUpdate() time.Time {
+	if !f.answerNextUpdate.IsZero() && time.Now().Before(f.answerNextUpdate) {
+		return f.answerNextUpdate
+	}
+	return f.nextUpdate
+}
+
+// issuerCadence is what GET /admin/v1/cadence reports about one issuer.
+type issuerCadence struct {
+	Issuer       string      `json:"issuer"`
+	Adapted      bool        `json:"adapted"`
+	Publications []time.Time `json:"publications"`
+	// Interval is the learned median interval, once there are enough
+	// publications.
+	Interval      string     `json:"interval,omitempty"`
+	ExpectedNext  *time.Time `json:"expected_next,omitempty"`
+	CRLNextUpdate *time.Time `json:"crl_next_update,omitempty"`
+	// AnswersNextUpdate is the nextUpdate of answers right now.
+	AnswersNextUpdate *time.Time `json:"answers_next_update,omitempty"`
+}
+
+// cadenceHandler serves GET /admin/v1/cadence.
+func cadenceHandler(w http.ResponseWriter, r *http.Request) {
+	st := currentState()
+	cadence.Lock()
+	out := make([]issuerCadence, 0, len(st.filters))
+	for key, f := range st.filters {
+		c := issuerCadence{
+			Issuer:            key,
+			Adapted:           !f.answerNextUpdate.IsZero(),
+			Publications:      append([]time.Time{}, cadence.history[key]...),
+			CRLNextUpdate:     timePtr(f.nextUpdate),
+			AnswersNextUpdate: timePtr(f.answersNextUpdate()),
+		}
+		if interval, ok := publicationInterval(c.Publications, st.cfg.Cadence.MinSamples); ok {
+			c.Interval = interval.String()
+			c.ExpectedNext = timePtr(f.thisUpdate.Add(interval))
+		}
+		out = append(out, c)
+	}
+	cadence.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].Issuer < out[j].Issuer })
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(out)
+}
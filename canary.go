@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/pkkemp/GoOCSPResponder/responder"
+)
+
+// Canary is a synthetic serial with a fixed answer, for monitors that
+// check the responder answers correctly rather than just that it answers.
+// No certificate needs to exist for it; pick serials the CA cannot issue.
+type Canary struct {
+	// Issuer is the CRL name, fingerprint, common name or subject of a
+	// served CA, as for routes.
+	Issuer string `yaml:"issuer"`
+	// Serial is decimal, 0x-prefixed hex or colon-separated hex.
+	Serial string `yaml:"serial"`
+	// Status is good, revoked or unknown.
+	Status string `yaml:"status"`
+	// Reason is the CRLReason code of a revoked canary.
+	Reason int `yaml:"reason"`
+	// RevokedAt is the revocation time of a revoked canary; it defaults
+	// to the CA certificate's notBefore, so the answer never changes.
+	RevokedAt time.Time `yaml:"revoked_at"`
+}
+
+var canaryStatuses = map[string]responder.Status{
+	"good":    responder.Good,
+	"revoked": responder.Revoked,
+	"unknown": responder.Unknown,
+}
+
+func (c Canary) validate() error {
+	status, ok := canaryStatuses[c.Status]
+	switch {
+	case c.Issuer == "":
+		return errors.New("canaries need an issuer")
+	case !ok:
+		return fmt.Errorf("canary %s: status %q is not good, revoked or unknown", c.Serial, c.Status)
+	case c.Reason != 0 && status != responder.Revoked:
+		return fmt.Errorf("canary %s: only revoked canaries have a reason", c.Serial)
+	case c.Reason < 0 || c.Reason > 10 || c.Reason == 7:
+		return fmt.Errorf("canary %s: %d is not a CRLReason code", c.Serial, c.Reason)
+	}
+	if _, ok := parseSerial(c.Serial); !ok {
+		return fmt.Errorf("canary: bad serial %q", c.Serial)
+	}
+	return nil
+}
+
+// canary is a configured canary resolved against the served issuers.
+type canary struct {
+	issuer    string
+	serial    *big.Int
+	status    responder.Status
+	reason    int
+	revokedAt time.Time
+}
+
+// buildCanaries resolves the configured canaries by CRL key and serial
+// bytes.
+func buildCanaries(st *state) (map[string]map[string]canary, error) {
+	canaries := make(map[string]map[string]canary)
+	for _, c := range st.cfg.Canaries {
+		crl, _, ok := st.findIssuer(c.Issuer)
+		if !ok {
+			return nil, fmt.Errorf("canaries: issuer %q of %s is not served", c.Issuer, c.Serial)
+		}
+		serial, _ := parseSerial(c.Serial)
+		if canaries[crl.key()] == nil {
+			canaries[crl.key()] = make(map[string]canary)
+		}
+		if _, dup := canaries[crl.key()][string(serial.Bytes())]; dup {
+			return nil, fmt.Errorf("canaries: serial %s of %s is defined twice", c.Serial, crl.key())
+		}
+		revokedAt := c.RevokedAt
+		if revokedAt.IsZero() {
+			revokedAt = crl.CA.NotBefore
+		}
+		canaries[crl.key()][string(serial.Bytes())] = canary{
+			issuer:    crl.key(),
+			serial:    serial,
+			status:    canaryStatuses[c.Status],
+			reason:    c.Reason,
+			revokedAt: revokedAt.UTC().Truncate(time.Second),
+		}
+	}
+	return canaries, nil
+}
+
+// The canary hook is registered after the blocklist's (files initialize
+// in name order), so a canary's answer is final.
+func init() {
+	policyHooks = append(policyHooks, policyHook{name: "canary", apply: applyCanary})
+}
+
+// applyCanary forces the configured answer for a canary serial, whatever
+// the CRL says.
+func applyCanary(f CRLBloomFilter, single *responder.SingleResponse) bool {
+	st, _ := current.Load().(*state)
+	if st == nil {
+		return false
+	}
+	c, ok := st.canaries[f.crlInfo.key()][string(single.CertID.SerialNumber.Bytes())]
+	if !ok {
+		return false
+	}
+	single.Status = c.status
+	single.RevokedAt, single.RevocationReason, single.Extensions = time.Time{}, 0, nil
+	if c.status == responder.Revoked {
+		single.RevokedAt, single.RevocationReason = c.revokedAt, c.reason
+	}
+	return true
+}
+
+// capabilities is what GET /api/v1/capabilities describes: the issuers
+// served, the requests accepted and the canaries monitors may check.
+type capabilities struct {
+	Issuers []capabilityIssuer `json:"issuers"`
+	// CertIDHashes are the hash algorithms CertIDs may use.
+	CertIDHashes []string `json:"certid_hashes"`
+	// Methods are the HTTP methods OCSP requests are accepted with.
+	Methods  []string           `json:"methods"`
+	Canaries []canaryDefinition `json:"canaries"`
+}
+
+type capabilityIssuer struct {
+	Issuer  string `json:"issuer"`
+	Subject string `json:"subject"`
+	// Routes are the paths dedicated to the issuer.
+	Routes []string `json:"routes,omitempty"`
+	// Certificate is the CA's DER, from which the CertIDs of its
+	// certificates are computed; goocsp router routes by it.
+	Certificate []byte `json:"certificate"`
+}
+
+type canaryDefinition struct {
+	Issuer    string     `json:"issuer"`
+	Serial    string     `json:"serial"`
+	Status    string     `json:"status"`
+	Reason    int        `json:"reason,omitempty"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+// capabilities describes st.
+func (st *state) capabilities() capabilities {
+	c := capabilities{Methods: []string{http.MethodPost, http.MethodGet}, Canaries: []canaryDefinition{}}
+	for _, crl := range st.crls {
+		ci := capabilityIssuer{Issuer: crl.key(), Subject: subjectDN(crl.CA), Certificate: crl.CA.Raw}
+		for seg, key := range st.routes {
+			if key == crl.key() {
+				ci.Routes = append(ci.Routes, "/"+seg)
+			}
+		}
+		sort.Strings(ci.Routes)
+		c.Issuers = append(c.Issuers, ci)
+	}
+	for _, h := range certIDHashes {
+		c.CertIDHashes = append(c.CertIDHashes, h.String())
+	}
+	// Canaries are listed in configuration order.
+	for _, cc := range st.cfg.Canaries {
+		crl, _, _ := st.findIssuer(cc.Issuer)
+		serial, _ := parseSerial(cc.Serial)
+		can := st.canaries[crl.key()][string(serial.Bytes())]
+		d := canaryDefinition{Issuer: can.issuer, Serial: fmt.Sprintf("0x%x", can.serial), Status: cc.Status}
+		if can.status == responder.Revoked {
+			t := can.revokedAt
+			d.Reason, d.RevokedAt = can.reason, &t
+		}
+		c.Canaries = append(c.Canaries, d)
+	}
+	return c
+}
+
+// capabilitiesHandler serves GET /api/v1/capabilities.
+func capabilitiesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(currentState().capabilities())
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// CaptureConfig keeps the raw bytes of the latest OCSP exchanges, so an
+// exchange a picky client rejects can be replayed and dissected offline
+// without a packet capture on the host. It is a debugging aid: it costs a
+// copy of every request and response while enabled.
+type CaptureConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Size is how many exchanges are kept; older ones are overwritten.
+	Size int `yaml:"size"`
+}
+
+func (c CaptureConfig) validate() error {
+	if c.Enabled && (c.Size < 1 || c.Size > 100000) {
+		return errors.New("capture.size must be between 1 and 100000")
+	}
+	return nil
+}
+
+// capturedExchange is one OCSP request and the response sent to it.
+type capturedExchange struct {
+	Seq        uint64        `json:"seq"`
+	At         time.Time     `json:"at"`
+	Duration   time.Duration `json:"duration_ns"`
+	RemoteAddr string        `json:"remote_addr"`
+	Method     string        `json:"method"`
+	Path       string        `json:"path"`
+	UserAgent  string        `json:"user_agent,omitempty"`
+	Status     int           `json:"status"`
+	// ContentType is that of the response.
+	ContentType string `json:"content_type,omitempty"`
+	request     []byte
+	response    []byte
+}
+
+// captureRing holds the latest exchanges while capture is enabled.
+type captureRing struct {
+	// on is read without mu on the OCSP fast path.
+	on   int32
+	mu   sync.Mutex
+	ring []capturedExchange
+	// next is where the next exchange goes; seq counts them all.
+	next int
+	seq  uint64
+}
+
+var captures = &captureRing{}
+
+// configure applies cfg, dropping what was captured if the size changes
+// or capture is turned off.
+func (c *captureRing) configure(cfg CaptureConfig) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !cfg.Enabled {
+		atomic.StoreInt32(&c.on, 0)
+		c.ring, c.next = nil, 0
+		return
+	}
+	atomic.StoreInt32(&c.on, 1)
+	if cap(c.ring) != cfg.Size {
+		c.ring, c.next = make([]capturedExchange, 0, cfg.Size), 0
+	}
+}
+
+// enabled reports whether exchanges are captured.
+func (c *captureRing) enabled() bool {
+	return atomic.LoadInt32(&c.on) != 0
+}
+
+// add keeps e, taking over its slices.
+func (c *captureRing) add(e capturedExchange) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if cap(c.ring) == 0 {
+		// Turned off meanwhile.
+		return
+	}
+	c.seq++
+	e.Seq = c.seq
+	if len(c.ring) < cap(c.ring) {
+		c.ring = append(c.ring, e)
+		return
+	}
+	c.ring[c.next] = e
+	c.next = (c.next + 1) % len(c.ring)
+}
+
+// exchanges returns the kept exchanges, oldest first.
+func (c *captureRing) exchanges() []capturedExchange {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := make([]capturedExchange, 0, len(c.ring))
+	out = append(out, c.ring[c.next:]...)
+	return append(out, c.ring[:c.next]...)
+}
+
+// captureWriter keeps what is written to an OCSP response.
+type captureWriter struct {
+	http.ResponseWriter
+	status int
+	body   []byte
+}
+
+func (w *captureWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *captureWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.body = append(w.body, b...)
+	return w.ResponseWriter.Write(b)
+}
+
+// captureExchange records the exchange of r, whose request bytes were
+// body, answered through w since start. body is copied, as it is pooled.
+func captureExchange(r *http.Request, body []byte, w *captureWriter, start time.Time) {
+	captures.add(capturedExchange{
+		At:          start.UTC(),
+		Duration:    time.Since(start),
+		RemoteAddr:  r.RemoteAddr,
+		Method:      r.Method,
+		Path:        r.URL.Path,
+		UserAgent:   r.UserAgent(),
+		Status:      w.status,
+		ContentType: w.Header().Get("Content-Type"),
+		request:     append([]byte(nil), body...),
+		response:    w.body,
+	})
+}
+
+// capturesHandler serves GET /admin/v1/captures: a tar archive of the kept
+// exchanges, oldest first. Exchange n is NNNNNNNN-request.der and
+// NNNNNNNN-response.der, ready for openssl ocsp -reqin and -respin, and
+// exchanges.json describes them all.
+func capturesHandler(w http.ResponseWriter, r *http.Request) {
+	if !captures.enabled() {
+		http.Error(w, "capture is not enabled", http.StatusNotFound)
+		return
+	}
+	exchanges := captures.exchanges()
+	now := time.Now()
+	w.Header().Set("Content-Type", "application/x-tar")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="ocsp-captures-%s.tar"`, now.UTC().Format("20060102T150405Z")))
+	tw := tar.NewWriter(w)
+	add := func(name string, data []byte, at time.Time) error {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), ModTime: at}); err != nil {
+			return err
+		}
+		_, err := tw.Write(data)
+		return err
+	}
+	index, _ := json.MarshalIndent(exchanges, "", "  ")
+	if err := add("exchanges.json", append(index, '\n'), now); err != nil {
+		return
+	}
+	for _, e := range exchanges {
+		if err := add(fmt.Sprintf("%08d-request.der", e.Seq), e.request, e.At); err != nil {
+			return
+		}
+		if err := add(fmt.Sprintf("%08d-response.der", e.Seq), e.response, e.At); err != nil {
+			return
+		}
+	}
+	tw.Close()
+}
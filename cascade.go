@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/pkkemp/GoOCSPResponder/responder"
+)
+
+// reasonCACompromise is the CRLReason of answers under a revoked CA.
+const reasonCACompromise = 2
+
+// CascadeConfig answers revoked for every certificate of a served CA that
+// is itself revoked, whatever the CA's own CRL says: a revoked
+// intermediate's CRL keeps listing only what the CA revoked, and its
+// certificates would otherwise stay good. A CA is revoked when the CRL
+// (ARL) of a served CA above it lists it, or the emergency blocklist does
+// under its issuer, and so are the CAs below it.
+type CascadeConfig struct {
+	// Enabled cascades for every issuer.
+	Enabled bool `yaml:"enabled"`
+	// Issuers overrides Enabled per issuer, by CRL name (DODEMAILCA_63).
+	Issuers map[string]bool `yaml:"issuers"`
+}
+
+// enabledFor reports whether revocations of the issuer key cascade.
+func (c CascadeConfig) enabledFor(key string) bool {
+	if on, ok := c.Issuers[key]; ok {
+		return on
+	}
+	return c.Enabled
+}
+
+// enabled reports whether any issuer cascades.
+func (c CascadeConfig) enabled() bool {
+	for _, on := range c.Issuers {
+		if on {
+			return true
+		}
+	}
+	return c.Enabled
+}
+
+// caRevocation is why a served CA counts as revoked.
+type caRevocation struct {
+	// RevokedCA is the subject of the CA certificate found revoked: the
+	// served CA's or that of a CA above it.
+	RevokedCA string    `json:"revoked_ca"`
+	Serial    string    `json:"serial"`
+	RevokedAt time.Time `json:"revoked_at"`
+	Reason    int       `json:"reason"`
+	// Source is the CRL name of the ARL that lists it, or blocklist.
+	Source string `json:"source"`
+}
+
+// revokedCAs finds the served CAs of st that are revoked, directly or
+// through a CA above them, by CRL key.
+func revokedCAs(st *state, bl *blocklist) map[string]caRevocation {
+	certs := make([]*x509.Certificate, 0, len(st.bundle.Certificates)+len(st.filters))
+	for i := range st.bundle.Certificates {
+		certs = append(certs, &st.bundle.Certificates[i])
+	}
+	for _, f := range st.filters {
+		certs = append(certs, f.crlInfo.CA)
+	}
+	// parents are the certificates of the CA that issued c, under any of
+	// its cross-certificates.
+	parents := func(c *x509.Certificate) []*x509.Certificate {
+		var found []*x509.Certificate
+		seen := make(map[[sha256.Size]byte]bool)
+		for _, p := range certs {
+			fp := getSha256Fingerprint(p)
+			if seen[fp] || !bytes.Equal(p.RawSubject, c.RawIssuer) || c.CheckSignatureFrom(p) != nil {
+				continue
+			}
+			seen[fp] = true
+			found = append(found, p)
+		}
+		return found
+	}
+	// listed finds c in the ARL of its issuer p, if served, or in the
+	// blocklist under p.
+	listed := func(p, c *x509.Certificate) *caRevocation {
+		for key, f := range st.filters {
+			if f.quarantine != "" || !bytes.Equal(f.crlInfo.CA.RawSubject, p.RawSubject) || !bytes.Equal(f.crlInfo.CA.RawSubjectPublicKeyInfo, p.RawSubjectPublicKeyInfo) {
+				continue
+			}
+			if l := f.lookup(c.SerialNumber); l.revoked {
+				return &caRevocation{RevokedAt: l.entry.RevokedAt, Reason: l.entry.Reason, Source: key}
+			}
+		}
+		if bl != nil {
+			if e, ok := bl.active[getSha256Fingerprint(p)][string(c.SerialNumber.Bytes())]; ok {
+				return &caRevocation{RevokedAt: e.RevokedAt, Reason: e.Reason, Source: "blocklist"}
+			}
+		}
+		return nil
+	}
+
+	// A certificate is revoked if its issuer revoked it, or if every
+	// certificate of its issuer is; one valid path keeps it valid, so a
+	// revoked cross-certificate does not cascade. Cycles of
+	// cross-certificates count as valid.
+	memo := make(map[[sha256.Size]byte]*caRevocation)
+	visiting := make(map[[sha256.Size]byte]bool)
+	var revoked func(c *x509.Certificate) *caRevocation
+	revoked = func(c *x509.Certificate) *caRevocation {
+		fp := getSha256Fingerprint(c)
+		if r, ok := memo[fp]; ok {
+			return r
+		}
+		if visiting[fp] || bytes.Equal(c.RawSubject, c.RawIssuer) {
+			return nil
+		}
+		visiting[fp] = true
+		defer delete(visiting, fp)
+		ps := parents(c)
+		var r *caRevocation
+		for _, p := range ps {
+			if r = listed(p, c); r != nil {
+				r.RevokedCA, r.Serial = subjectDN(c), fmt.Sprintf("%x", c.SerialNumber)
+				break
+			}
+		}
+		if r == nil && len(ps) > 0 {
+			r = revoked(ps[0])
+			for _, p := range ps[1:] {
+				if r == nil {
+					break
+				}
+				r = revoked(p)
+			}
+		}
+		memo[fp] = r
+		return r
+	}
+
+	out := make(map[string]caRevocation)
+	for key, f := range st.filters {
+		if r := revoked(f.crlInfo.CA); r != nil {
+			out[key] = *r
+		}
+	}
+	return out
+}
+
+// updateCascades finds the revoked CAs of next, which replaces old (nil
+// when there is none), drops the cached answers of the issuers whose
+// cascade changed and writes each change to the audit log. Callers that
+// install next hold stateMu.
+func updateCascades(old, next *state) {
+	next.cascades = nil
+	if next.cfg.Cascade.enabled() {
+		next.cascades = revokedCAs(next, currentBlocklist())
+	}
+	var before map[string]caRevocation
+	if old != nil {
+		before = old.cascades
+	}
+	for key, r := range next.cascades {
+		if prev, ok := before[key]; ok && prev.RevokedCA == r.RevokedCA && prev.Source == r.Source && prev.RevokedAt.Equal(r.RevokedAt) {
+			continue
+		}
+		if old != nil {
+			next.cache = next.cache.without(key)
+		}
+		if !next.cfg.Cascade.enabledFor(key) {
+			log.Printf("audit: cascade: %s is under revoked %s (by %s), but cascading is off for it", key, r.RevokedCA, r.Source)
+			continue
+		}
+		log.Printf("audit: cascade: %s answers revoked (cACompromise) for all its certificates: %s serial %s revoked at %s by %s",
+			key, r.RevokedCA, r.Serial, r.RevokedAt.UTC().Format(time.RFC3339), r.Source)
+		alert(next.cfg, "%s is under revoked CA %s; all its certificates are answered revoked", key, r.RevokedCA)
+	}
+	for key := range before {
+		if _, ok := next.cascades[key]; !ok {
+			next.cache = next.cache.without(key)
+			log.Printf("audit: cascade: %s is no longer under a revoked CA", key)
+		}
+	}
+}
+
+// The cascade hook runs after the blocklist's, so a blocklisted serial
+// keeps its own reason, and before the canary's, whose answer is final.
+func init() {
+	hook := policyHook{name: "cascade", apply: applyCascade}
+	for i, h := range policyHooks {
+		if h.name == "canary" {
+			policyHooks = append(policyHooks[:i], append([]policyHook{hook}, policyHooks[i:]...)...)
+			return
+		}
+	}
+	policyHooks = append(policyHooks, hook)
+}
+
+// applyCascade answers revoked under a revoked CA. Serials already revoked
+// keep their own revocation.
+func applyCascade(f CRLBloomFilter, single *responder.SingleResponse) bool {
+	st, _ := current.Load().(*state)
+	if st == nil || single.Status == responder.Revoked || !st.cfg.Cascade.enabledFor(f.crlInfo.key()) {
+		return false
+	}
+	r, ok := st.cascades[f.crlInfo.key()]
+	if !ok {
+		return false
+	}
+	single.Status = responder.Revoked
+	single.RevokedAt = r.RevokedAt
+	single.RevocationReason = reasonCACompromise
+	single.Extensions = nil
+	return true
+}
+
+// cascadeReport is what GET /admin/v1/cascade reports about one issuer.
+type cascadeReport struct {
+	Issuer string `json:"issuer"`
+	// Cascading is set when its answers are revoked.
+	Cascading bool `json:"cascading"`
+	caRevocation
+}
+
+// cascadeHandler serves GET /admin/v1/cascade, the served CAs found
+// revoked.
+func cascadeHandler(w http.ResponseWriter, r *http.Request) {
+	st := currentState()
+	out := make([]cascadeReport, 0, len(st.cascades))
+	for key, rev := range st.cascades {
+		out = append(out, cascadeReport{Issuer: key, Cascading: st.cfg.Cascade.enabledFor(key), caRevocation: rev})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Issuer < out[j].Issuer })
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(out)
+}
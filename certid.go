@@ -0,0 +1,156 @@
+package main
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkkemp/GoOCSPResponder/responder"
+)
+
+// certIDHashes are the hash algorithms a CertID may use. Client stacks
+// differ: OpenSSL and most browsers send SHA-1, some Java and Windows
+// configurations SHA-256 or stronger.
+var certIDHashes = []crypto.Hash{crypto.SHA1, crypto.SHA256, crypto.SHA384, crypto.SHA512}
+
+// issuerHashes caches the CertID hashes of every issuer seen, keyed by the
+// issuer certificate's DER, so reloads do not recompute them.
+var issuerHashes = struct {
+	sync.Mutex
+	byDER map[string][]string
+}{byDER: make(map[string][]string)}
+
+// certIDKeys returns the issuer index keys of ca, one per algorithm in
+// certIDHashes.
+func certIDKeys(ca *x509.Certificate) []string {
+	issuerHashes.Lock()
+	defer issuerHashes.Unlock()
+	if keys, ok := issuerHashes.byDER[string(ca.Raw)]; ok {
+		return keys
+	}
+	var keys []string
+	for _, h := range certIDHashes {
+		nameHash, keyHash, err := responder.IssuerHashes(ca, h)
+		if err != nil {
+			log.Printf("certid: %s: %v", ca.Subject, err)
+			continue
+		}
+		var buf [1 + 2*64]byte
+		keys = append(keys, string(appendCertIDKey(buf[:0], h, nameHash, keyHash)))
+	}
+	issuerHashes.byDER[string(ca.Raw)] = keys
+	return keys
+}
+
+// appendCertIDKey appends the issuer index key of a CertID's hash
+// algorithm and issuer hashes to b. The hashes have the algorithm's fixed
+// size, so the concatenation is unambiguous.
+func appendCertIDKey(b []byte, h crypto.Hash, nameHash, keyHash []byte) []byte {
+	b = append(b, byte(h))
+	b = append(b, nameHash...)
+	return append(b, keyHash...)
+}
+
+// certIDKeyHash returns the key hash part of the issuer index key k: its
+// algorithm and issuer key hash, without the name hash.
+func certIDKeyHash(k string) string {
+	size := crypto.Hash(k[0]).Size()
+	return k[:1] + k[1+size:]
+}
+
+// buildKeyHashIndex maps the CertID key hashes of every served CA, under
+// every algorithm in certIDHashes, to the key of its CRL. A key hash
+// shared by CAs of different CRLs, such as a CA re-issued under another
+// name, maps to "" since it cannot tell them apart.
+func buildKeyHashIndex(crls []CRLInfo) map[string]string {
+	index := make(map[string]string, len(crls)*len(certIDHashes))
+	for _, crl := range crls {
+		for _, k := range certIDKeys(crl.CA) {
+			kh := certIDKeyHash(k)
+			if prev, dup := index[kh]; dup && prev != crl.key() {
+				index[kh] = ""
+				continue
+			}
+			index[kh] = crl.key()
+		}
+	}
+	return index
+}
+
+// CertIDConfig sets how CertIDs are matched to the served issuers.
+type CertIDConfig struct {
+	// LenientNameHash answers CertIDs whose issuerKeyHash matches a served
+	// issuer but whose issuerNameHash does not, as from clients that hash
+	// a re-encoded issuer name, such as older Java stacks. The key hash
+	// alone identifies the CA's key, so the CRL is still the right one;
+	// a key shared by the CAs of several CRLs is never matched this way.
+	LenientNameHash bool `yaml:"lenient_name_hash"`
+}
+
+// lenientMatches counts the CertIDs answered under lenient_name_hash, by
+// CRL key, since startup.
+var lenientMatches = struct {
+	sync.Mutex
+	byIssuer map[string]*lenientMatch
+}{byIssuer: make(map[string]*lenientMatch)}
+
+// lenientMatch is one issuer in GET /admin/v1/lenient-matches.
+type lenientMatch struct {
+	Issuer   string    `json:"issuer"`
+	Requests uint64    `json:"requests"`
+	LastSeen time.Time `json:"last_seen"`
+	// NameHash is the last issuerNameHash received, and HashAlgorithm
+	// its algorithm.
+	HashAlgorithm string `json:"hash_algorithm"`
+	NameHash      string `json:"issuer_name_hash"`
+}
+
+// countLenientMatch counts id, answered by the issuer key under
+// lenient_name_hash.
+func countLenientMatch(key string, id responder.CertID, now time.Time) {
+	lenientMatches.Lock()
+	defer lenientMatches.Unlock()
+	m := lenientMatches.byIssuer[key]
+	if m == nil {
+		m = &lenientMatch{Issuer: key}
+		lenientMatches.byIssuer[key] = m
+	}
+	m.Requests++
+	m.LastSeen = now
+	m.HashAlgorithm, m.NameHash = id.HashAlgorithm.String(), hex.EncodeToString(id.NameHash)
+}
+
+// lenientMatchesHandler serves GET /admin/v1/lenient-matches.
+func lenientMatchesHandler(w http.ResponseWriter, r *http.Request) {
+	lenientMatches.Lock()
+	out := make([]lenientMatch, 0, len(lenientMatches.byIssuer))
+	for _, m := range lenientMatches.byIssuer {
+		out = append(out, *m)
+	}
+	lenientMatches.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].Issuer < out[j].Issuer })
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(out)
+}
+
+// buildIssuerIndex maps the CertID hashes of every served CA, under every
+// algorithm in certIDHashes, to the key of its CRL.
+func buildIssuerIndex(crls []CRLInfo) map[string]string {
+	index := make(map[string]string, len(crls)*len(certIDHashes))
+	for _, crl := range crls {
+		for _, k := range certIDKeys(crl.CA) {
+			if _, dup := index[k]; !dup {
+				index[k] = crl.key()
+			}
+		}
+	}
+	return index
+}
@@ -0,0 +1,428 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ClientsConfig sorts OCSP traffic into classes by source address, such as
+// CDN fills, monitoring probes and everyone else, so each is counted and
+// rate limited on its own.
+type ClientsConfig struct {
+	// TrustedProxies are the load balancers in front of the responder.
+	// Forwarding headers and PROXY protocol headers are honored only on
+	// requests from them, and the client is the last address in the
+	// forwarding header that is not itself trusted. A CDN belongs in a
+	// class, not here, or its fills would be counted as the clients
+	// behind it.
+	TrustedProxies []string `yaml:"trusted_proxies"`
+	// ForwardedHeader is the header the trusted proxies append the client
+	// to: X-Forwarded-For (the default) or Forwarded (RFC 7239). Only one
+	// is read, since clients can send either and only the one the proxies
+	// maintain can be believed.
+	ForwardedHeader string `yaml:"forwarded_header"`
+	// ProxyProtocol accepts a PROXY protocol header (version 1 or 2) from
+	// the trusted proxies on the main listener, for load balancers that
+	// forward TCP rather than HTTP. It takes effect on restart.
+	ProxyProtocol bool `yaml:"proxy_protocol"`
+	// Classes are matched in order; unmatched clients are "direct". A
+	// class named direct without CIDRs sets the limits of that class.
+	Classes []ClientClass `yaml:"classes"`
+}
+
+// ClientClass is one class of clients.
+type ClientClass struct {
+	Name  string   `yaml:"name"`
+	CIDRs []string `yaml:"cidrs"`
+	// RateLimit is the requests per second the whole class may make;
+	// 0 is unlimited. Requests over it are answered tryLater.
+	RateLimit float64 `yaml:"rate_limit"`
+	// Burst is how many requests over the rate are allowed at once; it
+	// defaults to one second's worth.
+	Burst int `yaml:"burst"`
+}
+
+// directClass is the class of clients no configured class matches.
+const directClass = "direct"
+
+func (c ClientsConfig) validate() error {
+	if _, err := parseCIDRs(c.TrustedProxies); err != nil {
+		return fmt.Errorf("clients.trusted_proxies: %v", err)
+	}
+	switch {
+	case !strings.EqualFold(c.ForwardedHeader, "Forwarded") && !strings.EqualFold(c.ForwardedHeader, "X-Forwarded-For") && c.ForwardedHeader != "":
+		return fmt.Errorf("clients.forwarded_header: %q is neither X-Forwarded-For nor Forwarded", c.ForwardedHeader)
+	case c.ProxyProtocol && len(c.TrustedProxies) == 0:
+		return errors.New("clients.proxy_protocol needs trusted_proxies")
+	}
+	seen := make(map[string]bool)
+	for _, cl := range c.Classes {
+		switch {
+		case cl.Name == "":
+			return errors.New("clients.classes need a name")
+		case seen[cl.Name]:
+			return fmt.Errorf("clients: class %q is defined twice", cl.Name)
+		case len(cl.CIDRs) == 0 && cl.Name != directClass:
+			return fmt.Errorf("clients: class %q needs cidrs", cl.Name)
+		case cl.RateLimit < 0 || cl.Burst < 0:
+			return fmt.Errorf("clients: class %q: rate_limit and burst must not be negative", cl.Name)
+		}
+		if _, err := parseCIDRs(cl.CIDRs); err != nil {
+			return fmt.Errorf("clients: class %q: %v", cl.Name, err)
+		}
+		seen[cl.Name] = true
+	}
+	return nil
+}
+
+// parseCIDRs parses networks, accepting bare addresses as single hosts.
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range cidrs {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("bad address %q", s)
+			}
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientClass is a configured class with its limiter and counters.
+type clientClass struct {
+	name  string
+	nets  []*net.IPNet
+	limit *tokenBucket
+	stats *classStats
+}
+
+// unclassified is the class of requests to a state built without a
+// classifier.
+var unclassified = &clientClass{name: directClass, stats: trafficStats.class(directClass)}
+
+// clientClassifier assigns requests to classes. It is built with each
+// state, so a reload resets the rate limiters but not the counters.
+type clientClassifier struct {
+	proxies []*net.IPNet
+	// rfc7239 reads Forwarded instead of X-Forwarded-For.
+	rfc7239 bool
+	classes []*clientClass
+	direct  *clientClass
+}
+
+func newClientClassifier(cfg ClientsConfig) (*clientClassifier, error) {
+	c := &clientClassifier{
+		direct:  &clientClass{name: directClass, stats: trafficStats.class(directClass)},
+		rfc7239: strings.EqualFold(cfg.ForwardedHeader, "Forwarded"),
+	}
+	var err error
+	if c.proxies, err = parseCIDRs(cfg.TrustedProxies); err != nil {
+		return nil, err
+	}
+	for _, cl := range cfg.Classes {
+		class := &clientClass{name: cl.Name, stats: trafficStats.class(cl.Name)}
+		if class.nets, err = parseCIDRs(cl.CIDRs); err != nil {
+			return nil, err
+		}
+		if cl.RateLimit > 0 {
+			class.limit = newTokenBucket(cl.RateLimit, cl.Burst)
+		}
+		if cl.Name == directClass {
+			c.direct = class
+			continue
+		}
+		c.classes = append(c.classes, class)
+	}
+	return c, nil
+}
+
+// classify returns the class of the client that made r. Without classes
+// or trusted proxies every client is direct and the address is not parsed.
+func (c *clientClassifier) classify(r *http.Request) *clientClass {
+	if c == nil {
+		return unclassified
+	}
+	if len(c.classes) == 0 && len(c.proxies) == 0 {
+		return c.direct
+	}
+	ip := c.clientIP(r)
+	if ip == nil {
+		return c.direct
+	}
+	for _, class := range c.classes {
+		if containsIP(class.nets, ip) {
+			return class
+		}
+	}
+	return c.direct
+}
+
+// trustedProxies returns the networks of the trusted proxies.
+func (c *clientClassifier) trustedProxies() []*net.IPNet {
+	if c == nil {
+		return nil
+	}
+	return c.proxies
+}
+
+// clientIP returns the address of the client, looking through trusted
+// proxies.
+func (c *clientClassifier) clientIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !containsIP(c.trustedProxies(), ip) {
+		return ip
+	}
+	// Proxies append the address they received the request from, so the
+	// client is the last untrusted hop; anything before it could have been
+	// sent by the client itself.
+	var hops []string
+	if c.rfc7239 {
+		hops = forwardedFor(r.Header.Values("Forwarded"))
+	} else {
+		hops = strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			break
+		}
+		ip = hop
+		if !containsIP(c.proxies, hop) {
+			break
+		}
+	}
+	return ip
+}
+
+// forwardedFor returns the for= node of each element of Forwarded headers
+// (RFC 7239), in order, without quotes and ports; an element without one
+// gives "". Like obfuscated and unknown nodes, that is not an address, so
+// it ends the walk through the hops as an unparsable X-Forwarded-For entry
+// does.
+func forwardedFor(values []string) []string {
+	var hops []string
+	for _, v := range values {
+		for _, elem := range strings.Split(v, ",") {
+			node := ""
+			for _, pair := range strings.Split(elem, ";") {
+				eq := strings.IndexByte(pair, '=')
+				if eq < 0 || !strings.EqualFold(strings.TrimSpace(pair[:eq]), "for") {
+					continue
+				}
+				node = strings.Trim(strings.TrimSpace(pair[eq+1:]), `"`)
+				if strings.HasPrefix(node, "[") {
+					// An IPv6 address, with or without a port.
+					if end := strings.IndexByte(node, ']'); end > 0 {
+						node = node[1:end]
+					}
+				} else if host, _, err := net.SplitHostPort(node); err == nil {
+					node = host
+				}
+			}
+			hops = append(hops, node)
+		}
+	}
+	return hops
+}
+
+// clientAddr returns the client that made r for logs: its address behind
+// the trusted proxies of the current state, or the peer address if it has
+// none.
+func clientAddr(r *http.Request) string {
+	if ip := currentState().clients.clientIP(r); ip != nil {
+		return ip.String()
+	}
+	return r.RemoteAddr
+}
+
+// tokenBucket is a rate limiter shared by a class.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	b := float64(burst)
+	if b == 0 {
+		b = rate
+	}
+	if b < 1 {
+		b = 1
+	}
+	return &tokenBucket{rate: rate, burst: b, tokens: b}
+}
+
+func (b *tokenBucket) allow(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.last.IsZero() {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// allow reports whether the class is within its rate limit.
+func (c *clientClass) allow(now time.Time) bool {
+	return c.limit == nil || c.limit.allow(now)
+}
+
+// Outcomes of an OCSP request, as counted per class.
+const (
+	outcomeCached = iota
+	outcomeSlow
+	outcomeRejected
+	outcomeLimited
+	outcomeMaintenance
+	numOutcomes
+)
+
+var outcomeNames = [numOutcomes]string{"cached", "slow", "rejected", "limited", "maintenance"}
+
+// latencyBuckets are the upper bounds of the latency histogram; the last
+// bucket counts everything slower.
+var latencyBuckets = [...]time.Duration{
+	time.Millisecond, 5 * time.Millisecond, 25 * time.Millisecond,
+	100 * time.Millisecond, 500 * time.Millisecond, 2500 * time.Millisecond,
+}
+
+// classStats are the counters of one class, updated atomically so the
+// fast path stays lock-free.
+type classStats struct {
+	requests  int64
+	bytesIn   int64
+	outcomes  [numOutcomes]int64
+	latency   [len(latencyBuckets) + 1]int64
+	totalNano int64
+}
+
+func (s *classStats) record(outcome int, size int, took time.Duration) {
+	atomic.AddInt64(&s.requests, 1)
+	atomic.AddInt64(&s.bytesIn, int64(size))
+	atomic.AddInt64(&s.outcomes[outcome], 1)
+	atomic.AddInt64(&s.totalNano, int64(took))
+	i := 0
+	for i < len(latencyBuckets) && took > latencyBuckets[i] {
+		i++
+	}
+	atomic.AddInt64(&s.latency[i], 1)
+}
+
+// trafficStats holds the counters of every class seen since startup.
+var trafficStats = &trafficCounters{since: time.Now(), classes: make(map[string]*classStats)}
+
+type trafficCounters struct {
+	mu      sync.Mutex
+	since   time.Time
+	classes map[string]*classStats
+}
+
+// class returns the counters of the named class, creating them.
+func (t *trafficCounters) class(name string) *classStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s, ok := t.classes[name]
+	if !ok {
+		s = new(classStats)
+		t.classes[name] = s
+	}
+	return s
+}
+
+// classReport is the JSON form of a class's counters.
+type classReport struct {
+	Requests int64            `json:"requests"`
+	BytesIn  int64            `json:"bytes_in"`
+	Outcomes map[string]int64 `json:"outcomes"`
+	// Latency counts requests by upper bound, cumulatively, with "+Inf"
+	// counting all of them.
+	Latency       map[string]int64 `json:"latency"`
+	MeanLatencyMs float64          `json:"mean_latency_ms"`
+}
+
+func (s *classStats) report() classReport {
+	r := classReport{
+		Requests: atomic.LoadInt64(&s.requests),
+		BytesIn:  atomic.LoadInt64(&s.bytesIn),
+		Outcomes: make(map[string]int64),
+		Latency:  make(map[string]int64),
+	}
+	for i, name := range outcomeNames {
+		r.Outcomes[name] = atomic.LoadInt64(&s.outcomes[i])
+	}
+	var cumulative int64
+	for i := range s.latency {
+		cumulative += atomic.LoadInt64(&s.latency[i])
+		bound := "+Inf"
+		if i < len(latencyBuckets) {
+			bound = latencyBuckets[i].String()
+		}
+		r.Latency[bound] = cumulative
+	}
+	if r.Requests > 0 {
+		r.MeanLatencyMs = float64(atomic.LoadInt64(&s.totalNano)) / float64(r.Requests) / 1e6
+	}
+	return r
+}
+
+// trafficHandler serves /admin/v1/traffic, the OCSP counters per class.
+func trafficHandler(w http.ResponseWriter, r *http.Request) {
+	trafficStats.mu.Lock()
+	report := struct {
+		Since   time.Time              `json:"since"`
+		Classes map[string]classReport `json:"classes"`
+		// Protocols counts every request of the main listener by
+		// protocol; see protocols.go.
+		Protocols map[string]protocolReport `json:"protocols"`
+	}{Since: trafficStats.since, Classes: make(map[string]classReport), Protocols: protocolReports()}
+	for name, s := range trafficStats.classes {
+		report.Classes[name] = s.report()
+	}
+	trafficStats.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(report)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	xff, err := newClientClassifier(ClientsConfig{TrustedProxies: []string{"10.0.0.0/8", "2001:db8:ffff::/48"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rfc7239, err := newClientClassifier(ClientsConfig{TrustedProxies: []string{"10.0.0.0/8", "2001:db8:ffff::/48"}, ForwardedHeader: "forwarded"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name   string
+		c      *clientClassifier
+		remote string
+		header []string
+		want   string
+	}{
+		{"untrusted peer", xff, "192.0.2.1:1234", []string{"198.51.100.7"}, "192.0.2.1"},
+		{"trusted peer without a header", xff, "10.0.0.1:1234", nil, "10.0.0.1"},
+		{"one hop", xff, "10.0.0.1:1234", []string{"198.51.100.7"}, "198.51.100.7"},
+		{"trusted hops", xff, "10.0.0.1:1234", []string{"198.51.100.7, 10.0.0.3,10.0.0.2"}, "198.51.100.7"},
+		{"spoofed before an untrusted hop", xff, "10.0.0.1:1234", []string{"203.0.113.9, 198.51.100.7, 10.0.0.2"}, "198.51.100.7"},
+		{"trusted address spoofed before an untrusted hop", xff, "10.0.0.1:1234", []string{"10.0.0.9, 198.51.100.7"}, "198.51.100.7"},
+		{"chain across headers", xff, "10.0.0.1:1234", []string{"203.0.113.9, 198.51.100.7", "10.0.0.2"}, "198.51.100.7"},
+		{"garbage ends the walk", xff, "10.0.0.1:1234", []string{"198.51.100.7, junk, 10.0.0.2"}, "10.0.0.2"},
+		{"IPv6 hops", xff, "[2001:db8:ffff::1]:1234", []string{"2001:db8::7, 2001:db8:ffff::2"}, "2001:db8::7"},
+		{"Forwarded is not read", xff, "10.0.0.1:1234", nil, "10.0.0.1"},
+		{"Forwarded", rfc7239, "10.0.0.1:1234", []string{"for=198.51.100.7"}, "198.51.100.7"},
+		{"Forwarded quoted IPv6 with a port", rfc7239, "10.0.0.1:1234", []string{`for="[2001:db8::7]:4711";proto=https`}, "2001:db8::7"},
+		{"Forwarded quoted IPv6", rfc7239, "10.0.0.1:1234", []string{`For="[2001:db8::7]"`}, "2001:db8::7"},
+		{"Forwarded IPv4 with a port", rfc7239, "10.0.0.1:1234", []string{`for="198.51.100.7:4711"`}, "198.51.100.7"},
+		{"Forwarded chain", rfc7239, "10.0.0.1:1234", []string{"for=203.0.113.9, for=198.51.100.7;by=10.0.0.2", "for=10.0.0.2"}, "198.51.100.7"},
+		{"Forwarded obfuscated node", rfc7239, "10.0.0.1:1234", []string{"for=198.51.100.7, for=_hidden, for=10.0.0.2"}, "10.0.0.2"},
+		{"Forwarded element without for", rfc7239, "10.0.0.1:1234", []string{"for=198.51.100.7, proto=https"}, "10.0.0.1"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tc.remote
+			header := "X-Forwarded-For"
+			if tc.c.rfc7239 {
+				header = "Forwarded"
+			}
+			for _, v := range tc.header {
+				r.Header.Add(header, v)
+			}
+			if got := tc.c.clientIP(r); got.String() != tc.want {
+				t.Errorf("clientIP = %v, want %s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestForwardedFor(t *testing.T) {
+	got := forwardedFor([]string{
+		`for=192.0.2.60;proto=http;by=203.0.113.43`,
+		`For="[2001:db8:cafe::17]:4711", for=unknown, proto=https`,
+		`for="_gazonk"; by=10.0.0.1`,
+	})
+	want := []string{"192.0.2.60", "2001:db8:cafe::17", "unknown", "", "_gazonk"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("forwardedFor = %q, want %q", got, want)
+	}
+}
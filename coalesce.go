@@ -0,0 +1,75 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pkkemp/GoOCSPResponder/responder"
+)
+
+// flightGroup coalesces concurrent identical cache misses: the first signs
+// the response and the others wait for it, so a burst of requests for one
+// certificate after a refresh costs one signature, not one per request.
+// It is golang.org/x/sync/singleflight, reduced to what the slow path
+// needs. Each response cache has its own, so a flight never outlives the
+// answers it was signed from.
+type flightGroup struct {
+	mu      sync.Mutex
+	flights map[string]*flight
+	stats   *cacheStats
+}
+
+type flight struct {
+	done  chan struct{}
+	der   []byte
+	entry *cachedResponse
+}
+
+func newFlightGroup(stats *cacheStats) *flightGroup {
+	return &flightGroup{flights: make(map[string]*flight), stats: stats}
+}
+
+// do runs fn for key unless a call for key is in flight, in which case it
+// waits for that call's result instead. shared reports the latter.
+func (g *flightGroup) do(key string, fn func() ([]byte, *cachedResponse)) (der []byte, e *cachedResponse, shared bool) {
+	g.mu.Lock()
+	if f, ok := g.flights[key]; ok {
+		g.mu.Unlock()
+		atomic.AddInt64(&g.stats.coalesced, 1)
+		<-f.done
+		return f.der, f.entry, true
+	}
+	f := &flight{done: make(chan struct{})}
+	g.flights[key] = f
+	g.mu.Unlock()
+
+	defer func() {
+		g.mu.Lock()
+		delete(g.flights, key)
+		g.mu.Unlock()
+		close(f.done)
+	}()
+	f.der, f.entry = fn()
+	return f.der, f.entry, false
+}
+
+// coalesceKey identifies the answer to req: its CertID, which names the
+// issuer, the hash algorithm and the serial, and the issuer restriction.
+// Only requests whose response is cached, a single CertID without
+// extensions, are coalesced; the others get responses of their own.
+func coalesceKey(body []byte, req *responder.Request, only string) (string, bool) {
+	if body == nil || len(req.Extensions) > 0 || len(req.CertIDs) != 1 {
+		return "", false
+	}
+	id := req.CertIDs[0]
+	key := make([]byte, 0, 8+len(id.NameHash)+len(id.KeyHash)+20+len(only))
+	key = strconv.AppendUint(key, uint64(id.HashAlgorithm), 10)
+	key = append(key, '/')
+	key = append(key, id.NameHash...)
+	key = append(key, id.KeyHash...)
+	key = append(key, id.SerialNumber.Bytes()...)
+	key = append(key, '/')
+	key = append(key, only...)
+	return string(key), true
+}
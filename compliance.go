@@ -0,0 +1,226 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The compliance self-report evaluates the running configuration against
+// a built-in checklist of the settings accreditation reviews ask about, so
+// their evidence comes from the responder itself rather than from copies
+// of its configuration.
+
+// Outcomes of a compliance check.
+const (
+	compliancePass = "pass"
+	complianceFail = "fail"
+	// complianceNA is a check whose subject is not configured, such as the
+	// TLS policy without TLS listeners.
+	complianceNA = "not_applicable"
+)
+
+// complianceCheck is one check of GET /admin/v1/compliance.
+type complianceCheck struct {
+	ID     string `json:"id"`
+	Title  string `json:"title"`
+	Status string `json:"status"`
+	Detail string `json:"detail"`
+}
+
+// complianceChecks is the checklist, in report order. Each check returns
+// its status and what it found.
+var complianceChecks = []struct {
+	id, title string
+	check     func(st *state) (string, string)
+}{
+	{"fips", "Cryptography runs in a FIPS validated module in FIPS mode", checkFIPSCompliance},
+	{"responder_key", "The responder signs with an approved key", checkResponderKey},
+	{"responder_authorized", "The responder key is each issuer's own or a delegated OCSP signer's", checkResponderAuthorized},
+	{"tls_policy", "TLS listeners offer TLS 1.2 or later with AEAD cipher suites only", checkTLSPolicy},
+	{"admin_auth", "The admin API requires authentication", checkAdminAuth},
+	{"dashboard_auth", "The dashboard requires authentication", checkDashboardAuth},
+	{"audit_logging", "Admin requests are written to the audit log", checkAuditLogging},
+	{"crl_signatures", "CRL signatures are verified, and SHA-1 signatures refused", checkCRLSignatures},
+}
+
+func checkFIPSCompliance(st *state) (string, string) {
+	backend, enabled := fipsBackend()
+	switch {
+	case !st.cfg.FIPS:
+		return complianceFail, "fips is not set; the " + backend + " is not required to be in FIPS mode"
+	case !enabled:
+		return complianceFail, "fips is set but the " + backend + " is not operating in FIPS mode"
+	}
+	return compliancePass, "the " + backend + " is operating in FIPS mode, as fips requires"
+}
+
+func checkResponderKey(st *state) (string, string) {
+	if st.signer == nil {
+		return complianceNA, "no responder key is configured"
+	}
+	for _, s := range []struct {
+		name string
+		cert *x509.Certificate
+	}{{"responder key", st.signer.Cert}, {"next responder key", nextSignerCert(st)}} {
+		if s.cert == nil {
+			continue
+		}
+		if err := fipsApprovedKey(s.cert.PublicKey); err != nil {
+			return complianceFail, fmt.Sprintf("%s: %v", s.name, err)
+		}
+	}
+	return compliancePass, fmt.Sprintf("%s key of %s", publicKeyName(st.signer.Cert), printableName(st.signer.Cert.Subject.CommonName))
+}
+
+func checkResponderAuthorized(st *state) (string, string) {
+	if st.signer == nil {
+		return complianceNA, "no responder key is configured"
+	}
+	unauthorized := st.signerAuthorization(time.Now())
+	if len(unauthorized) == 0 {
+		return compliancePass, fmt.Sprintf("authorized for all %d issuers", len(st.crls))
+	}
+	var problems []string
+	for key, why := range unauthorized {
+		problems = append(problems, key+": "+why)
+	}
+	sort.Strings(problems)
+	return complianceFail, strings.Join(problems, "; ")
+}
+
+func nextSignerCert(st *state) *x509.Certificate {
+	if st.nextSigner == nil {
+		return nil
+	}
+	return st.nextSigner.Cert
+}
+
+// publicKeyName describes the algorithm and size of the key of cert.
+func publicKeyName(cert *x509.Certificate) string {
+	switch k := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		return fmt.Sprintf("%d-bit RSA", k.N.BitLen())
+	case *ecdsa.PublicKey:
+		return "ECDSA " + k.Curve.Params().Name
+	}
+	return cert.PublicKeyAlgorithm.String()
+}
+
+func checkTLSPolicy(st *state) (string, string) {
+	reports := tlsReports()
+	if len(reports) == 0 {
+		return complianceNA, "no TLS listener is served"
+	}
+	var problems, listeners []string
+	for _, r := range reports {
+		listeners = append(listeners, fmt.Sprintf("%s (%s)", r.Listener, strings.Join(r.Versions, ", ")))
+		for _, s := range r.CipherSuites {
+			if !strings.Contains(s, "_GCM_") && !strings.Contains(s, "_CHACHA20_POLY1305_") {
+				problems = append(problems, r.Listener+" offers "+s)
+			}
+		}
+	}
+	if len(problems) > 0 {
+		return complianceFail, strings.Join(problems, "; ")
+	}
+	return compliancePass, strings.Join(listeners, "; ")
+}
+
+func checkAdminAuth(st *state) (string, string) {
+	var via []string
+	if st.cfg.adminToken != "" {
+		via = append(via, "a bearer token")
+	}
+	if dashboardAuthEnabled() {
+		via = append(via, "dashboard operators ("+st.cfg.Dashboard.Auth+")")
+	}
+	if len(via) == 0 {
+		return complianceNA, "the admin API is disabled"
+	}
+	return compliancePass, "operators authenticate with " + strings.Join(via, " or ")
+}
+
+func checkDashboardAuth(st *state) (string, string) {
+	switch st.cfg.Dashboard.Auth {
+	case "", "none":
+		return complianceFail, "dashboard.auth is none: the dashboard is public"
+	case "mtls":
+		return compliancePass, "client certificates chaining to dashboard.tls.client_ca"
+	}
+	return compliancePass, "OpenID Connect sign-in with " + st.cfg.Dashboard.OIDC.Issuer
+}
+
+func checkAuditLogging(st *state) (string, string) {
+	if st.cfg.adminToken == "" && !dashboardAuthEnabled() {
+		return complianceNA, "the admin API is disabled"
+	}
+	detail := "admin requests, denials and sign-ins are logged with an audit: prefix"
+	if st.cfg.Events.Bus != "" {
+		detail += "; revocations are published to " + st.cfg.Events.Bus
+	}
+	return compliancePass, detail
+}
+
+func checkCRLSignatures(st *state) (string, string) {
+	var problems []string
+	for _, algo := range []struct {
+		algo x509.SignatureAlgorithm
+		name string
+	}{{x509.SHA1WithRSA, "SHA1-RSA"}, {x509.ECDSAWithSHA1, "ECDSA-SHA1"}} {
+		if forbiddenAlgorithm(st.cfg, algo.algo, algo.name) == "" {
+			problems = append(problems, algo.name+" CRL signatures are accepted")
+		}
+	}
+	var quarantined []string
+	for key, f := range st.filters {
+		if f.quarantine != "" && !f.pending {
+			quarantined = append(quarantined, key+": "+f.quarantine)
+		}
+	}
+	sort.Strings(quarantined)
+	if len(problems) > 0 {
+		return complianceFail, strings.Join(problems, "; ")
+	}
+	detail := fmt.Sprintf("every CRL is verified against its CA before it is indexed; %d of %d quarantined", len(quarantined), len(st.filters))
+	if len(quarantined) > 0 {
+		detail += " (" + strings.Join(quarantined, "; ") + ")"
+	}
+	return compliancePass, detail
+}
+
+// complianceReport is GET /admin/v1/compliance.
+type complianceReport struct {
+	GeneratedAt time.Time `json:"generated_at"`
+	Version     string    `json:"version"`
+	// Compliant is true when no check failed.
+	Compliant bool              `json:"compliant"`
+	Checks    []complianceCheck `json:"checks"`
+}
+
+// evaluateCompliance runs the checklist against st.
+func evaluateCompliance(st *state) complianceReport {
+	r := complianceReport{GeneratedAt: time.Now().UTC(), Version: softwareVersion(), Compliant: true}
+	for _, c := range complianceChecks {
+		status, detail := c.check(st)
+		if status == complianceFail {
+			r.Compliant = false
+		}
+		r.Checks = append(r.Checks, complianceCheck{ID: c.id, Title: c.title, Status: status, Detail: detail})
+	}
+	return r
+}
+
+// complianceHandler serves GET /admin/v1/compliance.
+func complianceHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(evaluateCompliance(currentState()))
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// CompressionConfig gzips the responses of the JSON APIs, the dashboard
+// and the exports for clients that accept it. OCSP responses are never
+// compressed: they are small, signed DER, and clients do not expect it.
+// Brotli is not offered, as the standard library has no encoder for it.
+type CompressionConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// MinSize is the smallest body compressed, in bytes; below it gzip
+	// saves too little to be worth it.
+	MinSize int `yaml:"min_size"`
+	// MinSizes overrides MinSize by path prefix, such as /stats; the
+	// longest matching prefix applies.
+	MinSizes map[string]int `yaml:"min_sizes"`
+	// Level is the gzip level, 1 (fastest) to 9 (smallest), or -1 for
+	// the default.
+	Level int `yaml:"level"`
+}
+
+func (c CompressionConfig) validate() error {
+	if c.MinSize < 0 {
+		return errors.New("compression: min_size must not be negative")
+	}
+	for p, n := range c.MinSizes {
+		if !strings.HasPrefix(p, "/") || n < 0 {
+			return fmt.Errorf("compression: min_sizes: %q must be a path with a size not negative", p)
+		}
+	}
+	if c.Level != gzip.DefaultCompression && (c.Level < gzip.BestSpeed || c.Level > gzip.BestCompression) {
+		return fmt.Errorf("compression: level %d is not between 1 and 9, or -1", c.Level)
+	}
+	return nil
+}
+
+// minSize is the smallest body compressed for path.
+func (c CompressionConfig) minSize(path string) int {
+	n, longest := c.MinSize, -1
+	for p, size := range c.MinSizes {
+		if strings.HasPrefix(path, p) && len(p) > longest {
+			n, longest = size, len(p)
+		}
+	}
+	return n
+}
+
+// compressibleTypes are the media types worth compressing; everything
+// else, such as DER and images, is already dense.
+var compressibleTypes = map[string]bool{
+	"application/json":       true,
+	"application/x-ndjson":   true,
+	"application/javascript": true,
+	"application/xml":        true,
+	"image/svg+xml":          true,
+}
+
+func compressible(contentType string) bool {
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return strings.HasPrefix(mt, "text/") || compressibleTypes[mt]
+}
+
+// acceptsGzip reports whether the Accept-Encoding header admits gzip.
+func acceptsGzip(header string) bool {
+	for _, part := range strings.Split(header, ",") {
+		coding, params := part, ""
+		if i := strings.IndexByte(part, ';'); i >= 0 {
+			coding, params = part[:i], part[i+1:]
+		}
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding != "gzip" && coding != "x-gzip" && coding != "*" {
+			continue
+		}
+		q := 1.0
+		for _, p := range strings.Split(params, ";") {
+			if kv := strings.SplitN(strings.TrimSpace(p), "=", 2); len(kv) == 2 && strings.EqualFold(kv[0], "q") {
+				if v, err := strconv.ParseFloat(kv[1], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		return q > 0
+	}
+	return false
+}
+
+// gzipPools keep writers by level, offset by one for level -1.
+var gzipPools [gzip.BestCompression + 2]sync.Pool
+
+func getGzipWriter(w io.Writer, level int) *gzip.Writer {
+	if gz, ok := gzipPools[level+1].Get().(*gzip.Writer); ok {
+		gz.Reset(w)
+		return gz
+	}
+	gz, _ := gzip.NewWriterLevel(w, level)
+	return gz
+}
+
+// compressed wraps h with gzip compression as the current configuration
+// sets it.
+func compressed(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		st, _ := current.Load().(*state)
+		if st == nil || !st.cfg.Compression.Enabled {
+			h(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Accept-Encoding")
+		if r.Method == http.MethodHead || !acceptsGzip(r.Header.Get("Accept-Encoding")) {
+			h(w, r)
+			return
+		}
+		c := st.cfg.Compression
+		cw := &compressWriter{ResponseWriter: w, min: c.minSize(r.URL.Path), level: c.Level}
+		defer cw.close()
+		h(cw, r)
+	}
+}
+
+// compressWriter buffers the start of a body until it knows whether to
+// compress it: the body must reach the minimum size and be of a
+// compressible type.
+type compressWriter struct {
+	http.ResponseWriter
+	min, level int
+	status     int
+	buf        bytes.Buffer
+	// decided is set once the body is passed through or compressed into
+	// gz.
+	decided bool
+	gz      *gzip.Writer
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	if cw.status == 0 {
+		cw.status = status
+	}
+}
+
+func (cw *compressWriter) Write(p []byte) (int, error) {
+	if cw.status == 0 {
+		cw.status = http.StatusOK
+	}
+	if !cw.decided {
+		cw.buf.Write(p)
+		if cw.buf.Len() < cw.min {
+			return len(p), nil
+		}
+		if err := cw.decide(true); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+	if cw.gz != nil {
+		return cw.gz.Write(p)
+	}
+	return cw.ResponseWriter.Write(p)
+}
+
+// decide sends the header and the buffered body, compressed if big is set
+// and the response qualifies.
+func (cw *compressWriter) decide(big bool) error {
+	cw.decided = true
+	hdr := cw.Header()
+	if hdr.Get("Content-Type") == "" && cw.buf.Len() > 0 {
+		hdr.Set("Content-Type", http.DetectContentType(cw.buf.Bytes()))
+	}
+	if big && cw.status == http.StatusOK && hdr.Get("Content-Encoding") == "" && hdr.Get("Content-Range") == "" && compressible(hdr.Get("Content-Type")) {
+		hdr.Set("Content-Encoding", "gzip")
+		hdr.Del("Content-Length")
+		cw.gz = getGzipWriter(cw.ResponseWriter, cw.level)
+	}
+	cw.ResponseWriter.WriteHeader(cw.status)
+	var err error
+	if cw.gz != nil {
+		_, err = cw.gz.Write(cw.buf.Bytes())
+	} else if cw.buf.Len() > 0 {
+		_, err = cw.ResponseWriter.Write(cw.buf.Bytes())
+	}
+	cw.buf = bytes.Buffer{}
+	return err
+}
+
+// Flush sends what is buffered, uncompressed if the body is still under
+// the minimum size; streamed responses should not wait for it.
+func (cw *compressWriter) Flush() {
+	if !cw.decided {
+		if cw.status == 0 {
+			cw.status = http.StatusOK
+		}
+		cw.decide(false)
+	}
+	if cw.gz != nil {
+		cw.gz.Flush()
+	}
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (cw *compressWriter) close() {
+	if !cw.decided {
+		if cw.status == 0 {
+			// Nothing was written; the server answers 200 with no body.
+			return
+		}
+		cw.decide(false)
+	}
+	if cw.gz != nil {
+		cw.gz.Close()
+		gzipPools[cw.level+1].Put(cw.gz)
+	}
+}
@@ -0,0 +1,651 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the responder configuration, normally read from a YAML file
+// given with --config. Everything except Listen can be changed at runtime;
+// see reload.go.
+type Config struct {
+	Listen string `yaml:"listen"`
+	// Profile is the PKI served, dod by default, or none; see profile.go.
+	// It and Roots are read at startup only.
+	Profile string `yaml:"profile"`
+	// Roots is a PEM file of trust anchors, added to the profile's.
+	Roots string `yaml:"roots"`
+	// CacheDir is the directory of the cached bundle, CRLs and indexes
+	// when --cache is not given; it defaults to defaultCacheDir. It is
+	// read at startup only.
+	CacheDir string `yaml:"cache_dir"`
+	// BundleURL and CRLBaseURL default to the profile's.
+	BundleURL  string `yaml:"bundle_url"`
+	CRLBaseURL string `yaml:"crl_base_url"`
+	// Issuers restricts the served CAs to these common names. Empty means
+	// every issuing CA in the bundle that chains to a root.
+	Issuers []string `yaml:"issuers"`
+	// TolerantParsing names the issuers whose CRLs are parsed tolerantly,
+	// or holds "*" for all; see tolerant.go.
+	TolerantParsing []string `yaml:"tolerant_parsing"`
+	// IssuerAliases are extra names for served issuers, usable wherever an
+	// issuer is named: URLs, API parameters, routes and the CLI; see
+	// issuers.go.
+	IssuerAliases map[string]string `yaml:"issuer_aliases"`
+	// Routes dedicate URL paths to single issuers; see routes.go.
+	Routes []Route `yaml:"routes"`
+	// Canaries are serials with fixed answers for monitors; see canary.go.
+	Canaries []Canary `yaml:"canaries"`
+	// Freshness caps the validity of answers by issuer attributes; see
+	// freshness.go.
+	Freshness []FreshnessRule `yaml:"freshness"`
+	// Discovery serves unknown issuers found in a CA repository; see
+	// discovery.go.
+	Discovery DiscoveryConfig `yaml:"discovery"`
+	// Clients classifies OCSP clients; see clients.go.
+	Clients ClientsConfig `yaml:"clients"`
+	// CertID sets how CertIDs are matched to issuers; see certid.go.
+	CertID CertIDConfig `yaml:"cert_id"`
+
+	Signer  SignerConfig  `yaml:"signer"`
+	Reload  ReloadConfig  `yaml:"reload"`
+	Refresh RefreshConfig `yaml:"refresh"`
+	Storage StorageConfig `yaml:"storage"`
+	// Redirects limits the redirects followed by http(s) downloads.
+	Redirects RedirectConfig `yaml:"redirects"`
+	Admin     AdminConfig    `yaml:"admin"`
+	// Dashboard is read at startup only.
+	Dashboard DashboardConfig `yaml:"dashboard"`
+	Cache     CacheConfig     `yaml:"cache"`
+	Archive   ArchiveConfig   `yaml:"archive"`
+	Index     IndexConfig     `yaml:"index"`
+
+	Quarantine QuarantineConfig `yaml:"quarantine"`
+	// Events is read at startup only.
+	Events EventsConfig `yaml:"events"`
+	// Region is read at startup only.
+	Region      RegionConfig      `yaml:"region"`
+	Attestation AttestationConfig `yaml:"attestation"`
+	// Standby is read at startup only.
+	Standby StandbyConfig `yaml:"standby"`
+
+	SignedRequests SignedRequestsConfig `yaml:"signed_requests"`
+
+	// MirrorCheck compares crl_base_url with the authoritative CRLs.
+	MirrorCheck MirrorCheckConfig `yaml:"mirror_check"`
+
+	// Blocklist is the emergency blocklist; see blocklist.go.
+	Blocklist BlocklistConfig `yaml:"blocklist"`
+	// Cascade answers revoked under revoked CAs; see cascade.go.
+	Cascade CascadeConfig `yaml:"cascade"`
+
+	// Expired suppresses the answers of expired certificates; see
+	// expired.go.
+	Expired ExpiredConfig `yaml:"expired"`
+
+	// Cadence adapts the nextUpdate of answers; see cadence.go.
+	Cadence CadenceConfig `yaml:"cadence"`
+
+	// Compression gzips API and dashboard responses; see compress.go.
+	Compression CompressionConfig `yaml:"compression"`
+
+	// Gossip checks responses third parties submit; see gossip.go.
+	Gossip GossipConfig `yaml:"gossip"`
+	// BatchSigning serves batches of signed responses to external
+	// pipelines; see batch.go.
+	BatchSigning BatchSigningConfig `yaml:"batch_signing"`
+	// Capture keeps the latest OCSP exchanges for debugging; see
+	// capture.go.
+	Capture CaptureConfig `yaml:"capture"`
+	// Watchdog reports leaks, deadlocks and stalled background loops; see
+	// watchdog.go.
+	Watchdog WatchdogConfig `yaml:"watchdog"`
+
+	// OfflineImport is read by goocsp import; see offline.go.
+	OfflineImport OfflineImportConfig `yaml:"offline_import"`
+
+	// Consistency checks indexes against their CRLs; see consistency.go.
+	Consistency ConsistencyConfig `yaml:"consistency"`
+
+	// Staples exports responses for TLS servers; see staples.go.
+	Staples StaplesConfig `yaml:"staples"`
+
+	// Startup bounds the wait for CRLs at startup; see startup.go.
+	Startup StartupConfig `yaml:"startup"`
+
+	// TLSCheck watches the certificates HTTPS clients are presented; see
+	// tlscheck.go.
+	TLSCheck TLSCheckConfig `yaml:"tls_check"`
+	// TLSPolicy is the default protocol policy of the TLS listeners; see
+	// tlspolicy.go. It is read at startup only.
+	TLSPolicy TLSPolicy `yaml:"tls_policy"`
+
+	// Maintenance sets the defaults of maintenance mode; see
+	// maintenance.go.
+	Maintenance MaintenanceConfig `yaml:"maintenance"`
+	// Freeze bounds the freezes of issuers at a CRL; see freeze.go.
+	Freeze FreezeConfig `yaml:"freeze"`
+
+	// Peers compares this instance with the others of its pool; see
+	// peers.go.
+	Peers PeersConfig `yaml:"peers"`
+
+	// Router shards issuers across worker processes; see shards.go. Only
+	// goocsp router reads it.
+	Router RouterConfig `yaml:"router"`
+
+	// DPProbes probes the CRL distribution points and picks the mirror
+	// CRLs are fetched from; see dpprobe.go.
+	DPProbes DPProbeConfig `yaml:"dp_probes"`
+
+	// RequestFlags routes requests from trusted proxies through
+	// experimental code paths; see flags.go.
+	RequestFlags RequestFlagsConfig `yaml:"request_flags"`
+
+	// AIA is where the responder and its CAs' certificates are published;
+	// see aia.go.
+	AIA AIAConfig `yaml:"aia"`
+
+	// Limits bounds the size of CRLs; see limits.go.
+	Limits LimitsConfig `yaml:"crl_limits"`
+
+	// CrlID adds the CRL behind each answer to the response; see crlid.go.
+	CrlID CrlIDConfig `yaml:"crl_id"`
+
+	SubjectIndex SubjectIndexConfig `yaml:"subject_index"`
+
+	// FIPS requires FIPS mode of the cryptographic module and approved
+	// algorithms; see fips.go.
+	FIPS bool `yaml:"fips"`
+
+	// AlertWebhook, when set, receives a JSON POST for every alert.
+	AlertWebhook string `yaml:"alert_webhook"`
+
+	// hash identifies the file contents this configuration came from.
+	hash [sha256.Size]byte
+	// adminToken is the contents of Admin.TokenFile.
+	adminToken string
+	// fetchers download bundle_url and crl_base_url, by URL scheme.
+	fetchers map[string]Fetcher
+}
+
+// SignerConfig names the PEM responder certificate and key.
+type SignerConfig struct {
+	Cert string `yaml:"cert"`
+	Key  string `yaml:"key"`
+	// AllowUndelegated names the issuers, by CRL name or common name or
+	// "*" for all, whose responses the keys may sign without being the
+	// CA's or a delegated responder's. Any other such issuer makes the
+	// configuration invalid; see delegation.go.
+	AllowUndelegated []string `yaml:"allow_undelegated"`
+
+	// Next is the key being migrated to; see migration.go.
+	Next SignerMigrationConfig `yaml:"next"`
+}
+
+// ReloadConfig controls config file watching and post-apply health checks.
+type ReloadConfig struct {
+	PollInterval   time.Duration `yaml:"poll_interval"`
+	HealthWindow   time.Duration `yaml:"health_window"`
+	HealthInterval time.Duration `yaml:"health_interval"`
+}
+
+// RefreshConfig schedules background CRL refreshes.
+type RefreshConfig struct {
+	// Interval is how often each CRL is refreshed. Each issuer refreshes at
+	// its own fixed offset within the interval.
+	Interval time.Duration `yaml:"interval"`
+	// JitterSeed seeds the per-issuer offsets; it defaults to the host
+	// name so instances sharing a proxy spread out rather than align.
+	JitterSeed string `yaml:"jitter_seed"`
+	// MaxBytesPerSecond caps the combined download rate; 0 is unlimited.
+	MaxBytesPerSecond int64 `yaml:"max_bytes_per_second"`
+	// Surge refreshes issuers faster after a revocation surge; see
+	// surge.go.
+	Surge SurgeConfig `yaml:"surge"`
+}
+
+// CacheConfig sizes the pre-signed response cache and the slow path that
+// signs responses on a miss.
+type CacheConfig struct {
+	// MaxEntries bounds the number of cached responses; 0 disables the
+	// cache.
+	MaxEntries int `yaml:"max_entries"`
+	// TTL is how long a response is served from cache at most. Responses
+	// are never served past their nextUpdate either.
+	TTL time.Duration `yaml:"ttl"`
+	// SlowPathConcurrency bounds the cache misses signed at once.
+	SlowPathConcurrency int `yaml:"slow_path_concurrency"`
+	// SlowPathWait is how long a miss waits for a slot before it is
+	// answered with tryLater.
+	SlowPathWait time.Duration `yaml:"slow_path_wait"`
+
+	// Policy decides what happens once the cache is full: none refuses new
+	// responses until cached ones expire, lru evicts those used least
+	// recently, lfu those used least often and ttl those expiring first;
+	// see cachepolicy.go.
+	Policy string `yaml:"policy"`
+	// Prewarm is how many of an issuer's most requested responses are
+	// signed from its new CRL before the old ones are dropped; 0 signs
+	// none. See prewarm.go.
+	Prewarm int `yaml:"prewarm"`
+}
+
+// AdminConfig protects the /admin API. Without a token file the admin API
+// is disabled.
+type AdminConfig struct {
+	// TokenFile holds the bearer token admin requests must present.
+	TokenFile string `yaml:"token_file"`
+}
+
+// SubjectIndexConfig enables the subject reverse lookup index, built from
+// CA database exports since CRLs carry no subject information.
+type SubjectIndexConfig struct {
+	Enabled bool            `yaml:"enabled"`
+	Exports []SubjectExport `yaml:"exports"`
+}
+
+// SubjectExport is a CA database export for one issuer: an openssl
+// index.txt, or a CSV file (by .csv extension) with serial, subject and
+// optionally upn columns.
+type SubjectExport struct {
+	// Issuer names the CA as the explain endpoint accepts it: CRL name,
+	// fingerprint, common name or subject.
+	Issuer string `yaml:"issuer"`
+	Path   string `yaml:"path"`
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		Listen:  ":8080",
+		Profile: "dod",
+		Reload: ReloadConfig{
+			PollInterval:   10 * time.Second,
+			HealthWindow:   time.Minute,
+			HealthInterval: 10 * time.Second,
+		},
+		Refresh: RefreshConfig{
+			Interval: time.Hour,
+			Surge: SurgeConfig{
+				Enabled:        true,
+				MinRevocations: 1000,
+				Factor:         10,
+				Interval:       5 * time.Minute,
+				Duration:       6 * time.Hour,
+			},
+		},
+		Redirects: RedirectConfig{
+			Max: 10,
+		},
+		Index: IndexConfig{
+			// The size of the default filter.
+			Bloom: BloomConfig{BloomLimits: BloomLimits{MaxBytes: 20 * 1000000 / 8}},
+			Build: BuildConfig{Workers: 4, ChunkSize: 65536},
+		},
+		Cache: CacheConfig{
+			MaxEntries:          100000,
+			TTL:                 time.Hour,
+			SlowPathConcurrency: 4 * runtime.NumCPU(),
+			SlowPathWait:        2 * time.Second,
+			Policy:              "none",
+		},
+		Archive: ArchiveConfig{
+			Retention: 90 * 24 * time.Hour,
+		},
+		Compression: CompressionConfig{
+			Enabled: true,
+			MinSize: 1024,
+			Level:   -1,
+		},
+		Gossip: GossipConfig{
+			Retention:  7 * 24 * time.Hour,
+			MaxEntries: 1000000,
+		},
+		BatchSigning: BatchSigningConfig{
+			MaxItems: 1000,
+		},
+		Capture: CaptureConfig{
+			Size: 256,
+		},
+		Watchdog: WatchdogConfig{
+			Enabled:       true,
+			Interval:      30 * time.Second,
+			MaxGoroutines: 10000,
+			Stall:         30 * time.Minute,
+			LockWait:      5 * time.Minute,
+		},
+		Cadence: CadenceConfig{
+			MinSamples:  3,
+			Margin:      10 * time.Minute,
+			MinValidity: time.Hour,
+		},
+		SignedRequests: SignedRequestsConfig{
+			Workers:   runtime.NumCPU(),
+			QueueWait: 2 * time.Second,
+		},
+		Events: EventsConfig{
+			RetryInterval: 30 * time.Second,
+			BatchSize:     500,
+		},
+		Attestation: AttestationConfig{
+			Lifetime: 5 * time.Minute,
+		},
+		Consistency: ConsistencyConfig{
+			Interval: 5 * time.Minute,
+			Samples:  64,
+		},
+		Staples: StaplesConfig{
+			Format:   "haproxy",
+			Interval: time.Hour,
+		},
+		Startup: StartupConfig{
+			RetryInterval: 30 * time.Second,
+		},
+		Discovery: DiscoveryConfig{
+			MaxIssuers: 16,
+			MaxPerHour: 10,
+			Retry:      time.Hour,
+		},
+		TLSCheck: TLSCheckConfig{
+			CTSearchURL: "https://crt.sh/?serial=%s&output=json",
+		},
+		Maintenance: MaintenanceConfig{
+			RetryAfter: 5 * time.Minute,
+		},
+		Freeze: FreezeConfig{
+			Duration:    24 * time.Hour,
+			MaxDuration: 7 * 24 * time.Hour,
+		},
+		Peers: PeersConfig{
+			Interval: time.Minute,
+			Grace:    15 * time.Minute,
+		},
+		Router: RouterConfig{
+			Interval: 30 * time.Second,
+			Timeout:  5 * time.Second,
+		},
+		DPProbes: DPProbeConfig{
+			Timeout:   10 * time.Second,
+			FailAfter: 3,
+		},
+		RequestFlags: RequestFlagsConfig{
+			Header:      "GoOCSP-Flags",
+			TokenHeader: "GoOCSP-Flags-Token",
+		},
+		// Well above the largest DoD CRLs, some 100 MB with under two
+		// million entries.
+		Limits: LimitsConfig{CRLLimits: CRLLimits{MaxBytes: 512 << 20, MaxEntries: 10000000}},
+	}
+}
+
+// loadConfig reads path over the defaults. An empty path yields the
+// defaults.
+func loadConfig(path string) (*Config, error) {
+	cfg := defaultConfig()
+	if listenOverride != "" {
+		cfg.Listen = listenOverride
+	}
+	if path == "" {
+		if err := cfg.applyProfile(); err != nil {
+			return nil, err
+		}
+		cfg.fetchers = newFetchers(cfg.Storage, cfg.Redirects)
+		return cfg, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := yaml.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	cfg.hash = sha256.Sum256(data)
+	if listenOverride != "" {
+		cfg.Listen = listenOverride
+	}
+	if err := cfg.applyProfile(); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if cfg.Admin.TokenFile != "" {
+		if cfg.adminToken, err = readToken(cfg.Admin.TokenFile); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Region.TokenFile != "" {
+		if cfg.Region.token, err = readToken(cfg.Region.TokenFile); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.BatchSigning.TokenFile != "" {
+		if cfg.BatchSigning.token, err = readToken(cfg.BatchSigning.TokenFile); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.RequestFlags.TokenFile != "" && len(cfg.RequestFlags.Allow) > 0 {
+		if cfg.RequestFlags.token, err = readToken(cfg.RequestFlags.TokenFile); err != nil {
+			return nil, err
+		}
+	}
+	cfg.fetchers = newFetchers(cfg.Storage, cfg.Redirects)
+	return cfg, nil
+}
+
+// readToken reads a bearer token from path.
+func readToken(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", fmt.Errorf("%s is empty", path)
+	}
+	return token, nil
+}
+
+// validate performs the static checks that need no live data.
+func (c *Config) validate() error {
+	if c.Listen == "" {
+		return errors.New("listen must be set")
+	}
+	for name, u := range map[string]string{"bundle_url": c.BundleURL, "crl_base_url": c.CRLBaseURL} {
+		parsed, err := url.Parse(u)
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		switch parsed.Scheme {
+		case "http", "https", "s3", "azblob", "gs":
+		default:
+			return fmt.Errorf("%s %q must be an http(s), s3, azblob or gs URL", name, u)
+		}
+	}
+	if (c.Signer.Cert == "") != (c.Signer.Key == "") {
+		return errors.New("signer.cert and signer.key must be set together")
+	}
+	if err := c.Signer.Next.validate(c.Signer); err != nil {
+		return err
+	}
+	if err := validateIssuerAliases(c.IssuerAliases); err != nil {
+		return err
+	}
+	seen := make(map[string]bool)
+	for _, r := range c.Routes {
+		if err := r.validate(); err != nil {
+			return err
+		}
+		if seen[r.segment()] {
+			return fmt.Errorf("routes: path %q is routed twice", r.Path)
+		}
+		seen[r.segment()] = true
+	}
+	for _, cn := range c.Canaries {
+		if err := cn.validate(); err != nil {
+			return err
+		}
+	}
+	names := make(map[string]bool)
+	for _, r := range c.Freshness {
+		if err := r.validate(); err != nil {
+			return err
+		}
+		if names[r.Name] {
+			return fmt.Errorf("freshness: rule %s is defined twice", r.Name)
+		}
+		names[r.Name] = true
+	}
+	if err := c.Discovery.validate(c.Region); err != nil {
+		return err
+	}
+	if err := c.Clients.validate(); err != nil {
+		return err
+	}
+	if c.Reload.PollInterval <= 0 || c.Reload.HealthInterval <= 0 || c.Reload.HealthWindow < 0 {
+		return errors.New("reload intervals must be positive")
+	}
+	if c.Refresh.Interval < time.Minute {
+		return errors.New("refresh.interval must be at least 1m")
+	}
+	if c.Refresh.MaxBytesPerSecond < 0 {
+		return errors.New("refresh.max_bytes_per_second must not be negative")
+	}
+	if err := c.Refresh.Surge.validate(c.Refresh.Interval); err != nil {
+		return err
+	}
+	if err := c.Redirects.validate(); err != nil {
+		return err
+	}
+	if err := c.MirrorCheck.validate(); err != nil {
+		return err
+	}
+	if c.Cache.MaxEntries < 0 || c.Cache.TTL < 0 || c.Cache.Prewarm < 0 {
+		return errors.New("cache.max_entries, cache.ttl and cache.prewarm must not be negative")
+	}
+	if c.Cache.SlowPathConcurrency < 1 || c.Cache.SlowPathWait < 0 {
+		return errors.New("cache.slow_path_concurrency must be positive")
+	}
+	if _, ok := cachePolicies[c.Cache.Policy]; !ok {
+		return fmt.Errorf("cache.policy %q is not one of none, lru, lfu and ttl", c.Cache.Policy)
+	}
+	if err := c.Index.Bloom.validate(); err != nil {
+		return err
+	}
+	if err := c.Index.Build.validate(); err != nil {
+		return err
+	}
+	if err := c.Cadence.validate(); err != nil {
+		return err
+	}
+	if err := c.Expired.validate(); err != nil {
+		return err
+	}
+	if err := c.Gossip.validate(); err != nil {
+		return err
+	}
+	if err := c.BatchSigning.validate(); err != nil {
+		return err
+	}
+	if err := c.Capture.validate(); err != nil {
+		return err
+	}
+	if err := c.Watchdog.validate(); err != nil {
+		return err
+	}
+	if err := c.Compression.validate(); err != nil {
+		return err
+	}
+	if c.Archive.Enabled && c.Archive.Retention <= 0 {
+		return errors.New("archive.retention must be positive")
+	}
+	if c.SignedRequests.Listen != "" && c.SignedRequests.TrustStore == "" {
+		return errors.New("signed_requests.listen requires signed_requests.trust_store")
+	}
+	if c.SignedRequests.Workers < 1 || c.SignedRequests.QueueWait < 0 {
+		return errors.New("signed_requests.workers must be positive")
+	}
+	if err := c.Quarantine.validate(); err != nil {
+		return err
+	}
+	if err := c.Events.validate(); err != nil {
+		return err
+	}
+	if err := c.Region.validate(); err != nil {
+		return err
+	}
+	if err := c.Blocklist.validate(); err != nil {
+		return err
+	}
+	if err := c.Consistency.validate(); err != nil {
+		return err
+	}
+	if err := c.Staples.validate(); err != nil {
+		return err
+	}
+	if err := c.Startup.validate(); err != nil {
+		return err
+	}
+	if err := c.TLSCheck.validate(); err != nil {
+		return err
+	}
+	if err := c.TLSPolicy.validate("tls_policy"); err != nil {
+		return err
+	}
+	if err := c.Maintenance.validate(); err != nil {
+		return err
+	}
+	if err := c.Freeze.validate(); err != nil {
+		return err
+	}
+	if err := c.Peers.validate(); err != nil {
+		return err
+	}
+	if err := c.Router.validate(); err != nil {
+		return err
+	}
+	if err := c.DPProbes.validate(); err != nil {
+		return err
+	}
+	if err := c.RequestFlags.validate(); err != nil {
+		return err
+	}
+	if err := c.AIA.validate(); err != nil {
+		return err
+	}
+	if err := c.Limits.validate(); err != nil {
+		return err
+	}
+	if err := c.CrlID.validate(); err != nil {
+		return err
+	}
+	if err := c.Attestation.validate(); err != nil {
+		return err
+	}
+	if err := c.Standby.validate(); err != nil {
+		return err
+	}
+	if err := c.Dashboard.validate(); err != nil {
+		return err
+	}
+	if c.SubjectIndex.Enabled {
+		// Subject data is personal information; never serve it unauthenticated.
+		if c.Admin.TokenFile == "" {
+			return errors.New("subject_index requires admin.token_file")
+		}
+		for _, e := range c.SubjectIndex.Exports {
+			if e.Issuer == "" || e.Path == "" {
+				return errors.New("subject_index.exports need an issuer and a path")
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"math/rand"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkkemp/GoOCSPResponder/responder"
+)
+
+// ConsistencyConfig schedules the consistency checker, which re-reads one
+// cached CRL at a time in the background and checks the index serving it:
+// that a fresh build of the CRL digests the same, that an on-disk index
+// still holds what it was mapped with, and that sampled serials, revoked
+// and not, are answered as the CRL says. It catches index-build bugs and
+// silent corruption before they produce wrong answers.
+type ConsistencyConfig struct {
+	// Interval is the pause between two checks; each check covers the next
+	// issuer in turn. 0 disables the checker.
+	Interval time.Duration `yaml:"interval"`
+	// Samples is how many revoked serials are looked up per check, along
+	// with as many random serials the CRL does not list.
+	Samples int `yaml:"samples"`
+}
+
+func (c ConsistencyConfig) validate() error {
+	if c.Interval < 0 || c.Samples < 0 {
+		return errors.New("consistency: interval and samples must not be negative")
+	}
+	return nil
+}
+
+// consistencyCheck is the outcome of the last check of one issuer.
+type consistencyCheck struct {
+	CheckedAt time.Time `json:"checked_at"`
+	// CRL is the SHA-256 of the CRL file checked against.
+	CRL     string `json:"crl_sha256"`
+	Revoked int    `json:"revoked_sampled"`
+	Good    int    `json:"good_sampled"`
+	// Skipped says why the issuer was not checked, such as a CRL that
+	// changed since it was loaded.
+	Skipped string `json:"skipped,omitempty"`
+	// Problems lists every mismatch found; empty means the index agrees
+	// with its CRL.
+	Problems []string `json:"problems"`
+}
+
+// consistencyChecks holds the last check per issuer, and how many
+// mismatches were found since startup.
+var consistencyChecks = struct {
+	sync.Mutex
+	last       map[string]*consistencyCheck
+	mismatches int64
+}{last: make(map[string]*consistencyCheck)}
+
+// runConsistencyChecker checks one issuer of the current state per
+// interval, round robin.
+func runConsistencyChecker(hb heartbeat) {
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	next := 0
+	for {
+		st := currentState()
+		interval := st.cfg.Consistency.Interval
+		if interval <= 0 {
+			// Disabled; a reload may enable it.
+			if !hb.sleep(time.Minute) {
+				return
+			}
+			continue
+		}
+		if !hb.sleep(interval) {
+			return
+		}
+		st = currentState()
+		if len(st.crls) == 0 {
+			continue
+		}
+		crl := st.crls[next%len(st.crls)]
+		next++
+		c := checkConsistency(st.filters[crl.key()], st.cfg.Consistency.Samples, rng)
+		consistencyChecks.Lock()
+		consistencyChecks.last[crl.key()] = c
+		consistencyChecks.mismatches += int64(len(c.Problems))
+		consistencyChecks.Unlock()
+		for _, p := range c.Problems {
+			alert(st.cfg, "consistency check %s: %s", crl.key(), p)
+		}
+	}
+}
+
+// checkConsistency checks the index f against the CRL file it was built
+// from.
+func checkConsistency(f CRLBloomFilter, samples int, rng *rand.Rand) *consistencyCheck {
+	c := &consistencyCheck{CheckedAt: time.Now().UTC(), Problems: []string{}}
+	switch {
+	case !f.indexed():
+		c.Skipped = "not indexed"
+		return c
+	case f.quarantine != "":
+		c.Skipped = "quarantined"
+		return c
+	case len(f.quirks) > 0:
+		// The samples come from encoding/asn1, which refuses the quirks.
+		c.Skipped = "parsed tolerantly"
+		return c
+	}
+	// The CRL is read once, so a refresh replacing it meanwhile cannot
+	// mix two versions into the check.
+	data, err := os.ReadFile(rootDir + f.crlInfo.FileName)
+	if err != nil {
+		c.Problems = append(c.Problems, fmt.Sprintf("reading the CRL: %v", err))
+		return c
+	}
+	crlHash := sha256.Sum256(data)
+	c.CRL = fmt.Sprintf("%x", crlHash)
+	if crlHash != f.crlHash {
+		c.Skipped = "the CRL changed since it was loaded"
+		return c
+	}
+	parsed, err := x509.ParseDERCRL(data)
+	if err != nil {
+		c.Problems = append(c.Problems, fmt.Sprintf("parsing the CRL: %v", err))
+		return c
+	}
+
+	// The fresh build walks the DER as index builds do; the samples below
+	// come from encoding/asn1, so a scanner bug shows as a mismatch.
+	scanned, err := responder.ScanCRL(data)
+	if err != nil {
+		c.Problems = append(c.Problems, fmt.Sprintf("scanning the CRL: %v", err))
+		return c
+	}
+	canonical, err := encodeIndex(scanned, crlHash, nil)
+	if err != nil {
+		c.Problems = append(c.Problems, fmt.Sprintf("indexing the CRL: %v", err))
+		return c
+	}
+	if sum := sha256.Sum256(canonical); sum != f.indexHash {
+		c.Problems = append(c.Problems, fmt.Sprintf("the index digests %x, a fresh build of its CRL %x", f.indexHash, sum))
+	}
+	if f.disk != nil {
+		if sum := sha256.Sum256(f.disk.data); sum != f.indexHash {
+			c.Problems = append(c.Problems, fmt.Sprintf("the on-disk index changed since it was mapped: digests %x, was %x", sum, f.indexHash))
+		}
+	}
+	if want := (len(canonical) - indexHeaderSize) / indexRecordSize; f.size() != want {
+		c.Problems = append(c.Problems, fmt.Sprintf("the index holds %d entries, the CRL lists %d serials", f.size(), want))
+	}
+
+	// Sampled serials are looked up as requests would be, bloom filter
+	// included. A serial listed more than once is expected with its last
+	// entry, as the index keeps it.
+	revoked := parsed.TBSCertList.RevokedCertificates
+	want := make(map[string]*responder.Entry)
+	for i := 0; i < samples && len(revoked) > 0; i++ {
+		want[string(revoked[rng.Intn(len(revoked))].SerialNumber.Bytes())] = nil
+	}
+	var unlisted []*big.Int
+	for i := 0; i < samples; i++ {
+		serial := new(big.Int).SetBytes(randomSerial(rng))
+		if _, dup := want[string(serial.Bytes())]; !dup {
+			want[string(serial.Bytes())] = nil
+			unlisted = append(unlisted, serial)
+		}
+	}
+	for _, rc := range revoked {
+		if _, ok := want[string(rc.SerialNumber.Bytes())]; ok {
+			e := responder.EntryFromCRL(rc)
+			want[string(rc.SerialNumber.Bytes())] = &e
+		}
+	}
+	for _, e := range want {
+		if e == nil {
+			continue
+		}
+		c.Revoked++
+		l := f.lookup(e.Serial)
+		switch {
+		case !l.revoked && f.pruned.dropped(e.Serial):
+			// Left out under expired.prune.
+		case !l.revoked:
+			c.Problems = append(c.Problems, fmt.Sprintf("serial %x is revoked by the CRL but not in the index", e.Serial))
+		case !sameEntry(l.entry, *e):
+			c.Problems = append(c.Problems, fmt.Sprintf("serial %x: the index has %s, the CRL %s", e.Serial, describeEntry(l.entry), describeEntry(*e)))
+		}
+	}
+	for _, serial := range unlisted {
+		if want[string(serial.Bytes())] != nil {
+			// The CRL happens to list it.
+			continue
+		}
+		c.Good++
+		if f.lookup(serial).revoked {
+			c.Problems = append(c.Problems, fmt.Sprintf("serial %x is revoked by the index but not listed by the CRL", serial))
+		}
+	}
+	sort.Strings(c.Problems)
+	return c
+}
+
+// randomSerial returns a random serial of the usual 8 to 20 octets.
+func randomSerial(rng *rand.Rand) []byte {
+	b := make([]byte, 8+rng.Intn(13))
+	rng.Read(b)
+	return b
+}
+
+// sameEntry reports whether two entries answer the same, to the second,
+// as on-disk indexes store times.
+func sameEntry(a, b responder.Entry) bool {
+	return a.RevokedAt.Unix() == b.RevokedAt.Unix() &&
+		a.InvalidityDate.IsZero() == b.InvalidityDate.IsZero() &&
+		a.InvalidityDate.Unix() == b.InvalidityDate.Unix() &&
+		a.Reason == b.Reason &&
+		a.HoldInstruction.Equal(b.HoldInstruction)
+}
+
+func describeEntry(e responder.Entry) string {
+	s := fmt.Sprintf("revoked at %s, reason %d", e.RevokedAt.UTC().Format(time.RFC3339), e.Reason)
+	if !e.InvalidityDate.IsZero() {
+		s += ", invalid since " + e.InvalidityDate.UTC().Format(time.RFC3339)
+	}
+	if len(e.HoldInstruction) > 0 {
+		s += ", hold " + e.HoldInstruction.String()
+	}
+	return s
+}
+
+// consistencyHandler serves GET /admin/v1/consistency.
+func consistencyHandler(w http.ResponseWriter, r *http.Request) {
+	consistencyChecks.Lock()
+	defer consistencyChecks.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(struct {
+		Mismatches int64                        `json:"mismatches"`
+		Issuers    map[string]*consistencyCheck `json:"issuers"`
+	}{consistencyChecks.mismatches, consistencyChecks.last})
+}
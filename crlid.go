@@ -0,0 +1,67 @@
+package main
+
+import (
+	"crypto/x509/pkix"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+
+	"github.com/pkkemp/GoOCSPResponder/responder"
+)
+
+// CrlIDConfig controls the CrlID single extension (RFC 6960 section
+// 4.4.2), which names the URL, cRLNumber and thisUpdate of the CRL that
+// backed each answer, so auditors and clients can trace a response to
+// the CRL it came from.
+type CrlIDConfig struct {
+	// Enabled adds the extension to the answers of every issuer.
+	Enabled bool `yaml:"enabled"`
+	// Issuers overrides Enabled per issuer, by CRL name (DODEMAILCA_63).
+	Issuers map[string]bool `yaml:"issuers"`
+	// BaseURL is where the CRLs are published, if not at crl_base_url;
+	// the URL of a CRL is BaseURL/<CRL file>.
+	BaseURL string `yaml:"base_url"`
+}
+
+func (c CrlIDConfig) validate() error {
+	if c.BaseURL == "" {
+		return nil
+	}
+	if u, err := url.Parse(c.BaseURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("crl_id.base_url %q is not an http or https URL", c.BaseURL)
+	}
+	return nil
+}
+
+// enabledFor reports whether the answers of the issuer key carry a CrlID.
+func (c CrlIDConfig) enabledFor(key string) bool {
+	if on, ok := c.Issuers[key]; ok {
+		return on
+	}
+	return c.Enabled
+}
+
+// crlIDExtensions returns the single extensions naming the CRL of f, or
+// nil if the issuer has none. A quarantined CRL backs no answer, so it has
+// none either. They are encoded once per index and shared by its answers.
+func crlIDExtensions(cfg *Config, f CRLBloomFilter) []pkix.Extension {
+	if f.quarantine != "" || !cfg.CrlID.enabledFor(f.crlInfo.key()) {
+		return nil
+	}
+	base := cfg.CrlID.BaseURL
+	if base == "" {
+		base = cfg.CRLBaseURL
+	}
+	id := responder.CrlID{
+		URL:    strings.TrimSuffix(base, "/") + "/" + f.crlInfo.FileName,
+		Number: f.crlNumber,
+		Time:   f.thisUpdate,
+	}
+	ext, err := id.Extension()
+	if err != nil {
+		log.Printf("crl_id %s: %v", f.crlInfo.key(), err)
+		return nil
+	}
+	return []pkix.Extension{ext}
+}
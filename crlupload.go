@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// maxCRLUpload bounds an uploaded CRL, well above the largest DoD CRLs.
+const maxCRLUpload = 512 << 20
+
+// uploadSkew is how far in the future an uploaded CRL's thisUpdate may be,
+// for clock differences with the CA.
+const uploadSkew = 5 * time.Minute
+
+// uploadedCRL is what POST /admin/v1/crl reports about a loaded CRL.
+type uploadedCRL struct {
+	Issuer     string    `json:"issuer"`
+	SHA256     string    `json:"sha256"`
+	Number     string    `json:"crl_number,omitempty"`
+	ThisUpdate time.Time `json:"this_update"`
+	NextUpdate time.Time `json:"next_update,omitempty"`
+	Entries    int       `json:"entries"`
+}
+
+// crlUploadHandler serves POST /admin/v1/crl, which loads a CRL obtained
+// out of band when its distribution point is down. The CRL is the crl
+// field of a multipart form, or the whole body, in DER or PEM. It goes
+// through the downloader's checks and more, since nothing vouches for
+// where it came from: it must be signed by a served CA with an allowed
+// algorithm, current, and no older than the served CRL. It is then cached
+// and loaded as a refresh would, and replaced by the next refresh that
+// succeeds.
+func crlUploadHandler(w http.ResponseWriter, r *http.Request) {
+	if !requirePost(w, r) {
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxCRLUpload)
+	var data []byte
+	var err error
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		var f io.ReadCloser
+		if f, _, err = r.FormFile("crl"); err == nil {
+			data, err = io.ReadAll(f)
+			f.Close()
+		}
+	} else {
+		data, err = io.ReadAll(r.Body)
+	}
+	if err != nil {
+		http.Error(w, "reading the CRL: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if block, _ := pem.Decode(data); block != nil && block.Type == "X509 CRL" {
+		data = block.Bytes
+	}
+	parsed, err := x509.ParseDERCRL(data)
+	if err != nil {
+		http.Error(w, "not a CRL: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	st := currentState()
+	var crl CRLInfo
+	var found bool
+	if param := r.FormValue("issuer"); param != "" {
+		if crl, _, found = st.findIssuer(param); !found {
+			http.Error(w, fmt.Sprintf("no served issuer matches %q", param), http.StatusNotFound)
+			return
+		}
+	} else {
+		name := crlIssuerDN(parsed)
+		for _, c := range st.crls {
+			if subjectDN(c.CA) == name {
+				crl, found = c, true
+				break
+			}
+		}
+		if !found {
+			http.Error(w, "the CRL's issuer "+name+" is not served", http.StatusNotFound)
+			return
+		}
+	}
+
+	now := time.Now()
+	tbs := parsed.TBSCertList
+	problem := st.cfg.Limits.reason(crl.key(), int64(len(data)), len(tbs.RevokedCertificates))
+	if problem == "" {
+		problem = quarantineReason(st.cfg, crl, parsed)
+	}
+	switch {
+	case problem != "":
+	case tbs.ThisUpdate.After(now.Add(uploadSkew)):
+		problem = "thisUpdate " + tbs.ThisUpdate.UTC().Format(time.RFC3339) + " is in the future"
+	case !tbs.NextUpdate.IsZero() && !now.Before(tbs.NextUpdate):
+		problem = "it expired at " + tbs.NextUpdate.UTC().Format(time.RFC3339)
+	}
+	if problem != "" {
+		http.Error(w, "refused: "+problem, http.StatusUnprocessableEntity)
+		return
+	}
+	if fr := currentFreeze(crl.key()); fr != nil {
+		http.Error(w, "refused: "+crl.key()+" is "+fr.String(), http.StatusConflict)
+		return
+	}
+	if reason := rollbackReason(st.filters[crl.key()], CRLBloomFilter{thisUpdate: tbs.ThisUpdate, crlNumber: crlNumber(parsed)}); reason != "" {
+		http.Error(w, "refused: "+reason, http.StatusConflict)
+		return
+	}
+
+	if err := writeFileAtomic(rootDir+stagedName(crl.FileName), data, 0644); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	info := CRLInfo{FileName: stagedName(crl.FileName), Size: int64(len(data)), FetchedFrom: "upload"}
+	if err := loadCRL(st.cfg, crl, info, "uploaded"); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	sum := sha256.Sum256(data)
+	u := uploadedCRL{
+		Issuer:     crl.key(),
+		SHA256:     hex.EncodeToString(sum[:]),
+		ThisUpdate: tbs.ThisUpdate.UTC(),
+		NextUpdate: tbs.NextUpdate.UTC(),
+		Entries:    currentState().filters[crl.key()].size(),
+	}
+	if n := crlNumber(parsed); n != nil {
+		u.Number = n.String()
+	}
+	adminResult(w, r, fmt.Sprintf("loaded the CRL of %s with %d entries", u.Issuer, u.Entries), u)
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/pkkemp/GoOCSPResponder/responder"
+)
+
+// DashboardConfig protects the web dashboard (/stats). Viewers see it;
+// operators also get buttons that refresh CRLs and flush the response
+// cache through the admin API. It is read at startup only.
+type DashboardConfig struct {
+	// Auth is none (the default: the dashboard is public and read only),
+	// mtls or oidc.
+	Auth string `yaml:"auth"`
+	// Listen serves the dashboard and the admin API on a listener of their
+	// own, with TLS when tls.cert is set, instead of the main listener.
+	// mtls needs it, since the main listener is plain HTTP.
+	Listen string             `yaml:"listen"`
+	TLS    DashboardTLSConfig `yaml:"tls"`
+	OIDC   OIDCConfig         `yaml:"oidc"`
+	// Viewers and Operators grant roles by identity: for mtls the client
+	// certificate's subject, common name or email address, for oidc the
+	// sub or email claim or a group. "*" matches anyone authenticated.
+	Viewers   []string `yaml:"viewers"`
+	Operators []string `yaml:"operators"`
+}
+
+// DashboardTLSConfig is the dashboard listener's certificate and, for
+// mtls, the CAs client certificates must chain to.
+type DashboardTLSConfig struct {
+	Cert     string `yaml:"cert"`
+	Key      string `yaml:"key"`
+	ClientCA string `yaml:"client_ca"`
+	// Policy replaces tls_policy for the dashboard; see tlspolicy.go.
+	Policy *TLSPolicy `yaml:"policy"`
+}
+
+func (c DashboardConfig) validate() error {
+	if c.TLS.Policy != nil {
+		if err := c.TLS.Policy.validate("dashboard.tls.policy"); err != nil {
+			return err
+		}
+	}
+	switch c.Auth {
+	case "", "none":
+		return nil
+	case "mtls":
+		if c.Listen == "" || c.TLS.Cert == "" || c.TLS.Key == "" || c.TLS.ClientCA == "" {
+			return errors.New("dashboard: mtls requires listen, tls.cert, tls.key and tls.client_ca")
+		}
+	case "oidc":
+		o := c.OIDC
+		if o.Issuer == "" || o.ClientID == "" || o.ClientSecretFile == "" || o.RedirectURL == "" {
+			return errors.New("dashboard: oidc requires issuer, client_id, client_secret_file and redirect_url")
+		}
+	default:
+		return fmt.Errorf("dashboard: unknown auth %q (want none, mtls or oidc)", c.Auth)
+	}
+	if len(c.Viewers) == 0 && len(c.Operators) == 0 {
+		return errors.New("dashboard: auth needs viewers or operators")
+	}
+	return nil
+}
+
+// dashboardAuth authenticates dashboard users.
+type dashboardAuth struct {
+	cfg  DashboardConfig
+	oidc *oidcClient
+}
+
+// dashboard is set at startup when dashboard.auth is mtls or oidc.
+var dashboard *dashboardAuth
+
+func dashboardAuthEnabled() bool {
+	return dashboard != nil
+}
+
+func newDashboardAuth(cfg DashboardConfig) (*dashboardAuth, error) {
+	d := &dashboardAuth{cfg: cfg}
+	if cfg.Auth == "oidc" {
+		var err error
+		if d.oidc, err = newOIDCClient(cfg.OIDC); err != nil {
+			return nil, fmt.Errorf("dashboard: %v", err)
+		}
+	}
+	return d, nil
+}
+
+func matchesAny(ids, patterns []string) bool {
+	for _, p := range patterns {
+		if p == "*" && len(ids) > 0 {
+			return true
+		}
+		for _, id := range ids {
+			if strings.EqualFold(id, p) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// roleOf maps identities to the highest role they are granted.
+func (d *dashboardAuth) roleOf(ids []string) role {
+	switch {
+	case matchesAny(ids, d.cfg.Operators):
+		return roleOperator
+	case matchesAny(ids, d.cfg.Viewers):
+		return roleViewer
+	}
+	return roleNone
+}
+
+// dashboardPrincipal authenticates a dashboard user by client certificate
+// or session cookie. A user without a role is still returned, with
+// roleNone.
+func dashboardPrincipal(r *http.Request) (principal, bool) {
+	d := dashboard
+	if d == nil {
+		return principal{}, false
+	}
+	switch d.cfg.Auth {
+	case "mtls":
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+			return principal{}, false
+		}
+		chain := r.TLS.VerifiedChains[0]
+		cert := chain[0]
+		if len(chain) > 1 {
+			// A client certificate of a served issuer must not be
+			// revoked; others are only verified.
+			if s, err := checker.Status(r.Context(), chain[1].Raw, cert.SerialNumber); err == nil && s == responder.Revoked {
+				return principal{}, false
+			}
+		}
+		// The subject matches in its RFC 4514 form and, for existing
+		// configurations, as pkix.Name renders it.
+		ids := append([]string{subjectDN(cert), cert.Subject.String(), cert.Subject.CommonName}, cert.EmailAddresses...)
+		return principal{name: subjectDN(cert), role: d.roleOf(ids), via: "mtls"}, true
+	case "oidc":
+		s, ok := d.oidc.session(r)
+		if !ok {
+			return principal{}, false
+		}
+		return principal{name: s.Name, role: d.roleOf(s.IDs), via: "oidc"}, true
+	}
+	return principal{}, false
+}
+
+type principalKey struct{}
+
+// dashboardOnly wraps a dashboard page so it requires a viewer. Without
+// dashboard auth the page is public and read only.
+func dashboardOnly(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if dashboard == nil {
+			h(w, r)
+			return
+		}
+		p, ok := dashboardPrincipal(r)
+		switch {
+		case !ok && dashboard.oidc != nil:
+			http.Redirect(w, r, "/dashboard/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusFound)
+			return
+		case !ok:
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		case p.role < roleViewer:
+			log.Printf("audit: denied %s %s to %s (%s) from %s", r.Method, r.URL.Path, p.name, p.via, clientAddr(r))
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		h(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, p)))
+	}
+}
+
+// requestPrincipal returns the dashboard user dashboardOnly authenticated.
+func requestPrincipal(r *http.Request) (principal, bool) {
+	p, ok := r.Context().Value(principalKey{}).(principal)
+	return p, ok
+}
+
+// registerDashboard adds the dashboard to mux. A dashboard on its own
+// listener also gets the static assets and the admin API its forms use.
+func registerDashboard(mux *http.ServeMux, own bool) {
+	for _, e := range dashboardEndpoints() {
+		mux.HandleFunc(e.pattern(), e.wrapped())
+	}
+	if dashboard != nil && dashboard.oidc != nil {
+		mux.HandleFunc("/dashboard/login", dashboard.oidc.loginHandler)
+		mux.HandleFunc("/dashboard/callback", dashboard.oidc.callbackHandler)
+		mux.HandleFunc("/dashboard/logout", dashboard.oidc.logoutHandler)
+	}
+	if own {
+		mux.HandleFunc("/static/", staticHandler)
+		mux.HandleFunc("/favicon.ico", rootAssetHandler("favicon.ico"))
+		registerAdminActions(mux)
+	}
+}
+
+// registerAdminActions adds the admin API endpoints behind the dashboard's
+// operator buttons.
+func registerAdminActions(mux *http.ServeMux) {
+	for _, e := range adminEndpoints() {
+		mux.HandleFunc(e.pattern(), e.wrapped())
+	}
+}
+
+// serveDashboard serves the dashboard on its own listener, ln, under the
+// TLS policy policy.
+func serveDashboard(ln net.Listener, cfg DashboardConfig, policy TLSPolicy) error {
+	mux := http.NewServeMux()
+	registerDashboard(mux, true)
+	srv := &http.Server{Handler: mux}
+	if cfg.TLS.Cert == "" {
+		return srv.Serve(ln)
+	}
+	tc, err := serverTLSConfig("dashboard", policy)
+	if err != nil {
+		return err
+	}
+	srv.TLSConfig = tc
+	if cfg.Auth == "mtls" {
+		cas, err := readCertificates(cfg.TLS.ClientCA)
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		for _, ca := range cas {
+			pool.AddCert(ca)
+		}
+		tc.ClientAuth, tc.ClientCAs = tls.RequireAndVerifyClientCert, pool
+	}
+	return srv.ServeTLS(ln, cfg.TLS.Cert, cfg.TLS.Key)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"html/template"
+	"log"
+	"sync"
+)
+
+// rowVersion identifies the index a dashboard row was rendered from; it
+// changes only when the issuer's CRL is loaded again.
+type rowVersion struct {
+	loadedAt   int64
+	crlHash    [sha256.Size]byte
+	quarantine string
+	pending    bool
+	frozen     bool
+}
+
+// cachedRow is the rendered row of one issuer, for viewers and operators.
+type cachedRow struct {
+	version rowVersion
+	html    [2]template.HTML
+}
+
+// rowCache keeps the rendered CA table rows of the dashboard and the
+// issuer DNs they show, so a page view with hundreds of issuers renders
+// only the rows whose CRL was loaded since the last one.
+type rowCache struct {
+	mu   sync.Mutex
+	rows map[string]*cachedRow
+	// dns are the rendered subjects of CA certificates by raw subject.
+	dns map[string]string
+}
+
+var dashboardRows = &rowCache{}
+
+// render returns the CA table rows of st, with the refresh and freeze
+// buttons for an operator. Rows of issuers no longer served are dropped.
+func (c *rowCache) render(st *state, operator bool) []template.HTML {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	rows := make(map[string]*cachedRow, len(st.crls))
+	dns := make(map[string]string, len(st.crls))
+	out := make([]template.HTML, 0, len(st.crls))
+	variant := 0
+	if operator {
+		variant = 1
+	}
+	frozen := activeFreezes()
+	for _, crl := range st.crls {
+		key := crl.key()
+		f := st.filters[key]
+		v := rowVersion{loadedAt: f.loadedAt.UnixNano(), crlHash: f.crlHash, quarantine: f.quarantine, pending: f.pending, frozen: frozen[key] != nil}
+		row := c.rows[key]
+		if row == nil || row.version != v {
+			row = &cachedRow{version: v}
+		}
+		rows[key] = row
+		dn, ok := c.dns[string(crl.CA.RawSubject)]
+		if !ok {
+			dn = subjectDN(crl.CA)
+		}
+		dns[string(crl.CA.RawSubject)] = dn
+		if row.html[variant] == "" {
+			row.html[variant] = renderRow(CRLRevocations{
+				Key:                 key,
+				Issuer:              dn,
+				NumberOfRevocations: f.size(),
+				Quarantine:          f.quarantine,
+				Frozen:              v.frozen,
+				Operator:            operator,
+			})
+		}
+		out = append(out, row.html[variant])
+	}
+	c.rows, c.dns = rows, dns
+	return out
+}
+
+func renderRow(ca CRLRevocations) template.HTML {
+	var buf bytes.Buffer
+	if err := templates.ExecuteTemplate(&buf, "issuer-row", ca); err != nil {
+		log.Printf("dashboard: %s: %v", ca.Key, err)
+	}
+	return template.HTML(buf.String())
+}
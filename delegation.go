@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Clients that do not trust the responder locally accept a response only
+// when it is signed with the issuer's own key or by a delegated responder:
+// a certificate the issuer signed with the id-kp-OCSPSigning extended key
+// usage (RFC 6960 section 4.2.2.2). One key signs for every served issuer,
+// so a delegated responder key is authorized for its own issuer only. An
+// issuer the keys may not sign for is refused, unless
+// signer.allow_undelegated names it for clients that trust the responder
+// locally.
+
+// allowsUndelegated reports whether signer.allow_undelegated names crl by
+// CRL name or common name, or holds "*".
+func (c SignerConfig) allowsUndelegated(crl CRLInfo) bool {
+	for _, name := range c.AllowUndelegated {
+		if name == "*" || strings.EqualFold(name, crl.key()) || (crl.CA != nil && strings.EqualFold(name, crl.CA.Subject.CommonName)) {
+			return true
+		}
+	}
+	return false
+}
+
+// signerAuthorization returns, by issuer key, why the keys of st may not
+// sign that issuer's responses, for the issuers where they may not.
+func (st *state) signerAuthorization(now time.Time) map[string]string {
+	out := make(map[string]string)
+	for _, crl := range st.crls {
+		var problems []string
+		if st.signer != nil {
+			if err := st.signer.CheckAuthorized(crl.CA, now); err != nil {
+				problems = append(problems, err.Error())
+			}
+		}
+		if st.nextSigner != nil {
+			if err := st.nextSigner.CheckAuthorized(crl.CA, now); err != nil {
+				problems = append(problems, "next key: "+err.Error())
+			}
+		}
+		if len(problems) > 0 {
+			out[crl.key()] = strings.Join(problems, "; ")
+		}
+	}
+	return out
+}
+
+// checkSignerAuthorization refuses the issuers whose responses the keys
+// of st may not sign, and logs those signer.allow_undelegated names.
+func checkSignerAuthorization(st *state) error {
+	unauthorized := st.signerAuthorization(time.Now())
+	crls := append([]CRLInfo(nil), st.crls...)
+	sort.Slice(crls, func(i, j int) bool { return crls[i].key() < crls[j].key() })
+	for _, crl := range crls {
+		why, ok := unauthorized[crl.key()]
+		if !ok {
+			continue
+		}
+		if !st.cfg.Signer.allowsUndelegated(crl) {
+			return fmt.Errorf("the responder key may not sign for %s, which signer.allow_undelegated does not name: %s", crl.key(), why)
+		}
+		log.Printf("signer: only clients trusting the responder locally accept answers for %s: %s", crl.key(), why)
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkkemp/GoOCSPResponder/responder"
+)
+
+// delegatedResponder returns a key ca delegates OCSP signing to.
+func delegatedResponder(t *testing.T, ca *responder.Signer) *responder.Signer {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "Delegated Responder"},
+		NotBefore:    ca.Cert.NotBefore,
+		NotAfter:     ca.Cert.NotAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageOCSPSigning},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.Cert, key.Public(), ca.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &responder.Signer{Cert: cert, Key: key}
+}
+
+func TestCheckSignerAuthorization(t *testing.T) {
+	now := time.Now()
+	ca1 := testCA(t, "Delegation CA-1", now.Add(-time.Hour), now.Add(time.Hour))
+	ca2 := testCA(t, "Delegation CA-2", now.Add(-time.Hour), now.Add(time.Hour))
+	crl1 := CRLInfo{CA: ca1.Cert, FileName: "DELEGATIONCA_1.crl"}
+	crl2 := CRLInfo{CA: ca2.Cert, FileName: "DELEGATIONCA_2.crl"}
+	delegated := delegatedResponder(t, ca1)
+
+	for _, tc := range []struct {
+		name    string
+		signer  *responder.Signer
+		crls    []CRLInfo
+		allow   []string
+		refused string // the issuer refused, "" for none
+	}{
+		{"the CA's own key", ca1, []CRLInfo{crl1}, nil, ""},
+		{"delegated", delegated, []CRLInfo{crl1}, nil, ""},
+		{"another CA's key", ca1, []CRLInfo{crl1, crl2}, nil, crl2.key()},
+		{"delegated by another CA", delegated, []CRLInfo{crl1, crl2}, nil, crl2.key()},
+		{"an undelegated key", testCA(t, "Responder", now.Add(-time.Hour), now.Add(time.Hour)), []CRLInfo{crl1, crl2}, nil, crl1.key()},
+		{"allowed by common name", delegated, []CRLInfo{crl1, crl2}, []string{"delegation ca-2"}, ""},
+		{"allowed by CRL name", delegated, []CRLInfo{crl1, crl2}, []string{crl2.key()}, ""},
+		{"allowed for all", ca1, []CRLInfo{crl1, crl2}, []string{"*"}, ""},
+		{"another issuer allowed", delegated, []CRLInfo{crl1, crl2}, []string{"Delegation CA-3"}, crl2.key()},
+	} {
+		cfg := defaultConfig()
+		cfg.Signer.AllowUndelegated = tc.allow
+		err := checkSignerAuthorization(&state{cfg: cfg, crls: tc.crls, signer: tc.signer})
+		switch {
+		case tc.refused == "" && err != nil:
+			t.Errorf("%s: %v", tc.name, err)
+		case tc.refused != "" && (err == nil || !strings.Contains(err.Error(), tc.refused)):
+			t.Errorf("%s: got %v, want %s refused", tc.name, err, tc.refused)
+		}
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"crypto/x509/pkix"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkkemp/GoOCSPResponder/responder"
+)
+
+// diffRevocation is one revocation that differs between two CRL sets.
+type diffRevocation struct {
+	Serial         string     `json:"serial"`
+	RevokedAt      time.Time  `json:"revoked_at"`
+	Reason         int        `json:"reason"`
+	InvalidityDate *time.Time `json:"invalidity_date,omitempty"`
+	// Previous is the old entry of a revocation whose reason or
+	// invalidity date changed.
+	Previous *diffRevocation `json:"previous,omitempty"`
+}
+
+// issuerDiff is how the CRL of one issuer differs between two sets.
+type issuerDiff struct {
+	Issuer string `json:"issuer"`
+	// Change is added or removed for an issuer in one set only, changed
+	// or unchanged otherwise.
+	Change     string           `json:"change"`
+	OldNumber  string           `json:"old_crl_number,omitempty"`
+	NewNumber  string           `json:"new_crl_number,omitempty"`
+	OldEntries int              `json:"old_entries"`
+	NewEntries int              `json:"new_entries"`
+	Added      []diffRevocation `json:"added"`
+	Removed    []diffRevocation `json:"removed"`
+	Changed    []diffRevocation `json:"changed"`
+}
+
+// crlSetDiff is what goocsp diff reports.
+type crlSetDiff struct {
+	Old     string       `json:"old"`
+	New     string       `json:"new"`
+	Added   int          `json:"added"`
+	Removed int          `json:"removed"`
+	Changed int          `json:"changed"`
+	Issuers []issuerDiff `json:"issuers"`
+}
+
+// loadCRLSet parses the CRLs of a cache snapshot, by issuer key: every
+// *.crl of a directory, or a single CRL file.
+func loadCRLSet(path string) (map[string]*pkix.CertificateList, error) {
+	paths := []string{path}
+	if fi, err := os.Stat(path); err != nil {
+		return nil, err
+	} else if fi.IsDir() {
+		if paths, err = filepath.Glob(filepath.Join(path, "*.crl")); err != nil {
+			return nil, err
+		}
+	}
+	set := make(map[string]*pkix.CertificateList, len(paths))
+	for _, p := range paths {
+		parsed, err := parseCRLFile(p)
+		if err != nil {
+			return nil, err
+		}
+		set[CRLInfo{FileName: filepath.Base(p)}.key()] = parsed
+	}
+	return set, nil
+}
+
+// crlEntries indexes the revocations of crl by serial; like the server, a
+// serial listed twice keeps its last entry.
+func crlEntries(crl *pkix.CertificateList) map[string]responder.Entry {
+	if crl == nil {
+		return nil
+	}
+	entries := make(map[string]responder.Entry, len(crl.TBSCertList.RevokedCertificates))
+	for _, rc := range crl.TBSCertList.RevokedCertificates {
+		entries[string(rc.SerialNumber.Bytes())] = responder.EntryFromCRL(rc)
+	}
+	return entries
+}
+
+func newDiffRevocation(e responder.Entry) diffRevocation {
+	return diffRevocation{
+		Serial:         fmt.Sprintf("%x", e.Serial),
+		RevokedAt:      e.RevokedAt.UTC(),
+		Reason:         e.Reason,
+		InvalidityDate: timePtr(e.InvalidityDate),
+	}
+}
+
+// diffIssuer compares the older and newer CRLs of issuer key, either of
+// which may be nil.
+func diffIssuer(key string, older, newer *pkix.CertificateList) issuerDiff {
+	d := issuerDiff{Issuer: key, Added: []diffRevocation{}, Removed: []diffRevocation{}, Changed: []diffRevocation{}}
+	switch {
+	case older == nil:
+		d.Change = "added"
+	case newer == nil:
+		d.Change = "removed"
+	}
+	if older != nil {
+		if n := crlNumber(older); n != nil {
+			d.OldNumber = n.String()
+		}
+	}
+	if newer != nil {
+		if n := crlNumber(newer); n != nil {
+			d.NewNumber = n.String()
+		}
+	}
+	was, is := crlEntries(older), crlEntries(newer)
+	d.OldEntries, d.NewEntries = len(was), len(is)
+	for k, e := range is {
+		prev, ok := was[k]
+		switch {
+		case !ok:
+			d.Added = append(d.Added, newDiffRevocation(e))
+		case prev.Reason != e.Reason || !prev.InvalidityDate.Equal(e.InvalidityDate) || !prev.RevokedAt.Equal(e.RevokedAt):
+			r, p := newDiffRevocation(e), newDiffRevocation(prev)
+			r.Previous = &p
+			d.Changed = append(d.Changed, r)
+		}
+	}
+	for k, e := range was {
+		if _, ok := is[k]; !ok {
+			d.Removed = append(d.Removed, newDiffRevocation(e))
+		}
+	}
+	for _, l := range [][]diffRevocation{d.Added, d.Removed, d.Changed} {
+		// Hex serials without leading zeros sort numerically by length first.
+		sort.Slice(l, func(i, j int) bool {
+			if len(l[i].Serial) != len(l[j].Serial) {
+				return len(l[i].Serial) < len(l[j].Serial)
+			}
+			return l[i].Serial < l[j].Serial
+		})
+	}
+	if d.Change == "" {
+		d.Change = "unchanged"
+		if len(d.Added)+len(d.Removed)+len(d.Changed) > 0 || d.OldNumber != d.NewNumber {
+			d.Change = "changed"
+		}
+	}
+	return d
+}
+
+// diffCRLSets compares two CRL sets issuer by issuer, matching CRLs by
+// file name.
+func diffCRLSets(older, newer map[string]*pkix.CertificateList) crlSetDiff {
+	keys := make(map[string]bool, len(older)+len(newer))
+	for k := range older {
+		keys[k] = true
+	}
+	for k := range newer {
+		keys[k] = true
+	}
+	var d crlSetDiff
+	d.Issuers = make([]issuerDiff, 0, len(keys))
+	for k := range keys {
+		i := diffIssuer(k, older[k], newer[k])
+		d.Added += len(i.Added)
+		d.Removed += len(i.Removed)
+		d.Changed += len(i.Changed)
+		d.Issuers = append(d.Issuers, i)
+	}
+	sort.Slice(d.Issuers, func(i, j int) bool { return d.Issuers[i].Issuer < d.Issuers[j].Issuer })
+	return d
+}
+
+// writeDiffCSV writes one row per differing revocation, and one per issuer
+// added or removed without any.
+func writeDiffCSV(d crlSetDiff) error {
+	w := csv.NewWriter(os.Stdout)
+	w.Write([]string{"issuer", "change", "serial", "revoked_at", "reason", "invalidity_date", "previous_reason", "previous_invalidity_date"})
+	date := func(t *time.Time) string {
+		if t == nil {
+			return ""
+		}
+		return t.Format(time.RFC3339)
+	}
+	for _, i := range d.Issuers {
+		if i.Change == "added" || i.Change == "removed" {
+			if len(i.Added)+len(i.Removed) == 0 {
+				w.Write([]string{i.Issuer, "issuer " + i.Change, "", "", "", "", "", ""})
+			}
+		}
+		for _, l := range []struct {
+			change string
+			revs   []diffRevocation
+		}{{"added", i.Added}, {"removed", i.Removed}, {"changed", i.Changed}} {
+			for _, r := range l.revs {
+				row := []string{i.Issuer, l.change, r.Serial, r.RevokedAt.Format(time.RFC3339), strconv.Itoa(r.Reason), date(r.InvalidityDate), "", ""}
+				if r.Previous != nil {
+					row[6], row[7] = strconv.Itoa(r.Previous.Reason), date(r.Previous.InvalidityDate)
+				}
+				w.Write(row)
+			}
+		}
+	}
+	w.Flush()
+	return w.Error()
+}
+
+func printDiff(d crlSetDiff) {
+	fmt.Printf("%s -> %s: %d added, %d removed, %d changed revocations\n", d.Old, d.New, d.Added, d.Removed, d.Changed)
+	for _, i := range d.Issuers {
+		if i.Change == "unchanged" {
+			continue
+		}
+		number := func(n string) string {
+			if n == "" {
+				return "none"
+			}
+			return n
+		}
+		fmt.Printf("%s (%s): CRL number %s -> %s, %d -> %d entries, +%d -%d ~%d\n", i.Issuer, i.Change,
+			number(i.OldNumber), number(i.NewNumber), i.OldEntries, i.NewEntries, len(i.Added), len(i.Removed), len(i.Changed))
+	}
+}
+
+// diffCommand compares two cache snapshots or CRL sets offline, for change
+// review before a data set is promoted. Like diff(1) it exits 0 if they
+// match, 1 if they differ and 2 on trouble.
+func diffCommand(args []string) int {
+	fs := flag.NewFlagSet("diff", flag.ContinueOnError)
+	format := fs.String("format", "text", "text, json or csv")
+	issuer := fs.String("issuer", "", "only this CRL, by file name without extension")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: goocsp diff [--format text|json|csv] [--issuer name] old new")
+		fmt.Fprintln(fs.Output(), "old and new are CRL cache directories or CRL files.")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 2 || (*format != "text" && *format != "json" && *format != "csv") {
+		fs.Usage()
+		return 2
+	}
+	sets := make([]map[string]*pkix.CertificateList, 2)
+	for i, path := range fs.Args() {
+		set, err := loadCRLSet(path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "diff:", err)
+			return 2
+		}
+		if *issuer != "" {
+			for k := range set {
+				if !strings.EqualFold(k, *issuer) {
+					delete(set, k)
+				}
+			}
+		}
+		sets[i] = set
+	}
+	d := diffCRLSets(sets[0], sets[1])
+	d.Old, d.New = fs.Arg(0), fs.Arg(1)
+
+	switch *format {
+	case "json":
+		out, _ := json.MarshalIndent(d, "", "  ")
+		fmt.Println(string(out))
+	case "csv":
+		if err := writeDiffCSV(d); err != nil {
+			fmt.Fprintln(os.Stderr, "diff:", err)
+			return 2
+		}
+	default:
+		printDiff(d)
+	}
+	for _, i := range d.Issuers {
+		if i.Change != "unchanged" {
+			return 1
+		}
+	}
+	return 0
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/csv"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// disclosureHeader are the columns of the CRL disclosure export, after
+// the CCADB's "Full CRL Issued By This CA" disclosure: one row per CA
+// certificate with a CRL here, cross-certificates included.
+var disclosureHeader = []string{
+	"Certificate Name",
+	"Subject",
+	"Issuer",
+	"SHA-256 Fingerprint",
+	"Certificate Not After",
+	"Full CRL Issued By This CA",
+	"CRL Number",
+	"This Update",
+	"Next Update",
+	"Last Refresh",
+	"Revoked Entries",
+	"Status",
+}
+
+// disclosureRows returns the rows of the export from the issuer registry
+// and the indexes of st, by CRL name and certificate expiry.
+func disclosureRows(st *state) [][]string {
+	registry.sync(st)
+	registry.mu.Lock()
+	records := make([]issuerRecord, 0, len(registry.records))
+	for _, rec := range registry.records {
+		if rec.Key != "" {
+			records = append(records, *rec)
+		}
+	}
+	registry.mu.Unlock()
+	sort.Slice(records, func(i, j int) bool { return records[i].Key < records[j].Key })
+
+	var rows [][]string
+	for _, rec := range records {
+		var crlURL, number, thisUpdate, nextUpdate, refreshed, entries string
+		if len(rec.CRLDistributionPoints) > 0 {
+			crlURL = rec.CRLDistributionPoints[0]
+		} else if strings.HasPrefix(st.cfg.CRLBaseURL, "http") {
+			crlURL = st.cfg.CRLBaseURL + "/" + rec.Key + ".crl"
+		}
+		if f, ok := st.filters[rec.Key]; ok && f.quarantine == "" {
+			if f.crlNumber != nil {
+				number = f.crlNumber.String()
+			}
+			thisUpdate, nextUpdate = disclosureTime(f.thisUpdate), disclosureTime(f.nextUpdate)
+			refreshed = disclosureTime(f.loadedAt)
+			entries = strconv.Itoa(f.size())
+		}
+		certs := append([]issuerCertificate(nil), rec.Certificates...)
+		sort.Slice(certs, func(i, j int) bool { return certs[i].NotAfter.Before(certs[j].NotAfter) })
+		for _, c := range certs {
+			rows = append(rows, []string{
+				rec.Key, rec.Subject, c.Issuer, strings.ToUpper(c.SHA256), disclosureTime(c.NotAfter),
+				crlURL, number, thisUpdate, nextUpdate, refreshed, entries, rec.State,
+			})
+		}
+	}
+	return rows
+}
+
+func disclosureTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+// disclosureHandler serves GET /admin/v1/disclosure.csv.
+func disclosureHandler(w http.ResponseWriter, r *http.Request) {
+	rows := disclosureRows(currentState())
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="crl-disclosure.csv"`)
+	cw := csv.NewWriter(w)
+	cw.Write(disclosureHeader)
+	cw.WriteAll(rows)
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkkemp/GoOCSPResponder/responder"
+)
+
+// DiscoveryConfig lets the responder start serving issuers it was not
+// configured for when clients ask about them. A request for an unknown
+// issuer looks its CertID hashes up in repository; a CA found there whose
+// CRL name is allowed and which chains to a trust anchor has its CRL
+// fetched and checked as any other, and is served from then on, across
+// reloads and restarts. Requests are still answered unauthorized until
+// then.
+type DiscoveryConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Repository is a file or http(s) URL of PEM CA certificates.
+	Repository string `yaml:"repository"`
+	// Allow lists the CRL names, with * and ? wildcards (DODEMAILCA_*),
+	// that may be discovered; it is required.
+	Allow []string `yaml:"allow"`
+	// MaxIssuers bounds the issuers served through discovery.
+	MaxIssuers int `yaml:"max_issuers"`
+	// MaxPerHour bounds the lookups, so clients making up issuer hashes
+	// cannot keep the responder fetching.
+	MaxPerHour int `yaml:"max_per_hour"`
+	// Retry is how long a hash that was looked up is not looked up again,
+	// and how long a downloaded repository is reused.
+	Retry time.Duration `yaml:"retry"`
+}
+
+func (c DiscoveryConfig) validate(region RegionConfig) error {
+	if !c.Enabled {
+		return nil
+	}
+	switch {
+	case c.Repository == "":
+		return errors.New("discovery.repository is required")
+	case len(c.Allow) == 0:
+		return errors.New("discovery.allow must list the CRL names that may be discovered")
+	case c.MaxIssuers < 1 || c.MaxPerHour < 1:
+		return errors.New("discovery.max_issuers and discovery.max_per_hour must be positive")
+	case c.Retry < time.Minute:
+		return errors.New("discovery.retry must be at least 1m")
+	case region.secondary():
+		return errors.New("discovery runs on the primary region; secondaries serve what it discovered")
+	}
+	for _, pattern := range c.Allow {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("discovery.allow %q: %v", pattern, err)
+		}
+	}
+	return nil
+}
+
+// allowed reports whether the issuer with CRL key may be discovered.
+func (c DiscoveryConfig) allowed(key string) bool {
+	for _, pattern := range c.Allow {
+		if ok, _ := path.Match(pattern, key); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// discoveredFile keeps the CA certificates of discovered issuers in the
+// cache directory; discoveryRepositoryFile is the downloaded repository.
+const (
+	discoveredFile          = "discovered.pem"
+	discoveryRepositoryFile = "discovery-repository.pem"
+)
+
+// maxDiscoveryAttempts bounds the lookups the status endpoint reports.
+const maxDiscoveryAttempts = 64
+
+// discoveryAttempt is the outcome of looking up one issuer hash pair.
+type discoveryAttempt struct {
+	HashAlgorithm string    `json:"hash_algorithm"`
+	NameHash      string    `json:"issuer_name_hash"`
+	KeyHash       string    `json:"issuer_key_hash"`
+	At            time.Time `json:"at"`
+	// Issuer is the CRL name of the CA the hashes belong to, if the
+	// repository has it.
+	Issuer  string `json:"issuer,omitempty"`
+	Outcome string `json:"outcome"`
+}
+
+var discovery = struct {
+	sync.Mutex
+	once  sync.Once
+	queue chan responder.CertID
+	// tried holds when each certID key was last queued; lookups holds the
+	// times of the lookups in the last hour.
+	tried    map[string]time.Time
+	lookups  []time.Time
+	attempts []discoveryAttempt
+	// repository is the parsed repository, loaded at repositoryAt.
+	repository   []*x509.Certificate
+	repositoryAt time.Time
+}{queue: make(chan responder.CertID, 16), tried: make(map[string]time.Time)}
+
+// requestDiscovery queues a lookup of the issuer of id, which is not
+// served, unless it was looked up within discovery.retry or the hourly
+// budget is spent.
+func requestDiscovery(cfg *Config, id responder.CertID, now time.Time) {
+	c := cfg.Discovery
+	var buf [1 + 2*64]byte
+	key := appendCertIDKey(buf[:0], id.HashAlgorithm, id.NameHash, id.KeyHash)
+	discovery.Lock()
+	defer discovery.Unlock()
+	if at, ok := discovery.tried[string(key)]; ok && now.Sub(at) < c.Retry {
+		return
+	}
+	n := 0
+	for _, at := range discovery.lookups {
+		if now.Sub(at) < time.Hour {
+			discovery.lookups[n] = at
+			n++
+		}
+	}
+	discovery.lookups = discovery.lookups[:n]
+	if n >= c.MaxPerHour {
+		return
+	}
+	id.NameHash = append([]byte(nil), id.NameHash...)
+	id.KeyHash = append([]byte(nil), id.KeyHash...)
+	select {
+	case discovery.queue <- id:
+	default:
+		return
+	}
+	for k, at := range discovery.tried {
+		if now.Sub(at) >= c.Retry {
+			delete(discovery.tried, k)
+		}
+	}
+	discovery.tried[string(key)] = now
+	discovery.lookups = append(discovery.lookups, now)
+	discovery.once.Do(func() { go runDiscovery() })
+}
+
+// runDiscovery looks up the queued issuers one at a time.
+func runDiscovery() {
+	for id := range discovery.queue {
+		issuer, outcome := discoverIssuer(id)
+		if issuer != "" {
+			log.Printf("discovery: %s: %s", issuer, outcome)
+		}
+		discovery.Lock()
+		discovery.attempts = append(discovery.attempts, discoveryAttempt{
+			HashAlgorithm: id.HashAlgorithm.String(),
+			NameHash:      hex.EncodeToString(id.NameHash),
+			KeyHash:       hex.EncodeToString(id.KeyHash),
+			At:            time.Now().UTC(),
+			Issuer:        issuer,
+			Outcome:       outcome,
+		})
+		if len(discovery.attempts) > maxDiscoveryAttempts {
+			discovery.attempts = discovery.attempts[len(discovery.attempts)-maxDiscoveryAttempts:]
+		}
+		discovery.Unlock()
+	}
+}
+
+// discoverIssuer finds the issuer of id in the repository and starts
+// serving it if it passes every check. It returns the issuer's CRL name,
+// if found, and what became of it.
+func discoverIssuer(id responder.CertID) (string, string) {
+	cfg := currentState().cfg
+	if !cfg.Discovery.Enabled {
+		return "", "discovery was disabled"
+	}
+	if readOnly {
+		return "", "read-only mode fetches nothing"
+	}
+	repo, err := discoveryRepository(cfg, time.Now())
+	if err != nil {
+		log.Printf("discovery: repository: %v", err)
+		return "", fmt.Sprintf("repository unavailable: %v", err)
+	}
+	var buf [1 + 2*64]byte
+	key := string(appendCertIDKey(buf[:0], id.HashAlgorithm, id.NameHash, id.KeyHash))
+	var ca *x509.Certificate
+	for _, cert := range repo {
+		for _, k := range certIDKeys(cert) {
+			if k == key {
+				ca = cert
+			}
+		}
+	}
+	if ca == nil {
+		return "", "not in the repository"
+	}
+	name := crlFileName(ca)
+	if name == "" {
+		return "", fmt.Sprintf("%s publishes no CRL", subjectDN(ca))
+	}
+	crlKey := CRLInfo{FileName: name}.key()
+	if !cfg.Discovery.allowed(crlKey) {
+		return crlKey, "not allowed by discovery.allow"
+	}
+	if !VerifyCertificate(*ca) {
+		return crlKey, "does not chain to a trust anchor"
+	}
+	if n := len(discoveredCAs()); n >= cfg.Discovery.MaxIssuers {
+		return crlKey, fmt.Sprintf("discovery.max_issuers (%d) reached", n)
+	}
+
+	crl, err := fetchCRL(cfg, ca, true)
+	if err != nil {
+		return crlKey, fmt.Sprintf("fetching the CRL failed: %v", err)
+	}
+	filter, err := ConstructBloomFilter(cfg, crl)
+	if err != nil {
+		return crlKey, fmt.Sprintf("indexing the CRL failed: %v", err)
+	}
+	if filter.quarantine != "" {
+		return crlKey, fmt.Sprintf("CRL rejected: %s", filter.quarantine)
+	}
+	if err := serveDiscovered(cfg, ca, filter); err != nil {
+		return crlKey, err.Error()
+	}
+	alert(cfg, "discovery: now serving %s (%s) after a request for it", crlKey, subjectDN(ca))
+	return crlKey, "served"
+}
+
+// discoveryRepository returns the repository's certificates, reading or
+// downloading it again once discovery.retry has passed.
+func discoveryRepository(cfg *Config, now time.Time) ([]*x509.Certificate, error) {
+	discovery.Lock()
+	repo, at := discovery.repository, discovery.repositoryAt
+	discovery.Unlock()
+	if repo != nil && now.Sub(at) < cfg.Discovery.Retry {
+		return repo, nil
+	}
+	file := cfg.Discovery.Repository
+	if strings.HasPrefix(file, "http://") || strings.HasPrefix(file, "https://") {
+		if _, err := downloadTo(cfg, file, discoveryRepositoryFile); err != nil {
+			return nil, err
+		}
+		file = rootDir + discoveryRepositoryFile
+	}
+	repo, err := readCertificates(file)
+	if err != nil {
+		return nil, err
+	}
+	discovery.Lock()
+	discovery.repository, discovery.repositoryAt = repo, now
+	discovery.Unlock()
+	return repo, nil
+}
+
+// serveDiscovered adds the issuer ca, indexed by filter, to the current
+// state and records it so reloads and restarts keep serving it.
+func serveDiscovered(cfg *Config, ca *x509.Certificate, filter CRLBloomFilter) error {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	old := currentState()
+	if old.cfg != cfg {
+		return errors.New("the configuration was reloaded meanwhile")
+	}
+	if _, ok := old.filters[filter.crlInfo.key()]; ok {
+		return errors.New("already served")
+	}
+	crls := append(append([]CRLInfo(nil), old.crls...), filter.crlInfo)
+	filters := make(map[string]CRLBloomFilter, len(old.filters)+1)
+	for k, v := range old.filters {
+		filters[k] = v
+	}
+	filters[filter.crlInfo.key()] = filter
+	next, err := assembleState(cfg, old.bundle, crls, filters)
+	if err != nil {
+		return err
+	}
+	// Responses cached for the other issuers stay valid.
+	next.cache, next.slow = old.cache, old.slow
+	if err := saveDiscovered(append(discoveredCAs(), ca)); err != nil {
+		return fmt.Errorf("saving %s: %v", discoveredFile, err)
+	}
+	current.Store(next)
+	expireBlocklist(next)
+	return nil
+}
+
+// discoveredCAs returns the CA certificates of the discovered issuers.
+func discoveredCAs() []*x509.Certificate {
+	certs, err := readCertificates(rootDir + discoveredFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("discovery: %v", err)
+		}
+		return nil
+	}
+	return certs
+}
+
+func saveDiscovered(cas []*x509.Certificate) error {
+	var buf bytes.Buffer
+	for _, ca := range cas {
+		pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw})
+	}
+	return writeFileAtomic(rootDir+discoveredFile, buf.Bytes(), 0644)
+}
+
+// discoveredIssuers returns the discovered issuers still allowed by cfg
+// that chain to a trust anchor, for selectIssuers.
+func discoveredIssuers(cfg *Config) []*x509.Certificate {
+	if !cfg.Discovery.Enabled {
+		return nil
+	}
+	var issuers []*x509.Certificate
+	for _, ca := range discoveredCAs() {
+		key := CRLInfo{FileName: crlFileName(ca)}.key()
+		if key == "" || !cfg.Discovery.allowed(key) || !VerifyCertificate(*ca) {
+			log.Printf("discovery: no longer serving %s: not allowed or not trusted", subjectDN(ca))
+			continue
+		}
+		if len(issuers) == cfg.Discovery.MaxIssuers {
+			log.Printf("discovery: no longer serving %s: discovery.max_issuers reached", subjectDN(ca))
+			continue
+		}
+		issuers = append(issuers, ca)
+	}
+	return issuers
+}
+
+// discoveryHandler serves GET /admin/v1/discovery: the discovered issuers
+// and the latest lookups, newest first.
+func discoveryHandler(w http.ResponseWriter, r *http.Request) {
+	st := currentState()
+	type issuer struct {
+		Issuer  string `json:"issuer"`
+		Subject string `json:"subject"`
+		Served  bool   `json:"served"`
+	}
+	out := struct {
+		Issuers  []issuer           `json:"issuers"`
+		Attempts []discoveryAttempt `json:"attempts"`
+	}{Issuers: []issuer{}, Attempts: []discoveryAttempt{}}
+	for _, ca := range discoveredCAs() {
+		key := CRLInfo{FileName: registry.crlFile(ca)}.key()
+		_, served := st.filters[key]
+		out.Issuers = append(out.Issuers, issuer{key, subjectDN(ca), served})
+	}
+	discovery.Lock()
+	for i := len(discovery.attempts) - 1; i >= 0; i-- {
+		out.Attempts = append(out.Attempts, discovery.attempts[i])
+	}
+	discovery.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(out)
+}
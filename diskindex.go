@@ -0,0 +1,372 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"math/big"
+	"os"
+	"runtime"
+	"sort"
+	"time"
+
+	"github.com/pkkemp/GoOCSPResponder/responder"
+)
+
+// IndexConfig chooses how the revoked entries of each CRL are held.
+type IndexConfig struct {
+	// OnDisk keeps the entries in a memory-mapped index file next to each
+	// cached CRL instead of in Go maps, for CRLs too large to keep on the
+	// heap. The bloom filter is skipped too; lookups binary search the
+	// index instead.
+	OnDisk bool `yaml:"on_disk"`
+	// Bloom limits the bloom filters of in-memory indexes.
+	Bloom BloomConfig `yaml:"bloom"`
+	// Build tunes how indexes are built; see build.go.
+	Build BuildConfig `yaml:"build"`
+}
+
+// The on-disk index is a fixed header followed by fixed-width records
+// sorted by serial hash, so a lookup is a binary search over the mapped
+// file and loading one needs no parsing at all. All integers are big
+// endian; times are Unix seconds.
+//
+//	header (96 bytes)
+//	  0  magic "GOCSPIX2"
+//	  8  record count
+//	 16  thisUpdate
+//	 24  nextUpdate, or math.MinInt64 for none
+//	 32  SHA-256 of the CRL file the index was built from
+//	 64  cRLNumber length (0 for none), then up to 20 octets
+//	 85  the CRL's x509.SignatureAlgorithm, verified when the index was built
+//	 86  padding
+//	record (40 bytes)
+//	  0  first 16 bytes of SHA-256 of the serial's big-endian magnitude
+//	 16  revocation time
+//	 24  invalidity date, or math.MinInt64 for none
+//	 32  reason code
+//	 33  hold instruction: last arc of an id-holdinstruction OID, 0 for none
+//	 34  padding
+const (
+	// indexMagic changes with the encoding, so older indexes are rebuilt.
+	// Version 2 drops duplicate serials; see encodeIndex.
+	indexMagic      = "GOCSPIX2"
+	indexHeaderSize = 96
+	indexRecordSize = 40
+	indexHashSize   = 16
+	noTime          = math.MinInt64
+)
+
+// holdInstructionArc is id-holdinstruction (RFC 5280 5.3.2); the defined
+// instructions are its children.
+var holdInstructionArc = asn1.ObjectIdentifier{1, 2, 840, 10040, 2}
+
+// diskIndex is a mapped index file.
+type diskIndex struct {
+	data    []byte
+	count   int
+	release func() error
+}
+
+func indexPath(crl CRLInfo) string {
+	return rootDir + crl.key() + ".idx"
+}
+
+func serialHash(serial *big.Int) [sha256.Size]byte {
+	return sha256.Sum256(serial.Bytes())
+}
+
+func putTime(b []byte, t time.Time) {
+	v := int64(noTime)
+	if !t.IsZero() {
+		v = t.Unix()
+	}
+	binary.BigEndian.PutUint64(b, uint64(v))
+}
+
+func getTime(b []byte) time.Time {
+	v := int64(binary.BigEndian.Uint64(b))
+	if v == noTime {
+		return time.Time{}
+	}
+	return time.Unix(v, 0).UTC()
+}
+
+// encodeIndex returns the index of scanned, which was read from a file with
+// the given SHA-256. The encoding is canonical, so identical CRLs give
+// identical indexes on every node: a serial listed twice keeps its last
+// entry, as in-memory indexes do, and records are ordered by serial hash
+// alone, leaving no ties for the sort to break. b, if not nil, follows the
+// progress.
+func encodeIndex(scanned *responder.ScannedCRL, crlHash [sha256.Size]byte, b *buildProgress) ([]byte, error) {
+	parsed := scanned.CertificateList
+	buf := make([]byte, indexHeaderSize+scanned.Count*indexRecordSize)
+	copy(buf, indexMagic)
+	putTime(buf[16:], parsed.TBSCertList.ThisUpdate)
+	putTime(buf[24:], parsed.TBSCertList.NextUpdate)
+	copy(buf[32:], crlHash[:])
+	if n := crlNumber(parsed); n != nil && len(n.Bytes()) <= 20 {
+		buf[64] = byte(len(n.Bytes()))
+		copy(buf[65:], n.Bytes())
+	}
+	buf[85] = byte(responder.CRLSignatureAlgorithm(parsed))
+
+	records := buf[indexHeaderSize:]
+	b.phase("encoding", scanned.Count)
+	err := scanned.Entries(func(i int, serial []byte, e responder.Entry) {
+		rec := records[i*indexRecordSize : (i+1)*indexRecordSize]
+		// The magnitude is what serialHash hashes.
+		h := sha256.Sum256(serial)
+		copy(rec, h[:indexHashSize])
+		putTime(rec[16:], e.RevokedAt)
+		putTime(rec[24:], e.InvalidityDate)
+		rec[32] = byte(e.Reason)
+		if len(e.HoldInstruction) == len(holdInstructionArc)+1 && e.HoldInstruction[:len(holdInstructionArc)].Equal(holdInstructionArc) {
+			rec[33] = byte(e.HoldInstruction[len(holdInstructionArc)])
+		}
+		// The CRL position orders duplicates until they are dropped.
+		binary.BigEndian.PutUint32(rec[36:], uint32(i))
+		b.step(i)
+	})
+	if err != nil {
+		return nil, err
+	}
+	b.phase("sorting", 0)
+	sort.Sort(recordSorter(records))
+
+	n := 0
+	for i := 0; i < len(records); i += indexRecordSize {
+		rec := records[i : i+indexRecordSize]
+		if next := i + indexRecordSize; next < len(records) && bytes.Equal(rec[:indexHashSize], records[next:next+indexHashSize]) {
+			continue
+		}
+		copy(records[n:], rec)
+		binary.BigEndian.PutUint32(records[n+36:], 0)
+		n += indexRecordSize
+	}
+	binary.BigEndian.PutUint64(buf[8:], uint64(n/indexRecordSize))
+	return buf[:indexHeaderSize+n], nil
+}
+
+// writeDiskIndex writes the index of scanned, which was read from a file
+// with the given SHA-256, to path.
+func writeDiskIndex(path string, scanned *responder.ScannedCRL, crlHash [sha256.Size]byte, b *buildProgress) error {
+	idx, err := encodeIndex(scanned, crlHash, b)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, idx, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// recordSorter sorts packed records by serial hash, then by the CRL
+// position encodeIndex stores in their padding.
+type recordSorter []byte
+
+func (r recordSorter) Len() int { return len(r) / indexRecordSize }
+func (r recordSorter) Less(i, j int) bool {
+	a, b := r[i*indexRecordSize:(i+1)*indexRecordSize], r[j*indexRecordSize:(j+1)*indexRecordSize]
+	if c := bytes.Compare(a[:indexHashSize], b[:indexHashSize]); c != 0 {
+		return c < 0
+	}
+	return binary.BigEndian.Uint32(a[36:]) < binary.BigEndian.Uint32(b[36:])
+}
+func (r recordSorter) Swap(i, j int) {
+	var tmp [indexRecordSize]byte
+	a, b := r[i*indexRecordSize:(i+1)*indexRecordSize], r[j*indexRecordSize:(j+1)*indexRecordSize]
+	copy(tmp[:], a)
+	copy(a, b)
+	copy(b, tmp[:])
+}
+
+// openDiskIndex maps the index at path. The mapping is released once the
+// index is no longer referenced, so in-flight lookups against a replaced
+// index stay valid.
+func openDiskIndex(path string) (*diskIndex, error) {
+	data, release, err := mapFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < indexHeaderSize || string(data[:8]) != indexMagic {
+		release()
+		return nil, fmt.Errorf("%s: not an index file", path)
+	}
+	count := binary.BigEndian.Uint64(data[8:])
+	if uint64(len(data)-indexHeaderSize) != count*indexRecordSize {
+		release()
+		return nil, fmt.Errorf("%s: truncated index", path)
+	}
+	idx := &diskIndex{data: data, count: int(count), release: release}
+	runtime.SetFinalizer(idx, func(idx *diskIndex) { idx.release() })
+	return idx, nil
+}
+
+func (idx *diskIndex) crlHash() []byte {
+	return idx.data[32:64]
+}
+
+func (idx *diskIndex) record(i int) []byte {
+	off := indexHeaderSize + i*indexRecordSize
+	return idx.data[off : off+indexRecordSize]
+}
+
+// lookup binary searches the index for serial. The records hash
+// magnitudes, so a serial that is not positive is never found rather than
+// found as its positive twin.
+func (idx *diskIndex) lookup(serial *big.Int) (responder.Entry, bool) {
+	if serial.Sign() <= 0 {
+		return responder.Entry{}, false
+	}
+	h := serialHash(serial)
+	key := h[:indexHashSize]
+	// Compare on the leading eight bytes as an integer, which settles all
+	// but the last step or two of the search.
+	prefix := binary.BigEndian.Uint64(key)
+	lo, hi := 0, idx.count
+	for lo < hi {
+		mid := int(uint(lo+hi) >> 1)
+		rec := idx.record(mid)
+		p := binary.BigEndian.Uint64(rec)
+		if p < prefix || (p == prefix && bytes.Compare(rec[:indexHashSize], key) < 0) {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+	if lo == idx.count || !bytes.Equal(idx.record(lo)[:indexHashSize], key) {
+		return responder.Entry{}, false
+	}
+	rec := idx.record(lo)
+	e := responder.Entry{
+		Serial:         serial,
+		RevokedAt:      getTime(rec[16:]),
+		InvalidityDate: getTime(rec[24:]),
+		Reason:         int(rec[32]),
+	}
+	if rec[33] != 0 {
+		e.HoldInstruction = append(asn1.ObjectIdentifier{}, holdInstructionArc...)
+		e.HoldInstruction = append(e.HoldInstruction, int(rec[33]))
+	}
+	return e, true
+}
+
+func hashFile(path string) ([sha256.Size]byte, error) {
+	var sum [sha256.Size]byte
+	f, err := os.Open(path)
+	if err != nil {
+		return sum, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return sum, err
+	}
+	copy(sum[:], h.Sum(nil))
+	return sum, nil
+}
+
+var errStaleIndex = errors.New("index does not match the CRL")
+
+// loadDiskIndex returns the on-disk index of crl, rebuilding it if it is
+// missing or was built from a different version of the CRL. An index that
+// is current is used without parsing the CRL. crlHash is the CRL file's
+// SHA-256.
+func loadDiskIndex(cfg *Config, crl CRLInfo, crlHash [sha256.Size]byte, b *buildProgress) (CRLBloomFilter, error) {
+	path := indexPath(crl)
+	idx, err := openDiskIndex(path)
+	if err == nil && !bytes.Equal(idx.crlHash(), crlHash[:]) {
+		err = errStaleIndex
+	}
+	// Only verified CRLs are indexed, but the policy may have changed
+	// since; an index with an algorithm Go has no constant for is rebuilt
+	// so the CRL is checked in full.
+	if err == nil {
+		algo := x509.SignatureAlgorithm(idx.data[85])
+		if algo == x509.UnknownSignatureAlgorithm || forbiddenAlgorithm(cfg, algo, algo.String()) != "" {
+			err = errStaleIndex
+		}
+	}
+	// So are the limits; an index over them is rebuilt to be refused.
+	if err == nil {
+		if fi, serr := os.Stat(rootDir + crl.FileName); serr == nil && cfg.Limits.reason(crl.key(), fi.Size(), idx.count) != "" {
+			err = errStaleIndex
+		}
+	}
+	// quirks are those of the CRL if it is parsed again; see tolerant.go.
+	var quirks []string
+	if err != nil {
+		why := err
+		der, err := os.ReadFile(rootDir + crl.FileName)
+		if err != nil {
+			return CRLBloomFilter{}, err
+		}
+		if f, over := limitQuarantine(cfg, crl, der); over {
+			if !readOnly {
+				os.Remove(path)
+			}
+			f.crlHash = crlHash
+			return f, nil
+		}
+		b.phase("parsing", 0)
+		scanned, err := scanCRLFor(cfg, crl, der)
+		if err != nil {
+			return CRLBloomFilter{}, err
+		}
+		quirks = scanned.Quirks
+		if reason := quarantineReason(cfg, crl, scanned.CertificateList); reason != "" {
+			log.Printf("quarantined %s: %s", crl.FileName, reason)
+			if !readOnly {
+				os.Remove(path)
+			}
+			f := quarantined(crl, scanned.CertificateList, reason)
+			f.crlHash = crlHash
+			return f, nil
+		}
+		if readOnly {
+			// The index cannot be rewritten; index in memory instead.
+			log.Printf("read-only mode: %s: %v, indexing in memory", path, why)
+			f, err := indexCRL(cfg, crl, scanned, b)
+			if err != nil {
+				return CRLBloomFilter{}, err
+			}
+			idx, err := encodeIndex(scanned, crlHash, b)
+			if err != nil {
+				return CRLBloomFilter{}, err
+			}
+			f.crlHash = crlHash
+			f.indexHash = sha256.Sum256(idx)
+			f.quirks = quirks
+			return f, nil
+		}
+		if err := writeDiskIndex(path, scanned, crlHash, b); err != nil {
+			return CRLBloomFilter{}, err
+		}
+		if idx, err = openDiskIndex(path); err != nil {
+			return CRLBloomFilter{}, err
+		}
+	}
+	f := CRLBloomFilter{
+		crlInfo:    crl,
+		disk:       idx,
+		thisUpdate: getTime(idx.data[16:]),
+		nextUpdate: getTime(idx.data[24:]),
+		loadedAt:   time.Now(),
+		crlHash:    crlHash,
+		indexHash:  sha256.Sum256(idx.data),
+		quirks:     quirks,
+	}
+	if n := int(idx.data[64]); n > 0 {
+		f.crlNumber = new(big.Int).SetBytes(idx.data[65 : 65+n])
+	}
+	return f, nil
+}
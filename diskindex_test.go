@@ -0,0 +1,133 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkkemp/GoOCSPResponder/responder"
+)
+
+func TestDiskIndexRoundTrip(t *testing.T) {
+	now := time.Now().UTC().Truncate(time.Second)
+	ca := testCA(t, "Disk Index CA", now.Add(-time.Hour), now.Add(time.Hour))
+	long, _ := new(big.Int).SetString("7fffffffffffffffffffffffffffffffffffffff", 16)
+	der := signTestCRL(t, ca, 42, now,
+		x509.RevocationListEntry{SerialNumber: big.NewInt(0x10), RevocationTime: now.Add(-3 * time.Hour), ReasonCode: 1},
+		x509.RevocationListEntry{SerialNumber: big.NewInt(0x20), RevocationTime: now.Add(-2 * time.Hour), ReasonCode: 1},
+		x509.RevocationListEntry{SerialNumber: long, RevocationTime: now.Add(-time.Hour)},
+		// A serial listed twice keeps its last entry.
+		x509.RevocationListEntry{SerialNumber: big.NewInt(0x20), RevocationTime: now.Add(-time.Hour), ReasonCode: 4},
+	)
+	scanned, err := responder.ScanCRL(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crlHash := sha256.Sum256(der)
+	path := filepath.Join(t.TempDir(), "ca.idx")
+	if err := writeDiskIndex(path, scanned, crlHash, nil); err != nil {
+		t.Fatal(err)
+	}
+	idx, err := openDiskIndex(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if idx.count != 3 || string(idx.crlHash()) != string(crlHash[:]) {
+		t.Errorf("index of %d records for CRL %x, want 3 for %x", idx.count, idx.crlHash(), crlHash)
+	}
+
+	for _, tc := range []struct {
+		serial    *big.Int
+		revokedAt time.Time
+		reason    int
+	}{
+		{big.NewInt(0x10), now.Add(-3 * time.Hour), 1},
+		{big.NewInt(0x20), now.Add(-time.Hour), 4},
+		{long, now.Add(-time.Hour), 0},
+	} {
+		e, ok := idx.lookup(tc.serial)
+		if !ok || !e.RevokedAt.Equal(tc.revokedAt) || e.Reason != tc.reason {
+			t.Errorf("lookup(%#x) = %+v, %v, want revoked at %v for %d", tc.serial, e, ok, tc.revokedAt, tc.reason)
+		}
+	}
+	for _, serial := range []*big.Int{big.NewInt(0x30), big.NewInt(0), big.NewInt(-0x10)} {
+		if e, ok := idx.lookup(serial); ok {
+			t.Errorf("lookup(%v) = %+v, want not revoked", serial, e)
+		}
+	}
+}
+
+func TestOpenDiskIndexRefuses(t *testing.T) {
+	now := time.Now()
+	ca := testCA(t, "Disk Index CA", now.Add(-time.Hour), now.Add(time.Hour))
+	scanned, err := responder.ScanCRL(signTestCRL(t, ca, 1, now,
+		x509.RevocationListEntry{SerialNumber: big.NewInt(0x10), RevocationTime: now},
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	good, err := encodeIndex(scanned, [sha256.Size]byte{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	for name, data := range map[string][]byte{
+		"empty":          nil,
+		"short header":   good[:indexHeaderSize-1],
+		"wrong magic":    append([]byte("GOCSPIX1"), good[8:]...),
+		"truncated":      good[:len(good)-1],
+		"trailing bytes": append(append([]byte(nil), good...), 0),
+	} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := openDiskIndex(path); err == nil {
+			t.Errorf("%s: openDiskIndex accepted it", name)
+		}
+	}
+}
+
+// TestLoadDiskIndexRebuilds replaces the cached CRL, so the index built
+// from the old one no longer matches its hash.
+func TestLoadDiskIndexRebuilds(t *testing.T) {
+	saved := rootDir
+	defer func() { rootDir = saved }()
+	rootDir = t.TempDir() + string(filepath.Separator)
+	now := time.Now().UTC().Truncate(time.Second)
+	ca := testCA(t, "Disk Index CA", now.Add(-time.Hour), now.Add(time.Hour))
+	crl := CRLInfo{CA: ca.Cert, FileName: "DISKINDEXCA.crl"}
+	cfg := defaultConfig()
+
+	load := func(der []byte) CRLBloomFilter {
+		t.Helper()
+		if err := os.WriteFile(rootDir+crl.FileName, der, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		f, err := loadDiskIndex(cfg, crl, sha256.Sum256(der), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.disk == nil || f.quarantine != "" {
+			t.Fatalf("loaded %+v, want an on-disk index", f)
+		}
+		return f
+	}
+	first := load(signTestCRL(t, ca, 1, now.Add(-time.Minute),
+		x509.RevocationListEntry{SerialNumber: big.NewInt(0x10), RevocationTime: now},
+	))
+	if _, ok := first.disk.lookup(big.NewInt(0x10)); !ok || first.crlNumber.Int64() != 1 {
+		t.Fatalf("first index: CRL %v, 0x10 revoked %v", first.crlNumber, ok)
+	}
+	second := load(signTestCRL(t, ca, 2, now,
+		x509.RevocationListEntry{SerialNumber: big.NewInt(0x10), RevocationTime: now},
+		x509.RevocationListEntry{SerialNumber: big.NewInt(0x11), RevocationTime: now},
+	))
+	if _, ok := second.disk.lookup(big.NewInt(0x11)); !ok || second.crlNumber.Int64() != 2 || !second.thisUpdate.Equal(now) {
+		t.Errorf("index of the replaced CRL: CRL %v of %v, 0x11 revoked %v; want it rebuilt", second.crlNumber, second.thisUpdate, ok)
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Distinguished names are rendered from their DER rather than with
+// pkix.Name.String, which regroups RDNs by attribute type and passes
+// control characters and bidirectional overrides through to logs and
+// pages. dnString
+// decodes each value by its ASN.1 string type and escapes it per RFC 4514,
+// so the same name renders the same wherever it is shown, and is safe to
+// log and to match programmatically.
+
+// dnAttributeNames are the attribute type names RFC 4514 section 3
+// defines; other types are written as dotted OIDs.
+var dnAttributeNames = map[string]string{
+	"2.5.4.3":                    "CN",
+	"2.5.4.7":                    "L",
+	"2.5.4.8":                    "ST",
+	"2.5.4.10":                   "O",
+	"2.5.4.11":                   "OU",
+	"2.5.4.6":                    "C",
+	"2.5.4.9":                    "STREET",
+	"0.9.2342.19200300.100.1.25": "DC",
+	"0.9.2342.19200300.100.1.1":  "UID",
+}
+
+type dnAttribute struct {
+	Type  asn1.ObjectIdentifier
+	Value asn1.RawValue
+}
+
+// dnAttributeSET is one RDN; encoding/asn1 parses slice types named *SET
+// as a SET OF.
+type dnAttributeSET []dnAttribute
+
+// dnString renders the DER-encoded name der as an RFC 4514 string: RDNs
+// most specific first, the attributes of a multi-valued RDN sorted and
+// joined by '+'. Values that are not strings are written as '#' and the
+// hex of their DER. Besides the characters RFC 4514 requires escaping,
+// every non-printable character, such as controls, bidirectional
+// overrides and non-ASCII spaces, is escaped as hex pairs of its UTF-8
+// bytes. A name that does not parse is written as '#' and its hex.
+func dnString(der []byte) string {
+	var rdns []dnAttributeSET
+	if rest, err := asn1.Unmarshal(der, &rdns); err != nil || len(rest) > 0 {
+		return "#" + hex.EncodeToString(der)
+	}
+	parts := make([]string, 0, len(rdns))
+	for i := len(rdns) - 1; i >= 0; i-- {
+		atvs := make([]string, 0, len(rdns[i]))
+		for _, atv := range rdns[i] {
+			atvs = append(atvs, dnAttributeString(atv))
+		}
+		sort.Strings(atvs)
+		parts = append(parts, strings.Join(atvs, "+"))
+	}
+	return strings.Join(parts, ",")
+}
+
+func dnAttributeString(atv dnAttribute) string {
+	name, ok := dnAttributeNames[atv.Type.String()]
+	if !ok {
+		name = atv.Type.String()
+	}
+	s, ok := dnValue(atv.Value)
+	if !ok {
+		return name + "=#" + hex.EncodeToString(atv.Value.FullBytes)
+	}
+	return name + "=" + escapeDNValue(s)
+}
+
+// dnValue decodes a directory string value, reporting false for types
+// that are not strings and for encodings invalid for their type.
+func dnValue(v asn1.RawValue) (string, bool) {
+	if v.Class != asn1.ClassUniversal || v.IsCompound {
+		return "", false
+	}
+	b := v.Bytes
+	switch v.Tag {
+	case asn1.TagUTF8String:
+		return string(b), utf8.Valid(b)
+	case asn1.TagPrintableString, asn1.TagIA5String, asn1.TagNumericString, 26: // VisibleString
+		for _, c := range b {
+			if c >= utf8.RuneSelf {
+				return "", false
+			}
+		}
+		return string(b), true
+	case asn1.TagT61String:
+		// Treated as Latin-1, as CAs that use it mean.
+		r := make([]rune, len(b))
+		for i, c := range b {
+			r[i] = rune(c)
+		}
+		return string(r), true
+	case asn1.TagBMPString:
+		if len(b)%2 != 0 {
+			return "", false
+		}
+		var r []rune
+		for i := 0; i < len(b); i += 2 {
+			c := rune(b[i])<<8 | rune(b[i+1])
+			if c >= 0xd800 && c < 0xdc00 && i+3 < len(b) {
+				lo := rune(b[i+2])<<8 | rune(b[i+3])
+				if lo >= 0xdc00 && lo < 0xe000 {
+					r = append(r, 0x10000+(c-0xd800)<<10+(lo-0xdc00))
+					i += 2
+					continue
+				}
+			}
+			if c >= 0xd800 && c < 0xe000 {
+				return "", false
+			}
+			r = append(r, c)
+		}
+		return string(r), true
+	case 28: // UniversalString
+		if len(b)%4 != 0 {
+			return "", false
+		}
+		var r []rune
+		for i := 0; i < len(b); i += 4 {
+			c := rune(b[i])<<24 | rune(b[i+1])<<16 | rune(b[i+2])<<8 | rune(b[i+3])
+			if !utf8.ValidRune(c) {
+				return "", false
+			}
+			r = append(r, c)
+		}
+		return string(r), true
+	}
+	return "", false
+}
+
+// escapeDNValue escapes s as an RFC 4514 attribute value.
+func escapeDNValue(s string) string {
+	var b strings.Builder
+	for i, r := range s {
+		switch {
+		case strings.ContainsRune(`"+,;<>\`, r),
+			r == '#' && i == 0,
+			r == ' ' && (i == 0 || i == len(s)-1):
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case !unicode.IsPrint(r):
+			var buf [utf8.UTFMax]byte
+			for _, c := range buf[:utf8.EncodeRune(buf[:], r)] {
+				fmt.Fprintf(&b, `\%02X`, c)
+			}
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// subjectDN renders the subject of cert; see dnString.
+func subjectDN(cert *x509.Certificate) string {
+	return dnString(cert.RawSubject)
+}
+
+// issuerDN renders the issuer of cert; see dnString.
+func issuerDN(cert *x509.Certificate) string {
+	return dnString(cert.RawIssuer)
+}
+
+// crlIssuerDN renders the issuer of a CRL from its raw TBSCertList, as
+// pkix.CertificateList keeps only the decoded name.
+func crlIssuerDN(crl *pkix.CertificateList) string {
+	var tbs struct {
+		Version   int `asn1:"optional,default:0"`
+		Signature asn1.RawValue
+		Issuer    asn1.RawValue
+	}
+	if _, err := asn1.Unmarshal(crl.TBSCertList.Raw, &tbs); err != nil {
+		return crl.TBSCertList.Issuer.String()
+	}
+	return dnString(tbs.Issuer.FullBytes)
+}
+
+// printableName escapes the non-printable characters of a name taken from
+// a certificate or a peer, such as a common name, for logs.
+func printableName(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if unicode.IsPrint(r) {
+			b.WriteRune(r)
+			continue
+		}
+		q := strconv.QuoteRuneToASCII(r)
+		b.WriteString(q[1 : len(q)-1])
+	}
+	return b.String()
+}
@@ -0,0 +1,630 @@
+package main
+
+import (
+	"crypto"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkkemp/GoOCSPResponder/responder"
+)
+
+// apiEndpoint describes one HTTP endpoint. The tables below are what the
+// endpoints are registered from and what /docs renders, so the docs list
+// exactly what the instance serves.
+type apiEndpoint struct {
+	// Path is the documented path, with {name} for path parameters.
+	Path string
+	// Pattern is the ServeMux pattern, if it differs from Path.
+	Pattern string
+	Method  string
+	Summary string
+	// Role is the role required: "" (public), viewer or operator.
+	Role     string
+	Params   []apiParam
+	Request  string
+	Response string
+	// Codes are the other status codes worth knowing about.
+	Codes   map[int]string
+	handler http.HandlerFunc
+	// mutates marks endpoints refused in read-only mode.
+	mutates bool
+	// enabled, if set, limits the endpoint to some configurations.
+	enabled func(cfg *Config) bool
+}
+
+type apiParam struct {
+	Name     string
+	In       string
+	Required bool
+	Doc      string
+}
+
+func (e apiEndpoint) pattern() string {
+	if e.Pattern != "" {
+		return e.Pattern
+	}
+	return e.Path
+}
+
+// wrapped returns the handler behind the endpoint's role check.
+func (e apiEndpoint) wrapped() http.HandlerFunc {
+	h := e.handler
+	if e.mutates {
+		h = writable(h)
+	}
+	if !strings.HasPrefix(e.Response, "application/ocsp") {
+		h = compressed(h)
+	}
+	switch e.Role {
+	case "operator":
+		return adminOnly(h)
+	case "viewer":
+		return dashboardOnly(h)
+	}
+	return h
+}
+
+// registerAPI adds the endpoints enabled by cfg to mux.
+func registerAPI(mux *http.ServeMux, cfg *Config, endpoints []apiEndpoint) {
+	for _, e := range endpoints {
+		if e.enabled == nil || e.enabled(cfg) {
+			mux.HandleFunc(e.pattern(), e.wrapped())
+		}
+	}
+}
+
+var issuerParam = apiParam{"issuer", "query", false, "CRL name, SHA-256 fingerprint, common name or subject of a served CA; all of them when omitted"}
+
+// apiEndpoints are the endpoints of the main listener.
+func apiEndpoints() []apiEndpoint {
+	return []apiEndpoint{
+		{
+			Path: "/", Method: "POST", Summary: "Answer a DER OCSP request (RFC 6960) for any served issuer.",
+			Request: "application/ocsp-request", Response: "application/ocsp-response",
+			Codes:   map[int]string{503: "a standby that has not been promoted"},
+			handler: handler,
+		},
+		{
+			Path: "/healthz", Method: "GET", Summary: "Health, FIPS, region and standby status.",
+			Response: "application/json", Codes: map[int]string{503: "unhealthy, a stale region or a passive standby"},
+			handler: healthzHandler,
+		},
+		{
+			Path: "/readyz", Method: "GET", Summary: "Whether enough issuers are loaded to serve, with the readiness of each.",
+			Params:   []apiParam{{"min", "query", false, "issuers that must be loaded, as a number or a percentage such as 90%; all of them when omitted"}},
+			Response: "application/json", Codes: map[int]string{400: "a bad min", 503: "fewer issuers loaded, or a passive standby"},
+			handler: readyzHandler,
+		},
+		{
+			Path: "/attest", Method: "GET", Summary: "A signed statement of the loaded CRLs, configuration and software version.",
+			Params:   []apiParam{{"nonce", "query", false, "echoed in the statement to prove freshness, at most 128 characters"}},
+			Response: "application/jwt", Codes: map[int]string{404: "attestation is disabled"},
+			handler: attestHandler,
+		},
+		{
+			Path: snapshotPath + "{file}", Pattern: snapshotPath, Method: "GET",
+			Summary:  "The cached CRL behind an issuer's index, for secondary regions. Requires the replication bearer token.",
+			Params:   []apiParam{{"file", "path", true, "CRL file name, such as DODEMAILCA_63.crl"}, {"If-None-Match", "header", false, "ETag of the copy the caller has"}},
+			Response: "application/pkix-crl", Codes: map[int]string{304: "unchanged", 401: "missing or wrong token"},
+			handler: snapshotHandler,
+			enabled: func(cfg *Config) bool { return !cfg.Region.secondary() && cfg.Region.token != "" },
+		},
+		{
+			Path: bundlePath, Method: "GET",
+			Summary:  "The CA bundle the issuers are selected from, for subordinates. Requires the replication bearer token.",
+			Response: "application/x-pem-file", Codes: map[int]string{401: "missing or wrong token"},
+			handler: bundleHandler,
+			enabled: func(cfg *Config) bool { return !cfg.Region.secondary() && cfg.Region.token != "" },
+		},
+		{
+			Path: "/api/v1/capabilities", Method: "GET", Summary: "The served issuers, the CertID hash algorithms and HTTP methods accepted, and the canary serials with their expected answers.",
+			Response: "application/json",
+			handler:  capabilitiesHandler,
+		},
+		{
+			Path: "/api/v1/manifest", Method: "GET", Summary: "The SHA-256 of each loaded CRL and of the index built from it, to compare nodes.",
+			Response: "application/json",
+			handler:  manifestHandler,
+		},
+		{
+			Path: "/api/v1/explain", Method: "GET", Summary: "The decision trail behind the status of one serial.",
+			Params: []apiParam{
+				{"issuer", "query", true, "CRL name, SHA-256 fingerprint, common name or subject of the CA"},
+				{"serial", "query", true, serialHelp},
+				{"asOf", "query", false, "answer from the CRL current at this RFC 3339 time"},
+			},
+			Response: "application/json", Codes: map[int]string{400: "bad parameters", 404: "no such issuer or archived CRL"},
+			handler: explainHandler,
+		},
+		{
+			Path: "/api/v1/gossip", Method: "POST", Summary: "Submit an OCSP response served under this responder's name, to check that it was produced here.",
+			Request: "application/ocsp-response", Response: "application/json",
+			Codes:   map[int]string{400: "not a successful OCSP response", 413: "larger than 64 KiB"},
+			handler: gossipHandler,
+			enabled: func(cfg *Config) bool { return cfg.Gossip.Enabled },
+		},
+		{
+			Path: "/api/v1/gossip/produced", Method: "GET", Summary: "Whether this instance produced the response with a SHA-256, for its peers.",
+			Params:   []apiParam{{"sha256", "query", true, "SHA-256 of the DER response, in hex"}},
+			Response: "application/json", Codes: map[int]string{400: "a bad sha256", 404: "not produced here"},
+			handler: producedHandler,
+			enabled: func(cfg *Config) bool { return cfg.Gossip.Enabled },
+		},
+		{
+			Path: "/api/v1/sign", Method: "POST", Summary: "Sign the responses of a batch of certificates, each only if the served CRL gives the status the caller expects. Requires the batch signing bearer token.",
+			Request: "application/json", Response: "application/json",
+			Codes:   map[int]string{400: "a malformed or empty batch", 401: "missing or wrong token", 413: "over batch_signing.max_items"},
+			handler: batchSignHandler,
+			enabled: func(cfg *Config) bool { return cfg.BatchSigning.token != "" },
+		},
+		{
+			Path: "/api/v1/serial", Method: "GET", Summary: "A serial number in every accepted form, to check how a pasted serial is read.",
+			Params:   []apiParam{{"serial", "query", true, serialHelp}},
+			Response: "application/json", Codes: map[int]string{400: "not a serial in any accepted form"},
+			handler: serialHandler,
+		},
+		{
+			Path: "/admin/v1/subjects", Method: "GET", Role: "operator", Summary: "Revoked certificates by subject.",
+			Params:   []apiParam{{"q", "query", true, "an EDIPI, a UPN or a common name"}},
+			Response: "application/json",
+			handler:  subjectsHandler,
+		},
+		{
+			Path: "/admin/v1/traffic", Method: "GET", Role: "operator", Summary: "OCSP requests, outcomes and latency per client class.",
+			Response: "application/json",
+			handler:  trafficHandler,
+		},
+		{
+			Path: "/admin/v1/mirror-check", Method: "GET", Role: "operator", Summary: "The last comparison of each mirrored CRL with its authoritative copy.",
+			Response: "application/json",
+			handler:  mirrorCheckHandler,
+			enabled:  func(cfg *Config) bool { return cfg.MirrorCheck.enabled() },
+		},
+		{
+			Path: "/admin/v1/unknown-issuers", Method: "GET", Role: "operator", Summary: "Requests for issuers that are not served, by issuer hashes, resolved against the CA bundle.",
+			Response: "application/json",
+			handler:  unknownIssuersHandler,
+		},
+		{
+			Path: "/admin/v1/watchdog", Method: "GET", Role: "operator", Summary: "Goroutines, slow path slots, the state lock and the progress of every background loop.",
+			Response: "application/json",
+			handler:  watchdogHandler,
+		},
+		{
+			Path: "/admin/v1/watchdog/stacks", Method: "GET", Role: "operator", Summary: "The stacks of every goroutine.",
+			Response: "text/plain",
+			handler:  stacksHandler,
+		},
+		{
+			Path: "/admin/v1/captures", Method: "GET", Role: "operator", Summary: "The latest OCSP requests and responses as raw DER, in a tar archive.",
+			Response: "application/x-tar",
+			handler:  capturesHandler,
+			enabled:  func(cfg *Config) bool { return cfg.Capture.Enabled },
+		},
+		{
+			Path: "/admin/v1/discovery", Method: "GET", Role: "operator", Summary: "Issuers served through discovery and the latest lookups of unknown issuers.",
+			Response: "application/json",
+			handler:  discoveryHandler,
+			enabled:  func(cfg *Config) bool { return cfg.Discovery.Enabled },
+		},
+		{
+			Path: "/admin/v1/peers", Method: "GET", Role: "operator", Summary: "Whether the other instances of the pool serve the same revocation data, by manifest.",
+			Response: "application/json",
+			handler:  peersHandler,
+			enabled:  func(cfg *Config) bool { return len(cfg.Peers.URLs) > 0 },
+		},
+		{
+			Path: "/admin/v1/builds", Method: "GET", Role: "operator", Summary: "Index builds in progress with their phase, percent and ETA, the last ones built and the build tuning.",
+			Response: "application/json",
+			handler:  buildsHandler,
+		},
+		{
+			Path: "/admin/v1/cadence", Method: "GET", Role: "operator", Summary: "Each issuer's CRL publications, learned interval and the nextUpdate of its answers.",
+			Response: "application/json",
+			handler:  cadenceHandler,
+		},
+		{
+			Path: "/admin/v1/cascade", Method: "GET", Role: "operator", Summary: "Served CAs found revoked by an ARL or the blocklist, and whether their answers cascade.",
+			Response: "application/json",
+			handler:  cascadeHandler,
+			enabled:  func(cfg *Config) bool { return cfg.Cascade.enabled() },
+		},
+		{
+			Path: "/admin/v1/expired", Method: "GET", Role: "operator", Summary: "Per issuer with an issued-serial source, the expired certificates, their CRL entries and the answers suppressed.",
+			Response: "application/json",
+			handler:  expiredHandler,
+			enabled:  func(cfg *Config) bool { return len(cfg.Expired.Issued) > 0 },
+		},
+		{
+			Path: "/admin/v1/dp-probes", Method: "GET", Role: "operator", Summary: "Per CRL distribution point, the availability and latency of the probes, and the one CRLs are fetched from.",
+			Response: "application/json",
+			handler:  dpProbesHandler,
+			enabled:  func(cfg *Config) bool { return cfg.DPProbes.Interval > 0 },
+		},
+		{
+			Path: "/admin/v1/request-flags", Method: "GET", Role: "operator", Summary: "Each request flag, whether it is allowed and available, and the requests answered under it.",
+			Response: "application/json",
+			handler:  requestFlagsHandler,
+			enabled:  func(cfg *Config) bool { return len(cfg.RequestFlags.Allow) > 0 },
+		},
+		{
+			Path: "/admin/v1/tls", Method: "GET", Role: "operator", Summary: "Per TLS listener, the protocol versions, cipher suites and curves it offers, and its session ticket policy.",
+			Response: "application/json",
+			handler:  tlsHandler,
+			enabled:  func(cfg *Config) bool { return cfg.Dashboard.TLS.Cert != "" || cfg.Standby.Role != "" },
+		},
+		{
+			Path: "/admin/v1/compliance", Method: "GET", Role: "operator", Summary: "The running configuration evaluated against the built-in compliance checklist, check by check.",
+			Response: "application/json",
+			handler:  complianceHandler,
+		},
+		{
+			Path: "/admin/v1/lenient-matches", Method: "GET", Role: "operator", Summary: "Per issuer, the CertIDs answered by issuer key hash alone under cert_id.lenient_name_hash, and the last name hash received.",
+			Response: "application/json",
+			handler:  lenientMatchesHandler,
+			enabled:  func(cfg *Config) bool { return cfg.CertID.LenientNameHash },
+		},
+		{
+			Path: "/admin/v1/aia", Method: "GET", Role: "operator", Summary: "Per issuer, the OCSP and caIssuers URLs to embed in the certificates it issues.",
+			Response: "application/json",
+			handler:  aiaHandler,
+			enabled:  func(cfg *Config) bool { return cfg.AIA.enabled() },
+		},
+		{
+			Path: "/admin/v1/surges", Method: "GET", Role: "operator", Summary: "Each issuer's usual and latest batch of new revocations, and its revocation surges.",
+			Response: "application/json",
+			handler:  surgesHandler,
+			enabled:  func(cfg *Config) bool { return cfg.Refresh.Surge.Enabled },
+		},
+		{
+			Path: "/admin/v1/gossip", Method: "GET", Role: "operator", Summary: "Responses remembered, submissions by verdict and the last submissions never produced here.",
+			Response: "application/json",
+			handler:  gossipStatusHandler,
+			enabled:  func(cfg *Config) bool { return cfg.Gossip.Enabled },
+		},
+		{
+			Path: "/admin/v1/consistency", Method: "GET", Role: "operator", Summary: "The last consistency check of each issuer's index against its CRL.",
+			Response: "application/json",
+			handler:  consistencyHandler,
+		},
+		{
+			Path: "/admin/v1/blocklist", Method: "GET", Role: "operator", Summary: "The emergency blocklist: active entries, and those expired by a CRL.",
+			Response: "application/json",
+			handler:  blocklistHandler,
+			enabled:  func(cfg *Config) bool { return cfg.Blocklist.enabled() },
+		},
+		{
+			Path: "/admin/v1/legacy-usage", Method: "GET", Role: "operator", Summary: "Callers of the deprecated plaintext API.",
+			Response: "application/json",
+			handler:  legacyUsageHandler,
+		},
+		{
+			Path: "/admin/v1/listeners", Method: "GET", Role: "operator", Summary: "The addresses the listeners are bound to, with the process ID.",
+			Response: "application/json",
+			handler:  listenersHandler,
+		},
+		{
+			Path: "/admin/v1/cache", Method: "GET", Role: "operator", Summary: "The response cache's policy and fill, with the counters of every policy used since startup.",
+			Response: "application/json",
+			handler:  cacheHandler,
+		},
+		{
+			Path: "/admin/v1/issuers", Method: "GET", Role: "operator", Summary: "Every issuer seen, with its certificates, aliases, CRL distribution points and state.",
+			Params:   []apiParam{{"issuer", "query", false, "only the issuers this names: key, alias, subject, SKI or fingerprint"}},
+			Response: "application/json", Codes: map[int]string{404: "no known issuer matches"},
+			handler: issuersHandler,
+		},
+		{
+			Path: "/admin/v1/disclosure.csv", Method: "GET", Role: "operator", Summary: "A CCADB-style CRL disclosure: per CA certificate with a CRL here, the CRL URL, number, validity, last refresh and entry count.",
+			Response: "text/csv",
+			handler:  disclosureHandler,
+		},
+		{
+			Path: "/admin/v1/tls-check", Method: "GET", Role: "operator", Summary: "The last check of each HTTPS certificate against the pins and CT logs.",
+			Response: "application/json",
+			handler:  tlsCheckHandler,
+			enabled:  func(cfg *Config) bool { return cfg.TLSCheck.Interval > 0 },
+		},
+		{
+			Path: "/docs", Method: "GET", Summary: "This documentation.",
+			Response: "text/html", handler: docsHandler,
+		},
+		{
+			Path: "/docs/openapi.json", Method: "GET", Summary: "The endpoints as an OpenAPI 3.0 document.",
+			Response: "application/json", handler: openAPIHandler,
+		},
+		{
+			Path: "/docs/standby.proto", Method: "GET", Summary: "The gRPC service of the warm standby stream.",
+			Response: "text/plain", handler: protoHandler,
+		},
+		{
+			Path: "/docs/examples/{issuer}.{der|pem}", Pattern: "/docs/examples/", Method: "GET",
+			Summary:  "An example OCSP request for a served issuer (.der), or the issuer's certificate (.pem).",
+			Params:   []apiParam{{"serial", "query", false, "serial to ask about, " + serialHelp + "; 1 by default"}},
+			Response: "application/ocsp-request", Codes: map[int]string{404: "no such issuer"},
+			handler: exampleHandler,
+		},
+	}
+}
+
+// dashboardEndpoints are served with the dashboard, on its own listener if
+// it has one.
+func dashboardEndpoints() []apiEndpoint {
+	return []apiEndpoint{
+		{
+			Path: "/stats", Method: "GET", Role: "viewer", Summary: "The dashboard: revocations per CA, and operator actions.",
+			Response: "text/html", handler: crlStatsHandler,
+		},
+	}
+}
+
+// adminEndpoints are the admin API behind the dashboard's operator
+// buttons, served with the dashboard.
+func adminEndpoints() []apiEndpoint {
+	return []apiEndpoint{
+		{
+			Path: "/admin/v1/refresh", Method: "POST", Role: "operator", Summary: "Refresh CRLs now.",
+			Params: []apiParam{issuerParam}, Response: "application/json",
+			Codes:   map[int]string{404: "no such issuer", 502: "a refresh failed"},
+			handler: refreshHandler, mutates: true,
+		},
+		{
+			Path: "/admin/v1/crl", Method: "POST", Role: "operator", Summary: "Load a CRL obtained out of band, after the downloader's checks.",
+			Params:  []apiParam{{"issuer", "query", false, "the served issuer of the CRL; found from the CRL's issuer name when omitted"}},
+			Request: "multipart/form-data (field crl) or application/pkix-crl, DER or PEM", Response: "application/json",
+			Codes:   map[int]string{400: "not a CRL", 404: "no such issuer", 409: "older than the served CRL, or the issuer is frozen", 422: "bad signature or algorithm, expired or not yet valid"},
+			handler: crlUploadHandler, mutates: true,
+		},
+		{
+			Path: "/admin/v1/cache/flush", Method: "POST", Role: "operator", Summary: "Drop cached responses: all of them, or those of an issuer, a serial or CRLs below a number.",
+			Params: []apiParam{
+				issuerParam,
+				{"serial", "query", false, "only responses answering this serial, " + serialHelp},
+				{"before_crl_number", "query", false, "only responses derived from a CRL numbered below this, or without a number; needs issuer"},
+			},
+			Response: "application/json",
+			Codes:    map[int]string{400: "bad serial or CRL number, or before_crl_number without issuer", 404: "no such issuer"},
+			handler:  flushCacheHandler, mutates: true,
+		},
+		{
+			Path: "/admin/v1/signer", Method: "POST", Role: "operator", Summary: "Choose the key served during a signing key migration, and report it with the issuers the keys may not sign for.",
+			Params:   []apiParam{{"serve", "query", false, "current, next or schedule (signer.next.serve_from); reports only when omitted"}},
+			Response: "application/json", Codes: map[int]string{409: "no signer.next is configured"},
+			handler: signerHandler, mutates: true,
+		},
+		{
+			Path: "/admin/v1/blocklist/install", Method: "POST", Role: "operator", Summary: "Replace the emergency blocklist; it takes effect at once.",
+			Request: "application/jwt", Response: "application/json",
+			Codes:   map[int]string{400: "bad signature, entries or unserved issuers", 409: "older than the installed list"},
+			handler: blocklistInstallHandler, mutates: true,
+			enabled: func(cfg *Config) bool { return cfg.Blocklist.enabled() },
+		},
+		{
+			Path: "/admin/v1/maintenance", Method: "POST", Role: "operator", Summary: "Answer tryLater for every issuer or chosen ones, keeping health checks green, and report maintenance.",
+			Params: []apiParam{
+				{"mode", "query", false, "on or off; reports only when omitted"},
+				{"issuer", "query", false, "an issuer to put in maintenance, repeatable; every issuer when omitted"},
+				{"retry_after", "query", false, "the Retry-After, such as 10m; maintenance.retry_after by default"},
+				{"reason", "query", false, "logged and reported"},
+			},
+			Response: "application/json", Codes: map[int]string{400: "bad mode or retry_after", 404: "no such issuer"},
+			handler: maintenanceHandler, mutates: true,
+		},
+		{
+			Path: "/admin/v1/freeze", Method: "POST", Role: "operator", Summary: "Pin an issuer to the CRL it serves, refusing newer ones until lifted or expired, and report the freezes.",
+			Params: []apiParam{
+				{"mode", "query", false, "on or off; reports only when omitted"},
+				{"issuer", "query", false, "the issuer to freeze or unfreeze, required with mode"},
+				{"crl_number", "query", false, "the CRL number the issuer must be serving to be frozen"},
+				{"duration", "query", false, "how long the freeze lasts, such as 48h; freeze.duration by default, at most freeze.max_duration"},
+				{"reason", "query", false, "logged and reported"},
+			},
+			Response: "application/json", Codes: map[int]string{400: "bad mode, crl_number or duration, or no issuer", 404: "no such issuer", 409: "another CRL number is served, or the CRL is quarantined"},
+			handler: freezeHandler, mutates: true,
+		},
+		{
+			Path: "/admin/v1/builds/tune", Method: "POST", Role: "operator", Summary: "Change the workers, chunk size or pause of index builds until restart, running builds included.",
+			Params: []apiParam{
+				{"workers", "query", false, "indexes built at once"},
+				{"chunk_size", "query", false, "entries between two progress updates and pauses"},
+				{"pause", "query", false, "slept after every chunk, such as 5ms"},
+				{"reset", "query", false, "true to follow index.build of the configuration again"},
+			},
+			Response: "application/json", Codes: map[int]string{400: "bad workers, chunk_size or pause"},
+			handler: buildTuneHandler, mutates: true,
+		},
+		{
+			Path: "/admin/v1/promote", Method: "POST", Role: "operator", Summary: "Promote a warm standby.",
+			Response: "application/json", Codes: map[int]string{409: "not a standby"},
+			handler: promoteHandler, mutates: true,
+		},
+	}
+}
+
+// documented returns every endpoint enabled by cfg, sorted by path.
+func documented(cfg *Config) []apiEndpoint {
+	var all []apiEndpoint
+	for _, group := range [][]apiEndpoint{apiEndpoints(), dashboardEndpoints(), adminEndpoints()} {
+		for _, e := range group {
+			if e.enabled == nil || e.enabled(cfg) {
+				all = append(all, e)
+			}
+		}
+	}
+	// OCSP GETs are sniffed from the path rather than registered.
+	all = append(all, apiEndpoint{
+		Path: "/{request}", Method: "GET",
+		Summary:  "Answer a base64 DER OCSP request sent in the path (RFC 6960 appendix A.1); routed paths take it below them.",
+		Params:   []apiParam{{"request", "path", true, "URL-escaped base64 of the DER request"}},
+		Response: "application/ocsp-response",
+	})
+	for _, r := range cfg.Routes {
+		all = append(all, apiEndpoint{
+			Path: "/" + r.segment() + "/", Method: "POST",
+			Summary: "Answer a DER OCSP request for " + r.Issuer + " only; other issuers are unauthorized.",
+			Request: "application/ocsp-request", Response: "application/ocsp-response",
+		})
+	}
+	sort.SliceStable(all, func(i, j int) bool { return all[i].Path < all[j].Path })
+	return all
+}
+
+// openAPI renders the endpoints as an OpenAPI 3.0 document.
+func openAPI(cfg *Config) map[string]interface{} {
+	paths := make(map[string]interface{})
+	for _, e := range documented(cfg) {
+		op := map[string]interface{}{"summary": e.Summary}
+		var params []interface{}
+		for _, p := range e.Params {
+			params = append(params, map[string]interface{}{
+				"name": p.Name, "in": p.In, "required": p.Required || p.In == "path",
+				"description": p.Doc, "schema": map[string]string{"type": "string"},
+			})
+		}
+		if params != nil {
+			op["parameters"] = params
+		}
+		if e.Request != "" {
+			op["requestBody"] = map[string]interface{}{
+				"required": true,
+				"content":  map[string]interface{}{e.Request: map[string]interface{}{"schema": map[string]string{"type": "string", "format": "binary"}}},
+			}
+		}
+		responses := map[string]interface{}{
+			"200": map[string]interface{}{"description": "OK", "content": map[string]interface{}{e.Response: map[string]interface{}{}}},
+		}
+		for code, doc := range e.Codes {
+			responses[strconv.Itoa(code)] = map[string]string{"description": doc}
+		}
+		op["responses"] = responses
+		if e.Role != "" {
+			op["security"] = []interface{}{map[string][]string{"bearer": {}}, map[string][]string{"dashboard": {}}}
+			op["x-goocsp-role"] = e.Role
+		}
+		item, _ := paths[e.Path].(map[string]interface{})
+		if item == nil {
+			item = make(map[string]interface{})
+			paths[e.Path] = item
+		}
+		item[strings.ToLower(e.Method)] = op
+	}
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info":    map[string]string{"title": "goocsp", "version": softwareVersion()},
+		"paths":   paths,
+		"components": map[string]interface{}{
+			"securitySchemes": map[string]interface{}{
+				"bearer":    map[string]string{"type": "http", "scheme": "bearer", "description": "the admin token"},
+				"dashboard": map[string]string{"type": "apiKey", "in": "cookie", "name": sessionCookie, "description": "a dashboard session, or a client certificate with mtls"},
+			},
+		},
+	}
+}
+
+func openAPIHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(openAPI(currentState().cfg))
+}
+
+func protoHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte(standbyProto))
+}
+
+// docsExample is an example request for one served issuer.
+type docsExample struct {
+	Key    string
+	Issuer string
+	Serial string
+}
+
+// docsHandler serves /docs, rendered from the same tables the endpoints are
+// registered from.
+func docsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/docs" {
+		http.NotFound(w, r)
+		return
+	}
+	st := currentState()
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	data := struct {
+		PageTitle string
+		Version   string
+		Base      string
+		Endpoints []apiEndpoint
+		Examples  []docsExample
+		Standby   string
+	}{
+		PageTitle: "goocsp API",
+		Version:   softwareVersion(),
+		Base:      scheme + "://" + r.Host,
+		Endpoints: documented(st.cfg),
+		Standby:   st.cfg.Standby.Role,
+	}
+	for _, crl := range st.crls {
+		ex := docsExample{Key: crl.key(), Issuer: subjectDN(crl.CA), Serial: "0x1"}
+		// The lowest revoked serial, first in the index, makes a more
+		// telling example.
+		if idx := st.filters[crl.key()].entries; idx.len() > 0 {
+			ex.Serial = fmt.Sprintf("0x%x", idx.entry(0).Serial)
+		}
+		data.Examples = append(data.Examples, ex)
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	templates.ExecuteTemplate(w, "docs.html", data)
+}
+
+// exampleHandler serves /docs/examples/{issuer}.der, an OCSP request for
+// ?serial= under that issuer, and /docs/examples/{issuer}.pem, the issuer.
+func exampleHandler(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/docs/examples/")
+	dot := strings.LastIndex(name, ".")
+	if dot < 0 {
+		http.NotFound(w, r)
+		return
+	}
+	crl, _, ok := currentState().findIssuer(name[:dot])
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	switch name[dot:] {
+	case ".pem":
+		w.Header().Set("Content-Type", "application/x-pem-file")
+		pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: crl.CA.Raw})
+	case ".der":
+		serial := big.NewInt(1)
+		if s := r.URL.Query().Get("serial"); s != "" {
+			if serial, ok = parseSerial(s); !ok {
+				http.Error(w, "serial must be "+serialHelp, http.StatusBadRequest)
+				return
+			}
+		}
+		nameHash, keyHash, err := responder.IssuerHashes(crl.CA, crypto.SHA1)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		der, err := responder.CreateRequest(responder.CertID{HashAlgorithm: crypto.SHA1, NameHash: nameHash, KeyHash: keyHash, SerialNumber: serial})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/ocsp-request")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+crl.key()+`.der"`)
+		w.Write(der)
+	default:
+		http.NotFound(w, r)
+	}
+}
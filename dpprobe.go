@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DPProbeConfig probes the CRL distribution points ahead of the refreshes:
+// every interval each base URL, crl_base_url and its mirrors, is sent a
+// HEAD for one of the served CRLs in turn, and its availability and
+// latency are tracked. CRLs are fetched from the preferred base, which
+// moves to a healthy mirror as soon as the probes find the current one
+// failing, so a distribution point going down is noticed before a refresh
+// fails on it.
+type DPProbeConfig struct {
+	// Mirrors are further base URLs serving the CRLs by the same file
+	// names as crl_base_url, in order of preference.
+	Mirrors []string `yaml:"mirrors"`
+	// Interval is the pause between two rounds of probes; 0 disables them.
+	Interval time.Duration `yaml:"interval"`
+	// Timeout bounds one probe.
+	Timeout time.Duration `yaml:"timeout"`
+	// FailAfter is the number of failed probes in a row after which a base
+	// is given up for the next healthy one.
+	FailAfter int `yaml:"fail_after"`
+}
+
+func (c DPProbeConfig) validate() error {
+	for _, u := range c.Mirrors {
+		if parsed, err := url.Parse(u); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return fmt.Errorf("dp_probes: mirror %q must be an http(s) URL", u)
+		}
+	}
+	if c.Interval < 0 || c.Timeout <= 0 || c.FailAfter < 1 {
+		return errors.New("dp_probes: interval must not be negative, timeout must be positive and fail_after at least 1")
+	}
+	return nil
+}
+
+// dpProbeWindow is the number of probes availability is computed over.
+const dpProbeWindow = 60
+
+// dpStatus is what the probes found of one base URL.
+type dpStatus struct {
+	URL string `json:"url"`
+	// Probed is false for bases that cannot be probed, such as object
+	// storage.
+	Probed    bool      `json:"probed"`
+	CheckedAt time.Time `json:"checked_at,omitempty"`
+	// LastURL is the CRL the last probe asked for.
+	LastURL string `json:"last_url,omitempty"`
+	Error   string `json:"error,omitempty"`
+	// Availability is the share of the last probes that succeeded, over at
+	// most dpProbeWindow of them.
+	Availability float64 `json:"availability"`
+	// Latency is that of the last successful probe, and AvgLatency the
+	// average of the successful probes in the window.
+	Latency    time.Duration `json:"latency_ns"`
+	AvgLatency time.Duration `json:"avg_latency_ns"`
+	// Failures counts the failed probes in a row.
+	Failures  int  `json:"consecutive_failures"`
+	Preferred bool `json:"preferred"`
+
+	// results are the last probes, newest last; 0 for a failure.
+	results []time.Duration
+}
+
+// healthy reports whether the base has not failed failAfter probes in a
+// row.
+func (s *dpStatus) healthy(failAfter int) bool {
+	return !s.Probed || s.Failures < failAfter
+}
+
+func (s *dpStatus) record(latency time.Duration, err error, now time.Time) {
+	s.CheckedAt = now
+	if err != nil {
+		s.Error = err.Error()
+		s.Failures++
+		latency = 0
+	} else {
+		s.Error, s.Failures, s.Latency = "", 0, latency
+	}
+	s.results = append(s.results, latency)
+	if len(s.results) > dpProbeWindow {
+		s.results = s.results[1:]
+	}
+	var ok int
+	var total time.Duration
+	for _, d := range s.results {
+		if d > 0 {
+			ok++
+			total += d
+		}
+	}
+	s.Availability = float64(ok) / float64(len(s.results))
+	s.AvgLatency = 0
+	if ok > 0 {
+		s.AvgLatency = total / time.Duration(ok)
+	}
+}
+
+// dpProbes holds the status of every base URL and the preferred one.
+var dpProbes = struct {
+	sync.Mutex
+	byURL     map[string]*dpStatus
+	preferred string
+	// allDown is set while every base fails, not to alert every round.
+	allDown bool
+	// turn rotates the CRL each round probes.
+	turn int
+}{byURL: make(map[string]*dpStatus)}
+
+// crlBases returns crl_base_url and the mirrors, in order of preference.
+func (c *Config) crlBases() []string {
+	return append([]string{c.CRLBaseURL}, c.DPProbes.Mirrors...)
+}
+
+// preferredCRLBase returns the base URL CRLs are fetched from: the one the
+// probes prefer, while it is still configured, or else crl_base_url.
+func (c *Config) preferredCRLBase() string {
+	dpProbes.Lock()
+	p := dpProbes.preferred
+	dpProbes.Unlock()
+	if p != "" {
+		for _, b := range c.crlBases() {
+			if b == p {
+				return p
+			}
+		}
+	}
+	return c.CRLBaseURL
+}
+
+var dpProbeClient = &http.Client{}
+
+// probeDP sends a HEAD for the CRL u and returns how long the answer took.
+func probeDP(ctx context.Context, cfg *Config, u string) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, cfg.DPProbes.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, u, nil)
+	if err != nil {
+		return 0, err
+	}
+	client := *dpProbeClient
+	client.CheckRedirect = cfg.Redirects.checkRedirect
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("HEAD %s: %s", req.URL.Redacted(), resp.Status)
+	}
+	// A zero duration means a failure in the window.
+	return time.Since(start) + time.Nanosecond, nil
+}
+
+// runDPProber probes the distribution points of the current configuration
+// every interval.
+func runDPProber(hb heartbeat) {
+	for {
+		st := currentState()
+		cfg := st.cfg
+		if cfg.DPProbes.Interval == 0 || cfg.Region.secondary() || len(st.crls) == 0 {
+			// Disabled; a reload may enable it.
+			if !hb.sleep(time.Minute) {
+				return
+			}
+			continue
+		}
+		probeDPs(st)
+		if !hb.sleep(cfg.DPProbes.Interval) {
+			return
+		}
+	}
+}
+
+// probeDPs runs one round of probes and moves the preferred base if the
+// current one is failing.
+func probeDPs(st *state) {
+	cfg := st.cfg
+	dpProbes.Lock()
+	fileName := st.crls[dpProbes.turn%len(st.crls)].FileName
+	dpProbes.turn++
+	dpProbes.Unlock()
+
+	bases := cfg.crlBases()
+	type result struct {
+		latency time.Duration
+		err     error
+		probed  bool
+	}
+	results := make([]result, len(bases))
+	var wg sync.WaitGroup
+	for i, base := range bases {
+		if !strings.HasPrefix(base, "http://") && !strings.HasPrefix(base, "https://") {
+			continue
+		}
+		results[i].probed = true
+		wg.Add(1)
+		go func(i int, u string) {
+			defer wg.Done()
+			results[i].latency, results[i].err = probeDP(context.Background(), cfg, u)
+		}(i, strings.TrimSuffix(bases[i], "/")+"/"+fileName)
+	}
+	wg.Wait()
+
+	now := time.Now()
+	dpProbes.Lock()
+	defer dpProbes.Unlock()
+	byURL := make(map[string]*dpStatus, len(bases))
+	for i, base := range bases {
+		s := dpProbes.byURL[base]
+		if s == nil {
+			s = &dpStatus{URL: base}
+		}
+		s.Probed = results[i].probed
+		if s.Probed {
+			s.LastURL = strings.TrimSuffix(base, "/") + "/" + fileName
+			s.record(results[i].latency, results[i].err, now)
+			if s.Failures == cfg.DPProbes.FailAfter {
+				log.Printf("dp probes: %s failed %d probes in a row: %s", base, s.Failures, s.Error)
+			}
+		}
+		byURL[base] = s
+	}
+	dpProbes.byURL = byURL
+
+	// The first healthy base in order of preference wins, but a healthy
+	// preferred base is kept: no flapping back and forth on one failure.
+	preferred := dpProbes.preferred
+	if s := byURL[preferred]; s == nil || !s.healthy(cfg.DPProbes.FailAfter) {
+		next := ""
+		for _, base := range bases {
+			if byURL[base].healthy(cfg.DPProbes.FailAfter) {
+				next = base
+				break
+			}
+		}
+		switch {
+		case next == "" && s != nil:
+			// Nowhere better to go.
+			if !dpProbes.allDown {
+				alert(cfg, "every CRL distribution point is failing its probes; the next refresh will likely fail")
+			}
+			dpProbes.allDown = true
+		case next != "" && preferred != "" && s != nil:
+			alert(cfg, "CRL distribution point %s is failing its probes (%s); fetching CRLs from %s", preferred, s.Error, next)
+			preferred = next
+		case next != "":
+			preferred = next
+		}
+		if next != "" {
+			dpProbes.allDown = false
+		}
+	}
+	if preferred == "" {
+		preferred = cfg.CRLBaseURL
+	}
+	dpProbes.preferred = preferred
+	for base, s := range byURL {
+		s.Preferred = base == preferred
+	}
+}
+
+// dpProbesHandler serves GET /admin/v1/dp-probes.
+func dpProbesHandler(w http.ResponseWriter, r *http.Request) {
+	dpProbes.Lock()
+	out := make([]dpStatus, 0, len(dpProbes.byURL))
+	for _, s := range dpProbes.byURL {
+		out = append(out, *s)
+	}
+	dpProbes.Unlock()
+	order := make(map[string]int)
+	for i, b := range currentState().cfg.crlBases() {
+		order[b] = i
+	}
+	sort.Slice(out, func(i, j int) bool { return order[out[i].URL] < order[out[j].URL] })
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(out)
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkkemp/GoOCSPResponder/responder"
+)
+
+// EventsConfig publishes every newly observed revocation to a message bus,
+// so downstream systems (SIEM, access-control caches) can react without
+// polling. It is read at startup only.
+type EventsConfig struct {
+	// Bus is kafka or nats; empty disables the event stream.
+	Bus string `yaml:"bus"`
+	// Brokers are host:port addresses of Kafka bootstrap brokers or NATS
+	// servers, tried in order.
+	Brokers []string `yaml:"brokers"`
+	// Topic is the Kafka topic or NATS subject.
+	Topic string `yaml:"topic"`
+	// JetStream waits for a JetStream stream to acknowledge each message;
+	// core NATS only confirms the server received it.
+	JetStream bool `yaml:"jetstream"`
+	// TokenFile holds a NATS authentication token.
+	TokenFile string          `yaml:"token_file"`
+	TLS       EventsTLSConfig `yaml:"tls"`
+	// Spool holds events until the bus acknowledges them, so events
+	// survive bus outages and restarts. Defaults to events/ in the CRL
+	// cache, which should then be on persistent storage.
+	Spool         string        `yaml:"spool"`
+	RetryInterval time.Duration `yaml:"retry_interval"`
+	// BatchSize caps the events sent in one produce or flush.
+	BatchSize int `yaml:"batch_size"`
+}
+
+// EventsTLSConfig connects to the bus over TLS, with a client certificate
+// when cert is set.
+type EventsTLSConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	CA      string `yaml:"ca"`
+	Cert    string `yaml:"cert"`
+	Key     string `yaml:"key"`
+}
+
+func (c EventsConfig) validate() error {
+	switch c.Bus {
+	case "":
+		return nil
+	case "kafka", "nats":
+	default:
+		return fmt.Errorf("events: unknown bus %q (want kafka or nats)", c.Bus)
+	}
+	if len(c.Brokers) == 0 || c.Topic == "" {
+		return errors.New("events: bus requires brokers and topic")
+	}
+	if c.JetStream && c.Bus != "nats" {
+		return errors.New("events: jetstream requires the nats bus")
+	}
+	if c.RetryInterval <= 0 || c.BatchSize < 1 {
+		return errors.New("events: retry_interval and batch_size must be positive")
+	}
+	return nil
+}
+
+func (c EventsConfig) spool() string {
+	if c.Spool != "" {
+		return c.Spool
+	}
+	return filepath.Join(rootDir, "events")
+}
+
+func (c EventsConfig) tlsConfig() (*tls.Config, error) {
+	if !c.TLS.Enabled {
+		return nil, nil
+	}
+	tc := &tls.Config{}
+	if c.TLS.CA != "" {
+		cas, err := readCertificates(c.TLS.CA)
+		if err != nil {
+			return nil, err
+		}
+		tc.RootCAs = x509.NewCertPool()
+		for _, ca := range cas {
+			tc.RootCAs.AddCert(ca)
+		}
+	}
+	if c.TLS.Cert != "" {
+		cert, err := tls.LoadX509KeyPair(c.TLS.Cert, c.TLS.Key)
+		if err != nil {
+			return nil, err
+		}
+		tc.Certificates = []tls.Certificate{cert}
+	}
+	return tc, nil
+}
+
+// eventSchema versions the event JSON. Fields are only ever added to a
+// version; anything else gets a new one.
+const eventSchema = "goocsp.revocation.v1"
+
+// revocationEvent is one message on the bus.
+type revocationEvent struct {
+	Schema string `json:"schema"`
+	// ID is derived from the issuer, serial and revocation time, so every
+	// responder publishes the same ID for the same revocation; consumers
+	// deduplicate on it, since delivery is at least once.
+	ID string `json:"id"`
+	// Type is revoked for a serial new on the CRL, or updated when the
+	// reason or invalidity date of an entry changed (a hold made
+	// permanent, say).
+	Type           string           `json:"type"`
+	ObservedAt     time.Time        `json:"observed_at"`
+	Source         string           `json:"source"`
+	Issuer         eventIssuer      `json:"issuer"`
+	Serial         string           `json:"serial"`
+	RevokedAt      time.Time        `json:"revoked_at"`
+	Reason         int              `json:"reason"`
+	InvalidityDate *time.Time       `json:"invalidity_date,omitempty"`
+	Hold           string           `json:"hold_instruction,omitempty"`
+	CRL            eventCRL         `json:"crl"`
+	Previous       *eventRevocation `json:"previous,omitempty"`
+}
+
+type eventIssuer struct {
+	Key     string `json:"key"`
+	Subject string `json:"subject"`
+	SHA256  string `json:"sha256"`
+}
+
+type eventCRL struct {
+	Number     string    `json:"number,omitempty"`
+	ThisUpdate time.Time `json:"this_update"`
+}
+
+type eventRevocation struct {
+	Reason         int        `json:"reason"`
+	InvalidityDate *time.Time `json:"invalidity_date,omitempty"`
+}
+
+func eventID(fingerprint []byte, e responder.Entry) string {
+	h := sha256.New()
+	h.Write(fingerprint)
+	h.Write(e.Serial.Bytes())
+	var t [8]byte
+	binary.BigEndian.PutUint64(t[:], uint64(e.RevokedAt.Unix()))
+	h.Write(t[:])
+	return hex.EncodeToString(h.Sum(nil)[:16])
+}
+
+func timePtr(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+// crlEvents diffs the entries of parsed, the CRL that replaces prev, and
+// returns an event for each new entry and each changed one. Entries that
+// leave the CRL (released holds) are not reported.
+func crlEvents(prev CRLBloomFilter, crl CRLInfo, parsed *pkix.CertificateList, now time.Time) []revocationEvent {
+	fp := getSha256Fingerprint(crl.CA)
+	issuer := eventIssuer{Key: crl.key(), Subject: subjectDN(crl.CA), SHA256: hex.EncodeToString(fp[:])}
+	source := eventCRL{ThisUpdate: parsed.TBSCertList.ThisUpdate}
+	if n := crlNumber(parsed); n != nil {
+		source.Number = n.String()
+	}
+	var out []revocationEvent
+	for _, rc := range parsed.TBSCertList.RevokedCertificates {
+		e := responder.EntryFromCRL(rc)
+		ev := revocationEvent{
+			Schema:         eventSchema,
+			ID:             eventID(fp[:], e),
+			Type:           "revoked",
+			ObservedAt:     now,
+			Source:         "crl",
+			Issuer:         issuer,
+			Serial:         fmt.Sprintf("%x", e.Serial),
+			RevokedAt:      e.RevokedAt,
+			Reason:         e.Reason,
+			InvalidityDate: timePtr(e.InvalidityDate),
+			CRL:            source,
+		}
+		if e.HoldInstruction != nil {
+			ev.Hold = e.HoldInstruction.String()
+		}
+		if l := prev.lookup(e.Serial); l.revoked {
+			if l.entry.Reason == e.Reason && l.entry.InvalidityDate.Equal(e.InvalidityDate) {
+				continue
+			}
+			ev.Type = "updated"
+			ev.Previous = &eventRevocation{Reason: l.entry.Reason, InvalidityDate: timePtr(l.entry.InvalidityDate)}
+		}
+		out = append(out, ev)
+	}
+	return out
+}
+
+// eventPublisher sends messages to a bus and returns once the bus has
+// accepted all of them. key keeps each issuer's events in order.
+type eventPublisher interface {
+	publish(key string, msgs [][]byte) error
+	close()
+}
+
+// eventStream is the store-and-forward outbox: events are spooled to disk
+// first, and a single forwarder publishes spool files in order and deletes
+// each once the bus has acknowledged it.
+type eventStream struct {
+	cfg  EventsConfig
+	dial func() (eventPublisher, error)
+	wake chan struct{}
+}
+
+// events is set at startup when events.bus is configured.
+var events *eventStream
+
+func newEventStream(cfg EventsConfig) (*eventStream, error) {
+	tc, err := cfg.tlsConfig()
+	if err != nil {
+		return nil, fmt.Errorf("events: %v", err)
+	}
+	var token string
+	if cfg.TokenFile != "" {
+		b, err := os.ReadFile(cfg.TokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("events: %v", err)
+		}
+		token = strings.TrimSpace(string(b))
+	}
+	if err := os.MkdirAll(cfg.spool(), 0o755); err != nil {
+		return nil, fmt.Errorf("events: %v", err)
+	}
+	s := &eventStream{cfg: cfg, wake: make(chan struct{}, 1)}
+	switch cfg.Bus {
+	case "kafka":
+		s.dial = func() (eventPublisher, error) { return dialKafka(cfg, tc) }
+	case "nats":
+		s.dial = func() (eventPublisher, error) { return dialNATS(cfg, tc, token) }
+	}
+	return s, nil
+}
+
+// enqueue spools events and wakes the forwarder. Spooling only fails when
+// the disk does, and then the events are lost, so it is logged loudly.
+func (s *eventStream) enqueue(evs []revocationEvent) {
+	if len(evs) == 0 {
+		return
+	}
+	var buf bytes.Buffer
+	for _, ev := range evs {
+		line, _ := json.Marshal(ev)
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	name := filepath.Join(s.cfg.spool(), fmt.Sprintf("%020d.jsonl", time.Now().UnixNano()))
+	if err := os.WriteFile(name+".tmp", buf.Bytes(), 0o644); err != nil {
+		log.Printf("events: dropped %d events: %v", len(evs), err)
+		return
+	}
+	if err := os.Rename(name+".tmp", name); err != nil {
+		log.Printf("events: dropped %d events: %v", len(evs), err)
+		return
+	}
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// spooled lists the spool files, oldest first.
+func (s *eventStream) spooled() ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(s.cfg.spool(), "*.jsonl"))
+	sort.Strings(files)
+	return files, err
+}
+
+// run forwards spooled events for as long as the process lives. A file
+// that fails part way is sent again from the start.
+func (s *eventStream) run() {
+	var pub eventPublisher
+	for {
+		files, err := s.spooled()
+		if err == nil {
+			for _, f := range files {
+				if pub == nil {
+					if pub, err = s.dial(); err != nil {
+						break
+					}
+				}
+				if err = s.forward(pub, f); err != nil {
+					pub.close()
+					pub = nil
+					break
+				}
+			}
+		}
+		if err != nil {
+			log.Printf("events: %v; retrying in %v", err, s.cfg.RetryInterval)
+			time.Sleep(s.cfg.RetryInterval)
+			continue
+		}
+		<-s.wake
+	}
+}
+
+// forward publishes one spool file, grouped by issuer, and deletes it.
+func (s *eventStream) forward(pub eventPublisher, file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	byIssuer := make(map[string][][]byte)
+	var order []string
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, 1<<20)
+	for sc.Scan() {
+		var ev struct {
+			Issuer eventIssuer `json:"issuer"`
+		}
+		line := append([]byte(nil), sc.Bytes()...)
+		if err := json.Unmarshal(line, &ev); err != nil {
+			log.Printf("events: %s: skipped a malformed event: %v", filepath.Base(file), err)
+			continue
+		}
+		if _, ok := byIssuer[ev.Issuer.Key]; !ok {
+			order = append(order, ev.Issuer.Key)
+		}
+		byIssuer[ev.Issuer.Key] = append(byIssuer[ev.Issuer.Key], line)
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	for _, key := range order {
+		msgs := byIssuer[key]
+		for len(msgs) > 0 {
+			n := len(msgs)
+			if n > s.cfg.BatchSize {
+				n = s.cfg.BatchSize
+			}
+			if err := pub.publish(key, msgs[:n]); err != nil {
+				return err
+			}
+			msgs = msgs[n:]
+		}
+	}
+	return os.Remove(file)
+}
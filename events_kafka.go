@@ -0,0 +1,391 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// kafkaTimeout bounds each request to a broker, and is the produce
+// timeout the brokers are given.
+const kafkaTimeout = 10 * time.Second
+
+// kafkaPublisher is a minimal Kafka producer: it looks up the topic's
+// partition leaders with a Metadata (v1) request and sends each batch with
+// a Produce (v3) request with acks=all, as an uncompressed v2 record batch.
+// Messages are partitioned by key with the murmur2 hash of the Java
+// client's default partitioner, so each issuer's events stay in order on
+// one partition.
+type kafkaPublisher struct {
+	cfg EventsConfig
+	tc  *tls.Config
+	// leaders maps each partition to its leader's address.
+	leaders []string
+	conns   map[string]net.Conn
+	corr    int32
+}
+
+func dialKafka(cfg EventsConfig, tc *tls.Config) (eventPublisher, error) {
+	p := &kafkaPublisher{cfg: cfg, tc: tc, conns: make(map[string]net.Conn)}
+	var errs []string
+	for _, addr := range cfg.Brokers {
+		err := p.metadata(addr)
+		if err == nil {
+			return p, nil
+		}
+		errs = append(errs, fmt.Sprintf("%s: %v", addr, err))
+	}
+	p.close()
+	return nil, fmt.Errorf("kafka: %s", strings.Join(errs, "; "))
+}
+
+func (p *kafkaPublisher) close() {
+	for _, c := range p.conns {
+		c.Close()
+	}
+	p.conns = make(map[string]net.Conn)
+}
+
+func (p *kafkaPublisher) conn(addr string) (net.Conn, error) {
+	if c, ok := p.conns[addr]; ok {
+		return c, nil
+	}
+	d := &net.Dialer{Timeout: kafkaTimeout}
+	var c net.Conn
+	var err error
+	if p.tc != nil {
+		tc := p.tc.Clone()
+		if tc.ServerName == "" {
+			tc.ServerName, _, _ = net.SplitHostPort(addr)
+		}
+		c, err = tls.DialWithDialer(d, "tcp", addr, tc)
+	} else {
+		c, err = d.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	p.conns[addr] = c
+	return c, nil
+}
+
+// roundTrip sends one request to addr and returns the response body after
+// the correlation ID.
+func (p *kafkaPublisher) roundTrip(addr string, apiKey, version int16, body []byte) (*kafkaReader, error) {
+	c, err := p.conn(addr)
+	if err != nil {
+		return nil, err
+	}
+	p.corr++
+	var w kafkaWriter
+	w.int32(0) // size, filled in below
+	w.int16(apiKey)
+	w.int16(version)
+	w.int32(p.corr)
+	w.string("goocsp")
+	w.buf.Write(body)
+	req := w.buf.Bytes()
+	binary.BigEndian.PutUint32(req, uint32(len(req)-4))
+
+	c.SetDeadline(time.Now().Add(kafkaTimeout))
+	if _, err := c.Write(req); err != nil {
+		p.drop(addr)
+		return nil, err
+	}
+	var size [4]byte
+	if _, err := io.ReadFull(c, size[:]); err != nil {
+		p.drop(addr)
+		return nil, err
+	}
+	resp := make([]byte, binary.BigEndian.Uint32(size[:]))
+	if _, err := io.ReadFull(c, resp); err != nil {
+		p.drop(addr)
+		return nil, err
+	}
+	r := &kafkaReader{b: resp}
+	if corr := r.int32(); corr != p.corr {
+		p.drop(addr)
+		return nil, fmt.Errorf("response to request %d, want %d", corr, p.corr)
+	}
+	return r, nil
+}
+
+func (p *kafkaPublisher) drop(addr string) {
+	if c, ok := p.conns[addr]; ok {
+		c.Close()
+		delete(p.conns, addr)
+	}
+}
+
+// metadata learns the leader of each partition of the topic from addr.
+func (p *kafkaPublisher) metadata(addr string) error {
+	var w kafkaWriter
+	w.int32(1)
+	w.string(p.cfg.Topic)
+	r, err := p.roundTrip(addr, 3, 1, w.buf.Bytes())
+	if err != nil {
+		return err
+	}
+	brokers := make(map[int32]string)
+	for n := r.int32(); n > 0; n-- {
+		id := r.int32()
+		host := r.string()
+		port := r.int32()
+		r.string() // rack
+		brokers[id] = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	}
+	r.int32() // controller
+	for n := r.int32(); n > 0; n-- {
+		code := r.int16()
+		topic := r.string()
+		r.int8() // is_internal
+		if code != 0 {
+			return fmt.Errorf("topic %s: %v", topic, kafkaError(code))
+		}
+		leaders := make([]string, r.count())
+		for range leaders {
+			r.int16() // partition error
+			partition := r.int32()
+			leader := r.int32()
+			for m := r.int32(); m > 0; m-- { // replicas
+				r.int32()
+			}
+			for m := r.int32(); m > 0; m-- { // isr
+				r.int32()
+			}
+			if partition < 0 || int(partition) >= len(leaders) {
+				return fmt.Errorf("topic %s: partition %d out of range", topic, partition)
+			}
+			leaders[partition] = brokers[leader]
+		}
+		p.leaders = leaders
+	}
+	if r.err != nil {
+		return r.err
+	}
+	for i, l := range p.leaders {
+		if l == "" {
+			return fmt.Errorf("topic %s: partition %d has no leader", p.cfg.Topic, i)
+		}
+	}
+	if len(p.leaders) == 0 {
+		return fmt.Errorf("topic %s does not exist", p.cfg.Topic)
+	}
+	return nil
+}
+
+func (p *kafkaPublisher) publish(key string, msgs [][]byte) error {
+	partition := int32(murmur2([]byte(key))&0x7fffffff) % int32(len(p.leaders))
+	batch := recordBatch([]byte(key), msgs, time.Now())
+
+	var w kafkaWriter
+	w.int16(-1) // transactional_id: null
+	w.int16(-1) // acks: all in-sync replicas
+	w.int32(int32(kafkaTimeout / time.Millisecond))
+	w.int32(1)
+	w.string(p.cfg.Topic)
+	w.int32(1)
+	w.int32(partition)
+	w.int32(int32(len(batch)))
+	w.buf.Write(batch)
+	r, err := p.roundTrip(p.leaders[partition], 0, 3, w.buf.Bytes())
+	if err != nil {
+		return err
+	}
+	for n := r.int32(); n > 0; n-- {
+		r.string()
+		for m := r.int32(); m > 0; m-- {
+			r.int32()
+			code := r.int16()
+			r.int64() // base offset
+			r.int64() // log append time
+			if code != 0 {
+				// The leader may have moved; look it up again next time.
+				p.close()
+				return kafkaError(code)
+			}
+		}
+	}
+	return r.err
+}
+
+// recordBatch encodes msgs as a v2 record batch, all with key.
+func recordBatch(key []byte, msgs [][]byte, now time.Time) []byte {
+	ts := now.UnixNano() / int64(time.Millisecond)
+	var records kafkaWriter
+	for i, m := range msgs {
+		var rec kafkaWriter
+		rec.int8(0) // attributes
+		rec.varint(0)
+		rec.varint(int64(i))
+		rec.varint(int64(len(key)))
+		rec.buf.Write(key)
+		rec.varint(int64(len(m)))
+		rec.buf.Write(m)
+		rec.varint(0) // headers
+		records.varint(int64(rec.buf.Len()))
+		records.buf.Write(rec.buf.Bytes())
+	}
+
+	// Everything from attributes on is covered by the CRC.
+	var tail kafkaWriter
+	tail.int16(0) // attributes: no compression, create time
+	tail.int32(int32(len(msgs) - 1))
+	tail.int64(ts)
+	tail.int64(ts)
+	tail.int64(-1) // producer id
+	tail.int16(-1) // producer epoch
+	tail.int32(-1) // base sequence
+	tail.int32(int32(len(msgs)))
+	tail.buf.Write(records.buf.Bytes())
+
+	var w kafkaWriter
+	w.int64(0) // base offset, assigned by the broker
+	w.int32(int32(4 + 1 + 4 + tail.buf.Len()))
+	w.int32(-1) // partition leader epoch
+	w.int8(2)   // magic
+	w.int32(int32(crc32.Checksum(tail.buf.Bytes(), castagnoli)))
+	w.buf.Write(tail.buf.Bytes())
+	return w.buf.Bytes()
+}
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// murmur2 is the hash of the Java client's default partitioner.
+func murmur2(data []byte) uint32 {
+	const (
+		seed = 0x9747b28c
+		m    = 0x5bd1e995
+		r    = 24
+	)
+	h := uint32(seed) ^ uint32(len(data))
+	for len(data) >= 4 {
+		k := binary.LittleEndian.Uint32(data)
+		k *= m
+		k ^= k >> r
+		k *= m
+		h *= m
+		h ^= k
+		data = data[4:]
+	}
+	switch len(data) {
+	case 3:
+		h ^= uint32(data[2]) << 16
+		fallthrough
+	case 2:
+		h ^= uint32(data[1]) << 8
+		fallthrough
+	case 1:
+		h ^= uint32(data[0])
+		h *= m
+	}
+	h ^= h >> 13
+	h *= m
+	h ^= h >> 15
+	return h
+}
+
+type kafkaError int16
+
+func (e kafkaError) Error() string {
+	switch e {
+	case 2:
+		return "kafka: corrupt message"
+	case 3:
+		return "kafka: unknown topic or partition"
+	case 6:
+		return "kafka: not leader for partition"
+	case 7:
+		return "kafka: request timed out"
+	case 10:
+		return "kafka: message too large"
+	case 19, 20:
+		return "kafka: not enough replicas"
+	case 29:
+		return "kafka: topic authorization failed"
+	}
+	return fmt.Sprintf("kafka: error code %d", int16(e))
+}
+
+type kafkaWriter struct {
+	buf bytes.Buffer
+}
+
+func (w *kafkaWriter) int8(v int8) { w.buf.WriteByte(byte(v)) }
+
+func (w *kafkaWriter) int16(v int16) {
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], uint16(v))
+	w.buf.Write(b[:])
+}
+
+func (w *kafkaWriter) int32(v int32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], uint32(v))
+	w.buf.Write(b[:])
+}
+
+func (w *kafkaWriter) int64(v int64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(v))
+	w.buf.Write(b[:])
+}
+
+func (w *kafkaWriter) string(s string) {
+	w.int16(int16(len(s)))
+	w.buf.WriteString(s)
+}
+
+// varint writes a zigzag varint, as record fields use.
+func (w *kafkaWriter) varint(v int64) {
+	var b [binary.MaxVarintLen64]byte
+	w.buf.Write(b[:binary.PutVarint(b[:], v)])
+}
+
+// kafkaReader decodes a response; the first error sticks and later reads
+// return zero values.
+type kafkaReader struct {
+	b   []byte
+	err error
+}
+
+func (r *kafkaReader) next(n int) []byte {
+	if r.err != nil || len(r.b) < n {
+		r.err = errors.New("kafka: short response")
+		return make([]byte, n)
+	}
+	v := r.b[:n]
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *kafkaReader) int8() int8   { return int8(r.next(1)[0]) }
+func (r *kafkaReader) int16() int16 { return int16(binary.BigEndian.Uint16(r.next(2))) }
+func (r *kafkaReader) int32() int32 { return int32(binary.BigEndian.Uint32(r.next(4))) }
+func (r *kafkaReader) int64() int64 { return int64(binary.BigEndian.Uint64(r.next(8))) }
+
+// count reads an array length, rejecting lengths the response cannot hold.
+func (r *kafkaReader) count() int {
+	n := r.int32()
+	if n < 0 || int(n) > len(r.b) {
+		r.err = errors.New("kafka: malformed response")
+		return 0
+	}
+	return int(n)
+}
+
+func (r *kafkaReader) string() string {
+	n := r.int16()
+	if n < 0 {
+		return ""
+	}
+	return string(r.next(int(n)))
+}
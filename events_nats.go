@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// natsTimeout bounds each exchange with the server.
+const natsTimeout = 10 * time.Second
+
+// natsPublisher speaks the NATS client protocol: PUB followed by a PING,
+// whose PONG confirms the server has processed everything before it. With
+// JetStream every message carries a reply subject and the stream's
+// acknowledgement is awaited instead.
+type natsPublisher struct {
+	conn    net.Conn
+	r       *bufio.Reader
+	subject string
+	// inbox receives JetStream acknowledgements; empty for core NATS.
+	inbox string
+}
+
+func dialNATS(cfg EventsConfig, tc *tls.Config, token string) (eventPublisher, error) {
+	var errs []string
+	for _, addr := range cfg.Brokers {
+		p, err := connectNATS(addr, cfg, tc, token)
+		if err == nil {
+			return p, nil
+		}
+		errs = append(errs, fmt.Sprintf("%s: %v", addr, err))
+	}
+	return nil, fmt.Errorf("nats: %s", strings.Join(errs, "; "))
+}
+
+func connectNATS(addr string, cfg EventsConfig, tc *tls.Config, token string) (*natsPublisher, error) {
+	conn, err := net.DialTimeout("tcp", addr, natsTimeout)
+	if err != nil {
+		return nil, err
+	}
+	p := &natsPublisher{conn: conn, r: bufio.NewReader(conn), subject: cfg.Topic}
+	conn.SetDeadline(time.Now().Add(natsTimeout))
+	line, err := p.r.ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "INFO ") {
+		conn.Close()
+		return nil, fmt.Errorf("not a NATS server: %q", strings.TrimSpace(line))
+	}
+	var info struct {
+		TLSRequired bool `json:"tls_required"`
+	}
+	json.Unmarshal([]byte(line[5:]), &info)
+	if info.TLSRequired && tc == nil {
+		conn.Close()
+		return nil, errors.New("server requires TLS; set events.tls.enabled")
+	}
+	if tc != nil {
+		host, _, _ := net.SplitHostPort(addr)
+		tc = tc.Clone()
+		if tc.ServerName == "" {
+			tc.ServerName = host
+		}
+		tlsConn := tls.Client(conn, tc)
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		p.conn, p.r = tlsConn, bufio.NewReader(tlsConn)
+	}
+
+	connect, _ := json.Marshal(map[string]interface{}{
+		"verbose":      false,
+		"pedantic":     false,
+		"tls_required": tc != nil,
+		"name":         "goocsp",
+		"lang":         "go",
+		"version":      "1",
+		"protocol":     1,
+		"auth_token":   token,
+	})
+	cmd := "CONNECT " + string(connect) + "\r\n"
+	if cfg.JetStream {
+		var b [8]byte
+		rand.Read(b[:])
+		p.inbox = "_INBOX.goocsp." + hex.EncodeToString(b[:])
+		cmd += "SUB " + p.inbox + ".* 1\r\n"
+	}
+	if err := p.flush(cmd); err != nil {
+		p.close()
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *natsPublisher) close() {
+	p.conn.Close()
+}
+
+// flush writes cmd and a PING, and waits for the PONG.
+func (p *natsPublisher) flush(cmd string) error {
+	p.conn.SetDeadline(time.Now().Add(natsTimeout))
+	if _, err := io.WriteString(p.conn, cmd+"PING\r\n"); err != nil {
+		return err
+	}
+	for {
+		op, _, err := p.next()
+		if err != nil || op == "PONG" {
+			return err
+		}
+	}
+}
+
+// next reads one server operation, answering PINGs and returning the
+// payload of MSGs.
+func (p *natsPublisher) next() (string, []byte, error) {
+	for {
+		line, err := p.r.ReadString('\n')
+		if err != nil {
+			return "", nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		op := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		switch op {
+		case "PING":
+			if _, err := io.WriteString(p.conn, "PONG\r\n"); err != nil {
+				return "", nil, err
+			}
+		case "+OK", "INFO":
+		case "-ERR":
+			return "", nil, fmt.Errorf("nats: %s", strings.TrimSpace(line[4:]))
+		case "MSG":
+			// MSG <subject> <sid> [reply-to] <#bytes>
+			f := strings.Fields(line)
+			if len(f) < 4 {
+				return "", nil, fmt.Errorf("nats: malformed %q", line)
+			}
+			n, err := strconv.Atoi(f[len(f)-1])
+			if err != nil {
+				return "", nil, fmt.Errorf("nats: malformed %q", line)
+			}
+			payload := make([]byte, n+2)
+			if _, err := io.ReadFull(p.r, payload); err != nil {
+				return "", nil, err
+			}
+			return op, payload[:n], nil
+		default:
+			return op, nil, nil
+		}
+	}
+}
+
+func (p *natsPublisher) publish(key string, msgs [][]byte) error {
+	var cmd strings.Builder
+	for i, m := range msgs {
+		if p.inbox != "" {
+			fmt.Fprintf(&cmd, "PUB %s %s.%d %d\r\n", p.subject, p.inbox, i, len(m))
+		} else {
+			fmt.Fprintf(&cmd, "PUB %s %d\r\n", p.subject, len(m))
+		}
+		cmd.Write(m)
+		cmd.WriteString("\r\n")
+	}
+	if p.inbox == "" {
+		return p.flush(cmd.String())
+	}
+	p.conn.SetDeadline(time.Now().Add(natsTimeout))
+	if _, err := io.WriteString(p.conn, cmd.String()); err != nil {
+		return err
+	}
+	for acked := 0; acked < len(msgs); {
+		op, payload, err := p.next()
+		if err != nil {
+			return err
+		}
+		if op != "MSG" {
+			continue
+		}
+		var ack struct {
+			Stream string `json:"stream"`
+			Error  *struct {
+				Description string `json:"description"`
+			} `json:"error"`
+		}
+		if err := json.Unmarshal(payload, &ack); err != nil {
+			return fmt.Errorf("jetstream: malformed acknowledgement %q", payload)
+		}
+		if ack.Error != nil {
+			return fmt.Errorf("jetstream: %s", ack.Error.Description)
+		}
+		acked++
+	}
+	return nil
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkkemp/GoOCSPResponder/responder"
+)
+
+// ExpiredConfig suppresses the answers of expired certificates. RFC 5280
+// lets a CA drop a certificate from its CRL once it has expired, so past
+// its notAfter a certificate missing from the CRL may have been revoked
+// all the same, and good is no longer a statement the responder can make.
+// The notAfter of each certificate comes from an issued-serial source, a
+// CA database export per issuer; certificates it does not list are
+// answered from the CRL as usual.
+type ExpiredConfig struct {
+	// Issued are the issued-serial sources.
+	Issued []IssuedSource `yaml:"issued"`
+	// Retention is how long past its notAfter a certificate is still
+	// answered from the CRL.
+	Retention time.Duration `yaml:"retention"`
+	// Answer is what certificates expired for longer than Retention get:
+	// unauthorized, as for a certificate the responder knows nothing of,
+	// or unknown. Empty answers them from the CRL and only counts them.
+	Answer string `yaml:"answer"`
+	// Prune drops the entries of those certificates from in-memory
+	// indexes. The archived CRLs keep them.
+	Prune bool `yaml:"prune"`
+}
+
+// IssuedSource is the issued-serial source of one issuer: an openssl ca
+// index.txt, or a CSV file (by .csv extension) with serial (hex) and
+// not_after (RFC 3339 or YYYY-MM-DD) columns.
+type IssuedSource struct {
+	// Issuer names the CA as the explain endpoint accepts it: CRL name,
+	// fingerprint, common name or subject.
+	Issuer string `yaml:"issuer"`
+	Path   string `yaml:"path"`
+}
+
+func (c ExpiredConfig) validate() error {
+	switch c.Answer {
+	case "", "unauthorized", "unknown":
+	default:
+		return fmt.Errorf("expired.answer: %q is neither unauthorized nor unknown", c.Answer)
+	}
+	if c.Prune && c.Answer == "" {
+		// Answered from the CRL, a pruned serial would turn good.
+		return errors.New("expired.prune needs an answer")
+	}
+	if c.Retention < 0 {
+		return errors.New("expired.retention must not be negative")
+	}
+	for _, s := range c.Issued {
+		if s.Issuer == "" || s.Path == "" {
+			return errors.New("expired.issued sources need an issuer and a path")
+		}
+	}
+	return nil
+}
+
+// issuedSerials are the notAfter of the certificates of one issuer, in
+// Unix seconds by serial bytes.
+type issuedSerials struct {
+	path     string
+	notAfter map[string]int64
+}
+
+// expiredAt returns when the certificate serial expires, if the source
+// lists it.
+func (s *issuedSerials) expiredAt(serial *big.Int) (time.Time, bool) {
+	if s == nil || serial.Sign() < 0 {
+		return time.Time{}, false
+	}
+	t, ok := s.notAfter[string(serial.Bytes())]
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(t, 0), true
+}
+
+// issuedFiles keeps the sources read, so states rebuilt on every refresh
+// read only the files that changed.
+var issuedFiles = struct {
+	sync.Mutex
+	byPath map[string]issuedFile
+}{byPath: make(map[string]issuedFile)}
+
+type issuedFile struct {
+	modTime  time.Time
+	size     int64
+	notAfter map[string]int64
+}
+
+// buildIssuedSerials reads the issued-serial sources of st, by CRL key.
+func buildIssuedSerials(st *state) (map[string]*issuedSerials, error) {
+	if len(st.cfg.Expired.Issued) == 0 {
+		return nil, nil
+	}
+	issued := make(map[string]*issuedSerials, len(st.cfg.Expired.Issued))
+	for _, src := range st.cfg.Expired.Issued {
+		crl, _, ok := st.findIssuer(src.Issuer)
+		if !ok {
+			return nil, fmt.Errorf("expired: issuer %q is not served", src.Issuer)
+		}
+		if _, dup := issued[crl.key()]; dup {
+			return nil, fmt.Errorf("expired: issuer %q has two sources", src.Issuer)
+		}
+		notAfter, err := readIssuedSource(src.Path)
+		if err != nil {
+			return nil, fmt.Errorf("expired: %v", err)
+		}
+		issued[crl.key()] = &issuedSerials{path: src.Path, notAfter: notAfter}
+	}
+	return issued, nil
+}
+
+func readIssuedSource(path string) (map[string]int64, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	issuedFiles.Lock()
+	defer issuedFiles.Unlock()
+	if f, ok := issuedFiles.byPath[path]; ok && f.modTime.Equal(fi.ModTime()) && f.size == fi.Size() {
+		return f.notAfter, nil
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var notAfter map[string]int64
+	if strings.EqualFold(filepath.Ext(path), ".csv") {
+		notAfter, err = readIssuedCSV(file)
+	} else {
+		notAfter, err = readIssuedIndex(file)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	issuedFiles.byPath[path] = issuedFile{modTime: fi.ModTime(), size: fi.Size(), notAfter: notAfter}
+	return notAfter, nil
+}
+
+// readIssuedIndex reads the expiry and serial fields of an openssl ca
+// index.txt; see readOpenSSLIndex.
+func readIssuedIndex(r io.Reader) (map[string]int64, error) {
+	notAfter := make(map[string]int64)
+	s := bufio.NewScanner(r)
+	for line := 1; s.Scan(); line++ {
+		if s.Text() == "" {
+			continue
+		}
+		fields := strings.Split(s.Text(), "\t")
+		if len(fields) != 6 {
+			return nil, fmt.Errorf("line %d: want 6 fields, got %d", line, len(fields))
+		}
+		serial, ok := new(big.Int).SetString(fields[3], 16)
+		if !ok {
+			return nil, fmt.Errorf("line %d: bad serial %q", line, fields[3])
+		}
+		// UTCTime, or GeneralizedTime past 2049.
+		layout := "060102150405Z"
+		if len(fields[1]) == len("20060102150405Z") {
+			layout = "20060102150405Z"
+		}
+		t, err := time.Parse(layout, fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: bad expiry %q", line, fields[1])
+		}
+		notAfter[string(serial.Bytes())] = t.Unix()
+	}
+	return notAfter, s.Err()
+}
+
+// readIssuedCSV reads a CSV export with a header row naming the serial and
+// not_after columns.
+func readIssuedCSV(r io.Reader) (map[string]int64, error) {
+	cr := csv.NewReader(r)
+	header, err := cr.Read()
+	if err != nil {
+		return nil, err
+	}
+	col := map[string]int{"serial": -1, "not_after": -1}
+	for i, name := range header {
+		if _, ok := col[strings.ToLower(strings.TrimSpace(name))]; ok {
+			col[strings.ToLower(strings.TrimSpace(name))] = i
+		}
+	}
+	if col["serial"] < 0 || col["not_after"] < 0 {
+		return nil, fmt.Errorf("header must name serial and not_after columns")
+	}
+	notAfter := make(map[string]int64)
+	for {
+		row, err := cr.Read()
+		if err == io.EOF {
+			return notAfter, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		serial, ok := parseSerial("0x" + strings.Replace(row[col["serial"]], ":", "", -1))
+		if !ok {
+			return nil, fmt.Errorf("bad serial %q", row[col["serial"]])
+		}
+		t, err := parseTime(row[col["not_after"]])
+		if err != nil {
+			return nil, fmt.Errorf("bad not_after %q", row[col["not_after"]])
+		}
+		notAfter[string(serial.Bytes())] = t.Unix()
+	}
+}
+
+// expiredLongAgo reports whether the certificate serial of issuer key
+// expired more than expired.retention before now.
+func (st *state) expiredLongAgo(key string, serial *big.Int, now time.Time) bool {
+	notAfter, ok := st.issued[key].expiredAt(serial)
+	return ok && now.Sub(notAfter) > st.cfg.Expired.Retention
+}
+
+// pruning is what expired.prune dropped from an in-memory index.
+type pruning struct {
+	// count is the number of entries dropped, over every pruning of the
+	// index.
+	count int
+	// notAfter and before are the expiries and the cutoff of the last
+	// pruning: the entries of certificates expiring before it went.
+	notAfter map[string]int64
+	before   int64
+}
+
+func (p *pruning) len() int {
+	if p == nil {
+		return 0
+	}
+	return p.count
+}
+
+// dropped reports whether the entry of serial, if the CRL lists it, was
+// pruned.
+func (p *pruning) dropped(serial *big.Int) bool {
+	if p == nil || serial.Sign() < 0 {
+		return false
+	}
+	t, ok := p.notAfter[string(serial.Bytes())]
+	return ok && t < p.before
+}
+
+// pruneExpired returns f without the entries of certificates of issuer key
+// expired for longer than the retention, under expired.prune. Only
+// in-memory indexes are pruned: an on-disk index costs page cache rather
+// than heap. The bloom filter is kept, as a superset of the entries is all
+// it needs to be.
+func (st *state) pruneExpired(key string, f CRLBloomFilter, now time.Time) CRLBloomFilter {
+	s := st.issued[key]
+	if !st.cfg.Expired.Prune || s == nil || f.entries.len() == 0 {
+		return f
+	}
+	idx := f.entries
+	before := now.Add(-st.cfg.Expired.Retention).Unix()
+	expired := func(rec []byte) bool {
+		t, ok := s.notAfter[string(bytes.TrimLeft(rec[:idx.width], "\x00"))]
+		return ok && t < before
+	}
+	dropped := 0
+	for i := 0; i < idx.count; i++ {
+		if expired(idx.record(i)) {
+			dropped++
+		}
+	}
+	if dropped == 0 {
+		return f
+	}
+	kept := make([]byte, 0, (idx.count-dropped)*(idx.width+arenaTrailerSize))
+	for i := 0; i < idx.count; i++ {
+		if rec := idx.record(i); !expired(rec) {
+			kept = append(kept, rec...)
+		}
+	}
+	f.entries = &arenaIndex{data: kept, width: idx.width, count: idx.count - dropped}
+	f.pruned = &pruning{count: f.pruned.len() + dropped, notAfter: s.notAfter, before: before}
+	log.Printf("expired: pruned %d entries of %s", dropped, key)
+	return f
+}
+
+// suppressed counts the answers suppressed under expired.answer, by CRL
+// key, since startup.
+var suppressed = struct {
+	sync.Mutex
+	byIssuer map[string]uint64
+}{byIssuer: make(map[string]uint64)}
+
+func countSuppressed(key string) {
+	suppressed.Lock()
+	suppressed.byIssuer[key]++
+	suppressed.Unlock()
+}
+
+// unauthorizedExpired reports whether id is to be answered unauthorized
+// under expired.answer.
+func (st *state) unauthorizedExpired(f CRLBloomFilter, id responder.CertID, now time.Time) bool {
+	if st.cfg.Expired.Answer != "unauthorized" || !st.expiredLongAgo(f.crlInfo.key(), id.SerialNumber, now) {
+		return false
+	}
+	countSuppressed(f.crlInfo.key())
+	return true
+}
+
+func init() {
+	policyHooks = append(policyHooks, policyHook{name: "expired", apply: applyExpired})
+}
+
+// applyExpired answers unknown for certificates expired for longer than
+// the retention, under expired.answer: unknown.
+func applyExpired(f CRLBloomFilter, single *responder.SingleResponse) bool {
+	st, _ := current.Load().(*state)
+	if st == nil || st.cfg.Expired.Answer != "unknown" || single.Status == responder.Unknown {
+		return false
+	}
+	if !st.expiredLongAgo(f.crlInfo.key(), single.SerialNumber, time.Now()) {
+		return false
+	}
+	countSuppressed(f.crlInfo.key())
+	single.Status = responder.Unknown
+	single.RevokedAt, single.RevocationReason = time.Time{}, 0
+	single.Extensions = f.crlID[:len(f.crlID):len(f.crlID)]
+	return true
+}
+
+// expiredReport is one issuer in GET /admin/v1/expired.
+type expiredReport struct {
+	Issuer string `json:"issuer"`
+	Source string `json:"source"`
+	// Issued is the number of certificates the source lists, and Expired
+	// those expired for longer than the retention.
+	Issued  int `json:"issued"`
+	Expired int `json:"expired"`
+	// Prunable are the CRL entries of expired certificates still in the
+	// index: what RFC 5280 lets the CA drop from its CRL, and the index
+	// could do without. Pruned are those expired.prune dropped.
+	Prunable int `json:"prunable"`
+	Pruned   int `json:"pruned"`
+	// Suppressed counts the answers suppressed since startup.
+	Suppressed uint64 `json:"suppressed"`
+}
+
+// expiredReports counts, for every issuer with a source, the expired
+// certificates and their CRL entries.
+func (st *state) expiredReports(now time.Time) []expiredReport {
+	out := make([]expiredReport, 0, len(st.issued))
+	for key, s := range st.issued {
+		f := st.filters[key]
+		r := expiredReport{Issuer: key, Source: s.path, Issued: len(s.notAfter), Pruned: f.pruned.len()}
+		for serial, t := range s.notAfter {
+			if now.Sub(time.Unix(t, 0)) <= st.cfg.Expired.Retention {
+				continue
+			}
+			r.Expired++
+			if f.lookup(new(big.Int).SetBytes([]byte(serial))).revoked {
+				r.Prunable++
+			}
+		}
+		suppressed.Lock()
+		r.Suppressed = suppressed.byIssuer[key]
+		suppressed.Unlock()
+		out = append(out, r)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Issuer < out[j].Issuer })
+	return out
+}
+
+// expiredHandler serves GET /admin/v1/expired.
+func expiredHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(currentState().expiredReports(time.Now()))
+}
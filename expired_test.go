@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkkemp/GoOCSPResponder/responder"
+)
+
+func TestReadIssuedSource(t *testing.T) {
+	dir := t.TempDir()
+	want := map[string]int64{
+		string(big.NewInt(0x1001).Bytes()): time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC).Unix(),
+		string(big.NewInt(0x1002).Bytes()): time.Date(2051, 6, 1, 0, 0, 0, 0, time.UTC).Unix(),
+	}
+	for name, data := range map[string]string{
+		"index.txt": "V\t210601000000Z\t\t1001\tunknown\t/CN=a\n" +
+			"R\t20510601000000Z\t210101000000Z\t1002\tunknown\t/CN=b\n",
+		"issued.csv": "Serial,Not_After\n10:01,2021-06-01\n1002,2051-06-01T00:00:00Z\n",
+	} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		got, err := readIssuedSource(path)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if len(got) != len(want) {
+			t.Errorf("%s: read %d serials, want %d", name, len(got), len(want))
+		}
+		for serial, notAfter := range want {
+			if got[serial] != notAfter {
+				t.Errorf("%s: %x expires %v, want %v", name, serial, time.Unix(got[serial], 0).UTC(), time.Unix(notAfter, 0).UTC())
+			}
+		}
+	}
+}
+
+// expiredState installs a bench state answering under answer, whose issued
+// serials are 0x1001, expired two days ago, and 0x1002, expired an hour
+// ago, with a day of retention.
+func expiredState(t *testing.T, answer string) func(serial int64) []byte {
+	t.Helper()
+	newReq := benchState(t, defaultConfig().Cache)
+	st := currentState()
+	st.cfg.Expired.Answer, st.cfg.Expired.Retention = answer, 24*time.Hour
+	now := time.Now()
+	st.issued = map[string]*issuedSerials{st.crls[0].key(): {notAfter: map[string]int64{
+		string(big.NewInt(0x1001).Bytes()): now.Add(-48 * time.Hour).Unix(),
+		string(big.NewInt(0x1002).Bytes()): now.Add(-time.Hour).Unix(),
+	}}}
+	return newReq
+}
+
+func postOCSP(t *testing.T, req []byte) *responder.Response {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(req))
+	r.Header.Set("Content-Type", "application/ocsp-request")
+	w := httptest.NewRecorder()
+	ocspHandler(w, r)
+	resp, err := responder.ParseResponse(w.Body.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestExpiredAnswers(t *testing.T) {
+	for _, tc := range []struct {
+		answer string
+		// status is the answer for 0x1001, Successful meaning good.
+		status responder.ResponseStatus
+		single responder.Status
+	}{
+		{"", responder.Successful, responder.Good},
+		{"unauthorized", responder.Unauthorized, 0},
+		{"unknown", responder.Successful, responder.Unknown},
+	} {
+		newReq := expiredState(t, tc.answer)
+		resp := postOCSP(t, newReq(0x1001))
+		if resp.Status != tc.status || (resp.Status == responder.Successful && resp.Responses[0].Status != tc.single) {
+			t.Errorf("answer %q: long expired serial answered %v %+v", tc.answer, resp.Status, resp.Responses)
+		}
+		// Within the retention, and unlisted, serials are answered from
+		// the CRL.
+		for _, serial := range []int64{0x1002, 0x1003} {
+			if resp := postOCSP(t, newReq(serial)); resp.Status != responder.Successful || resp.Responses[0].Status != responder.Good {
+				t.Errorf("answer %q: %#x answered %v %+v, want good", tc.answer, serial, resp.Status, resp.Responses)
+			}
+		}
+	}
+}
+
+func TestPruneExpired(t *testing.T) {
+	newReq := expiredState(t, "unknown")
+	st := currentState()
+	st.cfg.Expired.Prune = true
+	key := st.crls[0].key()
+	revokedAt := time.Now().Add(-72 * time.Hour).UTC().Truncate(time.Second)
+	f := st.filters[key]
+	f.entries = newArenaIndex([]responder.Entry{
+		{Serial: big.NewInt(0x1001), RevokedAt: revokedAt},
+		{Serial: big.NewInt(0x1002), RevokedAt: revokedAt},
+		{Serial: big.NewInt(0x1003), RevokedAt: revokedAt},
+	})
+	now := time.Now()
+
+	pruned := st.pruneExpired(key, f, now)
+	if pruned.entries.len() != 2 || pruned.pruned.len() != 1 || pruned.size() != 3 {
+		t.Fatalf("kept %d entries and pruned %d, want 0x1001 pruned", pruned.entries.len(), pruned.pruned.len())
+	}
+	for serial, want := range map[int64]bool{0x1001: false, 0x1002: true, 0x1003: true} {
+		if _, ok := pruned.entries.lookup(big.NewInt(serial)); ok != want {
+			t.Errorf("%#x in the pruned index: %v, want %v", serial, ok, want)
+		}
+	}
+	if !pruned.pruned.dropped(big.NewInt(0x1001)) || pruned.pruned.dropped(big.NewInt(0x1002)) {
+		t.Error("the pruning does not record what it dropped")
+	}
+	// A pruned serial is answered unknown, never good.
+	st.filters[key] = pruned
+	if resp := postOCSP(t, newReq(0x1001)); resp.Status != responder.Successful || resp.Responses[0].Status != responder.Unknown {
+		t.Errorf("pruned serial answered %v %+v, want unknown", resp.Status, resp.Responses)
+	}
+	// Pruning again drops nothing more, and keeps the count.
+	if again := st.pruneExpired(key, pruned, now); again.entries.len() != 2 || again.pruned.len() != 1 {
+		t.Errorf("pruned again: %d entries, %d pruned", again.entries.len(), again.pruned.len())
+	}
+
+	st.cfg.Expired.Prune = false
+	if kept := st.pruneExpired(key, f, now); kept.entries.len() != 3 || kept.pruned != nil {
+		t.Error("pruned without expired.prune")
+	}
+}
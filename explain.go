@@ -0,0 +1,306 @@
+package main
+
+import (
+	"crypto"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkkemp/GoOCSPResponder/responder"
+)
+
+// explanation is the decision trail behind one status, as returned by
+// /api/v1/explain.
+type explanation struct {
+	Issuer explainIssuer `json:"issuer"`
+	Serial string        `json:"serial"`
+	// SerialFormat is how the serial parameter was read; see serial.go.
+	SerialFormat string             `json:"serial_format,omitempty"`
+	AsOf         *time.Time         `json:"as_of,omitempty"`
+	Status       string             `json:"status"`
+	Revocation   *explainRevocation `json:"revocation,omitempty"`
+	CRL          explainCRL         `json:"crl"`
+	Bloom        explainBloom       `json:"bloom"`
+	ExactLookup  bool               `json:"exact_lookup"`
+	Cache        explainCache       `json:"cache"`
+	PolicyHooks  []string           `json:"policy_hooks"`
+	Trail        []string           `json:"trail"`
+}
+
+type explainIssuer struct {
+	Subject string `json:"subject"`
+	SHA256  string `json:"sha256"`
+	// MatchedBy says which form of the issuer parameter selected it.
+	MatchedBy string `json:"matched_by"`
+	// NameHash and KeyHash are the SHA-1 CertID hashes an OCSP client
+	// would send for this issuer.
+	NameHash string `json:"name_hash"`
+	KeyHash  string `json:"key_hash"`
+}
+
+type explainRevocation struct {
+	RevokedAt       time.Time  `json:"revoked_at"`
+	Reason          int        `json:"reason"`
+	InvalidityDate  *time.Time `json:"invalidity_date,omitempty"`
+	HoldInstruction string     `json:"hold_instruction,omitempty"`
+}
+
+type explainCRL struct {
+	File       string    `json:"file"`
+	Source     string    `json:"source"`
+	Archived   string    `json:"archived,omitempty"`
+	Number     string    `json:"number,omitempty"`
+	ThisUpdate time.Time `json:"this_update"`
+	NextUpdate time.Time `json:"next_update"`
+	LoadedAt   time.Time `json:"loaded_at"`
+	Entries    int       `json:"entries"`
+	Quarantine string    `json:"quarantine,omitempty"`
+	// Quirks are the encoding quirks accepted under tolerant_parsing.
+	Quirks []string `json:"quirks,omitempty"`
+
+	// FetchedFrom is where the loaded CRL was downloaded from, after
+	// redirects.
+	FetchedFrom string `json:"fetched_from,omitempty"`
+}
+
+type explainBloom struct {
+	Checked bool `json:"checked"`
+	Hit     bool `json:"hit"`
+	// Disabled is set for issuers limited to exact lookups.
+	Disabled bool `json:"disabled,omitempty"`
+	// FalsePositiveRate is the filter's estimated false positive rate.
+	FalsePositiveRate float64 `json:"false_positive_rate,omitempty"`
+}
+
+type explainCache struct {
+	Used    bool       `json:"used"`
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+// findIssuer resolves the issuer parameter to a served CRL. It accepts the
+// CRL name (DODEMAILCA_59), the SHA-256 fingerprint of the CA certificate,
+// its common name or its full subject DN, its subject key identifier in
+// hex, or an alias: the common name as a slug (dod-email-ca-59) or one of
+// issuer_aliases. It reports which one matched. The DN is matched
+// case-insensitively in its RFC 4514 form, and exactly as pkix.Name
+// renders it.
+func (st *state) findIssuer(param string) (CRLInfo, string, bool) {
+	if crl, how, ok := st.matchIssuer(param); ok {
+		return crl, how, true
+	}
+	for alias, issuer := range st.cfg.IssuerAliases {
+		if strings.EqualFold(alias, param) {
+			if crl, _, ok := st.matchIssuer(issuer); ok {
+				return crl, "alias", true
+			}
+		}
+	}
+	return CRLInfo{}, "", false
+}
+
+// matchIssuer is findIssuer without the configured aliases.
+func (st *state) matchIssuer(param string) (CRLInfo, string, bool) {
+	fp := strings.ToLower(strings.Replace(param, ":", "", -1))
+	for _, crl := range st.crls {
+		switch {
+		case strings.EqualFold(crl.key(), param):
+			return crl, "crl name", true
+		case fp == fmt.Sprintf("%x", getSha256Fingerprint(crl.CA)):
+			return crl, "sha256 fingerprint", true
+		case strings.EqualFold(crl.CA.Subject.CommonName, param):
+			return crl, "common name", true
+		case strings.EqualFold(subjectDN(crl.CA), param), crl.CA.Subject.String() == param:
+			return crl, "subject", true
+		case strings.EqualFold(issuerSlug(crl.CA.Subject.CommonName), param):
+			return crl, "alias", true
+		case len(crl.CA.SubjectKeyId) > 0 && fp == hex.EncodeToString(crl.CA.SubjectKeyId):
+			return crl, "subject key identifier", true
+		}
+	}
+	return CRLInfo{}, "", false
+}
+
+// explain derives the status of serial under the issuer named by param the
+// same way the OCSP handler does, recording each step. A non-zero asOf
+// answers from the CRL that was current at that time instead.
+func (st *state) explain(param string, serial *big.Int, asOf time.Time) (*explanation, error) {
+	if serial.Sign() <= 0 {
+		return nil, errSerialNotPositive
+	}
+	crl, how, ok := st.findIssuer(param)
+	if !ok {
+		return nil, fmt.Errorf("no served issuer matches %q", param)
+	}
+	nameHash, keyHash, err := responder.IssuerHashes(crl.CA, crypto.SHA1)
+	if err != nil {
+		return nil, err
+	}
+	id := responder.CertID{HashAlgorithm: crypto.SHA1, NameHash: nameHash, KeyHash: keyHash, SerialNumber: serial}
+
+	e := &explanation{
+		Issuer: explainIssuer{
+			Subject:   subjectDN(crl.CA),
+			SHA256:    fmt.Sprintf("%x", getSha256Fingerprint(crl.CA)),
+			MatchedBy: how,
+			NameHash:  hex.EncodeToString(nameHash),
+			KeyHash:   hex.EncodeToString(keyHash),
+		},
+		Serial:      fmt.Sprintf("%x", serial),
+		PolicyHooks: []string{},
+	}
+	e.trail("issuer %q matched by %s: %s", param, how, e.Issuer.Subject)
+
+	// Go through the CertID match so the trail reflects what an OCSP
+	// request for this issuer would hit.
+	f, ok := st.issuerFor(id)
+	if !ok || f.crlInfo.key() != crl.key() {
+		return nil, fmt.Errorf("issuer %s matched but its CertID resolves to no index", crl.key())
+	}
+	e.trail("CertID name/key hash matched CRL %s", crl.FileName)
+
+	var archived string
+	if !asOf.IsZero() {
+		e.AsOf = &asOf
+		if asOf.Before(f.thisUpdate) {
+			f, archived, err = archivedIndex(st.cfg, crl, asOf)
+			if err != nil {
+				return nil, err
+			}
+			e.trail("asOf %s predates the current CRL, using the archived CRL issued %s",
+				asOf.UTC().Format(time.RFC3339), f.thisUpdate.UTC().Format(time.RFC3339))
+		} else {
+			e.trail("current CRL was already in effect at asOf %s", asOf.UTC().Format(time.RFC3339))
+		}
+	}
+
+	e.CRL = explainCRL{
+		File:        crl.FileName,
+		Source:      st.cfg.crlSource(crl.FileName),
+		FetchedFrom: f.crlInfo.FetchedFrom,
+		Archived:    archived,
+		ThisUpdate:  f.thisUpdate,
+		NextUpdate:  f.nextUpdate,
+		LoadedAt:    f.loadedAt,
+		Entries:     f.size(),
+		Quirks:      f.quirks,
+	}
+	if f.crlNumber != nil {
+		e.CRL.Number = f.crlNumber.String()
+	}
+	if f.quarantine != "" {
+		e.CRL.Quarantine = f.quarantine
+		e.trail("CRL is quarantined (%s), its serials are answered unknown", f.quarantine)
+	}
+
+	d := f.decide(id)
+	e.Bloom = explainBloom{Checked: d.lookup.bloomChecked, Hit: d.lookup.bloomHit}
+	if f.Filter != nil {
+		e.Bloom.FalsePositiveRate = bloomFalsePositiveRate(f.Filter.Cap(), f.Filter.K(), uint(f.size()))
+	} else if f.disk == nil && f.quarantine == "" {
+		e.Bloom.Disabled = true
+	}
+	e.ExactLookup = f.quarantine == "" && (!d.lookup.bloomChecked || d.lookup.bloomHit)
+	switch {
+	case f.quarantine != "":
+	case f.disk != nil:
+		e.trail("searched the on-disk index, which has no bloom filter")
+	case f.Filter == nil:
+		e.trail("bloom filter disabled for this issuer by its false positive ceiling, exact lookup only")
+	case !d.lookup.bloomChecked:
+		e.trail("serial is wider than 64 bits, skipped the bloom filter")
+	case d.lookup.bloomHit:
+		e.trail("bloom filter hit")
+	default:
+		e.trail("bloom filter miss, serial is not on the CRL")
+	}
+	if e.ExactLookup {
+		if d.lookup.revoked {
+			e.trail("exact lookup found the serial on the CRL")
+		} else if d.lookup.bloomHit {
+			e.trail("exact lookup did not find the serial, bloom hit was a false positive")
+		} else {
+			e.trail("exact lookup did not find the serial")
+		}
+	}
+
+	// Clients without a nonce send the same bytes CreateRequest produces,
+	// so that is the request the cache would have seen.
+	if !asOf.IsZero() {
+		e.trail("point-in-time query, the response cache does not apply")
+	} else if req, err := responder.CreateRequest(id); err == nil {
+		if c := st.cache.peek(req, time.Now()); c != nil {
+			e.Cache = explainCache{Used: true, Expires: &c.expires}
+			e.trail("pre-signed response cached until %s", c.expires.UTC().Format(time.RFC3339))
+		} else {
+			e.trail("no cached response, the next request is signed on the slow path")
+		}
+	}
+	e.PolicyHooks = append(e.PolicyHooks, d.hooks...)
+	for _, h := range d.hooks {
+		e.trail("policy hook %s changed the response", h)
+	}
+	if r, ok := st.freshness[crl.key()]; ok {
+		e.trail("freshness rule %s keeps answers valid for at most %s", r.Name, r.MaxValidity)
+	}
+
+	e.Status = d.single.Status.String()
+	if d.single.Status == responder.Revoked {
+		rev := &explainRevocation{RevokedAt: d.single.RevokedAt, Reason: d.single.RevocationReason}
+		if d.lookup.revoked {
+			if t := d.lookup.entry.InvalidityDate; !t.IsZero() {
+				rev.InvalidityDate = &t
+			}
+			if d.lookup.entry.HoldInstruction != nil {
+				rev.HoldInstruction = d.lookup.entry.HoldInstruction.String()
+			}
+		}
+		e.Revocation = rev
+	}
+	e.trail("status %s", e.Status)
+	return e, nil
+}
+
+func (e *explanation) trail(format string, args ...interface{}) {
+	e.Trail = append(e.Trail, fmt.Sprintf(format, args...))
+}
+
+// explainHandler serves /api/v1/explain?issuer=…&serial=…[&asOf=…].
+func explainHandler(w http.ResponseWriter, r *http.Request) {
+	issuer, serialParam := r.URL.Query().Get("issuer"), r.URL.Query().Get("serial")
+	if issuer == "" || serialParam == "" {
+		http.Error(w, "issuer and serial are required", http.StatusBadRequest)
+		return
+	}
+	serial, format, ok := parseSerialFormat(serialParam)
+	if !ok {
+		http.Error(w, "serial must be "+serialHelp, http.StatusBadRequest)
+		return
+	}
+	var asOf time.Time
+	if v := r.URL.Query().Get("asOf"); v != "" {
+		t, err := parseTime(v)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		asOf = t
+	}
+	e, err := currentState().explain(issuer, serial, asOf)
+	if err == errSerialNotPositive {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	e.SerialFormat = format
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(e)
+}
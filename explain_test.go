@@ -0,0 +1,31 @@
+package main
+
+import (
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestExplainRejectsNonPositiveSerials(t *testing.T) {
+	benchState(t, defaultConfig().Cache)
+	st := currentState()
+	issuer := st.crls[0].key()
+	for _, serial := range []int64{0, -5} {
+		if _, err := st.explain(issuer, big.NewInt(serial), time.Time{}); err != errSerialNotPositive {
+			t.Errorf("explain(%d) = %v, want %v", serial, err, errSerialNotPositive)
+		}
+	}
+	if _, err := st.explain(issuer, big.NewInt(5), time.Time{}); err != nil {
+		t.Errorf("explain(5) = %v", err)
+	}
+
+	for serial, want := range map[string]int{"-5": http.StatusBadRequest, "0": http.StatusBadRequest, "5": http.StatusOK} {
+		w := httptest.NewRecorder()
+		explainHandler(w, httptest.NewRequest(http.MethodGet, "/api/v1/explain?issuer="+issuer+"&serial="+serial, nil))
+		if w.Code != want {
+			t.Errorf("serial=%s answered %d, want %d: %s", serial, w.Code, want, w.Body)
+		}
+	}
+}
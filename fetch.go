@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Fetcher retrieves a PKI artifact (the CA bundle or a CRL) named by a URL.
+// The scheme of the URL selects the Fetcher: http and https are fetched
+// directly, s3, azblob and gs from object storage.
+type Fetcher interface {
+	Fetch(ctx context.Context, u *url.URL) (io.ReadCloser, error)
+}
+
+// StorageConfig configures the object storage fetchers. Credentials are
+// never read from this file; each backend walks its platform's usual
+// credential chain (environment, shared files, workload identity, instance
+// metadata) and falls back to anonymous access.
+type StorageConfig struct {
+	S3    S3Config    `yaml:"s3"`
+	Azure AzureConfig `yaml:"azure"`
+	GCS   GCSConfig   `yaml:"gcs"`
+}
+
+func newFetchers(cfg StorageConfig, redirects RedirectConfig) map[string]Fetcher {
+	h := httpFetcher{redirects: redirects}
+	return map[string]Fetcher{
+		"http":   h,
+		"https":  h,
+		"s3":     newS3Fetcher(cfg.S3),
+		"azblob": newAzureFetcher(cfg.Azure),
+		"gs":     newGCSFetcher(cfg.GCS),
+	}
+}
+
+// fetch opens rawURL with the fetcher registered for its scheme.
+func (c *Config) fetch(ctx context.Context, rawURL string) (io.ReadCloser, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	f, ok := c.fetchers[u.Scheme]
+	if !ok {
+		return nil, fmt.Errorf("no fetcher for %s URLs", u.Scheme)
+	}
+	return f.Fetch(ctx, u)
+}
+
+// fetchTimeout bounds a single download, including credential lookups.
+const fetchTimeout = 10 * time.Minute
+
+// RedirectConfig limits the redirects followed by http and https
+// downloads.
+type RedirectConfig struct {
+	// Max is the most redirects followed for one download.
+	Max int `yaml:"max"`
+	// AllowedHosts lists the hosts a redirect may lead to; a leading "*."
+	// also matches subdomains. Empty allows any host.
+	AllowedHosts []string `yaml:"allowed_hosts"`
+	// AllowDowngrade follows redirects from https to http, which are
+	// refused by default. Redirects from http to https are always followed.
+	AllowDowngrade bool `yaml:"allow_downgrade"`
+}
+
+func (c RedirectConfig) validate() error {
+	if c.Max < 0 {
+		return errors.New("redirects: max must not be negative")
+	}
+	for _, h := range c.AllowedHosts {
+		if h == "" || strings.Contains(strings.TrimPrefix(h, "*."), "*") {
+			return fmt.Errorf("redirects: bad allowed host %q", h)
+		}
+	}
+	return nil
+}
+
+// allowed reports whether a redirect may lead to host.
+func (c RedirectConfig) allowed(host string) bool {
+	if len(c.AllowedHosts) == 0 {
+		return true
+	}
+	host = strings.ToLower(host)
+	for _, h := range c.AllowedHosts {
+		h = strings.ToLower(h)
+		if host == h || (strings.HasPrefix(h, "*.") && strings.HasSuffix(host, h[1:])) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkRedirect vets the redirect to req, the len(via)th of a download.
+func (c RedirectConfig) checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) > c.Max {
+		return fmt.Errorf("stopped after %d redirects", c.Max)
+	}
+	for _, v := range via {
+		if v.URL.String() == req.URL.String() {
+			return fmt.Errorf("redirect loop at %s", req.URL.Redacted())
+		}
+	}
+	if prev := via[len(via)-1].URL; prev.Scheme == "https" && req.URL.Scheme != "https" && !c.AllowDowngrade {
+		return fmt.Errorf("refusing redirect from https to %s", req.URL.Redacted())
+	}
+	if !c.allowed(req.URL.Hostname()) {
+		return fmt.Errorf("redirect to %s: host is not in redirects.allowed_hosts", req.URL.Redacted())
+	}
+	return nil
+}
+
+type httpFetcher struct {
+	redirects RedirectConfig
+}
+
+// fetchedBody is the body of an http download, with where it came from.
+type fetchedBody struct {
+	io.ReadCloser
+	// url is the URL the body was served from, after redirects.
+	url       *url.URL
+	redirects int
+	// remoteAddr is the address of the server that sent it.
+	remoteAddr string
+}
+
+func (f httpFetcher) Fetch(ctx context.Context, u *url.URL) (io.ReadCloser, error) {
+	var body fetchedBody
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			body.remoteAddr = info.Conn.RemoteAddr().String()
+		},
+	})
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			body.redirects = len(via)
+			return f.redirects.checkRedirect(req, via)
+		},
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		resp.Body.Close()
+		return nil, fmt.Errorf("GET %s: %s: %s", resp.Request.URL.Redacted(), resp.Status, strings.TrimSpace(string(msg)))
+	}
+	body.ReadCloser, body.url = resp.Body, resp.Request.URL
+	return &body, nil
+}
+
+// doFetch sends req and returns the body of a 200 response.
+func doFetch(req *http.Request) (io.ReadCloser, error) {
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		resp.Body.Close()
+		return nil, fmt.Errorf("GET %s: %s: %s", req.URL.Redacted(), resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return resp.Body, nil
+}
+
+// metadataClient talks to link-local credential endpoints; the short
+// timeout keeps the credential chains fast on hosts without them.
+var metadataClient = &http.Client{Timeout: 2 * time.Second}
+
+// errNoCredentials is returned by a credential provider that is not
+// configured in this environment, so the chain moves on to the next one.
+var errNoCredentials = errors.New("no credentials")
+
+// decodeJSONResponse sends req with client and decodes a 200 JSON body into v.
+func decodeJSONResponse(client *http.Client, req *http.Request, v interface{}) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s %s: %s: %s", req.Method, req.URL.Redacted(), resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// tokenSource caches a bearer token obtained from a credential chain until
+// shortly before it expires. An empty token means anonymous access; that
+// outcome is cached briefly so hosts without credentials do not probe
+// metadata endpoints on every download.
+type tokenSource struct {
+	mu     sync.Mutex
+	token  string
+	expiry time.Time
+	fetch  func(ctx context.Context) (string, time.Time, error)
+}
+
+func (t *tokenSource) get(ctx context.Context) (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if time.Now().Before(t.expiry) {
+		return t.token, nil
+	}
+	token, expiry, err := t.fetch(ctx)
+	if err == errNoCredentials {
+		t.token, t.expiry = "", time.Now().Add(5*time.Minute)
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	t.token, t.expiry = token, expiry.Add(-time.Minute)
+	return token, nil
+}
+
+// oauthToken is the common shape of OAuth 2.0 token responses.
+type oauthToken struct {
+	AccessToken string      `json:"access_token"`
+	ExpiresIn   json.Number `json:"expires_in"`
+	ExpiresOn   json.Number `json:"expires_on"`
+}
+
+// expiry returns when the token expires, preferring the absolute expires_on
+// that Azure managed identity reports.
+func (t oauthToken) expiry() time.Time {
+	if on, err := t.ExpiresOn.Int64(); err == nil && on > 0 {
+		return time.Unix(on, 0)
+	}
+	if in, err := t.ExpiresIn.Int64(); err == nil && in > 0 {
+		return time.Now().Add(time.Duration(in) * time.Second)
+	}
+	return time.Now().Add(5 * time.Minute)
+}
+
+// postTokenForm exchanges form for an OAuth access token at endpoint.
+func postTokenForm(ctx context.Context, endpoint string, form url.Values) (string, time.Time, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	var tok oauthToken
+	if err := decodeJSONResponse(http.DefaultClient, req, &tok); err != nil {
+		return "", time.Time{}, err
+	}
+	return tok.AccessToken, tok.expiry(), nil
+}
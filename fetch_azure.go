@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// AzureConfig configures azblob://account/container/blob URLs.
+type AzureConfig struct {
+	// EndpointSuffix is the storage DNS suffix, e.g. core.usgovcloudapi.net
+	// for Azure Government. Defaults to core.windows.net.
+	EndpointSuffix string `yaml:"endpoint_suffix"`
+	// AuthorityHost is the Entra ID login host used for client secret and
+	// workload identity credentials. Defaults to AZURE_AUTHORITY_HOST, or
+	// the sovereign cloud matching EndpointSuffix.
+	AuthorityHost string `yaml:"authority_host"`
+}
+
+// azureStorageVersion is the REST API version sent with every request;
+// bearer tokens require 2017-11-09 or later.
+const azureStorageVersion = "2020-10-02"
+
+// azureFetcher authorizes blob reads with, in order: a SAS token
+// (AZURE_STORAGE_SAS_TOKEN), an account key (AZURE_STORAGE_KEY), a client
+// secret, a federated workload identity token, or managed identity. Without
+// any it fetches anonymously, which suits public containers.
+type azureFetcher struct {
+	cfg   AzureConfig
+	token tokenSource
+}
+
+func newAzureFetcher(cfg AzureConfig) *azureFetcher {
+	if cfg.EndpointSuffix == "" {
+		cfg.EndpointSuffix = "core.windows.net"
+	}
+	if cfg.AuthorityHost == "" {
+		cfg.AuthorityHost = os.Getenv("AZURE_AUTHORITY_HOST")
+	}
+	if cfg.AuthorityHost == "" {
+		cfg.AuthorityHost = "https://login.microsoftonline.com/"
+		if strings.HasSuffix(cfg.EndpointSuffix, "usgovcloudapi.net") {
+			cfg.AuthorityHost = "https://login.microsoftonline.us/"
+		}
+	}
+	f := &azureFetcher{cfg: cfg}
+	f.token.fetch = f.fetchToken
+	return f
+}
+
+func (f *azureFetcher) Fetch(ctx context.Context, u *url.URL) (io.ReadCloser, error) {
+	account := u.Host
+	if account == "" || strings.Count(strings.Trim(u.Path, "/"), "/") < 1 {
+		return nil, fmt.Errorf("azblob URL %s must be azblob://account/container/blob", u)
+	}
+	target := &url.URL{Scheme: "https", Host: account + ".blob." + f.cfg.EndpointSuffix, Path: u.Path}
+
+	if sas := strings.TrimPrefix(os.Getenv("AZURE_STORAGE_SAS_TOKEN"), "?"); sas != "" {
+		target.RawQuery = sas
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("x-ms-version", azureStorageVersion)
+	req.Header.Set("x-ms-date", time.Now().UTC().Format(http.TimeFormat))
+
+	switch {
+	case target.RawQuery != "":
+		// The SAS token in the query authorizes the request.
+	case os.Getenv("AZURE_STORAGE_KEY") != "":
+		if err := signSharedKey(req, account, os.Getenv("AZURE_STORAGE_KEY")); err != nil {
+			return nil, err
+		}
+	default:
+		token, err := f.token.get(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("azure credentials: %v", err)
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+	}
+	return doFetch(req)
+}
+
+// fetchToken walks the Entra ID credential chain for a storage token.
+func (f *azureFetcher) fetchToken(ctx context.Context) (string, time.Time, error) {
+	const scope = "https://storage.azure.com/.default"
+	tenant, clientID := os.Getenv("AZURE_TENANT_ID"), os.Getenv("AZURE_CLIENT_ID")
+	tokenURL := strings.TrimSuffix(f.cfg.AuthorityHost, "/") + "/" + tenant + "/oauth2/v2.0/token"
+
+	if secret := os.Getenv("AZURE_CLIENT_SECRET"); secret != "" && tenant != "" && clientID != "" {
+		return postTokenForm(ctx, tokenURL, url.Values{
+			"grant_type":    {"client_credentials"},
+			"client_id":     {clientID},
+			"client_secret": {secret},
+			"scope":         {scope},
+		})
+	}
+	if file := os.Getenv("AZURE_FEDERATED_TOKEN_FILE"); file != "" && tenant != "" && clientID != "" {
+		assertion, err := os.ReadFile(file)
+		if err != nil {
+			return "", time.Time{}, err
+		}
+		return postTokenForm(ctx, tokenURL, url.Values{
+			"grant_type":            {"client_credentials"},
+			"client_id":             {clientID},
+			"client_assertion_type": {"urn:ietf:params:oauth:client-assertion-type:jwt-bearer"},
+			"client_assertion":      {strings.TrimSpace(string(assertion))},
+			"scope":                 {scope},
+		})
+	}
+
+	// Managed identity through the instance metadata service.
+	q := url.Values{"api-version": {"2018-02-01"}, "resource": {"https://storage.azure.com/"}}
+	if clientID != "" {
+		q.Set("client_id", clientID)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://169.254.169.254/metadata/identity/oauth2/token?"+q.Encode(), nil)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	req.Header.Set("Metadata", "true")
+	var tok oauthToken
+	if err := decodeJSONResponse(metadataClient, req, &tok); err != nil {
+		return "", time.Time{}, errNoCredentials
+	}
+	return tok.AccessToken, tok.expiry(), nil
+}
+
+// signSharedKey authorizes a bodiless GET with the storage account key.
+func signSharedKey(req *http.Request, account, accountKey string) error {
+	key, err := base64.StdEncoding.DecodeString(accountKey)
+	if err != nil {
+		return fmt.Errorf("AZURE_STORAGE_KEY: %v", err)
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(sharedKeyStringToSign(req, account)))
+	req.Header.Set("Authorization", "SharedKey "+account+":"+base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+	return nil
+}
+
+// sharedKeyStringToSign returns the Shared Key string to sign of a bodiless
+// req: the verb, eleven empty standard headers (Content-Encoding through
+// Range), the x-ms- headers sorted by name, and the resource with its
+// query parameters sorted by name.
+func sharedKeyStringToSign(req *http.Request, account string) string {
+	var b strings.Builder
+	b.WriteString(req.Method + "\n" + strings.Repeat("\n", 11))
+	var headers []string
+	for name := range req.Header {
+		if name = strings.ToLower(name); strings.HasPrefix(name, "x-ms-") {
+			headers = append(headers, name)
+		}
+	}
+	sort.Strings(headers)
+	for _, h := range headers {
+		b.WriteString(h + ":" + strings.TrimSpace(req.Header.Get(h)) + "\n")
+	}
+	b.WriteString("/" + account + req.URL.EscapedPath())
+	q := req.URL.Query()
+	params := make([]string, 0, len(q))
+	for name := range q {
+		params = append(params, name)
+	}
+	sort.Strings(params)
+	for _, p := range params {
+		vs := append([]string(nil), q[p]...)
+		sort.Strings(vs)
+		b.WriteString("\n" + strings.ToLower(p) + ":" + strings.Join(vs, ","))
+	}
+	return b.String()
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// GCSConfig configures gs://bucket/object URLs.
+type GCSConfig struct {
+	// CredentialsFile is a service account or authorized user JSON file;
+	// it defaults to GOOGLE_APPLICATION_CREDENTIALS and then the gcloud
+	// application default credentials.
+	CredentialsFile string `yaml:"credentials_file"`
+	// Endpoint overrides https://storage.googleapis.com.
+	Endpoint string `yaml:"endpoint"`
+}
+
+// gcsFetcher reads objects through the JSON API with a token from the
+// credentials file or the metadata server, or anonymously without either.
+type gcsFetcher struct {
+	cfg   GCSConfig
+	token tokenSource
+}
+
+func newGCSFetcher(cfg GCSConfig) *gcsFetcher {
+	if cfg.CredentialsFile == "" {
+		cfg.CredentialsFile = os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	}
+	if cfg.CredentialsFile == "" {
+		if dir, err := os.UserConfigDir(); err == nil {
+			adc := filepath.Join(dir, "gcloud", "application_default_credentials.json")
+			if _, err := os.Stat(adc); err == nil {
+				cfg.CredentialsFile = adc
+			}
+		}
+	}
+	if cfg.Endpoint == "" {
+		cfg.Endpoint = "https://storage.googleapis.com"
+	}
+	f := &gcsFetcher{cfg: cfg}
+	f.token.fetch = f.fetchToken
+	return f
+}
+
+func (f *gcsFetcher) Fetch(ctx context.Context, u *url.URL) (io.ReadCloser, error) {
+	bucket, object := u.Host, strings.TrimPrefix(u.Path, "/")
+	if bucket == "" || object == "" {
+		return nil, fmt.Errorf("gs URL %s must be gs://bucket/object", u)
+	}
+	target := strings.TrimSuffix(f.cfg.Endpoint, "/") + "/storage/v1/b/" + url.PathEscape(bucket) +
+		"/o/" + url.PathEscape(object) + "?alt=media"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	token, err := f.token.get(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("gcs credentials: %v", err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return doFetch(req)
+}
+
+type googleCredentialsFile struct {
+	Type string `json:"type"`
+	// service_account
+	ClientEmail  string `json:"client_email"`
+	PrivateKey   string `json:"private_key"`
+	PrivateKeyID string `json:"private_key_id"`
+	TokenURI     string `json:"token_uri"`
+	// authorized_user
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+const gcsReadOnlyScope = "https://www.googleapis.com/auth/devstorage.read_only"
+
+func (f *gcsFetcher) fetchToken(ctx context.Context) (string, time.Time, error) {
+	if f.cfg.CredentialsFile != "" {
+		data, err := os.ReadFile(f.cfg.CredentialsFile)
+		if err != nil {
+			return "", time.Time{}, err
+		}
+		var creds googleCredentialsFile
+		if err := json.Unmarshal(data, &creds); err != nil {
+			return "", time.Time{}, fmt.Errorf("%s: %v", f.cfg.CredentialsFile, err)
+		}
+		switch creds.Type {
+		case "service_account":
+			return serviceAccountToken(ctx, creds)
+		case "authorized_user":
+			return postTokenForm(ctx, "https://oauth2.googleapis.com/token", url.Values{
+				"grant_type":    {"refresh_token"},
+				"client_id":     {creds.ClientID},
+				"client_secret": {creds.ClientSecret},
+				"refresh_token": {creds.RefreshToken},
+			})
+		}
+		return "", time.Time{}, fmt.Errorf("%s: unsupported credentials type %q", f.cfg.CredentialsFile, creds.Type)
+	}
+
+	host := os.Getenv("GCE_METADATA_HOST")
+	if host == "" {
+		host = "metadata.google.internal"
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		"http://"+host+"/computeMetadata/v1/instance/service-accounts/default/token?scopes="+url.QueryEscape(gcsReadOnlyScope), nil)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	var tok oauthToken
+	if err := decodeJSONResponse(metadataClient, req, &tok); err != nil {
+		return "", time.Time{}, errNoCredentials
+	}
+	return tok.AccessToken, tok.expiry(), nil
+}
+
+// serviceAccountToken exchanges a self-signed JWT for an access token.
+func serviceAccountToken(ctx context.Context, creds googleCredentialsFile) (string, time.Time, error) {
+	block, _ := pem.Decode([]byte(creds.PrivateKey))
+	if block == nil {
+		return "", time.Time{}, errors.New("service account private key is not PEM")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("service account private key: %v", err)
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return "", time.Time{}, errors.New("service account private key is not RSA")
+	}
+	tokenURI := creds.TokenURI
+	if tokenURI == "" {
+		tokenURI = "https://oauth2.googleapis.com/token"
+	}
+
+	now := time.Now()
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": creds.PrivateKeyID})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss":   creds.ClientEmail,
+		"scope": gcsReadOnlyScope,
+		"aud":   tokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	enc := base64.RawURLEncoding
+	signingInput := enc.EncodeToString(header) + "." + enc.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(signingInput))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return postTokenForm(ctx, tokenURI, url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {signingInput + "." + enc.EncodeToString(sig)},
+	})
+}
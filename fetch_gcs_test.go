@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestGCSServiceAccount(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tokenURI string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("grant_type") != "urn:ietf:params:oauth:grant-type:jwt-bearer" {
+			http.Error(w, "grant_type", http.StatusBadRequest)
+			return
+		}
+		parts := strings.Split(r.FormValue("assertion"), ".")
+		if len(parts) != 3 {
+			http.Error(w, "assertion", http.StatusBadRequest)
+			return
+		}
+		sig, _ := base64.RawURLEncoding.DecodeString(parts[2])
+		digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+		if err := rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, digest[:], sig); err != nil {
+			http.Error(w, "signature", http.StatusUnauthorized)
+			return
+		}
+		var claims struct {
+			Iss   string `json:"iss"`
+			Scope string `json:"scope"`
+			Aud   string `json:"aud"`
+			Iat   int64  `json:"iat"`
+			Exp   int64  `json:"exp"`
+		}
+		payload, _ := base64.RawURLEncoding.DecodeString(parts[1])
+		if err := json.Unmarshal(payload, &claims); err != nil || claims.Iss != "crl@example.iam.gserviceaccount.com" ||
+			claims.Scope != gcsReadOnlyScope || claims.Aud != tokenURI || claims.Exp <= claims.Iat {
+			http.Error(w, "claims: "+string(payload), http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token":"ya29.test","expires_in":3600}`))
+	})
+	mux.HandleFunc("/storage/v1/b/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer ya29.test" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.URL.EscapedPath() != "/storage/v1/b/crl-bucket/o/issuing%2Fca%201.crl" || r.URL.Query().Get("alt") != "media" {
+			http.Error(w, "path "+r.URL.RequestURI(), http.StatusNotFound)
+			return
+		}
+		w.Write([]byte("crl"))
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	tokenURI = srv.URL + "/token"
+
+	creds, _ := json.Marshal(googleCredentialsFile{
+		Type:         "service_account",
+		ClientEmail:  "crl@example.iam.gserviceaccount.com",
+		PrivateKey:   string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8})),
+		PrivateKeyID: "kid",
+		TokenURI:     tokenURI,
+	})
+	path := filepath.Join(t.TempDir(), "sa.json")
+	if err := os.WriteFile(path, creds, 0600); err != nil {
+		t.Fatal(err)
+	}
+	f := newGCSFetcher(GCSConfig{CredentialsFile: path, Endpoint: srv.URL})
+	u, _ := url.Parse("gs://crl-bucket/issuing/ca 1.crl")
+	body, err := f.Fetch(context.Background(), u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer body.Close()
+	if got, _ := io.ReadAll(body); string(got) != "crl" {
+		t.Errorf("fetched %q", got)
+	}
+}
+
+func TestGCSCredentialsType(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "creds.json")
+	if err := os.WriteFile(path, []byte(`{"type":"external_account"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	f := newGCSFetcher(GCSConfig{CredentialsFile: path})
+	if _, _, err := f.fetchToken(context.Background()); err == nil || !strings.Contains(err.Error(), "unsupported") {
+		t.Errorf("fetchToken = %v, want an unsupported credentials type", err)
+	}
+}
@@ -0,0 +1,443 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// S3Config configures s3://bucket/key URLs.
+type S3Config struct {
+	// Region defaults to AWS_REGION, then AWS_DEFAULT_REGION, then
+	// us-east-1.
+	Region string `yaml:"region"`
+	// Endpoint overrides https://s3.<region>.amazonaws.com, e.g. for FIPS
+	// endpoints or S3-compatible stores.
+	Endpoint string `yaml:"endpoint"`
+	// PathStyle addresses buckets as endpoint/bucket/key instead of
+	// bucket.endpoint/key; S3-compatible stores usually need it.
+	PathStyle bool `yaml:"path_style"`
+	// Profile selects the shared credentials profile (default AWS_PROFILE
+	// or "default").
+	Profile string `yaml:"profile"`
+}
+
+type awsCredentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	Expiry          time.Time
+}
+
+// s3Fetcher signs requests with SigV4 using credentials from, in order:
+// the environment, web identity (EKS), the shared credentials file, the ECS
+// container endpoint and EC2 instance metadata. Without any it fetches
+// anonymously.
+type s3Fetcher struct {
+	cfg S3Config
+
+	mu     sync.Mutex
+	creds  *awsCredentials
+	expiry time.Time
+}
+
+func newS3Fetcher(cfg S3Config) *s3Fetcher {
+	if cfg.Region == "" {
+		cfg.Region = os.Getenv("AWS_REGION")
+	}
+	if cfg.Region == "" {
+		cfg.Region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	if cfg.Profile == "" {
+		cfg.Profile = os.Getenv("AWS_PROFILE")
+	}
+	if cfg.Profile == "" {
+		cfg.Profile = "default"
+	}
+	return &s3Fetcher{cfg: cfg}
+}
+
+func (f *s3Fetcher) Fetch(ctx context.Context, u *url.URL) (io.ReadCloser, error) {
+	bucket, key := u.Host, strings.TrimPrefix(u.Path, "/")
+	if bucket == "" || key == "" {
+		return nil, fmt.Errorf("s3 URL %s must be s3://bucket/key", u)
+	}
+	endpoint := f.cfg.Endpoint
+	if endpoint == "" {
+		endpoint = "https://s3." + f.cfg.Region + ".amazonaws.com"
+	}
+	target, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if f.cfg.PathStyle {
+		target.Path = "/" + bucket + "/" + key
+	} else {
+		target.Host = bucket + "." + target.Host
+		target.Path = "/" + key
+	}
+	target.RawPath = awsURIEncode(target.Path, false)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	creds, err := f.credentials(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("s3 credentials: %v", err)
+	}
+	if creds != nil {
+		signV4(req, creds, f.cfg.Region, "s3", time.Now())
+	}
+	return doFetch(req)
+}
+
+func (f *s3Fetcher) credentials(ctx context.Context) (*awsCredentials, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if time.Now().Before(f.expiry) {
+		return f.creds, nil
+	}
+	providers := []func(context.Context) (*awsCredentials, error){
+		f.envCredentials,
+		f.webIdentityCredentials,
+		f.sharedCredentials,
+		f.containerCredentials,
+		f.instanceCredentials,
+	}
+	for _, p := range providers {
+		creds, err := p(ctx)
+		if err == errNoCredentials {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		f.creds = creds
+		f.expiry = creds.Expiry.Add(-time.Minute)
+		if creds.Expiry.IsZero() {
+			f.expiry = time.Now().Add(time.Hour)
+		}
+		return creds, nil
+	}
+	f.creds, f.expiry = nil, time.Now().Add(5*time.Minute)
+	return nil, nil
+}
+
+func (f *s3Fetcher) envCredentials(context.Context) (*awsCredentials, error) {
+	id, secret := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY")
+	if id == "" || secret == "" {
+		return nil, errNoCredentials
+	}
+	return &awsCredentials{AccessKeyID: id, SecretAccessKey: secret, SessionToken: os.Getenv("AWS_SESSION_TOKEN")}, nil
+}
+
+func (f *s3Fetcher) webIdentityCredentials(ctx context.Context) (*awsCredentials, error) {
+	tokenFile, role := os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE"), os.Getenv("AWS_ROLE_ARN")
+	if tokenFile == "" || role == "" {
+		return nil, errNoCredentials
+	}
+	token, err := os.ReadFile(tokenFile)
+	if err != nil {
+		return nil, err
+	}
+	session := os.Getenv("AWS_ROLE_SESSION_NAME")
+	if session == "" {
+		session = "goocsp"
+	}
+	q := url.Values{
+		"Action":           {"AssumeRoleWithWebIdentity"},
+		"Version":          {"2011-06-15"},
+		"RoleArn":          {role},
+		"RoleSessionName":  {session},
+		"WebIdentityToken": {strings.TrimSpace(string(token))},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://sts."+f.cfg.Region+".amazonaws.com/?"+q.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	body, err := doFetch(req)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	var out struct {
+		Credentials struct {
+			AccessKeyID     string    `xml:"AccessKeyId"`
+			SecretAccessKey string    `xml:"SecretAccessKey"`
+			SessionToken    string    `xml:"SessionToken"`
+			Expiration      time.Time `xml:"Expiration"`
+		} `xml:"AssumeRoleWithWebIdentityResult>Credentials"`
+	}
+	if err := xml.NewDecoder(body).Decode(&out); err != nil {
+		return nil, err
+	}
+	c := out.Credentials
+	return &awsCredentials{AccessKeyID: c.AccessKeyID, SecretAccessKey: c.SecretAccessKey, SessionToken: c.SessionToken, Expiry: c.Expiration}, nil
+}
+
+func (f *s3Fetcher) sharedCredentials(context.Context) (*awsCredentials, error) {
+	path := os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, errNoCredentials
+		}
+		path = filepath.Join(home, ".aws", "credentials")
+	}
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, errNoCredentials
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var creds awsCredentials
+	section := ""
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+		if section != f.cfg.Profile {
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		value := strings.TrimSpace(kv[1])
+		switch strings.TrimSpace(kv[0]) {
+		case "aws_access_key_id":
+			creds.AccessKeyID = value
+		case "aws_secret_access_key":
+			creds.SecretAccessKey = value
+		case "aws_session_token":
+			creds.SessionToken = value
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if creds.AccessKeyID == "" || creds.SecretAccessKey == "" {
+		return nil, errNoCredentials
+	}
+	return &creds, nil
+}
+
+// metadataCredentials is the JSON shape served by both the ECS container
+// endpoint and EC2 instance metadata.
+type metadataCredentials struct {
+	AccessKeyID     string    `json:"AccessKeyId"`
+	SecretAccessKey string    `json:"SecretAccessKey"`
+	Token           string    `json:"Token"`
+	Expiration      time.Time `json:"Expiration"`
+}
+
+func (m metadataCredentials) credentials() *awsCredentials {
+	return &awsCredentials{AccessKeyID: m.AccessKeyID, SecretAccessKey: m.SecretAccessKey, SessionToken: m.Token, Expiry: m.Expiration}
+}
+
+func (f *s3Fetcher) containerCredentials(ctx context.Context) (*awsCredentials, error) {
+	endpoint := os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI")
+	if rel := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); rel != "" {
+		endpoint = "http://169.254.170.2" + rel
+	}
+	if endpoint == "" {
+		return nil, errNoCredentials
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	if token := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN"); token != "" {
+		req.Header.Set("Authorization", token)
+	}
+	var m metadataCredentials
+	if err := decodeJSONResponse(metadataClient, req, &m); err != nil {
+		return nil, err
+	}
+	return m.credentials(), nil
+}
+
+func (f *s3Fetcher) instanceCredentials(ctx context.Context) (*awsCredentials, error) {
+	const imds = "http://169.254.169.254/latest"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, imds+"/api/token", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "300")
+	resp, err := metadataClient.Do(req)
+	if err != nil {
+		// Not on EC2.
+		return nil, errNoCredentials
+	}
+	token, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errNoCredentials
+	}
+
+	get := func(path string) (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, imds+path, nil)
+		if err == nil {
+			req.Header.Set("X-aws-ec2-metadata-token", string(token))
+		}
+		return req, err
+	}
+	req, err = get("/meta-data/iam/security-credentials/")
+	if err != nil {
+		return nil, err
+	}
+	resp, err = metadataClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	role, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		// No instance profile attached.
+		return nil, errNoCredentials
+	}
+	req, err = get("/meta-data/iam/security-credentials/" + strings.TrimSpace(strings.SplitN(string(role), "\n", 2)[0]))
+	if err != nil {
+		return nil, err
+	}
+	var m metadataCredentials
+	if err := decodeJSONResponse(metadataClient, req, &m); err != nil {
+		return nil, err
+	}
+	return m.credentials(), nil
+}
+
+// emptyPayloadHash is the hex SHA-256 of the empty body of a GET.
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// signV4 adds AWS Signature Version 4 headers to a bodiless request. The
+// host and every header already set on req, such as a Range, are signed.
+func signV4(req *http.Request, creds *awsCredentials, region, service string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", emptyPayloadHash)
+	if creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+
+	canonicalRequest, signedHeaders := v4CanonicalRequest(req)
+	scope := amzDate[:8] + "/" + region + "/" + service + "/aws4_request"
+	stringToSign := v4StringToSign(amzDate, scope, canonicalRequest)
+	signature := v4Signature(creds.SecretAccessKey, amzDate[:8], region, service, stringToSign)
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		creds.AccessKeyID, scope, signedHeaders, signature))
+}
+
+// v4CanonicalRequest returns the SigV4 canonical request of a bodiless
+// req and the names of the headers it signs.
+func v4CanonicalRequest(req *http.Request) (string, string) {
+	values := map[string]string{"host": req.URL.Host}
+	for name, v := range req.Header {
+		if name = strings.ToLower(name); name != "authorization" {
+			values[name] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+	headers := make([]string, 0, len(values))
+	for h := range values {
+		headers = append(headers, h)
+	}
+	sort.Strings(headers)
+	var canonicalHeaders strings.Builder
+	for _, h := range headers {
+		canonicalHeaders.WriteString(h + ":" + values[h] + "\n")
+	}
+	signedHeaders := strings.Join(headers, ";")
+
+	return strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		v4CanonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		emptyPayloadHash,
+	}, "\n"), signedHeaders
+}
+
+// v4CanonicalQuery encodes q sorted by name and then value, percent-encoded
+// as SigV4 requires rather than as url.Values.Encode does.
+func v4CanonicalQuery(q url.Values) string {
+	encoded := make(map[string][]string, len(q))
+	names := make([]string, 0, len(q))
+	for name, vs := range q {
+		name = awsURIEncode(name, true)
+		names = append(names, name)
+		for _, v := range vs {
+			encoded[name] = append(encoded[name], awsURIEncode(v, true))
+		}
+	}
+	sort.Strings(names)
+	var pairs []string
+	for _, name := range names {
+		sort.Strings(encoded[name])
+		for _, v := range encoded[name] {
+			pairs = append(pairs, name+"="+v)
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// v4StringToSign returns the SigV4 string to sign of canonicalRequest.
+func v4StringToSign(amzDate, scope, canonicalRequest string) string {
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	return "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+}
+
+// v4Signature signs stringToSign with the key derived from secret for the
+// date (YYYYMMDD), region and service.
+func v4Signature(secret, date, region, service, stringToSign string) string {
+	key := hmacSHA256([]byte("AWS4"+secret), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// awsURIEncode percent-encodes everything but RFC 3986 unreserved
+// characters, and '/' unless encodeSlash is set.
+func awsURIEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !encodeSlash) {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// In FIPS mode (fips: true) the responder refuses to start, or to apply a
+// configuration, unless the binary's cryptographic module is operating in
+// FIPS mode, and it only signs and verifies with approved algorithms.
+// SHA-1 remains accepted in CertIDs and responder IDs, where it is used
+// for identification rather than for signatures (SP 800-131A).
+//
+// Build with GOEXPERIMENT=boringcrypto for BoringCrypto, or with
+// GOFIPS140=v1.0.0 (or run with GODEBUG=fips140=on) for the Go
+// Cryptographic Module; see fips_*.go.
+
+// fipsApprovedKey checks that pub is an approved signature key: RSA of at
+// least 2048 bits or ECDSA on P-256, P-384 or P-521.
+func fipsApprovedKey(pub crypto.PublicKey) error {
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		if k.N.BitLen() < 2048 {
+			return fmt.Errorf("%d-bit RSA key is not FIPS approved", k.N.BitLen())
+		}
+		return nil
+	case *ecdsa.PublicKey:
+		switch k.Curve {
+		case elliptic.P256(), elliptic.P384(), elliptic.P521():
+			return nil
+		}
+		return fmt.Errorf("ECDSA curve %s is not FIPS approved", k.Curve.Params().Name)
+	}
+	return fmt.Errorf("%T key is not FIPS approved", pub)
+}
+
+// fipsApprovedSignature checks that algo is RSA or ECDSA with a SHA-2 hash.
+func fipsApprovedSignature(algo x509.SignatureAlgorithm) error {
+	switch algo {
+	case x509.SHA256WithRSA, x509.SHA384WithRSA, x509.SHA512WithRSA,
+		x509.SHA256WithRSAPSS, x509.SHA384WithRSAPSS, x509.SHA512WithRSAPSS,
+		x509.ECDSAWithSHA256, x509.ECDSAWithSHA384, x509.ECDSAWithSHA512:
+		return nil
+	}
+	return fmt.Errorf("signature algorithm %s is not FIPS approved", algo)
+}
+
+// checkFIPS is the fips health check: with fips set, the module must be in
+// FIPS mode and the responder key approved.
+func checkFIPS(st *state) error {
+	if !st.cfg.FIPS {
+		return nil
+	}
+	if backend, enabled := fipsBackend(); !enabled {
+		return fmt.Errorf("fips is set but the %s is not operating in FIPS mode", backend)
+	}
+	if st.signer != nil {
+		if err := fipsApprovedKey(st.signer.Cert.PublicKey); err != nil {
+			return fmt.Errorf("responder key: %v", err)
+		}
+	}
+	if st.nextSigner != nil {
+		if err := fipsApprovedKey(st.nextSigner.Cert.PublicKey); err != nil {
+			return fmt.Errorf("next responder key: %v", err)
+		}
+	}
+	return nil
+}
+
+// fipsStatus is the FIPS attestation in /healthz.
+type fipsStatus struct {
+	// Required is the fips configuration setting.
+	Required bool   `json:"required"`
+	Backend  string `json:"backend"`
+	Enabled  bool   `json:"enabled"`
+}
+
+func currentFIPSStatus(cfg *Config) fipsStatus {
+	backend, enabled := fipsBackend()
+	return fipsStatus{Required: cfg.FIPS, Backend: backend, Enabled: enabled}
+}
+
+// logFIPSBanner announces the FIPS status at startup.
+func logFIPSBanner(cfg *Config) {
+	s := currentFIPSStatus(cfg)
+	mode := "off"
+	if s.Enabled {
+		mode = "on"
+	}
+	log.Printf("crypto: %s, FIPS mode %s, required by configuration: %t", s.Backend, mode, s.Required)
+}
+
+// healthzHandler reports whether the current state passes its health
+// checks, along with the FIPS and region status.
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	st := currentState()
+	resp := struct {
+		Status  string         `json:"status"`
+		Error   string         `json:"error,omitempty"`
+		FIPS    fipsStatus     `json:"fips"`
+		Region  regionStatus   `json:"region"`
+		Standby *standbyStatus `json:"standby,omitempty"`
+
+		ReadOnly bool `json:"read_only,omitempty"`
+		// Startup is reported once serving started at the startup
+		// deadline; see /readyz.
+		Startup *startupStatus `json:"startup,omitempty"`
+		// Maintenance is reported while OCSP requests are answered tryLater
+		// for maintenance; the status stays ok so the instance is kept.
+		Maintenance *maintenanceStatus `json:"maintenance,omitempty"`
+	}{Status: "ok", FIPS: currentFIPSStatus(st.cfg), Region: currentRegionStatus(st.cfg), Standby: currentStandbyStatus(st.cfg), ReadOnly: readOnly, Maintenance: currentMaintenanceStatus()}
+	if s := currentStartupStatus(st); s.Partial {
+		resp.Startup = &s
+	}
+	code := http.StatusOK
+	if err := checkHealth(st); err != nil {
+		resp.Status = "unhealthy"
+		resp.Error = err.Error()
+		code = http.StatusServiceUnavailable
+	} else if standbyPassive() {
+		resp.Status = "standby"
+		code = http.StatusServiceUnavailable
+	} else if resp.Region.Stale {
+		resp.Status = "unhealthy"
+		resp.Error = "no sync with the primary region for more than " + st.cfg.Region.MaxLag.String()
+		code = http.StatusServiceUnavailable
+	} else if resp.Startup != nil && resp.Startup.Ready < resp.Startup.Issuers {
+		// Serving, but not every issuer; /readyz lets the orchestrator
+		// decide whether that is enough.
+		resp.Status = "partial"
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(resp)
+}
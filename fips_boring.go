@@ -0,0 +1,17 @@
+//go:build boringcrypto
+// +build boringcrypto
+
+package main
+
+import (
+	"crypto/boring"
+	// Restrict TLS, including CRL and bundle downloads, to FIPS approved
+	// versions, cipher suites and curves.
+	_ "crypto/tls/fipsonly"
+)
+
+// fipsBackend reports the cryptographic module the binary was built with
+// and whether it is operating in FIPS mode.
+func fipsBackend() (string, bool) {
+	return "BoringCrypto", boring.Enabled()
+}
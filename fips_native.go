@@ -0,0 +1,13 @@
+//go:build go1.24 && !boringcrypto
+// +build go1.24,!boringcrypto
+
+package main
+
+import "crypto/fips140"
+
+// fipsBackend reports the cryptographic module the binary was built with
+// and whether it is operating in FIPS mode. The Go Cryptographic Module is
+// in FIPS mode when built with GOFIPS140 or run with GODEBUG=fips140=on.
+func fipsBackend() (string, bool) {
+	return "Go Cryptographic Module", fips140.Enabled()
+}
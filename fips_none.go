@@ -0,0 +1,11 @@
+//go:build !go1.24 && !boringcrypto
+// +build !go1.24,!boringcrypto
+
+package main
+
+// fipsBackend reports the cryptographic module the binary was built with
+// and whether it is operating in FIPS mode. Before Go 1.24 only
+// BoringCrypto builds can operate in FIPS mode.
+func fipsBackend() (string, bool) {
+	return "Go standard library", false
+}
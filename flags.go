@@ -0,0 +1,223 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkkemp/GoOCSPResponder/responder"
+)
+
+// RequestFlagsConfig lets the trusted proxies route single requests
+// through experimental code paths, so new behavior can be tried on a
+// fraction of real traffic before it is turned on for everyone. A request
+// carrying flags is answered on the slow path, and its response is
+// neither served from nor stored in the cache, so flagged answers never
+// reach other clients.
+type RequestFlagsConfig struct {
+	// Allow lists the flags that may be requested; empty disables request
+	// flags.
+	Allow []string `yaml:"allow"`
+	// Header carries the flags, comma separated.
+	Header string `yaml:"header"`
+	// TokenHeader carries the token from TokenFile. Proxies must strip
+	// both headers from what clients send and set them themselves: the
+	// token is what tells their headers apart.
+	TokenHeader string `yaml:"token_header"`
+	TokenFile   string `yaml:"token_file"`
+
+	// token is the contents of TokenFile.
+	token string
+}
+
+func (c RequestFlagsConfig) validate() error {
+	if len(c.Allow) == 0 {
+		return nil
+	}
+	for _, name := range c.Allow {
+		if requestFlagNamed(name) == nil {
+			return fmt.Errorf("request_flags: unknown flag %q", name)
+		}
+	}
+	if c.Header == "" || c.TokenHeader == "" || c.TokenFile == "" {
+		return errors.New("request_flags: allow requires header, token_header and token_file")
+	}
+	return nil
+}
+
+// flagSet is the flags a request carries, a bit per requestFlags entry.
+type flagSet uint32
+
+const (
+	flagNextSigner flagSet = 1 << iota
+	flagExactLookup
+)
+
+// requestFlag is one experimental code path.
+type requestFlag struct {
+	name    string
+	summary string
+	flag    flagSet
+	// available reports whether st has the path; a flag it has not is
+	// ignored.
+	available func(st *state) bool
+}
+
+var requestFlags = []requestFlag{
+	{
+		name:      "next-signer",
+		summary:   "sign with the key signer.next migrates to",
+		flag:      flagNextSigner,
+		available: func(st *state) bool { return st.nextSigner != nil },
+	},
+	{
+		name:      "exact-lookup",
+		summary:   "search the exact CRL entries without the bloom filter",
+		flag:      flagExactLookup,
+		available: func(st *state) bool { return true },
+	},
+}
+
+func requestFlagNamed(name string) *requestFlag {
+	for i := range requestFlags {
+		if requestFlags[i].name == name {
+			return &requestFlags[i]
+		}
+	}
+	return nil
+}
+
+// requestFlags returns the flags r carries: none unless it came straight
+// from a trusted proxy with the token, and only those allowed and
+// available.
+func (st *state) requestFlags(r *http.Request) flagSet {
+	c := &st.cfg.RequestFlags
+	if c.token == "" {
+		return 0
+	}
+	header := r.Header.Get(c.Header)
+	if header == "" {
+		return 0
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !containsIP(st.clients.trustedProxies(), ip) {
+		return 0
+	}
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get(c.TokenHeader)), []byte(c.token)) != 1 {
+		return 0
+	}
+	var flags flagSet
+	for _, name := range strings.Split(header, ",") {
+		f := requestFlagNamed(strings.TrimSpace(name))
+		if f == nil || !f.available(st) {
+			continue
+		}
+		for _, allowed := range c.Allow {
+			if allowed == f.name {
+				flags |= f.flag
+			}
+		}
+	}
+	return flags
+}
+
+// flaggedPath answers a request carrying flags; see RequestFlagsConfig.
+func (st *state) flaggedPath(w http.ResponseWriter, body []byte, only string, flags flagSet) {
+	req, err := responder.ParseRequest(body)
+	if err != nil {
+		writeOCSPResponse(w, malformedResponse)
+		return
+	}
+	// Without a body to key it, the response is not cached.
+	st.respond(w, nil, req, only, flags, time.Now())
+}
+
+// flagStats are the answers given under each flag since startup, to
+// compare with those given without.
+var flagStats = struct {
+	sync.Mutex
+	byFlag map[flagSet]*flagCounters
+}{byFlag: make(map[flagSet]*flagCounters)}
+
+type flagCounters struct {
+	requests, failed uint64
+	latency          time.Duration
+}
+
+// countFlagged records a response given under flags; failed ones are the
+// error responses.
+func countFlagged(flags flagSet, der []byte, latency time.Duration) {
+	failed := isErrorResponse(der)
+	flagStats.Lock()
+	defer flagStats.Unlock()
+	for _, f := range requestFlags {
+		if flags&f.flag == 0 {
+			continue
+		}
+		c := flagStats.byFlag[f.flag]
+		if c == nil {
+			c = &flagCounters{}
+			flagStats.byFlag[f.flag] = c
+		}
+		c.requests++
+		c.latency += latency
+		if failed {
+			c.failed++
+		}
+	}
+}
+
+func isErrorResponse(der []byte) bool {
+	for _, e := range [][]byte{malformedResponse, internalResponse, tryLaterResponse, unauthResponse} {
+		if string(der) == string(e) {
+			return true
+		}
+	}
+	return false
+}
+
+// flagReport is one flag in GET /admin/v1/request-flags.
+type flagReport struct {
+	Name      string `json:"name"`
+	Summary   string `json:"summary"`
+	Allowed   bool   `json:"allowed"`
+	Available bool   `json:"available"`
+	Requests  uint64 `json:"requests"`
+	// Failed counts the error responses.
+	Failed uint64 `json:"failed"`
+	// AvgLatency covers parsing, answering and signing.
+	AvgLatency time.Duration `json:"avg_latency_ns"`
+}
+
+// requestFlagsHandler serves GET /admin/v1/request-flags.
+func requestFlagsHandler(w http.ResponseWriter, r *http.Request) {
+	st := currentState()
+	out := make([]flagReport, 0, len(requestFlags))
+	flagStats.Lock()
+	for _, f := range requestFlags {
+		rep := flagReport{Name: f.name, Summary: f.summary, Available: f.available(st)}
+		for _, allowed := range st.cfg.RequestFlags.Allow {
+			rep.Allowed = rep.Allowed || allowed == f.name
+		}
+		if c := flagStats.byFlag[f.flag]; c != nil {
+			rep.Requests, rep.Failed = c.requests, c.failed
+			rep.AvgLatency = c.latency / time.Duration(c.requests)
+		}
+		out = append(out, rep)
+	}
+	flagStats.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(out)
+}
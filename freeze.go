@@ -0,0 +1,223 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// FreezeConfig bounds issuer freezes, which an operator sets through POST
+// /admin/v1/freeze during an incident investigation: the issuer stays on
+// the CRL it serves, a known-good version, and newer CRLs are neither
+// downloaded nor installed until the freeze is lifted or expires.
+type FreezeConfig struct {
+	// Duration is how long a freeze lasts, unless the operator gives a
+	// duration.
+	Duration time.Duration `yaml:"duration"`
+	// MaxDuration is the longest freeze an operator may set.
+	MaxDuration time.Duration `yaml:"max_duration"`
+}
+
+func (c FreezeConfig) validate() error {
+	if c.Duration < time.Minute {
+		return errors.New("freeze.duration must be at least 1m")
+	}
+	if c.MaxDuration < c.Duration {
+		return errors.New("freeze.max_duration must be at least freeze.duration")
+	}
+	return nil
+}
+
+// issuerFreeze pins an issuer to the CRL it served when it was frozen.
+type issuerFreeze struct {
+	Issuer string `json:"issuer"`
+	// CRLNumber, ThisUpdate and SHA256 identify the pinned CRL.
+	CRLNumber  string    `json:"crl_number,omitempty"`
+	ThisUpdate time.Time `json:"this_update"`
+	SHA256     string    `json:"sha256"`
+	crlHash    [sha256.Size]byte
+	Reason     string    `json:"reason,omitempty"`
+	Since      time.Time `json:"since"`
+	Until      time.Time `json:"until"`
+}
+
+// Pinned names the pinned CRL, for the dashboard and the log.
+func (f *issuerFreeze) Pinned() string {
+	if f.CRLNumber != "" {
+		return "CRL number " + f.CRLNumber
+	}
+	return "the CRL of " + f.ThisUpdate.Format(time.RFC3339)
+}
+
+func (f *issuerFreeze) String() string {
+	return fmt.Sprintf("frozen at %s until %s", f.Pinned(), f.Until.Format(time.RFC3339))
+}
+
+// freezes are the issuer freezes set, by issuer key. Like maintenance,
+// they survive configuration reloads but not restarts.
+var freezes = struct {
+	sync.Mutex
+	byIssuer map[string]*issuerFreeze
+}{byIssuer: make(map[string]*issuerFreeze)}
+
+// currentFreeze returns the freeze of the issuer key, or nil if it is not
+// frozen or its freeze expired.
+func currentFreeze(key string) *issuerFreeze {
+	freezes.Lock()
+	defer freezes.Unlock()
+	if f := freezes.byIssuer[key]; f != nil && time.Now().Before(f.Until) {
+		return f
+	}
+	return nil
+}
+
+// activeFreezes returns the freezes in effect, by issuer key.
+func activeFreezes() map[string]*issuerFreeze {
+	now := time.Now()
+	freezes.Lock()
+	defer freezes.Unlock()
+	out := make(map[string]*issuerFreeze, len(freezes.byIssuer))
+	for key, f := range freezes.byIssuer {
+		if now.Before(f.Until) {
+			out[key] = f
+		}
+	}
+	return out
+}
+
+// sortedFreezes returns the freezes in effect, by issuer.
+func sortedFreezes() []*issuerFreeze {
+	out := make([]*issuerFreeze, 0)
+	for _, f := range activeFreezes() {
+		out = append(out, f)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Issuer < out[j].Issuer })
+	return out
+}
+
+// expireFreezes drops the freezes that ended by now and returns their
+// issuers, so the refresher catches them up at once.
+func expireFreezes(now time.Time) []string {
+	freezes.Lock()
+	defer freezes.Unlock()
+	var expired []string
+	for key, f := range freezes.byIssuer {
+		if !now.Before(f.Until) {
+			delete(freezes.byIssuer, key)
+			expired = append(expired, key)
+			log.Printf("freeze: %s expired after %v; refreshing its CRL", key, f.Until.Sub(f.Since).Round(time.Second))
+		}
+	}
+	sort.Strings(expired)
+	return expired
+}
+
+// frozenOut returns why f may not replace the CRL of the issuer key, if
+// the issuer is frozen at another CRL.
+func frozenOut(key string, f CRLBloomFilter) error {
+	if fr := currentFreeze(key); fr != nil && f.crlHash != fr.crlHash {
+		return fmt.Errorf("kept the previous CRL: %s", fr)
+	}
+	return nil
+}
+
+// freezeHandler serves POST /admin/v1/freeze?mode=on|off&issuer=, with
+// optionally crl_number, which must be the CRL number served, duration and
+// reason. It reports the freezes in effect, and only reports without mode.
+func freezeHandler(w http.ResponseWriter, r *http.Request) {
+	if !requirePost(w, r) {
+		return
+	}
+	mode := r.FormValue("mode")
+	if mode == "" {
+		adminResult(w, r, "", sortedFreezes())
+		return
+	}
+	if mode != "on" && mode != "off" {
+		http.Error(w, "mode must be on or off", http.StatusBadRequest)
+		return
+	}
+	st := currentState()
+	param := r.FormValue("issuer")
+	if param == "" {
+		http.Error(w, "issuer is required", http.StatusBadRequest)
+		return
+	}
+	crl, _, ok := st.findIssuer(param)
+	if !ok {
+		http.Error(w, fmt.Sprintf("no served issuer matches %q", param), http.StatusNotFound)
+		return
+	}
+	key := crl.key()
+	if mode == "off" {
+		freezes.Lock()
+		_, was := freezes.byIssuer[key]
+		delete(freezes.byIssuer, key)
+		freezes.Unlock()
+		msg := key + " was not frozen"
+		if was {
+			msg = "unfroze " + key
+			log.Printf("freeze: %s lifted by the operator", key)
+		}
+		adminResult(w, r, msg, sortedFreezes())
+		return
+	}
+
+	f := st.filters[key]
+	if f.quarantine != "" {
+		http.Error(w, fmt.Sprintf("the CRL of %s is quarantined: %s", key, f.quarantine), http.StatusConflict)
+		return
+	}
+	if v := r.FormValue("crl_number"); v != "" {
+		n, ok := new(big.Int).SetString(v, 10)
+		if !ok {
+			http.Error(w, fmt.Sprintf("crl_number %q is not a decimal number", v), http.StatusBadRequest)
+			return
+		}
+		if f.crlNumber == nil || f.crlNumber.Cmp(n) != 0 {
+			served := "a CRL without a number"
+			if f.crlNumber != nil {
+				served = "CRL number " + f.crlNumber.String()
+			}
+			http.Error(w, fmt.Sprintf("%s serves %s, not %s", key, served, v), http.StatusConflict)
+			return
+		}
+	}
+	d := st.cfg.Freeze.Duration
+	if v := r.FormValue("duration"); v != "" {
+		var err error
+		if d, err = time.ParseDuration(v); err != nil || d < time.Minute || d > st.cfg.Freeze.MaxDuration {
+			http.Error(w, fmt.Sprintf("duration %q is not between 1m and freeze.max_duration (%v)", v, st.cfg.Freeze.MaxDuration), http.StatusBadRequest)
+			return
+		}
+	}
+	now := time.Now().UTC()
+	fr := &issuerFreeze{
+		Issuer:     key,
+		ThisUpdate: f.thisUpdate.UTC(),
+		SHA256:     hex.EncodeToString(f.crlHash[:]),
+		crlHash:    f.crlHash,
+		Reason:     r.FormValue("reason"),
+		Since:      now,
+		Until:      now.Add(d),
+	}
+	if f.crlNumber != nil {
+		fr.CRLNumber = f.crlNumber.String()
+	}
+	freezes.Lock()
+	freezes.byIssuer[key] = fr
+	freezes.Unlock()
+	msg := fmt.Sprintf("froze %s at %s until %s", key, fr.Pinned(), fr.Until.Format(time.RFC3339))
+	if fr.Reason != "" {
+		msg += " (" + fr.Reason + ")"
+	}
+	log.Printf("freeze: %s by the operator", msg)
+	adminResult(w, r, msg, sortedFreezes())
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"crypto/sha256"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestFreeze(t *testing.T) {
+	t.Cleanup(func() {
+		freezes.Lock()
+		freezes.byIssuer = make(map[string]*issuerFreeze)
+		freezes.Unlock()
+	})
+	benchState(t, defaultConfig().Cache)
+	st := currentState()
+	crl := st.crls[0]
+	key := crl.key()
+	pinned := st.filters[key]
+	pinned.crlNumber, pinned.crlHash = big.NewInt(7), [sha256.Size]byte{7}
+	st.filters[key] = pinned
+	newer := pinned
+	newer.crlNumber, newer.crlHash = big.NewInt(8), [sha256.Size]byte{8}
+
+	freeze := func(form url.Values) int {
+		r := httptest.NewRequest(http.MethodPost, "/admin/v1/freeze?"+form.Encode(), nil)
+		w := httptest.NewRecorder()
+		freezeHandler(w, r)
+		return w.Code
+	}
+	for name, tc := range map[string]struct {
+		form url.Values
+		code int
+	}{
+		"unknown issuer":     {url.Values{"mode": {"on"}, "issuer": {"No Such CA"}}, http.StatusNotFound},
+		"another CRL number": {url.Values{"mode": {"on"}, "issuer": {"Bench CA-1"}, "crl_number": {"8"}}, http.StatusConflict},
+		"too long":           {url.Values{"mode": {"on"}, "issuer": {"Bench CA-1"}, "duration": {"8760h"}}, http.StatusBadRequest},
+	} {
+		if code := freeze(tc.form); code != tc.code {
+			t.Errorf("%s: answered %d, want %d", name, code, tc.code)
+		}
+	}
+	if currentFreeze(key) != nil {
+		t.Fatal("a refused freeze was set")
+	}
+
+	if code := freeze(url.Values{"mode": {"on"}, "issuer": {"Bench CA-1"}, "crl_number": {"7"}, "duration": {"1h"}, "reason": {"incident"}}); code != http.StatusOK {
+		t.Fatalf("freeze answered %d", code)
+	}
+	if fr := currentFreeze(key); fr == nil || fr.CRLNumber != "7" || fr.Reason != "incident" {
+		t.Fatalf("froze %+v, want CRL number 7", fr)
+	}
+	if err := refreshCRL(crl); err == nil {
+		t.Error("a frozen issuer was refreshed")
+	}
+	if ok, err := installFilter(crl, newer); ok || err == nil {
+		t.Errorf("installing a newer CRL of a frozen issuer = %v, %v, want refused", ok, err)
+	}
+	if ok, err := installFilter(crl, pinned); !ok || err != nil {
+		t.Errorf("reinstalling the pinned CRL = %v, %v", ok, err)
+	}
+
+	if expired := expireFreezes(time.Now().Add(2 * time.Hour)); len(expired) != 1 || expired[0] != key {
+		t.Errorf("expired %v, want %s", expired, key)
+	}
+	if ok, err := installFilter(crl, newer); !ok || err != nil {
+		t.Errorf("installing a newer CRL after the freeze expired = %v, %v", ok, err)
+	}
+
+	freeze(url.Values{"mode": {"on"}, "issuer": {"Bench CA-1"}})
+	if code := freeze(url.Values{"mode": {"off"}, "issuer": {"BENCHCA_1"}}); code != http.StatusOK || currentFreeze(key) != nil {
+		t.Errorf("lifting the freeze answered %d", code)
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"crypto/x509"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkkemp/GoOCSPResponder/responder"
+)
+
+// FreshnessRule caps how long the answers of matching issuers stay valid,
+// so the CAs a deployment trusts for authentication can carry shorter
+// lived answers than, say, its email CAs. An issuer matches when its CA
+// certificate asserts one of policies, lists one of ekus and its CRL name
+// matches one of issuers; an empty list matches any issuer. The first
+// matching rule applies.
+type FreshnessRule struct {
+	Name string `yaml:"name"`
+	// Policies are certificate policy OIDs.
+	Policies []string `yaml:"policies"`
+	// EKUs are extended key usages, by name (clientAuth, emailProtection,
+	// smartcardLogon, ...) or OID.
+	EKUs []string `yaml:"ekus"`
+	// Issuers are CRL names, with * and ? wildcards (DODIDCA_*).
+	Issuers []string `yaml:"issuers"`
+	// MaxValidity is the longest an answer stays valid after it is
+	// signed; the CRL may make it shorter still.
+	MaxValidity time.Duration `yaml:"max_validity"`
+}
+
+// ekuOIDs names the extended key usages rules may list.
+var ekuOIDs = map[string]string{
+	"any":             "2.5.29.37.0",
+	"serverAuth":      "1.3.6.1.5.5.7.3.1",
+	"clientAuth":      "1.3.6.1.5.5.7.3.2",
+	"codeSigning":     "1.3.6.1.5.5.7.3.3",
+	"emailProtection": "1.3.6.1.5.5.7.3.4",
+	"timeStamping":    "1.3.6.1.5.5.7.3.8",
+	"OCSPSigning":     "1.3.6.1.5.5.7.3.9",
+	"smartcardLogon":  "1.3.6.1.4.1.311.20.2.2",
+	"pkinitClient":    "1.3.6.1.5.2.3.4",
+}
+
+// knownEKUs maps the usages crypto/x509 parses to their OIDs; it leaves
+// the others in UnknownExtKeyUsage.
+var knownEKUs = map[x509.ExtKeyUsage]string{
+	x509.ExtKeyUsageAny:             ekuOIDs["any"],
+	x509.ExtKeyUsageServerAuth:      ekuOIDs["serverAuth"],
+	x509.ExtKeyUsageClientAuth:      ekuOIDs["clientAuth"],
+	x509.ExtKeyUsageCodeSigning:     ekuOIDs["codeSigning"],
+	x509.ExtKeyUsageEmailProtection: ekuOIDs["emailProtection"],
+	x509.ExtKeyUsageTimeStamping:    ekuOIDs["timeStamping"],
+	x509.ExtKeyUsageOCSPSigning:     ekuOIDs["OCSPSigning"],
+}
+
+func validOID(s string) bool {
+	parts := strings.Split(s, ".")
+	if len(parts) < 2 {
+		return false
+	}
+	for _, p := range parts {
+		if _, err := strconv.ParseUint(p, 10, 32); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+func (r FreshnessRule) validate() error {
+	if r.Name == "" {
+		return fmt.Errorf("freshness: every rule needs a name")
+	}
+	if r.MaxValidity < time.Minute {
+		return fmt.Errorf("freshness %s: max_validity must be at least 1m", r.Name)
+	}
+	for _, p := range r.Policies {
+		if !validOID(p) {
+			return fmt.Errorf("freshness %s: policy %q is not an OID", r.Name, p)
+		}
+	}
+	for _, e := range r.EKUs {
+		if _, ok := ekuOIDs[e]; !ok && !validOID(e) {
+			return fmt.Errorf("freshness %s: extended key usage %q is neither a known name nor an OID", r.Name, e)
+		}
+	}
+	for _, pattern := range r.Issuers {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("freshness %s: issuer %q: %v", r.Name, pattern, err)
+		}
+	}
+	return nil
+}
+
+// matches reports whether the rule applies to the issuer crl.
+func (r FreshnessRule) matches(crl CRLInfo) bool {
+	return r.matchesPolicy(crl.CA) && r.matchesEKU(crl.CA) && r.matchesIssuer(crl.key())
+}
+
+func (r FreshnessRule) matchesPolicy(ca *x509.Certificate) bool {
+	if len(r.Policies) == 0 {
+		return true
+	}
+	for _, want := range r.Policies {
+		for _, p := range ca.PolicyIdentifiers {
+			if p.String() == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (r FreshnessRule) matchesEKU(ca *x509.Certificate) bool {
+	if len(r.EKUs) == 0 {
+		return true
+	}
+	var have []string
+	for _, u := range ca.ExtKeyUsage {
+		if oid, ok := knownEKUs[u]; ok {
+			have = append(have, oid)
+		}
+	}
+	for _, oid := range ca.UnknownExtKeyUsage {
+		have = append(have, oid.String())
+	}
+	for _, want := range r.EKUs {
+		if oid, ok := ekuOIDs[want]; ok {
+			want = oid
+		}
+		for _, oid := range have {
+			if oid == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (r FreshnessRule) matchesIssuer(key string) bool {
+	if len(r.Issuers) == 0 {
+		return true
+	}
+	for _, pattern := range r.Issuers {
+		if ok, _ := path.Match(pattern, key); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// buildFreshness resolves the rule of each served issuer, by CRL key.
+// Issuers no rule matches are absent.
+func buildFreshness(st *state) map[string]FreshnessRule {
+	if len(st.cfg.Freshness) == 0 {
+		return nil
+	}
+	rules := make(map[string]FreshnessRule)
+	for _, crl := range st.crls {
+		for _, r := range st.cfg.Freshness {
+			if r.matches(crl) {
+				rules[crl.key()] = r
+				break
+			}
+		}
+	}
+	return rules
+}
+
+func init() {
+	hook := policyHook{name: "freshness", apply: applyFreshness}
+	for i, h := range policyHooks {
+		if h.name == "canary" {
+			policyHooks = append(policyHooks[:i], append([]policyHook{hook}, policyHooks[i:]...)...)
+			return
+		}
+	}
+	policyHooks = append(policyHooks, hook)
+}
+
+// applyFreshness brings the nextUpdate of an answer forward to the
+// max_validity of the issuer's rule, counted from now.
+func applyFreshness(f CRLBloomFilter, single *responder.SingleResponse) bool {
+	st, _ := current.Load().(*state)
+	if st == nil {
+		return false
+	}
+	r, ok := st.freshness[f.crlInfo.key()]
+	if !ok {
+		return false
+	}
+	limit := time.Now().Add(r.MaxValidity).Truncate(time.Second)
+	if !single.NextUpdate.IsZero() && !limit.Before(single.NextUpdate) {
+		return false
+	}
+	single.NextUpdate = limit
+	return true
+}
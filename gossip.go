@@ -0,0 +1,368 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkkemp/GoOCSPResponder/responder"
+)
+
+// GossipConfig lets third parties submit OCSP responses they were served
+// under this responder's name. Every response the responder signs is
+// remembered by hash; a submission that carries a valid signature of ours
+// but was never produced here means someone else holds the signing key.
+// It is a lightweight form of response transparency.
+type GossipConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Retention is how long produced responses are remembered.
+	Retention time.Duration `yaml:"retention"`
+	// MaxEntries bounds the responses remembered; the oldest are
+	// forgotten first.
+	MaxEntries int `yaml:"max_entries"`
+}
+
+func (c GossipConfig) validate() error {
+	if c.Enabled && (c.Retention <= 0 || c.MaxEntries <= 0) {
+		return errors.New("gossip: retention and max_entries must be positive")
+	}
+	return nil
+}
+
+// responseLogFile holds the produced responses in the cache directory,
+// one record of producedAt (Unix seconds) and SHA-256 per response.
+const responseLogFile = "responses.log"
+
+const responseRecordSize = 8 + sha256.Size
+
+// maxGossipBody bounds a submitted response.
+const maxGossipBody = 64 << 10
+
+// producedEntry is one response signed by this instance.
+type producedEntry struct {
+	producedAt int64
+	sum        [sha256.Size]byte
+}
+
+// responseLog remembers the responses signed here, oldest first.
+type responseLog struct {
+	mu      sync.Mutex
+	cfg     GossipConfig
+	loaded  bool
+	entries []producedEntry
+	seen    map[[sha256.Size]byte]int64
+	// since is the start of the window the log covers: responses produced
+	// earlier may have been forgotten.
+	since time.Time
+	// file is the open log, nil in read-only mode or when disabled;
+	// records counts the records in it.
+	file    *os.File
+	records int
+	// stats counts submissions by verdict; flagged keeps the last
+	// submissions that were never produced here.
+	stats   map[string]int64
+	flagged []gossipVerdict
+}
+
+var produced = &responseLog{seen: make(map[[sha256.Size]byte]int64), stats: make(map[string]int64)}
+
+// configure applies cfg, loading the log on first use.
+func (l *responseLog) configure(cfg GossipConfig) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.cfg = cfg
+	if !cfg.Enabled || l.loaded {
+		return
+	}
+	l.loaded = true
+	l.since = time.Now().Truncate(time.Second)
+	data, err := os.ReadFile(rootDir + responseLogFile)
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("%s: %v", responseLogFile, err)
+	}
+	for len(data) >= responseRecordSize {
+		var e producedEntry
+		e.producedAt = int64(binary.BigEndian.Uint64(data))
+		copy(e.sum[:], data[8:responseRecordSize])
+		data = data[responseRecordSize:]
+		if _, ok := l.seen[e.sum]; ok {
+			continue
+		}
+		if len(l.entries) == 0 {
+			l.since = time.Unix(e.producedAt, 0)
+		}
+		l.entries = append(l.entries, e)
+		l.seen[e.sum] = e.producedAt
+	}
+	l.prune(time.Now())
+	if !readOnly {
+		l.rewrite()
+	}
+}
+
+// enabled reports whether produced responses are remembered.
+func (l *responseLog) enabled() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.cfg.Enabled
+}
+
+// record remembers der, a response produced at producedAt.
+func (l *responseLog) record(der []byte, producedAt time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.cfg.Enabled {
+		return
+	}
+	e := producedEntry{producedAt: producedAt.Unix(), sum: sha256.Sum256(der)}
+	if _, ok := l.seen[e.sum]; ok {
+		return
+	}
+	l.entries = append(l.entries, e)
+	l.seen[e.sum] = e.producedAt
+	if l.prune(time.Now()) && l.file != nil && l.records > 2*len(l.entries) {
+		l.rewrite()
+		return
+	}
+	if l.file != nil {
+		var rec [responseRecordSize]byte
+		binary.BigEndian.PutUint64(rec[:], uint64(e.producedAt))
+		copy(rec[8:], e.sum[:])
+		if _, err := l.file.Write(rec[:]); err != nil {
+			log.Printf("%s: %v", responseLogFile, err)
+		}
+		l.records++
+	}
+}
+
+// prune forgets responses past the retention or the size bound and
+// reports whether it forgot any.
+func (l *responseLog) prune(now time.Time) bool {
+	cutoff := now.Add(-l.cfg.Retention).Unix()
+	n := 0
+	for n < len(l.entries) && (l.entries[n].producedAt < cutoff || len(l.entries)-n > l.cfg.MaxEntries) {
+		delete(l.seen, l.entries[n].sum)
+		n++
+	}
+	if n == 0 {
+		return false
+	}
+	// Responses produced up to the last one forgotten may be missing.
+	if since := time.Unix(l.entries[n-1].producedAt+1, 0); since.After(l.since) {
+		l.since = since
+	}
+	l.entries = append([]producedEntry(nil), l.entries[n:]...)
+	return true
+}
+
+// rewrite replaces the log file with the remembered responses and opens
+// it for appending.
+func (l *responseLog) rewrite() {
+	if l.file != nil {
+		l.file.Close()
+		l.file = nil
+	}
+	data := make([]byte, len(l.entries)*responseRecordSize)
+	for i, e := range l.entries {
+		rec := data[i*responseRecordSize:]
+		binary.BigEndian.PutUint64(rec, uint64(e.producedAt))
+		copy(rec[8:], e.sum[:])
+	}
+	if err := writeFileAtomic(rootDir+responseLogFile, data, 0o644); err != nil {
+		log.Printf("%s: %v", responseLogFile, err)
+		return
+	}
+	f, err := os.OpenFile(rootDir+responseLogFile, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		log.Printf("%s: %v", responseLogFile, err)
+		return
+	}
+	l.file, l.records = f, len(l.entries)
+}
+
+// gossipVerdict is the outcome of one submission.
+type gossipVerdict struct {
+	// Verdict is produced (signed here), not_ours (not signed with a key
+	// of this responder), outside_window (signed with our key before the
+	// log's window) or unknown (signed with our key but never produced
+	// here: the key may be compromised).
+	Verdict    string    `json:"verdict"`
+	ProducedAt time.Time `json:"produced_at"`
+	SHA256     string    `json:"sha256"`
+	// Window is when the log starts.
+	Window time.Time `json:"window_start"`
+	// ProducedBy is the peer that produced it, if not this instance.
+	ProducedBy string    `json:"produced_by,omitempty"`
+	Serials    []string  `json:"serials,omitempty"`
+	Submitter  string    `json:"submitter,omitempty"`
+	ReceivedAt time.Time `json:"received_at"`
+}
+
+// maxFlagged bounds the unknown submissions kept for GET /admin/v1/gossip.
+const maxFlagged = 100
+
+// check judges the response der submitted by submitter against the
+// signers of st. A response of ours not produced here is looked up on the
+// peers, which sign with the same key.
+func (l *responseLog) check(st *state, der []byte, submitter string, now time.Time) (gossipVerdict, error) {
+	resp, err := responder.ParseResponse(der)
+	if err != nil {
+		return gossipVerdict{}, err
+	}
+	if resp.Status != responder.Successful {
+		return gossipVerdict{}, fmt.Errorf("response status is %s", resp.Status)
+	}
+	sum := sha256.Sum256(der)
+	v := gossipVerdict{ProducedAt: resp.ProducedAt, SHA256: fmt.Sprintf("%x", sum), Submitter: submitter, ReceivedAt: now}
+	for _, sr := range resp.Responses {
+		v.Serials = append(v.Serials, fmt.Sprintf("%x", sr.SerialNumber))
+	}
+	ours := false
+	for _, s := range []*responder.Signer{st.signer, st.nextSigner} {
+		if s != nil && resp.CheckSignatureFrom(s.Cert) == nil {
+			ours = true
+		}
+	}
+
+	l.mu.Lock()
+	v.Window = l.since
+	_, logged := l.seen[sum]
+	l.mu.Unlock()
+	switch {
+	case !ours:
+		v.Verdict = "not_ours"
+	case logged:
+		v.Verdict = "produced"
+	default:
+		if v.ProducedBy = producedByPeer(st.cfg.Peers.URLs, v.SHA256); v.ProducedBy != "" {
+			v.Verdict = "produced"
+		} else if resp.ProducedAt.Before(v.Window) {
+			v.Verdict = "outside_window"
+		} else {
+			v.Verdict = "unknown"
+		}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if v.Verdict == "unknown" {
+		l.flagged = append(l.flagged, v)
+		if len(l.flagged) > maxFlagged {
+			l.flagged = l.flagged[len(l.flagged)-maxFlagged:]
+		}
+	}
+	l.stats[v.Verdict]++
+	return v, nil
+}
+
+// producedByPeer asks each peer whether it produced the response with the
+// SHA-256 sum and returns the first that did. A peer that cannot be asked
+// counts as not having produced it.
+func producedByPeer(peers []string, sum string) string {
+	for _, base := range peers {
+		resp, err := manifestClient.Get(strings.TrimSuffix(base, "/") + "/api/v1/gossip/produced?sha256=" + sum)
+		if err != nil {
+			log.Printf("gossip: %s: %v", base, err)
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			return base
+		}
+	}
+	return ""
+}
+
+// producedHandler serves GET /api/v1/gossip/produced, whether this
+// instance produced the response with the given SHA-256.
+func producedHandler(w http.ResponseWriter, r *http.Request) {
+	var sum [sha256.Size]byte
+	b, err := hex.DecodeString(r.FormValue("sha256"))
+	if err != nil || len(b) != len(sum) {
+		http.Error(w, "sha256 must be 64 hex digits", http.StatusBadRequest)
+		return
+	}
+	copy(sum[:], b)
+	produced.mu.Lock()
+	producedAt, ok := produced.seen[sum]
+	produced.mu.Unlock()
+	if !ok {
+		http.Error(w, "not produced here", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]time.Time{"produced_at": time.Unix(producedAt, 0).UTC()})
+}
+
+// gossipHandler serves POST /api/v1/gossip: a DER OCSP response a third
+// party was served, to compare with what this responder produced.
+func gossipHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	der, err := io.ReadAll(io.LimitReader(r.Body, maxGossipBody+1))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(der) > maxGossipBody {
+		http.Error(w, "response too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	st := currentState()
+	v, err := produced.check(st, der, r.RemoteAddr, time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	log.Printf("audit: gossip: %s submitted a response produced at %s (sha256 %s): %s",
+		r.RemoteAddr, v.ProducedAt.UTC().Format(time.RFC3339), v.SHA256, v.Verdict)
+	if v.Verdict == "unknown" {
+		alert(st.cfg, "gossip: %s submitted a response signed with our key that was never produced here (sha256 %s, produced at %s); the signing key may be compromised",
+			r.RemoteAddr, v.SHA256, v.ProducedAt.UTC().Format(time.RFC3339))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+// gossipStatus is what GET /admin/v1/gossip reports.
+type gossipStatus struct {
+	Remembered  int              `json:"remembered"`
+	WindowStart time.Time        `json:"window_start"`
+	Submissions map[string]int64 `json:"submissions"`
+	// Flagged are the last submissions never produced here.
+	Flagged []gossipVerdict `json:"flagged"`
+}
+
+// gossipStatusHandler serves GET /admin/v1/gossip.
+func gossipStatusHandler(w http.ResponseWriter, r *http.Request) {
+	produced.mu.Lock()
+	s := gossipStatus{
+		Remembered:  len(produced.entries),
+		WindowStart: produced.since,
+		Submissions: make(map[string]int64, len(produced.stats)),
+		Flagged:     append([]gossipVerdict{}, produced.flagged...),
+	}
+	for k, n := range produced.stats {
+		s.Submissions[k] = n
+	}
+	produced.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(s)
+}
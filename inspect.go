@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// inspectedCRL is what goocsp inspect reports about one cached CRL.
+type inspectedCRL struct {
+	Key        string    `json:"key"`
+	File       string    `json:"file"`
+	Issuer     string    `json:"issuer,omitempty"`
+	Size       int64     `json:"size"`
+	SHA256     string    `json:"sha256"`
+	Number     string    `json:"number,omitempty"`
+	ThisUpdate time.Time `json:"this_update"`
+	NextUpdate time.Time `json:"next_update,omitempty"`
+	Expired    bool      `json:"expired,omitempty"`
+	Entries    int       `json:"entries"`
+	// Index describes the on-disk index next to the CRL, if there is one.
+	Index    *inspectedIndex `json:"index,omitempty"`
+	Archived int             `json:"archived,omitempty"`
+	Error    string          `json:"error,omitempty"`
+}
+
+type inspectedIndex struct {
+	Size    int64 `json:"size"`
+	Records int   `json:"records"`
+	// Current reports whether the index was built from the cached CRL;
+	// a stale one is rebuilt when the server next loads it.
+	Current bool   `json:"current"`
+	Error   string `json:"error,omitempty"`
+}
+
+// inspectCRL describes the CRL at path, its index and archived versions,
+// without loading it into a server.
+func inspectCRL(path, archiveDir string, now time.Time) inspectedCRL {
+	name := filepath.Base(path)
+	c := inspectedCRL{Key: CRLInfo{FileName: name}.key(), File: name}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		c.Error = err.Error()
+		return c
+	}
+	sum := sha256.Sum256(data)
+	c.Size, c.SHA256 = int64(len(data)), hex.EncodeToString(sum[:])
+
+	if versions, err := archivedVersions(filepath.Join(archiveDir, c.Key)); err == nil {
+		c.Archived = len(versions)
+	}
+	idxPath := strings.TrimSuffix(path, filepath.Ext(path)) + ".idx"
+	if fi, err := os.Stat(idxPath); err == nil {
+		c.Index = &inspectedIndex{Size: fi.Size()}
+		if idx, err := openDiskIndex(idxPath); err != nil {
+			c.Index.Error = err.Error()
+		} else {
+			c.Index.Records = idx.count
+			c.Index.Current = bytes.Equal(idx.crlHash(), sum[:])
+		}
+	}
+
+	parsed, err := parseCRLFile(path)
+	if err != nil {
+		c.Error = err.Error()
+		return c
+	}
+	tbs := parsed.TBSCertList
+	c.Issuer = crlIssuerDN(parsed)
+	c.ThisUpdate, c.NextUpdate = tbs.ThisUpdate.UTC(), tbs.NextUpdate.UTC()
+	c.Expired = !tbs.NextUpdate.IsZero() && now.After(tbs.NextUpdate)
+	c.Entries = len(tbs.RevokedCertificates)
+	if n := crlNumber(parsed); n != nil {
+		c.Number = n.String()
+	}
+	return c
+}
+
+func printInspectedCRL(c inspectedCRL) {
+	fmt.Printf("%s (%s)\n", c.Key, c.File)
+	if c.Issuer != "" {
+		fmt.Printf("  Issuer:      %s\n", c.Issuer)
+	}
+	fmt.Printf("  Size:        %d bytes, SHA-256 %s\n", c.Size, c.SHA256)
+	if c.Error != "" {
+		fmt.Printf("  Error:       %s\n", c.Error)
+	} else {
+		number := c.Number
+		if number == "" {
+			number = "none"
+		}
+		fmt.Printf("  CRL number:  %s\n", number)
+		fmt.Printf("  This update: %s\n", c.ThisUpdate.Format(time.RFC3339))
+		if c.NextUpdate.IsZero() {
+			fmt.Printf("  Next update: none\n")
+		} else if c.Expired {
+			fmt.Printf("  Next update: %s (EXPIRED)\n", c.NextUpdate.Format(time.RFC3339))
+		} else {
+			fmt.Printf("  Next update: %s\n", c.NextUpdate.Format(time.RFC3339))
+		}
+		fmt.Printf("  Entries:     %d\n", c.Entries)
+	}
+	switch {
+	case c.Index == nil:
+		fmt.Printf("  Index:       none on disk\n")
+	case c.Index.Error != "":
+		fmt.Printf("  Index:       %d bytes, unreadable: %s\n", c.Index.Size, c.Index.Error)
+	case c.Index.Current:
+		fmt.Printf("  Index:       %d bytes, %d records\n", c.Index.Size, c.Index.Records)
+	default:
+		fmt.Printf("  Index:       %d bytes, %d records, STALE (built from another CRL)\n", c.Index.Size, c.Index.Records)
+	}
+	if c.Archived > 0 {
+		fmt.Printf("  Archived:    %d versions\n", c.Archived)
+	}
+}
+
+// inspectCommand reads the CRL cache offline, so it works on hosts where
+// the server is down.
+func inspectCommand(args []string) int {
+	fs := flag.NewFlagSet("inspect", flag.ContinueOnError)
+	cache := fs.String("cache", rootDir, "CRL cache directory")
+	archive := fs.String("archive", "", "CRL archive directory; defaults to archive/ in the cache")
+	issuer := fs.String("issuer", "", "only this CRL, by file name without extension or any name of the issuer registry")
+	asJSON := fs.Bool("json", false, "print JSON instead of text")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *archive == "" {
+		*archive = filepath.Join(*cache, "archive")
+	}
+	paths, err := filepath.Glob(filepath.Join(*cache, "*.crl"))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "inspect:", err)
+		return 2
+	}
+
+	key := *issuer
+	if reg, err := loadIssuerRegistry(filepath.Join(*cache, issuerRegistryFile)); err == nil && key != "" {
+		if found := reg.find(key); len(found) == 1 && found[0].Key != "" {
+			key = found[0].Key
+		}
+	}
+
+	now := time.Now()
+	crls := []inspectedCRL{}
+	failed := false
+	for _, path := range paths {
+		c := inspectCRL(path, *archive, now)
+		if key != "" && !strings.EqualFold(c.Key, key) {
+			continue
+		}
+		failed = failed || c.Error != ""
+		crls = append(crls, c)
+	}
+	if *issuer != "" && len(crls) == 0 {
+		fmt.Fprintf(os.Stderr, "inspect: no cached CRL %s in %s\n", *issuer, *cache)
+		return 1
+	}
+
+	if *asJSON {
+		out, _ := json.MarshalIndent(crls, "", "  ")
+		fmt.Println(string(out))
+	} else {
+		if bundle, err := readCertificates(filepath.Join(*cache, bundleFile())); err == nil {
+			fmt.Printf("Bundle:        %d certificates\n", len(bundle))
+		}
+		fmt.Printf("CRLs:          %d in %s\n", len(crls), *cache)
+		for _, c := range crls {
+			fmt.Println()
+			printInspectedCRL(c)
+		}
+	}
+	if failed {
+		return 1
+	}
+	return 0
+}
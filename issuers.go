@@ -0,0 +1,376 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// issuerRegistryFile holds the issuer registry in the cache directory.
+const issuerRegistryFile = "issuers.json"
+
+// aliasPattern is what an issuer alias may look like, so that it can be
+// used as is in URLs and on the command line.
+var aliasPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// validateIssuerAliases checks the issuer_aliases of a configuration; that
+// they resolve is checked against the bundle, see checkIssuerAliases.
+func validateIssuerAliases(aliases map[string]string) error {
+	folded := make(map[string]string, len(aliases))
+	for alias, issuer := range aliases {
+		if !aliasPattern.MatchString(alias) {
+			return fmt.Errorf("issuer_aliases: %q must be letters, digits, dots, dashes and underscores", alias)
+		}
+		if issuer == "" {
+			return fmt.Errorf("issuer_aliases: %q names no issuer", alias)
+		}
+		if other, ok := folded[strings.ToLower(alias)]; ok {
+			return fmt.Errorf("issuer_aliases: %q and %q differ only in case", alias, other)
+		}
+		folded[strings.ToLower(alias)] = alias
+	}
+	return nil
+}
+
+// checkIssuerAliases makes sure every configured alias names a served
+// issuer, as routes must.
+func checkIssuerAliases(st *state) error {
+	for alias, issuer := range st.cfg.IssuerAliases {
+		if _, _, ok := st.matchIssuer(issuer); !ok {
+			return fmt.Errorf("issuer_aliases: issuer %q of %s is not served", issuer, alias)
+		}
+	}
+	return nil
+}
+
+// issuerSlug is the alias every issuer gets from its common name:
+// DOD EMAIL CA-63 is dod-email-ca-63.
+func issuerSlug(commonName string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(commonName) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			if dash && b.Len() > 0 {
+				b.WriteByte('-')
+			}
+			b.WriteRune(r)
+			dash = false
+		} else {
+			dash = true
+		}
+	}
+	return b.String()
+}
+
+// issuerRecord is one issuer the responder has seen: a CA name and key,
+// whichever certificates carry them. Cross-certificates, issued for the
+// same name and key by other CAs, are recorded under the same issuer.
+type issuerRecord struct {
+	// Key is the CRL name the issuer is served and cached under, fixed
+	// when it is first seen; it is empty for CAs without a CRL here, such
+	// as the roots.
+	Key        string `json:"key,omitempty"`
+	Subject    string `json:"subject"`
+	SKI        string `json:"ski,omitempty"`
+	SPKISHA256 string `json:"spki_sha256"`
+	// Aliases name the issuer in URLs, API parameters and the CLI.
+	Aliases      []string            `json:"aliases,omitempty"`
+	Certificates []issuerCertificate `json:"certificates"`
+	// CRLDistributionPoints are the URLs its CRL was fetched from.
+	CRLDistributionPoints []string `json:"crl_distribution_points,omitempty"`
+	// State is served, quarantined, loading, not served (in the bundle
+	// but not selected) or gone (no longer in the bundle), as of
+	// LastSeen.
+	State      string     `json:"state"`
+	Quarantine string     `json:"quarantine,omitempty"`
+	CRLNumber  string     `json:"crl_number,omitempty"`
+	NextUpdate *time.Time `json:"next_update,omitempty"`
+	FirstSeen  time.Time  `json:"first_seen"`
+	LastSeen   time.Time  `json:"last_seen"`
+}
+
+// issuerCertificate is one certificate of an issuer.
+type issuerCertificate struct {
+	SHA256    string    `json:"sha256"`
+	Issuer    string    `json:"issuer"`
+	NotAfter  time.Time `json:"not_after"`
+	FirstSeen time.Time `json:"first_seen"`
+}
+
+// matches reports whether param names r: by key, alias, subject, SKI,
+// public key hash or certificate fingerprint, as findIssuer accepts them.
+func (r *issuerRecord) matches(param string) bool {
+	fp := strings.ToLower(strings.Replace(param, ":", "", -1))
+	if strings.EqualFold(r.Key, param) || strings.EqualFold(r.Subject, param) || fp == r.SKI || fp == r.SPKISHA256 {
+		return true
+	}
+	for _, a := range r.Aliases {
+		if strings.EqualFold(a, param) {
+			return true
+		}
+	}
+	for _, c := range r.Certificates {
+		if fp == c.SHA256 {
+			return true
+		}
+	}
+	return false
+}
+
+// issuerRegistry is every issuer seen since the cache directory was
+// created, persisted there. It names the CRL of each issuer once, so the
+// rest of the code looks issuers up by certificate instead of by the form
+// of their common names.
+type issuerRegistry struct {
+	mu      sync.Mutex
+	path    string                   // "" until loaded; nothing is saved then
+	records map[string]*issuerRecord // by subject and public key hash
+	byCert  map[[sha256.Size]byte]*issuerRecord
+	dirty   bool
+}
+
+var registry = newIssuerRegistry()
+
+func newIssuerRegistry() *issuerRegistry {
+	return &issuerRegistry{records: make(map[string]*issuerRecord), byCert: make(map[[sha256.Size]byte]*issuerRecord)}
+}
+
+func recordID(subject, spkiHash string) string {
+	return subject + "\x00" + spkiHash
+}
+
+// loadIssuerRegistry reads the registry at path, if there is one, and
+// saves to it from then on.
+func loadIssuerRegistry(path string) (*issuerRegistry, error) {
+	r := newIssuerRegistry()
+	r.path = path
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return r, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var records []*issuerRecord
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	for _, rec := range records {
+		r.records[recordID(rec.Subject, rec.SPKISHA256)] = rec
+	}
+	return r, nil
+}
+
+// observe records cert and returns its issuer.
+func (r *issuerRegistry) observe(cert *x509.Certificate) *issuerRecord {
+	fp := getSha256Fingerprint(cert)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if rec, ok := r.byCert[fp]; ok {
+		return rec
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	spki := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	subject, spkiHash := subjectDN(cert), hex.EncodeToString(spki[:])
+	rec, ok := r.records[recordID(subject, spkiHash)]
+	if !ok {
+		rec = &issuerRecord{
+			Key:        strings.TrimSuffix(crlFileName(cert), ".crl"),
+			Subject:    subject,
+			SKI:        hex.EncodeToString(cert.SubjectKeyId),
+			SPKISHA256: spkiHash,
+			State:      "not served",
+			FirstSeen:  now,
+			LastSeen:   now,
+		}
+		r.records[recordID(subject, spkiHash)] = rec
+		r.dirty = true
+	} else if rec.SKI == "" && len(cert.SubjectKeyId) > 0 {
+		rec.SKI = hex.EncodeToString(cert.SubjectKeyId)
+		r.dirty = true
+	}
+	hexFP := hex.EncodeToString(fp[:])
+	known := false
+	for _, c := range rec.Certificates {
+		known = known || c.SHA256 == hexFP
+	}
+	if !known {
+		rec.Certificates = append(rec.Certificates, issuerCertificate{SHA256: hexFP, Issuer: issuerDN(cert), NotAfter: cert.NotAfter.UTC(), FirstSeen: now})
+		r.dirty = true
+	}
+	r.byCert[fp] = rec
+	return rec
+}
+
+// crlFile returns the file name the CRL of the issuing CA cert is cached
+// and published under, or "" for CAs without one.
+func (r *issuerRegistry) crlFile(cert *x509.Certificate) string {
+	rec := r.observe(cert)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if rec.Key == "" {
+		return ""
+	}
+	return rec.Key + ".crl"
+}
+
+// sync brings the registry up to date with st: the bundle, the state of
+// each issuer, the aliases and where CRLs came from. It saves the registry
+// if that changed anything.
+func (r *issuerRegistry) sync(st *state) {
+	for i := range st.bundle.Certificates {
+		r.observe(&st.bundle.Certificates[i])
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now().UTC().Truncate(time.Second)
+	inBundle := make(map[*issuerRecord]bool)
+	for _, rec := range r.byCert {
+		inBundle[rec] = true
+	}
+	for _, rec := range r.records {
+		before := *rec
+		rec.State, rec.Quarantine = "gone", ""
+		if inBundle[rec] {
+			rec.State = "not served"
+		}
+		if f, ok := st.filters[rec.Key]; ok && rec.Key != "" {
+			switch {
+			case f.pending:
+				rec.State = "loading"
+			case f.quarantine != "":
+				rec.State, rec.Quarantine = "quarantined", f.quarantine
+			default:
+				rec.State = "served"
+			}
+			if f.crlNumber != nil {
+				rec.CRLNumber = f.crlNumber.String()
+			}
+			if !f.nextUpdate.IsZero() {
+				next := f.nextUpdate.UTC()
+				rec.NextUpdate = &next
+			}
+			if u := f.crlInfo.FetchedFrom; strings.HasPrefix(u, "http://") || strings.HasPrefix(u, "https://") {
+				rec.CRLDistributionPoints = addString(rec.CRLDistributionPoints, u)
+			}
+		}
+		rec.Aliases = issuerAliases(st.cfg, st, rec)
+		if rec.State != "gone" {
+			rec.LastSeen = now
+		}
+		if rec.State != before.State || rec.Quarantine != before.Quarantine || rec.CRLNumber != before.CRLNumber ||
+			strings.Join(rec.Aliases, " ") != strings.Join(before.Aliases, " ") || len(rec.CRLDistributionPoints) != len(before.CRLDistributionPoints) {
+			r.dirty = true
+		}
+	}
+	if r.dirty && r.path != "" && !readOnly {
+		if err := writeFileAtomic(r.path, r.marshalLocked(), 0644); err != nil {
+			log.Printf("issuer registry: %v", err)
+			return
+		}
+		r.dirty = false
+	}
+}
+
+// issuerAliases returns the aliases of rec: the slug of its common name
+// and those configured for it.
+func issuerAliases(cfg *Config, st *state, rec *issuerRecord) []string {
+	var aliases []string
+	for _, c := range st.bundle.Certificates {
+		if subjectDN(&c) == rec.Subject {
+			aliases = addString(aliases, issuerSlug(c.Subject.CommonName))
+			break
+		}
+	}
+	if rec.Key != "" {
+		for alias, issuer := range cfg.IssuerAliases {
+			if crl, _, ok := st.matchIssuer(issuer); ok && crl.key() == rec.Key {
+				aliases = addString(aliases, alias)
+			}
+		}
+	}
+	sort.Strings(aliases)
+	return aliases
+}
+
+func addString(list []string, s string) []string {
+	for _, v := range list {
+		if v == s {
+			return list
+		}
+	}
+	return append(list, s)
+}
+
+// marshalLocked returns the records as JSON, served issuers first by key,
+// then the others by subject.
+func (r *issuerRegistry) marshalLocked() []byte {
+	records := make([]*issuerRecord, 0, len(r.records))
+	for _, rec := range r.records {
+		records = append(records, rec)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		a, b := records[i], records[j]
+		if (a.Key == "") != (b.Key == "") {
+			return a.Key != ""
+		}
+		if a.Key != b.Key {
+			return a.Key < b.Key
+		}
+		return a.Subject < b.Subject
+	})
+	data, _ := json.MarshalIndent(records, "", "  ")
+	return append(data, '\n')
+}
+
+// find returns the records param names.
+func (r *issuerRegistry) find(param string) []issuerRecord {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var found []issuerRecord
+	for _, rec := range r.records {
+		if rec.matches(param) {
+			found = append(found, *rec)
+		}
+	}
+	return found
+}
+
+// issuersHandler serves GET /admin/v1/issuers, the registry, or with issuer
+// the records it names.
+func issuersHandler(w http.ResponseWriter, r *http.Request) {
+	registry.sync(currentState())
+	var data []byte
+	if param := r.FormValue("issuer"); param != "" {
+		found := registry.find(param)
+		if len(found) == 0 {
+			http.Error(w, fmt.Sprintf("no known issuer matches %q", param), http.StatusNotFound)
+			return
+		}
+		data, _ = json.MarshalIndent(found, "", "  ")
+		data = append(data, '\n')
+	} else {
+		registry.mu.Lock()
+		data = registry.marshalLocked()
+		registry.mu.Unlock()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// runIssuerRegistry keeps the persisted registry in step with the served
+// state.
+func runIssuerRegistry(hb heartbeat) {
+	for hb.sleep(time.Minute) {
+		registry.sync(currentState())
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxLegacyClients bounds the per-client usage counters; further clients
+// are counted together.
+const maxLegacyClients = 1000
+
+// legacyUsage counts requests to the deprecated plaintext API so operators
+// can see who still has to migrate before it is switched off.
+var legacyUsage = struct {
+	sync.Mutex
+	Total    int64            `json:"total"`
+	Last     time.Time        `json:"last"`
+	ByCA     map[string]int64 `json:"by_ca"`
+	ByClient map[string]int64 `json:"by_client"`
+}{ByCA: make(map[string]int64), ByClient: make(map[string]int64)}
+
+func recordLegacyUse(ca string, r *http.Request) {
+	client := clientAddr(r)
+	legacyUsage.Lock()
+	defer legacyUsage.Unlock()
+	legacyUsage.Total++
+	legacyUsage.Last = time.Now()
+	if _, ok := currentState().filters[ca]; ok {
+		legacyUsage.ByCA[ca]++
+	}
+	if _, seen := legacyUsage.ByClient[client]; !seen {
+		if len(legacyUsage.ByClient) >= maxLegacyClients {
+			client = "other"
+		} else {
+			log.Printf("legacy API: first request from %s", client)
+		}
+	}
+	legacyUsage.ByClient[client]++
+}
+
+// legacyHandler serves the original plaintext API, GET /{ca}/{serial} with
+// a decimal serial, answered from the bloom filter alone. Every response is
+// marked deprecated and points at the explain API.
+func legacyHandler(sunset time.Time) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Deprecation", "true")
+		w.Header().Set("Link", `</api/v1/explain>; rel="successor-version"`)
+		if !sunset.IsZero() {
+			w.Header().Set("Sunset", sunset.UTC().Format(http.TimeFormat))
+		}
+		ca, rest := splitPath(r.URL.Path)
+		serial, extra := splitPath(rest)
+		if ca == "" || serial == "" || extra != "" {
+			http.Error(w, "use /{ca}/{serial}", http.StatusBadRequest)
+			return
+		}
+		recordLegacyUse(ca, r)
+		f, ok := currentState().filters[ca]
+		if !ok {
+			http.Error(w, "unknown CA "+ca, http.StatusNotFound)
+			return
+		}
+		if f.quarantine != "" {
+			http.Error(w, "CRL of "+ca+" is quarantined: "+f.quarantine, http.StatusServiceUnavailable)
+			return
+		}
+		cert, _ := strconv.ParseUint(serial, 10, 64)
+		var revoked bool
+		if f.disk != nil {
+			// On-disk indexes have no bloom filter to answer from.
+			_, revoked = f.disk.lookup(new(big.Int).SetUint64(cert))
+		} else if f.Filter == nil {
+			_, revoked = f.entries.lookup(new(big.Int).SetUint64(cert))
+		} else {
+			revoked = findItemBloom(cert, f.Filter)
+		}
+		fmt.Fprintf(w, "Certificate Revoked?: %t", revoked)
+	}
+}
+
+// legacyUsageHandler serves /admin/v1/legacy-usage.
+func legacyUsageHandler(w http.ResponseWriter, r *http.Request) {
+	legacyUsage.Lock()
+	defer legacyUsage.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&legacyUsage)
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// LimitsConfig bounds what one CRL may cost, so a broken or malicious
+// distribution point or mirror cannot exhaust the responder's memory: a
+// download is aborted as soon as it passes max_bytes, whatever its
+// Content-Length or Content-Encoding, and a CRL's entries are counted from
+// its DER before it is parsed. A CRL over a limit is not loaded; its issuer
+// is quarantined and an alert is raised.
+type LimitsConfig struct {
+	CRLLimits `yaml:",inline"`
+	// Issuers overrides the limits per issuer, by CRL name (DODEMAILCA_63).
+	Issuers map[string]CRLLimits `yaml:"issuers"`
+}
+
+// CRLLimits are the limits of one issuer's CRL. Zero leaves a limit out,
+// or for an issuer, takes the global one.
+type CRLLimits struct {
+	// MaxBytes is the largest CRL file.
+	MaxBytes int64 `yaml:"max_bytes"`
+	// MaxEntries is the most revoked certificates in a CRL.
+	MaxEntries int `yaml:"max_entries"`
+}
+
+func (c LimitsConfig) validate() error {
+	if c.MaxBytes < 0 || c.MaxEntries < 0 {
+		return errors.New("crl_limits must not be negative")
+	}
+	for name, l := range c.Issuers {
+		if l.MaxBytes < 0 || l.MaxEntries < 0 {
+			return fmt.Errorf("crl_limits.issuers.%s must not be negative", name)
+		}
+	}
+	return nil
+}
+
+// forIssuer returns the limits of the issuer key.
+func (c LimitsConfig) forIssuer(key string) CRLLimits {
+	l := c.CRLLimits
+	if o, ok := c.Issuers[key]; ok {
+		if o.MaxBytes != 0 {
+			l.MaxBytes = o.MaxBytes
+		}
+		if o.MaxEntries != 0 {
+			l.MaxEntries = o.MaxEntries
+		}
+	}
+	return l
+}
+
+// reason returns why a CRL of the issuer key of size bytes with entries
+// revoked certificates is over its limits, or "".
+func (c LimitsConfig) reason(key string, size int64, entries int) string {
+	l := c.forIssuer(key)
+	if l.MaxBytes > 0 && size > l.MaxBytes {
+		return fmt.Sprintf("CRL of %d bytes is over the limit of %d", size, l.MaxBytes)
+	}
+	if l.MaxEntries > 0 && entries > l.MaxEntries {
+		return fmt.Sprintf("CRL with %d entries is over the limit of %d", entries, l.MaxEntries)
+	}
+	return ""
+}
+
+// crlLimitError is returned by a download aborted at the size limit.
+type crlLimitError struct {
+	fileName string
+	reason   string
+}
+
+func (e *crlLimitError) Error() string {
+	return fmt.Sprintf("%s: download aborted: %s", e.fileName, e.reason)
+}
+
+// downloadLimit returns the bytes that may be read for the CRL fileName,
+// one past its limit so an oversized download can be told apart, or -1
+// without a limit.
+func downloadLimit(cfg *Config, fileName string) int64 {
+	if max := cfg.Limits.forIssuer(CRLInfo{FileName: fileName}.key()).MaxBytes; max > 0 {
+		return max + 1
+	}
+	return -1
+}
+
+// checkDownloadSize returns a crlLimitError if n bytes read for fileName
+// are over its limit.
+func checkDownloadSize(cfg *Config, fileName string, n int64) error {
+	if limit := downloadLimit(cfg, fileName); limit >= 0 && n >= limit {
+		return &crlLimitError{fileName: fileName, reason: fmt.Sprintf("CRL is over the limit of %d bytes", limit-1)}
+	}
+	return nil
+}
+
+// limitQuarantine returns the quarantined index of crl, whose file is der,
+// if it is over the limits of its issuer. A CRL whose DER cannot be walked
+// is left to the parser to refuse.
+func limitQuarantine(cfg *Config, crl CRLInfo, der []byte) (CRLBloomFilter, bool) {
+	thisUpdate, nextUpdate, entries, err := crlShape(der)
+	if err != nil {
+		return CRLBloomFilter{}, false
+	}
+	reason := cfg.Limits.reason(crl.key(), int64(len(der)), entries)
+	if reason == "" {
+		return CRLBloomFilter{}, false
+	}
+	alert(cfg, "quarantined %s: %s", crl.FileName, reason)
+	return CRLBloomFilter{
+		crlInfo:    crl,
+		quarantine: reason,
+		thisUpdate: thisUpdate,
+		nextUpdate: nextUpdate,
+		loadedAt:   time.Now(),
+	}, true
+}
+
+// quarantineOversized installs a quarantined index for crl after its
+// download was aborted at the size limit. The cached CRL is untouched, and
+// installFilter keeps answering from it while it is current.
+func quarantineOversized(cfg *Config, crl CRLInfo, lerr *crlLimitError) error {
+	alert(cfg, "quarantined %s: %s", crl.FileName, lerr.reason)
+	prev := currentState().filters[crl.key()]
+	f := CRLBloomFilter{
+		crlInfo:    crl,
+		quarantine: lerr.reason,
+		thisUpdate: prev.thisUpdate,
+		nextUpdate: prev.nextUpdate,
+		crlNumber:  prev.crlNumber,
+		loadedAt:   time.Now(),
+	}
+	if ok, err := installFilter(crl, f); !ok {
+		if err == nil {
+			err = errIssuerDropped
+		}
+		return err
+	}
+	return nil
+}
+
+var errNotCRL = errors.New("not a DER CRL")
+
+// crlShape reads the dates of the DER CRL der and counts its revoked
+// certificates from their headers, without decoding a single entry.
+func crlShape(der []byte) (thisUpdate, nextUpdate time.Time, entries int, err error) {
+	tag, list, _, err := derElement(der)
+	if err != nil || tag != 0x30 {
+		return thisUpdate, nextUpdate, 0, errNotCRL
+	}
+	tag, tbs, _, err := derElement(list)
+	if err != nil || tag != 0x30 {
+		return thisUpdate, nextUpdate, 0, errNotCRL
+	}
+	rest := tbs
+	if len(rest) > 0 && rest[0] == 0x02 {
+		// version
+		if _, _, rest, err = derElement(rest); err != nil {
+			return thisUpdate, nextUpdate, 0, errNotCRL
+		}
+	}
+	// signature and issuer
+	for i := 0; i < 2; i++ {
+		if _, _, rest, err = derElement(rest); err != nil {
+			return thisUpdate, nextUpdate, 0, errNotCRL
+		}
+	}
+	start := rest
+	if _, _, rest, err = derElement(rest); err != nil {
+		return thisUpdate, nextUpdate, 0, errNotCRL
+	}
+	if _, err := asn1.Unmarshal(start[:len(start)-len(rest)], &thisUpdate); err != nil {
+		return thisUpdate, nextUpdate, 0, errNotCRL
+	}
+	if len(rest) == 0 {
+		return thisUpdate, nextUpdate, 0, nil
+	}
+	start = rest
+	tag, body, rest, err := derElement(rest)
+	if err != nil {
+		return thisUpdate, nextUpdate, 0, errNotCRL
+	}
+	if tag == 0x17 || tag == 0x18 {
+		if _, err := asn1.Unmarshal(start[:len(start)-len(rest)], &nextUpdate); err != nil {
+			return thisUpdate, nextUpdate, 0, errNotCRL
+		}
+		if len(rest) == 0 {
+			return thisUpdate, nextUpdate, 0, nil
+		}
+		if tag, body, _, err = derElement(rest); err != nil {
+			return thisUpdate, nextUpdate, 0, errNotCRL
+		}
+	}
+	if tag != 0x30 {
+		// crlExtensions: there are no revoked certificates.
+		return thisUpdate, nextUpdate, 0, nil
+	}
+	for len(body) > 0 {
+		if _, _, body, err = derElement(body); err != nil {
+			return thisUpdate, nextUpdate, 0, errNotCRL
+		}
+		entries++
+	}
+	return thisUpdate, nextUpdate, entries, nil
+}
+
+// derElement splits the DER element at the start of b into its
+// single-byte tag, its contents and what follows it.
+func derElement(b []byte) (tag byte, body, rest []byte, err error) {
+	if len(b) < 2 || b[0]&0x1f == 0x1f {
+		return 0, nil, nil, errNotCRL
+	}
+	tag, n, b := b[0], int(b[1]), b[2:]
+	if n&0x80 != 0 {
+		size := n & 0x7f
+		if size == 0 || size > 4 || len(b) < size {
+			return 0, nil, nil, errNotCRL
+		}
+		n = 0
+		for _, c := range b[:size] {
+			n = n<<8 | int(c)
+		}
+		b = b[size:]
+	}
+	if n < 0 || n > len(b) {
+		return 0, nil, nil, errNotCRL
+	}
+	return tag, b[:n], b[n:], nil
+}
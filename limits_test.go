@@ -0,0 +1,104 @@
+package main
+
+import (
+	"crypto/x509"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCRLShape(t *testing.T) {
+	now := time.Now().UTC().Truncate(time.Second)
+	ca := testCA(t, "Limits CA", now.Add(-time.Hour), now.Add(time.Hour))
+	var entries []x509.RevocationListEntry
+	for i := int64(1); i <= 3; i++ {
+		entries = append(entries, x509.RevocationListEntry{SerialNumber: big.NewInt(i), RevocationTime: now})
+	}
+	thisUpdate, nextUpdate, n, err := crlShape(signTestCRL(t, ca, 1, now, entries...))
+	if err != nil || n != 3 || !thisUpdate.Equal(now) || !nextUpdate.Equal(now.Add(24*time.Hour)) {
+		t.Errorf("crlShape = %v, %v, %d, %v; want 3 entries from %v", thisUpdate, nextUpdate, n, err, now)
+	}
+	if _, _, n, err := crlShape(signTestCRL(t, ca, 2, now)); err != nil || n != 0 {
+		t.Errorf("empty CRL: %d entries, %v", n, err)
+	}
+	if _, _, _, err := crlShape(ca.Cert.Raw); err == nil {
+		t.Error("crlShape took a certificate for a CRL")
+	}
+}
+
+func TestLimits(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Limits = LimitsConfig{
+		CRLLimits: CRLLimits{MaxBytes: 1000, MaxEntries: 10},
+		Issuers:   map[string]CRLLimits{"BIGCA": {MaxBytes: 5000}},
+	}
+	if l := cfg.Limits.forIssuer("BIGCA"); l.MaxBytes != 5000 || l.MaxEntries != 10 {
+		t.Errorf("BIGCA limits %+v, want the global entries and its own bytes", l)
+	}
+	for _, tc := range []struct {
+		key     string
+		size    int64
+		entries int
+		over    bool
+	}{
+		{"CA", 1000, 10, false},
+		{"CA", 1001, 10, true},
+		{"CA", 1000, 11, true},
+		{"BIGCA", 5000, 10, false},
+		{"BIGCA", 5001, 0, true},
+	} {
+		if over := cfg.Limits.reason(tc.key, tc.size, tc.entries) != ""; over != tc.over {
+			t.Errorf("%s of %d bytes and %d entries: over %v, want %v", tc.key, tc.size, tc.entries, over, tc.over)
+		}
+	}
+
+	// A download reads one byte past the limit to tell it was over.
+	if limit := downloadLimit(cfg, "CA.crl"); limit != 1001 {
+		t.Errorf("download limit %d, want 1001", limit)
+	}
+	var lerr *crlLimitError
+	if err := checkDownloadSize(cfg, "CA.crl", 1001); !errors.As(err, &lerr) {
+		t.Errorf("a download over the limit returned %v", err)
+	}
+	if err := checkDownloadSize(cfg, "CA.crl", 1000); err != nil {
+		t.Errorf("a download at the limit returned %v", err)
+	}
+	cfg.Limits = LimitsConfig{}
+	if limit := downloadLimit(cfg, "CA.crl"); limit != -1 {
+		t.Errorf("download limit %d without limits, want none", limit)
+	}
+}
+
+// TestLimitQuarantine indexes a CRL over the entry limit: its issuer is
+// quarantined instead.
+func TestLimitQuarantine(t *testing.T) {
+	saved := rootDir
+	defer func() { rootDir = saved }()
+	rootDir = t.TempDir() + string(filepath.Separator)
+	now := time.Now().UTC().Truncate(time.Second)
+	ca := testCA(t, "Limits CA", now.Add(-time.Hour), now.Add(time.Hour))
+	crl := CRLInfo{CA: ca.Cert, FileName: "LIMITSCA.crl"}
+	der := signTestCRL(t, ca, 1, now,
+		x509.RevocationListEntry{SerialNumber: big.NewInt(1), RevocationTime: now},
+		x509.RevocationListEntry{SerialNumber: big.NewInt(2), RevocationTime: now},
+	)
+	if err := os.WriteFile(rootDir+crl.FileName, der, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := defaultConfig()
+	for _, onDisk := range []bool{false, true} {
+		cfg.Index.OnDisk = onDisk
+		cfg.Limits.MaxEntries = 1
+		f, err := ConstructBloomFilter(cfg, crl)
+		if err != nil || f.quarantine == "" || !f.thisUpdate.Equal(now) {
+			t.Errorf("on disk %v: indexed %+v, %v; want it quarantined", onDisk, f, err)
+		}
+		cfg.Limits.MaxEntries = 2
+		if f, err := ConstructBloomFilter(cfg, crl); err != nil || f.quarantine != "" {
+			t.Errorf("on disk %v: a CRL at the limit was quarantined: %v, %v", onDisk, f.quarantine, err)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// listenOverride is set by --listen at startup. It replaces the
+// configuration's listen, on reloads too, so tests and sidecars can ask
+// for an ephemeral port with :0 whatever the configuration says.
+var listenOverride string
+
+// boundListeners are the addresses the listeners were bound to, by name:
+// ocsp, legacy, signed, dashboard and standby. With port 0 in the
+// configuration, the port is only known here.
+var boundListeners = struct {
+	sync.Mutex
+	addrs map[string]string
+}{addrs: make(map[string]string)}
+
+// listen binds the listener name to addr and records the address it got.
+// A socket passed by systemd under the same name is used instead; see
+// activatedSockets.
+func listen(name, addr string) (net.Listener, error) {
+	ln, err := activatedListener(name)
+	if err != nil {
+		return nil, err
+	}
+	if ln != nil {
+		log.Printf("socket activation: %s passed by systemd", name)
+	} else if ln, err = net.Listen("tcp", addr); err != nil {
+		return nil, err
+	}
+	boundListeners.Lock()
+	boundListeners.addrs[name] = ln.Addr().String()
+	boundListeners.Unlock()
+	log.Printf("listening for %s on %s", name, ln.Addr())
+	return ln, nil
+}
+
+// sdListenFDsStart is the first file descriptor systemd passes.
+const sdListenFDsStart = 3
+
+// activatedSockets are the sockets systemd passed by socket activation,
+// by their FileDescriptorName. The variables are cleared once read, so
+// they do not leak into child processes.
+var activatedSockets = struct {
+	sync.Mutex
+	read  bool
+	files map[string]*os.File
+	err   error
+}{}
+
+func readActivatedSockets() (map[string]*os.File, error) {
+	pid, fds, names := os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS"), os.Getenv("LISTEN_FDNAMES")
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	if fds == "" || pid != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(fds)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("socket activation: bad LISTEN_FDS %q", fds)
+	}
+	split := strings.Split(names, ":")
+	files := make(map[string]*os.File, n)
+	for i := 0; i < n; i++ {
+		if i >= len(split) || split[i] == "" {
+			return nil, fmt.Errorf("socket activation: socket %d has no FileDescriptorName", i)
+		}
+		files[split[i]] = os.NewFile(uintptr(sdListenFDsStart+i), split[i])
+	}
+	return files, nil
+}
+
+// activatedListener returns the listener systemd passed as name, or nil if
+// it passed none.
+func activatedListener(name string) (net.Listener, error) {
+	a := &activatedSockets
+	a.Lock()
+	defer a.Unlock()
+	if !a.read {
+		a.files, a.err = readActivatedSockets()
+		a.read = true
+	}
+	if a.err != nil {
+		return nil, a.err
+	}
+	f, ok := a.files[name]
+	if !ok {
+		return nil, nil
+	}
+	delete(a.files, name)
+	ln, err := net.FileListener(f)
+	f.Close()
+	if err != nil {
+		return nil, fmt.Errorf("socket activation: %s: %v", name, err)
+	}
+	return ln, nil
+}
+
+// listenerReport is what the ready file and GET /admin/v1/listeners hold.
+type listenerReport struct {
+	PID       int               `json:"pid"`
+	Listeners map[string]string `json:"listeners"`
+}
+
+func currentListeners() listenerReport {
+	boundListeners.Lock()
+	defer boundListeners.Unlock()
+	r := listenerReport{PID: os.Getpid(), Listeners: make(map[string]string, len(boundListeners.addrs))}
+	for name, addr := range boundListeners.addrs {
+		r.Listeners[name] = addr
+	}
+	return r
+}
+
+// writeReadyFile writes the bound listeners to path, once every listener
+// is bound. It is replaced atomically, so whoever waits for it never reads
+// it half written.
+func writeReadyFile(path string) error {
+	data, _ := json.MarshalIndent(currentListeners(), "", "  ")
+	if err := writeFileAtomic(path, append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	log.Printf("ready: listeners written to %s", path)
+	return nil
+}
+
+// listenersHandler serves GET /admin/v1/listeners.
+func listenersHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(currentListeners())
+}
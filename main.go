@@ -2,32 +2,35 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"crypto/sha1"
 	"crypto/sha256"
 	"crypto/sha512"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/asn1"
 	"encoding/binary"
 	"encoding/pem"
+	"flag"
 	"fmt"
+	"github.com/pkkemp/GoOCSPResponder/responder"
 	"github.com/willf/bloom"
 	"html/template"
 	"io"
 	"log"
-	"net"
+	"math/big"
 	"net/http"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
-var filter *bloom.BloomFilter
-var filters map[string]CRLBloomFilter
-
-const rootDir = "/cache/"
-//const rootDir = "./"
+// rootDir is the cache directory: --cache, cache_dir or the platform's
+// default, /cache/ but on Windows; see service_windows.go.
+var rootDir = defaultCacheDir
 
 func getSha256Fingerprint(certificate *x509.Certificate) [sha256.Size]byte {
 	return sha256.Sum256(certificate.Raw)
@@ -48,6 +51,17 @@ type CRLInfo struct {
 	RemoteAddr  string
 	CA          *x509.Certificate
 	FileName    string
+	// FetchedFrom is the URL the CRL was downloaded from, after any
+	// redirects; empty if it was not downloaded by this process.
+	FetchedFrom string
+}
+
+// key names the CRL in the filter map: its file name without extension.
+func (c CRLInfo) key() string {
+	if i := strings.IndexByte(c.FileName, '.'); i >= 0 {
+		return c.FileName[:i]
+	}
+	return c.FileName
 }
 
 type CertificateBundle struct {
@@ -58,38 +72,62 @@ type CertificateBundle struct {
 	Hash256 []string
 }
 
-func downloadFromUrl(url string, port int) CRLInfo {
+func downloadFromUrl(cfg *Config, url string) (CRLInfo, error) {
 	tokens := strings.Split(url, "/")
-	host := tokens[2]
-	host += ":" + strconv.Itoa(port)
-	conn, err := net.Dial("tcp", host)
-	if err != nil {
-		panic("Unable to connect to " + host)
+	return downloadTo(cfg, url, tokens[len(tokens)-1])
+}
+
+// downloadTo downloads url into the cache as fileName.
+func downloadTo(cfg *Config, url, fileName string) (CRLInfo, error) {
+	if readOnly {
+		return CRLInfo{}, errReadOnly
 	}
-	fmt.Fprintf(conn, "GET / HTTP/1.0\r\n\r\n")
-	fileName := tokens[len(tokens)-1]
-	fmt.Println("Downloading", url, "to", fileName)
+	log.Printf("downloading %s to %s", url, fileName)
 
-	// TODO: check file existence first with io.IsExist
-	output, err := os.Create(rootDir+fileName)
+	// Download next to the target and rename so readers never see a
+	// partially written file during a background refresh.
+	output, err := os.Create(rootDir+fileName+".tmp")
 	if err != nil {
-		panic("Error while creating " + fileName)
+		return CRLInfo{}, fmt.Errorf("error while creating %s: %v", fileName, err)
 	}
+	defer os.Remove(output.Name())
 	defer output.Close()
 
-	response, err := http.Get(url)
+	ctx, cancel := context.WithTimeout(context.Background(), fetchTimeout)
+	defer cancel()
+	body, err := cfg.fetch(ctx, url)
 	if err != nil {
-		panic("Error while downloading " + url)
+		return CRLInfo{}, fmt.Errorf("error while downloading %s: %v", url, err)
+	}
+	defer body.Close()
+	info := CRLInfo{FileName: fileName, FetchedFrom: url}
+	if fb, ok := body.(*fetchedBody); ok {
+		info.FetchedFrom, info.RemoteAddr = fb.url.String(), fb.remoteAddr
+		if fb.redirects > 0 {
+			log.Printf("audit: %s redirected %d times to %s (%s)", url, fb.redirects, fb.url.Redacted(), fb.remoteAddr)
+		}
 	}
-	defer response.Body.Close()
 
-	n, err := io.Copy(output, response.Body)
+	var src io.Reader = downloadLimiter.reader(body)
+	if limit := downloadLimit(cfg, fileName); limit >= 0 {
+		src = io.LimitReader(src, limit)
+	}
+	n, err := io.Copy(output, src)
 	if err != nil {
-		panic("Error while downloading " + url)
+		return CRLInfo{}, fmt.Errorf("error while downloading %s: %v", url, err)
+	}
+	if err := checkDownloadSize(cfg, fileName, n); err != nil {
+		return CRLInfo{}, err
+	}
+	if err := output.Close(); err != nil {
+		return CRLInfo{}, err
+	}
+	if err := os.Rename(output.Name(), rootDir+fileName); err != nil {
+		return CRLInfo{}, err
 	}
 
-	return CRLInfo{Size: n, RemoteAddr: conn.RemoteAddr().String(), FileName:fileName}
-	//fmt.Println(n, "bytes downloaded.")
+	info.Size = n
+	return info, nil
 }
 
 func convertBytesToCertificate(certificate []byte) *x509.Certificate {
@@ -105,108 +143,11 @@ func convertBytesToCertificate(certificate []byte) *x509.Certificate {
 	return cert
 }
 
+// VerifyCertificate reports whether certificate chains to a root of the
+// active profile; see profile.go.
 func VerifyCertificate(certificate x509.Certificate) bool {
-	// First, create the set of root certificates.
-	// This includes the four (currently valid) DOD Root CAs
-
-	const rootCA5 = `
------BEGIN CERTIFICATE-----
-MIICJDCCAaqgAwIBAgIBDzAKBggqhkjOPQQDAzBbMQswCQYDVQQGEwJVUzEYMBYG
-A1UEChMPVS5TLiBHb3Zlcm5tZW50MQwwCgYDVQQLEwNEb0QxDDAKBgNVBAsTA1BL
-STEWMBQGA1UEAxMNRG9EIFJvb3QgQ0EgNTAeFw0xNjA2MTQxNzE3MjdaFw00MTA2
-MTQxNzE3MjdaMFsxCzAJBgNVBAYTAlVTMRgwFgYDVQQKEw9VLlMuIEdvdmVybm1l
-bnQxDDAKBgNVBAsTA0RvRDEMMAoGA1UECxMDUEtJMRYwFAYDVQQDEw1Eb0QgUm9v
-dCBDQSA1MHYwEAYHKoZIzj0CAQYFK4EEACIDYgAENmLeC07Ax9cpRTp/HJnmKiF2
-sQDdjEf/wLG0+s46TlL7p+02LRweHJCNl6orpuLTc3N8XBzQZ/QKKdOQhOtR5fFe
-HMDShoTFbdEkSQ7sF4nkaMjeGlwaBtA4GTMpARqBo0IwQDAdBgNVHQ4EFgQUhsAV
-Qvtxdtw+LRFbIRBENcrB3BQwDgYDVR0PAQH/BAQDAgEGMA8GA1UdEwEB/wQFMAMB
-Af8wCgYIKoZIzj0EAwMDaAAwZQIwQQbk3t5iNJ3fuKoW2W2iOB85IlfJcIQfkw9X
-fgUvpUszzRXqV9XSKx+bjXzOarbMAjEAt4HS4TuTzxFk3AsvF9Jt1dgF5FByYmXc
-pDzKYaUGmsn77cQwyXuJ4KW+Y1XmnBHj
------END CERTIFICATE-----`
-
-	const rootCA4 = `
------BEGIN CERTIFICATE-----
-MIIB6zCCAY+gAwIBAgIBATAMBggqhkjOPQQDAgUAMFsxCzAJBgNVBAYTAlVTMRgw
-FgYDVQQKEw9VLlMuIEdvdmVybm1lbnQxDDAKBgNVBAsTA0RvRDEMMAoGA1UECxMD
-UEtJMRYwFAYDVQQDEw1Eb0QgUm9vdCBDQSA0MB4XDTEyMDczMDE5NDgyM1oXDTMy
-MDcyNTE5NDgyM1owWzELMAkGA1UEBhMCVVMxGDAWBgNVBAoTD1UuUy4gR292ZXJu
-bWVudDEMMAoGA1UECxMDRG9EMQwwCgYDVQQLEwNQS0kxFjAUBgNVBAMTDURvRCBS
-b290IENBIDQwWTATBgcqhkjOPQIBBggqhkjOPQMBBwNCAAR2yNhDyw8H0iwPKtA4
-8YLNQlXn3B1agLcIkUtU1k+yZoU0lo0uPvTgSpF8zM2GnxHgUqFmgsbLkCPsX1/1
-8DxFo0IwQDAdBgNVHQ4EFgQUvcG5a030HewwkL9ic8CEM/JxJIUwDgYDVR0PAQH/
-BAQDAgGGMA8GA1UdEwEB/wQFMAMBAf8wDAYIKoZIzj0EAwIFAANIADBFAiEA6GGK
-99yqCaUH0kSeggNaRFNHhCOZz1zT3kpe1rs1NUYCIHYPuMR8FjV/1BLtiD2AEWtk
-B0xFZd9Trl8B7fFD0vW3
------END CERTIFICATE-----`
-
-	const rootCA3 = `
------BEGIN CERTIFICATE-----
-MIIDczCCAlugAwIBAgIBATANBgkqhkiG9w0BAQsFADBbMQswCQYDVQQGEwJVUzEY
-MBYGA1UEChMPVS5TLiBHb3Zlcm5tZW50MQwwCgYDVQQLEwNEb0QxDDAKBgNVBAsT
-A1BLSTEWMBQGA1UEAxMNRG9EIFJvb3QgQ0EgMzAeFw0xMjAzMjAxODQ2NDFaFw0y
-OTEyMzAxODQ2NDFaMFsxCzAJBgNVBAYTAlVTMRgwFgYDVQQKEw9VLlMuIEdvdmVy
-bm1lbnQxDDAKBgNVBAsTA0RvRDEMMAoGA1UECxMDUEtJMRYwFAYDVQQDEw1Eb0Qg
-Um9vdCBDQSAzMIIBIjANBgkqhkiG9w0BAQEFAAOCAQ8AMIIBCgKCAQEAqewUcoro
-S3Cj2hADhKb7pzYNKjpSFr8wFVKGBUcgz6qmzXXEZG7v8WAjywpmQK60yGgqAFFo
-STfpWTJNlbxDJ+lAjToQzhS8Qxih+d7M54V2c14YGiNbvT8f8u2NGcwD0UCkj6cg
-AkwnWnk29qM3IY4AWgYWytNVlm8xKbtyDsviSFHy1DekNdZv7hezsQarCxmG6CNt
-MRsoeGXF3mJSvMF96+6gXVQE+7LLK7IjVJGCTPC/unRAOwwERYBnXMXrolfDGn8K
-Lb1/udzBmbDIB+QMhjaUOiUv8n3mlzwblLSXWQbJOuQL2erp/DtzNG/955jk86HC
-kF8c9T8u1xnTfwIDAQABo0IwQDAdBgNVHQ4EFgQUbIqUonexgHIdgXoWqvLczmbu
-RcAwDgYDVR0PAQH/BAQDAgGGMA8GA1UdEwEB/wQFMAMBAf8wDQYJKoZIhvcNAQEL
-BQADggEBAJ9xpMC2ltKAQ6BI6R92BPnFPK1mGFhjm8O26GiKhVpCZhK00uaLiH+H
-9Jj1qMYJyR/wLB/sgrj0pUc4wTMr30x+mr4LC7HLD3xQKBDPio2i6bqshtfUsZNf
-Io+WBbRODHWRfdPy55TClBR2T48MqxCHWDKFB3WGEgte6lO0CshMhJIf6+hBhjy6
-9E5BStFsWEdBw4Za8u7p8pgnguouNtb4Bl6C8aBSk0QJutKpGVpYo6hdIG1PZPgw
-hxuQE0iBzcqQxw3B1Jg/jvIOV2gzEo6ZCbHw5PYQ9DbySb3qozjIVkEjg5rfoRs1
-fOs/QbP1b0s6Xq5vk3aY0vGZnUXEjnI=
------END CERTIFICATE-----`
-
-	const rootCA2 = `
------BEGIN CERTIFICATE-----
-MIIDcDCCAligAwIBAgIBBTANBgkqhkiG9w0BAQUFADBbMQswCQYDVQQGEwJVUzEY
-MBYGA1UEChMPVS5TLiBHb3Zlcm5tZW50MQwwCgYDVQQLEwNEb0QxDDAKBgNVBAsT
-A1BLSTEWMBQGA1UEAxMNRG9EIFJvb3QgQ0EgMjAeFw0wNDEyMTMxNTAwMTBaFw0y
-OTEyMDUxNTAwMTBaMFsxCzAJBgNVBAYTAlVTMRgwFgYDVQQKEw9VLlMuIEdvdmVy
-bm1lbnQxDDAKBgNVBAsTA0RvRDEMMAoGA1UECxMDUEtJMRYwFAYDVQQDEw1Eb0Qg
-Um9vdCBDQSAyMIIBIjANBgkqhkiG9w0BAQEFAAOCAQ8AMIIBCgKCAQEAwCzB9o07
-rP8/PNZxvrh0IgfscEEV/KtA4weqwcPYn/7aTDq/P8jYKHtLNgHArEUlw9IOCo+F
-GGQQPRoTcCpvjtfcjZOzQQ84Ic2tq8I9KgXTVxE3Dc2MUfmT48xGSSGOFLTNyxQ+
-OM1yMe6rEvJl6jQuVl3/7mN1y226kTT8nvP0LRy+UMRC31mI/2qz+qhsPctWcXEF
-lrufgOWARVlnQbDrw61gpIB1BhecDvRD4JkOG/t/9bPMsoGCsf0ywbi+QaRktWA6
-WlEwjM7eQSwZR1xJEGS5dKmHQa99brrBuKG/ZTE6BGf5tbuOkooAY7ix5ow4X4P/
-UNU7ol1rshDMYwIDAQABoz8wPTAdBgNVHQ4EFgQUSXS7DF66ev4CVO97oMaVxgmA
-cJYwCwYDVR0PBAQDAgGGMA8GA1UdEwEB/wQFMAMBAf8wDQYJKoZIhvcNAQEFBQAD
-ggEBAJiRjT+JyLv1wGlzKTs1rLqzCHY9cAmS6YREIQF9FHYb7lFsHY0VNy17MWn0
-mkS4r0bMNPojywMnGdKDIXUr5+AbmSbchECV6KjSzPZYXGbvP0qXEIIdugqi3VsG
-K52nZE7rLgE1pLQ/E61V5NVzqGmbEfGY8jEeb0DU+HifjpGgb3AEkGaqBivO4XqS
-tX3h4NGW56E6LcyxnR8FRO2HmdNNGnA5wQQM5X7Z8a/XIA7xInolpHOZzD+kByeW
-qKKV7YK5FtOeC4fCwfKI9WLfaN/HvGlR7bFc3FRUKQ8JOZqsA8HbDE2ubwp6Fknx
-v5HSOJTT9pUst2zJQraNypCNhdk=
------END CERTIFICATE-----`
-
-	roots := x509.NewCertPool()
-	err5 := roots.AppendCertsFromPEM([]byte(rootCA5))
-	err4 := roots.AppendCertsFromPEM([]byte(rootCA4))
-	err3 := roots.AppendCertsFromPEM([]byte(rootCA3))
-	err2 := roots.AppendCertsFromPEM([]byte(rootCA2))
-
-	if !err5 || !err4 || !err3 || !err2 {
-		panic("failed to parse root certificate")
-	}
-
-	//block, _ := pem.Decode(certificate.Raw)
-	//if block == nil {
-	//	panic("failed to parse certificate PEM")
-	//}
-	//cert, err := x509.ParseCertificate(block.Bytes)
-	//if err != nil {
-	//	panic("failed to parse certificate: " + err.Error())
-	//}
-
 	opts := x509.VerifyOptions{
-		Roots: roots,
+		Roots: trustAnchors,
 	}
 
 	if _, err := certificate.Verify(opts); err != nil {
@@ -216,41 +157,19 @@ v5HSOJTT9pUst2zJQraNypCNhdk=
 	}
 }
 
-//func GenerateOCSPResponse(caName string, certs CertificateBundle, responderCert *x509.Certificate) {
-//
-//	var issuer *x509.Certificate
-//	var status ocsp.ResponseStatus
-//	for _, cert := range certs.Certificates {
-//		if cert.Subject.CommonName == caName {
-//			issuer = &cert
-//
-//			break
-//		}
-//		//TODO: change status code based on errors
-//	}
-//	templateInfo := ocsp.Response{
-//		Status:             0,
-//		SerialNumber:       nil,
-//		ThisUpdate:         time.Time{},
-//		NextUpdate:         time.Time{},
-//		RevokedAt:          time.Time{},
-//		RevocationReason:   0,
-//	}
-//	ocsp.CreateResponse(&issuer, templateInfo, )
-//}
-
 func loadCertificates() CertificateBundle {
-	cert, err := os.Open(rootDir+"DoD_CAs.pem")
+	cert, err := os.Open(rootDir+bundleFile())
 	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+		log.Fatal(err)
 	}
 	pemfileinfo, _ := cert.Stat()
 	size := pemfileinfo.Size()
 	pembytes := make([]byte, size)
 
 	buffer := bufio.NewReader(cert)
-	_, err = buffer.Read(pembytes)
+	if _, err := buffer.Read(pembytes); err != nil {
+		log.Fatalf("reading %s: %v", cert.Name(), err)
+	}
 	certString := string(pembytes)
 	concatcerts := strings.SplitAfter(certString, "-----END CERTIFICATE-----")
 	var certs []x509.Certificate
@@ -269,9 +188,6 @@ func loadCertificates() CertificateBundle {
 		certBytes := []byte(tempString)
 		if(tempString != "") {
 			tempCert := convertBytesToCertificate(certBytes)
-			if (err != nil) {
-				panic("oh no")
-			}
 			//getting Sha256 fingerprint of the certificate
 			fingerprint := getSha256Fingerprint(tempCert)
 			//converting the fingerprint to a hex string
@@ -308,57 +224,56 @@ func readCurrentDir() []string {
 func loadCRLs(CRLList []string) []*pkix.CertificateList {
 	var parsedCRLs []*pkix.CertificateList
 	for _, crl := range CRLList {
-		parsedCRLs = append(parsedCRLs, parseCRL(crl))
+		parsed, err := parseCRL(crl)
+		if err != nil {
+			log.Printf("skipping %s: %v", crl, err)
+			continue
+		}
+		parsedCRLs = append(parsedCRLs, parsed)
 	}
 	return parsedCRLs
 }
 
-func loadCRLsFromDisk(CRLList []string) []CRLInfo {
-	bundle := loadCertificates()
-	var crls []CRLInfo
-	var fileName string
-	for i:=0; i < len(bundle.Certificates); i++ {
-		if strings.HasPrefix(bundle.Certificates[i].Subject.CommonName, "DOD EMAIL") {
-			fileName = "DODEMAILCA_" + strings.SplitAfter(bundle.Certificates[i].Subject.CommonName, "-")[1] + ".crl"
-		} else if strings.HasPrefix(bundle.Certificates[i].Subject.CommonName, "DOD ID SW") {
-			fileName = "DODIDSWCA_" + strings.SplitAfter(bundle.Certificates[i].Subject.CommonName, "-")[1] + ".crl"
-		} else if strings.HasPrefix(bundle.Certificates[i].Subject.CommonName, "DOD ID") {
-			fileName = "DODIDCA_" + strings.SplitAfter(bundle.Certificates[i].Subject.CommonName, "-")[1] + ".crl"
-		} else if strings.HasPrefix(bundle.Certificates[i].Subject.CommonName, "DOD SW") {
-			fileName = "DODSWCA_" + strings.SplitAfter(bundle.Certificates[i].Subject.CommonName, "-")[1] + ".crl"
-		} else {
-			continue
-		}
-		temp := CRLInfo{
-			Size:       0,
-			RemoteAddr: "",
-			CA:         &bundle.Certificates[i],
-			FileName:   fileName,
-		}
-		crls = append(crls, temp)
-	}
+func parseCRL(crlFile string) (*pkix.CertificateList, error) {
+	return parseCRLFile(rootDir + crlFile)
+}
 
-	return crls
+// parseCRLFile parses the DER CRL at path.
+func parseCRLFile(path string) (*pkix.CertificateList, error) {
+	crlBytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseCRLDER(filepath.Base(path), crlBytes)
 }
 
+// parseCRLDER parses der, the CRL file name.
+func parseCRLDER(name string, der []byte) (*pkix.CertificateList, error) {
+	crl, err := x509.ParseDERCRL(der)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	return crl, nil
+}
 
-func parseCRL(crlFile string) *pkix.CertificateList {
-	cert, err := os.Open(rootDir+crlFile)
+// scanCRLFile scans the DER CRL at path for indexing.
+func scanCRLFile(path string) (*responder.ScannedCRL, error) {
+	crlBytes, err := os.ReadFile(path)
 	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+		return nil, err
 	}
-	defer cert.Close()
-	pemfileinfo, _ := cert.Stat()
-	size := pemfileinfo.Size()
-	pembytes := make([]byte, size)
-	buffer := bufio.NewReader(cert)
-	_, err = buffer.Read(pembytes)
-	crl, err := x509.ParseDERCRL(pembytes)
-	if (err != nil) {
-		panic(err)
+	return scanCRLDER(filepath.Base(path), crlBytes)
+}
+
+// scanCRLDER scans der, the CRL file name, for indexing: as parseCRLDER,
+// but the revoked certificates are left encoded for indexCRL and
+// encodeIndex to walk.
+func scanCRLDER(name string, der []byte) (*responder.ScannedCRL, error) {
+	crl, err := responder.ScanCRL(der)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
 	}
-	return crl
+	return crl, nil
 }
 
 //type CRLInfo struct {
@@ -373,26 +288,51 @@ type CRLPageData struct {
 }
 
 type CRLRevocations struct {
+	// Key names the CRL to the admin API.
+	Key string
 	Issuer string
 	NumberOfRevocations int
+	// Quarantine is why the issuer's CRL is quarantined, if it is.
+	Quarantine string
+	// Frozen marks an issuer frozen at its CRL; see freeze.go.
+	Frozen bool
+	// Operator shows the refresh button.
+	Operator bool
 }
 
 type CRLStatsPageData struct {
 	PageTitle string
-	Revocations []CRLRevocations
+	// Rows are the rendered CA table rows; see dashrows.go.
+	Rows []template.HTML
+	// User is the signed-in dashboard user, if dashboard auth is on.
+	User string
+	// Operator shows the refresh and flush buttons.
+	Operator bool
+	// Done reports the outcome of the last operator action.
+	Done string
+	// Freezes are the issuers frozen at a CRL; see freeze.go.
+	Freezes []*issuerFreeze
+	// Runtime is the runtime panel.
+	Runtime runtimeStats
+	// UnknownIssuers are the most requested issuers that are not served,
+	// out of UnknownRequests; see unknownissuers.go.
+	UnknownIssuers  []unknownIssuerReport
+	UnknownRequests int64
 }
 
+// crlStatsHandler serves the dashboard from the loaded indexes.
 func crlStatsHandler(w http.ResponseWriter, r *http.Request) {
-	tmpl := template.Must(template.ParseFiles("/data/crllist.html"))
-	CRLS := loadCRLs(readCurrentDir())
-	var stats CRLStatsPageData
-	for _, CRL := range CRLS {
-		var ca CRLRevocations
-		ca.Issuer = CRL.TBSCertList.Issuer.String()
-		ca.NumberOfRevocations = len(CRL.TBSCertList.RevokedCertificates)
-		stats.Revocations = append(stats.Revocations, ca)
+	st := currentState()
+	stats := CRLStatsPageData{PageTitle: "CRL Statistics", Done: r.FormValue("done")}
+	if p, ok := requestPrincipal(r); ok {
+		stats.User = p.name + " (" + p.role.String() + ")"
+		stats.Operator = p.role >= roleOperator
 	}
-	tmpl.Execute(w, stats)
+	stats.Rows = dashboardRows.render(st, stats.Operator)
+	stats.Freezes = sortedFreezes()
+	stats.Runtime = currentRuntimeStats(st)
+	stats.UnknownIssuers, stats.UnknownRequests = unknownIssuerReports(10)
+	templates.ExecuteTemplate(w, "crllist.html", stats)
 }
 
 func helloHandler(w http.ResponseWriter, r *http.Request) {
@@ -404,7 +344,6 @@ func helloHandler(w http.ResponseWriter, r *http.Request) {
 
 func crlHandler(w http.ResponseWriter, r *http.Request) {
 	// Write "Hello, world!" to the response body
-	tmpl := template.Must(template.ParseFiles("layout.html"))
 	start := time.Now()
 	CRL := loadCRLs(readCurrentDir())
 	data := CRLPageData{
@@ -412,87 +351,413 @@ func crlHandler(w http.ResponseWriter, r *http.Request) {
 		CRLS: CRL}
 	elapsed := time.Since(start)
 	log.Printf("crlHandler took %s", elapsed)
-	tmpl.Execute(w, data)
+	templates.ExecuteTemplate(w, "layout.html", data)
 }
 
 type CRLBloomFilter struct {
 	crlInfo CRLInfo
+	// Filter is nil for issuers limited to exact lookups; see bloom.go.
 	Filter *bloom.BloomFilter
+	// entries holds the exact revocation data, sorted by serial; the
+	// bloom filter only answers "possibly revoked". See arena.go.
+	entries *arenaIndex
+	// disk replaces Filter and entries with index.on_disk.
+	disk *diskIndex
+	// pruned is what expired.prune dropped from entries, if anything; see
+	// expired.go.
+	pruned *pruning
+	// quirks are the encoding quirks accepted under tolerant_parsing; see
+	// tolerant.go.
+	quirks []string
+	// quarantine is why the CRL cannot be trusted, if it cannot; a
+	// quarantined index has no entries. See quarantine.go.
+	quarantine string
+	// pending marks the placeholder of an issuer still loading after the
+	// startup deadline; it is quarantined too, but always answered
+	// tryLater. See startup.go.
+	pending    bool
+	thisUpdate time.Time
+	nextUpdate time.Time
+	// crlNumber is the CRL's cRLNumber extension, or nil without one.
+	crlNumber *big.Int
+	// loadedAt is when this index was built.
+	loadedAt time.Time
+	// crlHash is the SHA-256 of the CRL file the index was built from.
+	crlHash [sha256.Size]byte
+	// indexHash is the SHA-256 of the canonical index, zero for a
+	// quarantined CRL; see manifest.go.
+	indexHash [sha256.Size]byte
+	// crlID is the CrlID single extension of its answers, if configured.
+	crlID []pkix.Extension
+	// answerNextUpdate is the nextUpdate of its answers when learned from
+	// the issuer's publication cadence; see cadence.go.
+	answerNextUpdate time.Time
 }
 
-func ConstructBloomFilters(crls[] CRLInfo) map[string]CRLBloomFilter {
+// ConstructBloomFilters indexes crls concurrently, as many at once as the
+// build pool admits.
+func ConstructBloomFilters(cfg *Config, crls[] CRLInfo) (map[string]CRLBloomFilter, error) {
 	filters := make(map[string]CRLBloomFilter)
+	var (
+		mu       sync.Mutex
+		wg       sync.WaitGroup
+		firstErr error
+	)
 	for _, crl := range crls {
-		 temp := CRLBloomFilter {
-			crlInfo: crl,
-			Filter: ConstructBloomFilter(crl),
+		wg.Add(1)
+		go func(crl CRLInfo) {
+			defer wg.Done()
+			temp, err := ConstructBloomFilter(cfg, crl)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+				return
+			}
+			filters[crl.key()] = temp
+		}(crl)
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return filters, nil
+}
+
+// ConstructBloomFilter indexes the cached CRL crl once the build pool has
+// a worker for it.
+func ConstructBloomFilter(cfg *Config, crl CRLInfo) (CRLBloomFilter, error) {
+	b := builds.start(crl.key())
+	f, err := constructBloomFilter(cfg, crl, b)
+	builds.finish(b, err)
+	return f, err
+}
+
+func constructBloomFilter(cfg *Config, crl CRLInfo, b *buildProgress) (CRLBloomFilter, error) {
+	crlHash, err := hashFile(rootDir + crl.FileName)
+	if err != nil {
+		return CRLBloomFilter{}, err
+	}
+	if cfg.Index.OnDisk {
+		f, err := loadDiskIndex(cfg, crl, crlHash, b)
+		if err != nil {
+			return CRLBloomFilter{}, err
+		}
+		f.crlID = crlIDExtensions(cfg, f)
+		adaptNextUpdate(cfg, &f)
+		return f, nil
+	}
+	der, err := os.ReadFile(rootDir + crl.FileName)
+	if err != nil {
+		return CRLBloomFilter{}, err
+	}
+	if f, over := limitQuarantine(cfg, crl, der); over {
+		f.crlHash = crlHash
+		return f, nil
+	}
+	b.phase("parsing", 0)
+	scanned, err := scanCRLFor(cfg, crl, der)
+	if err != nil {
+		return CRLBloomFilter{}, err
+	}
+	var f CRLBloomFilter
+	if reason := quarantineReason(cfg, crl, scanned.CertificateList); reason != "" {
+		log.Printf("quarantined %s: %s", crl.FileName, reason)
+		f = quarantined(crl, scanned.CertificateList, reason)
+	} else {
+		if f, err = indexCRL(cfg, crl, scanned, b); err != nil {
+			return CRLBloomFilter{}, err
 		}
-		mapKey := strings.Split(temp.crlInfo.FileName, ".")
-		filters[mapKey[0]] = temp
+		idx, err := encodeIndex(scanned, crlHash, b)
+		if err != nil {
+			return CRLBloomFilter{}, err
+		}
+		f.indexHash = sha256.Sum256(idx)
 	}
-	return filters
+	f.crlHash = crlHash
+	f.quirks = scanned.Quirks
+	f.crlID = crlIDExtensions(cfg, f)
+	adaptNextUpdate(cfg, &f)
+	return f, nil
 }
 
-func ConstructBloomFilter(crl CRLInfo) *bloom.BloomFilter {
-	//TODO Fix n value
-	filter := createBloom(1000000)
-	parsedCRL := parseCRL(crl.FileName)
-	for k := 0; k < len(parsedCRL.TBSCertList.RevokedCertificates); k++ {
-		addItemToBloom(parsedCRL.TBSCertList.RevokedCertificates[k].SerialNumber.Uint64(), filter)
+// indexCRL builds the bloom filter and exact entries of a scanned CRL. The
+// entries go from the DER straight into the arena, with no Entry or
+// big.Int per serial. b, if not nil, follows the progress.
+func indexCRL(cfg *Config, crl CRLInfo, scanned *responder.ScannedCRL, b *buildProgress) (CRLBloomFilter, error) {
+	filter := newBloom(cfg, crl.key(), scanned.Count)
+	arena := newArenaBuilder(scanned.Count, scanned.SerialLen)
+	b.phase("indexing", scanned.Count)
+	err := scanned.Entries(func(k int, serial []byte, e responder.Entry) {
+		if filter != nil {
+			addItemToBloom(serialUint64(serial), filter)
+		}
+		arena.put(k, serial, e)
+		b.step(k)
+	})
+	if err != nil {
+		return CRLBloomFilter{}, err
 	}
-	return filter
+	b.phase("sorting", 0)
+	return CRLBloomFilter{
+		crlInfo:    crl,
+		Filter:     filter,
+		entries:    arena.finish(),
+		thisUpdate: scanned.TBSCertList.ThisUpdate,
+		nextUpdate: scanned.TBSCertList.NextUpdate,
+		crlNumber:  crlNumber(scanned.CertificateList),
+		loadedAt:   time.Now(),
+	}, nil
+}
+
+// indexed reports whether f holds an index, in memory or on disk, or was
+// quarantined.
+func (f CRLBloomFilter) indexed() bool {
+	return f.entries != nil || f.disk != nil || f.quarantine != ""
+}
+
+// size returns the number of revoked entries in f, pruned ones included.
+func (f CRLBloomFilter) size() int {
+	if f.disk != nil {
+		return f.disk.count
+	}
+	return f.entries.len() + f.pruned.len()
 }
 
+var oidCRLNumber = asn1.ObjectIdentifier{2, 5, 29, 20}
+
+// crlNumber returns the cRLNumber extension of crl, or nil if it has none.
+func crlNumber(crl *pkix.CertificateList) *big.Int {
+	for _, ext := range crl.TBSCertList.Extensions {
+		if ext.Id.Equal(oidCRLNumber) {
+			n := new(big.Int)
+			if _, err := asn1.Unmarshal(ext.Value, &n); err != nil {
+				return nil
+			}
+			return n
+		}
+	}
+	return nil
+}
+
+// commands are the goocsp subcommands; with no subcommand the server runs.
+var commands = map[string]func(args []string) int{
+	"verify-response":    verifyResponseCommand,
+	"verify-attestation": verifyAttestationCommand,
+	"inspect":            inspectCommand,
+	"sign-blocklist":     signBlocklistCommand,
+	"manifest":           manifestCommand,
+	"diff":               diffCommand,
+	"sign-media":         signMediaCommand,
+	"import":             importCommand,
+	"serial":             serialCommand,
+	"systemd":            systemdCommand,
+	"service":            serviceCommand,
+	"router":             routerCommand,
+	"snapshot":           snapshotCommand,
+}
 
 func main() {
-	downloadFromUrl("https://goocsp.blob.core.usgovcloudapi.net/pki/DoD_CAs.pem", 443)
-    crls := downloadCRLs()
-    //downloadFromUrl("https://goocsp.blob.core.usgovcloudapi.net/crl/DODEMAILCA_41.crl", 443)
-	const CRLEndpoint = "crl.disa.mil"
-	const OCSPEndpoint = "ocsp.disa.mil"
-	//data := downloadCRLs()
-	//fmt.Print("Downloaded from: ", data)
-	filter = createBloom(1000000)
-	CRL := parseCRL("DODEMAILCA_41.crl")
-	//crls := loadCRLsFromDisk(readCurrentDir())
-	const numCRLS = 100
-
-	filters = ConstructBloomFilters(crls)
-
-	//for i:=0; i < len(CRLS); i++ {
-	//	filter := createBloom(1000000)
-	//	filters = append(filters,CRLBloomFilter{})
-	//	currentFilter := &filters[i].Filter
-	//	currentFilter = &filter
-	//	filters[i].crlInfo.CA = CRLS[i].TBSCertList.Issuer.String()
-	//	for j:= 0; j < len(CRLInfo.TBSCertList.RevokedCertificates); j++  {
-	//		addItemToBloom(CRLS[i].TBSCertList.RevokedCertificates[j].SerialNumber.Uint64(), currentFilter)
-	//	}
-	//}
-
-	for k := 0; k < len(CRL.TBSCertList.RevokedCertificates); k++ {
-		addItemToBloom(CRL.TBSCertList.RevokedCertificates[k].SerialNumber.Uint64(), filter)
-	}
-
-	fmt.Println(findItemBloom(1572835, filter))
-	fmt.Println(findItemBloom(3145685, filter))
-	fmt.Println(findItemBloom(3145686, filter))
-	fmt.Println(findItemBloom(3145525, filter))
-	fmt.Println(findItemBloom(3145526, filter))
-	fmt.Println(findItemBloom(1572626, filter))
-	http.HandleFunc("/", handler)
-	http.HandleFunc("/api", handler)
-	http.HandleFunc("/stats", crlStatsHandler)
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	if len(os.Args) > 1 {
+		if cmd, ok := commands[os.Args[1]]; ok {
+			os.Exit(cmd(os.Args[2:]))
+		}
+	}
+	serve()
+}
+
+func serve() {
+	configPath := flag.String("config", "", "path to the YAML configuration file")
+	legacyAddr := flag.String("legacy-api", "", "serve the deprecated plaintext /{ca}/{serial} API on this address")
+	legacySunset := flag.String("legacy-api-sunset", "", "date announced in the Sunset header of legacy API responses")
+	cacheDir := flag.String("cache", "", "directory of the cached bundle, CRLs and indexes; cache_dir, or "+defaultCacheDir+" by default")
+	serviceName := flag.String("service", "", "run as the Windows service of this name, as goocsp service install sets up")
+	flag.BoolVar(&readOnly, "read-only", false, "serve the cache directory as is, without downloads, reloads or admin changes")
+	flag.StringVar(&listenOverride, "listen", "", "address to serve OCSP on instead of the configuration's listen; :0 picks a free port")
+	readyFile := flag.String("ready-file", "", "write the bound listener addresses here, as JSON, once every listener is bound")
+	flag.Parse()
+	if *serviceName != "" {
+		// Before anything slow: the service control manager gives a
+		// service 30 seconds to report.
+		if err := startService(*serviceName); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var sunset time.Time
+	if *legacySunset != "" {
+		var err error
+		if sunset, err = parseTime(*legacySunset); err != nil {
+			log.Fatalf("--legacy-api-sunset: %v", err)
+		}
+	}
+
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	switch {
+	case *cacheDir != "":
+		setCacheDir(*cacheDir)
+	case cfg.CacheDir != "":
+		setCacheDir(cfg.CacheDir)
+	}
+	if registry, err = loadIssuerRegistry(rootDir + issuerRegistryFile); err != nil {
+		log.Fatal(err)
+	}
+	if err := useProfile(cfg); err != nil {
+		log.Fatal(err)
+	}
+	logFIPSBanner(cfg)
+	setupRegion(cfg.Region)
+	if readOnly {
+		if err := checkReadOnly(cfg); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("read-only mode: serving %s as is", rootDir)
+	} else if cfg.Region.subordinate() {
+		if err := fetchBundle(cfg); err != nil {
+			if _, statErr := os.Stat(rootDir + bundleFile()); statErr != nil {
+				log.Fatal(err)
+			}
+			log.Printf("%v; starting from the cached bundle", err)
+		}
+	} else if _, err := downloadTo(cfg, cfg.BundleURL, bundleFile()); err != nil {
+		log.Fatal(err)
+	}
+	// A standby starts from whatever CRLs it has cached; the primary
+	// sends it the current ones.
+	st, finishStartup, err := startState(cfg, loadCertificates(), cfg.Standby.Role != "standby")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := checkHealth(st); err != nil {
+		log.Fatal(err)
+	}
+	current.Store(st)
+	registry.sync(st)
+	superviseLoop("registry", runIssuerRegistry)
+	if finishStartup != nil {
+		go finishStartup()
+	}
+	if err := loadBlocklist(cfg); err != nil {
+		log.Fatal(err)
+	}
+	if *configPath != "" && !readOnly {
+		go watchConfig(*configPath)
+	}
+	superviseLoop("consistency", runConsistencyChecker)
+	superviseLoop("peers", runPeerChecker)
+	superviseLoop("dp-probes", runDPProber)
+	superviseLoop("staples", runStapleExporter)
+	go runWatchdog()
+	if cfg.Events.Bus != "" {
+		if events, err = newEventStream(cfg.Events); err != nil {
+			log.Fatal(err)
+		}
+		go events.run()
+	}
+	switch cfg.Standby.Role {
+	case "primary":
+		ln, err := listen("standby", cfg.Standby.Listen)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go func() {
+			log.Fatal(serveStandbyStream(ln, cfg.Standby, cfg.tlsPolicyFor(cfg.Standby.TLS.Policy)))
+		}()
+		if !readOnly {
+			superviseLoop("refresher", runRefresher)
+		}
+	case "standby":
+		// The refresher starts on promotion.
+		standby.passive = 1
+		go runStandby(cfg.Standby, cfg.tlsPolicyFor(cfg.Standby.TLS.Policy))
+	default:
+		if !readOnly {
+			superviseLoop("refresher", runRefresher)
+		}
+	}
+
+	if *legacyAddr != "" {
+		legacy := http.NewServeMux()
+		legacy.HandleFunc("/", legacyHandler(sunset))
+		ln, err := listen("legacy", *legacyAddr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go func() {
+			log.Fatal(http.Serve(ln, legacy))
+		}()
+	}
+
+	if cfg.SignedRequests.Listen != "" {
+		signed := http.NewServeMux()
+		signed.HandleFunc("/", signedOCSPHandler(newVerifyPool(cfg.SignedRequests)))
+		ln, err := listen("signed", cfg.SignedRequests.Listen)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go func() {
+			log.Fatal(http.Serve(ln, signed))
+		}()
+	}
+
+	if cfg.Dashboard.Auth == "mtls" || cfg.Dashboard.Auth == "oidc" {
+		if dashboard, err = newDashboardAuth(cfg.Dashboard); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if cfg.Dashboard.Listen != "" {
+		ln, err := listen("dashboard", cfg.Dashboard.Listen)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go func() {
+			log.Fatal(serveDashboard(ln, cfg.Dashboard, cfg.tlsPolicyFor(cfg.Dashboard.TLS.Policy)))
+		}()
+	} else {
+		registerDashboard(http.DefaultServeMux, false)
+	}
 
+	registerAPI(http.DefaultServeMux, cfg, apiEndpoints())
+	http.HandleFunc("/static/", staticHandler)
+	http.HandleFunc("/favicon.ico", rootAssetHandler("favicon.ico"))
+	http.HandleFunc("/robots.txt", rootAssetHandler("robots.txt"))
+	registerAdminActions(http.DefaultServeMux)
+	ln, err := listen("ocsp", cfg.Listen)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if cfg.Clients.ProxyProtocol {
+		ln = proxyProtocolListener(ln)
+	}
+	if *readyFile != "" {
+		if err := writeReadyFile(*readyFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	serviceRunning()
+	// Every listener is bound, so the dashboard's can be checked too.
+	superviseLoop("tls-check", runTLSChecker)
+	log.Fatal(http.Serve(ln, sniffProtocols(http.DefaultServeMux)))
 }
 
 func handler(w http.ResponseWriter, r *http.Request) {
-	urlInfo := strings.Split(r.URL.Path, "/")
-	ca := urlInfo[1]
-	cert, _ := strconv.ParseUint(urlInfo[2], 10, 64)
-	revoked := findItemBloom(cert, filters[ca].Filter)
-	fmt.Fprintf(w, "Certificate Revoked?: %t", revoked)
+	if r.Method == http.MethodPost {
+		ocspHandler(w, r)
+		return
+	}
+	if r.Method == http.MethodGet {
+		if _, enc := currentState().routeGET(r.URL.Path); responder.LooksLikeGET(enc) {
+			ocspHandler(w, r)
+			return
+		}
+	}
+	// The plaintext /{ca}/{serial} API moved to the --legacy-api listener.
+	http.NotFound(w, r)
 }
 
 func createBloom(n uint) *bloom.BloomFilter {
@@ -512,39 +777,97 @@ func findItemBloom(serial uint64, filter *bloom.BloomFilter) bool {
 	return filter.Test(n1)
 }
 
-func downloadCRLs() []CRLInfo {
-	var baseURL string = "http://crl.disa.mil"
-	baseURL = "https://goocsp.blob.core.usgovcloudapi.net"
-	bundle := loadCertificates()
-	certs := bundle.Certificates
+// selectIssuers returns the issuing CAs from the bundle that cfg serves. Every
+// issuer named in cfg.Issuers must be present and chain to a root of the
+// profile.
+func selectIssuers(cfg *Config, bundle CertificateBundle) ([]*x509.Certificate, error) {
+	wanted := make(map[string]bool)
+	for _, name := range cfg.Issuers {
+		wanted[name] = false
+	}
+	var issuers []*x509.Certificate
+	selected := make(map[string]bool)
+	for i := range bundle.Certificates {
+		cert := &bundle.Certificates[i]
+		fileName := registry.crlFile(cert)
+		if fileName == "" || selected[fileName] {
+			// A root, or a cross-certificate of an issuer already
+			// selected.
+			continue
+		}
+		if _, ok := wanted[cert.Subject.CommonName]; len(wanted) > 0 && !ok {
+			continue
+		}
+		if !VerifyCertificate(*cert) {
+			continue
+		}
+		wanted[cert.Subject.CommonName] = true
+		selected[fileName] = true
+		issuers = append(issuers, cert)
+	}
+	for _, cert := range discoveredIssuers(cfg) {
+		// Served whatever issuers lists, as when they were discovered.
+		if fileName := registry.crlFile(cert); !selected[fileName] {
+			selected[fileName] = true
+			issuers = append(issuers, cert)
+		}
+	}
+	for name, found := range wanted {
+		if !found {
+			return nil, fmt.Errorf("issuer %q is not a valid issuing CA in the bundle", name)
+		}
+	}
+	return issuers, nil
+}
+
+// downloadCRLs makes sure the CRL of every served issuer is in the cache,
+// fetching it when refetch is set or no copy exists yet.
+func downloadCRLs(cfg *Config, bundle CertificateBundle, refetch bool) ([]CRLInfo, error) {
+	issuers, err := selectIssuers(cfg, bundle)
+	if err != nil {
+		return nil, err
+	}
 	var CRLDownloadInfo []CRLInfo
-	for _, cert := range certs {
-		if VerifyCertificate(cert) {
-			if !strings.HasPrefix(cert.Subject.CommonName, "DoD Root") {
-				var crl = ""
-				if strings.HasPrefix(cert.Subject.CommonName, "DOD EMAIL") {
-					crl = baseURL+ "/crl/DODEMAILCA_" + strings.SplitAfter(cert.Subject.CommonName, "-")[1] + ".crl"
-				} else if strings.HasPrefix(cert.Subject.CommonName, "DOD ID SW") {
-					crl = baseURL+ "/crl/DODIDSWCA_" + strings.SplitAfter(cert.Subject.CommonName, "-")[1] + ".crl"
-				} else if strings.HasPrefix(cert.Subject.CommonName, "DOD ID") {
-					crl = baseURL+ "/crl/DODIDCA_" + strings.SplitAfter(cert.Subject.CommonName, "-")[1] + ".crl"
-				} else if strings.HasPrefix(cert.Subject.CommonName, "DOD SW") {
-					crl = baseURL+ "/crl/DODSWCA_" + strings.SplitAfter(cert.Subject.CommonName, "-")[1] + ".crl"
-				} else {
-					continue
-				}
-				fingerprint := getSha256Fingerprint(&cert)
-				var crlSize int64 = 0
-				downloadInfo := downloadFromUrl(crl, 80)
-				downloadInfo.CA = &cert
-				crlSize = downloadInfo.Size
-				s := cert.Subject.CommonName + " " + cert.SignatureAlgorithm.String() + " Issuing CA: " + cert.Issuer.CommonName + " CRLInfo Size: " + strconv.Itoa(int(crlSize)) + ": "
-				s += fmt.Sprintf("%x", fingerprint)
-				//hashes = append(hashes, s)
-				fmt.Println(s)
-				CRLDownloadInfo = append(CRLDownloadInfo, downloadInfo)
+	for _, cert := range issuers {
+		downloadInfo, err := fetchCRL(cfg, cert, refetch)
+		if err != nil {
+			return nil, err
+		}
+		CRLDownloadInfo = append(CRLDownloadInfo, downloadInfo)
+	}
+	return CRLDownloadInfo, nil
+}
+
+// fetchCRL makes sure the CRL of the issuing CA cert is in the cache,
+// fetching it when refetch is set, unless the issuer is frozen, or no copy
+// exists yet.
+func fetchCRL(cfg *Config, cert *x509.Certificate, refetch bool) (CRLInfo, error) {
+	fileName := registry.crlFile(cert)
+	frozen := currentFreeze(CRLInfo{FileName: fileName}.key()) != nil
+	if fi, err := os.Stat(rootDir + fileName); err == nil && (!refetch || frozen) {
+		return CRLInfo{Size: fi.Size(), CA: cert, FileName: fileName}, nil
+	} else if readOnly {
+		return CRLInfo{}, fmt.Errorf("read-only mode: no cached CRL for %s: %v", printableName(cert.Subject.CommonName), err)
+	}
+	downloadInfo, err := downloadCRL(cfg, cert, fileName)
+	if err != nil && err != errNotModified {
+		return CRLInfo{}, err
+	}
+	if err == nil {
+		if err := commitStagedCRL(cfg, cert, fileName); err != nil {
+			fi, statErr := os.Stat(rootDir + fileName)
+			if statErr != nil {
+				return CRLInfo{}, err
 			}
+			log.Printf("%s: %v", fileName, err)
+			downloadInfo = CRLInfo{Size: fi.Size()}
 		}
+		downloadInfo.FileName = fileName
 	}
-	return CRLDownloadInfo
+	downloadInfo.CA = cert
+	fingerprint := getSha256Fingerprint(cert)
+	s := printableName(cert.Subject.CommonName) + " " + cert.SignatureAlgorithm.String() + " Issuing CA: " + printableName(cert.Issuer.CommonName) + " CRLInfo Size: " + strconv.Itoa(int(downloadInfo.Size)) + ": "
+	s += fmt.Sprintf("%x", fingerprint)
+	log.Println(s)
+	return downloadInfo, nil
 }
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// MaintenanceConfig sets the defaults of maintenance mode, which an
+// operator turns on through POST /admin/v1/maintenance for a planned outage
+// of the CRL sources: OCSP requests for every issuer, or for the chosen
+// ones, are answered tryLater with a Retry-After header, while /healthz and
+// /readyz stay green so load balancers keep the instance while clients are
+// drained to another responder.
+type MaintenanceConfig struct {
+	// RetryAfter is the Retry-After sent with maintenance responses, unless
+	// the operator gives one.
+	RetryAfter time.Duration `yaml:"retry_after"`
+}
+
+func (c MaintenanceConfig) validate() error {
+	if c.RetryAfter < time.Second {
+		return errors.New("maintenance.retry_after must be at least 1s")
+	}
+	return nil
+}
+
+// maintenanceMode is the maintenance in effect. It is immutable; a change
+// stores a new one.
+type maintenanceMode struct {
+	// All covers every issuer; otherwise Issuers lists those covered, by
+	// key.
+	All        bool            `json:"all"`
+	Issuers    []string        `json:"issuers,omitempty"`
+	covered    map[string]bool // Issuers, for lookups
+	RetryAfter time.Duration   `json:"-"`
+	Reason     string          `json:"reason,omitempty"`
+	Since      time.Time       `json:"since"`
+	// retryAfter is the Retry-After header value, in seconds.
+	retryAfter []string
+}
+
+// covers reports whether requests for the issuer key are in maintenance.
+func (m *maintenanceMode) covers(issuer string) bool {
+	return m != nil && (m.All || m.covered[issuer])
+}
+
+// maintenance holds the *maintenanceMode in effect, nil when there is
+// none, so the fast path checks it without locking. It survives
+// configuration reloads but not restarts.
+var maintenance atomic.Value
+
+func currentMaintenance() *maintenanceMode {
+	m, _ := maintenance.Load().(*maintenanceMode)
+	return m
+}
+
+// writeMaintenanceResponse answers tryLater with the Retry-After of m.
+func writeMaintenanceResponse(w http.ResponseWriter, m *maintenanceMode) {
+	w.Header()["Retry-After"] = m.retryAfter
+	writeOCSPResponse(w, tryLaterResponse)
+}
+
+// maintenanceStatus is what /admin/v1/maintenance and /healthz report.
+type maintenanceStatus struct {
+	*maintenanceMode
+	RetryAfterSeconds int `json:"retry_after_seconds"`
+}
+
+func currentMaintenanceStatus() *maintenanceStatus {
+	m := currentMaintenance()
+	if m == nil {
+		return nil
+	}
+	return &maintenanceStatus{maintenanceMode: m, RetryAfterSeconds: int(m.RetryAfter / time.Second)}
+}
+
+// maintenanceHandler serves POST /admin/v1/maintenance?mode=on|off, with
+// on for every issuer or, with issuer parameters, for those only, and
+// optionally retry_after and reason. It reports the maintenance in effect,
+// and only reports without mode.
+func maintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	if !requirePost(w, r) {
+		return
+	}
+	switch mode := r.FormValue("mode"); mode {
+	case "":
+	case "off":
+		if currentMaintenance() != nil {
+			maintenance.Store((*maintenanceMode)(nil))
+			log.Printf("maintenance: ended by the operator")
+		}
+	case "on":
+		st := currentState()
+		m := &maintenanceMode{All: true, RetryAfter: st.cfg.Maintenance.RetryAfter, Reason: r.FormValue("reason"), Since: time.Now().UTC()}
+		if v := r.FormValue("retry_after"); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d < time.Second {
+				http.Error(w, fmt.Sprintf("retry_after %q is not a duration of at least 1s", v), http.StatusBadRequest)
+				return
+			}
+			m.RetryAfter = d
+		}
+		m.retryAfter = []string{strconv.Itoa(int(m.RetryAfter / time.Second))}
+		if params := r.Form["issuer"]; len(params) > 0 {
+			m.All, m.covered = false, make(map[string]bool)
+			for _, param := range params {
+				crl, _, ok := st.findIssuer(param)
+				if !ok {
+					http.Error(w, fmt.Sprintf("no served issuer matches %q", param), http.StatusNotFound)
+					return
+				}
+				if !m.covered[crl.key()] {
+					m.covered[crl.key()] = true
+					m.Issuers = append(m.Issuers, crl.key())
+				}
+			}
+			sort.Strings(m.Issuers)
+		}
+		maintenance.Store(m)
+		scope := "every issuer"
+		if !m.All {
+			scope = strings.Join(m.Issuers, ", ")
+		}
+		if m.Reason != "" {
+			scope += " (" + m.Reason + ")"
+		}
+		log.Printf("maintenance: started by the operator for %s, retry after %v", scope, m.RetryAfter)
+	default:
+		http.Error(w, "mode must be on or off", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Maintenance *maintenanceStatus `json:"maintenance"`
+	}{currentMaintenanceStatus()})
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The build manifest maps each served CRL, by the SHA-256 of its file, to
+// the SHA-256 of the index built from it. Indexes are canonical (see
+// encodeIndex), whether held in memory or on disk, so nodes that loaded the
+// same CRLs publish the same manifest and any node, or an auditor with the
+// CRL files alone, can check that the others serve identical revocation
+// data. The bloom filters are left out: they only decide which lookups
+// reach the index.
+type manifest struct {
+	// Format is the index encoding the digests are taken over.
+	Format string `json:"format"`
+	// SHA256 digests the issuers' lines; see manifestDigest.
+	SHA256  string          `json:"sha256"`
+	Issuers []manifestEntry `json:"issuers"`
+}
+
+type manifestEntry struct {
+	Issuer string `json:"issuer"`
+	CRL    string `json:"crl_sha256"`
+	// Index is empty for a quarantined CRL, which serves nothing.
+	Index      string `json:"index_sha256,omitempty"`
+	Entries    int    `json:"entries"`
+	Quarantine string `json:"quarantine,omitempty"`
+	// CRLNumber and ThisUpdate tell which of two CRLs is newer; like the
+	// counts, they are left out of the digest.
+	CRLNumber  string     `json:"crl_number,omitempty"`
+	ThisUpdate *time.Time `json:"this_update,omitempty"`
+}
+
+// line is the entry's line in the manifest digest.
+func (e manifestEntry) line() string {
+	index := e.Index
+	if index == "" {
+		index = "-"
+	}
+	return e.Issuer + " " + e.CRL + " " + index + "\n"
+}
+
+// newManifest sorts entries by issuer and digests them.
+func newManifest(entries []manifestEntry) manifest {
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Issuer < entries[j].Issuer })
+	return manifest{Format: indexMagic, SHA256: manifestDigest(indexMagic, entries), Issuers: entries}
+}
+
+// manifestDigest is the SHA-256 of the format and one line per issuer,
+// "<issuer> <CRL SHA-256> <index SHA-256 or ->", in issuer order. The
+// quarantine reasons and entry counts are informative only.
+func manifestDigest(format string, entries []manifestEntry) string {
+	h := sha256.New()
+	h.Write([]byte(format + "\n"))
+	for _, e := range entries {
+		h.Write([]byte(e.line()))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// manifest describes the indexes of st.
+func (st *state) manifest() manifest {
+	entries := make([]manifestEntry, 0, len(st.crls))
+	for _, crl := range st.crls {
+		f := st.filters[crl.key()]
+		e := manifestEntry{
+			Issuer:     crl.key(),
+			CRL:        hex.EncodeToString(f.crlHash[:]),
+			Entries:    f.size(),
+			Quarantine: f.quarantine,
+		}
+		if f.quarantine == "" {
+			e.Index = hex.EncodeToString(f.indexHash[:])
+		}
+		if f.crlNumber != nil {
+			e.CRLNumber = f.crlNumber.String()
+		}
+		if !f.thisUpdate.IsZero() {
+			t := f.thisUpdate.UTC()
+			e.ThisUpdate = &t
+		}
+		entries = append(entries, e)
+	}
+	return newManifest(entries)
+}
+
+// manifestHandler serves GET /api/v1/manifest.
+func manifestHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	json.NewEncoder(w).Encode(currentState().manifest())
+}
+
+// cacheManifest builds the manifest of the CRLs in dir as a server would
+// index them, without their CAs: nothing is verified or quarantined.
+func cacheManifest(dir string) (manifest, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.crl"))
+	if err != nil {
+		return manifest{}, err
+	}
+	entries := make([]manifestEntry, 0, len(paths))
+	for _, path := range paths {
+		crlHash, err := hashFile(path)
+		if err != nil {
+			return manifest{}, err
+		}
+		scanned, err := scanCRLFile(path)
+		if err != nil {
+			return manifest{}, err
+		}
+		parsed := scanned.CertificateList
+		idx, err := encodeIndex(scanned, crlHash, nil)
+		if err != nil {
+			return manifest{}, err
+		}
+		indexHash := sha256.Sum256(idx)
+		e := manifestEntry{
+			Issuer:  CRLInfo{FileName: filepath.Base(path)}.key(),
+			CRL:     hex.EncodeToString(crlHash[:]),
+			Index:   hex.EncodeToString(indexHash[:]),
+			Entries: (len(idx) - indexHeaderSize) / indexRecordSize,
+		}
+		if n := crlNumber(parsed); n != nil {
+			e.CRLNumber = n.String()
+		}
+		thisUpdate := parsed.TBSCertList.ThisUpdate.UTC()
+		e.ThisUpdate = &thisUpdate
+		entries = append(entries, e)
+	}
+	return newManifest(entries), nil
+}
+
+var manifestClient = &http.Client{Timeout: 30 * time.Second}
+
+// fetchManifest returns the manifest a node serves.
+func fetchManifest(base string) (manifest, error) {
+	var m manifest
+	resp, err := manifestClient.Get(strings.TrimSuffix(base, "/") + "/api/v1/manifest")
+	if err != nil {
+		return m, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return m, fmt.Errorf("%s", resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&m); err != nil {
+		return m, err
+	}
+	// The digest is recomputed rather than trusted.
+	if sum := manifestDigest(m.Format, m.Issuers); sum != m.SHA256 {
+		return m, fmt.Errorf("manifest digest %s does not match its issuers (%s)", m.SHA256, sum)
+	}
+	return m, nil
+}
+
+// compareManifests lists how node differs from want for the issuers node
+// serves.
+func compareManifests(want, node manifest) []string {
+	var diffs []string
+	if node.Format != want.Format {
+		return []string{fmt.Sprintf("index format %s, want %s", node.Format, want.Format)}
+	}
+	byIssuer := make(map[string]manifestEntry, len(want.Issuers))
+	for _, e := range want.Issuers {
+		byIssuer[e.Issuer] = e
+	}
+	for _, e := range node.Issuers {
+		w, ok := byIssuer[e.Issuer]
+		switch {
+		case !ok:
+			diffs = append(diffs, fmt.Sprintf("%s: not in the reference", e.Issuer))
+		case e.CRL != w.CRL:
+			diffs = append(diffs, fmt.Sprintf("%s: CRL %s, want %s", e.Issuer, e.CRL, w.CRL))
+		case e.Quarantine != "":
+			diffs = append(diffs, fmt.Sprintf("%s: quarantined: %s", e.Issuer, e.Quarantine))
+		case e.Index != w.Index:
+			diffs = append(diffs, fmt.Sprintf("%s: index %s, want %s", e.Issuer, e.Index, w.Index))
+		}
+	}
+	return diffs
+}
+
+// manifestCommand prints the manifest of a CRL cache, or checks nodes
+// against it.
+func manifestCommand(args []string) int {
+	fs := flag.NewFlagSet("manifest", flag.ContinueOnError)
+	cache := fs.String("cache", rootDir, "CRL cache directory to build the reference manifest from")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: goocsp manifest [--cache dir] [node URL...]")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	want, err := cacheManifest(*cache)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "manifest:", err)
+		return 2
+	}
+	if fs.NArg() == 0 {
+		out, _ := json.MarshalIndent(want, "", "  ")
+		fmt.Println(string(out))
+		return 0
+	}
+
+	fmt.Printf("Reference:     %s (%d CRLs in %s)\n", want.SHA256, len(want.Issuers), *cache)
+	status := 0
+	for _, node := range fs.Args() {
+		m, err := fetchManifest(node)
+		if err != nil {
+			fmt.Printf("%s: ERROR: %v\n", node, err)
+			status = 1
+			continue
+		}
+		diffs := compareManifests(want, m)
+		if len(diffs) == 0 {
+			fmt.Printf("%s: MATCH %s\n", node, m.SHA256)
+			continue
+		}
+		status = 1
+		fmt.Printf("%s: DIFFERS %s\n", node, m.SHA256)
+		for _, d := range diffs {
+			fmt.Printf("  %s\n", d)
+		}
+	}
+	return status
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkkemp/GoOCSPResponder/responder"
+)
+
+// SignerMigrationConfig is the key a responder migrates to, for example
+// from RSA to ECDSA. While it is configured every cached response is
+// signed with both keys, so switching which one is served, or switching
+// back when relying parties fail to validate the new one, takes effect on
+// the next request without signing anything.
+type SignerMigrationConfig struct {
+	Cert string `yaml:"cert"`
+	Key  string `yaml:"key"`
+	// ServeFrom serves responses signed with the new key from this time
+	// on. Zero leaves it to POST /admin/v1/signer and client hints.
+	ServeFrom time.Time `yaml:"serve_from"`
+	// Hints lets a client choose the key with the preferred signature
+	// algorithms request extension (RFC 6960 section 4.4.7).
+	Hints bool `yaml:"hints"`
+}
+
+func (c SignerMigrationConfig) validate(signer SignerConfig) error {
+	if (c.Cert == "") != (c.Key == "") {
+		return errors.New("signer.next.cert and signer.next.key must be set together")
+	}
+	if c.Cert != "" && signer.Cert == "" {
+		return errors.New("signer.next requires signer.cert")
+	}
+	return nil
+}
+
+// Which key is served, as set through the admin API. It survives reloads.
+const (
+	serveScheduled int32 = iota
+	serveCurrent
+	serveNext
+)
+
+var signerOverride int32
+
+var serveNames = map[int32]string{serveScheduled: "schedule", serveCurrent: "current", serveNext: "next"}
+
+// servingNext reports whether responses signed with the next key are
+// served to clients that expressed no preference.
+func (st *state) servingNext(now time.Time) bool {
+	if st.nextSigner == nil {
+		return false
+	}
+	switch atomic.LoadInt32(&signerOverride) {
+	case serveCurrent:
+		return false
+	case serveNext:
+		return true
+	}
+	from := st.cfg.Signer.Next.ServeFrom
+	return !from.IsZero() && !now.Before(from)
+}
+
+// signerFor returns the key to answer req with. With hints enabled, the
+// first algorithm the client prefers that one of the keys signs with
+// decides.
+func (st *state) signerFor(req *responder.Request, now time.Time) *responder.Signer {
+	if st.nextSigner != nil && st.cfg.Signer.Next.Hints {
+		for _, algo := range req.PreferredSignatureAlgorithms() {
+			switch algo {
+			case st.signer.SignatureAlgorithm():
+				return st.signer
+			case st.nextSigner.SignatureAlgorithm():
+				return st.nextSigner
+			}
+		}
+	}
+	if st.servingNext(now) {
+		return st.nextSigner
+	}
+	return st.signer
+}
+
+// signerStatus is the state of a key migration, as returned by
+// /admin/v1/signer.
+type signerStatus struct {
+	Current   string     `json:"current"`
+	Next      string     `json:"next,omitempty"`
+	Serve     string     `json:"serve"`
+	ServeFrom *time.Time `json:"serve_from,omitempty"`
+	Serving   string     `json:"serving"`
+	// Unauthorized are the issuers the keys may not sign for, with why;
+	// see delegation.go.
+	Unauthorized map[string]string `json:"unauthorized,omitempty"`
+}
+
+func currentSignerStatus(st *state) signerStatus {
+	s := signerStatus{Serve: serveNames[atomic.LoadInt32(&signerOverride)], Serving: "current"}
+	if st.signer != nil {
+		s.Current = st.signer.SignatureAlgorithm().String()
+	}
+	if st.nextSigner != nil {
+		s.Next = st.nextSigner.SignatureAlgorithm().String()
+		if from := st.cfg.Signer.Next.ServeFrom; !from.IsZero() {
+			s.ServeFrom = &from
+		}
+	}
+	if st.servingNext(time.Now()) {
+		s.Serving = "next"
+	}
+	if u := st.signerAuthorization(time.Now()); len(u) > 0 {
+		s.Unauthorized = u
+	}
+	return s
+}
+
+// signerHandler serves POST /admin/v1/signer?serve=current|next|schedule,
+// which overrides the migration schedule, and reports which key is served.
+// Without serve it only reports.
+func signerHandler(w http.ResponseWriter, r *http.Request) {
+	if !requirePost(w, r) {
+		return
+	}
+	if serve := r.FormValue("serve"); serve != "" {
+		var mode int32 = -1
+		for m, name := range serveNames {
+			if name == serve {
+				mode = m
+			}
+		}
+		if mode < 0 {
+			http.Error(w, "serve must be current, next or schedule", http.StatusBadRequest)
+			return
+		}
+		if mode == serveNext && currentState().nextSigner == nil {
+			http.Error(w, "no signer.next is configured", http.StatusConflict)
+			return
+		}
+		atomic.StoreInt32(&signerOverride, mode)
+		log.Printf("signer: serve set to %s by the operator", serve)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(currentSignerStatus(currentState()))
+}
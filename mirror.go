@@ -0,0 +1,226 @@
+package main
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MirrorCheckConfig cross-checks the CRLs downloaded from crl_base_url,
+// typically a mirror, against the CAs' authoritative distribution points.
+// Each CRL is fetched from both; their CRL numbers and entries are
+// compared, divergence is alerted on, and the authoritative copy is served
+// whenever it verifies, so a stale or tampered mirror is caught and
+// bypassed.
+type MirrorCheckConfig struct {
+	// AuthoritativeBaseURL is where the CAs publish their CRLs, by file
+	// name, such as http://crl.disa.mil/crl.
+	AuthoritativeBaseURL string `yaml:"authoritative_base_url"`
+	// URLs overrides the authoritative URL per CRL name (DODEMAILCA_63).
+	URLs map[string]string `yaml:"urls"`
+}
+
+func (c MirrorCheckConfig) enabled() bool {
+	return c.AuthoritativeBaseURL != "" || len(c.URLs) > 0
+}
+
+func (c MirrorCheckConfig) validate() error {
+	urls := []string{c.AuthoritativeBaseURL}
+	for _, u := range c.URLs {
+		urls = append(urls, u)
+	}
+	for _, u := range urls {
+		if u == "" {
+			continue
+		}
+		if parsed, err := url.Parse(u); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+			return fmt.Errorf("mirror_check: %q must be an http(s) URL", u)
+		}
+	}
+	return nil
+}
+
+// authoritativeURL returns the distribution point of the CRL named
+// fileName, or "" if none is configured.
+func (c MirrorCheckConfig) authoritativeURL(fileName string) string {
+	if u, ok := c.URLs[strings.TrimSuffix(fileName, ".crl")]; ok {
+		return u
+	}
+	if c.AuthoritativeBaseURL == "" {
+		return ""
+	}
+	return strings.TrimSuffix(c.AuthoritativeBaseURL, "/") + "/" + fileName
+}
+
+// mirrorComparison is the outcome of the last check of one CRL.
+type mirrorComparison struct {
+	CheckedAt     time.Time `json:"checked_at"`
+	Mirror        string    `json:"mirror"`
+	Authoritative string    `json:"authoritative"`
+	// Served is which copy was installed: authoritative or mirror.
+	Served              string `json:"served"`
+	MirrorNumber        string `json:"mirror_number,omitempty"`
+	AuthoritativeNumber string `json:"authoritative_number,omitempty"`
+	// MissingFromMirror are revoked serials the authoritative CRL lists
+	// and the mirror does not; ExtraInMirror the reverse.
+	MissingFromMirror []string `json:"missing_from_mirror,omitempty"`
+	ExtraInMirror     []string `json:"extra_in_mirror,omitempty"`
+	// Problems describes every divergence found; empty means the copies
+	// agree.
+	Problems []string `json:"problems"`
+}
+
+// maxListedSerials bounds the serials listed in a comparison.
+const maxListedSerials = 100
+
+// mirrorChecks holds the last comparison per CRL name.
+var mirrorChecks = struct {
+	sync.Mutex
+	last map[string]*mirrorComparison
+}{last: make(map[string]*mirrorComparison)}
+
+// checkMirror fetches the authoritative copy of the CRL just downloaded
+// from the mirror as info, compares the two and installs the
+// authoritative one in the cache if it verifies. It returns the CRLInfo of
+// the copy now cached.
+func checkMirror(cfg *Config, ca *x509.Certificate, info CRLInfo) CRLInfo {
+	src := cfg.MirrorCheck.authoritativeURL(info.FileName)
+	if src == "" {
+		return info
+	}
+	key := strings.TrimSuffix(info.FileName, ".crl")
+	cmp := &mirrorComparison{CheckedAt: time.Now().UTC(), Mirror: info.FetchedFrom, Authoritative: src, Served: "mirror", Problems: []string{}}
+	defer func() {
+		mirrorChecks.Lock()
+		mirrorChecks.last[key] = cmp
+		mirrorChecks.Unlock()
+		for _, p := range cmp.Problems {
+			alert(cfg, "mirror check %s: %s", key, p)
+		}
+	}()
+
+	mirror, err := parseCRL(info.FileName)
+	if err != nil {
+		cmp.Problems = append(cmp.Problems, fmt.Sprintf("mirror copy: %v", err))
+		return info
+	}
+	dpFile := info.FileName + ".dp"
+	auth, err := downloadTo(cfg, src, dpFile)
+	if err != nil {
+		cmp.Problems = append(cmp.Problems, fmt.Sprintf("authoritative copy: %v", err))
+		return info
+	}
+	defer os.Remove(rootDir + dpFile)
+	authCRL, err := parseCRL(dpFile)
+	if err != nil {
+		cmp.Problems = append(cmp.Problems, fmt.Sprintf("authoritative copy: %v", err))
+		return info
+	}
+	crl := CRLInfo{CA: ca, FileName: info.FileName}
+	if reason := quarantineReason(cfg, crl, authCRL); reason != "" {
+		cmp.Problems = append(cmp.Problems, "authoritative copy: "+reason)
+		return info
+	}
+	if reason := quarantineReason(cfg, crl, mirror); reason != "" {
+		cmp.Problems = append(cmp.Problems, "mirror copy: "+reason)
+	}
+	compareCRLs(cmp, mirror, authCRL)
+
+	if err := os.Rename(rootDir+dpFile, rootDir+info.FileName); err != nil {
+		cmp.Problems = append(cmp.Problems, fmt.Sprintf("installing the authoritative copy: %v", err))
+		return info
+	}
+	cmp.Served = "authoritative"
+	auth.FileName = info.FileName
+	return auth
+}
+
+// compareCRLs records how mirror diverges from auth in cmp. A mirror with
+// an older CRL number is stale; entries of the authoritative CRL missing
+// from the mirror are divergence either way, since revocations are only
+// dropped from CRLs once the certificate has expired.
+func compareCRLs(cmp *mirrorComparison, mirror, auth *pkix.CertificateList) {
+	mn, an := crlNumber(mirror), crlNumber(auth)
+	if mn != nil {
+		cmp.MirrorNumber = mn.String()
+	}
+	if an != nil {
+		cmp.AuthoritativeNumber = an.String()
+	}
+	switch {
+	case mn == nil || an == nil:
+		if !mirror.TBSCertList.ThisUpdate.Equal(auth.TBSCertList.ThisUpdate) {
+			cmp.Problems = append(cmp.Problems, fmt.Sprintf("mirror CRL issued %s, authoritative %s",
+				mirror.TBSCertList.ThisUpdate.UTC().Format(time.RFC3339), auth.TBSCertList.ThisUpdate.UTC().Format(time.RFC3339)))
+		}
+	case mn.Cmp(an) < 0:
+		cmp.Problems = append(cmp.Problems, fmt.Sprintf("mirror is stale: CRL number %s, authoritative %s", mn, an))
+	case mn.Cmp(an) > 0:
+		cmp.Problems = append(cmp.Problems, fmt.Sprintf("mirror is ahead of the distribution point: CRL number %s, authoritative %s", mn, an))
+	}
+
+	mirrored := revokedSerials(mirror)
+	authoritative := revokedSerials(auth)
+	cmp.MissingFromMirror = serialDifference(authoritative, mirrored)
+	cmp.ExtraInMirror = serialDifference(mirrored, authoritative)
+	if len(cmp.MissingFromMirror) > 0 {
+		cmp.Problems = append(cmp.Problems, fmt.Sprintf("mirror is missing %d revocations of the authoritative CRL", countDifference(authoritative, mirrored)))
+	}
+	if mn != nil && an != nil && mn.Cmp(an) == 0 && len(cmp.ExtraInMirror) > 0 {
+		cmp.Problems = append(cmp.Problems, fmt.Sprintf("mirror lists %d revocations the authoritative CRL with the same number does not", countDifference(mirrored, authoritative)))
+	}
+}
+
+func revokedSerials(crl *pkix.CertificateList) map[string]*big.Int {
+	serials := make(map[string]*big.Int, len(crl.TBSCertList.RevokedCertificates))
+	for _, rc := range crl.TBSCertList.RevokedCertificates {
+		serials[string(rc.SerialNumber.Bytes())] = rc.SerialNumber
+	}
+	return serials
+}
+
+// serialDifference lists, in hex and sorted, up to maxListedSerials
+// serials of a that are not in b.
+func serialDifference(a, b map[string]*big.Int) []string {
+	var diff []string
+	for k, serial := range a {
+		if _, ok := b[k]; !ok {
+			diff = append(diff, fmt.Sprintf("%x", serial))
+		}
+	}
+	sort.Strings(diff)
+	if len(diff) > maxListedSerials {
+		diff = diff[:maxListedSerials]
+	}
+	return diff
+}
+
+func countDifference(a, b map[string]*big.Int) int {
+	n := 0
+	for k := range a {
+		if _, ok := b[k]; !ok {
+			n++
+		}
+	}
+	return n
+}
+
+// mirrorCheckHandler serves /admin/v1/mirror-check, the last comparison of
+// each CRL.
+func mirrorCheckHandler(w http.ResponseWriter, r *http.Request) {
+	mirrorChecks.Lock()
+	defer mirrorChecks.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(mirrorChecks.last)
+}
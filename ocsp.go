@@ -0,0 +1,474 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"errors"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkkemp/GoOCSPResponder/responder"
+)
+
+// maxRequestSize bounds the body of an OCSP request.
+const maxRequestSize = responder.MaxRequestSize
+
+// issuerFor returns the index of the CA the CertID was computed from, by
+// its precomputed hashes under any supported algorithm, or under
+// cert_id.lenient_name_hash by its key hash alone.
+func (st *state) issuerFor(id responder.CertID) (CRLBloomFilter, bool) {
+	if st.issuers != nil {
+		key, ok := st.strictIssuer(id)
+		if !ok {
+			if key, ok = st.lenientIssuer(id); !ok {
+				return CRLBloomFilter{}, false
+			}
+		}
+		f, ok := st.filters[key]
+		return f, ok
+	}
+	for _, crl := range st.crls {
+		if id.MatchesIssuer(crl.CA) {
+			f, ok := st.filters[crl.key()]
+			return f, ok
+		}
+	}
+	return CRLBloomFilter{}, false
+}
+
+// lookup is the outcome of checking one serial against a CRL index.
+type lookup struct {
+	// bloomChecked is false for serials the 64-bit filter cannot
+	// represent, and for issuers without a filter; those always go to the
+	// exact lookup.
+	bloomChecked bool
+	bloomHit     bool
+	revoked      bool
+	entry        responder.Entry
+}
+
+// lookup screens serial with the bloom filter, which rules out the common
+// good case, and confirms possible hits against the exact entries. An
+// on-disk index is searched directly.
+func (f CRLBloomFilter) lookup(serial *big.Int) lookup {
+	var l lookup
+	if f.quarantine != "" {
+		return l
+	}
+	if f.disk != nil {
+		l.entry, l.revoked = f.disk.lookup(serial)
+		return l
+	}
+	if f.Filter != nil && serial.Sign() >= 0 && serial.BitLen() <= 64 {
+		l.bloomChecked = true
+		l.bloomHit = findItemBloom(serial.Uint64(), f.Filter)
+	}
+	if !l.bloomChecked || l.bloomHit {
+		l.entry, l.revoked = f.entries.lookup(serial)
+	}
+	return l
+}
+
+// policyHook may override the status derived from a CRL, for example to
+// force a serial to revoked. It reports whether it changed single.
+type policyHook struct {
+	name  string
+	apply func(f CRLBloomFilter, single *responder.SingleResponse) bool
+}
+
+// policyHooks run in order after the CRL lookup for every answered CertID.
+var policyHooks []policyHook
+
+// decision is a single response together with how it was reached.
+type decision struct {
+	single responder.SingleResponse
+	lookup lookup
+	// hooks names the policy hooks that changed the response.
+	hooks []string
+}
+
+// decide answers one CertID from the index and applies the policy hooks.
+// CertIDs of a quarantined CRL are answered unknown, never good.
+func (f CRLBloomFilter) decide(id responder.CertID) decision {
+	d := decision{
+		single: responder.SingleResponse{
+			CertID:     id,
+			Status:     responder.Good,
+			ThisUpdate: f.thisUpdate,
+			NextUpdate: f.answersNextUpdate(),
+		},
+		lookup: f.lookup(id.SerialNumber),
+	}
+	if f.quarantine != "" {
+		d.single.Status = responder.Unknown
+	}
+	// The CrlID is shared by every answer of f; the capacity makes
+	// appending to it copy.
+	d.single.Extensions = f.crlID[:len(f.crlID):len(f.crlID)]
+	if d.lookup.revoked {
+		d.single.Status = responder.Revoked
+		d.single.RevokedAt = d.lookup.entry.RevokedAt
+		d.single.RevocationReason = d.lookup.entry.Reason
+		d.single.Extensions = append(d.lookup.entry.SingleExtensions(), f.crlID...)
+	}
+	for _, h := range policyHooks {
+		if h.apply(f, &d.single) {
+			d.hooks = append(d.hooks, h.name)
+		}
+	}
+	return d
+}
+
+// strictIssuer returns the CRL key of the issuer whose name and key
+// hashes id carries.
+func (st *state) strictIssuer(id responder.CertID) (string, bool) {
+	var buf [1 + 2*64]byte
+	key, ok := st.issuers[string(appendCertIDKey(buf[:0], id.HashAlgorithm, id.NameHash, id.KeyHash))]
+	return key, ok
+}
+
+// lenientIssuer returns the CRL key of the issuer whose key hash id
+// carries, under cert_id.lenient_name_hash.
+func (st *state) lenientIssuer(id responder.CertID) (string, bool) {
+	if !st.cfg.CertID.LenientNameHash || len(id.KeyHash) > 64 {
+		return "", false
+	}
+	var buf [1 + 64]byte
+	b := append(append(buf[:0], byte(id.HashAlgorithm)), id.KeyHash...)
+	key := st.keyHashes[string(b)]
+	return key, key != ""
+}
+
+// status answers one CertID from the index.
+func (f CRLBloomFilter) status(id responder.CertID) responder.SingleResponse {
+	return f.decide(id).single
+}
+
+// liveIndex is the index of the state in effect, for responder.Checker.
+type liveIndex struct{}
+
+// Lookup answers id as the slow path does before signing.
+func (liveIndex) Lookup(_ context.Context, id responder.CertID) (responder.SingleResponse, error) {
+	st := currentState()
+	f, ok := st.issuerFor(id)
+	if !ok {
+		return responder.SingleResponse{}, responder.ErrUnknownIssuer
+	}
+	if f.quarantine != "" && (st.cfg.Quarantine.Answer != "unknown" || f.pending) {
+		return responder.SingleResponse{}, responder.ErrTryLater
+	}
+	return f.status(id), nil
+}
+
+// checker checks certificates against the index without OCSP.
+var checker = responder.NewChecker(liveIndex{})
+
+// Error responses are fixed, so they are encoded once.
+var (
+	malformedResponse = responder.ErrorResponse(responder.MalformedRequest)
+	internalResponse  = responder.ErrorResponse(responder.InternalError)
+	tryLaterResponse  = responder.ErrorResponse(responder.TryLater)
+	unauthResponse    = responder.ErrorResponse(responder.Unauthorized)
+)
+
+// ocspResponseType is shared by all responses so setting it does not
+// allocate.
+var ocspResponseType = []string{"application/ocsp-response"}
+
+func writeOCSPResponse(w http.ResponseWriter, der []byte) {
+	w.Header()["Content-Type"] = ocspResponseType
+	setRegionHeaders(w.Header())
+	w.Write(der)
+}
+
+var errRequestTooLarge = errors.New("OCSP request too large")
+
+// bodyPool holds request buffers, one byte larger than the largest
+// accepted request so an oversized one can be told apart.
+var bodyPool = sync.Pool{New: func() interface{} {
+	b := make([]byte, maxRequestSize+1)
+	return &b
+}}
+
+// readBody reads all of r into buf.
+func readBody(r io.Reader, buf []byte) ([]byte, error) {
+	n, err := io.ReadFull(r, buf)
+	switch err {
+	case nil:
+		return nil, errRequestTooLarge
+	case io.EOF, io.ErrUnexpectedEOF:
+		return buf[:n], nil
+	}
+	return nil, err
+}
+
+// ocspHandler answers a DER OCSP request posted as the request body, to
+// the root path or a route, or sent base64 encoded in the path of a GET
+// (RFC 6960 appendix A.1). The fast path serves a pre-signed response from
+// the cache without locks or allocations; everything else goes to the slow
+// path. Each request is counted under the class of its client, and
+// answered tryLater when the class is over its rate limit or its issuer is
+// in maintenance.
+func ocspHandler(w http.ResponseWriter, r *http.Request) {
+	if standbyPassive() {
+		http.Error(w, "standby", http.StatusServiceUnavailable)
+		return
+	}
+	start := time.Now()
+	var body []byte
+	if captures.enabled() {
+		cw := &captureWriter{ResponseWriter: w}
+		w = cw
+		defer func() { captureExchange(r, body, cw, start) }()
+	}
+	st := currentState()
+	var only, enc string
+	if r.Method == http.MethodGet {
+		only, enc = st.routeGET(r.URL.Path)
+	} else {
+		var ok bool
+		if only, ok = st.route(r.URL.Path); !ok {
+			http.NotFound(w, r)
+			return
+		}
+	}
+	class := st.clients.classify(r)
+	if !class.allow(start) {
+		writeOCSPResponse(w, tryLaterResponse)
+		class.stats.record(outcomeLimited, 0, time.Since(start))
+		return
+	}
+	m := currentMaintenance()
+	if m != nil && m.All {
+		writeMaintenanceResponse(w, m)
+		class.stats.record(outcomeMaintenance, 0, time.Since(start))
+		return
+	}
+	bufp := bodyPool.Get().(*[]byte)
+	defer bodyPool.Put(bufp)
+	var err error
+	if r.Method == http.MethodGet {
+		body, err = responder.DecodeGET(enc, *bufp)
+	} else {
+		body, err = readBody(r.Body, *bufp)
+	}
+	if err == nil && len(body) > 0 && body[0] == '{' {
+		// JSON sent to an OCSP path rather than to the API.
+		http.Error(w, "OCSP requests are DER ("+ocspRequestType+"); the JSON API is under /api/", http.StatusUnsupportedMediaType)
+		class.stats.record(outcomeRejected, len(body), time.Since(start))
+		return
+	}
+	if err != nil {
+		writeOCSPResponse(w, malformedResponse)
+		class.stats.record(outcomeRejected, 0, time.Since(start))
+		return
+	}
+	if st.cfg.Cache.Prewarm > 0 {
+		requestFreq.add(body)
+	}
+	if flags := st.requestFlags(r); flags != 0 {
+		st.flaggedPath(w, body, only, flags)
+		class.stats.record(outcomeSlow, len(body), time.Since(start))
+		return
+	}
+	if e := st.cache.get(body, only, start); e != nil {
+		if m.covers(e.issuer) {
+			writeMaintenanceResponse(w, m)
+			class.stats.record(outcomeMaintenance, len(body), time.Since(start))
+			return
+		}
+		writeOCSPResponse(w, e.response(st.servingNext(start)))
+		class.stats.record(outcomeCached, len(body), time.Since(start))
+		return
+	}
+	st.slowPath(w, body, only)
+	class.stats.record(outcomeSlow, len(body), time.Since(start))
+}
+
+// acquireSlow takes a slow path slot, waiting at most the configured time.
+func (st *state) acquireSlow() bool {
+	select {
+	case st.slow <- struct{}{}:
+		return true
+	default:
+	}
+	timer := time.NewTimer(st.cfg.Cache.SlowPathWait)
+	defer timer.Stop()
+	select {
+	case st.slow <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// slowPath answers a cache miss: the request is parsed, answered from the
+// index and signed, with at most cache.slow_path_concurrency misses in
+// flight, and the response is cached when it can be reused. A non-empty
+// only restricts the answer to that issuer.
+func (st *state) slowPath(w http.ResponseWriter, body []byte, only string) {
+	now := time.Now()
+	if e := st.cache.getDirty(body, only, now); e != nil {
+		if m := currentMaintenance(); m.covers(e.issuer) {
+			writeMaintenanceResponse(w, m)
+			return
+		}
+		writeOCSPResponse(w, e.response(st.servingNext(now)))
+		return
+	}
+	req, err := responder.ParseRequest(body)
+	if err != nil {
+		writeOCSPResponse(w, malformedResponse)
+		return
+	}
+	st.respond(w, body, req, only, 0, now)
+}
+
+// respond answers a parsed request and signs the response, within the
+// slow path concurrency limit. The response is cached under body when it
+// can be reused; a nil body is never cached. CertIDs of issuers other than
+// a non-empty only are answered unauthorized, as for unknown issuers.
+// During a key migration cached responses are signed with both keys.
+// Concurrent identical requests that can be cached are coalesced: one is
+// answered and signed, and the others wait for its response. Requests for
+// issuers in maintenance are answered tryLater. flags route the request
+// through experimental code paths; see RequestFlagsConfig.
+func (st *state) respond(w http.ResponseWriter, body []byte, req *responder.Request, only string, flags flagSet, now time.Time) {
+	if m := currentMaintenance(); m != nil {
+		for _, id := range req.CertIDs {
+			if f, ok := st.issuerFor(id); ok && m.covers(f.crlInfo.key()) {
+				writeMaintenanceResponse(w, m)
+				return
+			}
+		}
+	}
+	key, ok := coalesceKey(body, req, only)
+	if !ok {
+		der, _ := st.sign(body, req, only, flags, now)
+		if flags != 0 {
+			countFlagged(flags, der, time.Since(now))
+		}
+		writeOCSPResponse(w, der)
+		return
+	}
+	der, e, shared := st.cache.flights.do(key, func() ([]byte, *cachedResponse) {
+		return st.sign(body, req, only, 0, now)
+	})
+	if shared && e != nil && st.cache.peek(body, now) == nil {
+		// The leader cached the response under its own request, which was
+		// encoded differently.
+		st.cache.put(body, e, now)
+	}
+	writeOCSPResponse(w, der)
+}
+
+// sign answers req, signs the response and caches it when it can be
+// reused; see respond. It returns the response to send and the cache
+// entry, if any.
+func (st *state) sign(body []byte, req *responder.Request, only string, flags flagSet, now time.Time) ([]byte, *cachedResponse) {
+	if st.signer == nil {
+		return unauthResponse, nil
+	}
+	if !st.acquireSlow() {
+		return tryLaterResponse, nil
+	}
+	defer func() { <-st.slow }()
+
+	tmpl := &responder.ResponseTemplate{ProducedAt: now, Extensions: region.extensions}
+	// Responses carrying request-specific extensions such as a nonce, or
+	// derived from several CRLs, are not reused.
+	cacheable := body != nil && len(req.Extensions) == 0
+	expires := now.Add(st.cache.ttl)
+	var issuer string
+	var number *big.Int
+	var cas []*x509.Certificate
+	for _, id := range req.CertIDs {
+		f, ok := st.issuerFor(id)
+		if ok && st.cfg.CertID.LenientNameHash {
+			if _, strict := st.strictIssuer(id); !strict {
+				countLenientMatch(f.crlInfo.key(), id, now)
+			}
+		}
+		if !ok {
+			recordUnknownIssuer(id, now)
+			if st.cfg.Discovery.Enabled {
+				requestDiscovery(st.cfg, id, now)
+			}
+		}
+		if !ok || (only != "" && f.crlInfo.key() != only) {
+			return unauthResponse, nil
+		}
+		if f.quarantine != "" {
+			if st.cfg.Quarantine.Answer != "unknown" || f.pending {
+				return tryLaterResponse, nil
+			}
+			cacheable = false
+		}
+		if st.unauthorizedExpired(f, id, now) {
+			return unauthResponse, nil
+		}
+		if flags&flagExactLookup != 0 {
+			f.Filter = nil
+		}
+		single := f.status(id)
+		tmpl.Responses = append(tmpl.Responses, single)
+		cas = append(cas, f.crlInfo.CA)
+		if issuer != "" && issuer != f.crlInfo.key() {
+			cacheable = false
+		}
+		issuer, number = f.crlInfo.key(), f.crlNumber
+		if single.NextUpdate.Before(expires) {
+			expires = single.NextUpdate
+		}
+	}
+	signer := st.signerFor(req, now)
+	if flags&flagNextSigner != 0 {
+		signer = st.nextSigner
+	}
+	if cacheable && st.nextSigner != nil {
+		// Both keys sign below; the one served is picked from the entry.
+		signer = st.signer
+	}
+	der, err := signResponse(tmpl, signer, cas)
+	if err != nil {
+		log.Printf("ocsp: %v", err)
+		return internalResponse, nil
+	}
+	if !cacheable || !expires.After(now) {
+		return der, nil
+	}
+	e := &cachedResponse{der: der, expires: expires, issuer: issuer, crlNumber: number}
+	if st.nextSigner != nil {
+		if e.next, err = signResponse(tmpl, st.nextSigner, cas); err != nil {
+			log.Printf("ocsp: next signer: %v", err)
+			return internalResponse, nil
+		}
+		der = e.response(st.servingNext(now))
+	}
+	st.cache.put(body, e, now)
+	standbyStreams.publishResponse(st, body, e)
+	return der, e
+}
+
+// signResponse signs tmpl with signer, including the signer's certificate
+// when it is not the CA of every answered CertID.
+func signResponse(tmpl *responder.ResponseTemplate, signer *responder.Signer, cas []*x509.Certificate) ([]byte, error) {
+	t := *tmpl
+	t.Certificates = nil
+	for _, ca := range cas {
+		if !bytes.Equal(ca.Raw, signer.Cert.Raw) {
+			t.Certificates = []*x509.Certificate{signer.Cert}
+			break
+		}
+	}
+	der, err := responder.CreateResponse(&t, signer)
+	if err == nil {
+		produced.record(der, t.ProducedAt)
+	}
+	return der, err
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pkkemp/GoOCSPResponder/responder"
+)
+
+func TestOCSPPost(t *testing.T) {
+	newReq := benchState(t, defaultConfig().Cache)
+	st := currentState()
+	key := st.crls[0].key()
+	revokedAt := time.Now().Add(-time.Hour).UTC().Truncate(time.Second)
+	f := st.filters[key]
+	f.entries = newArenaIndex([]responder.Entry{{Serial: big.NewInt(0x666), RevokedAt: revokedAt, Reason: 1}})
+	addItemToBloom(0x666, f.Filter)
+	st.filters[key] = f
+
+	post := func(path string, body []byte) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(body))
+		r.Header.Set("Content-Type", "application/ocsp-request")
+		w := httptest.NewRecorder()
+		ocspHandler(w, r)
+		return w
+	}
+	answer := func(body []byte) *responder.Response {
+		t.Helper()
+		w := post("/", body)
+		if ct := w.Header().Get("Content-Type"); w.Code != http.StatusOK || ct != "application/ocsp-response" {
+			t.Fatalf("answered %d, %s", w.Code, ct)
+		}
+		resp, err := responder.ParseResponse(w.Body.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	// -0x666 is not the revoked 0x666, which the index holds as its
+	// magnitude.
+	for serial, want := range map[int64]responder.Status{0x1001: responder.Good, 0x666: responder.Revoked, -0x666: responder.Good} {
+		resp := answer(newReq(serial))
+		if resp.Status != responder.Successful || len(resp.Responses) != 1 {
+			t.Fatalf("%#x: answered %v with %d responses", serial, resp.Status, len(resp.Responses))
+		}
+		if err := resp.CheckSignatureFrom(st.signer.Cert); err != nil {
+			t.Errorf("%#x: %v", serial, err)
+		}
+		single := resp.Responses[0]
+		if single.SerialNumber.Int64() != serial || single.Status != want {
+			t.Errorf("%#x: answered %#x %v, want %v", serial, single.SerialNumber, single.Status, want)
+		}
+		if want == responder.Revoked && (!single.RevokedAt.Equal(revokedAt) || single.RevocationReason != 1) {
+			t.Errorf("%#x: revoked at %v for %d, want %v for 1", serial, single.RevokedAt, single.RevocationReason, revokedAt)
+		}
+	}
+
+	// A CertID of an issuer not served is not this responder's to answer.
+	other, err := responder.CreateRequest(responder.CertID{
+		HashAlgorithm: crypto.SHA1,
+		NameHash:      bytes.Repeat([]byte{1}, 20),
+		KeyHash:       bytes.Repeat([]byte{2}, 20),
+		SerialNumber:  big.NewInt(0x1001),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp := answer(other); resp.Status != responder.Unauthorized {
+		t.Errorf("unknown issuer answered %v, want unauthorized", resp.Status)
+	}
+
+	for name, body := range map[string][]byte{
+		"empty":     nil,
+		"not DER":   []byte("Certificate Revoked?"),
+		"truncated": newReq(0x1001)[:20],
+		"too large": bytes.Repeat([]byte{0x30}, maxRequestSize+1),
+	} {
+		if resp := answer(body); resp.Status != responder.MalformedRequest {
+			t.Errorf("%s: answered %v, want malformedRequest", name, resp.Status)
+		}
+	}
+	if w := post("/", []byte(`{"serial": "0x1001"}`)); w.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("JSON answered %d, want 415", w.Code)
+	}
+	if w := post("/no-such-route", newReq(0x1001)); w.Code != http.StatusNotFound {
+		t.Errorf("unrouted path answered %d, want 404", w.Code)
+	}
+}
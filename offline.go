@@ -0,0 +1,384 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkkemp/GoOCSPResponder/responder"
+)
+
+// OfflineImportConfig sets up the sneakernet path into air-gapped
+// enclaves: goocsp sign-media signs a directory of CRLs and the CA bundle
+// on the connected side, and goocsp import installs it into the cache of
+// an offline responder once every file checks out against the signature.
+type OfflineImportConfig struct {
+	// TrustStore is a PEM file of the certificates media signers must
+	// chain to.
+	TrustStore string `yaml:"trust_store"`
+}
+
+const (
+	// mediaManifestFile lists the files of the media with their digests;
+	// mediaSignatureFile is its detached JWS.
+	mediaManifestFile  = "media.json"
+	mediaSignatureFile = "media.json.jws"
+	// mediaType is the JWS typ of a media signature.
+	mediaType = "goocsp-media+json"
+	// importRecordFile in the cache records the last import.
+	importRecordFile = "offline-import.json"
+	// mediaSkew is how far in the future media may have been created.
+	mediaSkew = 5 * time.Minute
+)
+
+// mediaManifest is the signed description of offline media.
+type mediaManifest struct {
+	// CreatedAt orders media; older media than the last imported are
+	// refused, so a captured set cannot be replayed to roll CRLs back.
+	CreatedAt int64       `json:"created_at"`
+	Files     []mediaFile `json:"files"`
+	// Snapshot is the digest of the build manifest of the CRLs, which an
+	// imported node serves at /api/v1/manifest once it loaded them.
+	Snapshot string `json:"snapshot_sha256"`
+}
+
+type mediaFile struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// importRecord is what an import leaves in the cache and reports.
+type importRecord struct {
+	CreatedAt  time.Time `json:"created_at"`
+	ImportedAt time.Time `json:"imported_at"`
+	Signer     string    `json:"signer"`
+	Snapshot   string    `json:"snapshot_sha256"`
+	Files      []string  `json:"files"`
+}
+
+// mediaFileAllowed reports whether name may travel on media: the bundle,
+// the issuer registry and CRLs, never paths or anything else.
+func mediaFileAllowed(name string) bool {
+	if name == "" || filepath.Base(name) != name || strings.HasPrefix(name, ".") {
+		return false
+	}
+	return name == bundleFile() || name == issuerRegistryFile || strings.HasSuffix(name, ".crl")
+}
+
+// detachJWS turns a compact JWS into its detached form, header..signature,
+// so the payload travels as the file it signs.
+func detachJWS(token string) string {
+	parts := strings.Split(token, ".")
+	return parts[0] + ".." + parts[2]
+}
+
+// parseDetachedJWS checks a detached JWS of type typ over payload, as
+// parseJWS does.
+func parseDetachedJWS(token, typ string, payload []byte) ([]*x509.Certificate, error) {
+	parts := strings.Split(strings.TrimSpace(token), ".")
+	if len(parts) != 3 || parts[1] != "" {
+		return nil, errors.New("malformed detached JWS")
+	}
+	_, chain, err := parseJWS(parts[0]+"."+base64.RawURLEncoding.EncodeToString(payload)+"."+parts[2], typ)
+	return chain, err
+}
+
+// verifyMedia checks the signature of the manifest of the media in dir
+// against roots at now and returns the manifest and its signer. The
+// manifest's creation time is the signer's claim, so it only has to fall
+// within the signer's validity and not after now.
+func verifyMedia(dir string, roots *x509.CertPool, now time.Time) (mediaManifest, *x509.Certificate, error) {
+	var m mediaManifest
+	raw, err := os.ReadFile(filepath.Join(dir, mediaManifestFile))
+	if err != nil {
+		return m, nil, err
+	}
+	sig, err := os.ReadFile(filepath.Join(dir, mediaSignatureFile))
+	if err != nil {
+		return m, nil, err
+	}
+	chain, err := parseDetachedJWS(string(sig), mediaType, raw)
+	if err != nil {
+		return m, nil, fmt.Errorf("%s: %v", mediaSignatureFile, err)
+	}
+	if err := json.Unmarshal(raw, &m); err != nil {
+		return m, nil, fmt.Errorf("%s: %v", mediaManifestFile, err)
+	}
+	opts := x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: x509.NewCertPool(),
+		CurrentTime:   now,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}
+	for _, c := range chain[1:] {
+		opts.Intermediates.AddCert(c)
+	}
+	if _, err := chain[0].Verify(opts); err != nil {
+		return m, nil, fmt.Errorf("media signer %s: %v", chain[0].Subject, err)
+	}
+	switch created := time.Unix(m.CreatedAt, 0); {
+	case created.After(now.Add(mediaSkew)):
+		return m, nil, fmt.Errorf("%s: media is created in the future, at %s", mediaManifestFile, created.UTC().Format(time.RFC3339))
+	case created.Before(chain[0].NotBefore) || created.After(chain[0].NotAfter):
+		return m, nil, fmt.Errorf("%s: media created at %s is outside the validity of its signer %s", mediaManifestFile, created.UTC().Format(time.RFC3339), chain[0].Subject)
+	}
+	seen := make(map[string]bool, len(m.Files))
+	for _, f := range m.Files {
+		if !mediaFileAllowed(f.Name) || seen[f.Name] {
+			return m, nil, fmt.Errorf("%s: refusing file %q", mediaManifestFile, f.Name)
+		}
+		seen[f.Name] = true
+	}
+	if !seen[bundleFile()] {
+		return m, nil, fmt.Errorf("%s: the media carries no CA bundle", mediaManifestFile)
+	}
+	return m, chain[0], nil
+}
+
+// copyVerified copies the media file f from dir into staging, checking its
+// size and digest on the bytes written rather than rereading the media.
+func copyVerified(dir, staging string, f mediaFile) error {
+	in, err := os.Open(filepath.Join(dir, f.Name))
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(filepath.Join(staging, f.Name))
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(out, h), io.LimitReader(in, f.Size+1))
+	if err != nil {
+		return err
+	}
+	if n != f.Size {
+		return fmt.Errorf("%s: %d bytes, the manifest says %d", f.Name, n, f.Size)
+	}
+	if sum := hex.EncodeToString(h.Sum(nil)); !strings.EqualFold(sum, f.SHA256) {
+		return fmt.Errorf("%s: SHA-256 %s, the manifest says %s", f.Name, sum, f.SHA256)
+	}
+	return out.Sync()
+}
+
+// importMedia verifies the media in dir and installs its files into the
+// cache directory cache. Nothing is installed unless the signature, every
+// file, every CRL and the snapshot digest check out. Unless allowOlder is
+// set, media older than the last import or CRLs older than the cached ones
+// are refused.
+func importMedia(cfg *Config, dir, cache string, allowOlder bool) (importRecord, error) {
+	var rec importRecord
+	if cfg.OfflineImport.TrustStore == "" {
+		return rec, errors.New("offline_import.trust_store is not set")
+	}
+	roots, err := readCertPool(cfg.OfflineImport.TrustStore)
+	if err != nil {
+		return rec, err
+	}
+	now := time.Now()
+	m, signer, err := verifyMedia(dir, roots, now)
+	if err != nil {
+		return rec, err
+	}
+	rec = importRecord{
+		CreatedAt: time.Unix(m.CreatedAt, 0).UTC(),
+		Signer:    subjectDN(signer),
+		Snapshot:  m.Snapshot,
+	}
+	if data, err := os.ReadFile(filepath.Join(cache, importRecordFile)); err == nil && !allowOlder {
+		var last importRecord
+		if json.Unmarshal(data, &last) == nil && !rec.CreatedAt.After(last.CreatedAt) {
+			return rec, fmt.Errorf("media of %s is not newer than the last import, of %s", rec.CreatedAt.Format(time.RFC3339), last.CreatedAt.Format(time.RFC3339))
+		}
+	}
+
+	staging, err := os.MkdirTemp(cache, ".import-")
+	if err != nil {
+		return rec, err
+	}
+	defer os.RemoveAll(staging)
+	for _, f := range m.Files {
+		if err := copyVerified(dir, staging, f); err != nil {
+			return rec, err
+		}
+		rec.Files = append(rec.Files, f.Name)
+		switch {
+		case f.Name == bundleFile():
+			if certs, err := readCertificates(filepath.Join(staging, f.Name)); err != nil || len(certs) == 0 {
+				return rec, fmt.Errorf("%s: not a PEM bundle of certificates", f.Name)
+			}
+		case strings.HasSuffix(f.Name, ".crl"):
+			if err := checkImportedCRL(cfg, staging, cache, f, allowOlder); err != nil {
+				return rec, err
+			}
+		}
+	}
+	snapshot, err := cacheManifest(staging)
+	if err != nil {
+		return rec, err
+	}
+	if snapshot.SHA256 != m.Snapshot {
+		return rec, fmt.Errorf("snapshot %s does not match the manifest's %s", snapshot.SHA256, m.Snapshot)
+	}
+
+	for _, name := range rec.Files {
+		if err := os.Rename(filepath.Join(staging, name), filepath.Join(cache, name)); err != nil {
+			return rec, err
+		}
+	}
+	rec.ImportedAt = now.UTC()
+	data, _ := json.MarshalIndent(rec, "", "  ")
+	return rec, writeFileAtomic(filepath.Join(cache, importRecordFile), data, 0o644)
+}
+
+// checkImportedCRL parses the staged CRL f and checks it against the
+// limits and, unless allowOlder is set, the CRL cached under its name.
+func checkImportedCRL(cfg *Config, staging, cache string, f mediaFile, allowOlder bool) error {
+	parsed, err := parseCRLFile(filepath.Join(staging, f.Name))
+	if err != nil {
+		return err
+	}
+	key := CRLInfo{FileName: f.Name}.key()
+	if reason := cfg.Limits.reason(key, f.Size, len(parsed.TBSCertList.RevokedCertificates)); reason != "" {
+		return fmt.Errorf("%s: %s", f.Name, reason)
+	}
+	if allowOlder {
+		return nil
+	}
+	cached, err := parseCRLFile(filepath.Join(cache, f.Name))
+	if err != nil {
+		return nil
+	}
+	if n, was := crlNumber(parsed), crlNumber(cached); n != nil && was != nil {
+		if n.Cmp(was) < 0 {
+			return fmt.Errorf("%s: CRL number %s is older than the cached %s", f.Name, n, was)
+		}
+		return nil
+	}
+	if parsed.TBSCertList.ThisUpdate.Before(cached.TBSCertList.ThisUpdate) {
+		return fmt.Errorf("%s: thisUpdate %s is older than the cached CRL's", f.Name, parsed.TBSCertList.ThisUpdate.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// signMedia writes the signed manifest of the bundle, issuer registry and
+// CRLs in dir.
+func signMedia(dir string, signer *responder.Signer) (mediaManifest, error) {
+	m := mediaManifest{CreatedAt: time.Now().Unix()}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return m, err
+	}
+	for _, e := range entries {
+		if !e.Type().IsRegular() || !mediaFileAllowed(e.Name()) {
+			continue
+		}
+		sum, err := hashFile(filepath.Join(dir, e.Name()))
+		if err != nil {
+			return m, err
+		}
+		fi, err := e.Info()
+		if err != nil {
+			return m, err
+		}
+		m.Files = append(m.Files, mediaFile{Name: e.Name(), Size: fi.Size(), SHA256: hex.EncodeToString(sum[:])})
+	}
+	sort.Slice(m.Files, func(i, j int) bool { return m.Files[i].Name < m.Files[j].Name })
+	snapshot, err := cacheManifest(dir)
+	if err != nil {
+		return m, err
+	}
+	m.Snapshot = snapshot.SHA256
+	raw, _ := json.MarshalIndent(m, "", "  ")
+	token, err := signJWS(signer, mediaType, raw)
+	if err != nil {
+		return m, err
+	}
+	return m, writeManifest(dir, raw, token)
+}
+
+// writeManifest writes the manifest raw and its JWS token, detached, to
+// dir.
+func writeManifest(dir string, raw []byte, token string) error {
+	if err := writeFileAtomic(filepath.Join(dir, mediaManifestFile), raw, 0o644); err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(dir, mediaSignatureFile), []byte(detachJWS(token)+"\n"), 0o644)
+}
+
+// signMediaCommand signs a directory on the connected side before it is
+// written to removable media.
+func signMediaCommand(args []string) int {
+	fs := flag.NewFlagSet("sign-media", flag.ContinueOnError)
+	dir := fs.String("dir", "", "directory holding the CA bundle, the CRLs and optionally issuers.json")
+	certPath := fs.String("cert", "", "PEM certificate of the signing key, chaining to offline_import.trust_store")
+	keyPath := fs.String("key", "", "PEM signing key")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *dir == "" || *certPath == "" || *keyPath == "" {
+		fmt.Fprintln(os.Stderr, "sign-media: --dir, --cert and --key are required")
+		fs.Usage()
+		return 2
+	}
+	signer, err := responder.LoadSigner(*certPath, *keyPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "sign-media:", err)
+		return 2
+	}
+	m, err := signMedia(*dir, signer)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "sign-media:", err)
+		return 1
+	}
+	fmt.Printf("Signed %d files, snapshot %s\n", len(m.Files), m.Snapshot)
+	return 0
+}
+
+// importCommand installs signed offline media into the cache of a
+// responder without network access.
+func importCommand(args []string) int {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	configPath := fs.String("config", "", "YAML configuration, for offline_import.trust_store and crl_limits")
+	cache := fs.String("cache", rootDir, "CRL cache directory to install into")
+	allowOlder := fs.Bool("allow-older", false, "install media or CRLs older than those already imported or cached")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: goocsp import [--config file] [--cache dir] [--allow-older] media-dir")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	cfg, err := loadConfig(*configPath)
+	if err == nil {
+		err = useProfile(cfg)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "import:", err)
+		return 2
+	}
+	rec, err := importMedia(cfg, fs.Arg(0), *cache, *allowOlder)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "import:", err)
+		return 1
+	}
+	fmt.Printf("Imported %d files signed by %s on %s, snapshot %s\n", len(rec.Files), rec.Signer, rec.CreatedAt.Format(time.RFC3339), rec.Snapshot)
+	return 0
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/pkkemp/GoOCSPResponder/responder"
+)
+
+// writeMedia writes a manifest created at created, signed by s as typ,
+// into a new directory.
+func writeMedia(t *testing.T, s *responder.Signer, typ string, created time.Time) string {
+	t.Helper()
+	dir := t.TempDir()
+	raw, _ := json.Marshal(mediaManifest{
+		CreatedAt: created.Unix(),
+		Files:     []mediaFile{{Name: bundleFile(), Size: 1, SHA256: "00"}},
+	})
+	token, err := signJWS(s, typ, raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeManifest(dir, raw, token); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestVerifyMedia(t *testing.T) {
+	now := time.Now()
+	valid, roots := jwsSigner(t, now.Add(-time.Hour), now.Add(time.Hour))
+	expired, expiredRoots := jwsSigner(t, now.Add(-48*time.Hour), now.Add(-24*time.Hour))
+
+	m, signer, err := verifyMedia(writeMedia(t, valid, mediaType, now), roots, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if signer.Subject.CommonName != "Statement Signer" || m.CreatedAt != now.Unix() {
+		t.Errorf("verifyMedia = %+v, %s", m, signer.Subject)
+	}
+	if _, _, err := verifyMedia(writeMedia(t, valid, mediaType, now.Add(mediaSkew/2)), roots, now); err != nil {
+		t.Errorf("media within the clock skew: %v", err)
+	}
+
+	tests := []struct {
+		name  string
+		dir   string
+		roots *x509.CertPool
+	}{
+		{"other type", writeMedia(t, valid, attestationType, now), roots},
+		{"created in the future", writeMedia(t, valid, mediaType, now.Add(time.Hour/2)), roots},
+		{"created before the signer", writeMedia(t, valid, mediaType, now.Add(-2*time.Hour)), roots},
+		// The signer chooses the creation time, so one within its
+		// validity does not make an expired signer acceptable.
+		{"expired signer", writeMedia(t, expired, mediaType, now.Add(-30*time.Hour)), expiredRoots},
+		{"untrusted signer", writeMedia(t, valid, mediaType, now), expiredRoots},
+	}
+	for _, tc := range tests {
+		if _, _, err := verifyMedia(tc.dir, tc.roots, now); err == nil {
+			t.Errorf("%s: verifyMedia accepted the media", tc.name)
+		}
+	}
+}
@@ -0,0 +1,482 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	_ "crypto/sha512" // SHA-384 and SHA-512 for RS384, RS512 and ES384
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OIDCConfig signs dashboard users in with an OpenID Connect provider,
+// using the authorization code flow.
+type OIDCConfig struct {
+	// Issuer is the provider's issuer URL; its discovery document is read
+	// from /.well-known/openid-configuration below it.
+	Issuer           string `yaml:"issuer"`
+	ClientID         string `yaml:"client_id"`
+	ClientSecretFile string `yaml:"client_secret_file"`
+	// RedirectURL is this server's /dashboard/callback URL as registered
+	// with the provider.
+	RedirectURL string `yaml:"redirect_url"`
+	// GroupsClaim names the ID token claim listing the user's groups.
+	GroupsClaim string `yaml:"groups_claim"`
+	// SessionKeyFile holds the key session cookies are signed with, so
+	// sessions survive restarts and work across instances. Without it a
+	// key is generated at startup.
+	SessionKeyFile  string        `yaml:"session_key_file"`
+	SessionLifetime time.Duration `yaml:"session_lifetime"`
+}
+
+const (
+	sessionCookie = "goocsp_session"
+	loginCookie   = "goocsp_login"
+)
+
+var oidcHTTP = &http.Client{Timeout: 10 * time.Second}
+
+// oidcClient is the relying party. Discovery and the provider's keys are
+// fetched on first use, so an unreachable provider does not keep the
+// responder from starting.
+type oidcClient struct {
+	cfg        OIDCConfig
+	secret     string
+	sessionKey []byte
+
+	mu       sync.Mutex
+	provider *oidcProvider
+	keys     map[string]crypto.PublicKey
+	keysAt   time.Time
+}
+
+type oidcProvider struct {
+	Issuer   string `json:"issuer"`
+	AuthURL  string `json:"authorization_endpoint"`
+	TokenURL string `json:"token_endpoint"`
+	JWKSURL  string `json:"jwks_uri"`
+}
+
+func newOIDCClient(cfg OIDCConfig) (*oidcClient, error) {
+	secret, err := os.ReadFile(cfg.ClientSecretFile)
+	if err != nil {
+		return nil, err
+	}
+	c := &oidcClient{cfg: cfg, secret: strings.TrimSpace(string(secret))}
+	if cfg.SessionKeyFile != "" {
+		if c.sessionKey, err = os.ReadFile(cfg.SessionKeyFile); err != nil {
+			return nil, err
+		}
+		if len(c.sessionKey) < 32 {
+			return nil, fmt.Errorf("%s: session key must be at least 32 bytes", cfg.SessionKeyFile)
+		}
+	} else {
+		c.sessionKey = make([]byte, 32)
+		if _, err := rand.Read(c.sessionKey); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func getJSON(u string, v interface{}) error {
+	resp, err := oidcHTTP.Get(u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", u, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func (c *oidcClient) discover() (*oidcProvider, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.provider != nil {
+		return c.provider, nil
+	}
+	var p oidcProvider
+	if err := getJSON(strings.TrimSuffix(c.cfg.Issuer, "/")+"/.well-known/openid-configuration", &p); err != nil {
+		return nil, fmt.Errorf("oidc discovery: %v", err)
+	}
+	if p.Issuer != c.cfg.Issuer || p.AuthURL == "" || p.TokenURL == "" || p.JWKSURL == "" {
+		return nil, fmt.Errorf("oidc discovery: incomplete document for issuer %q", p.Issuer)
+	}
+	c.provider = &p
+	return c.provider, nil
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func b64(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := b64(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := b64(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := b64(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := b64(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+// key returns the provider key kid, refetching the key set at most once a
+// minute when kid is unknown, as happens after a key rotation.
+func (c *oidcClient) key(p *oidcProvider, kid string) (crypto.PublicKey, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if k, ok := c.keys[kid]; ok {
+		return k, nil
+	}
+	if time.Since(c.keysAt) < time.Minute {
+		return nil, fmt.Errorf("unknown key %q", kid)
+	}
+	c.keysAt = time.Now()
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := getJSON(p.JWKSURL, &set); err != nil {
+		return nil, err
+	}
+	c.keys = make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		if pub, err := k.publicKey(); err == nil {
+			c.keys[k.Kid] = pub
+		}
+	}
+	if k, ok := c.keys[kid]; ok {
+		return k, nil
+	}
+	return nil, fmt.Errorf("unknown key %q", kid)
+}
+
+// verifyJWT checks the signature of a compact JWS with the provider's keys
+// and returns its claims.
+func (c *oidcClient) verifyJWT(p *oidcProvider, token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed ID token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	raw, err := b64(parts[0])
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(raw, &header); err != nil {
+		return nil, err
+	}
+	sig, err := b64(parts[2])
+	if err != nil {
+		return nil, err
+	}
+	if _, err := jwsHash(header.Alg); err != nil {
+		return nil, fmt.Errorf("ID token: %v", err)
+	}
+	pub, err := c.key(p, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyJWS(header.Alg, pub, parts[0]+"."+parts[1], sig); err != nil {
+		return nil, fmt.Errorf("ID token signature: %v", err)
+	}
+	raw, err = b64(parts[1])
+	if err != nil {
+		return nil, err
+	}
+	var claims map[string]interface{}
+	if err := json.Unmarshal(raw, &claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// checkIDToken validates the claims of a verified ID token (OpenID Connect
+// Core 3.1.3.7).
+func (c *oidcClient) checkIDToken(p *oidcProvider, claims map[string]interface{}, nonce string, now time.Time) error {
+	if claims["iss"] != p.Issuer {
+		return fmt.Errorf("ID token issuer %v", claims["iss"])
+	}
+	audOK := false
+	switch aud := claims["aud"].(type) {
+	case string:
+		audOK = aud == c.cfg.ClientID
+	case []interface{}:
+		for _, a := range aud {
+			audOK = audOK || a == c.cfg.ClientID
+		}
+	}
+	if !audOK {
+		return errors.New("ID token is not for this client")
+	}
+	exp, _ := claims["exp"].(float64)
+	if now.After(time.Unix(int64(exp), 0)) {
+		return errors.New("ID token expired")
+	}
+	if claims["nonce"] != nonce {
+		return errors.New("ID token nonce mismatch")
+	}
+	return nil
+}
+
+// identities are the names an ID token grants roles by: its subject, its
+// email address unless marked unverified, and its groups.
+func (c *oidcClient) identities(claims map[string]interface{}) []string {
+	var ids []string
+	if sub, ok := claims["sub"].(string); ok {
+		ids = append(ids, sub)
+	}
+	if email, ok := claims["email"].(string); ok && claims["email_verified"] != false {
+		ids = append(ids, email)
+	}
+	groupsClaim := c.cfg.GroupsClaim
+	if groupsClaim == "" {
+		groupsClaim = "groups"
+	}
+	if groups, ok := claims[groupsClaim].([]interface{}); ok {
+		for _, g := range groups {
+			if g, ok := g.(string); ok {
+				ids = append(ids, g)
+			}
+		}
+	}
+	return ids
+}
+
+// sign and open protect cookie values with an HMAC under the session key.
+func (c *oidcClient) sign(v interface{}) string {
+	payload, _ := json.Marshal(v)
+	mac := hmac.New(sha256.New, c.sessionKey)
+	mac.Write(payload)
+	return base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (c *oidcClient) open(value string, v interface{}) bool {
+	i := strings.IndexByte(value, '.')
+	if i < 0 {
+		return false
+	}
+	payload, err1 := base64.RawURLEncoding.DecodeString(value[:i])
+	sum, err2 := base64.RawURLEncoding.DecodeString(value[i+1:])
+	if err1 != nil || err2 != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, c.sessionKey)
+	mac.Write(payload)
+	if !hmac.Equal(sum, mac.Sum(nil)) {
+		return false
+	}
+	return json.Unmarshal(payload, v) == nil
+}
+
+// session is the content of the session cookie.
+type session struct {
+	Name    string   `json:"n"`
+	IDs     []string `json:"i"`
+	Expires int64    `json:"e"`
+}
+
+// loginState is the content of the cookie that carries the login across
+// the round trip to the provider.
+type loginState struct {
+	State string `json:"s"`
+	Nonce string `json:"n"`
+	Next  string `json:"r"`
+}
+
+// session returns the signed-in user of r.
+func (c *oidcClient) session(r *http.Request) (session, bool) {
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return session{}, false
+	}
+	var s session
+	if !c.open(cookie.Value, &s) || time.Now().Unix() > s.Expires {
+		return session{}, false
+	}
+	return s, true
+}
+
+func randomString() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func (c *oidcClient) setCookie(w http.ResponseWriter, name, value string, maxAge time.Duration) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		MaxAge:   int(maxAge / time.Second),
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(c.cfg.RedirectURL, "https:"),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// loginHandler serves /dashboard/login and sends the user to the provider.
+func (c *oidcClient) loginHandler(w http.ResponseWriter, r *http.Request) {
+	p, err := c.discover()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	next := r.FormValue("next")
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") {
+		next = "/stats"
+	}
+	ls := loginState{State: randomString(), Nonce: randomString(), Next: next}
+	c.setCookie(w, loginCookie, c.sign(ls), 10*time.Minute)
+	q := url.Values{
+		"response_type": {"code"},
+		"client_id":     {c.cfg.ClientID},
+		"redirect_uri":  {c.cfg.RedirectURL},
+		"scope":         {"openid email profile"},
+		"state":         {ls.State},
+		"nonce":         {ls.Nonce},
+	}
+	sep := "?"
+	if strings.Contains(p.AuthURL, "?") {
+		sep = "&"
+	}
+	http.Redirect(w, r, p.AuthURL+sep+q.Encode(), http.StatusFound)
+}
+
+// callbackHandler serves /dashboard/callback: it redeems the code, checks
+// the ID token and starts a session.
+func (c *oidcClient) callbackHandler(w http.ResponseWriter, r *http.Request) {
+	var ls loginState
+	cookie, err := r.Cookie(loginCookie)
+	if err != nil || !c.open(cookie.Value, &ls) || ls.State != r.FormValue("state") {
+		http.Error(w, "login expired, try again", http.StatusBadRequest)
+		return
+	}
+	c.setCookie(w, loginCookie, "", -1)
+	if e := r.FormValue("error"); e != "" {
+		http.Error(w, "sign-in failed: "+e, http.StatusForbidden)
+		return
+	}
+	p, err := c.discover()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	claims, err := c.redeem(p, r.FormValue("code"), ls.Nonce)
+	if err != nil {
+		log.Printf("audit: oidc sign-in from %s failed: %v", clientAddr(r), err)
+		http.Error(w, "sign-in failed", http.StatusForbidden)
+		return
+	}
+	s := session{IDs: c.identities(claims), Expires: time.Now().Add(c.lifetime()).Unix()}
+	s.Name, _ = claims["email"].(string)
+	if s.Name == "" {
+		s.Name, _ = claims["sub"].(string)
+	}
+	c.setCookie(w, sessionCookie, c.sign(s), c.lifetime())
+	log.Printf("audit: %s signed in to the dashboard as %s from %s", s.Name, dashboard.roleOf(s.IDs), clientAddr(r))
+	http.Redirect(w, r, ls.Next, http.StatusSeeOther)
+}
+
+func (c *oidcClient) lifetime() time.Duration {
+	if c.cfg.SessionLifetime > 0 {
+		return c.cfg.SessionLifetime
+	}
+	return 8 * time.Hour
+}
+
+// redeem exchanges an authorization code for a checked ID token.
+func (c *oidcClient) redeem(p *oidcProvider, code, nonce string) (map[string]interface{}, error) {
+	form := url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {code},
+		"redirect_uri": {c.cfg.RedirectURL},
+	}
+	req, err := http.NewRequest(http.MethodPost, p.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(c.cfg.ClientID), url.QueryEscape(c.secret))
+	resp, err := oidcHTTP.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("token endpoint: %s", resp.Status)
+	}
+	var tok struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tok); err != nil {
+		return nil, err
+	}
+	claims, err := c.verifyJWT(p, tok.IDToken)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.checkIDToken(p, claims, nonce, time.Now()); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// logoutHandler serves /dashboard/logout.
+func (c *oidcClient) logoutHandler(w http.ResponseWriter, r *http.Request) {
+	c.setCookie(w, sessionCookie, "", -1)
+	fmt.Fprintln(w, "Signed out.")
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testIdP is an OpenID provider whose token endpoint answers with idToken.
+type testIdP struct {
+	srv     *httptest.Server
+	key     *ecdsa.PrivateKey
+	idToken string
+}
+
+func newTestIdP(t *testing.T) *testIdP {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp := &testIdP{key: key}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(oidcProvider{
+			Issuer:   idp.srv.URL,
+			AuthURL:  idp.srv.URL + "/authorize",
+			TokenURL: idp.srv.URL + "/token",
+			JWKSURL:  idp.srv.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		enc := base64.RawURLEncoding
+		json.NewEncoder(w).Encode(map[string][]jwk{"keys": {{
+			Kty: "EC",
+			Kid: "k1",
+			Crv: "P-256",
+			X:   enc.EncodeToString(key.X.FillBytes(make([]byte, 32))),
+			Y:   enc.EncodeToString(key.Y.FillBytes(make([]byte, 32))),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if id, secret, ok := r.BasicAuth(); !ok || id != "dashboard" || secret != "s3cret" || r.FormValue("code") != "the-code" {
+			http.Error(w, "invalid_client", http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id_token": idp.idToken})
+	})
+	idp.srv = httptest.NewServer(mux)
+	t.Cleanup(idp.srv.Close)
+	return idp
+}
+
+// sign returns claims as an ES256 ID token signed by key.
+func (idp *testIdP) sign(t *testing.T, key *ecdsa.PrivateKey, claims map[string]interface{}) string {
+	t.Helper()
+	enc := base64.RawURLEncoding
+	header, _ := json.Marshal(map[string]string{"alg": "ES256", "kid": "k1", "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	input := enc.EncodeToString(header) + "." + enc.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(input))
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig := append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	return input + "." + enc.EncodeToString(sig)
+}
+
+func (idp *testIdP) client(t *testing.T) *oidcClient {
+	t.Helper()
+	secret := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(secret, []byte("s3cret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	c, err := newOIDCClient(OIDCConfig{
+		Issuer:           idp.srv.URL,
+		ClientID:         "dashboard",
+		ClientSecretFile: secret,
+		RedirectURL:      "https://ocsp.example/dashboard/callback",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestOIDCSignIn(t *testing.T) {
+	benchState(t, defaultConfig().Cache)
+	idp := newTestIdP(t)
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev := dashboard
+	dashboard = &dashboardAuth{cfg: DashboardConfig{Operators: []string{"ops@example.com"}}}
+	defer func() { dashboard = prev }()
+
+	tests := []struct {
+		name string
+		// claims edits the claims of a valid ID token.
+		claims func(map[string]interface{})
+		// key signs the ID token instead of the provider's key.
+		key *ecdsa.PrivateKey
+		// cookie edits the login cookie sent back to the callback.
+		cookie func(*http.Cookie)
+		state  string
+		want   int
+	}{
+		{name: "valid", want: http.StatusSeeOther},
+		{name: "audience list", claims: func(c map[string]interface{}) { c["aud"] = []string{"other", "dashboard"} }, want: http.StatusSeeOther},
+		{name: "wrong audience", claims: func(c map[string]interface{}) { c["aud"] = "other-client" }, want: http.StatusForbidden},
+		{name: "wrong issuer", claims: func(c map[string]interface{}) { c["iss"] = "https://idp.example" }, want: http.StatusForbidden},
+		{name: "expired", claims: func(c map[string]interface{}) { c["exp"] = time.Now().Add(-time.Minute).Unix() }, want: http.StatusForbidden},
+		{name: "nonce mismatch", claims: func(c map[string]interface{}) { c["nonce"] = "replayed" }, want: http.StatusForbidden},
+		{name: "no nonce", claims: func(c map[string]interface{}) { delete(c, "nonce") }, want: http.StatusForbidden},
+		{name: "signed by another key", key: otherKey, want: http.StatusForbidden},
+		{name: "tampered state cookie", cookie: func(c *http.Cookie) {
+			payload, _ := json.Marshal(loginState{State: "forged", Nonce: "forged", Next: "/stats"})
+			c.Value = base64.RawURLEncoding.EncodeToString(payload) + c.Value[strings.IndexByte(c.Value, '.'):]
+		}, state: "forged", want: http.StatusBadRequest},
+		{name: "state mismatch", state: "other", want: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := idp.client(t)
+			w := httptest.NewRecorder()
+			c.loginHandler(w, httptest.NewRequest(http.MethodGet, "/dashboard/login?next=/stats/issuers", nil))
+			if w.Code != http.StatusFound {
+				t.Fatalf("login answered %d: %s", w.Code, w.Body)
+			}
+			auth, err := url.Parse(w.Header().Get("Location"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			q := auth.Query()
+			if q.Get("client_id") != "dashboard" || q.Get("redirect_uri") != "https://ocsp.example/dashboard/callback" {
+				t.Fatalf("authorization request %s", auth)
+			}
+			loginCookies := w.Result().Cookies()
+			if len(loginCookies) != 1 || loginCookies[0].Name != loginCookie {
+				t.Fatalf("login set cookies %v", loginCookies)
+			}
+
+			claims := map[string]interface{}{
+				"iss":   idp.srv.URL,
+				"aud":   "dashboard",
+				"sub":   "u-1",
+				"email": "ops@example.com",
+				"exp":   time.Now().Add(time.Hour).Unix(),
+				"nonce": q.Get("nonce"),
+			}
+			if tt.claims != nil {
+				tt.claims(claims)
+			}
+			key := idp.key
+			if tt.key != nil {
+				key = tt.key
+			}
+			idp.idToken = idp.sign(t, key, claims)
+
+			state := q.Get("state")
+			if tt.state != "" {
+				state = tt.state
+			}
+			r := httptest.NewRequest(http.MethodGet, "/dashboard/callback?code=the-code&state="+url.QueryEscape(state), nil)
+			cookie := *loginCookies[0]
+			if tt.cookie != nil {
+				tt.cookie(&cookie)
+			}
+			r.AddCookie(&cookie)
+			w = httptest.NewRecorder()
+			c.callbackHandler(w, r)
+			if w.Code != tt.want {
+				t.Fatalf("callback answered %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+			if tt.want != http.StatusSeeOther {
+				for _, ck := range w.Result().Cookies() {
+					if ck.Name == sessionCookie {
+						t.Error("a refused sign-in set a session cookie")
+					}
+				}
+				return
+			}
+			if loc := w.Header().Get("Location"); loc != "/stats/issuers" {
+				t.Errorf("redirected to %q", loc)
+			}
+			r = httptest.NewRequest(http.MethodGet, "/stats", nil)
+			for _, ck := range w.Result().Cookies() {
+				if ck.Name == sessionCookie {
+					r.AddCookie(ck)
+				}
+			}
+			s, ok := c.session(r)
+			if !ok || s.Name != "ops@example.com" || dashboard.roleOf(s.IDs) != roleOperator {
+				t.Errorf("session %+v, %v", s, ok)
+			}
+		})
+	}
+}
+
+func TestOIDCSessionCookie(t *testing.T) {
+	c := newTestIdP(t).client(t)
+	valid := c.sign(session{Name: "u", Expires: time.Now().Add(time.Hour).Unix()})
+	expired := c.sign(session{Name: "u", Expires: time.Now().Add(-time.Minute).Unix()})
+	other := &oidcClient{sessionKey: []byte("another key of at least 32 bytes")}
+	for name, tt := range map[string]struct {
+		value string
+		want  bool
+	}{
+		"valid":         {valid, true},
+		"expired":       {expired, false},
+		"other key":     {other.sign(session{Name: "u", Expires: time.Now().Add(time.Hour).Unix()}), false},
+		"no signature":  {strings.SplitN(valid, ".", 2)[0], false},
+		"not base64":    {"!!.!!", false},
+		"flipped bytes": {strings.Replace(valid, valid[:4], "eyJv", 1), false},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/stats", nil)
+		r.AddCookie(&http.Cookie{Name: sessionCookie, Value: tt.value})
+		if _, ok := c.session(r); ok != tt.want {
+			t.Errorf("%s: session ok = %v, want %v", name, ok, tt.want)
+		}
+	}
+}
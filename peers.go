@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+// PeersConfig turns on the peer check of an active-active pool: every
+// interval each instance fetches the build manifest of its peers and
+// compares it with its own, so a node stuck on old CRLs behind a load
+// balancer is noticed instead of silently answering from them. Nodes that
+// refresh at different offsets differ for a while after every CRL update;
+// only a divergence that lasts longer than grace makes the pool
+// inconsistent and raises an alert.
+type PeersConfig struct {
+	// URLs are the base URLs of the other instances, as their clients
+	// reach them; /api/v1/manifest is fetched from each.
+	URLs []string `yaml:"urls"`
+	// Interval is the pause between two checks of every peer.
+	Interval time.Duration `yaml:"interval"`
+	// Grace is how long a peer may differ before it counts as divergent.
+	Grace time.Duration `yaml:"grace"`
+}
+
+func (c PeersConfig) validate() error {
+	for _, u := range c.URLs {
+		if parsed, err := url.Parse(u); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return fmt.Errorf("peers: %q must be an http(s) URL", u)
+		}
+	}
+	if len(c.URLs) > 0 && (c.Interval <= 0 || c.Grace < 0) {
+		return errors.New("peers.interval must be positive and peers.grace not negative")
+	}
+	return nil
+}
+
+// peerCheck is the outcome of the last check of one peer.
+type peerCheck struct {
+	URL       string    `json:"url"`
+	CheckedAt time.Time `json:"checked_at"`
+	// Manifest is the digest of the peer's manifest; it matches the local
+	// one when both serve identical revocation data.
+	Manifest string `json:"manifest_sha256,omitempty"`
+	Error    string `json:"error,omitempty"`
+	// Differences lists how the peer's indexes differ from the local ones.
+	Differences []string `json:"differences,omitempty"`
+	// Behind and Ahead list the issuers the peer serves an older or a
+	// newer CRL of, by CRL number or else thisUpdate.
+	Behind []string `json:"behind,omitempty"`
+	Ahead  []string `json:"ahead,omitempty"`
+	// DifferentSince is when the peer started to differ, if it does.
+	DifferentSince *time.Time `json:"different_since,omitempty"`
+	// Divergent is set once it differed for longer than the grace.
+	Divergent bool `json:"divergent"`
+}
+
+// peerStatus is what GET /admin/v1/peers reports.
+type peerStatus struct {
+	// Consistent is the cluster gauge: no peer is divergent.
+	Consistent bool         `json:"consistent"`
+	Divergent  int          `json:"divergent"`
+	Manifest   string       `json:"manifest_sha256"`
+	Peers      []*peerCheck `json:"peers"`
+}
+
+// peers holds the last check of each peer, by URL.
+var peers = struct {
+	sync.Mutex
+	checks   map[string]*peerCheck
+	manifest string
+}{checks: make(map[string]*peerCheck)}
+
+// runPeerChecker checks the peers of the current configuration every
+// interval.
+func runPeerChecker(hb heartbeat) {
+	for {
+		st := currentState()
+		cfg := st.cfg.Peers
+		if len(cfg.URLs) == 0 {
+			// Disabled; a reload may enable it.
+			if !hb.sleep(time.Minute) {
+				return
+			}
+			continue
+		}
+		checkPeers(st)
+		if !hb.sleep(cfg.Interval) {
+			return
+		}
+	}
+}
+
+// checkPeers compares the manifest of every peer with the one of st.
+func checkPeers(st *state) {
+	local := st.manifest()
+	results := make(map[string]*peerCheck, len(st.cfg.Peers.URLs))
+	for _, u := range st.cfg.Peers.URLs {
+		c := &peerCheck{URL: u, CheckedAt: time.Now()}
+		if m, err := fetchManifest(u); err != nil {
+			c.Error = err.Error()
+		} else {
+			c.Manifest = m.SHA256
+			if m.SHA256 != local.SHA256 {
+				c.Differences, c.Behind, c.Ahead = comparePeer(local, m)
+			}
+		}
+		results[u] = c
+	}
+
+	peers.Lock()
+	defer peers.Unlock()
+	for u, c := range results {
+		prev := peers.checks[u]
+		if c.Error == "" && c.Manifest == local.SHA256 {
+			if prev != nil && prev.Divergent {
+				log.Printf("peers: %s serves the same data again", u)
+			}
+			continue
+		}
+		since := c.CheckedAt
+		if prev != nil && prev.DifferentSince != nil {
+			since = *prev.DifferentSince
+		}
+		c.DifferentSince = &since
+		c.Divergent = c.CheckedAt.Sub(since) > st.cfg.Peers.Grace
+		if c.Divergent && (prev == nil || !prev.Divergent) {
+			alert(st.cfg, "peer %s diverged from this node for %v: %s", u, c.CheckedAt.Sub(since).Round(time.Second), c.summary())
+		}
+	}
+	peers.checks = results
+	peers.manifest = local.SHA256
+}
+
+// summary says in a line how a differing peer differs.
+func (c *peerCheck) summary() string {
+	switch {
+	case c.Error != "":
+		return c.Error
+	case len(c.Behind) > 0:
+		return fmt.Sprintf("behind on %v", c.Behind)
+	case len(c.Ahead) > 0:
+		return fmt.Sprintf("ahead on %v", c.Ahead)
+	case len(c.Differences) > 0:
+		return c.Differences[0]
+	}
+	return "manifest " + c.Manifest
+}
+
+// comparePeer lists how the peer manifest m differs from local, and the
+// issuers it is behind or ahead on.
+func comparePeer(local, m manifest) (diffs, behind, ahead []string) {
+	diffs = compareManifests(local, m)
+	served := make(map[string]manifestEntry, len(m.Issuers))
+	for _, e := range m.Issuers {
+		served[e.Issuer] = e
+	}
+	for _, l := range local.Issuers {
+		p, ok := served[l.Issuer]
+		if !ok {
+			diffs = append(diffs, fmt.Sprintf("%s: not served by the peer", l.Issuer))
+			continue
+		}
+		if p.CRL == l.CRL {
+			continue
+		}
+		switch newerCRL(p, l) {
+		case -1:
+			behind = append(behind, l.Issuer)
+		case 1:
+			ahead = append(ahead, l.Issuer)
+		}
+	}
+	return diffs, behind, ahead
+}
+
+// newerCRL compares the CRLs of two manifest entries of an issuer by CRL
+// number or, without numbers, by thisUpdate: -1 if a is older, 1 if it is
+// newer and 0 if that cannot be told.
+func newerCRL(a, b manifestEntry) int {
+	an, aok := new(big.Int).SetString(a.CRLNumber, 10)
+	bn, bok := new(big.Int).SetString(b.CRLNumber, 10)
+	if aok && bok {
+		return an.Cmp(bn)
+	}
+	if a.ThisUpdate == nil || b.ThisUpdate == nil {
+		return 0
+	}
+	switch {
+	case a.ThisUpdate.Before(*b.ThisUpdate):
+		return -1
+	case a.ThisUpdate.After(*b.ThisUpdate):
+		return 1
+	}
+	return 0
+}
+
+// currentPeerStatus returns the peer gauge and the last check of each peer.
+func currentPeerStatus() peerStatus {
+	peers.Lock()
+	defer peers.Unlock()
+	s := peerStatus{Manifest: peers.manifest, Peers: make([]*peerCheck, 0, len(peers.checks))}
+	for _, c := range peers.checks {
+		if c.Divergent {
+			s.Divergent++
+		}
+		s.Peers = append(s.Peers, c)
+	}
+	sort.Slice(s.Peers, func(i, j int) bool { return s.Peers[i].URL < s.Peers[j].URL })
+	s.Consistent = s.Divergent == 0
+	return s
+}
+
+// peersHandler serves GET /admin/v1/peers.
+func peersHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(currentPeerStatus())
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkkemp/GoOCSPResponder/responder"
+)
+
+// A CRL refresh drops the responses derived from the old CRL, and under
+// heavy traffic the requests that follow would all miss at once and queue
+// for a signature. With cache.prewarm, the responses of the issuer that
+// were requested most lately are signed from the new CRL before it is
+// swapped in, and replace the old ones in the same swap.
+
+// sketchDepth and sketchWidth size requestFreq: four rows of 64Ki counters,
+// a megabyte in all.
+const (
+	sketchDepth = 4
+	sketchWidth = 1 << 16
+)
+
+// countMinSketch estimates how often each request was seen lately, in
+// fixed memory and without locks: every request increments one counter per
+// row, and its estimate is the smallest of them. The counters are halved
+// every ten times sketchWidth requests, so old popularity fades.
+type countMinSketch struct {
+	once   sync.Once
+	rows   [sketchDepth][]uint32
+	added  int64
+	halved int32
+}
+
+// requestFreq counts the OCSP requests while cache.prewarm is set. It
+// survives reloads, like the cache counters.
+var requestFreq countMinSketch
+
+// sketchIndexes returns the counter of req in each row, by double hashing
+// its FNV-1a hash.
+func sketchIndexes(req []byte) [sketchDepth]uint32 {
+	h := uint64(14695981039346656037)
+	for _, b := range req {
+		h ^= uint64(b)
+		h *= 1099511628211
+	}
+	h1, h2 := uint32(h), uint32(h>>32)|1
+	var idx [sketchDepth]uint32
+	for i := range idx {
+		idx[i] = (h1 + uint32(i)*h2) & (sketchWidth - 1)
+	}
+	return idx
+}
+
+// make allocates the counters on first use, so a responder without
+// cache.prewarm does without them.
+func (s *countMinSketch) make() {
+	s.once.Do(func() {
+		for i := range s.rows {
+			s.rows[i] = make([]uint32, sketchWidth)
+		}
+	})
+}
+
+// add counts one request. It does not allocate once the sketch is made.
+func (s *countMinSketch) add(req []byte) {
+	s.make()
+	for i, j := range sketchIndexes(req) {
+		atomic.AddUint32(&s.rows[i][j], 1)
+	}
+	if atomic.AddInt64(&s.added, 1)%(10*sketchWidth) == 0 && atomic.CompareAndSwapInt32(&s.halved, 0, 1) {
+		go s.halve()
+	}
+}
+
+// halve halves every counter. Increments racing with it may be lost, which
+// an estimate can afford.
+func (s *countMinSketch) halve() {
+	for i := range s.rows {
+		for j := range s.rows[i] {
+			p := &s.rows[i][j]
+			atomic.StoreUint32(p, atomic.LoadUint32(p)/2)
+		}
+	}
+	atomic.StoreInt32(&s.halved, 0)
+}
+
+// estimate returns how often req was seen lately, never less than it was.
+func (s *countMinSketch) estimate(req string) uint32 {
+	s.make()
+	var least uint32
+	for i, j := range sketchIndexes([]byte(req)) {
+		if n := atomic.LoadUint32(&s.rows[i][j]); i == 0 || n < least {
+			least = n
+		}
+	}
+	return least
+}
+
+// hottest returns the requests answered from the cache for issuer that
+// were seen most lately, at most n of them, most frequent first.
+func (c *responseCache) hottest(issuer string, n int, now time.Time) []string {
+	type scored struct {
+		req string
+		n   uint32
+	}
+	var candidates []scored
+	for req, e := range c.live(now) {
+		if e.issuer != issuer {
+			continue
+		}
+		if f := requestFreq.estimate(req); f > 0 {
+			candidates = append(candidates, scored{req, f})
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].n > candidates[j].n })
+	if len(candidates) > n {
+		candidates = candidates[:n]
+	}
+	reqs := make([]string, len(candidates))
+	for i, s := range candidates {
+		reqs[i] = s.req
+	}
+	return reqs
+}
+
+// adopt adds entries to the read map of c, as far as there is room.
+func (c *responseCache) adopt(entries map[string]*cachedResponse, now time.Time) {
+	if len(entries) == 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	live := c.liveLocked(now)
+	for req, e := range entries {
+		if len(live) >= c.max {
+			break
+		}
+		if now.Before(e.expires) {
+			live[req] = e
+		}
+	}
+	c.read.Store(live)
+	c.dirty = make(map[string]*cachedResponse)
+	c.promoted = now
+}
+
+// prewarm signs from filter the responses to the hottest cached requests
+// for the issuer of crl, and returns them by request. They are signed on
+// the slow path like misses, in turn, so they neither exceed its
+// concurrency nor starve the misses; those that cannot get a slot in time
+// are left out.
+func prewarm(old *state, crl CRLInfo, filter CRLBloomFilter) map[string]*cachedResponse {
+	cfg := old.cfg.Cache
+	if cfg.Prewarm == 0 || cfg.MaxEntries == 0 || filter.quarantine != "" || old.signer == nil {
+		return nil
+	}
+	start := time.Now()
+	n := cfg.Prewarm
+	if n > cfg.MaxEntries {
+		n = cfg.MaxEntries
+	}
+	reqs := old.cache.hottest(crl.key(), n, start)
+	if len(reqs) == 0 {
+		return nil
+	}
+	// A state that answers from the new CRL and caches on its own.
+	warm := *old
+	warm.filters = make(map[string]CRLBloomFilter, len(old.filters))
+	for k, v := range old.filters {
+		warm.filters[k] = v
+	}
+	warm.filters[crl.key()] = filter
+	warm.cache = newResponseCache(cfg)
+	for _, body := range reqs {
+		req, err := responder.ParseRequest([]byte(body))
+		if err != nil {
+			continue
+		}
+		warm.sign([]byte(body), req, "", 0, time.Now())
+	}
+	warmed := warm.cache.live(time.Now())
+	log.Printf("prewarm %s: signed %d of the %d most requested responses in %s", crl.FileName, len(warmed), len(reqs), time.Since(start).Round(time.Millisecond))
+	atomic.AddInt64(&old.cache.stats.prewarmed, int64(len(warmed)))
+	return warmed
+}
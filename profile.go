@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/x509"
+	"fmt"
+	"strings"
+
+	"github.com/pkkemp/GoOCSPResponder/profiles"
+	"github.com/pkkemp/GoOCSPResponder/profiles/dod"
+)
+
+// noProfile is the generic responder, for a PKI without a profile:
+// bundle_url, crl_base_url and roots must be configured, and CRLs are named
+// after their CA's common name.
+var noProfile = &profiles.Profile{
+	Name:       "none",
+	BundleFile: "bundle.pem",
+	CRLName:    genericCRLName,
+}
+
+var (
+	// activeProfile is the profile selected at startup. It is dod until
+	// then, so the commands that read no configuration keep their
+	// behaviour.
+	activeProfile = dod.Profile
+	// trustAnchors are the roots served issuers must chain to: those of
+	// the profile and of cfg.Roots.
+	trustAnchors = certPool(dod.Profile.Roots)
+)
+
+// lookupProfile finds the profile named in the configuration.
+func lookupProfile(name string) (*profiles.Profile, error) {
+	if name == noProfile.Name {
+		return noProfile, nil
+	}
+	if p, ok := profiles.Lookup(name); ok {
+		return p, nil
+	}
+	return nil, fmt.Errorf("profile %q is not known (want none or one of %s)", name, strings.Join(profiles.Names(), ", "))
+}
+
+// applyProfile fills in the settings the profile provides defaults for.
+func (c *Config) applyProfile() error {
+	p, err := lookupProfile(c.Profile)
+	if err != nil {
+		return err
+	}
+	if c.BundleURL == "" {
+		c.BundleURL = p.BundleURL
+	}
+	if c.CRLBaseURL == "" {
+		c.CRLBaseURL = p.CRLBaseURL
+	}
+	if p == noProfile && c.Roots == "" {
+		return fmt.Errorf("profile none needs roots")
+	}
+	return nil
+}
+
+// useProfile selects the profile of cfg and its trust anchors. It is
+// called at startup only.
+func useProfile(cfg *Config) error {
+	p, err := lookupProfile(cfg.Profile)
+	if err != nil {
+		return err
+	}
+	roots := append([]*x509.Certificate(nil), p.Roots...)
+	if cfg.Roots != "" {
+		extra, err := readCertificates(cfg.Roots)
+		if err != nil {
+			return fmt.Errorf("roots: %v", err)
+		}
+		roots = append(roots, extra...)
+	}
+	if len(roots) == 0 {
+		return fmt.Errorf("profile %s has no roots and none are configured", p.Name)
+	}
+	activeProfile, trustAnchors = p, certPool(roots)
+	return nil
+}
+
+func certPool(certs []*x509.Certificate) *x509.CertPool {
+	pool := x509.NewCertPool()
+	for _, c := range certs {
+		pool.AddCert(c)
+	}
+	return pool
+}
+
+// bundleFile is the name the CA bundle is cached under.
+func bundleFile() string {
+	return activeProfile.BundleFile
+}
+
+// crlFileName is the file name the CRL of the CA cert is published under,
+// or "" for CAs that have none. The issuer registry names an issuer with it
+// when first seen; everything else asks the registry.
+func crlFileName(cert *x509.Certificate) string {
+	return activeProfile.CRLName(cert)
+}
+
+// genericCRLName names the CRL of an issuing CA after its common name:
+// Example Issuing CA 1 publishes EXAMPLE_ISSUING_CA_1.crl. Self-signed
+// and non-CA certificates have none.
+func genericCRLName(cert *x509.Certificate) string {
+	if !cert.IsCA || cert.CheckSignatureFrom(cert) == nil {
+		return ""
+	}
+	slug := issuerSlug(cert.Subject.CommonName)
+	if slug == "" {
+		return ""
+	}
+	return strings.ToUpper(strings.ReplaceAll(slug, "-", "_")) + ".crl"
+}
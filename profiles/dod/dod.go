@@ -0,0 +1,60 @@
+// Package dod is the profile of the DoD PKI: the DoD root CAs, the bundle
+// and CRLs mirrored for the responder, and the DODEMAILCA_63 style CRL
+// names. Importing it registers profile dod, the responder's default.
+package dod
+
+import (
+	"crypto/x509"
+	_ "embed"
+	"strings"
+
+	"github.com/pkkemp/GoOCSPResponder/profiles"
+)
+
+// rootsPEM are the DoD Root CAs 2 to 5 that are currently valid.
+//
+//go:embed roots.pem
+var rootsPEM []byte
+
+// Profile is the DoD profile.
+var Profile = &profiles.Profile{
+	Name:       "dod",
+	BundleURL:  "https://goocsp.blob.core.usgovcloudapi.net/pki/DoD_CAs.pem",
+	CRLBaseURL: "https://goocsp.blob.core.usgovcloudapi.net/crl",
+	BundleFile: "DoD_CAs.pem",
+	CRLName: func(cert *x509.Certificate) string {
+		return CRLName(cert.Subject.CommonName)
+	},
+}
+
+func init() {
+	roots, err := profiles.ParseRoots(rootsPEM)
+	if err != nil {
+		panic(err)
+	}
+	Profile.Roots = roots
+	profiles.Register(Profile)
+}
+
+// CRLName maps a DoD issuing CA common name to the file name its CRL is
+// published under, or "" for CAs that have none.
+func CRLName(commonName string) string {
+	var prefix string
+	switch {
+	case strings.HasPrefix(commonName, "DOD EMAIL"):
+		prefix = "DODEMAILCA_"
+	case strings.HasPrefix(commonName, "DOD ID SW"):
+		prefix = "DODIDSWCA_"
+	case strings.HasPrefix(commonName, "DOD ID"):
+		prefix = "DODIDCA_"
+	case strings.HasPrefix(commonName, "DOD SW"):
+		prefix = "DODSWCA_"
+	default:
+		return ""
+	}
+	parts := strings.SplitAfter(commonName, "-")
+	if len(parts) < 2 {
+		return ""
+	}
+	return prefix + parts[1] + ".crl"
+}
@@ -0,0 +1,91 @@
+// Package profiles holds what the responder knows about one PKI: the roots
+// its issuing CAs chain to, where its bundle and CRLs are published and
+// how its CRLs are named. The responder itself is generic; a profile is
+// selected with profile in its configuration. Profile packages register
+// themselves when imported, so a build can leave out the ones it does not
+// need.
+package profiles
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Profile describes one PKI.
+type Profile struct {
+	Name string
+	// Roots are the trust anchors issuing CAs must chain to.
+	Roots []*x509.Certificate
+	// BundleURL and CRLBaseURL are the default bundle_url and
+	// crl_base_url.
+	BundleURL  string
+	CRLBaseURL string
+	// BundleFile is the name the CA bundle is cached under.
+	BundleFile string
+	// CRLName is the file name the CRL of the CA cert is published under,
+	// or "" for CAs that have none, such as roots.
+	CRLName func(cert *x509.Certificate) string
+}
+
+var (
+	mu       sync.Mutex
+	profiles = make(map[string]*Profile)
+)
+
+// Register makes p available by name. It panics if the name is taken, as
+// two profiles of one name are a programming error.
+func Register(p *Profile) {
+	mu.Lock()
+	defer mu.Unlock()
+	if _, ok := profiles[p.Name]; ok {
+		panic("profiles: " + p.Name + " registered twice")
+	}
+	profiles[p.Name] = p
+}
+
+// Lookup returns the profile registered as name.
+func Lookup(name string) (*Profile, bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	p, ok := profiles[name]
+	return p, ok
+}
+
+// Names lists the registered profiles, sorted.
+func Names() []string {
+	mu.Lock()
+	defer mu.Unlock()
+	names := make([]string, 0, len(profiles))
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ParseRoots parses PEM certificates, for profiles that embed their roots.
+func ParseRoots(data []byte) ([]*x509.Certificate, error) {
+	var roots []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("profiles: %v", err)
+		}
+		roots = append(roots, cert)
+	}
+	if len(roots) == 0 {
+		return nil, fmt.Errorf("profiles: no certificates")
+	}
+	return roots, nil
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkkemp/GoOCSPResponder/responder"
+)
+
+// The main listener carries OCSP, the JSON API and the dashboard on one
+// port, so an enclave firewall needs a single rule. Each request is sorted
+// into a protocol before it is routed: OCSP by its content type or, for GET
+// (RFC 6960 appendix A.1), by a path that is a base64 DER request; the rest
+// by the endpoint its path is registered as. OCSP skips the mux, which
+// would redirect paths with the "//" base64 may contain.
+const (
+	protoOCSP = iota
+	protoAPI
+	protoDashboard
+	protoOther
+	numProtocols
+)
+
+var protocolNames = [numProtocols]string{"ocsp", "api", "dashboard", "other"}
+
+const ocspRequestType = "application/ocsp-request"
+
+// dashboardPrefixes are the paths of the dashboard and its assets.
+var dashboardPrefixes = []string{"/stats", "/static/", "/dashboard/", "/favicon.ico", "/robots.txt"}
+
+// sniffProtocols routes the requests of the main listener by protocol and
+// counts them.
+func sniffProtocols(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		proto, h := protocolOf(mux, r)
+		if pathTooLong(r) {
+			h = pathTooLongHandler
+		}
+		sw := statusWriters.Get().(*statusWriter)
+		sw.ResponseWriter, sw.status = w, 0
+		h.ServeHTTP(sw, r)
+		if sw.status == 0 {
+			// net/http answers 200 for a handler that wrote nothing.
+			sw.status = http.StatusOK
+		}
+		protocolStats[proto].record(sw.status, time.Since(start))
+		sw.ResponseWriter = nil
+		statusWriters.Put(sw)
+	})
+}
+
+// protocolOf sorts r into a protocol and returns the handler for it.
+func protocolOf(mux *http.ServeMux, r *http.Request) (int, http.Handler) {
+	switch r.Method {
+	case http.MethodPost:
+		if r.Header.Get("Content-Type") == ocspRequestType {
+			return protoOCSP, http.HandlerFunc(ocspHandler)
+		}
+	case http.MethodGet:
+		if _, enc := currentState().routeGET(r.URL.Path); responder.LooksLikeGET(enc) {
+			return protoOCSP, http.HandlerFunc(ocspHandler)
+		}
+	}
+	h, pattern := mux.Handler(r)
+	switch {
+	case pattern == "/":
+		// The root handler answers OCSP POSTs to the root and routed
+		// paths, whatever their content type; see ocspHandler.
+		if r.Method == http.MethodPost {
+			return protoOCSP, h
+		}
+		return protoOther, h
+	case pattern == "":
+		return protoOther, h
+	}
+	for _, p := range dashboardPrefixes {
+		if strings.HasPrefix(pattern, p) {
+			return protoDashboard, h
+		}
+	}
+	return protoAPI, h
+}
+
+// statusWriter records the status a handler answered with.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+var statusWriters = sync.Pool{New: func() interface{} { return new(statusWriter) }}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// protoCounters are the counters of one protocol: requests by status
+// class and latency, as for client classes.
+type protoCounters struct {
+	statuses  [6]int64 // by status / 100
+	latency   [len(latencyBuckets) + 1]int64
+	totalNano int64
+}
+
+var protocolStats [numProtocols]protoCounters
+
+func (c *protoCounters) record(status int, took time.Duration) {
+	class := status / 100
+	if class < 0 || class >= len(c.statuses) {
+		class = 0
+	}
+	atomic.AddInt64(&c.statuses[class], 1)
+	atomic.AddInt64(&c.totalNano, int64(took))
+	i := 0
+	for i < len(latencyBuckets) && took > latencyBuckets[i] {
+		i++
+	}
+	atomic.AddInt64(&c.latency[i], 1)
+}
+
+// protocolReport is the JSON form of a protocol's counters.
+type protocolReport struct {
+	Requests int64 `json:"requests"`
+	// Statuses counts responses by status class: 2xx, 4xx and so on.
+	Statuses      map[string]int64 `json:"statuses"`
+	Latency       map[string]int64 `json:"latency"`
+	MeanLatencyMs float64          `json:"mean_latency_ms"`
+}
+
+func (c *protoCounters) report() protocolReport {
+	r := protocolReport{Statuses: make(map[string]int64), Latency: make(map[string]int64)}
+	for i := range c.statuses {
+		n := atomic.LoadInt64(&c.statuses[i])
+		r.Requests += n
+		if n > 0 && i > 0 {
+			r.Statuses[string(rune('0'+i))+"xx"] = n
+		}
+	}
+	var cumulative int64
+	for i := range c.latency {
+		cumulative += atomic.LoadInt64(&c.latency[i])
+		bound := "+Inf"
+		if i < len(latencyBuckets) {
+			bound = latencyBuckets[i].String()
+		}
+		r.Latency[bound] = cumulative
+	}
+	if r.Requests > 0 {
+		r.MeanLatencyMs = float64(atomic.LoadInt64(&c.totalNano)) / float64(r.Requests) / 1e6
+	}
+	return r
+}
+
+func protocolReports() map[string]protocolReport {
+	reports := make(map[string]protocolReport, numProtocols)
+	for i := range protocolStats {
+		reports[protocolNames[i]] = protocolStats[i].report()
+	}
+	return reports
+}
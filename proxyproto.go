@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The PROXY protocol (HAProxy's proxy-protocol.txt, versions 1 and 2) lets
+// a TCP load balancer pass the client's address ahead of the request. It
+// is read only from trusted proxies, and is optional from them, so health
+// checks without a header still work; anyone else who sends one gets a
+// malformed request.
+
+// proxyV2Signature starts every version 2 header.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyHeaderTimeout bounds how long a trusted proxy may take to send its
+// header.
+const proxyHeaderTimeout = 5 * time.Second
+
+// proxyProtocolListener accepts the PROXY protocol on the connections of
+// ln from the trusted proxies of the current state.
+func proxyProtocolListener(ln net.Listener) net.Listener {
+	return &proxyListener{Listener: ln}
+}
+
+type proxyListener struct {
+	net.Listener
+}
+
+func (l *proxyListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyConn{Conn: c}, nil
+}
+
+// proxyConn reads the PROXY header, if any, the first time the connection
+// is used. net/http asks for the remote address first, on the
+// connection's own goroutine, so the listener never waits for a header.
+type proxyConn struct {
+	net.Conn
+	once   sync.Once
+	r      io.Reader
+	remote net.Addr
+	err    error
+}
+
+func (c *proxyConn) init() {
+	c.once.Do(func() {
+		c.r, c.remote = c.Conn, c.Conn.RemoteAddr()
+		tcp, ok := c.remote.(*net.TCPAddr)
+		if !ok || !containsIP(currentState().clients.trustedProxies(), tcp.IP) {
+			return
+		}
+		br := bufio.NewReader(c.Conn)
+		c.r = br
+		c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		defer c.Conn.SetReadDeadline(time.Time{})
+		var src net.Addr
+		src, c.err = readProxyHeader(br)
+		if c.err != nil {
+			c.err = fmt.Errorf("PROXY header from %s: %v", c.remote, c.err)
+			return
+		}
+		if src != nil {
+			c.remote = src
+		}
+	})
+}
+
+func (c *proxyConn) Read(p []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(p)
+}
+
+// RemoteAddr returns the client's address from the PROXY header, or the
+// peer's without one.
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.init()
+	return c.remote
+}
+
+var errProxyHeader = errors.New("malformed header")
+
+// readProxyHeader reads a PROXY header from r if one is there, returning
+// the source address it carries. It returns nil for a connection without
+// a header and for headers without an address: LOCAL and UNKNOWN, which
+// proxies send for their own connections, and non-TCP families.
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	start, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	switch start[0] {
+	case '\r':
+		return readProxyV2(r)
+	case 'P':
+		if b, err := r.Peek(6); err == nil && string(b) == "PROXY " {
+			return readProxyV1(r)
+		}
+	}
+	return nil, nil
+}
+
+// readProxyV1 reads a text header:
+// "PROXY TCP4|TCP6|UNKNOWN src dst sport dport\r\n", at most 107 bytes.
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < 107 {
+		c, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, c)
+		if c == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errProxyHeader
+	}
+	f := strings.Fields(string(line[:len(line)-2]))
+	if len(f) >= 2 && f[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(f) != 6 || (f[1] != "TCP4" && f[1] != "TCP6") {
+		return nil, errProxyHeader
+	}
+	ip := net.ParseIP(f[2])
+	port, err := strconv.ParseUint(f[4], 10, 16)
+	if ip == nil || err != nil || (ip.To4() != nil) != (f[1] == "TCP4") {
+		return nil, errProxyHeader
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyV2 reads a binary header: the signature, version and command,
+// family and protocol, and the length of the addresses that follow.
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	var hdr [16]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(hdr[:12], proxyV2Signature) || hdr[12]>>4 != 2 {
+		return nil, errProxyHeader
+	}
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	switch hdr[12] & 0x0f {
+	case 0: // LOCAL
+		return nil, nil
+	case 1: // PROXY
+	default:
+		return nil, errProxyHeader
+	}
+	var size int
+	switch hdr[13] {
+	case 0x11: // TCP over IPv4
+		size = net.IPv4len
+	case 0x21: // TCP over IPv6
+		size = net.IPv6len
+	default:
+		return nil, nil
+	}
+	if len(body) < 2*size+4 {
+		return nil, errProxyHeader
+	}
+	ip := net.IP(append([]byte(nil), body[:size]...))
+	return &net.TCPAddr{IP: ip, Port: int(binary.BigEndian.Uint16(body[2*size:]))}, nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+)
+
+// proxyV2 builds a version 2 header with the command, family and address
+// block given, and the length field set to length.
+func proxyV2(command, family byte, length int, body []byte) string {
+	hdr := append([]byte(nil), proxyV2Signature...)
+	hdr = append(hdr, 0x20|command, family, 0, 0)
+	binary.BigEndian.PutUint16(hdr[14:], uint16(length))
+	return string(append(hdr, body...))
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	v4 := []byte{192, 0, 2, 1, 198, 51, 100, 7, 0x30, 0x39, 0x01, 0xbb}
+	v6 := append(append(net.ParseIP("2001:db8::1").To16(), net.ParseIP("2001:db8::2").To16()...), 0x30, 0x39, 0x01, 0xbb)
+	for _, tc := range []struct {
+		name, in string
+		want     string // the address, or "" for none
+		err      bool
+	}{
+		{name: "no header", in: "GET / HTTP/1.1\r\n"},
+		{name: "v1 TCP4", in: "PROXY TCP4 192.0.2.1 198.51.100.7 12345 443\r\n", want: "192.0.2.1:12345"},
+		{name: "v1 TCP6", in: "PROXY TCP6 2001:db8::1 2001:db8::2 12345 443\r\n", want: "[2001:db8::1]:12345"},
+		{name: "v1 UNKNOWN", in: "PROXY UNKNOWN\r\n"},
+		{name: "v1 UNKNOWN with addresses", in: "PROXY UNKNOWN 192.0.2.1 198.51.100.7 12345 443\r\n"},
+		{name: "v1 TCP4 with an IPv6 address", in: "PROXY TCP4 2001:db8::1 2001:db8::2 12345 443\r\n", err: true},
+		{name: "v1 TCP6 with an IPv4 address", in: "PROXY TCP6 192.0.2.1 198.51.100.7 12345 443\r\n", err: true},
+		{name: "v1 bad port", in: "PROXY TCP4 192.0.2.1 198.51.100.7 65536 443\r\n", err: true},
+		{name: "v1 missing field", in: "PROXY TCP4 192.0.2.1 198.51.100.7 12345\r\n", err: true},
+		{name: "v1 bare newline", in: "PROXY TCP4 192.0.2.1 198.51.100.7 12345 443\n", err: true},
+		{name: "v1 too long", in: "PROXY TCP4 " + strings.Repeat("1", 120) + "\r\n", err: true},
+		{name: "v1 truncated", in: "PROXY TCP4 192.0.2.1", err: true},
+		{name: "v2 LOCAL", in: proxyV2(0, 0, 0, nil)},
+		{name: "v2 LOCAL with addresses", in: proxyV2(0, 0x11, len(v4), v4)},
+		{name: "v2 PROXY TCP4", in: proxyV2(1, 0x11, len(v4), v4), want: "192.0.2.1:12345"},
+		{name: "v2 PROXY TCP6", in: proxyV2(1, 0x21, len(v6), v6), want: "[2001:db8::1]:12345"},
+		{name: "v2 PROXY TCP4 with TLVs", in: proxyV2(1, 0x11, len(v4)+4, append(append([]byte(nil), v4...), 0x04, 0, 1, 0)), want: "192.0.2.1:12345"},
+		{name: "v2 PROXY UDP4", in: proxyV2(1, 0x12, len(v4), v4)},
+		{name: "v2 PROXY unix", in: proxyV2(1, 0x31, 216, make([]byte, 216))},
+		{name: "v2 bad command", in: proxyV2(2, 0x11, len(v4), v4), err: true},
+		{name: "v2 bad version", in: strings.Replace(proxyV2(1, 0x11, len(v4), v4), "\x21\x11", "\x11\x11", 1), err: true},
+		{name: "v2 bad signature", in: "\r\n\r\n\x00\r\nQUIT\r\x21\x11\x00\x0c" + string(v4), err: true},
+		{name: "v2 length short of the addresses", in: proxyV2(1, 0x11, 8, v4[:8]), err: true},
+		{name: "v2 length short of an IPv6 address", in: proxyV2(1, 0x21, len(v4), v4), err: true},
+		{name: "v2 length past the data", in: proxyV2(1, 0x11, len(v4)+10, v4), err: true},
+		{name: "v2 truncated signature", in: string(proxyV2Signature[:8]), err: true},
+		{name: "v2 truncated length", in: proxyV2(1, 0x11, 0, nil)[:15], err: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := bufio.NewReader(strings.NewReader(tc.in + "rest"))
+			addr, err := readProxyHeader(r)
+			if tc.err {
+				if err == nil {
+					t.Fatalf("readProxyHeader = %v, want an error", addr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := ""
+			if addr != nil {
+				got = addr.String()
+			}
+			if got != tc.want {
+				t.Errorf("readProxyHeader = %q, want %q", got, tc.want)
+			}
+			rest, _ := ioutil.ReadAll(r)
+			if want := "rest"; tc.name == "no header" {
+				if string(rest) != tc.in+want {
+					t.Errorf("left %q, want the request untouched", rest)
+				}
+			} else if string(rest) != want {
+				t.Errorf("left %q after the header, want %q", rest, want)
+			}
+		})
+	}
+}
+
+func TestReadProxyHeaderEOF(t *testing.T) {
+	if _, err := readProxyHeader(bufio.NewReader(strings.NewReader(""))); err != io.EOF {
+		t.Errorf("readProxyHeader of nothing = %v, want EOF", err)
+	}
+}
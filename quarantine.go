@@ -0,0 +1,111 @@
+package main
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkkemp/GoOCSPResponder/responder"
+)
+
+// QuarantineConfig decides what happens to an issuer whose CRL cannot be
+// trusted: one signed with an algorithm Go cannot verify or that policy
+// forbids, or whose signature does not verify. Such a CRL is loaded in
+// quarantine: it is reported on the dashboard and by explain, and its
+// issuer's serials are never answered good.
+type QuarantineConfig struct {
+	// Answer is tryLater (the default), which fails whole requests that
+	// touch the issuer, or unknown, which answers its CertIDs unknown.
+	Answer string `yaml:"answer"`
+	// ForbiddenAlgorithms are CRL signature algorithms to refuse, by Go
+	// name (SHA1-RSA, ECDSA-SHA1, ...). In FIPS mode every algorithm that
+	// is not approved is refused as well.
+	ForbiddenAlgorithms []string `yaml:"forbidden_algorithms"`
+}
+
+func (c QuarantineConfig) validate() error {
+	switch c.Answer {
+	case "", "tryLater", "unknown":
+		return nil
+	}
+	return fmt.Errorf("quarantine.answer %q must be tryLater or unknown", c.Answer)
+}
+
+// algorithmName names a CRL signature algorithm, falling back to its OID.
+func algorithmName(crl *pkix.CertificateList) string {
+	if algo := responder.CRLSignatureAlgorithm(crl); algo != x509.UnknownSignatureAlgorithm {
+		return algo.String()
+	}
+	return crl.SignatureAlgorithm.Algorithm.String()
+}
+
+// forbiddenAlgorithm returns why policy refuses a CRL signed with algo, or
+// "" if it does not.
+func forbiddenAlgorithm(cfg *Config, algo x509.SignatureAlgorithm, name string) string {
+	for _, f := range cfg.Quarantine.ForbiddenAlgorithms {
+		if strings.EqualFold(f, name) {
+			return fmt.Sprintf("signature algorithm %s is forbidden by policy", name)
+		}
+	}
+	if cfg.FIPS {
+		if err := fipsApprovedSignature(algo); err != nil {
+			return fmt.Sprintf("signature algorithm %s is not FIPS approved", name)
+		}
+	}
+	return ""
+}
+
+// quarantineReason checks the signature of parsed against its CA and the
+// algorithm against policy. It returns why the CRL must be quarantined,
+// or "" if it can be trusted.
+func quarantineReason(cfg *Config, crl CRLInfo, parsed *pkix.CertificateList) string {
+	name := algorithmName(parsed)
+	if reason := forbiddenAlgorithm(cfg, responder.CRLSignatureAlgorithm(parsed), name); reason != "" {
+		return reason
+	}
+	err := crl.CA.CheckCRLSignature(parsed)
+	var insecure x509.InsecureAlgorithmError
+	switch {
+	case err == nil:
+		return ""
+	case errors.Is(err, x509.ErrUnsupportedAlgorithm), errors.As(err, &insecure):
+		return fmt.Sprintf("signature algorithm %s cannot be verified", name)
+	}
+	return fmt.Sprintf("signature does not verify against %s: %v", printableName(crl.CA.Subject.CommonName), err)
+}
+
+// quarantined returns the index of a CRL that cannot be trusted: it
+// carries the CRL's dates for reporting but no entries.
+func quarantined(crl CRLInfo, parsed *pkix.CertificateList, reason string) CRLBloomFilter {
+	return CRLBloomFilter{
+		crlInfo:    crl,
+		quarantine: reason,
+		thisUpdate: parsed.TBSCertList.ThisUpdate,
+		nextUpdate: parsed.TBSCertList.NextUpdate,
+		crlNumber:  crlNumber(parsed),
+		loadedAt:   time.Now(),
+	}
+}
+
+// rollbackReason returns why next, a trusted CRL of an issuer served from
+// prev, is older than prev and must not replace it, or "". A CRL number
+// lower than the served one is a rollback; without numbers, so is an
+// earlier thisUpdate. Nothing is older than an untrusted or missing CRL.
+func rollbackReason(prev, next CRLBloomFilter) string {
+	if prev.quarantine != "" || prev.pending || !prev.indexed() {
+		return ""
+	}
+	if prev.crlNumber != nil && next.crlNumber != nil {
+		if next.crlNumber.Cmp(prev.crlNumber) < 0 {
+			return fmt.Sprintf("CRL number %s is older than the served %s", next.crlNumber, prev.crlNumber)
+		}
+		return ""
+	}
+	if next.thisUpdate.Before(prev.thisUpdate) {
+		return fmt.Sprintf("thisUpdate %s is older than the served %s", next.thisUpdate.UTC().Format(time.RFC3339), prev.thisUpdate.UTC().Format(time.RFC3339))
+	}
+	return ""
+}
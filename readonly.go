@@ -0,0 +1,47 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// readOnly is set by --read-only at startup. A read-only responder serves
+// the CRLs already in its cache directory, such as a copy of /cache taken
+// during an incident, and never changes them: nothing is downloaded, the
+// configuration is not reloaded, nothing is archived or indexed to disk,
+// and admin actions that change state are refused.
+var readOnly bool
+
+var errReadOnly = errors.New("read-only mode")
+
+// setCacheDir points the responder at dir instead of defaultCacheDir.
+func setCacheDir(dir string) {
+	if !strings.HasSuffix(dir, "/") && !strings.HasSuffix(dir, string(filepath.Separator)) {
+		dir += string(filepath.Separator)
+	}
+	rootDir = dir
+}
+
+// checkReadOnly rejects configurations that need to write to the cache.
+func checkReadOnly(cfg *Config) error {
+	if cfg.Standby.Role == "standby" {
+		return errors.New("--read-only: a warm standby installs the primary's CRLs")
+	}
+	if cfg.Region.secondary() {
+		return errors.New("--read-only: a secondary region installs the primary's CRLs")
+	}
+	return nil
+}
+
+// writable refuses h in read-only mode.
+func writable(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if readOnly {
+			http.Error(w, "read-only mode", http.StatusForbidden)
+			return
+		}
+		h(w, r)
+	}
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// refreshOffset is the fixed position of an issuer's refresh within the
+// refresh interval. It is derived from the jitter seed and the issuer so a
+// given instance always refreshes an issuer at the same point, while
+// different instances and issuers are spread across the interval.
+func refreshOffset(cfg *Config, key string) time.Duration {
+	seed := cfg.Refresh.JitterSeed
+	if seed == "" {
+		seed, _ = os.Hostname()
+	}
+	h := fnv.New64a()
+	h.Write([]byte(seed + "/" + key))
+	return time.Duration(h.Sum64() % uint64(cfg.Refresh.Interval))
+}
+
+// nextRefresh returns the first refresh slot for key strictly after now.
+func nextRefresh(cfg *Config, key string, now time.Time) time.Time {
+	next := now.Truncate(cfg.Refresh.Interval).Add(refreshOffset(cfg, key))
+	if !next.After(now) {
+		next = next.Add(cfg.Refresh.Interval)
+	}
+	return next
+}
+
+// runRefresher refreshes each served CRL in its own slot, one at a time,
+// and issuers in a revocation surge every surge interval, ahead of the
+// others. Downloads share downloadLimiter, so the aggregate rate stays
+// under the configured cap however many issuers come due together.
+func runRefresher(hb heartbeat) {
+	var cfg *Config
+	next := make(map[string]time.Time)
+	// last is when each issuer was last refreshed, for surge intervals.
+	last := make(map[string]time.Time)
+	for {
+		st := currentState()
+		if st.cfg != cfg {
+			// A new configuration may change the interval or seed.
+			cfg = st.cfg
+			next = make(map[string]time.Time)
+		}
+		now := time.Now()
+		wake := now.Add(time.Minute)
+		for _, key := range expireFreezes(now) {
+			next[key] = now
+		}
+		for _, crl := range surges.prioritize(cfg.Refresh.Surge, st.crls, now) {
+			key := crl.key()
+			t, ok := next[key]
+			if !ok {
+				t = nextRefresh(cfg, key, now)
+			}
+			if surges.active(cfg.Refresh.Surge, key, now) {
+				if _, ok := last[key]; !ok {
+					last[key] = now
+				}
+				if fast := last[key].Add(cfg.Refresh.Surge.Interval); fast.Before(t) {
+					t = fast
+				}
+			}
+			if !t.After(now) {
+				if err := refreshCRL(crl); err != nil {
+					log.Printf("refresh %s: %v", crl.FileName, err)
+				}
+				last[key] = time.Now()
+				t = nextRefresh(cfg, key, time.Now())
+				if !hb.beat(0) {
+					return
+				}
+			}
+			next[key] = t
+			if t.Before(wake) {
+				wake = t
+			}
+		}
+		if !hb.sleep(time.Until(wake)) {
+			return
+		}
+	}
+}
+
+// refreshCRL downloads and re-indexes one CRL and swaps it into the current
+// state.
+func refreshCRL(crl CRLInfo) error {
+	cfg := currentState().cfg
+	if fr := currentFreeze(crl.key()); fr != nil {
+		return fmt.Errorf("not refreshed: %s", fr)
+	}
+	info, err := downloadCRL(cfg, crl.CA, crl.FileName)
+	if err == errNotModified {
+		return nil
+	}
+	var lerr *crlLimitError
+	if errors.As(err, &lerr) {
+		return quarantineOversized(cfg, crl, lerr)
+	}
+	if err != nil {
+		return err
+	}
+	if err := loadCRL(cfg, crl, info, "refreshed"); err != nil && err != errIssuerDropped {
+		return err
+	}
+	return nil
+}
+
+// stagedName is where a download of the CRL cached as fileName waits, in
+// the same directory, until it is parsed, verified and indexed: one that
+// fails any of these never replaces the last good copy.
+func stagedName(fileName string) string {
+	return fileName + ".new"
+}
+
+// commitStagedCRL moves the staged download of the CRL of ca over the
+// cached fileName. If the download does not parse or verify while a cached
+// copy exists, it is dropped and the cached copy kept, with an error. The
+// first download of an issuer is committed regardless, so that indexing
+// quarantines it.
+func commitStagedCRL(cfg *Config, ca *x509.Certificate, fileName string) error {
+	staged := rootDir + stagedName(fileName)
+	if _, err := os.Stat(rootDir + fileName); err == nil {
+		if reason := stagedProblem(cfg, CRLInfo{CA: ca, FileName: stagedName(fileName)}); reason != "" {
+			os.Remove(staged)
+			return fmt.Errorf("kept the cached CRL: %s", reason)
+		}
+	}
+	return os.Rename(staged, rootDir+fileName)
+}
+
+// stagedProblem returns why the staged CRL crl may not be served, if it
+// may not.
+func stagedProblem(cfg *Config, crl CRLInfo) string {
+	der, err := os.ReadFile(rootDir + crl.FileName)
+	if err != nil {
+		return err.Error()
+	}
+	scanned, err := scanCRLFor(cfg, crl, der)
+	if err != nil {
+		return err.Error()
+	}
+	return quarantineReason(cfg, crl, scanned.CertificateList)
+}
+
+// errIssuerDropped is returned by loadCRL when a reload stopped serving
+// the issuer meanwhile.
+var errIssuerDropped = errors.New("the issuer is no longer served")
+
+// loadCRL indexes the CRL of crl that was just staged next to its cached
+// copy as info, and swaps it into the current state: it is archived,
+// diffed for revocation events and sent to standbys. The staged file
+// replaces the cached copy only once it is indexed and trusted; a CRL
+// older than the served one is refused, see rollbackReason. how names the
+// cause in the log. Refreshes and uploads share it.
+func loadCRL(cfg *Config, crl CRLInfo, info CRLInfo, how string) error {
+	info.CA = crl.CA
+	defer os.Remove(rootDir + stagedName(crl.FileName))
+	filter, err := ConstructBloomFilter(cfg, info)
+	if err != nil {
+		return err
+	}
+	if filter.quarantine == "" {
+		if reason := rollbackReason(currentState().filters[crl.key()], filter); reason != "" {
+			return fmt.Errorf("kept the previous CRL: %s", reason)
+		}
+		if err := os.Rename(rootDir+info.FileName, rootDir+crl.FileName); err != nil {
+			return err
+		}
+	}
+	// A quarantined download is dropped; the cached copy stays the last
+	// good CRL for the next start.
+	info.FileName = crl.FileName
+	filter.crlInfo = info
+	filter.crlID = crlIDExtensions(cfg, filter)
+	if err := archiveCRL(cfg, filter); err != nil {
+		log.Printf("archive %s: %v", crl.FileName, err)
+	}
+	var evs []revocationEvent
+	diffed := false
+	if prev := currentState().filters[crl.key()]; (events != nil || cfg.Refresh.Surge.Enabled) && filter.quarantine == "" && prev.indexed() && prev.quarantine == "" {
+		// Only a diff against a trusted CRL tells new revocations apart.
+		parsed, err := parseCRL(info.FileName)
+		if err != nil {
+			return err
+		}
+		evs, diffed = crlEvents(prev, crl, parsed, time.Now()), true
+	}
+
+	if ok, err := installFilter(crl, filter); !ok {
+		if err == nil {
+			err = errIssuerDropped
+		}
+		return err
+	}
+	log.Printf("%s %s: %d bytes, %d entries", how, crl.FileName, info.Size, filter.size())
+	if events != nil {
+		events.enqueue(evs)
+	}
+	standbyStreams.publishCRL(crl)
+	if diffed && cfg.Refresh.Surge.Enabled {
+		observeSurge(cfg, crl, addedRevocations(evs))
+	}
+	return nil
+}
+
+// installFilter swaps filter in as the index of crl in the current state
+// and drops the responses cached from the old one. It reports false if the
+// issuer was dropped by a reload in the meantime, or with an error if a
+// quarantined filter was refused or the issuer is frozen; see freeze.go.
+func installFilter(crl CRLInfo, filter CRLBloomFilter) (bool, error) {
+	filter = currentState().pruneExpired(crl.key(), filter, time.Now())
+	warmed := prewarm(currentState(), crl, filter)
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	old := currentState()
+	prev, ok := old.filters[crl.key()]
+	if !ok {
+		return false, nil
+	}
+	if err := frozenOut(crl.key(), filter); err != nil {
+		return false, err
+	}
+	if filter.quarantine != "" && prev.quarantine == "" && (prev.nextUpdate.IsZero() || time.Now().Before(prev.nextUpdate)) {
+		// Keep answering from the last trusted CRL while it is current.
+		return false, fmt.Errorf("kept the previous CRL: %s", filter.quarantine)
+	}
+	next := *old
+	next.filters = make(map[string]CRLBloomFilter, len(old.filters))
+	for k, v := range old.filters {
+		next.filters[k] = v
+	}
+	next.filters[crl.key()] = filter
+	next.cache = old.cache.without(crl.key())
+	next.cache.adopt(warmed, time.Now())
+	updateCascades(old, &next)
+	current.Store(&next)
+	expireBlocklist(&next)
+	return true, nil
+}
+
+// bandwidthLimiter is a token bucket shared by all downloads.
+type bandwidthLimiter struct {
+	mu     sync.Mutex
+	rate   float64 // bytes per second; 0 disables limiting
+	tokens float64
+	last   time.Time
+}
+
+var downloadLimiter = &bandwidthLimiter{}
+
+func (l *bandwidthLimiter) setRate(bytesPerSecond int64) {
+	l.mu.Lock()
+	l.rate = float64(bytesPerSecond)
+	l.mu.Unlock()
+}
+
+// wait blocks until n bytes may be transferred.
+func (l *bandwidthLimiter) wait(n int) {
+	l.mu.Lock()
+	if l.rate == 0 {
+		l.mu.Unlock()
+		return
+	}
+	now := time.Now()
+	if !l.last.IsZero() {
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+		// Allow at most one second of burst.
+		if l.tokens > l.rate {
+			l.tokens = l.rate
+		}
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	// The debt is booked before sleeping, so the downloads that follow
+	// wait behind this one and the aggregate rate stays capped without
+	// holding the lock through the sleep.
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+	time.Sleep(delay)
+}
+
+func (l *bandwidthLimiter) reader(r io.Reader) io.Reader {
+	return &limitedReader{r: r, l: l}
+}
+
+type limitedReader struct {
+	r io.Reader
+	l *bandwidthLimiter
+}
+
+func (lr *limitedReader) Read(p []byte) (int, error) {
+	// Small reads keep the rate smooth instead of bursting a whole buffer.
+	if len(p) > 32<<10 {
+		p = p[:32<<10]
+	}
+	n, err := lr.r.Read(p)
+	lr.l.wait(n)
+	return n, err
+}
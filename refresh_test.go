@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRefreshSlots(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Refresh.Interval = time.Hour
+	cfg.Refresh.JitterSeed = "node-a"
+	offsets := make(map[time.Duration]bool)
+	for _, key := range []string{"CA_1", "CA_2", "CA_3", "CA_4"} {
+		off := refreshOffset(cfg, key)
+		if off < 0 || off >= cfg.Refresh.Interval {
+			t.Errorf("%s: offset %v outside the interval", key, off)
+		}
+		if again := refreshOffset(cfg, key); again != off {
+			t.Errorf("%s: offset %v, then %v for the same seed", key, off, again)
+		}
+		offsets[off] = true
+
+		now := time.Date(2026, 1, 2, 3, 0, 0, 0, time.UTC)
+		for i := 0; i < 8; i++ {
+			next := nextRefresh(cfg, key, now)
+			if !next.After(now) || next.Sub(now) > cfg.Refresh.Interval {
+				t.Errorf("%s: next refresh after %v is %v", key, now, next)
+			}
+			if slot := next.Sub(next.Truncate(cfg.Refresh.Interval)); slot != off {
+				t.Errorf("%s: next refresh %v is not in slot %v", key, next, off)
+			}
+			// The refresh at its slot is not due again until the next
+			// interval.
+			now = next
+		}
+	}
+	if len(offsets) < 2 {
+		t.Error("every issuer refreshes in the same slot")
+	}
+
+	other := *cfg
+	other.Refresh.JitterSeed = "node-b"
+	moved := false
+	for _, key := range []string{"CA_1", "CA_2", "CA_3", "CA_4"} {
+		moved = moved || refreshOffset(&other, key) != refreshOffset(cfg, key)
+	}
+	if !moved {
+		t.Error("another seed gives the same slots")
+	}
+}
+
+// TestBandwidthLimiter reads through one limiter from several goroutines:
+// together they may not exceed its rate.
+func TestBandwidthLimiter(t *testing.T) {
+	const rate, readers, size = 1 << 20, 4, 64 << 10
+	l := &bandwidthLimiter{}
+	l.setRate(rate)
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < readers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			io.Copy(io.Discard, l.reader(bytes.NewReader(make([]byte, size))))
+		}()
+	}
+	wg.Wait()
+	// Nothing was banked before the first read, so the last byte is
+	// allowed no earlier than readers*size/rate after it.
+	want := time.Duration(float64(readers*size) / rate * float64(time.Second))
+	if elapsed := time.Since(start); elapsed < want*9/10 {
+		t.Errorf("read %d bytes in %v, want at least %v at %d bytes/s", readers*size, elapsed, want, rate)
+	}
+}
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// RegionConfig places the responder in a multi-region deployment. A
+// primary region downloads CRLs from the distribution point as usual and
+// serves them to secondaries over the replication API; secondaries are
+// read only and take every CRL from the primary instead. Subordinates are
+// secondaries that take the CA bundle from the primary too, so edge
+// responders fetch nothing from outside; they trust what they are sent no
+// more than a public bundle or CRL. It is read at startup only.
+type RegionConfig struct {
+	// Name identifies the region in /healthz, response headers and, with
+	// ResponseExtension, in the responses themselves.
+	Name string `yaml:"name"`
+	// Role is primary (the default), secondary or subordinate.
+	Role string `yaml:"role"`
+	// Primary is the base URL of the primary region, for secondaries.
+	Primary string `yaml:"primary"`
+	// TokenFile holds the replication token: the one secondaries must
+	// present on a primary, and the one a secondary presents.
+	TokenFile string `yaml:"token_file"`
+	// MaxLag makes /healthz answer 503 on a secondary that has not synced
+	// with the primary for this long, so global load balancers route
+	// around it. 0 disables the check.
+	MaxLag time.Duration `yaml:"max_lag"`
+	// ResponseExtension adds the region name to every response as a
+	// non-critical extension with this OID, a UTF8String. Take it from an
+	// arc your organization controls; empty leaves responses unchanged.
+	ResponseExtension string `yaml:"response_extension"`
+	// Failover lists OCSP URLs in other regions, advertised to clients and
+	// proxies in Link headers.
+	Failover []string `yaml:"failover"`
+
+	// token is the contents of TokenFile.
+	token string
+}
+
+func (c RegionConfig) validate() error {
+	switch c.Role {
+	case "", "primary":
+		if c.Primary != "" {
+			return errors.New("region: primary is only for secondaries")
+		}
+	case "secondary", "subordinate":
+		u, err := url.Parse(c.Primary)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("region: secondary needs the primary's http(s) URL, not %q", c.Primary)
+		}
+		if c.TokenFile == "" {
+			return fmt.Errorf("region: %s requires token_file", c.Role)
+		}
+	default:
+		return fmt.Errorf("region: unknown role %q (want primary, secondary or subordinate)", c.Role)
+	}
+	if c.ResponseExtension != "" {
+		if c.Name == "" {
+			return errors.New("region: response_extension requires name")
+		}
+		if _, err := parseOID(c.ResponseExtension); err != nil {
+			return fmt.Errorf("region: response_extension: %v", err)
+		}
+	}
+	if c.MaxLag < 0 {
+		return errors.New("region: max_lag must not be negative")
+	}
+	return nil
+}
+
+// secondary reports whether CRLs come from the primary, as they do on
+// subordinates.
+func (c RegionConfig) secondary() bool {
+	return c.Role == "secondary" || c.Role == "subordinate"
+}
+
+// subordinate reports whether the CA bundle comes from the primary too.
+func (c RegionConfig) subordinate() bool {
+	return c.Role == "subordinate"
+}
+
+// parseOID parses a dotted OID.
+func parseOID(s string) (asn1.ObjectIdentifier, error) {
+	parts := strings.Split(s, ".")
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("%q is not a dotted OID", s)
+	}
+	oid := make(asn1.ObjectIdentifier, len(parts))
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("%q is not a dotted OID", s)
+		}
+		oid[i] = n
+	}
+	return oid, nil
+}
+
+// region is the state of the multi-region setup, set at startup.
+var region struct {
+	// name and failover are the Ocsp-Region and Link header values.
+	name, failover []string
+	// extensions are added to every signed response.
+	extensions []pkix.Extension
+	// lastSync is when a secondary last heard from its primary, in Unix
+	// nanoseconds.
+	lastSync int64
+}
+
+// setupRegion prepares the response headers and extension for cfg.
+func setupRegion(cfg RegionConfig) {
+	if cfg.Name != "" {
+		region.name = []string{cfg.Name}
+	}
+	if len(cfg.Failover) > 0 {
+		links := make([]string, len(cfg.Failover))
+		for i, u := range cfg.Failover {
+			links[i] = "<" + u + `>; rel="alternate"`
+		}
+		region.failover = []string{strings.Join(links, ", ")}
+	}
+	if cfg.ResponseExtension != "" {
+		oid, _ := parseOID(cfg.ResponseExtension)
+		value, _ := asn1.MarshalWithParams(cfg.Name, "utf8")
+		region.extensions = []pkix.Extension{{Id: oid, Value: value}}
+	}
+}
+
+// setRegionHeaders adds the region and failover hints to an OCSP response.
+// The values are built once, so the fast path stays allocation free.
+func setRegionHeaders(h http.Header) {
+	if region.name != nil {
+		h["Ocsp-Region"] = region.name
+	}
+	if region.failover != nil {
+		h["Link"] = region.failover
+	}
+}
+
+// regionStatus is the region section of /healthz.
+type regionStatus struct {
+	Name     string     `json:"name,omitempty"`
+	Role     string     `json:"role"`
+	Primary  string     `json:"primary,omitempty"`
+	LastSync *time.Time `json:"last_sync,omitempty"`
+	Stale    bool       `json:"stale,omitempty"`
+}
+
+func currentRegionStatus(cfg *Config) regionStatus {
+	s := regionStatus{Name: cfg.Region.Name, Role: "primary"}
+	if !cfg.Region.secondary() {
+		return s
+	}
+	s.Role, s.Primary = cfg.Region.Role, cfg.Region.Primary
+	last := atomic.LoadInt64(&region.lastSync)
+	if last != 0 {
+		t := time.Unix(0, last).UTC()
+		s.LastSync = &t
+	}
+	s.Stale = cfg.Region.MaxLag > 0 && (last == 0 || time.Since(time.Unix(0, last)) > cfg.Region.MaxLag)
+	return s
+}
+
+// snapshotPath is where the primary serves the CRL behind an issuer's
+// index.
+const snapshotPath = "/replication/v1/snapshot/"
+
+// snapshotHandler serves GET /replication/v1/snapshot/{CRL file} on a
+// primary: the cached CRL an issuer's index was built from. Secondaries
+// build the same index from it, after checking its signature like any CRL.
+// The ETag is the CRL's SHA-256, so an unchanged CRL costs a 304.
+func snapshotHandler(w http.ResponseWriter, r *http.Request) {
+	st := currentState()
+	if !replicationAuthorized(w, r, st) {
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, snapshotPath)
+	var crl CRLInfo
+	for _, c := range st.crls {
+		if c.FileName == name {
+			crl = c
+		}
+	}
+	f, ok := st.filters[crl.key()]
+	if crl.FileName == "" || !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if f.quarantine != "" {
+		http.Error(w, "CRL is quarantined: "+f.quarantine, http.StatusServiceUnavailable)
+		return
+	}
+	data, err := os.ReadFile(rootDir + crl.FileName)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sum := sha256.Sum256(data)
+	etag := `"` + hex.EncodeToString(sum[:]) + `"`
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Last-Modified", f.loadedAt.UTC().Format(http.TimeFormat))
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "application/pkix-crl")
+	w.Write(data)
+}
+
+// replicationAuthorized reports whether r carries the replication token,
+// answering it otherwise.
+func replicationAuthorized(w http.ResponseWriter, r *http.Request, st *state) bool {
+	if st.cfg.Region.token == "" {
+		http.NotFound(w, r)
+		return false
+	}
+	presented := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(presented), []byte(st.cfg.Region.token)) != 1 {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="goocsp-replication"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// bundlePath is where the primary serves its CA bundle to subordinates.
+const bundlePath = "/replication/v1/bundle"
+
+// maxBundleSize bounds the CA bundle a subordinate accepts.
+const maxBundleSize = 16 << 20
+
+// bundleHandler serves GET /replication/v1/bundle on a primary: the CA
+// bundle its issuers were selected from, as downloaded.
+func bundleHandler(w http.ResponseWriter, r *http.Request) {
+	if !replicationAuthorized(w, r, currentState()) {
+		return
+	}
+	data, err := os.ReadFile(rootDir + bundleFile())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	w.Write(data)
+}
+
+// fetchBundle downloads the primary's CA bundle into the cache, on a
+// subordinate. The bundle is only checked to hold certificates: as with a
+// public one, issuers are served only if they chain to the local trust
+// anchors, and their CRLs only if they verify.
+func fetchBundle(cfg *Config) error {
+	ctx, cancel := context.WithTimeout(context.Background(), fetchTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(cfg.Region.Primary, "/")+bundlePath, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+cfg.Region.token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("bundle from primary: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("bundle from primary: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxBundleSize+1))
+	if err != nil {
+		return fmt.Errorf("bundle from primary: %v", err)
+	}
+	if len(data) > maxBundleSize {
+		return fmt.Errorf("bundle from primary: larger than %d bytes", maxBundleSize)
+	}
+	if err := checkBundle(data); err != nil {
+		return fmt.Errorf("bundle from primary: %v", err)
+	}
+	return writeFileAtomic(rootDir+bundleFile(), data, 0644)
+}
+
+// checkBundle makes sure data is PEM certificates that parse, which
+// loadCertificates takes for granted.
+func checkBundle(data []byte) error {
+	n := 0
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		if _, err := x509.ParseCertificate(block.Bytes); err != nil {
+			return fmt.Errorf("certificate %d: %v", n+1, err)
+		}
+		n++
+	}
+	if n == 0 {
+		return errors.New("no certificates")
+	}
+	return nil
+}
+
+// errNotModified is returned by fetchSnapshot when the local copy is
+// already the primary's.
+var errNotModified = errors.New("not modified")
+
+// fetchSnapshot downloads the CRL behind fileName's index from the primary
+// into the cache as dest.
+func fetchSnapshot(cfg *Config, fileName, dest string) (CRLInfo, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), fetchTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, cfg.crlSource(fileName), nil)
+	if err != nil {
+		return CRLInfo{}, err
+	}
+	req.Header.Set("Authorization", "Bearer "+cfg.Region.token)
+	if sum, err := hashFile(rootDir + fileName); err == nil {
+		req.Header.Set("If-None-Match", `"`+hex.EncodeToString(sum[:])+`"`)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return CRLInfo{}, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		atomic.StoreInt64(&region.lastSync, time.Now().UnixNano())
+		return CRLInfo{}, errNotModified
+	default:
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return CRLInfo{}, fmt.Errorf("snapshot %s from primary: %s: %s", fileName, resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	output, err := os.Create(rootDir + dest + ".tmp")
+	if err != nil {
+		return CRLInfo{}, err
+	}
+	defer os.Remove(output.Name())
+	defer output.Close()
+	var src io.Reader = downloadLimiter.reader(resp.Body)
+	if limit := downloadLimit(cfg, fileName); limit >= 0 {
+		src = io.LimitReader(src, limit)
+	}
+	n, err := io.Copy(output, src)
+	if err != nil {
+		return CRLInfo{}, fmt.Errorf("snapshot %s from primary: %v", fileName, err)
+	}
+	if err := checkDownloadSize(cfg, fileName, n); err != nil {
+		return CRLInfo{}, err
+	}
+	if err := output.Close(); err != nil {
+		return CRLInfo{}, err
+	}
+	if err := os.Rename(output.Name(), rootDir+dest); err != nil {
+		return CRLInfo{}, err
+	}
+	atomic.StoreInt64(&region.lastSync, time.Now().UnixNano())
+	return CRLInfo{Size: n, RemoteAddr: req.URL.Host, FileName: dest, FetchedFrom: req.URL.String()}, nil
+}
+
+// crlSource is the URL the CRL named fileName is fetched from.
+func (c *Config) crlSource(fileName string) string {
+	if c.Region.secondary() {
+		return strings.TrimSuffix(c.Region.Primary, "/") + snapshotPath + fileName
+	}
+	return c.preferredCRLBase() + "/" + fileName
+}
+
+// downloadCRL fetches the CRL of ca next to its cached copy, as
+// stagedName(fileName): from the distribution point, checked against the
+// authoritative one if mirror_check is set, or on a secondary from the
+// primary. The cached copy is replaced by loadCRL or commitStagedCRL.
+func downloadCRL(cfg *Config, ca *x509.Certificate, fileName string) (CRLInfo, error) {
+	if cfg.Region.secondary() {
+		info, err := fetchSnapshot(cfg, fileName, stagedName(fileName))
+		if err == errNotModified {
+			if fi, statErr := os.Stat(rootDir + fileName); statErr == nil {
+				return CRLInfo{Size: fi.Size(), FileName: fileName}, err
+			}
+		}
+		return info, err
+	}
+	info, err := downloadTo(cfg, cfg.crlSource(fileName), stagedName(fileName))
+	if err != nil || !cfg.MirrorCheck.enabled() {
+		return info, err
+	}
+	return checkMirror(cfg, ca, info), nil
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkkemp/GoOCSPResponder/responder"
+)
+
+// state is everything derived from one configuration. It is replaced as a
+// unit so requests never observe a half-applied configuration.
+type state struct {
+	cfg     *Config
+	bundle  CertificateBundle
+	crls    []CRLInfo
+	filters map[string]CRLBloomFilter
+	signer  *responder.Signer
+	// nextSigner is the key being migrated to, nil outside a migration.
+	nextSigner *responder.Signer
+	// subjects is the subject reverse lookup index, nil unless enabled.
+	subjects *subjectIndex
+	// cache holds pre-signed responses derived from filters.
+	cache *responseCache
+	// slow bounds concurrent cache misses; see slowPath.
+	slow chan struct{}
+	// routes maps routed path segments to CRL keys.
+	routes map[string]string
+	// issuers maps CertID issuer hashes, under every supported algorithm,
+	// to CRL keys; see certid.go.
+	issuers map[string]string
+	// keyHashes maps CertID key hashes to CRL keys, for
+	// cert_id.lenient_name_hash; see certid.go.
+	keyHashes map[string]string
+	// requestors verifies signed requests, nil unless a trust store is
+	// configured.
+	requestors *x509.CertPool
+	// clients classifies OCSP clients for counting and rate limiting.
+	clients *clientClassifier
+	// canaries maps CRL keys to serial bytes to canaries; see canary.go.
+	canaries map[string]map[string]canary
+	// cascades maps the CRL keys of revoked CAs to their revocation, when
+	// cascading is configured; see cascade.go.
+	cascades map[string]caRevocation
+	// freshness maps CRL keys to the freshness rule of their answers; see
+	// freshness.go.
+	freshness map[string]FreshnessRule
+	// issued maps CRL keys to the notAfter of their certificates, from
+	// the issued-serial sources; see expired.go.
+	issued map[string]*issuedSerials
+}
+
+var (
+	current atomic.Value // *state
+	// stateMu serializes writers of current; readers just Load.
+	stateMu sync.Mutex
+	// reloadMu serializes reloads, which build their state without
+	// holding stateMu so refreshes go on meanwhile.
+	reloadMu sync.Mutex
+)
+
+func currentState() *state {
+	return current.Load().(*state)
+}
+
+// buildState resolves the issuers of cfg against the loaded bundle, makes
+// sure their CRLs are cached and indexed, and loads the signing key.
+func buildState(cfg *Config, bundle CertificateBundle, refetch bool) (*state, error) {
+	configureGlobals(cfg)
+	crls, err := downloadCRLs(cfg, bundle, refetch)
+	if err != nil {
+		return nil, err
+	}
+	filters, err := ConstructBloomFilters(cfg, crls)
+	if err != nil {
+		return nil, err
+	}
+	return assembleState(cfg, bundle, crls, filters)
+}
+
+// configureGlobals applies the settings of cfg that live outside the
+// state: the download rate, index builds, gossip and capture.
+func configureGlobals(cfg *Config) {
+	downloadLimiter.setRate(cfg.Refresh.MaxBytesPerSecond)
+	builds.configure(cfg.Index.Build)
+	produced.configure(cfg.Gossip)
+	captures.configure(cfg.Capture)
+}
+
+// rebaseState assembles the state of cfg serving crls with the indexes of
+// cur where a refresh installed them: those cur serves a different CRL
+// with than base did, or every index cur has when base is nil. The others
+// come from built. Only the config-derived parts of cur's indexes are
+// derived anew for cfg; run it with stateMu held.
+func rebaseState(cfg *Config, crls []CRLInfo, built map[string]CRLBloomFilter, base, cur *state) (*state, error) {
+	filters := make(map[string]CRLBloomFilter, len(crls))
+	for _, crl := range crls {
+		key := crl.key()
+		f, ok := cur.filters[key]
+		if !ok || base != nil && f.crlHash == base.filters[key].crlHash {
+			filters[key] = built[key]
+			continue
+		}
+		f.crlID = crlIDExtensions(cfg, f)
+		f.answerNextUpdate = time.Time{}
+		adaptNextUpdate(cfg, &f)
+		filters[key] = f
+	}
+	return assembleState(cfg, cur.bundle, crls, filters)
+}
+
+// assembleState builds the state serving crls with their indexes.
+func assembleState(cfg *Config, bundle CertificateBundle, crls []CRLInfo, filters map[string]CRLBloomFilter) (*state, error) {
+	var err error
+	for _, f := range filters {
+		if err := archiveCRL(cfg, f); err != nil {
+			log.Printf("archive %s: %v", f.crlInfo.FileName, err)
+		}
+	}
+	st := &state{
+		cfg:       cfg,
+		bundle:    bundle,
+		crls:      crls,
+		filters:   filters,
+		cache:     newResponseCache(cfg.Cache),
+		slow:      make(chan struct{}, cfg.Cache.SlowPathConcurrency),
+		issuers:   buildIssuerIndex(crls),
+		keyHashes: buildKeyHashIndex(crls),
+	}
+	if err := checkIssuerAliases(st); err != nil {
+		return nil, err
+	}
+	st.routes, err = buildRoutes(st)
+	if err != nil {
+		return nil, err
+	}
+	st.canaries, err = buildCanaries(st)
+	if err != nil {
+		return nil, err
+	}
+	st.freshness = buildFreshness(st)
+	if st.issued, err = buildIssuedSerials(st); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	for key, f := range st.filters {
+		st.filters[key] = st.pruneExpired(key, f, now)
+	}
+	st.clients, err = newClientClassifier(cfg.Clients)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.SubjectIndex.Enabled {
+		st.subjects, err = buildSubjectIndex(st)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if cfg.SignedRequests.TrustStore != "" {
+		certs, err := readCertificates(cfg.SignedRequests.TrustStore)
+		if err != nil {
+			return nil, err
+		}
+		st.requestors = x509.NewCertPool()
+		for _, cert := range certs {
+			st.requestors.AddCert(cert)
+		}
+	}
+	if cfg.Signer.Cert != "" {
+		st.signer, err = responder.LoadSigner(cfg.Signer.Cert, cfg.Signer.Key)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Signer.Next.Cert != "" {
+		st.nextSigner, err = responder.LoadSigner(cfg.Signer.Next.Cert, cfg.Signer.Next.Key)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := checkSignerAuthorization(st); err != nil {
+		return nil, err
+	}
+	prev, _ := current.Load().(*state)
+	updateCascades(prev, st)
+	return st, nil
+}
+
+// healthChecks run before a new state is applied and repeatedly during the
+// health window afterwards.
+var healthChecks = []struct {
+	name  string
+	check func(st *state) error
+}{
+	{"crls", func(st *state) error {
+		for _, crl := range st.crls {
+			if st.filters[crl.key()].pending {
+				continue
+			}
+			if !st.filters[crl.key()].indexed() {
+				return fmt.Errorf("no index for %s", printableName(crl.CA.Subject.CommonName))
+			}
+			if _, err := os.Stat(rootDir + crl.FileName); err != nil {
+				return err
+			}
+		}
+		return nil
+	}},
+	{"signer", func(st *state) error {
+		if st.signer == nil {
+			return nil
+		}
+		if st.nextSigner != nil {
+			if err := st.nextSigner.Check(); err != nil {
+				return fmt.Errorf("next: %v", err)
+			}
+		}
+		return st.signer.Check()
+	}},
+	{"fips", checkFIPS},
+}
+
+func checkHealth(st *state) error {
+	for _, hc := range healthChecks {
+		if err := hc.check(st); err != nil {
+			return fmt.Errorf("health check %s: %v", hc.name, err)
+		}
+	}
+	return nil
+}
+
+// watchConfig polls the configuration file and reloads it whenever its
+// contents change.
+func watchConfig(path string) {
+	last := currentState().cfg.hash
+	for {
+		time.Sleep(currentState().cfg.Reload.PollInterval)
+		data, err := os.ReadFile(path)
+		if err != nil {
+			log.Printf("config watch: %v", err)
+			continue
+		}
+		hash := sha256.Sum256(data)
+		if hash == last {
+			continue
+		}
+		last = hash
+		reloadConfig(path)
+	}
+}
+
+// reloadConfig stages the configuration at path: it is validated against
+// the live bundle and health-checked before being swapped in, then watched
+// for the health window and rolled back if a check fails.
+func reloadConfig(path string) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	old := currentState()
+	cfg, err := loadConfig(path)
+	if err != nil {
+		alert(old.cfg, "config reload rejected: %v", err)
+		return
+	}
+	if cfg.Listen != old.cfg.Listen || cfg.BundleURL != old.cfg.BundleURL || cfg.Profile != old.cfg.Profile || cfg.Roots != old.cfg.Roots || cfg.CacheDir != old.cfg.CacheDir {
+		log.Printf("config reload: listen, bundle_url, profile, roots and cache_dir changes take effect on restart")
+	}
+	next, err := buildState(cfg, old.bundle, cfg.CRLBaseURL != old.cfg.CRLBaseURL)
+	var r *reload
+	if err == nil {
+		r, err = applyState(old, next)
+	}
+	if err != nil {
+		configureGlobals(old.cfg)
+		alert(old.cfg, "config reload rejected: %v", err)
+		return
+	}
+	log.Printf("config reload: applied %x, watching health for %s", cfg.hash[:8], cfg.Reload.HealthWindow)
+	go r.monitorHealth()
+}
+
+// reload is an applied configuration, kept for the health window so it
+// can be rolled back.
+type reload struct {
+	prev, next *state
+	// blocklist is the blocklist before the reload, and expired the one
+	// left after expiring the entries next's CRLs list.
+	blocklist, expired *blocklist
+}
+
+// applyState health-checks next, built from old without stateMu held, and
+// makes it current. Indexes refreshes installed meanwhile are kept.
+func applyState(old, next *state) (*reload, error) {
+	if err := checkHealth(next); err != nil {
+		return nil, err
+	}
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	if cur := currentState(); cur != old {
+		var err error
+		next, err = rebaseState(next.cfg, next.crls, next.filters, old, cur)
+		if err != nil {
+			return nil, err
+		}
+	}
+	r := &reload{prev: old, next: next, blocklist: currentBlocklist()}
+	current.Store(next)
+	expireBlocklist(next)
+	r.expired = currentBlocklist()
+	return r, nil
+}
+
+// monitorHealth rolls back if the current state fails a health check
+// within the health window. It gives up once another reload replaced
+// next's config; CRL refreshes swap the state too but keep the config.
+func (r *reload) monitorHealth() {
+	deadline := time.Now().Add(r.next.cfg.Reload.HealthWindow)
+	for time.Now().Before(deadline) {
+		time.Sleep(r.next.cfg.Reload.HealthInterval)
+		cur := currentState()
+		if cur.cfg != r.next.cfg {
+			return
+		}
+		if err := checkHealth(cur); err != nil {
+			r.rollBack(err)
+			return
+		}
+	}
+}
+
+// rollBack reinstates the previous config on the indexes currently served,
+// so CRLs refreshed during the health window stay, and undoes what the
+// reload changed outside the state.
+func (r *reload) rollBack(cause error) {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	cur := currentState()
+	if cur.cfg != r.next.cfg {
+		return
+	}
+	prev, err := rebaseState(r.prev.cfg, r.prev.crls, r.prev.filters, nil, cur)
+	if err != nil {
+		alert(cur.cfg, "config %x failed a health check (%v) and rolling back to %x failed: %v", r.next.cfg.hash[:8], cause, r.prev.cfg.hash[:8], err)
+		return
+	}
+	configureGlobals(prev.cfg)
+	current.Store(prev)
+	restoreBlocklist(r.expired, r.blocklist)
+	expireBlocklist(prev)
+	alert(prev.cfg, "config %x rolled back to %x: %v", r.next.cfg.hash[:8], r.prev.cfg.hash[:8], cause)
+}
+
+// alert logs msg and, if cfg has a webhook, posts it there.
+func alert(cfg *Config, format string, args ...interface{}) {
+	postAlert(cfg, "", fmt.Sprintf(format, args...))
+}
+
+// criticalAlert is an alert with severity critical, for incidents to act
+// on at once.
+func criticalAlert(cfg *Config, format string, args ...interface{}) {
+	postAlert(cfg, "critical", fmt.Sprintf(format, args...))
+}
+
+func postAlert(cfg *Config, severity, msg string) {
+	if severity != "" {
+		log.Printf("ALERT (%s): %s", severity, msg)
+	} else {
+		log.Printf("ALERT: %s", msg)
+	}
+	if cfg.AlertWebhook == "" {
+		return
+	}
+	payload := map[string]string{
+		"time":    time.Now().UTC().Format(time.RFC3339),
+		"message": msg,
+	}
+	if severity != "" {
+		payload["severity"] = severity
+	}
+	body, _ := json.Marshal(payload)
+	go func() {
+		resp, err := http.Post(cfg.AlertWebhook, "application/json", bytes.NewReader(body))
+		if err != nil {
+			log.Printf("alert webhook: %v", err)
+			return
+		}
+		resp.Body.Close()
+	}()
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// reloadFixture installs a bench state served from a temporary cache and
+// health checks that fail while fail returns an error.
+func reloadFixture(t *testing.T, fail func(st *state) error) *state {
+	t.Helper()
+	saved, savedRoot := healthChecks, rootDir
+	t.Cleanup(func() {
+		healthChecks, rootDir = saved, savedRoot
+		configureGlobals(defaultConfig())
+	})
+	rootDir = t.TempDir() + string(filepath.Separator)
+	healthChecks = []struct {
+		name  string
+		check func(st *state) error
+	}{{"test", fail}}
+	benchState(t, defaultConfig().Cache)
+	old := currentState()
+	old.cfg.Refresh.MaxBytesPerSecond = 1000
+	configureGlobals(old.cfg)
+	return old
+}
+
+func writeConfig(t *testing.T, yaml string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(yaml), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func downloadRate() float64 {
+	downloadLimiter.mu.Lock()
+	defer downloadLimiter.mu.Unlock()
+	return downloadLimiter.rate
+}
+
+// refreshed installs an index of the current state's CRL built from
+// another CRL file, as a refresh would.
+func refreshed(t *testing.T, hash byte) {
+	t.Helper()
+	crl := currentState().crls[0]
+	f := currentState().filters[crl.key()]
+	f.crlHash = [sha256.Size]byte{hash}
+	f.thisUpdate = f.thisUpdate.Add(time.Minute)
+	if ok, err := installFilter(crl, f); !ok || err != nil {
+		t.Fatalf("installFilter = %v, %v", ok, err)
+	}
+}
+
+func TestReloadRejected(t *testing.T) {
+	unhealthy := errors.New("unhealthy")
+	for name, tc := range map[string]struct {
+		yaml string
+		fail error
+	}{
+		"unknown issuer": {"issuers: [No Such CA]\nrefresh:\n  max_bytes_per_second: 5\n", nil},
+		"health check":   {"refresh:\n  max_bytes_per_second: 5\n", unhealthy},
+	} {
+		t.Run(name, func(t *testing.T) {
+			old := reloadFixture(t, func(st *state) error {
+				if st == currentState() {
+					return nil
+				}
+				return tc.fail
+			})
+			reloadConfig(writeConfig(t, tc.yaml))
+			if currentState() != old {
+				t.Error("the rejected config was applied")
+			}
+			if downloadRate() != 1000 {
+				t.Errorf("download rate is %v, want the old config's 1000", downloadRate())
+			}
+		})
+	}
+}
+
+func TestReloadApplied(t *testing.T) {
+	reloadFixture(t, func(*state) error { return nil })
+	yaml := "refresh:\n  max_bytes_per_second: 5\nreload:\n  health_window: 0s\n"
+	reloadConfig(writeConfig(t, yaml))
+	if currentState().cfg.hash != sha256.Sum256([]byte(yaml)) {
+		t.Error("the config was not applied")
+	}
+	if downloadRate() != 5 {
+		t.Errorf("download rate is %v, want 5", downloadRate())
+	}
+}
+
+// TestReloadKeepsRefreshes refreshes an index while a reload builds, and
+// again during its health window before the reload is rolled back: both
+// the applied and the rolled back state serve the refreshed index.
+func TestReloadKeepsRefreshes(t *testing.T) {
+	bad := [sha256.Size]byte{2}
+	old := reloadFixture(t, func(st *state) error {
+		if st.filters[st.crls[0].key()].crlHash == bad {
+			return errors.New("unhealthy")
+		}
+		return nil
+	})
+	key := old.crls[0].key()
+
+	cfg := *old.cfg
+	cfg.hash = [sha256.Size]byte{0xff}
+	cfg.Refresh.MaxBytesPerSecond = 5
+	cfg.Reload.HealthWindow, cfg.Reload.HealthInterval = time.Minute, time.Millisecond
+	configureGlobals(&cfg)
+	next := *old
+	next.cfg = &cfg
+	refreshed(t, 1)
+	r, err := applyState(old, &next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st := currentState(); st.cfg != &cfg || st.filters[key].crlHash != [sha256.Size]byte{1} {
+		t.Fatalf("applied config %x with CRL %x, want the refreshed CRL", st.cfg.hash[0], st.filters[key].crlHash[0])
+	}
+
+	refreshed(t, bad[0])
+	r.monitorHealth()
+	st := currentState()
+	if st.cfg != old.cfg {
+		t.Fatal("the failing config was not rolled back")
+	}
+	if st.filters[key].crlHash != bad {
+		t.Error("the rollback reinstated the CRL index of the old state")
+	}
+	if downloadRate() != 1000 {
+		t.Errorf("download rate is %v, want the old config's 1000", downloadRate())
+	}
+}
@@ -0,0 +1,83 @@
+package responder
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// AIAOptions describes where a responder and the certificates of its CAs
+// are published, for AIAURLFor.
+type AIAOptions struct {
+	// OCSP are the base URLs the responder answers at, preferred first.
+	OCSP []string
+	// Path is the path the responder dedicates to the issuer under each
+	// base URL, such as /dodemailca41, or "" to answer at the base URLs.
+	Path string
+	// CAIssuers are the URLs the issuer's certificate is published at,
+	// with {name} replaced by Name, {ski} by the issuer's subject key
+	// identifier and {sha256} by its fingerprint, both in lowercase hex.
+	CAIssuers []string
+	// Name is the issuer's name in the CAIssuers URLs, such as the name
+	// of its CRL.
+	Name string
+}
+
+// AIAURLs are the URLs of the authority information access extension
+// (RFC 5280 section 4.2.2.1) of certificates issued by one CA.
+type AIAURLs struct {
+	OCSP      []string `json:"ocsp"`
+	CAIssuers []string `json:"ca_issuers"`
+}
+
+// AIAURLFor returns the URLs CAs are to embed in the certificates issuer
+// issues, so that issuance and the responder agree on them.
+func AIAURLFor(issuer *x509.Certificate, opts AIAOptions) (AIAURLs, error) {
+	if !issuer.IsCA {
+		return AIAURLs{}, errors.New("responder: AIA URLs of a certificate that is not a CA")
+	}
+	var urls AIAURLs
+	for _, base := range opts.OCSP {
+		u := strings.TrimSuffix(base, "/")
+		if opts.Path != "" {
+			u += "/" + strings.Trim(opts.Path, "/")
+		}
+		if err := checkAIAURL(u); err != nil {
+			return AIAURLs{}, err
+		}
+		urls.OCSP = append(urls.OCSP, u)
+	}
+	fingerprint := sha256.Sum256(issuer.Raw)
+	for _, tmpl := range opts.CAIssuers {
+		if strings.Contains(tmpl, "{ski}") && len(issuer.SubjectKeyId) == 0 {
+			return AIAURLs{}, fmt.Errorf("responder: %s has no subject key identifier for %s", issuer.Subject, tmpl)
+		}
+		u := strings.NewReplacer(
+			"{name}", url.PathEscape(opts.Name),
+			"{ski}", hex.EncodeToString(issuer.SubjectKeyId),
+			"{sha256}", hex.EncodeToString(fingerprint[:]),
+		).Replace(tmpl)
+		if err := checkAIAURL(u); err != nil {
+			return AIAURLs{}, err
+		}
+		urls.CAIssuers = append(urls.CAIssuers, u)
+	}
+	return urls, nil
+}
+
+// checkAIAURL refuses URLs relying parties cannot fetch without a
+// revocation check of their own.
+func checkAIAURL(u string) error {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return fmt.Errorf("responder: AIA URL %q: %v", u, err)
+	}
+	if parsed.Scheme != "http" || parsed.Host == "" {
+		return fmt.Errorf("responder: AIA URL %q is not an http URL", u)
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package responder
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"reflect"
+	"testing"
+)
+
+func TestAIAURLFor(t *testing.T) {
+	ca := testCA(t, "Test CA", nil).Cert
+	fingerprint := sha256.Sum256(ca.Raw)
+	got, err := AIAURLFor(ca, AIAOptions{
+		OCSP:      []string{"http://ocsp.example.mil/", "http://ocsp2.example.mil"},
+		Path:      "/dodemailca41/",
+		CAIssuers: []string{"http://crl.example.mil/issuedto/{name}_IT.p7c", "http://crl.example.mil/ca/{sha256}.cer"},
+		Name:      "DOD EMAIL CA-41",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := AIAURLs{
+		OCSP: []string{"http://ocsp.example.mil/dodemailca41", "http://ocsp2.example.mil/dodemailca41"},
+		CAIssuers: []string{
+			"http://crl.example.mil/issuedto/DOD%20EMAIL%20CA-41_IT.p7c",
+			"http://crl.example.mil/ca/" + hex.EncodeToString(fingerprint[:]) + ".cer",
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	ski := AIAOptions{CAIssuers: []string{"http://crl.example.mil/{ski}.cer"}}
+	if got, err := AIAURLFor(ca, ski); err != nil || got.CAIssuers[0] != "http://crl.example.mil/"+hex.EncodeToString(ca.SubjectKeyId)+".cer" {
+		t.Errorf("{ski}: got %+v, %v", got, err)
+	}
+	noSKI := *ca
+	noSKI.SubjectKeyId = nil
+	if _, err := AIAURLFor(&noSKI, ski); err == nil {
+		t.Error("{ski} of a CA without a subject key identifier")
+	}
+
+	for name, opts := range map[string]AIAOptions{
+		"https":   {OCSP: []string{"https://ocsp.example.mil"}},
+		"no host": {CAIssuers: []string{"http:///{name}.cer"}},
+	} {
+		if _, err := AIAURLFor(ca, opts); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+	leaf := *ca
+	leaf.IsCA = false
+	if _, err := AIAURLFor(&leaf, AIAOptions{}); err == nil {
+		t.Error("AIA URLs of a leaf certificate")
+	}
+}
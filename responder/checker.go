@@ -0,0 +1,103 @@
+package responder
+
+import (
+	"context"
+	"crypto"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"math/big"
+	"sync"
+)
+
+var (
+	// ErrUnknownIssuer is returned for certificates of an issuer the index
+	// does not serve; an OCSP responder answers them unauthorized.
+	ErrUnknownIssuer = errors.New("responder: issuer not served")
+	// ErrTryLater is returned while the index cannot answer for an issuer,
+	// such as before its CRL is loaded; an OCSP responder answers tryLater.
+	ErrTryLater = errors.New("responder: status not available yet")
+)
+
+// Index answers CertIDs from revocation data, as an OCSP responder does
+// before signing. Implementations must be safe for concurrent use.
+type Index interface {
+	// Lookup returns the status of the certificate id names, or
+	// ErrUnknownIssuer or ErrTryLater.
+	Lookup(ctx context.Context, id CertID) (SingleResponse, error)
+}
+
+// maxCheckerIssuers bounds the issuer hashes a Checker keeps; past it they
+// are computed again.
+const maxCheckerIssuers = 256
+
+// Checker checks certificates against an Index without going through OCSP:
+// for a TLS server that does its own revocation checks in the same process
+// as the index, there is nothing to encode, sign or parse. The CertID
+// hashes of each issuer are computed once.
+type Checker struct {
+	index Index
+	hash  crypto.Hash
+
+	mu      sync.RWMutex
+	issuers map[string]issuerHashes // by issuer DER
+}
+
+type issuerHashes struct {
+	name, key []byte
+}
+
+// NewChecker returns a Checker of index that identifies issuers by their
+// SHA-1 CertID hashes, which every index serves.
+func NewChecker(index Index) *Checker {
+	return &Checker{index: index, hash: crypto.SHA1, issuers: make(map[string]issuerHashes)}
+}
+
+// Status returns the status of the certificate with serial issued by the
+// CA certificate issuerDER.
+func (c *Checker) Status(ctx context.Context, issuerDER []byte, serial *big.Int) (Status, error) {
+	single, err := c.Check(ctx, issuerDER, serial)
+	if err != nil {
+		return Unknown, err
+	}
+	return single.Status, nil
+}
+
+// Check is Status with the whole answer: the revocation time and reason,
+// and the validity of the CRL it comes from.
+func (c *Checker) Check(ctx context.Context, issuerDER []byte, serial *big.Int) (SingleResponse, error) {
+	if err := ctx.Err(); err != nil {
+		return SingleResponse{}, err
+	}
+	if serial == nil {
+		return SingleResponse{}, errors.New("responder: nil serial number")
+	}
+	h, err := c.issuerHashes(issuerDER)
+	if err != nil {
+		return SingleResponse{}, err
+	}
+	return c.index.Lookup(ctx, CertID{HashAlgorithm: c.hash, NameHash: h.name, KeyHash: h.key, SerialNumber: serial})
+}
+
+func (c *Checker) issuerHashes(issuerDER []byte) (issuerHashes, error) {
+	c.mu.RLock()
+	h, ok := c.issuers[string(issuerDER)]
+	c.mu.RUnlock()
+	if ok {
+		return h, nil
+	}
+	cert, err := x509.ParseCertificate(issuerDER)
+	if err != nil {
+		return issuerHashes{}, fmt.Errorf("responder: parsing the issuer: %v", err)
+	}
+	if h.name, h.key, err = IssuerHashes(cert, c.hash); err != nil {
+		return issuerHashes{}, err
+	}
+	c.mu.Lock()
+	if len(c.issuers) >= maxCheckerIssuers {
+		c.issuers = make(map[string]issuerHashes)
+	}
+	c.issuers[string(issuerDER)] = h
+	c.mu.Unlock()
+	return h, nil
+}
@@ -0,0 +1,81 @@
+package responder
+
+import (
+	"context"
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// mapIndex serves one issuer, with revoked serials by decimal string.
+type mapIndex struct {
+	issuer  *x509.Certificate
+	revoked map[string]bool
+}
+
+func (m mapIndex) Lookup(_ context.Context, id CertID) (SingleResponse, error) {
+	if !id.MatchesIssuer(m.issuer) {
+		return SingleResponse{}, ErrUnknownIssuer
+	}
+	single := SingleResponse{CertID: id, Status: Good}
+	if m.revoked[id.SerialNumber.String()] {
+		single.Status = Revoked
+	}
+	return single, nil
+}
+
+func TestCheckerStatus(t *testing.T) {
+	issuer := parseTestCert(t, filepath.Join(keyHashDir, "p256.pem"))
+	other := parseTestCert(t, filepath.Join(keyHashDir, "p384.pem"))
+	c := NewChecker(mapIndex{issuer: issuer, revoked: map[string]bool{"2": true}})
+	ctx := context.Background()
+
+	for serial, want := range map[int64]Status{1: Good, 2: Revoked} {
+		got, err := c.Status(ctx, issuer.Raw, big.NewInt(serial))
+		if err != nil || got != want {
+			t.Errorf("serial %d: got %v, %v; want %v", serial, got, err, want)
+		}
+	}
+	if single, err := c.Check(ctx, issuer.Raw, big.NewInt(2)); err != nil || single.HashAlgorithm != crypto.SHA1 || single.Status != Revoked {
+		t.Errorf("Check: got %+v, %v", single, err)
+	}
+	if _, err := c.Status(ctx, other.Raw, big.NewInt(1)); err != ErrUnknownIssuer {
+		t.Errorf("other issuer: got %v, want ErrUnknownIssuer", err)
+	}
+	if _, err := c.Status(ctx, issuer.Raw[:20], big.NewInt(1)); err == nil {
+		t.Error("truncated issuer: no error")
+	}
+	if _, err := c.Status(ctx, issuer.Raw, nil); err == nil {
+		t.Error("nil serial: no error")
+	}
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := c.Status(canceled, issuer.Raw, big.NewInt(1)); !errors.Is(err, context.Canceled) {
+		t.Errorf("canceled context: got %v", err)
+	}
+	if len(c.issuers) != 2 {
+		t.Errorf("%d issuer hashes kept, want 2", len(c.issuers))
+	}
+}
+
+func parseTestCert(t *testing.T, file string) *x509.Certificate {
+	t.Helper()
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		t.Fatalf("%s: no PEM certificate", file)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
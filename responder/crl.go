@@ -0,0 +1,125 @@
+package responder
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"math/big"
+	"time"
+)
+
+var (
+	oidReasonCode          = asn1.ObjectIdentifier{2, 5, 29, 21}
+	oidHoldInstructionCode = asn1.ObjectIdentifier{2, 5, 29, 23}
+	oidInvalidityDate      = asn1.ObjectIdentifier{2, 5, 29, 24}
+	// oidCrlID is id-pkix-ocsp-crl, the CrlID single extension.
+	oidCrlID = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 48, 1, 3}
+)
+
+// Revocation reasons from RFC 5280 section 5.3.1.
+const (
+	Unspecified          = 0
+	KeyCompromise        = 1
+	CACompromise         = 2
+	AffiliationChanged   = 3
+	Superseded           = 4
+	CessationOfOperation = 5
+	CertificateHold      = 6
+	RemoveFromCRL        = 8
+	PrivilegeWithdrawn   = 9
+	AACompromise         = 10
+)
+
+// Entry is one revoked certificate taken from a CRL, together with the CRL
+// entry extensions that OCSP carries over as single extensions
+// (RFC 6960 section 4.4.5).
+type Entry struct {
+	Serial    *big.Int
+	RevokedAt time.Time
+	Reason    int
+	// InvalidityDate is when the key is known or suspected to have been
+	// compromised, if the CA recorded it.
+	InvalidityDate time.Time
+	// HoldInstruction is the hold instruction code of a certificateHold
+	// entry, if any.
+	HoldInstruction asn1.ObjectIdentifier
+}
+
+// EntryFromCRL extracts an Entry from a parsed CRL entry. Malformed entry
+// extensions are ignored rather than failing the whole CRL.
+func EntryFromCRL(rc pkix.RevokedCertificate) Entry {
+	e := Entry{Serial: rc.SerialNumber, RevokedAt: rc.RevocationTime}
+	for _, ext := range rc.Extensions {
+		switch {
+		case ext.Id.Equal(oidReasonCode):
+			var reason asn1.Enumerated
+			if _, err := asn1.Unmarshal(ext.Value, &reason); err == nil {
+				e.Reason = int(reason)
+			}
+		case ext.Id.Equal(oidInvalidityDate):
+			var t time.Time
+			if _, err := asn1.UnmarshalWithParams(ext.Value, &t, "generalized"); err == nil {
+				e.InvalidityDate = t
+			}
+		case ext.Id.Equal(oidHoldInstructionCode):
+			var oid asn1.ObjectIdentifier
+			if _, err := asn1.Unmarshal(ext.Value, &oid); err == nil {
+				e.HoldInstruction = oid
+			}
+		}
+	}
+	return e
+}
+
+// SingleExtensions returns the invalidity date and hold instruction code of
+// e encoded as OCSP single extensions.
+func (e Entry) SingleExtensions() []pkix.Extension {
+	var exts []pkix.Extension
+	if !e.InvalidityDate.IsZero() {
+		if v, err := asn1.MarshalWithParams(e.InvalidityDate.UTC(), "generalized"); err == nil {
+			exts = append(exts, pkix.Extension{Id: oidInvalidityDate, Value: v})
+		}
+	}
+	if len(e.HoldInstruction) > 0 {
+		if v, err := asn1.Marshal(e.HoldInstruction); err == nil {
+			exts = append(exts, pkix.Extension{Id: oidHoldInstructionCode, Value: v})
+		}
+	}
+	return exts
+}
+
+// CrlID names the CRL a response was derived from, for the CrlID single
+// extension (RFC 6960 section 4.4.2). Zero fields are left out.
+type CrlID struct {
+	// URL is where the CRL is published.
+	URL string
+	// Number is the CRL's cRLNumber.
+	Number *big.Int
+	// Time is the CRL's thisUpdate.
+	Time time.Time
+}
+
+type crlIDASN1 struct {
+	URL    string    `asn1:"optional,explicit,tag:0,ia5"`
+	Number *big.Int  `asn1:"optional,explicit,tag:1"`
+	Time   time.Time `asn1:"optional,explicit,tag:2,generalized"`
+}
+
+// Extension encodes c as a CrlID single extension.
+func (c CrlID) Extension() (pkix.Extension, error) {
+	v := crlIDASN1{URL: c.URL, Number: c.Number}
+	if !c.Time.IsZero() {
+		v.Time = c.Time.UTC().Truncate(time.Second)
+	}
+	der, err := asn1.Marshal(v)
+	if err != nil {
+		return pkix.Extension{}, err
+	}
+	return pkix.Extension{Id: oidCrlID, Value: der}, nil
+}
+
+// CRLSignatureAlgorithm returns the algorithm crl is signed with, or
+// x509.UnknownSignatureAlgorithm for one this package does not know.
+func CRLSignatureAlgorithm(crl *pkix.CertificateList) x509.SignatureAlgorithm {
+	return signatureAlgorithmFromOID(crl.SignatureAlgorithm.Algorithm)
+}
@@ -0,0 +1,467 @@
+package responder
+
+import (
+	"bytes"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"time"
+)
+
+// A CRL of a few million entries parsed by encoding/asn1 becomes a
+// pkix.RevokedCertificate per entry, each with a big.Int, a time and an
+// extension slice, built by reflection only to be copied into an index and
+// dropped. ScanCRL parses everything but the revoked certificates that way
+// and leaves them encoded; Entries then walks them straight from the DER.
+// The two agree with x509.ParseDERCRL and EntryFromCRL on every CRL the
+// latter accept, except that ScanCRL refuses tags above 30, which no CRL
+// structure uses, and negative serials, which RFC 5280 forbids and an
+// index of magnitudes would take for their positive twin.
+//
+// ScanCRLTolerant also accepts the encoding quirks of CAs seen in the wild
+// that x509.ParseDERCRL refuses, and reports each one it met.
+
+// ScannedCRL is a CRL whose revoked certificates are left encoded.
+type ScannedCRL struct {
+	// CertificateList is the CRL without its revoked certificates:
+	// TBSCertList.RevokedCertificates is nil, the rest is as parsed by
+	// x509.ParseDERCRL, so signatures check as usual.
+	*pkix.CertificateList
+	// Count is the number of revoked certificates, and SerialLen the
+	// length of the longest serial magnitude among them.
+	Count, SerialLen int
+	// Quirks describes the encoding quirks ScanCRLTolerant accepted, with
+	// how often each occurs; it is nil for a CRL scanned strictly.
+	Quirks  []string
+	revoked []byte
+	// tolerant is set by ScanCRLTolerant, for Entries to decode alike.
+	tolerant bool
+}
+
+// quirks counts the encoding quirks a tolerant scan accepts, by
+// description. A nil quirks is a strict scan, which accepts none.
+type quirks map[string]int
+
+func (q quirks) add(what string) {
+	if q != nil {
+		q[what]++
+	}
+}
+
+var errCRLSyntax = errors.New("x509: malformed CRL")
+
+// tlv is one DER value.
+type tlv struct {
+	tag              byte
+	full, body, rest []byte
+}
+
+// readTLV reads the value at the start of b, with the length checks of
+// encoding/asn1.
+func readTLV(b []byte) (tlv, error) {
+	if len(b) < 2 || b[0]&0x1f == 0x1f {
+		return tlv{}, errCRLSyntax
+	}
+	n, hdr := int(b[1]), 2
+	if n&0x80 != 0 {
+		size := n & 0x7f
+		if size == 0 || size > 4 || len(b) < 2+size || b[2] == 0 {
+			return tlv{}, errCRLSyntax
+		}
+		n = 0
+		for _, c := range b[2 : 2+size] {
+			n = n<<8 | int(c)
+		}
+		if n < 0x80 {
+			return tlv{}, errCRLSyntax
+		}
+		hdr += size
+	}
+	if n > len(b)-hdr {
+		return tlv{}, errCRLSyntax
+	}
+	return tlv{
+		tag:  b[0],
+		full: b[:hdr+n],
+		body: b[hdr : hdr+n],
+		rest: b[hdr+n:],
+	}, nil
+}
+
+// ScanCRL parses der as x509.ParseDERCRL does, but for the revoked
+// certificates, which it only checks.
+func ScanCRL(der []byte) (*ScannedCRL, error) {
+	return scanCRL(der, nil)
+}
+
+// ScanCRLTolerant scans der as ScanCRL does, but accepts:
+//
+//   - trailing data after the CRL;
+//   - serial numbers that are not minimally encoded;
+//   - times without a time zone, taken as UTC;
+//   - invalidity dates encoded as UTCTime;
+//   - negative serials, taken as their magnitude, so the certificate of
+//     the positive serial answers revoked rather than good.
+//
+// It also notes GeneralizedTime before 2050, which ScanCRL accepts, as RFC
+// 5280 forbids it. The signature covers the
+// TBSCertList only, so it still checks over trailing data.
+func ScanCRLTolerant(der []byte) (*ScannedCRL, error) {
+	q := make(quirks)
+	crl, err := scanCRL(der, q)
+	if err != nil {
+		return nil, err
+	}
+	crl.tolerant = true
+	crl.Quirks = []string{}
+	for what, n := range q {
+		crl.Quirks = append(crl.Quirks, fmt.Sprintf("%s (%d)", what, n))
+	}
+	sort.Strings(crl.Quirks)
+	return crl, nil
+}
+
+func scanCRL(der []byte, q quirks) (*ScannedCRL, error) {
+	outer, err := readTLV(der)
+	if err != nil || outer.tag != tagSequence {
+		return nil, errCRLSyntax
+	}
+	if len(outer.rest) != 0 {
+		if q == nil {
+			return nil, errCRLSyntax
+		}
+		q[fmt.Sprintf("%d bytes of trailing data", len(outer.rest))]++
+	}
+	crl := &ScannedCRL{CertificateList: new(pkix.CertificateList)}
+	tbs, err := readTLV(outer.body)
+	if err != nil || tbs.tag != tagSequence {
+		return nil, errCRLSyntax
+	}
+	sigAlg, err := readTLV(tbs.rest)
+	if err != nil {
+		return nil, errCRLSyntax
+	}
+	if err := unmarshalAll(sigAlg.full, &crl.SignatureAlgorithm); err != nil {
+		return nil, err
+	}
+	sig, err := readTLV(sigAlg.rest)
+	if err != nil {
+		return nil, errCRLSyntax
+	}
+	if err := unmarshalAll(sig.full, &crl.SignatureValue); err != nil {
+		return nil, err
+	}
+	if err := crl.scanTBS(tbs, q); err != nil {
+		return nil, err
+	}
+	return crl, nil
+}
+
+// unmarshalAll unmarshals the single value der into v.
+func unmarshalAll(der []byte, v interface{}) error {
+	_, err := asn1.Unmarshal(der, v)
+	return err
+}
+
+func (crl *ScannedCRL) scanTBS(tbs tlv, q quirks) error {
+	l := &crl.TBSCertList
+	l.Raw = tbs.full
+	v, err := readTLV(tbs.body)
+	if err != nil {
+		return err
+	}
+	if v.tag == tagInteger {
+		if err := unmarshalAll(v.full, &l.Version); err != nil {
+			return err
+		}
+		if v, err = readTLV(v.rest); err != nil {
+			return err
+		}
+	}
+	if err := unmarshalAll(v.full, &l.Signature); err != nil {
+		return err
+	}
+	if v, err = readTLV(v.rest); err != nil {
+		return err
+	}
+	if err := unmarshalAll(v.full, &l.Issuer); err != nil {
+		return err
+	}
+	if v, err = readTLV(v.rest); err != nil {
+		return err
+	}
+	if l.ThisUpdate, err = decodeCRLTime(v, q); err != nil {
+		return err
+	}
+	rest := v.rest
+	if len(rest) > 0 && (rest[0] == tagUTCTime || rest[0] == tagGeneralizedTime) {
+		if v, err = readTLV(rest); err != nil {
+			return err
+		}
+		if l.NextUpdate, err = decodeCRLTime(v, q); err != nil {
+			return err
+		}
+		rest = v.rest
+	}
+	if len(rest) > 0 && rest[0] == tagSequence {
+		if v, err = readTLV(rest); err != nil {
+			return err
+		}
+		crl.revoked, rest = v.body, v.rest
+		for b := crl.revoked; len(b) > 0; crl.Count++ {
+			serial, _, next, err := decodeRevoked(b, q)
+			if err != nil {
+				return err
+			}
+			if len(serial) > crl.SerialLen {
+				crl.SerialLen = len(serial)
+			}
+			b = next
+		}
+	}
+	if len(rest) > 0 && rest[0] == contextTag(0, true) {
+		if v, err = readTLV(rest); err != nil {
+			return err
+		}
+		if err := unmarshalAll(v.body, &l.Extensions); err != nil {
+			return err
+		}
+	}
+	// Anything after is ignored, as encoding/asn1 ignores trailing
+	// elements of a SEQUENCE.
+	return nil
+}
+
+// Entries calls fn with every revoked certificate of crl in CRL order: its
+// position, the big-endian magnitude of its serial, which aliases the CRL,
+// and its entry, whose Serial is left nil. ScanCRL checked every entry, so
+// an error means crl was not made by it; fn has then seen the entries
+// before the bad one.
+func (crl *ScannedCRL) Entries(fn func(i int, serial []byte, e Entry)) error {
+	var q quirks
+	if crl.tolerant {
+		// Counted by the scan already.
+		q = make(quirks)
+	}
+	b := crl.revoked
+	for i := 0; len(b) > 0; i++ {
+		serial, e, next, err := decodeRevoked(b, q)
+		if err != nil {
+			return fmt.Errorf("revoked certificate %d: %v", i, err)
+		}
+		fn(i, serial, e)
+		b = next
+	}
+	return nil
+}
+
+const tagUTCTime = 0x17
+
+// The DER content of the CRL entry extension OIDs EntryFromCRL reads.
+var (
+	derReasonCode          = []byte{0x55, 0x1d, 0x15}
+	derHoldInstructionCode = []byte{0x55, 0x1d, 0x17}
+	derInvalidityDate      = []byte{0x55, 0x1d, 0x18}
+)
+
+// decodeRevoked decodes the revoked certificate at the start of b as
+// EntryFromCRL would, returning the magnitude of its serial apart. With q,
+// it accepts the quirks of ScanCRLTolerant.
+func decodeRevoked(b []byte, q quirks) (serial []byte, e Entry, rest []byte, err error) {
+	rc, err := readTLV(b)
+	if err != nil || rc.tag != tagSequence {
+		return nil, Entry{}, nil, errCRLSyntax
+	}
+	v, err := readTLV(rc.body)
+	if err != nil || v.tag != tagInteger {
+		return nil, Entry{}, nil, errCRLSyntax
+	}
+	if serial, err = magnitude(v.body, q); err != nil {
+		return nil, Entry{}, nil, err
+	}
+	if v, err = readTLV(v.rest); err != nil {
+		return nil, Entry{}, nil, err
+	}
+	if e.RevokedAt, err = decodeCRLTime(v, q); err != nil {
+		return nil, Entry{}, nil, err
+	}
+	if len(v.rest) > 0 && v.rest[0] == tagSequence {
+		if v, err = readTLV(v.rest); err != nil {
+			return nil, Entry{}, nil, err
+		}
+		if err := decodeEntryExtensions(v.body, &e, q); err != nil {
+			return nil, Entry{}, nil, err
+		}
+	}
+	return serial, e, rc.rest, nil
+}
+
+// magnitude returns the big-endian magnitude of the DER INTEGER content
+// b, without leading zeros, as big.Int.Bytes does. With q, an integer that
+// is not minimally encoded is accepted.
+func magnitude(b []byte, q quirks) ([]byte, error) {
+	if len(b) > 1 && (b[0] == 0 && b[1]&0x80 == 0 || b[0] == 0xff && b[1]&0x80 != 0) {
+		if q == nil {
+			return nil, asn1.StructuralError{Msg: "integer not minimally-encoded"}
+		}
+		q.add("serials not minimally encoded")
+		for len(b) > 1 && (b[0] == 0 && b[1]&0x80 == 0 || b[0] == 0xff && b[1]&0x80 != 0) {
+			b = b[1:]
+		}
+	}
+	switch {
+	case len(b) == 0:
+		return nil, errCRLSyntax
+	case b[0]&0x80 != 0:
+		// Negative, which no CA issues; take the slow way.
+		if q == nil {
+			return nil, asn1.StructuralError{Msg: "negative serial number"}
+		}
+		q.add("negative serials")
+		n := new(big.Int).SetBytes(b)
+		n.Sub(n, new(big.Int).Lsh(big.NewInt(1), uint(len(b))*8))
+		return n.Bytes(), nil
+	case b[0] == 0:
+		return b[1:], nil
+	}
+	return b, nil
+}
+
+// decodeTime decodes a UTCTime or GeneralizedTime as encoding/asn1 does.
+// The DER forms CAs use are parsed by hand; any other goes to
+// encoding/asn1.
+func decodeTime(v tlv) (time.Time, error) {
+	switch {
+	case v.tag == tagUTCTime && len(v.body) == 13 && v.body[12] == 'Z':
+		year, ok := digits(v.body[:2])
+		if year >= 50 {
+			year += 1900
+		} else {
+			year += 2000
+		}
+		if t, good := clock(year, v.body[2:12]); ok && good {
+			return t, nil
+		}
+	case v.tag == tagGeneralizedTime && len(v.body) == 15 && v.body[14] == 'Z':
+		year, ok := digits(v.body[:4])
+		if t, good := clock(year, v.body[4:14]); ok && good {
+			return t, nil
+		}
+	}
+	var t time.Time
+	if v.tag != tagUTCTime && v.tag != tagGeneralizedTime {
+		return t, errCRLSyntax
+	}
+	err := unmarshalAll(v.full, &t)
+	return t, err
+}
+
+// decodeCRLTime decodes a time of the CRL as decodeTime does. With q, it
+// also accepts times without a time zone, as UTC.
+func decodeCRLTime(v tlv, q quirks) (time.Time, error) {
+	t, err := decodeTime(v)
+	if q == nil {
+		return t, err
+	}
+	if err != nil {
+		layout := "20060102150405"
+		if v.tag == tagUTCTime {
+			layout = "060102150405"
+		}
+		if zoneless, perr := time.Parse(layout, string(v.body)); perr == nil {
+			q.add("times without a time zone")
+			return zoneless, nil
+		}
+		return t, err
+	}
+	if v.tag == tagGeneralizedTime && t.Year() < 2050 {
+		q.add("GeneralizedTime before 2050")
+	}
+	return t, nil
+}
+
+// clock returns the UTC time of year and b, MMDDHHMMSS, and whether it is
+// a valid one.
+func clock(year int, b []byte) (time.Time, bool) {
+	month, ok1 := digits(b[0:2])
+	day, ok2 := digits(b[2:4])
+	hour, ok3 := digits(b[4:6])
+	min, ok4 := digits(b[6:8])
+	sec, ok5 := digits(b[8:10])
+	if !(ok1 && ok2 && ok3 && ok4 && ok5) || hour > 23 || min > 59 || sec > 59 {
+		return time.Time{}, false
+	}
+	t := time.Date(year, time.Month(month), day, hour, min, sec, 0, time.UTC)
+	if t.Year() != year || int(t.Month()) != month || t.Day() != day {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+func digits(b []byte) (int, bool) {
+	n := 0
+	for _, c := range b {
+		if c < '0' || c > '9' {
+			return 0, false
+		}
+		n = n*10 + int(c-'0')
+	}
+	return n, true
+}
+
+// decodeEntryExtensions decodes the crlEntryExtensions content b into e,
+// ignoring malformed values as EntryFromCRL does. With q, an invalidity
+// date encoded as UTCTime is taken.
+func decodeEntryExtensions(b []byte, e *Entry, q quirks) error {
+	for len(b) > 0 {
+		ext, err := readTLV(b)
+		if err != nil || ext.tag != tagSequence {
+			return errCRLSyntax
+		}
+		b = ext.rest
+		id, err := readTLV(ext.body)
+		if err != nil || id.tag != tagOID {
+			return errCRLSyntax
+		}
+		v, err := readTLV(id.rest)
+		if err == nil && v.tag == tagBoolean {
+			v, err = readTLV(v.rest)
+		}
+		if err != nil || v.tag != tagOctetString {
+			return errCRLSyntax
+		}
+		value := v.body
+		switch {
+		case bytes.Equal(id.body, derReasonCode):
+			if len(value) == 3 && value[0] == tagEnumerated && value[1] == 1 && value[2] < 0x80 {
+				e.Reason = int(value[2])
+				break
+			}
+			var reason asn1.Enumerated
+			if _, err := asn1.Unmarshal(value, &reason); err == nil {
+				e.Reason = int(reason)
+			}
+		case bytes.Equal(id.body, derInvalidityDate):
+			t, err := readTLV(value)
+			if err == nil && t.tag == tagUTCTime && q != nil {
+				if d, err := decodeTime(t); err == nil {
+					q.add("invalidity dates as UTCTime")
+					e.InvalidityDate = d
+				}
+			} else if err == nil && t.tag == tagGeneralizedTime {
+				if d, err := decodeTime(t); err == nil {
+					e.InvalidityDate = d
+				}
+			}
+		case bytes.Equal(id.body, derHoldInstructionCode):
+			var oid asn1.ObjectIdentifier
+			if _, err := asn1.Unmarshal(value, &oid); err == nil {
+				e.HoldInstruction = oid
+			}
+		}
+	}
+	return nil
+}
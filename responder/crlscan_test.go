@@ -0,0 +1,354 @@
+package responder
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"math/big"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The CRL structures, with the revocation time left raw so the tests can
+// encode it in every form encoding/asn1 accepts.
+type scanRevoked struct {
+	Serial     *big.Int
+	Time       asn1.RawValue
+	Extensions []pkix.Extension `asn1:"optional"`
+}
+
+type scanTBS struct {
+	Version    int `asn1:"optional,default:0"`
+	Signature  pkix.AlgorithmIdentifier
+	Issuer     pkix.RDNSequence
+	ThisUpdate time.Time
+	NextUpdate time.Time        `asn1:"optional"`
+	Revoked    []scanRevoked    `asn1:"optional"`
+	Extensions []pkix.Extension `asn1:"tag:0,optional,explicit"`
+}
+
+type scanList struct {
+	TBS       scanTBS
+	Algorithm pkix.AlgorithmIdentifier
+	Signature asn1.BitString
+}
+
+func rawTime(tag int, s string) asn1.RawValue {
+	return asn1.RawValue{Tag: tag, Bytes: []byte(s)}
+}
+
+func scanExtension(t *testing.T, id asn1.ObjectIdentifier, critical bool, v interface{}) pkix.Extension {
+	t.Helper()
+	value, ok := v.([]byte)
+	if !ok {
+		var err error
+		if value, err = asn1.Marshal(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return pkix.Extension{Id: id, Critical: critical, Value: value}
+}
+
+func encodeScanCRL(t *testing.T, revoked []scanRevoked) []byte {
+	t.Helper()
+	sha256WithRSA := pkix.AlgorithmIdentifier{Algorithm: asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 11}, Parameters: asn1.NullRawValue}
+	der, err := asn1.Marshal(scanList{
+		TBS: scanTBS{
+			Version:    1,
+			Signature:  sha256WithRSA,
+			Issuer:     pkix.Name{CommonName: "Scan Test CA"}.ToRDNSequence(),
+			ThisUpdate: time.Date(2025, 10, 1, 0, 0, 0, 0, time.UTC),
+			NextUpdate: time.Date(2025, 10, 8, 0, 0, 0, 0, time.UTC),
+			Revoked:    revoked,
+			Extensions: []pkix.Extension{scanExtension(t, asn1.ObjectIdentifier{2, 5, 29, 20}, false, big.NewInt(42))},
+		},
+		Algorithm: sha256WithRSA,
+		Signature: asn1.BitString{Bytes: []byte{1, 2, 3}, BitLength: 24},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+// checkScan compares ScanCRL and Entries with x509.ParseDERCRL and
+// EntryFromCRL on der.
+func checkScan(t *testing.T, der []byte) {
+	t.Helper()
+	want, werr := x509.ParseDERCRL(der)
+	got, gerr := ScanCRL(der)
+	if (werr == nil) != (gerr == nil) {
+		t.Fatalf("ScanCRL error %v, ParseDERCRL error %v", gerr, werr)
+	}
+	if werr != nil {
+		return
+	}
+	revoked := want.TBSCertList.RevokedCertificates
+	shell := *want
+	shell.TBSCertList.RevokedCertificates = nil
+	if !reflect.DeepEqual(*got.CertificateList, shell) {
+		t.Errorf("CertificateList differs:\n got %+v\nwant %+v", *got.CertificateList, shell)
+	}
+	if got.Count != len(revoked) {
+		t.Errorf("Count %d, want %d", got.Count, len(revoked))
+	}
+	serialLen := 0
+	n := 0
+	err := got.Entries(func(i int, serial []byte, e Entry) {
+		n++
+		if i >= len(revoked) {
+			return
+		}
+		w := EntryFromCRL(revoked[i])
+		if !bytes.Equal(serial, w.Serial.Bytes()) {
+			t.Errorf("entry %d: serial %x, want %x", i, serial, w.Serial.Bytes())
+		}
+		if len(serial) > serialLen {
+			serialLen = len(serial)
+		}
+		w.Serial = nil
+		if !e.RevokedAt.Equal(w.RevokedAt) || !e.InvalidityDate.Equal(w.InvalidityDate) || e.Reason != w.Reason || !e.HoldInstruction.Equal(w.HoldInstruction) {
+			t.Errorf("entry %d: got %+v, want %+v", i, e, w)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(revoked) || got.SerialLen != serialLen {
+		t.Errorf("Entries walked %d entries, SerialLen %d; want %d, %d", n, got.SerialLen, len(revoked), serialLen)
+	}
+}
+
+func TestScanCRLMatchesParseDERCRL(t *testing.T) {
+	hold := asn1.ObjectIdentifier{1, 2, 840, 10040, 2, 2}
+	invalidity, _ := asn1.MarshalWithParams(time.Date(2025, 9, 30, 12, 0, 0, 0, time.UTC), "generalized")
+	revoked := []scanRevoked{
+		{Serial: big.NewInt(1), Time: rawTime(asn1.TagUTCTime, "251001120000Z")},
+		{Serial: big.NewInt(0), Time: rawTime(asn1.TagUTCTime, "491231235959Z")},
+		{Serial: big.NewInt(128), Time: rawTime(asn1.TagUTCTime, "500101000000Z")},
+		{Serial: new(big.Int).Lsh(big.NewInt(1), 159), Time: rawTime(asn1.TagGeneralizedTime, "20550101000000Z")},
+		// Forms left to encoding/asn1.
+		{Serial: big.NewInt(6), Time: rawTime(asn1.TagUTCTime, "2510011200Z")},
+		{Serial: big.NewInt(7), Time: rawTime(asn1.TagUTCTime, "251001120000+0100")},
+		{Serial: big.NewInt(8), Time: rawTime(asn1.TagGeneralizedTime, "20251001120000.25Z")},
+		{Serial: big.NewInt(9), Time: rawTime(asn1.TagUTCTime, "251001120000Z"), Extensions: []pkix.Extension{
+			scanExtension(t, oidReasonCode, false, asn1.Enumerated(KeyCompromise)),
+			{Id: oidInvalidityDate, Value: invalidity},
+		}},
+		{Serial: big.NewInt(10), Time: rawTime(asn1.TagUTCTime, "251001120000Z"), Extensions: []pkix.Extension{
+			scanExtension(t, oidReasonCode, true, asn1.Enumerated(CertificateHold)),
+			scanExtension(t, oidHoldInstructionCode, false, hold),
+		}},
+		// Malformed values are ignored, as EntryFromCRL ignores them.
+		{Serial: big.NewInt(11), Time: rawTime(asn1.TagUTCTime, "251001120000Z"), Extensions: []pkix.Extension{
+			scanExtension(t, oidReasonCode, false, []byte{0x0a, 0x02, 0x00, 0x05}),
+			scanExtension(t, oidInvalidityDate, false, []byte{0x17, 0x01, '1'}),
+			scanExtension(t, oidHoldInstructionCode, false, []byte{0x05, 0x00}),
+			scanExtension(t, asn1.ObjectIdentifier{1, 2, 3}, false, []byte{0x05, 0x00}),
+		}},
+		{Serial: big.NewInt(12), Time: rawTime(asn1.TagUTCTime, "251001120000Z"), Extensions: []pkix.Extension{
+			scanExtension(t, oidReasonCode, false, asn1.Enumerated(200)),
+		}},
+		// A serial listed twice.
+		{Serial: big.NewInt(1), Time: rawTime(asn1.TagUTCTime, "251002120000Z")},
+	}
+	checkScan(t, encodeScanCRL(t, revoked))
+	checkScan(t, encodeScanCRL(t, nil))
+}
+
+func TestScanCRLRefusesWhatParseDERCRLRefuses(t *testing.T) {
+	der := encodeScanCRL(t, []scanRevoked{{Serial: big.NewInt(300), Time: rawTime(asn1.TagUTCTime, "251001120000Z")}})
+	cases := map[string][]byte{
+		"truncated":     der[:len(der)-1],
+		"trailing data": append(append([]byte(nil), der...), 0),
+		"invalid date":  encodeScanCRL(t, []scanRevoked{{Serial: big.NewInt(1), Time: rawTime(asn1.TagUTCTime, "250231120000Z")}}),
+		"not a time":    encodeScanCRL(t, []scanRevoked{{Serial: big.NewInt(1), Time: rawTime(asn1.TagPrintableString, "251001120000Z")}}),
+	}
+	// A serial with a redundant leading zero.
+	i := bytes.Index(der, []byte{0x02, 0x02, 0x01, 0x2c})
+	bad := append(append(append([]byte(nil), der[:i]...), 0x02, 0x03, 0x00, 0x01, 0x2c), der[i+4:]...)
+	bad[1]++
+	bad[5]++
+	cases["non-minimal serial"] = bad
+	for name, der := range cases {
+		t.Run(name, func(t *testing.T) {
+			if _, err := x509.ParseDERCRL(der); err == nil {
+				t.Fatal("ParseDERCRL accepts it")
+			}
+			if _, err := ScanCRL(der); err == nil {
+				t.Error("ScanCRL accepts it")
+			}
+		})
+	}
+}
+
+// TestScanCRLRefusesNegativeSerials scans a CRL revoking -5, which
+// x509.ParseDERCRL accepts, but which an index of serial magnitudes would
+// take for a revocation of 5.
+func TestScanCRLRefusesNegativeSerials(t *testing.T) {
+	der := encodeScanCRL(t, []scanRevoked{
+		{Serial: big.NewInt(1), Time: rawTime(asn1.TagUTCTime, "251001120000Z")},
+		{Serial: big.NewInt(-5), Time: rawTime(asn1.TagUTCTime, "251001120000Z")},
+	})
+	if _, err := x509.ParseDERCRL(der); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ScanCRL(der); err == nil {
+		t.Error("ScanCRL accepts a negative serial")
+	}
+}
+
+func TestScanCRLTolerant(t *testing.T) {
+	utcInvalidity, _ := asn1.Marshal(time.Date(2025, 9, 30, 12, 0, 0, 0, time.UTC))
+	der := encodeScanCRL(t, []scanRevoked{
+		{Serial: big.NewInt(300), Time: rawTime(asn1.TagUTCTime, "251001120000Z")},
+		{Serial: big.NewInt(-5), Time: rawTime(asn1.TagGeneralizedTime, "20251001120000Z")},
+		{Serial: big.NewInt(7), Time: rawTime(asn1.TagGeneralizedTime, "20251001120000"), Extensions: []pkix.Extension{
+			{Id: oidInvalidityDate, Value: utcInvalidity},
+		}},
+	})
+	// The serial 300 with a redundant leading zero, which lengthens the
+	// entry, the list of entries, the TBSCertList and the CRL by one, and
+	// trailing data.
+	i := bytes.Index(der, []byte{0x02, 0x02, 0x01, 0x2c})
+	quirky := append(append(append([]byte(nil), der[:i]...), 0x02, 0x03, 0x00, 0x01, 0x2c), der[i+4:]...)
+	for _, length := range []int{2, 5, i - 3, i - 1} {
+		quirky[length]++
+	}
+	quirky = append(quirky, 0, 0)
+
+	if _, err := ScanCRL(quirky); err == nil {
+		t.Fatal("ScanCRL accepts the quirks")
+	}
+	crl, err := ScanCRLTolerant(quirky)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"2 bytes of trailing data (1)",
+		"GeneralizedTime before 2050 (1)",
+		"invalidity dates as UTCTime (1)",
+		"negative serials (1)",
+		"serials not minimally encoded (1)",
+		"times without a time zone (1)",
+	}
+	if !reflect.DeepEqual(crl.Quirks, want) {
+		t.Errorf("quirks %q, want %q", crl.Quirks, want)
+	}
+	var serials []string
+	err = crl.Entries(func(i int, serial []byte, e Entry) {
+		serials = append(serials, new(big.Int).SetBytes(serial).String())
+		if i == 2 && (!e.RevokedAt.Equal(time.Date(2025, 10, 1, 12, 0, 0, 0, time.UTC)) || e.InvalidityDate.IsZero()) {
+			t.Errorf("entry 2: %+v", e)
+		}
+	})
+	if got := strings.Join(serials, " "); err != nil || got != "300 5 7" {
+		t.Errorf("serials %s, %v", got, err)
+	}
+	// Walked strictly, the quirky entries are an error.
+	crl.tolerant = false
+	n := 0
+	if err := crl.Entries(func(int, []byte, Entry) { n++ }); err == nil || n != 0 {
+		t.Errorf("strict Entries of quirky entries: %v after %d entries, want an error before any", err, n)
+	}
+
+	// Quirks are reported only as met, and what no reading makes sense of
+	// is still refused.
+	if crl, err := ScanCRLTolerant(encodeScanCRL(t, nil)); err != nil || len(crl.Quirks) != 0 {
+		t.Errorf("CRL without quirks: %v, %q", err, crl.Quirks)
+	}
+	bad := encodeScanCRL(t, []scanRevoked{{Serial: big.NewInt(1), Time: rawTime(asn1.TagUTCTime, "250231120000Z")}})
+	if _, err := ScanCRLTolerant(bad); err == nil {
+		t.Error("ScanCRLTolerant accepts an invalid date")
+	}
+}
+
+func TestScanCRLSignatureChecks(t *testing.T) {
+	s := testCA(t, "Scan Test CA", nil)
+	ca := s.Cert
+	der, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:     big.NewInt(7),
+		ThisUpdate: time.Now().Add(-time.Minute),
+		NextUpdate: time.Now().Add(time.Hour),
+		RevokedCertificateEntries: []x509.RevocationListEntry{
+			{SerialNumber: big.NewInt(99), RevocationTime: time.Now().Add(-time.Hour).UTC(), ReasonCode: KeyCompromise},
+		},
+	}, ca, s.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkScan(t, der)
+	crl, err := ScanCRL(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ca.CheckCRLSignature(crl.CertificateList); err != nil {
+		t.Errorf("signature of the scanned CRL: %v", err)
+	}
+}
+
+// benchCRL encodes a CRL of n entries, a tenth of them with a reason.
+func benchCRL(b *testing.B, n int) []byte {
+	revoked := make([]pkix.RevokedCertificate, n)
+	at := time.Date(2025, 10, 1, 0, 0, 0, 0, time.UTC)
+	reason, _ := asn1.Marshal(asn1.Enumerated(KeyCompromise))
+	for i := range revoked {
+		serial := new(big.Int).Lsh(big.NewInt(int64(i)+1), 100)
+		revoked[i] = pkix.RevokedCertificate{SerialNumber: serial, RevocationTime: at.Add(time.Duration(i) * time.Second)}
+		if i%10 == 0 {
+			revoked[i].Extensions = []pkix.Extension{{Id: oidReasonCode, Value: reason}}
+		}
+	}
+	der, err := asn1.Marshal(pkix.CertificateList{
+		TBSCertList: pkix.TBSCertificateList{
+			Version:             1,
+			Signature:           pkix.AlgorithmIdentifier{Algorithm: asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 11}},
+			Issuer:              pkix.Name{CommonName: "Bench CA"}.ToRDNSequence(),
+			ThisUpdate:          at,
+			NextUpdate:          at.Add(7 * 24 * time.Hour),
+			RevokedCertificates: revoked,
+		},
+		SignatureAlgorithm: pkix.AlgorithmIdentifier{Algorithm: asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 11}},
+		SignatureValue:     asn1.BitString{Bytes: []byte{1}, BitLength: 8},
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	return der
+}
+
+const benchCRLEntries = 200000
+
+func BenchmarkParseDERCRL(b *testing.B) {
+	der := benchCRL(b, benchCRLEntries)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		crl, err := x509.ParseDERCRL(der)
+		if err != nil {
+			b.Fatal(err)
+		}
+		for _, rc := range crl.TBSCertList.RevokedCertificates {
+			EntryFromCRL(rc)
+		}
+	}
+}
+
+func BenchmarkScanCRL(b *testing.B) {
+	der := benchCRL(b, benchCRLEntries)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		crl, err := ScanCRL(der)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err := crl.Entries(func(int, []byte, Entry) {}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
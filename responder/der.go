@@ -0,0 +1,276 @@
+package responder
+
+import (
+	"crypto/sha512"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"math/big"
+	"sync"
+	"time"
+)
+
+// A minimal DER encoder for the responses this package signs. Values are
+// appended to one buffer; a constructed value reserves a single length byte
+// and is shifted right once its length is known, which is rare for
+// anything but the outer structures. The output is byte for byte what
+// encoding/asn1 produces for the structures in ocsp.go, without the
+// reflection and the intermediate slices.
+
+// DER tags used in responses.
+const (
+	tagBoolean         = 0x01
+	tagInteger         = 0x02
+	tagBitString       = 0x03
+	tagOctetString     = 0x04
+	tagNull            = 0x05
+	tagOID             = 0x06
+	tagEnumerated      = 0x0a
+	tagGeneralizedTime = 0x18
+	tagSequence        = 0x30
+)
+
+// contextTag is the tag of a context-specific [n], constructed or not.
+func contextTag(n byte, constructed bool) byte {
+	if constructed {
+		return 0xa0 | n
+	}
+	return 0x80 | n
+}
+
+// derBuf is the scratch space of one response: the encoding and the
+// digest that is signed.
+type derBuf struct {
+	b   []byte
+	sum [sha512.Size]byte
+}
+
+// derBufs holds encoding buffers, sized for a typical single response with
+// an embedded responder certificate.
+var derBufs = sync.Pool{New: func() interface{} {
+	return &derBuf{b: make([]byte, 0, 4<<10)}
+}}
+
+// begin appends tag and a placeholder length and returns the offset end
+// needs to complete the value.
+func begin(b []byte, tag byte) ([]byte, int) {
+	b = append(b, tag, 0)
+	return b, len(b)
+}
+
+// end writes the length of the value begun at start, moving its contents
+// when the length does not fit the placeholder byte.
+func end(b []byte, start int) []byte {
+	n := len(b) - start
+	if n < 0x80 {
+		b[start-1] = byte(n)
+		return b
+	}
+	size := 1
+	for l := n; l > 0xff; l >>= 8 {
+		size++
+	}
+	for i := 0; i < size; i++ {
+		b = append(b, 0)
+	}
+	copy(b[start+size:], b[start:start+n])
+	b[start-1] = 0x80 | byte(size)
+	for i := size; i > 0; i-- {
+		b[start-1+i] = byte(n)
+		n >>= 8
+	}
+	return b
+}
+
+// appendValue appends a complete primitive value.
+func appendValue(b []byte, tag byte, content []byte) []byte {
+	b, start := begin(b, tag)
+	b = append(b, content...)
+	return end(b, start)
+}
+
+func appendOID(b []byte, oid asn1.ObjectIdentifier) []byte {
+	b, start := begin(b, tagOID)
+	if len(oid) >= 2 {
+		b = appendBase128(b, oid[0]*40+oid[1])
+		for _, arc := range oid[2:] {
+			b = appendBase128(b, arc)
+		}
+	}
+	return end(b, start)
+}
+
+func appendBase128(b []byte, v int) []byte {
+	n := 1
+	for i := v; i > 0x7f; i >>= 7 {
+		n++
+	}
+	for i := n - 1; i >= 0; i-- {
+		c := byte(v>>(7*uint(i))) & 0x7f
+		if i != 0 {
+			c |= 0x80
+		}
+		b = append(b, c)
+	}
+	return b
+}
+
+// appendInt64 appends the minimal two's complement encoding of v under tag.
+func appendInt64(b []byte, tag byte, v int64) []byte {
+	n := 1
+	for i := v; i > 127 || i < -128; i >>= 8 {
+		n++
+	}
+	b, start := begin(b, tag)
+	for i := n - 1; i >= 0; i-- {
+		b = append(b, byte(v>>(8*uint(i))))
+	}
+	return end(b, start)
+}
+
+var bigOne = big.NewInt(1)
+
+// appendBigInt appends n as an INTEGER.
+func appendBigInt(b []byte, n *big.Int) ([]byte, error) {
+	if n == nil {
+		return nil, errors.New("nil serial number")
+	}
+	b, start := begin(b, tagInteger)
+	switch n.Sign() {
+	case 0:
+		b = append(b, 0)
+	case 1:
+		size := (n.BitLen() + 7) / 8
+		if n.BitLen()%8 == 0 {
+			b = append(b, 0)
+		}
+		b = append(b, make([]byte, size)...)
+		n.FillBytes(b[len(b)-size:])
+	default:
+		// As encoding/asn1: the complement of |n| - 1.
+		m := new(big.Int).Neg(n)
+		m.Sub(m, bigOne)
+		size := (m.BitLen() + 7) / 8
+		if m.BitLen()%8 == 0 {
+			b = append(b, 0xff)
+		}
+		b = append(b, make([]byte, size)...)
+		m.FillBytes(b[len(b)-size:])
+		for i := len(b) - size; i < len(b); i++ {
+			b[i] ^= 0xff
+		}
+	}
+	return end(b, start), nil
+}
+
+// appendGeneralizedTime appends t, in UTC and to the second, as
+// encoding/asn1 does.
+func appendGeneralizedTime(b []byte, t time.Time) []byte {
+	t = t.UTC()
+	year, month, day := t.Date()
+	hour, min, sec := t.Clock()
+	b = append(b, tagGeneralizedTime, 15)
+	b = appendDigits(b, year, 4)
+	b = appendDigits(b, int(month), 2)
+	b = appendDigits(b, day, 2)
+	b = appendDigits(b, hour, 2)
+	b = appendDigits(b, min, 2)
+	b = appendDigits(b, sec, 2)
+	return append(b, 'Z')
+}
+
+func appendDigits(b []byte, v, n int) []byte {
+	for i := n - 1; i >= 0; i-- {
+		d := v
+		for j := 0; j < i; j++ {
+			d /= 10
+		}
+		b = append(b, byte('0'+d%10))
+	}
+	return b
+}
+
+// appendExtensions appends exts as the explicitly tagged [n] Extensions.
+func appendExtensions(b []byte, n byte, exts []pkix.Extension) []byte {
+	b, outer := begin(b, contextTag(n, true))
+	b, seq := begin(b, tagSequence)
+	for _, e := range exts {
+		var ext int
+		b, ext = begin(b, tagSequence)
+		b = appendOID(b, e.Id)
+		if e.Critical {
+			b = append(b, tagBoolean, 1, 0xff)
+		}
+		b = appendValue(b, tagOctetString, e.Value)
+		b = end(b, ext)
+	}
+	b = end(b, seq)
+	return end(b, outer)
+}
+
+// appendCertID appends a CertID with the hash algorithm's NULL parameters.
+func appendCertID(b []byte, id CertID) ([]byte, error) {
+	oid, ok := hashOIDs[id.HashAlgorithm]
+	if !ok {
+		return nil, errUnsupportedHash(id.HashAlgorithm)
+	}
+	b, start := begin(b, tagSequence)
+	b = appendAlgorithmIdentifier(b, oid, true)
+	b = appendValue(b, tagOctetString, id.NameHash)
+	b = appendValue(b, tagOctetString, id.KeyHash)
+	b, err := appendBigInt(b, id.SerialNumber)
+	if err != nil {
+		return nil, err
+	}
+	return end(b, start), nil
+}
+
+func appendAlgorithmIdentifier(b []byte, oid asn1.ObjectIdentifier, null bool) []byte {
+	b, start := begin(b, tagSequence)
+	b = appendOID(b, oid)
+	if null {
+		b = append(b, tagNull, 0)
+	}
+	return end(b, start)
+}
+
+// appendSingleResponse appends s as a SingleResponse.
+func appendSingleResponse(b []byte, s SingleResponse) ([]byte, error) {
+	b, start := begin(b, tagSequence)
+	b, err := appendCertID(b, s.CertID)
+	if err != nil {
+		return nil, err
+	}
+	switch s.Status {
+	case Good:
+		b = append(b, contextTag(0, false), 0)
+	case Revoked:
+		var revoked int
+		b, revoked = begin(b, contextTag(1, true))
+		b = appendGeneralizedTime(b, s.RevokedAt)
+		// The reason is optional with a zero default, so unspecified (0)
+		// is left out.
+		if s.RevocationReason != 0 {
+			var reason int
+			b, reason = begin(b, contextTag(0, true))
+			b = appendInt64(b, tagEnumerated, int64(s.RevocationReason))
+			b = end(b, reason)
+		}
+		b = end(b, revoked)
+	case Unknown:
+		b = append(b, contextTag(2, false), 0)
+	default:
+		return nil, errInvalidStatus(s.Status)
+	}
+	b = appendGeneralizedTime(b, s.ThisUpdate)
+	if !s.NextUpdate.IsZero() {
+		var next int
+		b, next = begin(b, contextTag(0, true))
+		b = appendGeneralizedTime(b, s.NextUpdate)
+		b = end(b, next)
+	}
+	if s.Extensions != nil {
+		b = appendExtensions(b, 1, s.Extensions)
+	}
+	return end(b, start), nil
+}
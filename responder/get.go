@@ -0,0 +1,117 @@
+package responder
+
+import (
+	"encoding/base64"
+	"errors"
+	"sync"
+)
+
+// MaxRequestSize bounds the DER of an OCSP request, posted or in a GET.
+const MaxRequestSize = 10 << 10
+
+// maxEncodedRequest is the base64 length of the largest accepted request.
+var maxEncodedRequest = base64.StdEncoding.EncodedLen(MaxRequestSize)
+
+// LooksLikeGET reports whether enc, a GET path without its leading
+// slashes, could be a base64 DER request: every DER SEQUENCE encodes to a
+// leading M.
+func LooksLikeGET(enc string) bool {
+	if len(enc) < 16 || len(enc) > 3*maxEncodedRequest || enc[0] != 'M' {
+		return false
+	}
+	for i := 0; i < len(enc); i++ {
+		if base64Canonical[enc[i]] == 0 && enc[i] != '%' {
+			return false
+		}
+	}
+	return true
+}
+
+// base64Canonical maps the characters of both base64 alphabets to the
+// standard one, and everything else to 0.
+var base64Canonical = func() (t [256]byte) {
+	for _, c := range []byte("ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/=") {
+		t[c] = c
+	}
+	t['-'], t['_'] = '+', '/'
+	return t
+}()
+
+// encodedPool holds canonical copies of encoded GET requests, since base64
+// decodes from bytes and converting the path would allocate.
+var encodedPool = sync.Pool{New: func() interface{} {
+	b := make([]byte, maxEncodedRequest)
+	return &b
+}}
+
+var (
+	// ErrNotBase64 is returned by DecodeGET for a path that is no
+	// request.
+	ErrNotBase64   = errors.New("OCSP GET path is not a base64 request")
+	errGETTooLarge = errors.New("OCSP request too large")
+)
+
+// canonicalBase64 copies enc into dst in the standard alphabet, decoding
+// the percent-encoded +, / and = that are left after net/http decoded the
+// path once.
+func canonicalBase64(dst []byte, enc string) ([]byte, bool) {
+	n := 0
+	for i := 0; i < len(enc); i++ {
+		c := enc[i]
+		if c == '%' {
+			if i+2 >= len(enc) {
+				return nil, false
+			}
+			switch enc[i+1 : i+3] {
+			case "2B", "2b":
+				c = '+'
+			case "2F", "2f":
+				c = '/'
+			case "3D", "3d":
+				c = '='
+			default:
+				return nil, false
+			}
+			i += 2
+		}
+		if c = base64Canonical[c]; c == 0 || n == len(dst) {
+			return nil, false
+		}
+		dst[n] = c
+		n++
+	}
+	return dst[:n], true
+}
+
+// DecodeGET decodes the base64 request enc, a GET path as net/http decoded
+// it without its leading slashes, into buf; a request larger than buf is
+// refused (RFC 6960 appendix A.1). Both base64 alphabets are
+// accepted, with or without padding, and with +, / and = percent-encoded
+// again or not, as clients and proxies mangle them. It does not allocate.
+func DecodeGET(enc string, buf []byte) ([]byte, error) {
+	if !LooksLikeGET(enc) {
+		return nil, ErrNotBase64
+	}
+	srcp := encodedPool.Get().(*[]byte)
+	defer encodedPool.Put(srcp)
+	src, ok := canonicalBase64(*srcp, enc)
+	if !ok {
+		return nil, ErrNotBase64
+	}
+	// Some clients leave the padding out.
+	encoding := base64.StdEncoding
+	if len(src)%4 != 0 {
+		for len(src) > 0 && src[len(src)-1] == '=' {
+			src = src[:len(src)-1]
+		}
+		encoding = base64.RawStdEncoding
+	}
+	if encoding.DecodedLen(len(src)) > len(buf) {
+		return nil, errGETTooLarge
+	}
+	n, err := encoding.Decode(buf, src)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
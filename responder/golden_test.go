@@ -0,0 +1,376 @@
+package responder
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"flag"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// The golden tests pin the exact DER of a matrix of responses, and their
+// decoded fields as canonical JSON, under testdata/golden. A change to
+// the encoder that alters a single byte on the wire fails them. When a
+// change is intended, review the diff of the regenerated files:
+//
+//	go test ./responder/ -run TestGolden -update
+//
+// ECDSA signatures are randomized, so ECDSA responses are pinned with an
+// empty signature and their signatures are verified instead.
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata/golden")
+
+const goldenDir = "testdata/golden"
+
+var (
+	goldenProducedAt = time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+	goldenThisUpdate = time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	goldenNextUpdate = time.Date(2025, 1, 8, 0, 0, 0, 0, time.UTC)
+	goldenRevokedAt  = time.Date(2024, 6, 30, 12, 0, 0, 0, time.UTC)
+	goldenInvalidAt  = time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+)
+
+// goldenSigners are the responder keys of the matrix, by file name under
+// testdata/golden/signers.
+var goldenSigners = []struct {
+	name     string
+	generate func() (crypto.Signer, error)
+}{
+	{"rsa2048", func() (crypto.Signer, error) { return rsa.GenerateKey(rand.Reader, 2048) }},
+	{"p256", func() (crypto.Signer, error) { return ecdsa.GenerateKey(elliptic.P256(), rand.Reader) }},
+	{"p384", func() (crypto.Signer, error) { return ecdsa.GenerateKey(elliptic.P384(), rand.Reader) }},
+	{"p521", func() (crypto.Signer, error) { return ecdsa.GenerateKey(elliptic.P521(), rand.Reader) }},
+	{"ed25519", func() (crypto.Signer, error) {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	}},
+}
+
+// goldenSigner loads the signer name from testdata, creating its key and
+// self-signed certificate with -update if they do not exist yet.
+func goldenSigner(t *testing.T, name string) *Signer {
+	t.Helper()
+	certFile := filepath.Join(goldenDir, "signers", name+".pem")
+	keyFile := filepath.Join(goldenDir, "signers", name+".key")
+	if _, err := os.Stat(certFile); os.IsNotExist(err) && *update {
+		for _, gs := range goldenSigners {
+			if gs.name == name {
+				writeGoldenSigner(t, certFile, keyFile, name, gs.generate)
+			}
+		}
+	}
+	s, err := LoadSigner(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("%v (run with -update to create it)", err)
+	}
+	return s
+}
+
+func writeGoldenSigner(t *testing.T, certFile, keyFile, name string, generate func() (crypto.Signer, error)) {
+	t.Helper()
+	key, err := generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := issueTestCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "Golden Responder " + name},
+		NotBefore:   time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		NotAfter:    time.Date(2044, 1, 1, 0, 0, 0, 0, time.UTC),
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageOCSPSigning},
+	}, key, nil)
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeGolden(t, certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.Cert.Raw}))
+	writeGolden(t, keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}))
+}
+
+func writeGolden(t *testing.T, path string, data []byte) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// goldenCertID returns a CertID with fixed issuer hashes of the length
+// hash produces.
+func goldenCertID(hash crypto.Hash, serial int64) CertID {
+	h := hash.New()
+	h.Write([]byte("golden issuer name"))
+	nameHash := h.Sum(nil)
+	h.Reset()
+	h.Write([]byte("golden issuer key"))
+	return CertID{HashAlgorithm: hash, NameHash: nameHash, KeyHash: h.Sum(nil), SerialNumber: big.NewInt(serial)}
+}
+
+func goldenGood(serial int64) SingleResponse {
+	return SingleResponse{CertID: goldenCertID(crypto.SHA1, serial), Status: Good, ThisUpdate: goldenThisUpdate, NextUpdate: goldenNextUpdate}
+}
+
+func goldenRevoked(serial int64, reason int, e Entry) SingleResponse {
+	s := goldenGood(serial)
+	s.Status, s.RevokedAt, s.RevocationReason = Revoked, goldenRevokedAt, reason
+	s.Extensions = e.SingleExtensions()
+	return s
+}
+
+// goldenCase is one response of the matrix. A nil template is an
+// unsigned error response with the status only.
+type goldenCase struct {
+	name   string
+	signer string
+	status ResponseStatus
+	tmpl   func(s *Signer) *ResponseTemplate
+}
+
+func goldenCases() []goldenCase {
+	withCert := func(singles ...SingleResponse) func(s *Signer) *ResponseTemplate {
+		return func(s *Signer) *ResponseTemplate {
+			return &ResponseTemplate{ProducedAt: goldenProducedAt, Responses: singles, Certificates: []*x509.Certificate{s.Cert}}
+		}
+	}
+	cases := []goldenCase{
+		{name: "error-malformed-request", status: MalformedRequest},
+		{name: "error-internal-error", status: InternalError},
+		{name: "error-try-later", status: TryLater},
+		{name: "error-sig-required", status: SignatureRequired},
+		{name: "error-unauthorized", status: Unauthorized},
+	}
+	// Every signature algorithm, on the most common response.
+	for _, gs := range goldenSigners {
+		cases = append(cases, goldenCase{name: gs.name + "-good", signer: gs.name, tmpl: withCert(goldenGood(0x1001))})
+	}
+	// Statuses, reasons and extensions, with a deterministic signature.
+	cases = append(cases,
+		goldenCase{name: "revoked-unspecified", signer: "rsa2048", tmpl: withCert(goldenRevoked(0x1002, 0, Entry{}))},
+		goldenCase{name: "revoked-key-compromise", signer: "rsa2048", tmpl: withCert(goldenRevoked(0x1003, 1, Entry{}))},
+		goldenCase{name: "revoked-invalidity-date", signer: "rsa2048", tmpl: withCert(goldenRevoked(0x1004, 1, Entry{InvalidityDate: goldenInvalidAt}))},
+		goldenCase{name: "revoked-certificate-hold", signer: "rsa2048", tmpl: withCert(goldenRevoked(0x1005, 6, Entry{HoldInstruction: asn1.ObjectIdentifier{1, 2, 840, 10040, 2, 2}}))},
+		goldenCase{name: "crl-id", signer: "rsa2048", tmpl: func(s *Signer) *ResponseTemplate {
+			ext, err := CrlID{URL: "http://crl.example.mil/crl/GOLDENCA_1.crl", Number: big.NewInt(4242), Time: goldenThisUpdate}.Extension()
+			if err != nil {
+				panic(err)
+			}
+			good, revoked := goldenGood(0x100d), goldenRevoked(0x100e, 1, Entry{InvalidityDate: goldenInvalidAt})
+			good.Extensions = []pkix.Extension{ext}
+			revoked.Extensions = append(revoked.Extensions, ext)
+			return withCert(good, revoked)(s)
+		}},
+		goldenCase{name: "unknown", signer: "rsa2048", tmpl: withCert(SingleResponse{CertID: goldenCertID(crypto.SHA1, 0x1006), Status: Unknown, ThisUpdate: goldenThisUpdate, NextUpdate: goldenNextUpdate})},
+		goldenCase{name: "no-next-update", signer: "rsa2048", tmpl: withCert(SingleResponse{CertID: goldenCertID(crypto.SHA1, 0x1007), Status: Good, ThisUpdate: goldenThisUpdate})},
+		goldenCase{name: "large-serial", signer: "rsa2048", tmpl: func(s *Signer) *ResponseTemplate {
+			single := goldenGood(0)
+			single.SerialNumber, _ = new(big.Int).SetString("7fffffffffffffffffffffffffffffffffffffff", 16)
+			return withCert(single)(s)
+		}},
+		goldenCase{name: "multiple", signer: "rsa2048", tmpl: withCert(goldenGood(0x1008), goldenRevoked(0x1009, 4, Entry{}), SingleResponse{CertID: goldenCertID(crypto.SHA1, 0x100a), Status: Unknown, ThisUpdate: goldenThisUpdate, NextUpdate: goldenNextUpdate})},
+		goldenCase{name: "no-certificates", signer: "rsa2048", tmpl: func(s *Signer) *ResponseTemplate {
+			return &ResponseTemplate{ProducedAt: goldenProducedAt, Responses: []SingleResponse{goldenGood(0x100b)}}
+		}},
+		goldenCase{name: "nonce", signer: "rsa2048", tmpl: func(s *Signer) *ResponseTemplate {
+			t := withCert(goldenGood(0x100c))(s)
+			nonce, _ := asn1.Marshal([]byte("0123456789abcdef"))
+			t.Extensions = []pkix.Extension{{Id: asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 48, 1, 2}, Value: nonce}}
+			return t
+		}},
+		goldenCase{name: "certid-hashes", signer: "ed25519", tmpl: func(s *Signer) *ResponseTemplate {
+			var singles []SingleResponse
+			for i, h := range []crypto.Hash{crypto.SHA1, crypto.SHA256, crypto.SHA384, crypto.SHA512} {
+				single := goldenGood(0x2000 + int64(i))
+				single.CertID = goldenCertID(h, 0x2000+int64(i))
+				singles = append(singles, single)
+			}
+			return withCert(singles...)(s)
+		}},
+	)
+	return cases
+}
+
+// TestGoldenResponses builds every response of the matrix and compares
+// its DER and decoded fields with testdata/golden.
+func TestGoldenResponses(t *testing.T) {
+	for _, c := range goldenCases() {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			der := ErrorResponse(c.status)
+			var signer *Signer
+			if c.tmpl != nil {
+				signer = goldenSigner(t, c.signer)
+				var err error
+				if der, err = CreateResponse(c.tmpl(signer), signer); err != nil {
+					t.Fatal(err)
+				}
+			}
+			resp, err := ParseResponse(der)
+			if err != nil {
+				t.Fatal(err)
+			}
+			randomized := false
+			if signer != nil {
+				if err := resp.CheckSignatureFrom(signer.Cert); err != nil {
+					t.Fatalf("signature: %v", err)
+				}
+				if _, ok := signer.Key.Public().(*ecdsa.PublicKey); ok {
+					randomized = true
+					if der, err = maskSignature(der); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			js, err := json.MarshalIndent(goldenFields(resp, randomized), "", "  ")
+			if err != nil {
+				t.Fatal(err)
+			}
+			compareGolden(t, filepath.Join(goldenDir, c.name+".der"), der)
+			compareGolden(t, filepath.Join(goldenDir, c.name+".json"), append(js, '\n'))
+		})
+	}
+}
+
+func compareGolden(t *testing.T, path string, got []byte) {
+	t.Helper()
+	if *update {
+		writeGolden(t, path, got)
+		return
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%v (run with -update to create it)", err)
+	}
+	if bytes.Equal(got, want) {
+		return
+	}
+	i := 0
+	for i < len(got) && i < len(want) && got[i] == want[i] {
+		i++
+	}
+	t.Errorf("%s: differs from byte %d on (got %d bytes, want %d); if the change is intended, rerun with -update and review the diff", path, i, len(got), len(want))
+	if filepath.Ext(path) == ".json" {
+		t.Logf("got:\n%s", got)
+	}
+}
+
+// maskSignature empties the signature of a successful DER response.
+func maskSignature(der []byte) ([]byte, error) {
+	var outer responseASN1
+	if _, err := asn1.Unmarshal(der, &outer); err != nil {
+		return nil, err
+	}
+	var basic struct {
+		TBSResponseData    asn1.RawValue
+		SignatureAlgorithm asn1.RawValue
+		Signature          asn1.BitString
+		Certificates       asn1.RawValue `asn1:"optional"`
+	}
+	if _, err := asn1.Unmarshal(outer.Response.Response, &basic); err != nil {
+		return nil, err
+	}
+	basic.Signature = asn1.BitString{}
+	var err error
+	if outer.Response.Response, err = asn1.Marshal(basic); err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(outer)
+}
+
+// goldenResponse is the canonical JSON form of a decoded response: fixed
+// field order, hex bytes, dotted OIDs and RFC 3339 UTC times.
+type goldenResponse struct {
+	Status             string            `json:"status"`
+	ProducedAt         string            `json:"produced_at,omitempty"`
+	ResponderKeyHash   string            `json:"responder_key_hash,omitempty"`
+	ResponderName      string            `json:"responder_name,omitempty"`
+	Responses          []goldenSingle    `json:"responses,omitempty"`
+	Extensions         []goldenExtension `json:"extensions,omitempty"`
+	SignatureAlgorithm string            `json:"signature_algorithm,omitempty"`
+	// Signature is the hex signature, or "randomized" for ECDSA.
+	Signature    string   `json:"signature,omitempty"`
+	Certificates []string `json:"certificates,omitempty"`
+}
+
+type goldenSingle struct {
+	HashAlgorithm    string            `json:"hash_algorithm"`
+	NameHash         string            `json:"issuer_name_hash"`
+	KeyHash          string            `json:"issuer_key_hash"`
+	Serial           string            `json:"serial"`
+	Status           string            `json:"status"`
+	RevokedAt        string            `json:"revoked_at,omitempty"`
+	RevocationReason int               `json:"revocation_reason,omitempty"`
+	ThisUpdate       string            `json:"this_update"`
+	NextUpdate       string            `json:"next_update,omitempty"`
+	Extensions       []goldenExtension `json:"extensions,omitempty"`
+}
+
+type goldenExtension struct {
+	ID       string `json:"id"`
+	Critical bool   `json:"critical,omitempty"`
+	Value    string `json:"value"`
+}
+
+func goldenTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+func goldenExtensions(exts []pkix.Extension) []goldenExtension {
+	var out []goldenExtension
+	for _, e := range exts {
+		out = append(out, goldenExtension{ID: e.Id.String(), Critical: e.Critical, Value: hex.EncodeToString(e.Value)})
+	}
+	return out
+}
+
+func goldenFields(r *Response, randomized bool) goldenResponse {
+	g := goldenResponse{Status: r.Status.String()}
+	if r.Status != Successful {
+		return g
+	}
+	g.ProducedAt = goldenTime(r.ProducedAt)
+	g.ResponderKeyHash = hex.EncodeToString(r.ResponderKeyHash)
+	g.ResponderName = hex.EncodeToString(r.ResponderName)
+	g.Extensions = goldenExtensions(r.Extensions)
+	g.SignatureAlgorithm = r.SignatureAlgorithm.String()
+	g.Signature = hex.EncodeToString(r.Signature)
+	if randomized {
+		g.Signature = "randomized"
+	}
+	for _, c := range r.Certificates {
+		g.Certificates = append(g.Certificates, c.Subject.String())
+	}
+	for _, s := range r.Responses {
+		g.Responses = append(g.Responses, goldenSingle{
+			HashAlgorithm:    s.HashAlgorithm.String(),
+			NameHash:         hex.EncodeToString(s.NameHash),
+			KeyHash:          hex.EncodeToString(s.KeyHash),
+			Serial:           s.SerialNumber.Text(16),
+			Status:           s.Status.String(),
+			RevokedAt:        goldenTime(s.RevokedAt),
+			RevocationReason: s.RevocationReason,
+			ThisUpdate:       goldenTime(s.ThisUpdate),
+			NextUpdate:       goldenTime(s.NextUpdate),
+			Extensions:       goldenExtensions(s.Extensions),
+		})
+	}
+	return g
+}
@@ -0,0 +1,279 @@
+package responder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Handler answers OCSP requests over HTTP from an Index, signing every
+// response with one Signer. It is the OCSP side of the responder without
+// its CRL handling, caching or admin API, for programs that keep their own
+// revocation data and mount OCSP in a server they already run:
+//
+//	h := responder.Chain(responder.NewHandler(index, signer),
+//		responder.Metrics(observe),
+//		responder.RequireAuth(allowed),
+//		responder.RateLimit(100, 200, responder.ByRemoteIP))
+//	mux.Handle("/ocsp/", http.StripPrefix("/ocsp", h))
+//
+// Requests are DER posted as the body, or base64 in the path of a GET
+// (RFC 6960 appendix A.1); mounted under a prefix, strip it first.
+type Handler struct {
+	index  Index
+	signer *Signer
+}
+
+// NewHandler returns a Handler answering from index and signing with
+// signer. The signer's certificate is embedded in responses unless it is
+// the CA of every CertID answered.
+func NewHandler(index Index, signer *Signer) *Handler {
+	return &Handler{index: index, signer: signer}
+}
+
+// Error responses are fixed, so they are encoded once.
+var errorResponses = map[ResponseStatus][]byte{
+	MalformedRequest: ErrorResponse(MalformedRequest),
+	InternalError:    ErrorResponse(InternalError),
+	TryLater:         ErrorResponse(TryLater),
+	Unauthorized:     ErrorResponse(Unauthorized),
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var der []byte
+	var err error
+	switch r.Method {
+	case http.MethodGet:
+		der, err = DecodeGET(strings.TrimLeft(r.URL.Path, "/"), make([]byte, MaxRequestSize))
+	case http.MethodPost:
+		der, err = io.ReadAll(io.LimitReader(r.Body, MaxRequestSize+1))
+		if err == nil && len(der) > MaxRequestSize {
+			err = errors.New("OCSP request too large")
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "OCSP requests are GET or POST", http.StatusMethodNotAllowed)
+		if x := exchangeFrom(r.Context()); x != nil {
+			x.HTTPStatus = http.StatusMethodNotAllowed
+		}
+		return
+	}
+	if err != nil {
+		WriteError(w, r, MalformedRequest)
+		return
+	}
+	req, err := ParseRequest(der)
+	if err != nil {
+		WriteError(w, r, MalformedRequest)
+		return
+	}
+	if x := exchangeFrom(r.Context()); x != nil {
+		x.CertIDs = len(req.CertIDs)
+	}
+
+	now := time.Now()
+	tmpl := &ResponseTemplate{ProducedAt: now}
+	embed := false
+	for _, id := range req.CertIDs {
+		single, err := h.index.Lookup(r.Context(), id)
+		switch {
+		case errors.Is(err, ErrUnknownIssuer):
+			WriteError(w, r, Unauthorized)
+			return
+		case errors.Is(err, ErrTryLater):
+			WriteError(w, r, TryLater)
+			return
+		case err != nil:
+			WriteError(w, r, InternalError)
+			return
+		}
+		// The CertID is answered as the client encoded it.
+		single.CertID = id
+		if single.ThisUpdate.IsZero() {
+			single.ThisUpdate = now
+		}
+		tmpl.Responses = append(tmpl.Responses, single)
+		if !id.MatchesIssuer(h.signer.Cert) {
+			embed = true
+		}
+	}
+	if embed {
+		tmpl.Certificates = append(tmpl.Certificates, h.signer.Cert)
+	}
+	resp, err := CreateResponse(tmpl, h.signer)
+	if err != nil {
+		WriteError(w, r, InternalError)
+		return
+	}
+	if r.Method == http.MethodGet {
+		setCacheHeaders(w.Header(), tmpl, now)
+	}
+	writeResponse(w, r, Successful, resp)
+}
+
+// setCacheHeaders lets HTTP caches keep a GET response until the earliest
+// nextUpdate it carries, as RFC 5019 section 6 describes. Responses
+// without a nextUpdate are not cached.
+func setCacheHeaders(hdr http.Header, tmpl *ResponseTemplate, now time.Time) {
+	var next time.Time
+	for _, single := range tmpl.Responses {
+		if single.NextUpdate.IsZero() {
+			hdr.Set("Cache-Control", "no-cache")
+			return
+		}
+		if next.IsZero() || single.NextUpdate.Before(next) {
+			next = single.NextUpdate
+		}
+	}
+	maxAge := int(next.Sub(now) / time.Second)
+	if maxAge <= 0 {
+		hdr.Set("Cache-Control", "no-cache")
+		return
+	}
+	hdr.Set("Cache-Control", fmt.Sprintf("max-age=%d, public, no-transform, must-revalidate", maxAge))
+	hdr.Set("Last-Modified", now.UTC().Format(http.TimeFormat))
+	hdr.Set("Expires", next.UTC().Format(http.TimeFormat))
+}
+
+// WriteError answers r with an unsigned response of status, which must
+// not be Successful. Middleware refusing a request answers this way, so
+// OCSP clients get a status they understand rather than an HTTP error.
+func WriteError(w http.ResponseWriter, r *http.Request, status ResponseStatus) {
+	der, ok := errorResponses[status]
+	if !ok {
+		der = ErrorResponse(status)
+	}
+	writeResponse(w, r, status, der)
+}
+
+func writeResponse(w http.ResponseWriter, r *http.Request, status ResponseStatus, der []byte) {
+	if x := exchangeFrom(r.Context()); x != nil {
+		x.Status, x.HTTPStatus = status, http.StatusOK
+	}
+	w.Header().Set("Content-Type", "application/ocsp-response")
+	w.Write(der)
+}
+
+// Middleware wraps a Handler, or another middleware, with one concern.
+type Middleware func(http.Handler) http.Handler
+
+// Chain returns h wrapped in middleware, the first outermost: it sees
+// requests first and responses last.
+func Chain(h http.Handler, middleware ...Middleware) http.Handler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		h = middleware[i](h)
+	}
+	return h
+}
+
+// Exchange describes a request answered under Metrics.
+type Exchange struct {
+	Method string
+	// Status is the OCSP response status, and HTTPStatus the HTTP one:
+	// 200 for every OCSP response, 0 if nothing was written.
+	Status     ResponseStatus
+	HTTPStatus int
+	// CertIDs is the number of certificates asked about, 0 for a request
+	// refused before it was parsed.
+	CertIDs  int
+	Duration time.Duration
+}
+
+type exchangeKey struct{}
+
+// exchangeFrom returns the exchange Metrics follows in ctx, or nil.
+func exchangeFrom(ctx context.Context) *Exchange {
+	x, _ := ctx.Value(exchangeKey{}).(*Exchange)
+	return x
+}
+
+// Metrics calls observe with every exchange once it is answered; observe
+// typically counts them by Status and times them.
+func Metrics(observe func(Exchange)) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			x := &Exchange{Method: r.Method}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), exchangeKey{}, x)))
+			x.Duration = time.Since(start)
+			observe(*x)
+		})
+	}
+}
+
+// RequireAuth answers unauthorized the requests allow refuses, such as
+// those without a client certificate of the right CA or from outside a
+// network.
+func RequireAuth(allow func(r *http.Request) bool) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !allow(r) {
+				WriteError(w, r, Unauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// maxRateLimitKeys bounds the buckets RateLimit keeps; past it they are all
+// dropped, which lets every client start afresh.
+const maxRateLimitKeys = 65536
+
+// RateLimit answers tryLater the requests over rate per second, with
+// bursts of up to burst, counted separately under each key returns; a
+// key of "" is not limited.
+func RateLimit(rate float64, burst int, key func(r *http.Request) string) Middleware {
+	type bucket struct {
+		tokens float64
+		at     time.Time
+	}
+	var mu sync.Mutex
+	buckets := make(map[string]*bucket)
+	allow := func(k string, now time.Time) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		b := buckets[k]
+		if b == nil {
+			if len(buckets) >= maxRateLimitKeys {
+				buckets = make(map[string]*bucket)
+			}
+			b = &bucket{tokens: float64(burst), at: now}
+			buckets[k] = b
+		}
+		b.tokens += now.Sub(b.at).Seconds() * rate
+		if b.tokens > float64(burst) {
+			b.tokens = float64(burst)
+		}
+		b.at = now
+		if b.tokens < 1 {
+			return false
+		}
+		b.tokens--
+		return true
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if k := key(r); k != "" && !allow(k, time.Now()) {
+				WriteError(w, r, TryLater)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// ByRemoteIP keys RateLimit by the client's IP address.
+func ByRemoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,202 @@
+package responder
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"encoding/base64"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func handlerRequest(t *testing.T, issuer *x509.Certificate, serial int64) []byte {
+	t.Helper()
+	name, key, err := IssuerHashes(issuer, crypto.SHA1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := CreateRequest(CertID{HashAlgorithm: crypto.SHA1, NameHash: name, KeyHash: key, SerialNumber: big.NewInt(serial)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+func serveOCSP(h http.Handler, r *http.Request) (*httptest.ResponseRecorder, *Response) {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	resp, _ := ParseResponse(w.Body.Bytes())
+	return w, resp
+}
+
+func TestHandler(t *testing.T) {
+	ca := testCA(t, "Test CA", nil)
+	other := parseTestCert(t, keyHashDir+"/p384.pem")
+	h := NewHandler(mapIndex{issuer: ca.Cert, revoked: map[string]bool{"2": true}}, ca)
+
+	post := func(der []byte) *http.Request {
+		return httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(der))
+	}
+	for serial, want := range map[int64]Status{1: Good, 2: Revoked} {
+		w, resp := serveOCSP(h, post(handlerRequest(t, ca.Cert, serial)))
+		if resp == nil || resp.Status != Successful || len(resp.Responses) != 1 || resp.Responses[0].Status != want {
+			t.Fatalf("serial %d: got %+v", serial, resp)
+		}
+		if _, err := Verify(resp, ca.Cert, VerifyOptions{}); err != nil {
+			t.Errorf("serial %d: %v", serial, err)
+		}
+		if len(resp.Certificates) != 0 {
+			t.Errorf("serial %d: the CA's own certificate is embedded", serial)
+		}
+		if ct := w.Header().Get("Content-Type"); ct != "application/ocsp-response" {
+			t.Errorf("Content-Type %q", ct)
+		}
+	}
+
+	// GET, in the URL-safe alphabet without padding, percent-encoded.
+	enc := base64.RawURLEncoding.EncodeToString(handlerRequest(t, ca.Cert, 2))
+	_, resp := serveOCSP(h, httptest.NewRequest(http.MethodGet, "/"+strings.Replace(enc, "_", "%5F", -1), nil))
+	if resp == nil || resp.Status != Successful || resp.Responses[0].Status != Revoked {
+		t.Errorf("GET: got %+v", resp)
+	}
+
+	for name, c := range map[string]struct {
+		r    *http.Request
+		want ResponseStatus
+	}{
+		"unknown issuer": {post(handlerRequest(t, other, 1)), Unauthorized},
+		"garbage":        {post([]byte{0x30, 0x03, 0x02}), MalformedRequest},
+		"too large":      {post(make([]byte, MaxRequestSize+1)), MalformedRequest},
+		"bad GET":        {httptest.NewRequest(http.MethodGet, "/not*base64", nil), MalformedRequest},
+	} {
+		if _, resp := serveOCSP(h, c.r); resp == nil || resp.Status != c.want {
+			t.Errorf("%s: got %+v, want %v", name, resp, c.want)
+		}
+	}
+	if w, _ := serveOCSP(h, httptest.NewRequest(http.MethodPut, "/", nil)); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("PUT: HTTP %d", w.Code)
+	}
+}
+
+func TestHandlerMiddleware(t *testing.T) {
+	ca := testCA(t, "Test CA", nil)
+	var seen []Exchange
+	h := Chain(NewHandler(mapIndex{issuer: ca.Cert}, ca),
+		Metrics(func(x Exchange) { seen = append(seen, x) }),
+		RequireAuth(func(r *http.Request) bool { return r.Header.Get("X-Allowed") != "" }),
+		RateLimit(1e-9, 2, ByRemoteIP))
+	der := handlerRequest(t, ca.Cert, 1)
+	request := func(allowed bool) *http.Request {
+		r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(der))
+		if allowed {
+			r.Header.Set("X-Allowed", "1")
+		}
+		return r
+	}
+
+	want := []ResponseStatus{Unauthorized, Successful, Successful, TryLater}
+	for i, allowed := range []bool{false, true, true, true} {
+		if _, resp := serveOCSP(h, request(allowed)); resp == nil || resp.Status != want[i] {
+			t.Errorf("request %d: got %+v, want %v", i, resp, want[i])
+		}
+	}
+	// Another client has a bucket of its own.
+	r := request(true)
+	r.RemoteAddr = "192.0.2.7:1234"
+	if _, resp := serveOCSP(h, r); resp == nil || resp.Status != Successful {
+		t.Errorf("other client: got %+v", resp)
+	}
+
+	if len(seen) != 5 {
+		t.Fatalf("%d exchanges observed, want 5", len(seen))
+	}
+	for i, x := range seen[:4] {
+		if x.Status != want[i] || x.HTTPStatus != http.StatusOK || x.Method != http.MethodPost {
+			t.Errorf("exchange %d: %+v", i, x)
+		}
+	}
+	if seen[0].CertIDs != 0 || seen[1].CertIDs != 1 {
+		t.Errorf("CertIDs: %d, %d; want 0, 1", seen[0].CertIDs, seen[1].CertIDs)
+	}
+}
+
+// TestDecodeGET decodes a request whose standard base64 has a +, a / and
+// padding in each of the ways clients and proxies escape it, as net/http
+// leaves the path.
+func TestDecodeGET(t *testing.T) {
+	ca := testCA(t, "Test CA", nil)
+	var der []byte
+	var enc string
+	for serial := int64(1); ; serial++ {
+		der = handlerRequest(t, ca.Cert, serial)
+		enc = base64.StdEncoding.EncodeToString(der)
+		if strings.Contains(enc, "+") && strings.Contains(enc, "/") && strings.HasSuffix(enc, "=") {
+			break
+		}
+	}
+	escaped := strings.NewReplacer("+", "%2B", "/", "%2F", "=", "%3D").Replace(enc)
+	url := base64.URLEncoding.EncodeToString(der)
+	for name, in := range map[string]string{
+		"standard":            enc,
+		"standard unpadded":   strings.TrimRight(enc, "="),
+		"escaped":             escaped,
+		"escaped lower case":  strings.NewReplacer("%2B", "%2b", "%2F", "%2f", "%3D", "%3d").Replace(escaped),
+		"escaped plus only":   strings.Replace(enc, "+", "%2B", -1),
+		"base64url":           url,
+		"base64url unpadded":  strings.TrimRight(url, "="),
+		"base64url escaped =": strings.Replace(url, "=", "%3D", -1),
+	} {
+		got, err := DecodeGET(in, make([]byte, MaxRequestSize))
+		if err != nil || !bytes.Equal(got, der) {
+			t.Errorf("%s: DecodeGET(%q) = %x, %v, want %x", name, in, got, err, der)
+		}
+	}
+	for name, in := range map[string]string{
+		"other escape":     strings.Replace(escaped, "%2B", "%2C", 1),
+		"bad escape":       strings.Replace(escaped, "%2B", "%2G", 1),
+		"truncated escape": strings.TrimSuffix(escaped, "3D"),
+		"not base64":       strings.Replace(enc, "+", "*", 1),
+		"space":            strings.Replace(enc, "+", " ", 1),
+		"not a SEQUENCE":   "N" + enc[1:],
+		"too short":        enc[:8],
+		"too large":        "M" + strings.Repeat("A", base64.RawStdEncoding.EncodedLen(MaxRequestSize+1)),
+	} {
+		if got, err := DecodeGET(in, make([]byte, MaxRequestSize)); err == nil {
+			t.Errorf("%s: DecodeGET(%q) = %x, want an error", name, in, got)
+		}
+	}
+}
+
+func TestSetCacheHeaders(t *testing.T) {
+	now := time.Date(2025, 10, 1, 12, 0, 0, 0, time.UTC)
+	single := func(next time.Duration) SingleResponse {
+		s := SingleResponse{ThisUpdate: now}
+		if next != 0 {
+			s.NextUpdate = now.Add(next)
+		}
+		return s
+	}
+	for name, c := range map[string]struct {
+		responses    []SingleResponse
+		cacheControl string
+		expires      string
+	}{
+		"one":             {[]SingleResponse{single(time.Hour)}, "max-age=3600, public, no-transform, must-revalidate", "Wed, 01 Oct 2025 13:00:00 GMT"},
+		"earliest":        {[]SingleResponse{single(2 * time.Hour), single(time.Hour)}, "max-age=3600, public, no-transform, must-revalidate", "Wed, 01 Oct 2025 13:00:00 GMT"},
+		"no nextUpdate":   {[]SingleResponse{single(time.Hour), single(0)}, "no-cache", ""},
+		"past nextUpdate": {[]SingleResponse{single(-time.Minute)}, "no-cache", ""},
+	} {
+		hdr := http.Header{}
+		setCacheHeaders(hdr, &ResponseTemplate{Responses: c.responses}, now)
+		if got := hdr.Get("Cache-Control"); got != c.cacheControl {
+			t.Errorf("%s: Cache-Control %q, want %q", name, got, c.cacheControl)
+		}
+		if got := hdr.Get("Expires"); got != c.expires {
+			t.Errorf("%s: Expires %q, want %q", name, got, c.expires)
+		}
+	}
+}
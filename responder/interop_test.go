@@ -0,0 +1,403 @@
+//go:build interop
+// +build interop
+
+// Interoperability tests that put responses from this package in front of
+// real OCSP clients: openssl ocsp and the NSS tools (certutil, ocspclnt).
+// They need the client binaries on PATH and skip the clients that are
+// missing. Run them with
+//
+//	go test -tags interop ./responder/
+package responder
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// maxCompactResponse bounds a single response without embedded
+// certificates. Keeping responses small lets them fit in one TCP segment
+// and in the stapling buffers of constrained TLS servers.
+const maxCompactResponse = 1024
+
+var (
+	goodSerial    = big.NewInt(0x1001)
+	revokedSerial = big.NewInt(0x1002)
+	holdSerial    = big.NewInt(0x1003)
+	unknownSerial = big.NewInt(0x1004)
+)
+
+type keyType struct {
+	name string
+	gen  func() (crypto.Signer, error)
+}
+
+var keyTypes = []keyType{
+	{"rsa2048", func() (crypto.Signer, error) { return rsa.GenerateKey(rand.Reader, 2048) }},
+	{"p256", func() (crypto.Signer, error) { return ecdsa.GenerateKey(elliptic.P256(), rand.Reader) }},
+	{"p384", func() (crypto.Signer, error) { return ecdsa.GenerateKey(elliptic.P384(), rand.Reader) }},
+}
+
+// testPKI is a throwaway CA, an optional delegated responder and end-entity
+// certificates for each test serial, written to dir as PEM files.
+type testPKI struct {
+	dir    string
+	ca     *x509.Certificate
+	signer *Signer
+	ee     map[string]*x509.Certificate // by serial in hex
+}
+
+func newTestPKI(t *testing.T, kt keyType, delegated bool, ocspURL string) *testPKI {
+	t.Helper()
+	dir := t.TempDir()
+	now := time.Now()
+
+	caKey, err := kt.gen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	caSigner := issueTestCert(t, &x509.Certificate{
+		Subject:               pkix.Name{Country: []string{"US"}, Organization: []string{"Interop Test"}, CommonName: "Interop CA " + kt.name},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}, caKey, nil)
+	ca := caSigner.Cert
+	p := &testPKI{dir: dir, ca: ca, signer: caSigner, ee: make(map[string]*x509.Certificate)}
+	p.write(t, "ca.pem", ca)
+
+	if delegated {
+		key, err := kt.gen()
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.signer = issueTestCert(t, &x509.Certificate{
+			SerialNumber: big.NewInt(2),
+			Subject:      pkix.Name{CommonName: "Interop OCSP Responder " + kt.name},
+			NotBefore:    now.Add(-time.Hour),
+			NotAfter:     now.Add(24 * time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageOCSPSigning},
+			ExtraExtensions: []pkix.Extension{
+				// id-pkix-ocsp-nocheck
+				{Id: asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 48, 1, 5}, Value: asn1.NullBytes},
+			},
+		}, key, caSigner)
+		p.write(t, "responder.pem", p.signer.Cert)
+	}
+
+	eeKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, serial := range []*big.Int{goodSerial, revokedSerial, holdSerial, unknownSerial} {
+		cert := issueTestCert(t, &x509.Certificate{
+			SerialNumber: serial,
+			Subject:      pkix.Name{CommonName: fmt.Sprintf("interop-%x", serial)},
+			NotBefore:    now.Add(-time.Hour),
+			NotAfter:     now.Add(12 * time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+			OCSPServer:   []string{ocspURL},
+		}, eeKey, caSigner).Cert
+		p.ee[fmt.Sprintf("%x", serial)] = cert
+		p.write(t, fmt.Sprintf("ee-%x.pem", serial), cert)
+	}
+	return p
+}
+
+func (p *testPKI) write(t *testing.T, name string, cert *x509.Certificate) {
+	t.Helper()
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	if err := os.WriteFile(filepath.Join(p.dir, name), data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (p *testPKI) path(name string) string { return filepath.Join(p.dir, name) }
+
+// single answers one CertID the way the responder does for each of the
+// test serials.
+func (p *testPKI) single(id CertID, now time.Time) SingleResponse {
+	s := SingleResponse{
+		CertID:     id,
+		Status:     Good,
+		ThisUpdate: now.Add(-time.Minute).Truncate(time.Second),
+		NextUpdate: now.Add(time.Hour).Truncate(time.Second),
+	}
+	if !id.MatchesIssuer(p.ca) {
+		s.Status = Unknown
+		return s
+	}
+	switch {
+	case id.SerialNumber.Cmp(revokedSerial) == 0:
+		e := Entry{
+			Serial:         revokedSerial,
+			RevokedAt:      now.Add(-30 * time.Minute).Truncate(time.Second),
+			Reason:         KeyCompromise,
+			InvalidityDate: now.Add(-48 * time.Hour).Truncate(time.Second),
+		}
+		s.Status, s.RevokedAt, s.RevocationReason, s.Extensions = Revoked, e.RevokedAt, e.Reason, e.SingleExtensions()
+	case id.SerialNumber.Cmp(holdSerial) == 0:
+		e := Entry{
+			Serial:    holdSerial,
+			RevokedAt: now.Add(-10 * time.Minute).Truncate(time.Second),
+			Reason:    CertificateHold,
+			// id-holdinstruction-reject
+			HoldInstruction: asn1.ObjectIdentifier{1, 2, 840, 10040, 2, 3},
+		}
+		s.Status, s.RevokedAt, s.RevocationReason, s.Extensions = Revoked, e.RevokedAt, e.Reason, e.SingleExtensions()
+	case id.SerialNumber.Cmp(unknownSerial) == 0:
+		s.Status = Unknown
+	}
+	return s
+}
+
+// respond builds the signed response for a DER request.
+func (p *testPKI) respond(der []byte) ([]byte, error) {
+	req, err := ParseRequest(der)
+	if err != nil {
+		return ErrorResponse(MalformedRequest), nil
+	}
+	now := time.Now()
+	tmpl := &ResponseTemplate{ProducedAt: now}
+	for _, id := range req.CertIDs {
+		tmpl.Responses = append(tmpl.Responses, p.single(id, now))
+	}
+	if p.signer.Cert != p.ca {
+		tmpl.Certificates = []*x509.Certificate{p.signer.Cert}
+	}
+	return CreateResponse(tmpl, p.signer)
+}
+
+// server is an OCSP endpoint for p that records the size of every
+// response it sends.
+type server struct {
+	*httptest.Server
+	pki   *testPKI
+	sizes []int
+}
+
+func newServer(t *testing.T) *server {
+	s := &server{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(io.LimitReader(r.Body, 10<<10))
+		if err != nil || r.Method != http.MethodPost {
+			http.Error(w, "POST a DER OCSP request", http.StatusBadRequest)
+			return
+		}
+		der, err := s.pki.respond(body)
+		if err != nil {
+			t.Errorf("respond: %v", err)
+			der = ErrorResponse(InternalError)
+		}
+		s.sizes = append(s.sizes, len(der))
+		w.Header().Set("Content-Type", "application/ocsp-response")
+		w.Write(der)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func run(t *testing.T, name string, args ...string) (string, error) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, name, args...).CombinedOutput()
+	return string(out), err
+}
+
+func need(t *testing.T, names ...string) {
+	t.Helper()
+	for _, name := range names {
+		if _, err := exec.LookPath(name); err != nil {
+			t.Skipf("%s not on PATH", name)
+		}
+	}
+}
+
+// wantStatus is the status each client should report per serial.
+var wantStatus = map[*big.Int]string{
+	goodSerial:    "good",
+	revokedSerial: "revoked",
+	holdSerial:    "revoked",
+	unknownSerial: "unknown",
+}
+
+func TestOpenSSLInterop(t *testing.T) {
+	need(t, "openssl")
+	for _, kt := range keyTypes {
+		for _, delegated := range []bool{false, true} {
+			for _, hash := range []string{"-sha1", "-sha256"} {
+				name := fmt.Sprintf("%s/delegated=%v/%s", kt.name, delegated, hash[1:])
+				t.Run(name, func(t *testing.T) {
+					srv := newServer(t)
+					srv.pki = newTestPKI(t, kt, delegated, srv.URL)
+					p := srv.pki
+					for serial, want := range wantStatus {
+						ee := p.path(fmt.Sprintf("ee-%x.pem", serial))
+						out, err := run(t, "openssl", "ocsp", "-no_nonce", hash,
+							"-issuer", p.path("ca.pem"), "-cert", ee,
+							"-url", srv.URL, "-CAfile", p.path("ca.pem"), "-resp_text")
+						if err != nil {
+							t.Fatalf("openssl ocsp for %x: %v\n%s", serial, err, out)
+						}
+						if !strings.Contains(out, "Response verify OK") {
+							t.Errorf("openssl did not verify the response for %x:\n%s", serial, out)
+						}
+						if !strings.Contains(out, ee+": "+want) {
+							t.Errorf("openssl status for %x: want %s\n%s", serial, want, out)
+						}
+						switch serial {
+						case revokedSerial:
+							for _, s := range []string{"Reason: keyCompromise", "Invalidity Date"} {
+								if !strings.Contains(out, s) {
+									t.Errorf("response for %x lacks %q:\n%s", serial, s, out)
+								}
+							}
+						case holdSerial:
+							for _, s := range []string{"Reason: certificateHold", "Hold Instruction Code"} {
+								if !strings.Contains(out, s) {
+									t.Errorf("response for %x lacks %q:\n%s", serial, s, out)
+								}
+							}
+						}
+					}
+					checkSizes(t, srv)
+				})
+			}
+		}
+	}
+}
+
+// TestOpenSSLMultipleCertIDs sends several CertIDs in one request and
+// expects one verified status per certificate, in order.
+func TestOpenSSLMultipleCertIDs(t *testing.T) {
+	need(t, "openssl")
+	srv := newServer(t)
+	srv.pki = newTestPKI(t, keyTypes[1], true, srv.URL)
+	p := srv.pki
+	args := []string{"ocsp", "-no_nonce", "-issuer", p.path("ca.pem")}
+	for _, serial := range []*big.Int{goodSerial, revokedSerial, unknownSerial} {
+		args = append(args, "-cert", p.path(fmt.Sprintf("ee-%x.pem", serial)))
+	}
+	args = append(args, "-url", srv.URL, "-CAfile", p.path("ca.pem"))
+	out, err := run(t, "openssl", args...)
+	if err != nil {
+		t.Fatalf("openssl ocsp: %v\n%s", err, out)
+	}
+	if !strings.Contains(out, "Response verify OK") {
+		t.Errorf("openssl did not verify the response:\n%s", out)
+	}
+	re := regexp.MustCompile(`ee-([0-9a-f]+)\.pem: (\w+)`)
+	var got []string
+	for _, m := range re.FindAllStringSubmatch(out, -1) {
+		got = append(got, m[1]+"="+m[2])
+	}
+	want := []string{"1001=good", "1002=revoked", "1004=unknown"}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("statuses = %v, want %v\n%s", got, want, out)
+	}
+}
+
+// TestOpenSSLParsesErrorResponses checks the unsigned error responses.
+func TestOpenSSLParsesErrorResponses(t *testing.T) {
+	need(t, "openssl")
+	dir := t.TempDir()
+	for _, status := range []ResponseStatus{MalformedRequest, InternalError, TryLater, SignatureRequired, Unauthorized} {
+		path := filepath.Join(dir, "resp.der")
+		if err := os.WriteFile(path, ErrorResponse(status), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		out, _ := run(t, "openssl", "ocsp", "-respin", path, "-resp_text", "-noverify")
+		want := fmt.Sprintf("Responder Error: %s (%d)", openSSLStatusName[status], int(status))
+		if !strings.Contains(out, want) {
+			t.Errorf("status %v: want %q in\n%s", status, want, out)
+		}
+	}
+}
+
+var openSSLStatusName = map[ResponseStatus]string{
+	MalformedRequest:  "malformedrequest",
+	InternalError:     "internalerror",
+	TryLater:          "trylater",
+	SignatureRequired: "sigrequired",
+	Unauthorized:      "unauthorized",
+}
+
+// TestNSSInterop fetches status with the NSS ocspclnt tool, which follows
+// the AIA OCSP URL in the certificate and verifies the response against
+// the trust anchors in its certificate database.
+func TestNSSInterop(t *testing.T) {
+	need(t, "certutil", "ocspclnt")
+	for _, kt := range keyTypes {
+		for _, delegated := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s/delegated=%v", kt.name, delegated), func(t *testing.T) {
+				srv := newServer(t)
+				srv.pki = newTestPKI(t, kt, delegated, srv.URL)
+				p := srv.pki
+				db := "sql:" + p.dir
+				if out, err := run(t, "certutil", "-N", "-d", db, "--empty-password"); err != nil {
+					t.Fatalf("certutil -N: %v\n%s", err, out)
+				}
+				if out, err := run(t, "certutil", "-A", "-d", db, "-n", "ca", "-t", "C,C,C", "-i", p.path("ca.pem")); err != nil {
+					t.Fatalf("certutil -A ca: %v\n%s", err, out)
+				}
+				for serial, want := range wantStatus {
+					nick := fmt.Sprintf("ee-%x", serial)
+					if out, err := run(t, "certutil", "-A", "-d", db, "-n", nick, "-t", ",,", "-i", p.path(nick+".pem")); err != nil {
+						t.Fatalf("certutil -A %s: %v\n%s", nick, err, out)
+					}
+					out, err := run(t, "ocspclnt", "-d", db, "-S", nick, "-l", srv.URL, "-t", "ca")
+					got := strings.ToLower(out)
+					if want == "good" && err != nil {
+						t.Errorf("ocspclnt %s: %v\n%s", nick, err, out)
+					}
+					if !strings.Contains(got, want) {
+						t.Errorf("ocspclnt %s: want status %s\n%s", nick, want, out)
+					}
+					if strings.Contains(got, "bad signature") || strings.Contains(got, "bad der") {
+						t.Errorf("ocspclnt rejected the response for %s:\n%s", nick, out)
+					}
+				}
+				checkSizes(t, srv)
+			})
+		}
+	}
+}
+
+// checkSizes asserts every response the server sent stayed compact,
+// allowing for an embedded responder certificate.
+func checkSizes(t *testing.T, srv *server) {
+	t.Helper()
+	limit := maxCompactResponse
+	if srv.pki.signer.Cert != srv.pki.ca {
+		limit += len(srv.pki.signer.Cert.Raw)
+	}
+	for _, n := range srv.sizes {
+		if n > limit {
+			t.Errorf("response of %d bytes exceeds %d", n, limit)
+		}
+	}
+}
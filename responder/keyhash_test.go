@@ -0,0 +1,246 @@
+package responder
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// The key hash tests check IssuerHashes against CertID hashes computed by
+// OpenSSL for issuer certificates under testdata/keyhash. Clients that
+// hash the whole SubjectPublicKeyInfo, re-encode the key or shift it by
+// its unused bits get CertIDs no responder matches, so the values are
+// recorded from openssl ocsp rather than from this package. With -update
+// and openssl on PATH, missing certificates are generated and every value
+// is recorded again:
+//
+//	go test ./responder/ -run TestIssuerHashes -update
+
+const keyHashDir = "testdata/keyhash"
+
+// keyHashIssuers are the issuer keys checked, with the openssl req
+// arguments that generate them. DoD Root CA 4 and 5 are P-256 and P-384
+// EC roots.
+var keyHashIssuers = []struct {
+	name   string
+	newkey []string
+}{
+	{"rsa2048", []string{"-newkey", "rsa:2048"}},
+	{"rsa4096", []string{"-newkey", "rsa:4096"}},
+	{"rsa2048-e3", []string{"-newkey", "rsa:2048", "-pkeyopt", "rsa_keygen_pubexp:3"}},
+	{"p256", []string{"-newkey", "ec", "-pkeyopt", "ec_paramgen_curve:P-256"}},
+	{"p384", []string{"-newkey", "ec", "-pkeyopt", "ec_paramgen_curve:P-384"}},
+	{"p521", []string{"-newkey", "ec", "-pkeyopt", "ec_paramgen_curve:P-521"}},
+	{"ed25519", []string{"-newkey", "ed25519"}},
+	// A P-256 key whose BIT STRING declares an unused bit, the last bit
+	// of the point being 0. crypto/x509 cannot parse it.
+	{"p256-unused-bit", []string{"-newkey", "ec", "-pkeyopt", "ec_paramgen_curve:P-256"}},
+}
+
+var keyHashAlgorithms = map[string]crypto.Hash{
+	"sha1":   crypto.SHA1,
+	"sha256": crypto.SHA256,
+	"sha384": crypto.SHA384,
+	"sha512": crypto.SHA512,
+}
+
+// opensslHashes are the CertID hashes OpenSSL computed, by issuer and
+// hash algorithm.
+type opensslHashes map[string]map[string]struct {
+	NameHash string `json:"name_hash"`
+	KeyHash  string `json:"key_hash"`
+}
+
+func TestIssuerHashesMatchOpenSSL(t *testing.T) {
+	file := filepath.Join(keyHashDir, "openssl.json")
+	if *update {
+		recordOpenSSLHashes(t, file)
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatalf("%v (run with -update to create it)", err)
+	}
+	var want opensslHashes
+	if err := json.Unmarshal(data, &want); err != nil {
+		t.Fatal(err)
+	}
+	for _, iss := range keyHashIssuers {
+		t.Run(iss.name, func(t *testing.T) {
+			cert := rawIssuer(t, filepath.Join(keyHashDir, iss.name+".pem"))
+			if len(want[iss.name]) != len(keyHashAlgorithms) {
+				t.Fatalf("%s has %d recorded hashes, want %d", file, len(want[iss.name]), len(keyHashAlgorithms))
+			}
+			for alg, h := range keyHashAlgorithms {
+				nameHash, keyHash, err := IssuerHashes(cert, h)
+				if err != nil {
+					t.Fatal(err)
+				}
+				w := want[iss.name][alg]
+				if got := hex.EncodeToString(nameHash); got != w.NameHash {
+					t.Errorf("%s issuerNameHash = %s, OpenSSL has %s", alg, got, w.NameHash)
+				}
+				if got := hex.EncodeToString(keyHash); got != w.KeyHash {
+					t.Errorf("%s issuerKeyHash = %s, OpenSSL has %s", alg, got, w.KeyHash)
+				}
+				id := CertID{HashAlgorithm: h, NameHash: nameHash, KeyHash: keyHash}
+				if !id.MatchesIssuer(cert) {
+					t.Errorf("%s CertID does not match its issuer", alg)
+				}
+			}
+		})
+	}
+}
+
+func TestKeyHashInputRejectsMalformedKeys(t *testing.T) {
+	cert := rawIssuer(t, filepath.Join(keyHashDir, "p256.pem"))
+	spki := cert.RawSubjectPublicKeyInfo
+	for name, raw := range map[string][]byte{
+		"trailing data": append(append([]byte(nil), spki...), 0),
+		"truncated":     spki[:len(spki)-1],
+		"empty key":     {0x30, 0x0d, 0x30, 0x09, 0x06, 0x07, 0x2a, 0x86, 0x48, 0xce, 0x3d, 0x02, 0x01, 0x03, 0x01, 0x00},
+	} {
+		if _, err := keyHashInput(raw); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+}
+
+// rawIssuer reads the subject and public key of the certificate in file
+// without crypto/x509, which refuses some of the keys, into the only
+// fields IssuerHashes uses.
+func rawIssuer(t *testing.T, file string) *x509.Certificate {
+	t.Helper()
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatalf("%v (run with -update to create it)", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		t.Fatalf("%s: no PEM certificate", file)
+	}
+	var c struct {
+		TBS struct {
+			Version  int `asn1:"optional,explicit,default:0,tag:0"`
+			Serial   asn1.RawValue
+			SigAlg   asn1.RawValue
+			Issuer   asn1.RawValue
+			Validity asn1.RawValue
+			Subject  asn1.RawValue
+			SPKI     asn1.RawValue
+			Rest     asn1.RawValue `asn1:"optional"`
+		}
+	}
+	if _, err := asn1.Unmarshal(block.Bytes, &c); err != nil {
+		t.Fatalf("%s: %v", file, err)
+	}
+	return &x509.Certificate{RawSubject: c.TBS.Subject.FullBytes, RawSubjectPublicKeyInfo: c.TBS.SPKI.FullBytes}
+}
+
+var (
+	opensslHashLine = regexp.MustCompile(`(?m)^\s*Issuer (Name|Key) Hash: ([0-9A-F]+)$`)
+	// opensslWrap is where openssl breaks long hex values over lines.
+	opensslWrap = regexp.MustCompile(`\\\n\s*`)
+)
+
+// recordOpenSSLHashes generates the missing issuer certificates and
+// records the hashes openssl ocsp puts in a request for each of them.
+func recordOpenSSLHashes(t *testing.T, file string) {
+	t.Helper()
+	if _, err := exec.LookPath("openssl"); err != nil {
+		t.Skip("-update needs openssl on PATH")
+	}
+	if err := os.MkdirAll(keyHashDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	tmp := t.TempDir()
+	got := make(opensslHashes)
+	for _, iss := range keyHashIssuers {
+		pemFile := filepath.Join(keyHashDir, iss.name+".pem")
+		if _, err := os.Stat(pemFile); os.IsNotExist(err) {
+			writeKeyHashIssuer(t, pemFile, iss.name, iss.newkey)
+		}
+		got[iss.name] = make(map[string]struct {
+			NameHash string `json:"name_hash"`
+			KeyHash  string `json:"key_hash"`
+		})
+		for alg := range keyHashAlgorithms {
+			req := filepath.Join(tmp, iss.name+"-"+alg+".der")
+			if out, err := exec.Command("openssl", "ocsp", "-"+alg, "-issuer", pemFile, "-serial", "1", "-no_nonce", "-reqout", req).CombinedOutput(); err != nil {
+				t.Fatalf("openssl ocsp -issuer %s: %v\n%s", pemFile, err, out)
+			}
+			out, err := exec.Command("openssl", "ocsp", "-reqin", req, "-req_text").CombinedOutput()
+			if err != nil {
+				t.Fatalf("openssl ocsp -reqin: %v\n%s", err, out)
+			}
+			m := opensslHashLine.FindAllStringSubmatch(opensslWrap.ReplaceAllString(string(out), ""), -1)
+			if len(m) != 2 || m[0][1] != "Name" || m[1][1] != "Key" {
+				t.Fatalf("no CertID hashes in\n%s", out)
+			}
+			v := got[iss.name][alg]
+			v.NameHash, v.KeyHash = strings.ToLower(m[0][2]), strings.ToLower(m[1][2])
+			got[iss.name][alg] = v
+		}
+	}
+	data, err := json.MarshalIndent(got, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(file, append(data, '\n'), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// writeKeyHashIssuer has openssl create a self-signed certificate for a new
+// key. For p256-unused-bit it retries until the point ends in a 0 bit,
+// then declares that bit unused; the signature no longer verifies, which
+// no CertID hash depends on.
+func writeKeyHashIssuer(t *testing.T, pemFile, name string, newkey []string) {
+	t.Helper()
+	for {
+		args := append([]string{"req", "-x509", "-nodes", "-keyout", os.DevNull, "-subj", "/O=GoOCSPResponder tests/CN=Key Hash " + name, "-days", "3650", "-outform", "DER"}, newkey...)
+		der, err := exec.Command("openssl", args...).Output()
+		if err != nil {
+			t.Fatalf("openssl req for %s: %v", name, err)
+		}
+		if name == "p256-unused-bit" {
+			var bitString []byte
+			if bitString = keyBitString(t, der); bitString[len(bitString)-1]&1 != 0 {
+				continue
+			}
+			// A P-256 point is 65 bytes: 03 42 <unused bits> 04 X Y.
+			at := bytes.Index(der, bitString)
+			der[at+2] = 1
+		}
+		if err := os.WriteFile(pemFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+}
+
+// keyBitString returns the DER subjectPublicKey BIT STRING of cert.
+func keyBitString(t *testing.T, der []byte) []byte {
+	t.Helper()
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var spki struct {
+		Algorithm asn1.RawValue
+		PublicKey asn1.RawValue
+	}
+	if _, err := asn1.Unmarshal(cert.RawSubjectPublicKeyInfo, &spki); err != nil {
+		t.Fatal(err)
+	}
+	return spki.PublicKey.FullBytes
+}
@@ -0,0 +1,446 @@
+// Package responder implements the OCSP (RFC 6960) wire format and the
+// revocation logic shared by the GoOCSPResponder server and its tooling.
+package responder
+
+import (
+	"crypto"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+)
+
+// ResponseStatus is the outer OCSPResponseStatus of an OCSP response.
+type ResponseStatus int
+
+const (
+	Successful        ResponseStatus = 0
+	MalformedRequest  ResponseStatus = 1
+	InternalError     ResponseStatus = 2
+	TryLater          ResponseStatus = 3
+	SignatureRequired ResponseStatus = 5
+	Unauthorized      ResponseStatus = 6
+)
+
+func (s ResponseStatus) String() string {
+	switch s {
+	case Successful:
+		return "successful"
+	case MalformedRequest:
+		return "malformedRequest"
+	case InternalError:
+		return "internalError"
+	case TryLater:
+		return "tryLater"
+	case SignatureRequired:
+		return "sigRequired"
+	case Unauthorized:
+		return "unauthorized"
+	}
+	return fmt.Sprintf("status(%d)", int(s))
+}
+
+// Status is the certificate status carried in a single response.
+type Status int
+
+const (
+	Good Status = iota
+	Revoked
+	Unknown
+)
+
+func (s Status) String() string {
+	switch s {
+	case Good:
+		return "good"
+	case Revoked:
+		return "revoked"
+	case Unknown:
+		return "unknown"
+	}
+	return fmt.Sprintf("status(%d)", int(s))
+}
+
+var oidOCSPBasic = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 48, 1, 1}
+
+// oidPreferredSignatureAlgorithms is the request extension of RFC 6960
+// section 4.4.7.
+var oidPreferredSignatureAlgorithms = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 48, 1, 8}
+
+var hashOIDs = map[crypto.Hash]asn1.ObjectIdentifier{
+	crypto.SHA1:   {1, 3, 14, 3, 2, 26},
+	crypto.SHA256: {2, 16, 840, 1, 101, 3, 4, 2, 1},
+	crypto.SHA384: {2, 16, 840, 1, 101, 3, 4, 2, 2},
+	crypto.SHA512: {2, 16, 840, 1, 101, 3, 4, 2, 3},
+}
+
+var signatureAlgorithms = []struct {
+	algo x509.SignatureAlgorithm
+	oid  asn1.ObjectIdentifier
+}{
+	{x509.SHA1WithRSA, asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 5}},
+	{x509.SHA256WithRSA, asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 11}},
+	{x509.SHA384WithRSA, asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 12}},
+	{x509.SHA512WithRSA, asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 13}},
+	{x509.ECDSAWithSHA1, asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 1}},
+	{x509.ECDSAWithSHA256, asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}},
+	{x509.ECDSAWithSHA384, asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 3}},
+	{x509.ECDSAWithSHA512, asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 4}},
+	{x509.PureEd25519, asn1.ObjectIdentifier{1, 3, 101, 112}},
+}
+
+func hashFromOID(oid asn1.ObjectIdentifier) crypto.Hash {
+	for h, o := range hashOIDs {
+		if o.Equal(oid) {
+			return h
+		}
+	}
+	return 0
+}
+
+func signatureAlgorithmFromOID(oid asn1.ObjectIdentifier) x509.SignatureAlgorithm {
+	for _, s := range signatureAlgorithms {
+		if s.oid.Equal(oid) {
+			return s.algo
+		}
+	}
+	return x509.UnknownSignatureAlgorithm
+}
+
+// ASN.1 structures from RFC 6960 section 4.
+
+type certID struct {
+	HashAlgorithm pkix.AlgorithmIdentifier
+	NameHash      []byte
+	IssuerKeyHash []byte
+	SerialNumber  *big.Int
+}
+
+type ocspRequest struct {
+	TBSRequest        tbsRequest
+	OptionalSignature requestSignature `asn1:"explicit,tag:0,optional"`
+}
+
+type requestSignature struct {
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          asn1.BitString
+	Certificates       []asn1.RawValue `asn1:"explicit,tag:0,optional"`
+}
+
+type tbsRequest struct {
+	Raw               asn1.RawContent
+	Version           int           `asn1:"explicit,tag:0,default:0,optional"`
+	RequestorName     asn1.RawValue `asn1:"explicit,tag:1,optional"`
+	RequestList       []request
+	RequestExtensions []pkix.Extension `asn1:"explicit,tag:2,optional"`
+}
+
+type request struct {
+	Cert                    certID
+	SingleRequestExtensions []pkix.Extension `asn1:"explicit,tag:0,optional"`
+}
+
+type responseASN1 struct {
+	Status   asn1.Enumerated
+	Response responseBytes `asn1:"explicit,tag:0,optional"`
+}
+
+type responseBytes struct {
+	ResponseType asn1.ObjectIdentifier
+	Response     []byte
+}
+
+type basicResponse struct {
+	TBSResponseData    responseData
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          asn1.BitString
+	Certificates       []asn1.RawValue `asn1:"explicit,tag:0,optional"`
+}
+
+type responseData struct {
+	Raw                asn1.RawContent
+	Version            int `asn1:"optional,default:0,explicit,tag:0"`
+	RawResponderID     asn1.RawValue
+	ProducedAt         time.Time `asn1:"generalized"`
+	Responses          []singleResponse
+	ResponseExtensions []pkix.Extension `asn1:"explicit,tag:1,optional"`
+}
+
+type singleResponse struct {
+	CertID           certID
+	Good             asn1.Flag        `asn1:"tag:0,optional"`
+	Revoked          revokedInfo      `asn1:"tag:1,optional"`
+	Unknown          asn1.Flag        `asn1:"tag:2,optional"`
+	ThisUpdate       time.Time        `asn1:"generalized"`
+	NextUpdate       time.Time        `asn1:"generalized,explicit,tag:0,optional"`
+	SingleExtensions []pkix.Extension `asn1:"explicit,tag:1,optional"`
+}
+
+type revokedInfo struct {
+	RevocationTime time.Time       `asn1:"generalized"`
+	Reason         asn1.Enumerated `asn1:"explicit,tag:0,optional"`
+}
+
+// CertID identifies a certificate by its issuer hashes and serial number.
+type CertID struct {
+	HashAlgorithm crypto.Hash
+	NameHash      []byte
+	KeyHash       []byte
+	SerialNumber  *big.Int
+}
+
+func (id certID) decode() (CertID, error) {
+	h := hashFromOID(id.HashAlgorithm.Algorithm)
+	if h == 0 {
+		return CertID{}, fmt.Errorf("unsupported CertID hash algorithm %s", id.HashAlgorithm.Algorithm)
+	}
+	return CertID{
+		HashAlgorithm: h,
+		NameHash:      id.NameHash,
+		KeyHash:       id.IssuerKeyHash,
+		SerialNumber:  id.SerialNumber,
+	}, nil
+}
+
+// Request is a decoded OCSP request.
+type Request struct {
+	CertIDs    []CertID
+	Extensions []pkix.Extension
+	Raw        []byte
+
+	// The remaining fields are set for signed requests only.
+
+	// TBSRequest is the DER the requestor signed.
+	TBSRequest []byte
+	// RequestorName is the DER GeneralName the requestor gave, if any.
+	RequestorName      []byte
+	SignatureAlgorithm x509.SignatureAlgorithm
+	Signature          []byte
+	// Certificates are the ones the requestor sent to help verify the
+	// signature, its own first.
+	Certificates []*x509.Certificate
+}
+
+// Signed reports whether the request carries a signature.
+func (r *Request) Signed() bool {
+	return r.Signature != nil
+}
+
+// preferredSignatureAlgorithm is one entry of the extension; the optional
+// public key algorithm that may follow the signature algorithm is ignored.
+type preferredSignatureAlgorithm struct {
+	SigIdentifier pkix.AlgorithmIdentifier
+	Rest          asn1.RawValue `asn1:"optional"`
+}
+
+// PreferredSignatureAlgorithms returns the signature algorithms the client
+// asked the response to be signed with, most preferred first, from the
+// extension of RFC 6960 section 4.4.7. Algorithms this package does not
+// know are left out.
+func (r *Request) PreferredSignatureAlgorithms() []x509.SignatureAlgorithm {
+	for _, ext := range r.Extensions {
+		if !ext.Id.Equal(oidPreferredSignatureAlgorithms) {
+			continue
+		}
+		var prefs []preferredSignatureAlgorithm
+		if _, err := asn1.Unmarshal(ext.Value, &prefs); err != nil {
+			return nil
+		}
+		var algos []x509.SignatureAlgorithm
+		for _, p := range prefs {
+			if algo := signatureAlgorithmFromOID(p.SigIdentifier.Algorithm); algo != x509.UnknownSignatureAlgorithm {
+				algos = append(algos, algo)
+			}
+		}
+		return algos
+	}
+	return nil
+}
+
+// ParseRequest decodes a DER OCSP request.
+func ParseRequest(der []byte) (*Request, error) {
+	var req ocspRequest
+	rest, err := asn1.Unmarshal(der, &req)
+	if err != nil {
+		return nil, fmt.Errorf("parsing OCSP request: %v", err)
+	}
+	if len(rest) > 0 {
+		return nil, errors.New("trailing data after OCSP request")
+	}
+	if len(req.TBSRequest.RequestList) == 0 {
+		return nil, errors.New("OCSP request contains no certificates")
+	}
+	r := &Request{Extensions: req.TBSRequest.RequestExtensions, Raw: der}
+	for _, single := range req.TBSRequest.RequestList {
+		id, err := single.Cert.decode()
+		if err != nil {
+			return nil, err
+		}
+		r.CertIDs = append(r.CertIDs, id)
+	}
+	if sig := req.OptionalSignature; sig.SignatureAlgorithm.Algorithm != nil {
+		r.TBSRequest = req.TBSRequest.Raw
+		r.RequestorName = req.TBSRequest.RequestorName.Bytes
+		r.SignatureAlgorithm = signatureAlgorithmFromOID(sig.SignatureAlgorithm.Algorithm)
+		r.Signature = sig.Signature.RightAlign()
+		for _, raw := range sig.Certificates {
+			cert, err := x509.ParseCertificate(raw.FullBytes)
+			if err != nil {
+				return nil, fmt.Errorf("parsing requestor certificate: %v", err)
+			}
+			r.Certificates = append(r.Certificates, cert)
+		}
+	}
+	return r, nil
+}
+
+func (id CertID) marshal() (certID, error) {
+	oid, ok := hashOIDs[id.HashAlgorithm]
+	if !ok {
+		return certID{}, fmt.Errorf("unsupported CertID hash algorithm %v", id.HashAlgorithm)
+	}
+	return certID{
+		HashAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oid, Parameters: asn1.NullRawValue},
+		NameHash:      id.NameHash,
+		IssuerKeyHash: id.KeyHash,
+		SerialNumber:  id.SerialNumber,
+	}, nil
+}
+
+// CreateRequest returns an unsigned DER OCSP request for ids without
+// extensions, encoded the way common clients encode one.
+func CreateRequest(ids ...CertID) ([]byte, error) {
+	if len(ids) == 0 {
+		return nil, errors.New("OCSP request needs at least one CertID")
+	}
+	var tbs tbsRequest
+	for _, id := range ids {
+		c, err := id.marshal()
+		if err != nil {
+			return nil, err
+		}
+		tbs.RequestList = append(tbs.RequestList, request{Cert: c})
+	}
+	return asn1.Marshal(ocspRequest{TBSRequest: tbs})
+}
+
+// SingleResponse is the decoded status of one certificate.
+type SingleResponse struct {
+	CertID
+	Status           Status
+	RevokedAt        time.Time
+	RevocationReason int
+	ThisUpdate       time.Time
+	NextUpdate       time.Time
+	Extensions       []pkix.Extension
+}
+
+// Response is a decoded OCSP response.
+type Response struct {
+	Status ResponseStatus
+
+	ProducedAt       time.Time
+	ResponderName    []byte // raw DER Name when the responder is identified by name
+	ResponderKeyHash []byte // SHA-1 key hash when the responder is identified by key
+	Responses        []SingleResponse
+	Extensions       []pkix.Extension
+
+	Certificates       []*x509.Certificate
+	SignatureAlgorithm x509.SignatureAlgorithm
+	Signature          []byte
+	TBSResponseData    []byte
+	Raw                []byte
+}
+
+// ParseResponse decodes a DER OCSP response. Only the status is populated
+// for non-successful responses.
+func ParseResponse(der []byte) (*Response, error) {
+	var outer responseASN1
+	rest, err := asn1.Unmarshal(der, &outer)
+	if err != nil {
+		return nil, fmt.Errorf("parsing OCSP response: %v", err)
+	}
+	if len(rest) > 0 {
+		return nil, errors.New("trailing data after OCSP response")
+	}
+	r := &Response{Status: ResponseStatus(outer.Status), Raw: der}
+	if r.Status != Successful {
+		return r, nil
+	}
+	if !outer.Response.ResponseType.Equal(oidOCSPBasic) {
+		return nil, fmt.Errorf("unsupported OCSP response type %s", outer.Response.ResponseType)
+	}
+
+	var basic basicResponse
+	rest, err = asn1.Unmarshal(outer.Response.Response, &basic)
+	if err != nil {
+		return nil, fmt.Errorf("parsing basic OCSP response: %v", err)
+	}
+	if len(rest) > 0 {
+		return nil, errors.New("trailing data after basic OCSP response")
+	}
+
+	r.TBSResponseData = basic.TBSResponseData.Raw
+	r.ProducedAt = basic.TBSResponseData.ProducedAt
+	r.Extensions = basic.TBSResponseData.ResponseExtensions
+	r.SignatureAlgorithm = signatureAlgorithmFromOID(basic.SignatureAlgorithm.Algorithm)
+	r.Signature = basic.Signature.RightAlign()
+
+	rid := basic.TBSResponseData.RawResponderID
+	switch {
+	case rid.Class == asn1.ClassContextSpecific && rid.Tag == 1:
+		r.ResponderName = rid.Bytes
+	case rid.Class == asn1.ClassContextSpecific && rid.Tag == 2:
+		if _, err := asn1.Unmarshal(rid.Bytes, &r.ResponderKeyHash); err != nil {
+			return nil, fmt.Errorf("parsing responder key hash: %v", err)
+		}
+	default:
+		return nil, errors.New("invalid responder ID")
+	}
+
+	for _, raw := range basic.Certificates {
+		cert, err := x509.ParseCertificate(raw.FullBytes)
+		if err != nil {
+			return nil, fmt.Errorf("parsing embedded certificate: %v", err)
+		}
+		r.Certificates = append(r.Certificates, cert)
+	}
+
+	for _, sr := range basic.TBSResponseData.Responses {
+		id, err := sr.CertID.decode()
+		if err != nil {
+			return nil, err
+		}
+		single := SingleResponse{
+			CertID:     id,
+			ThisUpdate: sr.ThisUpdate,
+			NextUpdate: sr.NextUpdate,
+			Extensions: sr.SingleExtensions,
+		}
+		switch {
+		case bool(sr.Good):
+			single.Status = Good
+		case bool(sr.Unknown):
+			single.Status = Unknown
+		default:
+			single.Status = Revoked
+			single.RevokedAt = sr.Revoked.RevocationTime
+			single.RevocationReason = int(sr.Revoked.Reason)
+		}
+		r.Responses = append(r.Responses, single)
+	}
+	return r, nil
+}
+
+// CheckSignatureFrom verifies the response signature with the public key of
+// cert. SHA-1 signatures are accepted since archived responses commonly use
+// them.
+func (r *Response) CheckSignatureFrom(cert *x509.Certificate) error {
+	if r.SignatureAlgorithm == x509.UnknownSignatureAlgorithm {
+		return errors.New("unsupported response signature algorithm")
+	}
+	return cert.CheckSignature(r.SignatureAlgorithm, r.TBSResponseData, r.Signature)
+}
@@ -0,0 +1,150 @@
+package responder
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/hex"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// signedRequest returns a request for serial under issuer signed by
+// requestor, naming it as requestor and carrying certs.
+func signedRequest(t *testing.T, issuer *x509.Certificate, serial int64, requestor *Signer, certs ...*x509.Certificate) []byte {
+	t.Helper()
+	name, key, err := IssuerHashes(issuer, crypto.SHA1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := CertID{HashAlgorithm: crypto.SHA1, NameHash: name, KeyHash: key, SerialNumber: big.NewInt(serial)}.marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// encoding/asn1 writes a RawValue as is, so the explicit [1] tag of
+	// requestorName around the directoryName GeneralName is spelled out.
+	generalName, err := asn1.Marshal(asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 4, IsCompound: true, Bytes: requestor.Cert.RawSubject})
+	if err != nil {
+		t.Fatal(err)
+	}
+	requestorName, err := asn1.Marshal(asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 1, IsCompound: true, Bytes: generalName})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tbs := tbsRequest{
+		RequestorName: asn1.RawValue{FullBytes: requestorName},
+		RequestList:   []request{{Cert: id}},
+	}
+	tbsDER, err := asn1.Marshal(tbs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256(tbsDER)
+	sig, err := requestor.Key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var oid asn1.ObjectIdentifier
+	for _, s := range signatureAlgorithms {
+		if s.algo == x509.ECDSAWithSHA256 {
+			oid = s.oid
+		}
+	}
+	reqSig := requestSignature{Signature: asn1.BitString{Bytes: sig, BitLength: 8 * len(sig)}}
+	reqSig.SignatureAlgorithm.Algorithm = oid
+	for _, c := range certs {
+		reqSig.Certificates = append(reqSig.Certificates, asn1.RawValue{FullBytes: c.Raw})
+	}
+	der, err := asn1.Marshal(ocspRequest{TBSRequest: tbs, OptionalSignature: reqSig})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+func TestParseSignedRequest(t *testing.T) {
+	ca := testCA(t, "Test CA", nil)
+	requestor := delegatedSigner(t, ca, x509.ExtKeyUsageClientAuth)
+	der := signedRequest(t, ca.Cert, 42, requestor, requestor.Cert, ca.Cert)
+
+	r, err := ParseRequest(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.Signed() {
+		t.Fatal("the request is not reported signed")
+	}
+	if len(r.CertIDs) != 1 || r.CertIDs[0].SerialNumber.Int64() != 42 {
+		t.Errorf("CertIDs = %+v", r.CertIDs)
+	}
+	if r.SignatureAlgorithm != x509.ECDSAWithSHA256 {
+		t.Errorf("SignatureAlgorithm = %v", r.SignatureAlgorithm)
+	}
+	generalName, _ := asn1.Marshal(asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 4, IsCompound: true, Bytes: requestor.Cert.RawSubject})
+	if !bytes.Equal(r.RequestorName, generalName) {
+		t.Errorf("RequestorName = %s", hex.EncodeToString(r.RequestorName))
+	}
+	if len(r.Certificates) != 2 || !r.Certificates[0].Equal(requestor.Cert) || !r.Certificates[1].Equal(ca.Cert) {
+		t.Errorf("got %d certificates, want the requestor's and the CA's", len(r.Certificates))
+	}
+	if !bytes.Contains(der, r.TBSRequest) {
+		t.Error("TBSRequest is not the signed DER")
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Cert)
+	got, err := VerifyRequest(r, roots, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.Equal(requestor.Cert) {
+		t.Errorf("VerifyRequest returned %s", got.Subject)
+	}
+}
+
+func TestVerifyRequestRefuses(t *testing.T) {
+	ca := testCA(t, "Test CA", nil)
+	requestor := delegatedSigner(t, ca, x509.ExtKeyUsageClientAuth)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Cert)
+	parse := func(der []byte) *Request {
+		t.Helper()
+		r, err := ParseRequest(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+
+	badSig := parse(signedRequest(t, ca.Cert, 42, requestor, requestor.Cert))
+	badSig.Signature[len(badSig.Signature)-1] ^= 1
+	otherKey := parse(signedRequest(t, ca.Cert, 42, delegatedSigner(t, ca), requestor.Cert))
+	unknownRoot := parse(signedRequest(t, ca.Cert, 42, requestor, requestor.Cert))
+	otherRoots := x509.NewCertPool()
+	otherRoots.AddCert(testCA(t, "Test CA", nil).Cert)
+
+	tests := []struct {
+		name  string
+		r     *Request
+		roots *x509.CertPool
+		at    time.Time
+	}{
+		{"unsigned", parse(handlerRequest(t, ca.Cert, 42)), roots, time.Now()},
+		{"no certificates", parse(signedRequest(t, ca.Cert, 42, requestor)), roots, time.Now()},
+		{"bad signature", badSig, roots, time.Now()},
+		{"signed by another key", otherKey, roots, time.Now()},
+		{"untrusted root", unknownRoot, otherRoots, time.Now()},
+		{"expired requestor", unknownRoot, roots, time.Now().Add(2 * time.Hour)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := VerifyRequest(tt.r, tt.roots, tt.at); err == nil {
+				t.Error("VerifyRequest accepted the request")
+			}
+		})
+	}
+}
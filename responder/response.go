@@ -0,0 +1,200 @@
+package responder
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ResponseTemplate describes a basic OCSP response to be signed.
+type ResponseTemplate struct {
+	ProducedAt time.Time
+	Responses  []SingleResponse
+	Extensions []pkix.Extension
+	// Certificates are embedded in the response; normally the delegated
+	// responder certificate when the signer is not the CA itself.
+	Certificates []*x509.Certificate
+}
+
+// ErrorResponse returns the DER encoding of an unsigned response carrying
+// only a non-successful status.
+func ErrorResponse(status ResponseStatus) []byte {
+	der, _ := asn1.Marshal(responseASN1{Status: asn1.Enumerated(status)})
+	return der
+}
+
+// signatureAlgorithm picks the signature algorithm and digest for key.
+func signatureAlgorithm(pub crypto.PublicKey) (x509.SignatureAlgorithm, crypto.Hash, error) {
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		return x509.SHA256WithRSA, crypto.SHA256, nil
+	case *ecdsa.PublicKey:
+		switch k.Curve {
+		case elliptic.P384():
+			return x509.ECDSAWithSHA384, crypto.SHA384, nil
+		case elliptic.P521():
+			return x509.ECDSAWithSHA512, crypto.SHA512, nil
+		}
+		return x509.ECDSAWithSHA256, crypto.SHA256, nil
+	case ed25519.PublicKey:
+		return x509.PureEd25519, crypto.Hash(0), nil
+	}
+	return x509.UnknownSignatureAlgorithm, 0, fmt.Errorf("unsupported signing key type %T", pub)
+}
+
+func signatureAlgorithmOID(algo x509.SignatureAlgorithm) asn1.ObjectIdentifier {
+	for _, s := range signatureAlgorithms {
+		if s.algo == algo {
+			return s.oid
+		}
+	}
+	return nil
+}
+
+func errUnsupportedHash(h crypto.Hash) error {
+	return fmt.Errorf("unsupported CertID hash algorithm %v", h)
+}
+
+func errInvalidStatus(s Status) error {
+	return fmt.Errorf("invalid certificate status %v", s)
+}
+
+// signerInfo is what signing a response needs to know about a signer
+// besides its key.
+type signerInfo struct {
+	keyHash []byte
+	algo    x509.SignatureAlgorithm
+	hash    crypto.Hash
+}
+
+// signerInfos caches the signerInfo of each Signer, since deriving it
+// parses and copies the public key.
+var signerInfos sync.Map // *Signer -> *signerInfo
+
+func (s *Signer) info() (*signerInfo, error) {
+	if info, ok := signerInfos.Load(s); ok {
+		return info.(*signerInfo), nil
+	}
+	_, keyHash, err := IssuerHashes(s.Cert, crypto.SHA1)
+	if err != nil {
+		return nil, err
+	}
+	algo, hash, err := signatureAlgorithm(s.Key.Public())
+	if err != nil {
+		return nil, err
+	}
+	info := &signerInfo{keyHash: keyHash, algo: algo, hash: hash}
+	signerInfos.Store(s, info)
+	return info, nil
+}
+
+// digest hashes tbs for signing into sum, without allocating for the
+// common hashes.
+func digest(hash crypto.Hash, tbs []byte, sum *[sha512.Size]byte) []byte {
+	switch hash {
+	case 0:
+		return tbs
+	case crypto.SHA256:
+		d := sha256.Sum256(tbs)
+		return sum[:copy(sum[:], d[:])]
+	case crypto.SHA384:
+		d := sha512.Sum384(tbs)
+		return sum[:copy(sum[:], d[:])]
+	case crypto.SHA512:
+		d := sha512.Sum512(tbs)
+		return sum[:copy(sum[:], d[:])]
+	}
+	h := hash.New()
+	h.Write(tbs)
+	return h.Sum(sum[:0])
+}
+
+// CreateResponse builds the basic response described by t, signs it with
+// signer and returns the complete DER OCSPResponse. The responder is
+// identified by key hash. The response is encoded into a pooled buffer,
+// so the only allocations besides the signature's are the returned slice
+// and whatever the key makes.
+func CreateResponse(t *ResponseTemplate, signer *Signer) ([]byte, error) {
+	if len(t.Responses) == 0 {
+		return nil, errors.New("response template has no single responses")
+	}
+	info, err := signer.info()
+	if err != nil {
+		return nil, err
+	}
+
+	buf := derBufs.Get().(*derBuf)
+	defer derBufs.Put(buf)
+	b := buf.b[:0]
+
+	// ResponseData, signed first and then wrapped in place.
+	b, data := begin(b, tagSequence)
+	b, rid := begin(b, contextTag(2, true))
+	b = appendValue(b, tagOctetString, info.keyHash)
+	b = end(b, rid)
+	b = appendGeneralizedTime(b, t.ProducedAt)
+	b, responses := begin(b, tagSequence)
+	for _, s := range t.Responses {
+		if b, err = appendSingleResponse(b, s); err != nil {
+			return nil, err
+		}
+	}
+	b = end(b, responses)
+	if t.Extensions != nil {
+		b = appendExtensions(b, 1, t.Extensions)
+	}
+	b = end(b, data)
+	tbs := b
+
+	signature, err := signer.Key.Sign(rand.Reader, digest(info.hash, tbs, &buf.sum), info.hash)
+	if err != nil {
+		return nil, fmt.Errorf("signing response: %v", err)
+	}
+
+	// The wrapping is encoded after the tbs in the same buffer, then the
+	// result is assembled front to back in the returned slice.
+	b, basic := begin(b, tagSequence)
+	b = append(b, tbs...)
+	b = appendAlgorithmIdentifier(b, signatureAlgorithmOID(info.algo), info.algo == x509.SHA256WithRSA)
+	b, sig := begin(b, tagBitString)
+	b = append(b, 0)
+	b = append(b, signature...)
+	b = end(b, sig)
+	if len(t.Certificates) > 0 {
+		var certs, seq int
+		b, certs = begin(b, contextTag(0, true))
+		b, seq = begin(b, tagSequence)
+		for _, cert := range t.Certificates {
+			b = append(b, cert.Raw...)
+		}
+		b = end(b, seq)
+		b = end(b, certs)
+	}
+	b = end(b, basic)
+	basicDER := b[len(tbs):]
+
+	out := make([]byte, 0, len(basicDER)+32)
+	out, resp := begin(out, tagSequence)
+	out = appendInt64(out, tagEnumerated, int64(Successful))
+	out, explicit := begin(out, contextTag(0, true))
+	out, rb := begin(out, tagSequence)
+	out = appendOID(out, oidOCSPBasic)
+	out = appendValue(out, tagOctetString, basicDER)
+	out = end(out, rb)
+	out = end(out, explicit)
+	out = end(out, resp)
+	buf.b = b
+	return out, nil
+}
@@ -0,0 +1,181 @@
+package responder
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"math/big"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// benchTemplate is a typical response: one good CertID, with the responder
+// certificate embedded.
+func benchTemplate(s *Signer) *ResponseTemplate {
+	hash := make([]byte, 20)
+	now := time.Now()
+	return &ResponseTemplate{
+		ProducedAt: now,
+		Responses: []SingleResponse{{
+			CertID:     CertID{HashAlgorithm: crypto.SHA1, NameHash: hash, KeyHash: hash, SerialNumber: big.NewInt(0x1001)},
+			Status:     Good,
+			ThisUpdate: now,
+			NextUpdate: now.Add(time.Hour),
+		}},
+		Certificates: []*x509.Certificate{s.Cert},
+	}
+}
+
+func TestCreateResponse(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	hash := bytes.Repeat([]byte{0xab}, 20)
+	id := func(serial int64) CertID {
+		return CertID{HashAlgorithm: crypto.SHA1, NameHash: hash, KeyHash: hash, SerialNumber: big.NewInt(serial)}
+	}
+	nonce := pkix.Extension{Id: asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 48, 1, 2}, Value: []byte{0x04, 0x02, 0xca, 0xfe}}
+	singles := []SingleResponse{
+		{CertID: id(1), Status: Good, ThisUpdate: now, NextUpdate: now.Add(time.Hour)},
+		{CertID: id(2), Status: Revoked, RevokedAt: now.Add(-time.Hour), RevocationReason: 1, ThisUpdate: now},
+		// Unspecified (0) is the default, so it is left out and reads back
+		// the same.
+		{CertID: id(3), Status: Revoked, RevokedAt: now.Add(-2 * time.Hour), ThisUpdate: now},
+		{CertID: id(0x7fffffff), Status: Unknown, ThisUpdate: now, NextUpdate: now.Add(time.Hour)},
+	}
+
+	for name, tc := range map[string]struct {
+		key  crypto.Signer
+		algo x509.SignatureAlgorithm
+	}{
+		"RSA":     {rsaKey, x509.SHA256WithRSA},
+		"ECDSA":   {ecKey, x509.ECDSAWithSHA384},
+		"Ed25519": {edKey, x509.PureEd25519},
+	} {
+		s := testCA(t, "Bench Responder", tc.key)
+		der, err := CreateResponse(&ResponseTemplate{
+			ProducedAt:   now,
+			Responses:    singles,
+			Extensions:   []pkix.Extension{nonce},
+			Certificates: []*x509.Certificate{s.Cert},
+		}, s)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		resp, err := ParseResponse(der)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if err := resp.CheckSignatureFrom(s.Cert); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+		if resp.SignatureAlgorithm != tc.algo {
+			t.Errorf("%s: signature algorithm %v, want %v", name, resp.SignatureAlgorithm, tc.algo)
+		}
+		_, keyHash, _ := IssuerHashes(s.Cert, crypto.SHA1)
+		if resp.Status != Successful || !resp.ProducedAt.Equal(now) || !bytes.Equal(resp.ResponderKeyHash, keyHash) || resp.ResponderName != nil {
+			t.Errorf("%s: status %v, produced %v, responder key hash %x, want %x", name, resp.Status, resp.ProducedAt, resp.ResponderKeyHash, keyHash)
+		}
+		if !reflect.DeepEqual(resp.Extensions, []pkix.Extension{nonce}) {
+			t.Errorf("%s: extensions %+v", name, resp.Extensions)
+		}
+		if len(resp.Certificates) != 1 || !resp.Certificates[0].Equal(s.Cert) {
+			t.Errorf("%s: %d certificates embedded", name, len(resp.Certificates))
+		}
+		if len(resp.Responses) != len(singles) {
+			t.Fatalf("%s: %d single responses, want %d", name, len(resp.Responses), len(singles))
+		}
+		for i, got := range resp.Responses {
+			want := singles[i]
+			if got.SerialNumber.Cmp(want.SerialNumber) != 0 || got.HashAlgorithm != want.HashAlgorithm || !bytes.Equal(got.NameHash, hash) || !bytes.Equal(got.KeyHash, hash) {
+				t.Errorf("%s: response %d: CertID %+v", name, i, got.CertID)
+			}
+			if got.Status != want.Status || !got.RevokedAt.Equal(want.RevokedAt) || got.RevocationReason != want.RevocationReason ||
+				!got.ThisUpdate.Equal(want.ThisUpdate) || !got.NextUpdate.Equal(want.NextUpdate) {
+				t.Errorf("%s: response %d: got %+v, want %+v", name, i, got, want)
+			}
+		}
+	}
+
+	s := testCA(t, "Bench Responder", edKey)
+	if _, err := CreateResponse(&ResponseTemplate{ProducedAt: now}, s); err == nil {
+		t.Error("CreateResponse signs a response without single responses")
+	}
+	if _, err := CreateResponse(&ResponseTemplate{ProducedAt: now, Responses: []SingleResponse{{CertID: id(1), Status: Status(7), ThisUpdate: now}}}, s); err == nil {
+		t.Error("CreateResponse signs an invalid certificate status")
+	}
+}
+
+func TestErrorResponse(t *testing.T) {
+	for _, status := range []ResponseStatus{MalformedRequest, InternalError, TryLater, SignatureRequired, Unauthorized} {
+		der := ErrorResponse(status)
+		// SEQUENCE { ENUMERATED status }, with no responseBytes.
+		if want := []byte{0x30, 0x03, 0x0a, 0x01, byte(status)}; !bytes.Equal(der, want) {
+			t.Errorf("ErrorResponse(%v) = %x, want %x", status, der, want)
+		}
+		resp, err := ParseResponse(der)
+		if err != nil || resp.Status != status || resp.Responses != nil {
+			t.Errorf("ParseResponse(ErrorResponse(%v)) = %+v, %v", status, resp, err)
+		}
+	}
+}
+
+// BenchmarkCreateResponse signs with Ed25519, whose signing allocates only
+// the signature, so it measures the encoding. It fails if the encoding
+// allocates more than the returned response.
+func BenchmarkCreateResponse(b *testing.B) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		b.Fatal(err)
+	}
+	s := testCA(b, "Bench Responder", key)
+	t := benchTemplate(s)
+	sign := func() {
+		if _, err := CreateResponse(t, s); err != nil {
+			b.Fatal(err)
+		}
+	}
+	sign()
+	if allocs := testing.AllocsPerRun(100, sign); allocs > 2 {
+		b.Fatalf("CreateResponse allocates %v times per response, want the response and the signature only", allocs)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		sign()
+	}
+}
+
+// BenchmarkCreateResponseECDSA signs with P-256, as a typical responder
+// key; most of its allocations are the ECDSA implementation's.
+func BenchmarkCreateResponseECDSA(b *testing.B) {
+	s := testCA(b, "Bench Responder", nil)
+	t := benchTemplate(s)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := CreateResponse(t, s); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
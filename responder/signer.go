@@ -0,0 +1,132 @@
+package responder
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Signer holds the responder certificate and the private key responses are
+// signed with.
+type Signer struct {
+	Cert *x509.Certificate
+	Key  crypto.Signer
+}
+
+// LoadSigner reads a PEM responder certificate and its PEM private key
+// (PKCS#1, PKCS#8 or SEC 1) and checks that they belong together.
+func LoadSigner(certFile, keyFile string) (*Signer, error) {
+	certPEM, err := os.ReadFile(certFile)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(certPEM)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("%s: no PEM certificate found", certFile)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", certFile, err)
+	}
+
+	keyPEM, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	key, err := parsePrivateKey(keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", keyFile, err)
+	}
+
+	s := &Signer{Cert: cert, Key: key}
+	if err := s.Check(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func parsePrivateKey(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM private key found")
+	}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		switch k := key.(type) {
+		case *rsa.PrivateKey:
+			return k, nil
+		case *ecdsa.PrivateKey:
+			return k, nil
+		case ed25519.PrivateKey:
+			return k, nil
+		}
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+	return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+}
+
+// SignatureAlgorithm is the algorithm responses are signed with.
+func (s *Signer) SignatureAlgorithm() x509.SignatureAlgorithm {
+	algo, _, _ := signatureAlgorithm(s.Key.Public())
+	return algo
+}
+
+// Check signs a probe digest and verifies it against the certificate's
+// public key, proving that the key is usable and matches the certificate.
+func (s *Signer) Check() error {
+	probe := sha256.Sum256([]byte("goocsp signer probe"))
+	var (
+		sig  []byte
+		algo x509.SignatureAlgorithm
+		err  error
+	)
+	switch s.Key.Public().(type) {
+	case *rsa.PublicKey:
+		algo = x509.SHA256WithRSA
+		sig, err = s.Key.Sign(rand.Reader, probe[:], crypto.SHA256)
+	case *ecdsa.PublicKey:
+		algo = x509.ECDSAWithSHA256
+		sig, err = s.Key.Sign(rand.Reader, probe[:], crypto.SHA256)
+	case ed25519.PublicKey:
+		algo = x509.PureEd25519
+		sig, err = s.Key.Sign(rand.Reader, []byte("goocsp signer probe"), crypto.Hash(0))
+	default:
+		return fmt.Errorf("unsupported signing key type %T", s.Key.Public())
+	}
+	if err != nil {
+		return fmt.Errorf("signing probe: %v", err)
+	}
+	if err := s.Cert.CheckSignature(algo, []byte("goocsp signer probe"), sig); err != nil {
+		return fmt.Errorf("private key does not match certificate %s: %v", s.Cert.Subject, err)
+	}
+	return nil
+}
+
+// CheckAuthorized verifies that s may sign responses for issuer at the
+// given time (RFC 6960 section 4.2.2.2): its certificate is the issuer's
+// own, or that of a delegated responder; see CheckDelegatedResponder.
+// Clients that trust s locally accept its responses either way.
+func (s *Signer) CheckAuthorized(issuer *x509.Certificate, at time.Time) error {
+	if bytes.Equal(s.Cert.RawSubject, issuer.RawSubject) && bytes.Equal(s.Cert.RawSubjectPublicKeyInfo, issuer.RawSubjectPublicKeyInfo) {
+		return nil
+	}
+	return CheckDelegatedResponder(s.Cert, issuer, at)
+}
@@ -0,0 +1,34 @@
+package responder
+
+import (
+	"crypto/x509"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckAuthorized(t *testing.T) {
+	ca, other := testCA(t, "Test CA", nil), testCA(t, "Test CA", nil)
+	now := time.Now()
+	for _, tc := range []struct {
+		name   string
+		signer *Signer
+		at     time.Time
+		want   string
+	}{
+		{"the issuer itself", ca, now, ""},
+		{"delegated", delegatedSigner(t, ca, x509.ExtKeyUsageOCSPSigning), now, ""},
+		{"without the EKU", delegatedSigner(t, ca, x509.ExtKeyUsageServerAuth), now, "lacks the OCSP signing"},
+		{"issued by another CA", delegatedSigner(t, other, x509.ExtKeyUsageOCSPSigning), now, "signature"},
+		{"another CA", other, now, "signature"},
+		{"expired", delegatedSigner(t, ca, x509.ExtKeyUsageOCSPSigning), now.Add(2 * time.Hour), "not valid at"},
+	} {
+		err := tc.signer.CheckAuthorized(ca.Cert, tc.at)
+		switch {
+		case tc.want == "" && err != nil:
+			t.Errorf("%s: %v", tc.name, err)
+		case tc.want != "" && (err == nil || !strings.Contains(err.Error(), tc.want)):
+			t.Errorf("%s: got %v, want an error containing %q", tc.name, err, tc.want)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package responder
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// issueTestCert issues tmpl for key, signed by issuer or self-signed if
+// issuer is nil. A nil key is a new P-256 key. An unset serial is 1, and an
+// unset validity an hour either side of now.
+func issueTestCert(tb testing.TB, tmpl *x509.Certificate, key crypto.Signer, issuer *Signer) *Signer {
+	tb.Helper()
+	if key == nil {
+		k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		key = k
+	}
+	if tmpl.SerialNumber == nil {
+		tmpl.SerialNumber = big.NewInt(1)
+	}
+	if tmpl.NotBefore.IsZero() {
+		now := time.Now()
+		tmpl.NotBefore, tmpl.NotAfter = now.Add(-time.Hour), now.Add(time.Hour)
+	}
+	parent, parentKey := tmpl, key
+	if issuer != nil {
+		parent, parentKey = issuer.Cert, issuer.Key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, key.Public(), parentKey)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return &Signer{Cert: cert, Key: key}
+}
+
+// testCA returns a new self-signed CA named cn, with key or a new P-256
+// key if it is nil.
+func testCA(tb testing.TB, cn string, key crypto.Signer) *Signer {
+	tb.Helper()
+	return issueTestCert(tb, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: cn},
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}, key, nil)
+}
+
+// delegatedSigner returns a responder key issued by ca with ekus.
+func delegatedSigner(tb testing.TB, ca *Signer, ekus ...x509.ExtKeyUsage) *Signer {
+	tb.Helper()
+	return issueTestCert(tb, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "Delegated Responder"},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  ekus,
+	}, nil, ca)
+}
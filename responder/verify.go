@@ -0,0 +1,218 @@
+package responder
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"time"
+)
+
+type subjectPublicKeyInfo struct {
+	Algorithm pkix.AlgorithmIdentifier
+	PublicKey asn1.BitString
+}
+
+// IssuerHashes returns the issuerNameHash and issuerKeyHash of cert under h,
+// as used in CertID. The name hash covers the DER subject as the
+// certificate encodes it, and the key hash only the subjectPublicKey bits
+// (see keyHashInput).
+func IssuerHashes(cert *x509.Certificate, h crypto.Hash) (nameHash, keyHash []byte, err error) {
+	if !h.Available() {
+		return nil, nil, fmt.Errorf("hash %v is not available", h)
+	}
+	key, err := keyHashInput(cert.RawSubjectPublicKeyInfo)
+	if err != nil {
+		return nil, nil, err
+	}
+	hn := h.New()
+	hn.Write(cert.RawSubject)
+	nameHash = hn.Sum(nil)
+	hk := h.New()
+	hk.Write(key)
+	keyHash = hk.Sum(nil)
+	return nameHash, keyHash, nil
+}
+
+// keyHashInput returns what issuerKeyHash is computed over: the contents of
+// the subjectPublicKey BIT STRING of a DER SubjectPublicKeyInfo, without
+// its tag, length and unused-bits octet (RFC 6960 section 4.1.1). That is
+// the PKCS #1 RSAPublicKey SEQUENCE for RSA, the 0x04 || X || Y point for
+// EC and the raw 32 bytes for Ed25519; the AlgorithmIdentifier, and the
+// curve it names, are not covered. The bytes are taken as encoded, never
+// re-encoded or shifted by the unused bits, as OpenSSL does: the few
+// encoders that set unused bits on a key would otherwise yield a hash no
+// client computes.
+func keyHashInput(rawSPKI []byte) ([]byte, error) {
+	var spki subjectPublicKeyInfo
+	rest, err := asn1.Unmarshal(rawSPKI, &spki)
+	if err != nil {
+		return nil, fmt.Errorf("parsing subject public key info: %v", err)
+	}
+	if len(rest) > 0 {
+		return nil, errors.New("trailing data after subject public key info")
+	}
+	if len(spki.PublicKey.Bytes) == 0 {
+		return nil, errors.New("empty subject public key")
+	}
+	return spki.PublicKey.Bytes, nil
+}
+
+// MatchesIssuer reports whether id was computed from issuer.
+func (id CertID) MatchesIssuer(issuer *x509.Certificate) bool {
+	nameHash, keyHash, err := IssuerHashes(issuer, id.HashAlgorithm)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(nameHash, id.NameHash) && bytes.Equal(keyHash, id.KeyHash)
+}
+
+// identifies reports whether cert is the responder named by the responder ID.
+func (r *Response) identifies(cert *x509.Certificate) bool {
+	if r.ResponderName != nil {
+		return bytes.Equal(r.ResponderName, cert.RawSubject)
+	}
+	_, keyHash, err := IssuerHashes(cert, crypto.SHA1)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(keyHash, r.ResponderKeyHash)
+}
+
+// VerifyOptions controls Verify.
+type VerifyOptions struct {
+	// At is the point in time the response is evaluated at. The zero
+	// value means now.
+	At time.Time
+	// Skew is the clock skew tolerated on either side of the validity
+	// window.
+	Skew time.Duration
+	// TrustedResponders are locally trusted responder certificates that
+	// are accepted without being issued by the CA (RFC 6960 4.2.2.2).
+	TrustedResponders []*x509.Certificate
+}
+
+// Verify checks that r is a successful response about certificates issued
+// by issuer, that it was signed by an authorized responder, and that every
+// single response was valid at opts.At. It returns the signing certificate.
+func Verify(r *Response, issuer *x509.Certificate, opts VerifyOptions) (*x509.Certificate, error) {
+	at := opts.At
+	if at.IsZero() {
+		at = time.Now()
+	}
+	if r.Status != Successful {
+		return nil, fmt.Errorf("response status is %s", r.Status)
+	}
+
+	signer, err := r.authorizedSigner(issuer, at, opts.TrustedResponders)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.CheckSignatureFrom(signer); err != nil {
+		return signer, fmt.Errorf("response signature: %v", err)
+	}
+
+	if r.ProducedAt.After(at.Add(opts.Skew)) {
+		return signer, fmt.Errorf("response produced at %s, after %s", r.ProducedAt.Format(time.RFC3339), at.Format(time.RFC3339))
+	}
+	if len(r.Responses) == 0 {
+		return signer, errors.New("response contains no single responses")
+	}
+	for _, sr := range r.Responses {
+		if !sr.MatchesIssuer(issuer) {
+			return signer, fmt.Errorf("serial %x: CertID does not match issuer %s", sr.SerialNumber, issuer.Subject)
+		}
+		if sr.ThisUpdate.After(at.Add(opts.Skew)) {
+			return signer, fmt.Errorf("serial %x: thisUpdate %s is after %s", sr.SerialNumber, sr.ThisUpdate.Format(time.RFC3339), at.Format(time.RFC3339))
+		}
+		if !sr.NextUpdate.IsZero() && sr.NextUpdate.Add(opts.Skew).Before(at) {
+			return signer, fmt.Errorf("serial %x: nextUpdate %s is before %s", sr.SerialNumber, sr.NextUpdate.Format(time.RFC3339), at.Format(time.RFC3339))
+		}
+	}
+	return signer, nil
+}
+
+// authorizedSigner finds the certificate named by the responder ID and
+// checks that it may sign responses for issuer.
+func (r *Response) authorizedSigner(issuer *x509.Certificate, at time.Time, trusted []*x509.Certificate) (*x509.Certificate, error) {
+	if r.identifies(issuer) {
+		return issuer, nil
+	}
+	for _, cert := range trusted {
+		if r.identifies(cert) {
+			return cert, nil
+		}
+	}
+	for _, cert := range r.Certificates {
+		if !r.identifies(cert) {
+			continue
+		}
+		if err := CheckDelegatedResponder(cert, issuer, at); err != nil {
+			return nil, err
+		}
+		return cert, nil
+	}
+	return nil, errors.New("responder is neither the issuer nor a certificate included in the response")
+}
+
+// CheckDelegatedResponder verifies that cert is a responder certificate
+// issued directly by issuer with the id-kp-OCSPSigning extended key usage,
+// valid at the given time.
+func CheckDelegatedResponder(cert, issuer *x509.Certificate, at time.Time) error {
+	if !bytes.Equal(cert.RawIssuer, issuer.RawSubject) {
+		return fmt.Errorf("responder certificate %s was not issued by %s", cert.Subject, issuer.Subject)
+	}
+	if err := issuer.CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate, cert.Signature); err != nil {
+		return fmt.Errorf("responder certificate signature: %v", err)
+	}
+	ocspSigning := false
+	for _, eku := range cert.ExtKeyUsage {
+		if eku == x509.ExtKeyUsageOCSPSigning {
+			ocspSigning = true
+		}
+	}
+	if !ocspSigning {
+		return fmt.Errorf("responder certificate %s lacks the OCSP signing extended key usage", cert.Subject)
+	}
+	if at.Before(cert.NotBefore) || at.After(cert.NotAfter) {
+		return fmt.Errorf("responder certificate %s is not valid at %s", cert.Subject, at.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// VerifyRequest checks the signature on a signed request (RFC 6960 4.1.2).
+// The requestor certificate must be the first one included in the request
+// and must chain, through any others included, to roots at the given time.
+// It returns the requestor certificate.
+func VerifyRequest(r *Request, roots *x509.CertPool, at time.Time) (*x509.Certificate, error) {
+	if !r.Signed() {
+		return nil, errors.New("request is not signed")
+	}
+	if len(r.Certificates) == 0 {
+		return nil, errors.New("signed request includes no requestor certificate")
+	}
+	requestor := r.Certificates[0]
+	if r.SignatureAlgorithm == x509.UnknownSignatureAlgorithm {
+		return requestor, errors.New("unsupported request signature algorithm")
+	}
+	if err := requestor.CheckSignature(r.SignatureAlgorithm, r.TBSRequest, r.Signature); err != nil {
+		return requestor, fmt.Errorf("request signature: %v", err)
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range r.Certificates[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := requestor.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		CurrentTime:   at,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return requestor, fmt.Errorf("requestor certificate %s: %v", requestor.Subject, err)
+	}
+	return requestor, nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"strings"
+)
+
+// The OCSP router maps the path of a request on the main listener to the
+// issuer it is restricted to and, for a GET, the encoded request. It runs
+// on the fast path, so it works on substrings of the path and never
+// allocates. Runs of slashes around the route segment are one slash;
+// slashes inside the request are base64, never separators. The request
+// itself is decoded by responder.DecodeGET.
+
+// maxPathLength bounds the request target on the main listener: the
+// largest request with every character percent-encoded, under a route.
+var maxPathLength = 3*base64.StdEncoding.EncodedLen(maxRequestSize) + 256
+
+// pathTooLong reports whether r's target is over maxPathLength; such
+// requests are answered 414 before routing.
+func pathTooLong(r *http.Request) bool {
+	return len(r.RequestURI) > maxPathLength || len(r.URL.Path) > maxPathLength
+}
+
+var pathTooLongHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	http.Error(w, "request path too long", http.StatusRequestURITooLong)
+})
+
+// splitPath returns the first segment of path and what follows it,
+// without the slashes around the segment.
+func splitPath(path string) (seg, rest string) {
+	path = strings.TrimLeft(path, "/")
+	i := strings.IndexByte(path, '/')
+	if i < 0 {
+		return path, ""
+	}
+	return path[:i], strings.TrimLeft(path[i:], "/")
+}
+
+// route maps a request path to the issuer it is restricted to, "" for the
+// multi-issuer root path. It reports false for paths that are not routed.
+func (st *state) route(path string) (string, bool) {
+	seg, _ := splitPath(path)
+	if seg == "" {
+		return "", true
+	}
+	issuer, ok := st.routes[seg]
+	return issuer, ok
+}
+
+// routeGET splits the path of an OCSP GET into the issuer its route
+// restricts it to and the encoded request.
+func (st *state) routeGET(path string) (string, string) {
+	seg, rest := splitPath(path)
+	if rest != "" {
+		if issuer, ok := st.routes[seg]; ok {
+			return issuer, rest
+		}
+	}
+	return "", strings.TrimLeft(path, "/")
+}
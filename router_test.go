@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/pkkemp/GoOCSPResponder/responder"
+)
+
+func TestRoute(t *testing.T) {
+	st := &state{routes: map[string]string{"ca1": "KEY1"}}
+	for _, tc := range []struct {
+		path, issuer string
+		ok           bool
+	}{
+		{"", "", true},
+		{"/", "", true},
+		{"//", "", true},
+		{"/ca1", "KEY1", true},
+		{"/ca1/", "KEY1", true},
+		{"//ca1", "KEY1", true},
+		{"//ca1//", "KEY1", true},
+		{"/ca2", "", false},
+		{"/ca2/", "", false},
+		{"/CA1", "", false},
+	} {
+		issuer, ok := st.route(tc.path)
+		if issuer != tc.issuer || ok != tc.ok {
+			t.Errorf("route(%q) = %q, %v, want %q, %v", tc.path, issuer, ok, tc.issuer, tc.ok)
+		}
+	}
+}
+
+func TestRouteGET(t *testing.T) {
+	st := &state{routes: map[string]string{"ca1": "KEY1"}}
+	for _, tc := range []struct {
+		path, issuer, enc string
+	}{
+		{"/MEQwQj", "", "MEQwQj"},
+		{"//MEQwQj", "", "MEQwQj"},
+		{"/MEQ/wQj/A==", "", "MEQ/wQj/A=="},
+		{"/ca1/MEQwQj", "KEY1", "MEQwQj"},
+		{"//ca1//MEQwQj", "KEY1", "MEQwQj"},
+		{"/ca1/MEQ/wQj//A==", "KEY1", "MEQ/wQj//A=="},
+		// A route without a request is the root path's request.
+		{"/ca1", "", "ca1"},
+		{"/ca2/MEQwQj", "", "ca2/MEQwQj"},
+	} {
+		issuer, enc := st.routeGET(tc.path)
+		if issuer != tc.issuer || enc != tc.enc {
+			t.Errorf("routeGET(%q) = %q, %q, want %q, %q", tc.path, issuer, enc, tc.issuer, tc.enc)
+		}
+	}
+}
+
+// escapedRequest returns a request of newReq whose standard base64 has a
+// +, a / and padding, so every escape is exercised.
+func escapedRequest(t *testing.T, newReq func(int64) []byte) ([]byte, string) {
+	t.Helper()
+	for serial := int64(0x1000); serial < 0x11000; serial++ {
+		req := newReq(serial)
+		enc := base64.StdEncoding.EncodeToString(req)
+		if strings.Contains(enc, "+") && strings.Contains(enc, "/") && strings.HasSuffix(enc, "=") {
+			return req, enc
+		}
+	}
+	t.Fatal("no request encodes with +, / and =")
+	return nil, ""
+}
+
+// TestOCSPGetPaths serves one request under the paths clients and proxies
+// mangle it into.
+func TestOCSPGetPaths(t *testing.T) {
+	req, enc := escapedRequest(t, benchState(t, defaultConfig().Cache))
+	st := currentState()
+	st.routes = map[string]string{"ca1": st.crls[0].key()}
+	// The targets are as sent, so %2B is a + by the time the router sees
+	// the path, and %252B a %2B.
+	escaped := strings.NewReplacer("+", "%2B", "/", "%2F", "=", "%3D").Replace(enc)
+	twice := strings.Replace(escaped, "%", "%25", -1)
+	for _, target := range []string{
+		"/" + enc,
+		"//" + enc,
+		"/" + escaped,
+		"/" + twice,
+		"/" + base64.RawURLEncoding.EncodeToString(req),
+		"/ca1/" + enc,
+		"//ca1//" + escaped,
+		"/ca1/" + twice,
+		"/ca1/" + base64.URLEncoding.EncodeToString(req),
+	} {
+		w := httptest.NewRecorder()
+		ocspHandler(w, httptest.NewRequest(http.MethodGet, target, nil))
+		resp, err := responder.ParseResponse(w.Body.Bytes())
+		if err != nil {
+			t.Errorf("GET %s: %v", target, err)
+			continue
+		}
+		if resp.Status != responder.Successful || len(resp.Responses) != 1 {
+			t.Errorf("GET %s answered %v", target, resp.Status)
+		}
+	}
+
+	// A trailing slash after the route is the route itself: POSTs to it
+	// are answered, and a GET of it is no request.
+	for _, path := range []string{"/ca1", "/ca1/", "//ca1//"} {
+		r := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(req))
+		w := httptest.NewRecorder()
+		ocspHandler(w, r)
+		if resp, err := responder.ParseResponse(w.Body.Bytes()); err != nil || resp.Status != responder.Successful {
+			t.Errorf("POST %s: %v, %v", path, resp, err)
+		}
+	}
+	w := httptest.NewRecorder()
+	ocspHandler(w, httptest.NewRequest(http.MethodPost, "/ca2/", bytes.NewReader(req)))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("POST /ca2/ answered %d, want 404", w.Code)
+	}
+	w = httptest.NewRecorder()
+	ocspHandler(w, httptest.NewRequest(http.MethodGet, "/ca1/", nil))
+	if !bytes.Equal(w.Body.Bytes(), malformedResponse) {
+		t.Errorf("GET /ca1/ answered %x, want malformedRequest", w.Body.Bytes())
+	}
+}
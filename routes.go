@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Route dedicates a URL path to one issuer, to match the OCSP URLs already
+// in the AIA extension of certificates that CA issued. Requests posted
+// under the path are answered for that issuer only; the root path keeps
+// answering for every issuer.
+type Route struct {
+	// Path is a single path segment such as /dodemailca41/. Requests to
+	// it with or without the trailing slash, or below it, are routed.
+	Path string `yaml:"path"`
+	// Issuer names the CA as the explain endpoint accepts it: CRL name,
+	// fingerprint, common name or subject.
+	Issuer string `yaml:"issuer"`
+}
+
+// reservedPaths are served by other handlers and cannot be routed.
+var reservedPaths = map[string]bool{
+	"stats": true, "healthz": true, "static": true, "api": true,
+	"admin": true, "favicon.ico": true, "robots.txt": true, "attest": true,
+	"docs": true, "replication": true,
+}
+
+// segment returns the route path without its slashes.
+func (r Route) segment() string {
+	return strings.Trim(r.Path, "/")
+}
+
+func (r Route) validate() error {
+	seg := r.segment()
+	switch {
+	case seg == "" || strings.Contains(seg, "/"):
+		return fmt.Errorf("routes: path %q must be a single path segment", r.Path)
+	case reservedPaths[seg]:
+		return fmt.Errorf("routes: path %q is reserved", r.Path)
+	case r.Issuer == "":
+		return fmt.Errorf("routes: path %q needs an issuer", r.Path)
+	}
+	return nil
+}
+
+// buildRoutes resolves the configured routes to CRL keys by path segment.
+func buildRoutes(st *state) (map[string]string, error) {
+	routes := make(map[string]string)
+	for _, r := range st.cfg.Routes {
+		crl, _, ok := st.findIssuer(r.Issuer)
+		if !ok {
+			return nil, fmt.Errorf("routes: issuer %q of %s is not served", r.Issuer, r.Path)
+		}
+		routes[r.segment()] = crl.key()
+	}
+	return routes, nil
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"runtime"
+	"runtime/metrics"
+	"sort"
+	"time"
+)
+
+// startedAt is when the process started, for the uptime.
+var startedAt = time.Now()
+
+// runtimeStats is the dashboard's runtime panel, read from runtime/metrics
+// so rendering it does not stop the world the way ReadMemStats does.
+type runtimeStats struct {
+	Region     string
+	GoVersion  string
+	Uptime     time.Duration
+	Goroutines uint64
+	// HeapObjects is the memory of live and not yet swept heap objects,
+	// HeapGoal the heap size at which the next GC starts, and Total all
+	// memory mapped by the runtime.
+	HeapObjects uint64
+	HeapGoal    uint64
+	Total       uint64
+	GCCycles    uint64
+	// GC pause quantiles since startup, from the runtime's histogram.
+	PauseP50, PauseP99, PauseMax time.Duration
+
+	// Memory is the estimated memory per subsystem, largest first.
+	Memory []memoryUse
+}
+
+// memoryUse is the memory one subsystem holds. OnDisk indexes are mapped
+// files the kernel pages in and out, not heap.
+type memoryUse struct {
+	Name   string
+	Bytes  uint64
+	OnDisk bool
+}
+
+var runtimeMetrics = []string{
+	"/sched/goroutines:goroutines",
+	"/memory/classes/heap/objects:bytes",
+	"/gc/heap/goal:bytes",
+	"/memory/classes/total:bytes",
+	"/gc/cycles/total:gc-cycles",
+	"/gc/pauses:seconds",
+}
+
+func currentRuntimeStats(st *state) runtimeStats {
+	rs := runtimeStats{
+		Region:    st.cfg.Region.Name,
+		GoVersion: runtime.Version(),
+		Uptime:    time.Since(startedAt).Truncate(time.Second),
+	}
+	samples := make([]metrics.Sample, len(runtimeMetrics))
+	for i, name := range runtimeMetrics {
+		samples[i].Name = name
+	}
+	metrics.Read(samples)
+	uint64Of := func(i int) uint64 {
+		if samples[i].Value.Kind() != metrics.KindUint64 {
+			return 0
+		}
+		return samples[i].Value.Uint64()
+	}
+	rs.Goroutines = uint64Of(0)
+	rs.HeapObjects = uint64Of(1)
+	rs.HeapGoal = uint64Of(2)
+	rs.Total = uint64Of(3)
+	rs.GCCycles = uint64Of(4)
+	if samples[5].Value.Kind() == metrics.KindFloat64Histogram {
+		h := samples[5].Value.Float64Histogram()
+		rs.PauseP50 = histogramQuantile(h, 0.5)
+		rs.PauseP99 = histogramQuantile(h, 0.99)
+		rs.PauseMax = histogramQuantile(h, 1)
+	}
+	rs.Memory = memoryAttribution(st)
+	return rs
+}
+
+// formatBytes renders n in binary units, for templates.
+func formatBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// histogramQuantile returns the upper bound of the bucket holding quantile
+// q of a histogram of seconds.
+func histogramQuantile(h *metrics.Float64Histogram, q float64) time.Duration {
+	var total uint64
+	for _, n := range h.Counts {
+		total += n
+	}
+	if total == 0 {
+		return 0
+	}
+	rank := uint64(math.Ceil(q * float64(total)))
+	var seen uint64
+	for i, n := range h.Counts {
+		seen += n
+		if n > 0 && seen >= rank {
+			upper := h.Buckets[i+1]
+			if math.IsInf(upper, 1) {
+				upper = h.Buckets[i]
+			}
+			return time.Duration(upper * float64(time.Second))
+		}
+	}
+	return 0
+}
+
+// memoryAttribution estimates the memory held by each issuer's index and
+// by the response cache.
+func memoryAttribution(st *state) []memoryUse {
+	var uses []memoryUse
+	for _, crl := range st.crls {
+		f := st.filters[crl.key()]
+		u := memoryUse{Name: "index " + crl.key()}
+		switch {
+		case f.disk != nil:
+			u.Bytes, u.OnDisk = uint64(len(f.disk.data)), true
+		default:
+			u.Bytes = f.entries.bytes()
+			if f.Filter != nil {
+				u.Bytes += uint64(f.Filter.Cap() / 8)
+			}
+		}
+		uses = append(uses, u)
+	}
+	var cached uint64
+	for k, e := range st.cache.live(time.Now()) {
+		cached += uint64(len(k) + len(e.der) + len(e.next))
+	}
+	uses = append(uses, memoryUse{Name: "response cache", Bytes: cached})
+	if st.subjects != nil {
+		uses = append(uses, memoryUse{Name: "subject index", Bytes: st.subjects.bytes()})
+	}
+	sort.SliceStable(uses, func(i, j int) bool { return uses[i].Bytes > uses[j].Bytes })
+	return uses
+}
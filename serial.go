@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Serial formats, as parseSerialFormat reports them.
+const (
+	serialHex      = "hex"
+	serialColonHex = "colon-separated hex"
+	serialDecimal  = "decimal"
+	serialDER      = "base64 DER INTEGER"
+)
+
+// errSerialNotPositive refuses a serial number that is zero or negative,
+// which no certificate may carry (RFC 5280 section 4.1.2.2).
+var errSerialNotPositive = errors.New("serial must be a positive number")
+
+// serialHelp lists the accepted forms for error messages and the docs.
+const serialHelp = "a positive number in decimal, hex with or without 0x, colon- or space-separated hex bytes, or a base64 DER INTEGER"
+
+// parseSerial reads a serial number in any of the forms users paste; see
+// parseSerialFormat.
+func parseSerial(s string) (*big.Int, bool) {
+	n, _, ok := parseSerialFormat(s)
+	return n, ok
+}
+
+// parseSerialFormat reads a serial number and reports the form it was
+// in: hex with a 0x prefix, hex bytes separated by colons or spaces (as
+// openssl prints them), decimal, bare hex, or a base64 DER INTEGER (the
+// serial as encoded in the certificate). Digits alone are decimal, so bare
+// hex needs a letter to be taken as hex; add 0x when in doubt. Zero and
+// negative numbers are refused, as no certificate carries them.
+func parseSerialFormat(s string) (*big.Int, string, bool) {
+	n, format, ok := readSerialFormat(s)
+	if !ok || n.Sign() <= 0 {
+		return nil, "", false
+	}
+	return n, format, true
+}
+
+func readSerialFormat(s string) (*big.Int, string, bool) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, "", false
+	}
+	if strings.HasPrefix(s, "0x") || strings.HasPrefix(s, "0X") {
+		n, ok := parseHexSerial(strings.NewReplacer(":", "", " ", "").Replace(s[2:]))
+		return n, serialHex, ok
+	}
+	if strings.ContainsAny(s, ": ") {
+		var b strings.Builder
+		for _, group := range strings.FieldsFunc(s, func(r rune) bool { return r == ':' || r == ' ' }) {
+			if len(group) > 2 {
+				return nil, "", false
+			}
+			if len(group) == 1 {
+				b.WriteByte('0')
+			}
+			b.WriteString(group)
+		}
+		n, ok := parseHexSerial(b.String())
+		return n, serialColonHex, ok
+	}
+	if n, ok := new(big.Int).SetString(s, 10); ok {
+		return n, serialDecimal, true
+	}
+	if n, ok := parseHexSerial(s); ok {
+		return n, serialHex, true
+	}
+	if n, ok := parseDERSerial(s); ok {
+		return n, serialDER, true
+	}
+	return nil, "", false
+}
+
+// parseHexSerial reads unsigned hex digits.
+func parseHexSerial(s string) (*big.Int, bool) {
+	if s == "" || strings.HasPrefix(s, "-") || strings.HasPrefix(s, "+") {
+		return nil, false
+	}
+	return new(big.Int).SetString(s, 16)
+}
+
+// parseDERSerial reads a DER INTEGER encoded in either base64 alphabet,
+// with or without padding.
+func parseDERSerial(s string) (*big.Int, bool) {
+	for _, enc := range []*base64.Encoding{base64.StdEncoding, base64.URLEncoding, base64.RawStdEncoding, base64.RawURLEncoding} {
+		der, err := enc.DecodeString(s)
+		if err != nil || len(der) < 3 || der[0] != asn1.TagInteger {
+			continue
+		}
+		n := new(big.Int)
+		if rest, err := asn1.Unmarshal(der, &n); err == nil && len(rest) == 0 {
+			return n, true
+		}
+	}
+	return nil, false
+}
+
+// serialForms is a serial number in every form the responder accepts.
+type serialForms struct {
+	Input  string `json:"input"`
+	Format string `json:"format"`
+	// Hex is the canonical form the APIs answer with.
+	Hex      string `json:"hex"`
+	ColonHex string `json:"colon_hex"`
+	Decimal  string `json:"decimal"`
+	DER      string `json:"der_base64"`
+}
+
+// newSerialForms renders n, read from input in format.
+func newSerialForms(input, format string, n *big.Int) serialForms {
+	der, _ := asn1.Marshal(n)
+	// The colon form shows the content octets, as openssl does, with the
+	// leading zero of serials whose top bit is set.
+	content := der[2:]
+	if der[1]&0x80 != 0 {
+		content = der[2+int(der[1]&0x7f):]
+	}
+	colon := make([]string, len(content))
+	for i, b := range content {
+		colon[i] = fmt.Sprintf("%02x", b)
+	}
+	return serialForms{
+		Input:    input,
+		Format:   format,
+		Hex:      fmt.Sprintf("%x", n),
+		ColonHex: strings.Join(colon, ":"),
+		Decimal:  n.String(),
+		DER:      base64.StdEncoding.EncodeToString(der),
+	}
+}
+
+// serialHandler serves /api/v1/serial?serial=…, the forms of a serial.
+func serialHandler(w http.ResponseWriter, r *http.Request) {
+	input := r.URL.Query().Get("serial")
+	n, format, ok := parseSerialFormat(input)
+	if !ok {
+		http.Error(w, "serial must be "+serialHelp, http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(newSerialForms(input, format, n))
+}
+
+// serialCommand prints the forms of each serial given, to check how a
+// pasted serial is read before looking it up.
+func serialCommand(args []string) int {
+	fs := flag.NewFlagSet("serial", flag.ContinueOnError)
+	asJSON := fs.Bool("json", false, "print JSON")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: goocsp serial [--json] serial...")
+		fmt.Fprintln(fs.Output(), "A serial is "+serialHelp+".")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+	status := 0
+	var all []serialForms
+	for _, input := range fs.Args() {
+		n, format, ok := parseSerialFormat(input)
+		if !ok {
+			fmt.Fprintf(os.Stderr, "serial: %q is not %s\n", input, serialHelp)
+			status = 1
+			continue
+		}
+		f := newSerialForms(input, format, n)
+		if *asJSON {
+			all = append(all, f)
+			continue
+		}
+		fmt.Printf("%s (%s)\n  hex:     %s\n  colons:  %s\n  decimal: %s\n  DER:     %s\n", f.Input, f.Format, f.Hex, f.ColonHex, f.Decimal, f.DER)
+	}
+	if *asJSON {
+		out, _ := json.MarshalIndent(all, "", "  ")
+		fmt.Println(string(out))
+	}
+	return status
+}
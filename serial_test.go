@@ -0,0 +1,91 @@
+package main
+
+import (
+	"math/big"
+	"testing"
+)
+
+func TestParseSerialFormat(t *testing.T) {
+	for _, tc := range []struct {
+		in     string
+		want   int64 // 0 when the input is refused
+		format string
+	}{
+		{"1780797", 0x1b2c3d, serialDecimal},
+		{" 1780797\n", 0x1b2c3d, serialDecimal},
+		{"1b2c3d", 0x1b2c3d, serialHex},
+		{"1B2C3D", 0x1b2c3d, serialHex},
+		{"0x1B2C3D", 0x1b2c3d, serialHex},
+		{"0X1b2c3d", 0x1b2c3d, serialHex},
+		{"0x1780797", 0x1780797, serialHex},
+		{"0x1b:2c:3d", 0x1b2c3d, serialHex},
+		{"0x1b 2c 3d", 0x1b2c3d, serialHex},
+		{"1b:2c:3d", 0x1b2c3d, serialColonHex},
+		{"1B 2C 3D", 0x1b2c3d, serialColonHex},
+		{"1b:2c 3d", 0x1b2c3d, serialColonHex},
+		{"00:1b:2c:3d", 0x1b2c3d, serialColonHex},
+		// An odd-length group is a byte without its leading zero.
+		{"1:2c:3d", 0x012c3d, serialColonHex},
+		{"1b:2:3d", 0x1b023d, serialColonHex},
+		{"17 80 79 7", 0x17807907, serialColonHex},
+		{"1b:2c3:3d", 0, ""},
+		{"AgMbLD0=", 0x1b2c3d, serialDER},
+		{"AgMbLD0", 0x1b2c3d, serialDER},
+		{"AgM++/8=", 0x3efbff, serialDER},
+		{"AgM++/8", 0x3efbff, serialDER},
+		{"AgM--_8=", 0x3efbff, serialDER},
+		{"AgM--_8", 0x3efbff, serialDER},
+		{"AgQA++++", 0xfbefbe, serialDER},
+		{"AgQA----", 0xfbefbe, serialDER},
+		{"AgMbLD0A", 0, ""},
+		{"AgM-+/8=", 0, ""},
+		{"", 0, ""},
+		{"  ", 0, ""},
+		{"0", 0, ""},
+		{"00", 0, ""},
+		{"-5", 0, ""},
+		{"-0x5", 0, ""},
+		{"0x-5", 0, ""},
+		{"0x+5", 0, ""},
+		{"0x0", 0, ""},
+		{"0x", 0, ""},
+		{"00:00", 0, ""},
+		{"AgEA", 0, ""},
+		{"AgH/", 0, ""},
+		{"AgH_", 0, ""},
+		{"1b2c3g", 0, ""},
+		{"serial", 0, ""},
+	} {
+		n, format, ok := parseSerialFormat(tc.in)
+		if tc.want == 0 {
+			if ok {
+				t.Errorf("parseSerialFormat(%q) = %v (%s), want it refused", tc.in, n, format)
+			}
+			continue
+		}
+		if !ok || n.Cmp(big.NewInt(tc.want)) != 0 || format != tc.format {
+			t.Errorf("parseSerialFormat(%q) = %v (%s), %v, want %#x (%s)", tc.in, n, format, ok, tc.want, tc.format)
+		}
+	}
+}
+
+func TestNewSerialForms(t *testing.T) {
+	for _, tc := range []struct {
+		n                        int64
+		hex, colon, decimal, der string
+	}{
+		{0x1b2c3d, "1b2c3d", "1b:2c:3d", "1780797", "AgMbLD0="},
+		// The top bit is set, so DER and the colon form carry a zero.
+		{0xfbefbe, "fbefbe", "00:fb:ef:be", "16510910", "AgQA++++"},
+	} {
+		f := newSerialForms("in", serialHex, big.NewInt(tc.n))
+		if f.Hex != tc.hex || f.ColonHex != tc.colon || f.Decimal != tc.decimal || f.DER != tc.der {
+			t.Errorf("newSerialForms(%#x) = %+v", tc.n, f)
+		}
+		for _, in := range []string{f.Hex, "0x" + f.Hex, f.ColonHex, f.Decimal, f.DER} {
+			if n, ok := parseSerial(in); !ok || n.Int64() != tc.n {
+				t.Errorf("parseSerial(%q) = %v, %v, want %#x", in, n, ok, tc.n)
+			}
+		}
+	}
+}
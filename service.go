@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// serviceOptions are the choices goocsp service leaves to its flags.
+type serviceOptions struct {
+	name, display string
+	configPath    string
+	cache         string
+	legacyAPI     string
+	readOnly      bool
+}
+
+// resolve makes the paths absolute: a service starts in the system
+// directory, not where it was installed from.
+func (o *serviceOptions) resolve() error {
+	for _, p := range []*string{&o.configPath, &o.cache} {
+		if *p == "" {
+			continue
+		}
+		abs, err := filepath.Abs(*p)
+		if err != nil {
+			return err
+		}
+		*p = abs
+	}
+	return nil
+}
+
+// serverArgs returns the arguments the service runs the server with.
+func (o serviceOptions) serverArgs() []string {
+	args := []string{"--service", o.name}
+	if o.configPath != "" {
+		args = append(args, "--config", o.configPath)
+	}
+	if o.cache != "" {
+		args = append(args, "--cache", o.cache)
+	}
+	if o.legacyAPI != "" {
+		args = append(args, "--legacy-api", o.legacyAPI)
+	}
+	if o.readOnly {
+		args = append(args, "--read-only")
+	}
+	return args
+}
+
+var errNotWindows = errors.New("Windows services are only available on Windows; see goocsp systemd")
+
+// serviceCommand installs the responder as a Windows service that starts
+// with the system and logs to the Application event log, or removes it.
+func serviceCommand(args []string) int {
+	fs := flag.NewFlagSet("service", flag.ContinueOnError)
+	o := serviceOptions{}
+	fs.StringVar(&o.configPath, "config", "", "YAML configuration the service runs with")
+	fs.StringVar(&o.cache, "cache", "", "CRL cache directory of the service; cache_dir, or "+defaultCacheDir+" by default")
+	fs.StringVar(&o.name, "name", "goocsp", "service name, also its event log source")
+	fs.StringVar(&o.display, "display-name", "GoOCSP responder", "service name shown in the Services console")
+	fs.StringVar(&o.legacyAPI, "legacy-api", "", "address of the deprecated plaintext API listener, as for the server")
+	fs.BoolVar(&o.readOnly, "read-only", false, "run the service with --read-only")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: goocsp service install|uninstall [--name name] [--config file] [--cache dir] [flags]")
+		fs.PrintDefaults()
+	}
+	if len(args) == 0 {
+		fs.Usage()
+		return 2
+	}
+	action := args[0]
+	if err := fs.Parse(args[1:]); err != nil {
+		return 2
+	}
+	if fs.NArg() != 0 || (action != "install" && action != "uninstall") {
+		fs.Usage()
+		return 2
+	}
+	var err error
+	if action == "install" {
+		if err = o.resolve(); err == nil {
+			// Refuse a configuration the service would die on.
+			_, err = loadConfig(o.configPath)
+		}
+		if err == nil {
+			err = installService(o)
+		}
+	} else {
+		err = uninstallService(o.name)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "service:", err)
+		return 1
+	}
+	fmt.Printf("service %s: %sed\n", o.name, action)
+	return 0
+}
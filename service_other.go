@@ -0,0 +1,17 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+// defaultCacheDir is the cache directory without --cache or cache_dir.
+const defaultCacheDir = "/cache/"
+
+func startService(name string) error { return errNotWindows }
+
+// serviceRunning reports a started service as running; there is none
+// outside Windows.
+func serviceRunning() {}
+
+func installService(o serviceOptions) error { return errNotWindows }
+
+func uninstallService(name string) error { return errNotWindows }
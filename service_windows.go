@@ -0,0 +1,394 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// The service control manager and event log are driven through advapi32
+// directly, as golang.org/x/sys/windows/svc would, to keep the module's
+// dependencies down.
+
+// defaultCacheDir is the cache directory without --cache or cache_dir.
+var defaultCacheDir = filepath.Join(programData(), "goocsp", "cache") + `\`
+
+func programData() string {
+	if dir := os.Getenv("ProgramData"); dir != "" {
+		return dir
+	}
+	return `C:\ProgramData`
+}
+
+var (
+	advapi32 = syscall.NewLazyDLL("advapi32.dll")
+
+	procStartServiceCtrlDispatcher   = advapi32.NewProc("StartServiceCtrlDispatcherW")
+	procRegisterServiceCtrlHandlerEx = advapi32.NewProc("RegisterServiceCtrlHandlerExW")
+	procSetServiceStatus             = advapi32.NewProc("SetServiceStatus")
+	procOpenSCManager                = advapi32.NewProc("OpenSCManagerW")
+	procCreateService                = advapi32.NewProc("CreateServiceW")
+	procChangeServiceConfig2         = advapi32.NewProc("ChangeServiceConfig2W")
+	procOpenService                  = advapi32.NewProc("OpenServiceW")
+	procControlService               = advapi32.NewProc("ControlService")
+	procDeleteService                = advapi32.NewProc("DeleteService")
+	procCloseServiceHandle           = advapi32.NewProc("CloseServiceHandle")
+	procRegisterEventSource          = advapi32.NewProc("RegisterEventSourceW")
+	procReportEvent                  = advapi32.NewProc("ReportEventW")
+	procRegCreateKeyEx               = advapi32.NewProc("RegCreateKeyExW")
+	procRegSetValueEx                = advapi32.NewProc("RegSetValueExW")
+	procRegDeleteKey                 = advapi32.NewProc("RegDeleteKeyW")
+)
+
+const (
+	serviceWin32OwnProcess = 0x10
+
+	serviceStopped      = 1
+	serviceStartPending = 2
+	serviceStopPending  = 3
+	serviceRunningState = 4
+
+	serviceAcceptStop     = 0x1
+	serviceAcceptShutdown = 0x4
+
+	serviceControlStop        = 1
+	serviceControlInterrogate = 4
+	serviceControlShutdown    = 5
+
+	errorCallNotImplemented = 120
+
+	scManagerAllAccess   = 0xf003f
+	serviceAllAccess     = 0xf01ff
+	serviceStop          = 0x20
+	accessDelete         = 0x10000
+	serviceAutoStart     = 2
+	serviceErrorNormal   = 1
+	serviceConfigFailure = 2
+	scActionRestart      = 1
+
+	eventlogErrorType       = 1
+	eventlogWarningType     = 2
+	eventlogInformationType = 4
+
+	hkeyLocalMachine = 0x80000002
+	keySetValue      = 0x2
+	regExpandSz      = 2
+	regDword         = 4
+)
+
+// serviceStatus is SERVICE_STATUS.
+type serviceStatus struct {
+	ServiceType             uint32
+	CurrentState            uint32
+	ControlsAccepted        uint32
+	Win32ExitCode           uint32
+	ServiceSpecificExitCode uint32
+	CheckPoint              uint32
+	WaitHint                uint32
+}
+
+// serviceTableEntry is SERVICE_TABLE_ENTRYW.
+type serviceTableEntry struct {
+	name *uint16
+	proc uintptr
+}
+
+// scAction and serviceFailureActions are SC_ACTION and
+// SERVICE_FAILURE_ACTIONSW.
+type scAction struct {
+	Type  uint32
+	Delay uint32
+}
+
+type serviceFailureActions struct {
+	ResetPeriod uint32
+	RebootMsg   *uint16
+	Command     *uint16
+	Actions     uint32
+	lpsaActions *scAction
+}
+
+// service is the Windows service the process runs as, if any.
+var service struct {
+	sync.Mutex
+	name   string
+	handle uintptr
+	status serviceStatus
+	// started receives nil once the service control manager called
+	// serviceMain, or why it could not.
+	started chan error
+}
+
+var (
+	serviceMainCallback = syscall.NewCallback(serviceMain)
+	ctrlHandlerCallback = syscall.NewCallback(ctrlHandler)
+)
+
+// startService connects to the service control manager as the service
+// name and sends the log to the Application event log. The service stays
+// start pending until serviceRunning.
+func startService(name string) error {
+	service.name = name
+	service.started = make(chan error, 1)
+	namePtr, err := syscall.UTF16PtrFromString(name)
+	if err != nil {
+		return err
+	}
+	go func() {
+		// The dispatcher keeps this thread until the service stops.
+		runtime.LockOSThread()
+		table := []serviceTableEntry{{namePtr, serviceMainCallback}, {}}
+		if r, _, err := procStartServiceCtrlDispatcher.Call(uintptr(unsafe.Pointer(&table[0]))); r == 0 {
+			service.started <- fmt.Errorf("--service %s: not started by the service control manager: %v", name, err)
+		}
+	}()
+	if err := <-service.started; err != nil {
+		return err
+	}
+	if w, err := openEventLog(name); err != nil {
+		log.Printf("service %s: event log: %v; logging to stderr", name, err)
+	} else {
+		// The event log stamps every entry itself.
+		log.SetFlags(0)
+		log.SetOutput(w)
+	}
+	go reportStartPending()
+	return nil
+}
+
+// serviceMain is the ServiceMain of the service. It never returns: the
+// process exits when the service stops.
+func serviceMain(argc, argv uintptr) uintptr {
+	namePtr, _ := syscall.UTF16PtrFromString(service.name)
+	h, _, err := procRegisterServiceCtrlHandlerEx.Call(uintptr(unsafe.Pointer(namePtr)), ctrlHandlerCallback, 0)
+	if h == 0 {
+		service.started <- fmt.Errorf("--service %s: RegisterServiceCtrlHandlerEx: %v", service.name, err)
+		return 0
+	}
+	service.Lock()
+	service.handle = h
+	service.Unlock()
+	setServiceState(serviceStartPending)
+	service.started <- nil
+	select {}
+}
+
+// ctrlHandler is the HandlerEx of the service.
+func ctrlHandler(ctrl, eventType, eventData, context uintptr) uintptr {
+	switch ctrl {
+	case serviceControlStop, serviceControlShutdown:
+		setServiceState(serviceStopPending)
+		go stopService()
+	case serviceControlInterrogate:
+		setServiceState(0)
+	default:
+		return errorCallNotImplemented
+	}
+	return 0
+}
+
+// stopService reports the service stopped and exits. Requests in flight
+// are cut, as when the process is killed on other platforms.
+func stopService() {
+	log.Printf("service %s: stopping", service.name)
+	setServiceState(serviceStopped)
+	os.Exit(0)
+}
+
+// setServiceState reports state to the service control manager, or the
+// current state again for 0.
+func setServiceState(state uint32) {
+	service.Lock()
+	defer service.Unlock()
+	if service.handle == 0 {
+		return
+	}
+	s := &service.status
+	if state != 0 {
+		if state != s.CurrentState {
+			s.CheckPoint = 0
+		}
+		s.CurrentState = state
+	}
+	s.ServiceType = serviceWin32OwnProcess
+	s.ControlsAccepted = 0
+	s.WaitHint = 0
+	switch s.CurrentState {
+	case serviceRunningState:
+		s.ControlsAccepted = serviceAcceptStop | serviceAcceptShutdown
+	case serviceStartPending, serviceStopPending:
+		s.WaitHint = 30000
+	}
+	if r, _, err := procSetServiceStatus.Call(service.handle, uintptr(unsafe.Pointer(s))); r == 0 {
+		log.Printf("service %s: SetServiceStatus: %v", service.name, err)
+	}
+}
+
+// reportStartPending keeps the service control manager waiting while the
+// CRLs load, which can take longer than it waits for a silent service.
+func reportStartPending() {
+	for range time.Tick(10 * time.Second) {
+		service.Lock()
+		pending := service.status.CurrentState == serviceStartPending
+		if pending {
+			service.status.CheckPoint++
+		}
+		service.Unlock()
+		if !pending {
+			return
+		}
+		setServiceState(0)
+	}
+}
+
+// serviceRunning reports the service running, once every listener is
+// bound.
+func serviceRunning() {
+	setServiceState(serviceRunningState)
+}
+
+// eventLog writes each log line as an Application event: alerts as
+// warnings, critical ones as errors, the rest as information.
+type eventLog struct {
+	handle uintptr
+}
+
+func openEventLog(source string) (*eventLog, error) {
+	sourcePtr, err := syscall.UTF16PtrFromString(source)
+	if err != nil {
+		return nil, err
+	}
+	h, _, err := procRegisterEventSource.Call(0, uintptr(unsafe.Pointer(sourcePtr)))
+	if h == 0 {
+		return nil, err
+	}
+	return &eventLog{handle: h}, nil
+}
+
+func (l *eventLog) Write(p []byte) (int, error) {
+	msg := strings.TrimRight(strings.Replace(string(p), "\x00", "", -1), "\n")
+	typ := eventlogInformationType
+	switch {
+	case strings.HasPrefix(msg, "ALERT (critical)"):
+		typ = eventlogErrorType
+	case strings.HasPrefix(msg, "ALERT"):
+		typ = eventlogWarningType
+	}
+	s, err := syscall.UTF16PtrFromString(msg)
+	if err != nil {
+		return 0, err
+	}
+	// Event ID 1 of EventCreate.exe, the message file of the source,
+	// shows the string as is.
+	if r, _, err := procReportEvent.Call(l.handle, uintptr(typ), 0, 1, 0, 1, 0, uintptr(unsafe.Pointer(&s)), 0); r == 0 {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// eventSourceKey is where the event log finds the message file of source.
+func eventSourceKey(source string) string {
+	return `SYSTEM\CurrentControlSet\Services\EventLog\Application\` + source
+}
+
+// installService creates the service, started with the system and
+// restarted when it dies, and registers its event log source.
+func installService(o serviceOptions) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	cmdline := syscall.EscapeArg(exe)
+	for _, arg := range o.serverArgs() {
+		cmdline += " " + syscall.EscapeArg(arg)
+	}
+	m, err := openSCManager()
+	if err != nil {
+		return err
+	}
+	defer procCloseServiceHandle.Call(m)
+	s, _, err := procCreateService.Call(m, uintptr(unsafe.Pointer(utf16Ptr(o.name))), uintptr(unsafe.Pointer(utf16Ptr(o.display))), serviceAllAccess,
+		serviceWin32OwnProcess, serviceAutoStart, serviceErrorNormal, uintptr(unsafe.Pointer(utf16Ptr(cmdline))), 0, 0, 0, 0, 0)
+	if s == 0 {
+		return fmt.Errorf("CreateService: %v", err)
+	}
+	defer procCloseServiceHandle.Call(s)
+	// Restart after 10s, 1m and 5m, and count failures afresh after a day.
+	actions := []scAction{{scActionRestart, 10000}, {scActionRestart, 60000}, {scActionRestart, 300000}}
+	failure := serviceFailureActions{ResetPeriod: 86400, Actions: uint32(len(actions)), lpsaActions: &actions[0]}
+	if r, _, err := procChangeServiceConfig2.Call(s, serviceConfigFailure, uintptr(unsafe.Pointer(&failure))); r == 0 {
+		log.Printf("service %s: no restart on failure: %v", o.name, err)
+	}
+	return registerEventSource(o.name)
+}
+
+func registerEventSource(source string) error {
+	var key uintptr
+	if r, _, _ := procRegCreateKeyEx.Call(hkeyLocalMachine, uintptr(unsafe.Pointer(utf16Ptr(eventSourceKey(source)))), 0, 0, 0, keySetValue, 0, uintptr(unsafe.Pointer(&key)), 0); r != 0 {
+		return fmt.Errorf("event log source: %v", syscall.Errno(r))
+	}
+	defer syscall.RegCloseKey(syscall.Handle(key))
+	file := syscall.StringToUTF16(`%SystemRoot%\System32\EventCreate.exe`)
+	if r, _, _ := procRegSetValueEx.Call(key, uintptr(unsafe.Pointer(utf16Ptr("EventMessageFile"))), 0, regExpandSz, uintptr(unsafe.Pointer(&file[0])), uintptr(len(file)*2)); r != 0 {
+		return fmt.Errorf("event log source: %v", syscall.Errno(r))
+	}
+	types := uint32(eventlogErrorType | eventlogWarningType | eventlogInformationType)
+	if r, _, _ := procRegSetValueEx.Call(key, uintptr(unsafe.Pointer(utf16Ptr("TypesSupported"))), 0, regDword, uintptr(unsafe.Pointer(&types)), 4); r != 0 {
+		return fmt.Errorf("event log source: %v", syscall.Errno(r))
+	}
+	return nil
+}
+
+// uninstallService stops and deletes the service and its event log
+// source.
+func uninstallService(name string) error {
+	m, err := openSCManager()
+	if err != nil {
+		return err
+	}
+	defer procCloseServiceHandle.Call(m)
+	s, _, err := procOpenService.Call(m, uintptr(unsafe.Pointer(utf16Ptr(name))), serviceStop|accessDelete)
+	if s == 0 {
+		return fmt.Errorf("OpenService: %v", err)
+	}
+	defer procCloseServiceHandle.Call(s)
+	// Not running is fine.
+	var status serviceStatus
+	procControlService.Call(s, serviceControlStop, uintptr(unsafe.Pointer(&status)))
+	if r, _, err := procDeleteService.Call(s); r == 0 {
+		return fmt.Errorf("DeleteService: %v", err)
+	}
+	if r, _, _ := procRegDeleteKey.Call(hkeyLocalMachine, uintptr(unsafe.Pointer(utf16Ptr(eventSourceKey(name))))); r != 0 && syscall.Errno(r) != syscall.ERROR_FILE_NOT_FOUND {
+		return fmt.Errorf("event log source: %v", syscall.Errno(r))
+	}
+	return nil
+}
+
+func openSCManager() (uintptr, error) {
+	m, _, err := procOpenSCManager.Call(0, 0, scManagerAllAccess)
+	if m == 0 {
+		if errors.Is(err, syscall.ERROR_ACCESS_DENIED) {
+			return 0, errors.New("installing a service needs an administrator")
+		}
+		return 0, fmt.Errorf("OpenSCManager: %v", err)
+	}
+	return m, nil
+}
+
+// utf16Ptr returns s for a Windows API; s comes from flags or constants
+// and holds no NUL.
+func utf16Ptr(s string) *uint16 {
+	p, _ := syscall.UTF16PtrFromString(s)
+	return p
+}
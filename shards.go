@@ -0,0 +1,415 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkkemp/GoOCSPResponder/responder"
+)
+
+// RouterConfig shards the issuers of a very large deployment across
+// worker processes. Each worker is an ordinary goocsp restricted to some
+// issuers with issuers:, with its own cache directory, so the indexes of
+// one CA cannot exhaust the memory of another and a crash takes only its
+// own issuers down. goocsp router runs in front of them: it learns which
+// worker serves which issuer from their /api/v1/capabilities and forwards
+// every OCSP request to the worker of its CertIDs. It holds no CRLs and
+// signs nothing. Only goocsp router reads this section.
+type RouterConfig struct {
+	// Shards are the base URLs of the workers, as the router reaches them.
+	// An issuer served by several is routed to the first listed.
+	Shards []string `yaml:"shards"`
+	// Interval is the pause between two refreshes of the issuers of every
+	// worker.
+	Interval time.Duration `yaml:"interval"`
+	// Timeout bounds a request forwarded to a worker.
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+func (c RouterConfig) validate() error {
+	seen := make(map[string]bool)
+	for _, u := range c.Shards {
+		if parsed, err := url.Parse(u); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return fmt.Errorf("router: shard %q must be an http(s) URL", u)
+		}
+		if seen[u] {
+			return fmt.Errorf("router: shard %s is listed twice", u)
+		}
+		seen[u] = true
+	}
+	if c.Interval <= 0 || c.Timeout <= 0 {
+		return errors.New("router.interval and router.timeout must be positive")
+	}
+	return nil
+}
+
+// shard is one worker as the router last saw it.
+type shard struct {
+	URL       string    `json:"url"`
+	CheckedAt time.Time `json:"checked_at"`
+	// Up is false when the last refresh or forwarded request failed.
+	Up    bool   `json:"up"`
+	Error string `json:"error,omitempty"`
+	// Issuers are the CRL names of the issuers routed to the worker.
+	Issuers   []string `json:"issuers"`
+	Forwarded uint64   `json:"forwarded"`
+	Failed    uint64   `json:"failed"`
+
+	// keys are the issuer index keys of the worker's issuers; a worker
+	// that cannot be reached keeps those of its last refresh.
+	keys []string
+}
+
+// shards is the routing table: the workers in configuration order and
+// the shard of every issuer index key.
+var shards = struct {
+	sync.RWMutex
+	list  []*shard
+	byKey map[string]*shard
+}{byKey: make(map[string]*shard)}
+
+// refreshShards fetches the issuers of every worker and rebuilds the
+// routing table.
+func refreshShards(cfg RouterConfig, client *http.Client) {
+	type result struct {
+		caps capabilities
+		err  error
+	}
+	results := make([]result, len(cfg.Shards))
+	var wg sync.WaitGroup
+	for i, u := range cfg.Shards {
+		wg.Add(1)
+		go func(i int, u string) {
+			defer wg.Done()
+			results[i].caps, results[i].err = fetchCapabilities(client, u)
+		}(i, u)
+	}
+	wg.Wait()
+
+	shards.Lock()
+	defer shards.Unlock()
+	prev := make(map[string]*shard, len(shards.list))
+	for _, s := range shards.list {
+		prev[s.URL] = s
+	}
+	list := make([]*shard, len(cfg.Shards))
+	byKey := make(map[string]*shard)
+	for i, u := range cfg.Shards {
+		s := &shard{URL: u, CheckedAt: time.Now()}
+		if p := prev[u]; p != nil {
+			s.Forwarded, s.Failed, s.keys, s.Issuers = p.Forwarded, p.Failed, p.keys, p.Issuers
+		}
+		if err := results[i].err; err != nil {
+			s.Error = err.Error()
+			if p := prev[u]; p == nil || p.Up {
+				log.Printf("router: shard %s: %v", u, err)
+			}
+		} else {
+			s.Up = true
+			s.keys, s.Issuers = shardKeys(u, results[i].caps)
+			if p := prev[u]; p != nil && !p.Up {
+				log.Printf("router: shard %s is back with %d issuers", u, len(s.Issuers))
+			}
+		}
+		for _, k := range s.keys {
+			if other, dup := byKey[k]; dup && other != s {
+				continue
+			}
+			byKey[k] = s
+		}
+		list[i] = s
+	}
+	shards.list, shards.byKey = list, byKey
+}
+
+// shardKeys returns the issuer index keys and CRL names of the issuers a
+// worker described.
+func shardKeys(u string, caps capabilities) (keys, issuers []string) {
+	for _, ci := range caps.Issuers {
+		ca, err := x509.ParseCertificate(ci.Certificate)
+		if err != nil {
+			log.Printf("router: shard %s: issuer %s: %v", u, ci.Issuer, err)
+			continue
+		}
+		keys = append(keys, certIDKeys(ca)...)
+		issuers = append(issuers, ci.Issuer)
+	}
+	sort.Strings(issuers)
+	return keys, issuers
+}
+
+// fetchCapabilities returns what a worker serves.
+func fetchCapabilities(client *http.Client, base string) (capabilities, error) {
+	var caps capabilities
+	resp, err := client.Get(strings.TrimSuffix(base, "/") + "/api/v1/capabilities")
+	if err != nil {
+		return caps, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return caps, fmt.Errorf("%s", resp.Status)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&caps)
+	return caps, err
+}
+
+// shardFor returns the worker serving every CertID of req, or nil when
+// one of them is not served or they are served by different workers.
+func shardFor(req *responder.Request) *shard {
+	shards.RLock()
+	defer shards.RUnlock()
+	var s *shard
+	for _, id := range req.CertIDs {
+		var buf [1 + 2*64]byte
+		t := shards.byKey[string(appendCertIDKey(buf[:0], id.HashAlgorithm, id.NameHash, id.KeyHash))]
+		if t == nil || (s != nil && t != s) {
+			return nil
+		}
+		s = t
+	}
+	return s
+}
+
+// count records the outcome of a forwarded request; a failure marks the
+// worker down until it answers again.
+func (s *shard) count(err error) {
+	shards.Lock()
+	defer shards.Unlock()
+	if err == nil {
+		s.Forwarded++
+		s.Up, s.Error = true, ""
+		return
+	}
+	s.Failed++
+	if s.Up {
+		log.Printf("router: shard %s: %v", s.URL, err)
+	}
+	s.Up, s.Error = false, err.Error()
+}
+
+// forwardedHeaders are the response headers copied from a worker.
+var forwardedHeaders = []string{"Content-Type", "Cache-Control", "Expires", "Last-Modified", "ETag", "Retry-After"}
+
+// routerOCSPHandler forwards an OCSP request to the worker of its
+// CertIDs, on the same path so the worker's routes apply. Requests for
+// issuers no worker serves, or spanning several workers, are answered
+// unauthorized, and those whose worker cannot be reached tryLater.
+func routerOCSPHandler(client *http.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		bufp := bodyPool.Get().(*[]byte)
+		defer bodyPool.Put(bufp)
+		var body []byte
+		var err error
+		switch r.Method {
+		case http.MethodPost:
+			body, err = readBody(r.Body, *bufp)
+		case http.MethodGet:
+			body, err = routerDecodeGET(r.URL.Path, *bufp)
+			if err == responder.ErrNotBase64 {
+				http.NotFound(w, r)
+				return
+			}
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			writeOCSPResponse(w, malformedResponse)
+			return
+		}
+		req, err := responder.ParseRequest(body)
+		if err != nil {
+			writeOCSPResponse(w, malformedResponse)
+			return
+		}
+		s := shardFor(req)
+		if s == nil {
+			writeOCSPResponse(w, unauthResponse)
+			return
+		}
+
+		target := strings.TrimSuffix(s.URL, "/") + r.URL.EscapedPath()
+		var reqBody io.Reader
+		if r.Method == http.MethodPost {
+			reqBody = bytes.NewReader(body)
+		}
+		out, err := http.NewRequestWithContext(r.Context(), r.Method, target, reqBody)
+		if err != nil {
+			writeOCSPResponse(w, malformedResponse)
+			return
+		}
+		if r.Method == http.MethodPost {
+			out.Header.Set("Content-Type", ocspRequestType)
+		}
+		if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+			if prior := r.Header.Get("X-Forwarded-For"); prior != "" {
+				host = prior + ", " + host
+			}
+			out.Header.Set("X-Forwarded-For", host)
+		}
+		resp, err := client.Do(out)
+		if err == nil && resp.StatusCode >= http.StatusInternalServerError {
+			resp.Body.Close()
+			err = fmt.Errorf("%s", resp.Status)
+		}
+		s.count(err)
+		if err != nil {
+			writeOCSPResponse(w, tryLaterResponse)
+			return
+		}
+		defer resp.Body.Close()
+		for _, h := range forwardedHeaders {
+			if v := resp.Header.Get(h); v != "" {
+				w.Header().Set(h, v)
+			}
+		}
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, io.LimitReader(resp.Body, maxRequestSize<<4))
+	}
+}
+
+// routerDecodeGET decodes the request of an OCSP GET path into buf. The
+// router does not know the routes of its workers, so the path is tried
+// without its first segment, as a route, then whole.
+func routerDecodeGET(path string, buf []byte) ([]byte, error) {
+	if _, rest := splitPath(path); rest != "" {
+		if body, err := responder.DecodeGET(rest, buf); err == nil {
+			if _, err := responder.ParseRequest(body); err == nil {
+				return body, nil
+			}
+		}
+	}
+	return responder.DecodeGET(strings.TrimLeft(path, "/"), buf)
+}
+
+// routerStatus is what GET /admin/v1/shards reports.
+type routerStatus struct {
+	Up     int      `json:"up"`
+	Shards []*shard `json:"shards"`
+}
+
+func currentRouterStatus() routerStatus {
+	shards.RLock()
+	defer shards.RUnlock()
+	s := routerStatus{Shards: make([]*shard, 0, len(shards.list))}
+	for _, sh := range shards.list {
+		c := *sh
+		if c.Up {
+			s.Up++
+		}
+		s.Shards = append(s.Shards, &c)
+	}
+	return s
+}
+
+// shardsHandler serves GET /admin/v1/shards on the router.
+func shardsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(currentRouterStatus())
+}
+
+// routerHealthzHandler serves GET /healthz on the router: healthy while
+// at least one worker is up.
+func routerHealthzHandler(w http.ResponseWriter, r *http.Request) {
+	s := currentRouterStatus()
+	w.Header().Set("Content-Type", "application/json")
+	if s.Up == 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(map[string]int{"shards": len(s.Shards), "up": s.Up})
+}
+
+// routerEndpoints are the endpoints of goocsp router.
+func routerEndpoints(client *http.Client) []apiEndpoint {
+	return []apiEndpoint{
+		{
+			Path: "/", Method: "POST", Summary: "Forward an OCSP request, POSTed or as a GET, to the worker serving its issuer.",
+			Request: "application/ocsp-request", Response: "application/ocsp-response",
+			handler: routerOCSPHandler(client),
+		},
+		{
+			Path: "/healthz", Method: "GET", Summary: "Number of workers, and of those up.",
+			Response: "application/json", Codes: map[int]string{503: "no worker is up"},
+			handler: routerHealthzHandler,
+		},
+		{
+			Path: "/admin/v1/shards", Method: "GET", Summary: "Workers, their issuers and the requests forwarded to each.",
+			Role: "operator", Response: "application/json",
+			handler: shardsHandler,
+		},
+	}
+}
+
+// routerCommand runs the router in front of the workers of router.shards.
+func routerCommand(args []string) int {
+	fs := flag.NewFlagSet("router", flag.ContinueOnError)
+	configPath := fs.String("config", "", "YAML configuration with the router section")
+	fs.StringVar(&listenOverride, "listen", "", "address to serve OCSP on instead of the configuration's listen")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: goocsp router --config file [--listen addr]")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 0 || *configPath == "" {
+		fs.Usage()
+		return 2
+	}
+	cfg, err := loadConfig(*configPath)
+	if err == nil && len(cfg.Router.Shards) == 0 {
+		err = fmt.Errorf("%s: router.shards lists no worker", *configPath)
+	}
+	var clients *clientClassifier
+	if err == nil {
+		clients, err = newClientClassifier(cfg.Clients)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "router:", err)
+		return 2
+	}
+	// The admin API authenticates against the configuration of the state.
+	current.Store(&state{cfg: cfg, clients: clients})
+
+	client := &http.Client{
+		Timeout:   cfg.Router.Timeout,
+		Transport: &http.Transport{MaxIdleConnsPerHost: 64, IdleConnTimeout: 90 * time.Second},
+		// Workers answer OCSP themselves; a redirect is a misconfiguration.
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	refreshShards(cfg.Router, client)
+	superviseLoop("shards", func(hb heartbeat) {
+		for hb.sleep(cfg.Router.Interval) {
+			refreshShards(cfg.Router, client)
+		}
+	})
+
+	mux := http.NewServeMux()
+	registerAPI(mux, cfg, routerEndpoints(client))
+	ln, err := listen("router", cfg.Listen)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "router:", err)
+		return 1
+	}
+	if cfg.Clients.ProxyProtocol {
+		ln = proxyProtocolListener(ln)
+	}
+	fmt.Fprintln(os.Stderr, "router:", http.Serve(ln, mux))
+	return 1
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"crypto/x509"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/pkkemp/GoOCSPResponder/responder"
+)
+
+// SignedRequestsConfig sets up a second listener on which every OCSP
+// request must be signed (RFC 6960 4.1.2). Client classes that are required
+// to sign their requests are pointed at it; the main listener keeps
+// accepting unsigned requests.
+type SignedRequestsConfig struct {
+	// Listen is the address of the signed request listener; empty
+	// disables it. Like Listen and Workers, it is read at startup only.
+	Listen string `yaml:"listen"`
+	// TrustStore is a PEM file of the CA certificates, or pinned requestor
+	// certificates, that requestor certificates must chain to.
+	TrustStore string `yaml:"trust_store"`
+	// Workers is the number of request signatures verified at once.
+	Workers int `yaml:"workers"`
+	// QueueWait is how long a request waits for a worker before it is
+	// answered with tryLater.
+	QueueWait time.Duration `yaml:"queue_wait"`
+}
+
+var (
+	sigRequiredResponse = responder.ErrorResponse(responder.SignatureRequired)
+
+	errVerifyBusy = errors.New("no signature verification worker available")
+)
+
+type verifyJob struct {
+	req   *responder.Request
+	roots *x509.CertPool
+	at    time.Time
+	done  chan verifyResult
+}
+
+type verifyResult struct {
+	requestor *x509.Certificate
+	err       error
+}
+
+// verifyPool verifies request signatures on a fixed set of workers, so a
+// flood of signed requests costs at most that many CPUs and the rest are
+// turned away rather than queued without bound.
+type verifyPool struct {
+	jobs chan verifyJob
+	wait time.Duration
+}
+
+func newVerifyPool(cfg SignedRequestsConfig) *verifyPool {
+	p := &verifyPool{jobs: make(chan verifyJob), wait: cfg.QueueWait}
+	for i := 0; i < cfg.Workers; i++ {
+		go func() {
+			for job := range p.jobs {
+				requestor, err := responder.VerifyRequest(job.req, job.roots, job.at)
+				job.done <- verifyResult{requestor, err}
+			}
+		}()
+	}
+	return p
+}
+
+// verify hands req to a worker and waits for the result. It returns
+// errVerifyBusy if no worker picks the request up within the queue wait.
+func (p *verifyPool) verify(req *responder.Request, roots *x509.CertPool, at time.Time) (*x509.Certificate, error) {
+	job := verifyJob{req: req, roots: roots, at: at, done: make(chan verifyResult, 1)}
+	timer := time.NewTimer(p.wait)
+	defer timer.Stop()
+	select {
+	case p.jobs <- job:
+	case <-timer.C:
+		return nil, errVerifyBusy
+	}
+	res := <-job.done
+	return res.requestor, res.err
+}
+
+// signedOCSPHandler answers POSTed OCSP requests on the signed request
+// listener. Unsigned requests get sigRequired and requests whose signature
+// does not verify against the trust store get unauthorized. Responses to
+// signed requests are never cached.
+func signedOCSPHandler(pool *verifyPool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.NotFound(w, r)
+			return
+		}
+		bufp := bodyPool.Get().(*[]byte)
+		defer bodyPool.Put(bufp)
+		body, err := readBody(r.Body, *bufp)
+		if err != nil {
+			writeOCSPResponse(w, malformedResponse)
+			return
+		}
+		req, err := responder.ParseRequest(body)
+		if err != nil {
+			writeOCSPResponse(w, malformedResponse)
+			return
+		}
+		if !req.Signed() {
+			writeOCSPResponse(w, sigRequiredResponse)
+			return
+		}
+		st := currentState()
+		if st.requestors == nil {
+			writeOCSPResponse(w, unauthResponse)
+			return
+		}
+		if st.cfg.FIPS {
+			if err := fipsApprovedSignature(req.SignatureAlgorithm); err != nil {
+				log.Printf("signed request from %s rejected: %v", clientAddr(r), err)
+				writeOCSPResponse(w, unauthResponse)
+				return
+			}
+		}
+		now := time.Now()
+		requestor, err := pool.verify(req, st.requestors, now)
+		if err == nil && st.cfg.FIPS {
+			err = fipsApprovedKey(requestor.PublicKey)
+		}
+		switch {
+		case err == errVerifyBusy:
+			writeOCSPResponse(w, tryLaterResponse)
+			return
+		case err != nil:
+			log.Printf("signed request from %s rejected: %v", clientAddr(r), err)
+			writeOCSPResponse(w, unauthResponse)
+			return
+		}
+		st.respond(w, nil, req, "", 0, now)
+	}
+}
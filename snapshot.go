@@ -0,0 +1,458 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// A snapshot holds the indexes of a whole cache in one file, to be copied
+// between nodes and kept across upgrades. It is a fixed header followed by
+// checksummed sections. All integers are big endian; times are Unix
+// seconds.
+//
+//	header (16 bytes)
+//	  0  magic "GOCSPSNP"
+//	  8  major version
+//	 10  minor version
+//	 12  CRC-32C of bytes 0-11
+//	section
+//	  0  type
+//	  2  flags: bit 0 marks the section critical; the others are written 0
+//	  4  payload length
+//	  8  payload
+//	     CRC-32C of the type, flags, length and payload
+//
+// Version 1.0 has three section types, all critical:
+//
+//	1  issuer table, exactly one, before any entry block:
+//	     creation time, issuer count (4 bytes), then per issuer its length
+//	     (2 bytes), CRL name length (2 bytes) and CRL name, the 96-byte
+//	     header of its on-disk index and the SHA-256 of that index
+//	2  entry block: issuer number (4 bytes, from 0 in table order), number
+//	     of the block's first record (8 bytes), then up to
+//	     snapshotBlockRecords records of the issuer's on-disk index
+//	0xFFFF  end: the SHA-256 of every byte before the section; nothing
+//	     follows it
+//
+// An issuer's blocks follow one another in record order, and the issuers'
+// in table order; the index header and the records of all its blocks are
+// the on-disk index of diskindex.go, byte for byte. So a snapshot is
+// checked section by section as it is read, and in full by the end
+// section, and corruption or truncation anywhere is caught.
+//
+// Forward compatibility: a reader accepts every minor version of its major
+// version. Later minor versions may add section types, and append fields
+// to the issuer table, to its entries and to the end section; readers skip
+// the sections they do not know unless they are critical, and ignore the
+// bytes past the fields they know. A new critical section type, or any
+// other change, is a new major version, which older readers refuse.
+const (
+	snapshotMagic        = "GOCSPSNP"
+	snapshotMajor        = 1
+	snapshotMinor        = 0
+	snapshotHeaderSize   = 16
+	snapshotBlockRecords = 1 << 16
+
+	sectionIssuers = 1
+	sectionEntries = 2
+	sectionEnd     = 0xFFFF
+
+	sectionCritical = 1
+)
+
+// snapshotIssuer is one issuer of a snapshot.
+type snapshotIssuer struct {
+	Key     string
+	Entries int
+	// index is the issuer's on-disk index, and indexHash its SHA-256.
+	index     []byte
+	indexHash [sha256.Size]byte
+}
+
+// snapshot is a decoded snapshot.
+type snapshot struct {
+	Major, Minor int
+	CreatedAt    time.Time
+	Issuers      []snapshotIssuer
+	// Skipped counts the sections of a later minor version that were
+	// skipped.
+	Skipped int
+}
+
+// snapshotWriter writes a snapshot, keeping the SHA-256 of the end
+// section.
+type snapshotWriter struct {
+	w   io.Writer
+	sum io.Writer
+	err error
+}
+
+func (sw *snapshotWriter) write(b []byte) {
+	if sw.err == nil {
+		_, sw.err = sw.w.Write(b)
+		sw.sum.Write(b)
+	}
+}
+
+func (sw *snapshotWriter) section(typ uint16, payload []byte) {
+	var head [8]byte
+	binary.BigEndian.PutUint16(head[0:], typ)
+	binary.BigEndian.PutUint16(head[2:], sectionCritical)
+	binary.BigEndian.PutUint32(head[4:], uint32(len(payload)))
+	crc := crc32.Update(crc32.Checksum(head[:], castagnoli), castagnoli, payload)
+	sw.write(head[:])
+	sw.write(payload)
+	sw.write(appendUint32(nil, crc))
+}
+
+// writeSnapshot writes the on-disk indexes of the issuers by CRL name to
+// w, in name order.
+func writeSnapshot(w io.Writer, indexes map[string][]byte, createdAt time.Time) error {
+	keys := make([]string, 0, len(indexes))
+	for k := range indexes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	h := sha256.New()
+	sw := &snapshotWriter{w: w, sum: h}
+	head := make([]byte, snapshotHeaderSize)
+	copy(head, snapshotMagic)
+	binary.BigEndian.PutUint16(head[8:], snapshotMajor)
+	binary.BigEndian.PutUint16(head[10:], snapshotMinor)
+	binary.BigEndian.PutUint32(head[12:], crc32.Checksum(head[:12], castagnoli))
+	sw.write(head)
+
+	table := appendUint64(nil, uint64(createdAt.Unix()))
+	table = appendUint32(table, uint32(len(keys)))
+	for _, k := range keys {
+		idx := indexes[k]
+		if len(idx) < indexHeaderSize || len(k) > 0xFFFF {
+			return fmt.Errorf("snapshot: bad index for %s", k)
+		}
+		sum := sha256.Sum256(idx)
+		table = appendUint16(table, uint16(2+len(k)+indexHeaderSize+len(sum)))
+		table = appendUint16(table, uint16(len(k)))
+		table = append(table, k...)
+		table = append(table, idx[:indexHeaderSize]...)
+		table = append(table, sum[:]...)
+	}
+	sw.section(sectionIssuers, table)
+
+	for i, k := range keys {
+		records := indexes[k][indexHeaderSize:]
+		for first := 0; first*indexRecordSize < len(records); first += snapshotBlockRecords {
+			end := (first + snapshotBlockRecords) * indexRecordSize
+			if end > len(records) {
+				end = len(records)
+			}
+			block := appendUint32(nil, uint32(i))
+			block = appendUint64(block, uint64(first))
+			block = append(block, records[first*indexRecordSize:end]...)
+			sw.section(sectionEntries, block)
+		}
+	}
+	sw.section(sectionEnd, h.Sum(nil))
+	return sw.err
+}
+
+// errSnapshotVersion is returned for snapshots of another major version.
+var errSnapshotVersion = errors.New("snapshot: unsupported major version")
+
+// readSnapshot decodes and checks a snapshot: every checksum, the order of
+// the sections and of the records, and the SHA-256 of every issuer's
+// index.
+func readSnapshot(data []byte) (*snapshot, error) {
+	if len(data) < snapshotHeaderSize || string(data[:8]) != snapshotMagic {
+		return nil, errors.New("snapshot: not a snapshot file")
+	}
+	if crc32.Checksum(data[:12], castagnoli) != binary.BigEndian.Uint32(data[12:]) {
+		return nil, errors.New("snapshot: header checksum mismatch")
+	}
+	s := &snapshot{Major: int(binary.BigEndian.Uint16(data[8:])), Minor: int(binary.BigEndian.Uint16(data[10:]))}
+	if s.Major != snapshotMajor {
+		return nil, fmt.Errorf("%w %d.%d (this goocsp reads %d.x)", errSnapshotVersion, s.Major, s.Minor, snapshotMajor)
+	}
+	var (
+		tableSeen bool
+		current   = -1
+		pos       = snapshotHeaderSize
+	)
+	for {
+		if len(data)-pos < 12 {
+			return nil, fmt.Errorf("snapshot: offset %d: truncated", pos)
+		}
+		typ := binary.BigEndian.Uint16(data[pos:])
+		flags := binary.BigEndian.Uint16(data[pos+2:])
+		n := int(binary.BigEndian.Uint32(data[pos+4:]))
+		if n > len(data)-pos-12 {
+			return nil, fmt.Errorf("snapshot: offset %d: section %d overruns the file", pos, typ)
+		}
+		payload := data[pos+8 : pos+8+n]
+		if crc32.Checksum(data[pos:pos+8+n], castagnoli) != binary.BigEndian.Uint32(data[pos+8+n:]) {
+			return nil, fmt.Errorf("snapshot: offset %d: section %d checksum mismatch", pos, typ)
+		}
+		var err error
+		switch {
+		case typ == sectionEnd:
+			if sum := sha256.Sum256(data[:pos]); len(payload) < sha256.Size || !bytes.Equal(payload[:sha256.Size], sum[:]) {
+				return nil, fmt.Errorf("snapshot: offset %d: SHA-256 mismatch", pos)
+			}
+			if pos+12+n != len(data) {
+				return nil, fmt.Errorf("snapshot: offset %d: data after the end section", pos+12+n)
+			}
+			if !tableSeen {
+				return nil, errors.New("snapshot: no issuer table")
+			}
+			if current < 0 {
+				current = 0
+			}
+			return s, s.checkIssuers(current, len(s.Issuers))
+		case typ == sectionIssuers:
+			if tableSeen {
+				err = errors.New("a second issuer table")
+			} else {
+				tableSeen = true
+				err = s.readIssuerTable(payload)
+			}
+		case typ == sectionEntries:
+			if !tableSeen {
+				err = errors.New("entries before the issuer table")
+			} else {
+				current, err = s.readEntries(payload, current)
+			}
+		case flags&sectionCritical != 0:
+			err = fmt.Errorf("critical section %d is unknown; a newer goocsp wrote this snapshot", typ)
+		default:
+			s.Skipped++
+		}
+		if err != nil {
+			return nil, fmt.Errorf("snapshot: offset %d: %v", pos, err)
+		}
+		pos += 12 + n
+	}
+}
+
+func (s *snapshot) readIssuerTable(p []byte) error {
+	if len(p) < 12 {
+		return errors.New("short issuer table")
+	}
+	s.CreatedAt = time.Unix(int64(binary.BigEndian.Uint64(p)), 0).UTC()
+	count := int(binary.BigEndian.Uint32(p[8:]))
+	p = p[12:]
+	for i := 0; i < count; i++ {
+		if len(p) < 2 || int(binary.BigEndian.Uint16(p)) > len(p)-2 {
+			return fmt.Errorf("issuer %d: truncated", i)
+		}
+		entry := p[2 : 2+int(binary.BigEndian.Uint16(p))]
+		p = p[2+len(entry):]
+		if len(entry) < 2 {
+			return fmt.Errorf("issuer %d: truncated", i)
+		}
+		k := int(binary.BigEndian.Uint16(entry))
+		if len(entry) < 2+k+indexHeaderSize+sha256.Size {
+			return fmt.Errorf("issuer %d: truncated", i)
+		}
+		iss := snapshotIssuer{Key: string(entry[2 : 2+k])}
+		head := entry[2+k : 2+k+indexHeaderSize]
+		if string(head[:8]) != indexMagic {
+			return fmt.Errorf("issuer %s: index format %q, want %s", iss.Key, head[:8], indexMagic)
+		}
+		iss.Entries = int(binary.BigEndian.Uint64(head[8:]))
+		if iss.Entries < 0 || iss.Entries > maxSnapshotEntries {
+			return fmt.Errorf("issuer %s: %d entries", iss.Key, iss.Entries)
+		}
+		iss.index = append(make([]byte, 0, indexHeaderSize+iss.Entries*indexRecordSize), head...)
+		copy(iss.indexHash[:], entry[2+k+indexHeaderSize:])
+		if i > 0 && s.Issuers[i-1].Key >= iss.Key {
+			return fmt.Errorf("issuer %s: out of order", iss.Key)
+		}
+		s.Issuers = append(s.Issuers, iss)
+	}
+	return nil
+}
+
+// maxSnapshotEntries bounds the entries of one issuer, well above any CRL,
+// so a corrupt count cannot make the reader allocate without bound.
+const maxSnapshotEntries = 1 << 31 / indexRecordSize
+
+// readEntries appends an entry block to its issuer; current is the issuer
+// of the previous block, -1 for none. The issuers before the block's are
+// complete and checked.
+func (s *snapshot) readEntries(p []byte, current int) (int, error) {
+	if len(p) < 12 || (len(p)-12)%indexRecordSize != 0 || len(p)-12 > snapshotBlockRecords*indexRecordSize {
+		return current, errors.New("malformed entry block")
+	}
+	i := int(binary.BigEndian.Uint32(p))
+	first := binary.BigEndian.Uint64(p[4:])
+	if i < current || i >= len(s.Issuers) {
+		return current, fmt.Errorf("entry block of issuer %d out of order", i)
+	}
+	if i != current {
+		from := current
+		if from < 0 {
+			from = 0
+		}
+		if err := s.checkIssuers(from, i); err != nil {
+			return current, err
+		}
+	}
+	iss := &s.Issuers[i]
+	have := (len(iss.index) - indexHeaderSize) / indexRecordSize
+	if first != uint64(have) {
+		return current, fmt.Errorf("issuer %s: block starts at record %d, want %d", iss.Key, first, have)
+	}
+	if have+(len(p)-12)/indexRecordSize > iss.Entries {
+		return current, fmt.Errorf("issuer %s: more than %d records", iss.Key, iss.Entries)
+	}
+	iss.index = append(iss.index, p[12:]...)
+	return i, nil
+}
+
+// checkIssuers checks the indexes of issuers from to to-1, whose blocks
+// have all been read.
+func (s *snapshot) checkIssuers(from, to int) error {
+	for _, iss := range s.Issuers[from:to] {
+		if n := (len(iss.index) - indexHeaderSize) / indexRecordSize; n != iss.Entries {
+			return fmt.Errorf("issuer %s: %d records, want %d", iss.Key, n, iss.Entries)
+		}
+		if sha256.Sum256(iss.index) != iss.indexHash {
+			return fmt.Errorf("issuer %s: index SHA-256 mismatch", iss.Key)
+		}
+		records := iss.index[indexHeaderSize:]
+		for r := indexRecordSize; r < len(records); r += indexRecordSize {
+			if bytes.Compare(records[r-indexRecordSize:r-indexRecordSize+indexHashSize], records[r:r+indexHashSize]) >= 0 {
+				return fmt.Errorf("issuer %s: records out of order at %d", iss.Key, r/indexRecordSize)
+			}
+		}
+	}
+	return nil
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	return appendUint32(appendUint32(b, uint32(v>>32)), uint32(v))
+}
+
+// cacheIndexes builds the on-disk index of every CRL in dir, by CRL name,
+// as cacheManifest does.
+func cacheIndexes(dir string) (map[string][]byte, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.crl"))
+	if err != nil {
+		return nil, err
+	}
+	indexes := make(map[string][]byte, len(paths))
+	for _, path := range paths {
+		crlHash, err := hashFile(path)
+		if err != nil {
+			return nil, err
+		}
+		scanned, err := scanCRLFile(path)
+		if err != nil {
+			return nil, err
+		}
+		idx, err := encodeIndex(scanned, crlHash, nil)
+		if err != nil {
+			return nil, err
+		}
+		indexes[CRLInfo{FileName: filepath.Base(path)}.key()] = idx
+	}
+	return indexes, nil
+}
+
+// snapshotCommand writes the indexes of a cache directory to a snapshot,
+// or checks snapshots.
+func snapshotCommand(args []string) int {
+	fs := flag.NewFlagSet("snapshot", flag.ContinueOnError)
+	cache := fs.String("cache", rootDir, "CRL cache directory to snapshot")
+	out := fs.String("out", "", "snapshot file to write; standard output by default")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: goocsp snapshot create [--cache dir] [--out file]")
+		fmt.Fprintln(fs.Output(), "       goocsp snapshot validate file...")
+		fs.PrintDefaults()
+	}
+	if len(args) == 0 {
+		fs.Usage()
+		return 2
+	}
+	action := args[0]
+	if err := fs.Parse(args[1:]); err != nil {
+		return 2
+	}
+	switch {
+	case action == "create" && fs.NArg() == 0:
+		indexes, err := cacheIndexes(*cache)
+		if err == nil && len(indexes) == 0 {
+			err = fmt.Errorf("no CRLs in %s", *cache)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "snapshot:", err)
+			return 1
+		}
+		var buf bytes.Buffer
+		if err := writeSnapshot(&buf, indexes, time.Now()); err != nil {
+			fmt.Fprintln(os.Stderr, "snapshot:", err)
+			return 1
+		}
+		if *out == "" {
+			os.Stdout.Write(buf.Bytes())
+			return 0
+		}
+		tmp := *out + ".tmp"
+		err = os.WriteFile(tmp, buf.Bytes(), 0o644)
+		if err == nil {
+			err = os.Rename(tmp, *out)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "snapshot:", err)
+			return 1
+		}
+		fmt.Fprintf(os.Stderr, "Wrote %s: %d issuers, %d bytes\n", *out, len(indexes), buf.Len())
+		return 0
+	case action == "validate" && fs.NArg() > 0:
+		status := 0
+		for _, path := range fs.Args() {
+			data, err := os.ReadFile(path)
+			var s *snapshot
+			if err == nil {
+				s, err = readSnapshot(data)
+			}
+			if err != nil {
+				fmt.Printf("%s: INVALID: %v\n", path, err)
+				status = 1
+				continue
+			}
+			entries := 0
+			for _, iss := range s.Issuers {
+				entries += iss.Entries
+			}
+			fmt.Printf("%s: OK: version %d.%d, created %s, %d issuers, %d entries\n", path, s.Major, s.Minor, s.CreatedAt.Format(time.RFC3339), len(s.Issuers), entries)
+			if s.Skipped > 0 {
+				fmt.Printf("  %d sections of a later version skipped\n", s.Skipped)
+			}
+			for _, iss := range s.Issuers {
+				fmt.Printf("  %-32s %8d entries  index %x\n", iss.Key, iss.Entries, iss.indexHash[:8])
+			}
+		}
+		return status
+	}
+	fs.Usage()
+	return 2
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkkemp/GoOCSPResponder/responder"
+)
+
+// testSnapshot returns a snapshot of the indexes of two CRLs, by CRL name.
+func testSnapshot(t *testing.T, createdAt time.Time) ([]byte, map[string][]byte) {
+	t.Helper()
+	indexes := make(map[string][]byte)
+	for i, name := range []string{"SNAPSHOTCA_2", "SNAPSHOTCA_1"} {
+		ca := testCA(t, name, createdAt.Add(-time.Hour), createdAt.Add(time.Hour))
+		var entries []x509.RevocationListEntry
+		for s := int64(1); s <= int64(10*(i+1)); s++ {
+			entries = append(entries, x509.RevocationListEntry{SerialNumber: big.NewInt(s * 0x101), RevocationTime: createdAt})
+		}
+		der := signTestCRL(t, ca, 1, createdAt, entries...)
+		scanned, err := responder.ScanCRL(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+		idx, err := encodeIndex(scanned, sha256.Sum256(der), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		indexes[name] = idx
+	}
+	var buf bytes.Buffer
+	if err := writeSnapshot(&buf, indexes, createdAt); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes(), indexes
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	createdAt := time.Now().UTC().Truncate(time.Second)
+	data, indexes := testSnapshot(t, createdAt)
+	s, err := readSnapshot(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Major != snapshotMajor || s.Minor != snapshotMinor || !s.CreatedAt.Equal(createdAt) || s.Skipped != 0 {
+		t.Errorf("read version %d.%d of %v, %d skipped", s.Major, s.Minor, s.CreatedAt, s.Skipped)
+	}
+	if len(s.Issuers) != 2 || s.Issuers[0].Key != "SNAPSHOTCA_1" || s.Issuers[1].Key != "SNAPSHOTCA_2" {
+		t.Fatalf("read issuers %+v, want both in name order", s.Issuers)
+	}
+	for _, iss := range s.Issuers {
+		if !bytes.Equal(iss.index, indexes[iss.Key]) {
+			t.Errorf("%s: the index read back differs from the one written", iss.Key)
+		}
+	}
+}
+
+func TestReadSnapshotRefuses(t *testing.T) {
+	data, _ := testSnapshot(t, time.Now())
+	corrupt := func(at int) []byte {
+		b := append([]byte(nil), data...)
+		b[at] ^= 1
+		return b
+	}
+	otherMajor := append([]byte(nil), data...)
+	binary.BigEndian.PutUint16(otherMajor[8:], snapshotMajor+1)
+	binary.BigEndian.PutUint32(otherMajor[12:], crc32.Checksum(otherMajor[:12], castagnoli))
+
+	for name, tc := range map[string]struct {
+		data []byte
+		want string
+	}{
+		"empty":           {nil, "not a snapshot"},
+		"header":          {corrupt(9), "header checksum mismatch"},
+		"issuer table":    {corrupt(snapshotHeaderSize + 20), "section 1 checksum mismatch"},
+		"entry block":     {corrupt(len(data) / 2), "checksum mismatch"},
+		"section length":  {corrupt(snapshotHeaderSize + 5), "section 1"},
+		"truncated":       {data[:len(data)-1], "overruns the file"},
+		"trailing bytes":  {append(append([]byte(nil), data...), 0), "data after the end section"},
+		"major version 2": {otherMajor, "unsupported major version"},
+	} {
+		_, err := readSnapshot(tc.data)
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: got %v, want %q", name, err, tc.want)
+		}
+		if name == "major version 2" && !errors.Is(err, errSnapshotVersion) {
+			t.Errorf("%s: %v is not errSnapshotVersion", name, err)
+		}
+	}
+}
@@ -0,0 +1,724 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkkemp/GoOCSPResponder/responder"
+)
+
+// StandbyConfig pairs a primary with warm standbys. The primary streams
+// every CRL it installs and every response it signs to its standbys, which
+// index the same CRLs and cache the same responses but do not answer until
+// promoted; a promoted standby serves from the state it already holds, so
+// failing over takes no downloads or signing. It is read at startup only.
+type StandbyConfig struct {
+	// Role is primary or standby; empty disables streaming.
+	Role string `yaml:"role"`
+	// Listen is where a primary serves the stream, gRPC over TLS.
+	Listen string `yaml:"listen"`
+	// Primary is the host:port of the primary's stream, for a standby.
+	Primary string `yaml:"primary"`
+	// TLS is this side's certificate; the peer's must chain to CA. Both
+	// sides are authenticated.
+	TLS StandbyTLSConfig `yaml:"tls"`
+	// PromoteAfter promotes a standby by itself once it has not heard from
+	// the primary for this long. 0 leaves promotion to POST
+	// /admin/v1/promote.
+	PromoteAfter time.Duration `yaml:"promote_after"`
+}
+
+// StandbyTLSConfig names the PEM files of one side of the stream.
+type StandbyTLSConfig struct {
+	Cert string `yaml:"cert"`
+	Key  string `yaml:"key"`
+	CA   string `yaml:"ca"`
+	// Policy replaces tls_policy for both sides of the stream; see
+	// tlspolicy.go.
+	Policy *TLSPolicy `yaml:"policy"`
+}
+
+func (c StandbyConfig) validate() error {
+	switch c.Role {
+	case "":
+		return nil
+	case "primary":
+		if c.Listen == "" {
+			return errors.New("standby: a primary requires listen")
+		}
+	case "standby":
+		if c.Primary == "" {
+			return errors.New("standby: a standby requires primary")
+		}
+	default:
+		return fmt.Errorf("standby: unknown role %q (want primary or standby)", c.Role)
+	}
+	if c.TLS.Cert == "" || c.TLS.Key == "" || c.TLS.CA == "" {
+		return errors.New("standby: tls.cert, tls.key and tls.ca are required")
+	}
+	if c.PromoteAfter < 0 {
+		return errors.New("standby: promote_after must not be negative")
+	}
+	if c.TLS.Policy != nil {
+		if err := c.TLS.Policy.validate("standby.tls.policy"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tlsConfig loads both sides' common TLS settings onto tc.
+func (c StandbyTLSConfig) tlsConfig(tc *tls.Config) (*tls.Config, *x509.CertPool, error) {
+	cert, err := tls.LoadX509KeyPair(c.Cert, c.Key)
+	if err != nil {
+		return nil, nil, err
+	}
+	cas, err := readCertificates(c.CA)
+	if err != nil {
+		return nil, nil, err
+	}
+	pool := x509.NewCertPool()
+	for _, ca := range cas {
+		pool.AddCert(ca)
+	}
+	tc.Certificates = []tls.Certificate{cert}
+	return tc, pool, nil
+}
+
+// standbyProto is the stream's gRPC service, whose messages are encoded by
+// hand below. It is served at /docs/standby.proto.
+const standbyProto = `syntax = "proto3";
+
+package goocsp.standby.v1;
+
+service Standby {
+  // Stream sends a snapshot of the primary's CRLs and cached responses,
+  // then every update as it happens, until the standby disconnects.
+  rpc Stream(StreamRequest) returns (stream Update);
+}
+
+message StreamRequest {
+  string name = 1;
+}
+
+message Update {
+  CRL crl = 1;
+  CachedResponse response = 2;
+  int64 heartbeat = 3;   // Unix nanoseconds
+  bool synced = 4;       // the initial snapshot is complete
+}
+
+message CRL {
+  string file_name = 1;
+  bytes der = 2;
+}
+
+message CachedResponse {
+  string issuer = 1;
+  bytes request = 2;
+  bytes response = 3;
+  int64 expires = 4;     // Unix nanoseconds
+  bytes crl_sha256 = 5;  // of the CRL the response was derived from
+  bytes next_response = 6;  // signed with signer.next, during a migration
+}
+`
+
+const (
+	standbyMethod = "/goocsp.standby.v1.Standby/Stream"
+	// standbyHeartbeat is how often an idle primary proves it is alive,
+	// and standbyTimeout how long a standby waits before reconnecting.
+	standbyHeartbeat = 250 * time.Millisecond
+	standbyTimeout   = time.Second
+	// standbyMaxMessage bounds one message, which may carry a whole CRL.
+	standbyMaxMessage = 512 << 20
+)
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	return append(b, tmp[:binary.PutUvarint(tmp[:], v)]...)
+}
+
+// protoBytes appends a length-delimited field.
+func protoBytes(b []byte, field int, v []byte) []byte {
+	b = appendUvarint(b, uint64(field)<<3|2)
+	b = appendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+// protoVarint appends a varint field.
+func protoVarint(b []byte, field int, v uint64) []byte {
+	b = appendUvarint(b, uint64(field)<<3)
+	return appendUvarint(b, v)
+}
+
+// protoFields calls fn with each field of the message b: varints with
+// their value, length-delimited fields with their contents. Fixed-width
+// fields are skipped.
+func protoFields(b []byte, fn func(field int, v uint64, data []byte)) error {
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return errors.New("malformed protobuf")
+		}
+		b = b[n:]
+		field := int(key >> 3)
+		switch key & 7 {
+		case 0:
+			v, n := binary.Uvarint(b)
+			if n <= 0 {
+				return errors.New("malformed protobuf")
+			}
+			b = b[n:]
+			fn(field, v, nil)
+		case 1, 5:
+			size := 8
+			if key&7 == 5 {
+				size = 4
+			}
+			if len(b) < size {
+				return errors.New("malformed protobuf")
+			}
+			b = b[size:]
+		case 2:
+			l, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < l {
+				return errors.New("malformed protobuf")
+			}
+			fn(field, 0, b[n:n+int(l)])
+			b = b[n+int(l):]
+		default:
+			return fmt.Errorf("unsupported protobuf wire type %d", key&7)
+		}
+	}
+	return nil
+}
+
+// writeGRPCMessage writes msg as one length-prefixed gRPC message.
+func writeGRPCMessage(w io.Writer, msg []byte) error {
+	var prefix [5]byte
+	binary.BigEndian.PutUint32(prefix[1:], uint32(len(msg)))
+	if _, err := w.Write(prefix[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(msg)
+	return err
+}
+
+// readGRPCMessage reads one length-prefixed gRPC message.
+func readGRPCMessage(r io.Reader) ([]byte, error) {
+	var prefix [5]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		return nil, err
+	}
+	if prefix[0] != 0 {
+		return nil, errors.New("compressed gRPC messages are not supported")
+	}
+	n := binary.BigEndian.Uint32(prefix[1:])
+	if n > standbyMaxMessage {
+		return nil, fmt.Errorf("gRPC message of %d bytes is too large", n)
+	}
+	msg := make([]byte, n)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func crlUpdate(fileName string, der []byte) []byte {
+	crl := protoBytes(nil, 1, []byte(fileName))
+	crl = protoBytes(crl, 2, der)
+	return protoBytes(nil, 1, crl)
+}
+
+func responseUpdate(issuer string, req []byte, e *cachedResponse, crlHash []byte) []byte {
+	r := protoBytes(nil, 1, []byte(issuer))
+	r = protoBytes(r, 2, req)
+	r = protoBytes(r, 3, e.der)
+	r = protoVarint(r, 4, uint64(e.expires.UnixNano()))
+	r = protoBytes(r, 5, crlHash)
+	if e.next != nil {
+		r = protoBytes(r, 6, e.next)
+	}
+	return protoBytes(nil, 2, r)
+}
+
+// standbyHub fans the primary's updates out to connected standbys.
+type standbyHub struct {
+	mu   sync.Mutex
+	subs map[*standbySub]bool
+	// n is the number of subscribers, read without the lock so the slow
+	// path does not encode updates nobody receives.
+	n int32
+}
+
+type standbySub struct {
+	updates chan []byte
+	// dropped is closed when the standby fell too far behind; it
+	// reconnects and starts over from a snapshot.
+	dropped chan struct{}
+}
+
+var standbyStreams standbyHub
+
+func (h *standbyHub) subscribe() *standbySub {
+	s := &standbySub{updates: make(chan []byte, 8192), dropped: make(chan struct{})}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.subs == nil {
+		h.subs = make(map[*standbySub]bool)
+	}
+	h.subs[s] = true
+	atomic.AddInt32(&h.n, 1)
+	return s
+}
+
+func (h *standbyHub) unsubscribe(s *standbySub) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.subs[s] {
+		delete(h.subs, s)
+		atomic.AddInt32(&h.n, -1)
+	}
+}
+
+func (h *standbyHub) send(msg []byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for s := range h.subs {
+		select {
+		case s.updates <- msg:
+		default:
+			close(s.dropped)
+			delete(h.subs, s)
+			atomic.AddInt32(&h.n, -1)
+		}
+	}
+}
+
+// publishCRL streams the cached CRL behind crl to the standbys.
+func (h *standbyHub) publishCRL(crl CRLInfo) {
+	if atomic.LoadInt32(&h.n) == 0 {
+		return
+	}
+	der, err := os.ReadFile(rootDir + crl.FileName)
+	if err != nil {
+		log.Printf("standby: %v", err)
+		return
+	}
+	h.send(crlUpdate(crl.FileName, der))
+}
+
+// publishResponse streams a response st just cached to the standbys.
+func (h *standbyHub) publishResponse(st *state, req []byte, e *cachedResponse) {
+	if atomic.LoadInt32(&h.n) == 0 {
+		return
+	}
+	f := st.filters[e.issuer]
+	h.send(responseUpdate(e.issuer, req, e, f.crlHash[:]))
+}
+
+// serveStandbyStream serves the primary's stream on ln under the TLS
+// policy policy. Standbys must present a certificate that chains to tls.ca.
+func serveStandbyStream(ln net.Listener, cfg StandbyConfig, policy TLSPolicy) error {
+	tc, err := serverTLSConfig("standby", policy)
+	if err != nil {
+		return fmt.Errorf("standby: %v", err)
+	}
+	tc, pool, err := cfg.TLS.tlsConfig(tc)
+	if err != nil {
+		return fmt.Errorf("standby: %v", err)
+	}
+	tc.ClientAuth = tls.RequireAndVerifyClientCert
+	tc.ClientCAs = pool
+	mux := http.NewServeMux()
+	mux.HandleFunc(standbyMethod, standbyStreamHandler)
+	srv := &http.Server{Handler: mux, TLSConfig: tc}
+	return srv.ServeTLS(ln, "", "")
+}
+
+// standbyStreamHandler serves one standby: a snapshot of every CRL and
+// cached response, then each update as it happens, with heartbeats in
+// between.
+func standbyStreamHandler(w http.ResponseWriter, r *http.Request) {
+	if r.ProtoMajor != 2 || r.Header.Get("Content-Type") != "application/grpc" {
+		http.Error(w, "gRPC over HTTP/2 only", http.StatusUnsupportedMediaType)
+		return
+	}
+	msg, err := readGRPCMessage(r.Body)
+	if err != nil {
+		grpcStatus(w, 3, err.Error())
+		return
+	}
+	name := r.TLS.PeerCertificates[0].Subject.CommonName
+	protoFields(msg, func(field int, _ uint64, data []byte) {
+		if field == 1 && len(data) > 0 {
+			name = string(data)
+		}
+	})
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		grpcStatus(w, 13, "streaming unsupported")
+		return
+	}
+
+	// Subscribe before the snapshot, so no update falls in between; the
+	// standby applies a repeated one harmlessly.
+	sub := standbyStreams.subscribe()
+	defer standbyStreams.unsubscribe(sub)
+	log.Printf("standby %s connected from %s", printableName(name), clientAddr(r))
+
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+	w.WriteHeader(http.StatusOK)
+	status, reason := 0, ""
+	defer func() {
+		w.Header().Set("Grpc-Status", strconv.Itoa(status))
+		w.Header().Set("Grpc-Message", reason)
+		log.Printf("standby %s disconnected: %s", printableName(name), reason)
+	}()
+	write := func(msg []byte) bool {
+		if err := writeGRPCMessage(w, msg); err != nil {
+			status, reason = 14, err.Error()
+			return false
+		}
+		flusher.Flush()
+		return true
+	}
+
+	st := currentState()
+	for _, crl := range st.crls {
+		der, err := os.ReadFile(rootDir + crl.FileName)
+		if err != nil {
+			status, reason = 13, err.Error()
+			return
+		}
+		if !write(crlUpdate(crl.FileName, der)) {
+			return
+		}
+	}
+	for req, e := range st.cache.live(time.Now()) {
+		f := st.filters[e.issuer]
+		if !write(responseUpdate(e.issuer, []byte(req), e, f.crlHash[:])) {
+			return
+		}
+	}
+	if !write(protoVarint(nil, 4, 1)) {
+		return
+	}
+
+	heartbeat := time.NewTicker(standbyHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case msg := <-sub.updates:
+			if !write(msg) {
+				return
+			}
+		case now := <-heartbeat.C:
+			if !write(protoVarint(nil, 3, uint64(now.UnixNano()))) {
+				return
+			}
+		case <-sub.dropped:
+			status, reason = 8, "standby fell behind the update stream"
+			return
+		case <-r.Context().Done():
+			reason = "stream closed"
+			return
+		}
+	}
+}
+
+// grpcStatus ends a call that failed before streaming began.
+func grpcStatus(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Grpc-Status", strconv.Itoa(code))
+	w.Header().Set("Grpc-Message", msg)
+	w.WriteHeader(http.StatusOK)
+}
+
+// standby is the state of this process as a standby, set at startup.
+var standby struct {
+	// passive is 1 until the standby is promoted; a passive standby
+	// answers no OCSP requests.
+	passive int32
+	// synced is 1 once the current stream's snapshot has been applied.
+	synced int32
+	// lastUpdate is when the primary was last heard from, in Unix
+	// nanoseconds.
+	lastUpdate  int64
+	promoteOnce sync.Once
+}
+
+func standbyPassive() bool {
+	return atomic.LoadInt32(&standby.passive) == 1
+}
+
+// promote makes a standby serve. The stream to the primary is closed and
+// the standby starts refreshing CRLs itself.
+func promote(reason string) bool {
+	promoted := false
+	standby.promoteOnce.Do(func() {
+		atomic.StoreInt32(&standby.passive, 0)
+		log.Printf("standby promoted: %s", reason)
+		superviseLoop("refresher", runRefresher)
+		promoted = true
+	})
+	return promoted
+}
+
+// runStandby follows the primary, under the TLS policy policy, until the
+// standby is promoted.
+func runStandby(cfg StandbyConfig, policy TLSPolicy) {
+	tc, err := policy.config()
+	if err != nil {
+		log.Fatalf("standby: %v", err)
+	}
+	tc, pool, err := cfg.TLS.tlsConfig(tc)
+	if err != nil {
+		log.Fatalf("standby: %v", err)
+	}
+	tc.RootCAs = pool
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: tc, ForceAttemptHTTP2: true}}
+	atomic.StoreInt64(&standby.lastUpdate, time.Now().UnixNano())
+	for standbyPassive() {
+		err := followPrimary(client, cfg)
+		atomic.StoreInt32(&standby.synced, 0)
+		if !standbyPassive() {
+			return
+		}
+		log.Printf("standby: stream from %s: %v", cfg.Primary, err)
+		lost := time.Since(time.Unix(0, atomic.LoadInt64(&standby.lastUpdate)))
+		if cfg.PromoteAfter > 0 && lost >= cfg.PromoteAfter {
+			promote(fmt.Sprintf("no word from the primary for %s", lost.Round(time.Millisecond)))
+			return
+		}
+		wait := 200 * time.Millisecond
+		if cfg.PromoteAfter > 0 && cfg.PromoteAfter-lost < wait {
+			wait = cfg.PromoteAfter - lost
+		}
+		time.Sleep(wait)
+	}
+}
+
+// followPrimary applies one stream from the primary until it breaks, goes
+// quiet for standbyTimeout, or the standby is promoted.
+func followPrimary(client *http.Client, cfg StandbyConfig) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	watchdog := time.AfterFunc(standbyTimeout, cancel)
+	defer watchdog.Stop()
+
+	var req bytes.Buffer
+	name, _ := os.Hostname()
+	writeGRPCMessage(&req, protoBytes(nil, 1, []byte(name)))
+	hreq, err := http.NewRequestWithContext(ctx, http.MethodPost, "https://"+cfg.Primary+standbyMethod, &req)
+	if err != nil {
+		return err
+	}
+	hreq.Header.Set("Content-Type", "application/grpc")
+	hreq.Header.Set("Te", "trailers")
+	resp, err := client.Do(hreq)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("primary answered %s", resp.Status)
+	}
+	if code := resp.Header.Get("Grpc-Status"); code != "" && code != "0" {
+		return fmt.Errorf("gRPC status %s: %s", code, resp.Header.Get("Grpc-Message"))
+	}
+
+	for standbyPassive() {
+		msg, err := readGRPCMessage(resp.Body)
+		if err == io.EOF {
+			return fmt.Errorf("gRPC status %s: %s", resp.Trailer.Get("Grpc-Status"), resp.Trailer.Get("Grpc-Message"))
+		}
+		if err != nil {
+			return err
+		}
+		watchdog.Reset(standbyTimeout)
+		atomic.StoreInt64(&standby.lastUpdate, time.Now().UnixNano())
+		if err := applyStandbyUpdate(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func applyStandbyUpdate(msg []byte) error {
+	var crl, resp []byte
+	err := protoFields(msg, func(field int, v uint64, data []byte) {
+		switch field {
+		case 1:
+			crl = data
+		case 2:
+			resp = data
+		case 4:
+			if v == 1 && atomic.SwapInt32(&standby.synced, 1) == 0 {
+				log.Printf("standby: in sync with the primary")
+			}
+		}
+	})
+	switch {
+	case err != nil:
+		return err
+	case crl != nil:
+		return applyStandbyCRL(crl)
+	case resp != nil:
+		return applyStandbyResponse(resp)
+	}
+	return nil
+}
+
+// applyStandbyCRL caches a CRL from the primary and indexes it, as a
+// refresh would. CRLs of issuers this standby does not serve are ignored.
+func applyStandbyCRL(msg []byte) error {
+	var fileName string
+	var der []byte
+	if err := protoFields(msg, func(field int, _ uint64, data []byte) {
+		switch field {
+		case 1:
+			fileName = string(data)
+		case 2:
+			der = data
+		}
+	}); err != nil {
+		return err
+	}
+	st := currentState()
+	var crl CRLInfo
+	for _, c := range st.crls {
+		if c.FileName == fileName {
+			crl = c
+		}
+	}
+	if crl.FileName == "" {
+		return nil
+	}
+	if sum, err := hashFile(rootDir + fileName); err == nil && st.filters[crl.key()].crlHash == sum {
+		return nil
+	}
+	if fr := currentFreeze(crl.key()); fr != nil {
+		log.Printf("standby: %s: not installed: %s", fileName, fr)
+		return nil
+	}
+	tmp := rootDir + fileName + ".tmp"
+	if err := os.WriteFile(tmp, der, 0o644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, rootDir+fileName); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	crl.Size, crl.FetchedFrom = int64(len(der)), "standby://"+st.cfg.Standby.Primary
+	filter, err := ConstructBloomFilter(st.cfg, crl)
+	if err != nil {
+		return err
+	}
+	if _, err := installFilter(crl, filter); err != nil {
+		log.Printf("standby: %s: %v", fileName, err)
+		return nil
+	}
+	log.Printf("standby: installed %s: %d bytes, %d entries", fileName, len(der), filter.size())
+	return nil
+}
+
+// applyStandbyResponse caches a response the primary signed, if this
+// standby indexes the same CRL it was derived from.
+func applyStandbyResponse(msg []byte) error {
+	var issuer string
+	var req, crlHash []byte
+	e := &cachedResponse{}
+	if err := protoFields(msg, func(field int, v uint64, data []byte) {
+		switch field {
+		case 1:
+			issuer = string(data)
+		case 2:
+			req = data
+		case 3:
+			e.der = data
+		case 4:
+			e.expires = time.Unix(0, int64(v))
+		case 5:
+			crlHash = data
+		case 6:
+			e.next = data
+		}
+	}); err != nil {
+		return err
+	}
+	e.issuer = issuer
+	st := currentState()
+	f, ok := st.filters[issuer]
+	if !ok || !bytes.Equal(f.crlHash[:], crlHash) {
+		return nil
+	}
+	e.crlNumber = f.crlNumber
+	st.cache.put(req, e, time.Now())
+	// The primary produced it; answers to gossip cover what standbys serve.
+	for _, der := range [][]byte{e.der, e.next} {
+		if der == nil || !produced.enabled() {
+			continue
+		}
+		if resp, err := responder.ParseResponse(der); err == nil {
+			produced.record(der, resp.ProducedAt)
+		}
+	}
+	return nil
+}
+
+// standbyStatus is the standby section of /healthz.
+type standbyStatus struct {
+	Role       string     `json:"role"`
+	Passive    bool       `json:"passive,omitempty"`
+	Synced     bool       `json:"synced,omitempty"`
+	LastUpdate *time.Time `json:"last_update,omitempty"`
+	// Standbys is the number of standbys connected to a primary.
+	Standbys int `json:"standbys,omitempty"`
+}
+
+func currentStandbyStatus(cfg *Config) *standbyStatus {
+	switch cfg.Standby.Role {
+	case "primary":
+		return &standbyStatus{Role: "primary", Standbys: int(atomic.LoadInt32(&standbyStreams.n))}
+	case "standby":
+		s := &standbyStatus{Role: "standby", Passive: standbyPassive(), Synced: atomic.LoadInt32(&standby.synced) == 1}
+		if last := atomic.LoadInt64(&standby.lastUpdate); last != 0 {
+			t := time.Unix(0, last).UTC()
+			s.LastUpdate = &t
+		}
+		return s
+	}
+	return nil
+}
+
+// promoteHandler serves POST /admin/v1/promote, which promotes a standby.
+func promoteHandler(w http.ResponseWriter, r *http.Request) {
+	if !requirePost(w, r) {
+		return
+	}
+	if currentState().cfg.Standby.Role != "standby" {
+		http.Error(w, "not a standby", http.StatusConflict)
+		return
+	}
+	msg := "already promoted"
+	if promote("promoted through the admin API") {
+		msg = "promoted"
+	}
+	adminResult(w, r, msg, map[string]string{"result": msg})
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestGRPCMessages(t *testing.T) {
+	var buf bytes.Buffer
+	msg := crlUpdate("CA.crl", []byte{0x30, 0x03, 1, 2, 3})
+	if err := writeGRPCMessage(&buf, msg); err != nil {
+		t.Fatal(err)
+	}
+	got, err := readGRPCMessage(&buf)
+	if err != nil || !bytes.Equal(got, msg) {
+		t.Fatalf("read %x, %v, want %x", got, err, msg)
+	}
+	var fileName, der []byte
+	protoFields(got, func(field int, _ uint64, data []byte) {
+		protoFields(data, func(field int, _ uint64, data []byte) {
+			switch field {
+			case 1:
+				fileName = data
+			case 2:
+				der = data
+			}
+		})
+	})
+	if string(fileName) != "CA.crl" || len(der) != 5 {
+		t.Errorf("decoded %q and %x", fileName, der)
+	}
+
+	if _, err := readGRPCMessage(bytes.NewReader([]byte{1, 0, 0, 0, 1, 0})); err == nil {
+		t.Error("read a compressed message")
+	}
+	if err := protoFields([]byte{0x0a, 0x05, 1}, func(int, uint64, []byte) {}); err == nil {
+		t.Error("decoded a truncated field")
+	}
+}
+
+// TestStandbyUpdates applies a primary's CRL and responses, as a standby
+// following its stream does.
+func TestStandbyUpdates(t *testing.T) {
+	saved := rootDir
+	defer func() { rootDir = saved }()
+	rootDir = t.TempDir() + string(filepath.Separator)
+	newReq := benchState(t, defaultConfig().Cache)
+	st := currentState()
+	crl := st.crls[0]
+	now := time.Now().UTC().Truncate(time.Second)
+	der := signTestCRL(t, st.signer, 2, now,
+		x509.RevocationListEntry{SerialNumber: big.NewInt(0x666), RevocationTime: now},
+	)
+	// Both the initial index and the primary's are built from CRL files.
+	if err := os.WriteFile(rootDir+crl.FileName, signTestCRL(t, st.signer, 1, now.Add(-time.Minute)), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := applyStandbyUpdate(crlUpdate("OTHERCA.crl", der)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(rootDir + "OTHERCA.crl"); err == nil {
+		t.Error("cached the CRL of an issuer not served")
+	}
+	if err := applyStandbyUpdate(crlUpdate(crl.FileName, der)); err != nil {
+		t.Fatal(err)
+	}
+	f := currentState().filters[crl.key()]
+	if f.crlHash != sha256.Sum256(der) || !f.lookup(big.NewInt(0x666)).revoked {
+		t.Fatal("the primary's CRL was not installed")
+	}
+
+	// Responses are cached only if derived from the CRL indexed here.
+	e := &cachedResponse{der: []byte{0x30, 0}, expires: now.Add(time.Hour)}
+	stale := [sha256.Size]byte{1}
+	for req, hash := range map[int64][]byte{0x1001: f.crlHash[:], 0x1002: stale[:]} {
+		if err := applyStandbyUpdate(responseUpdate(crl.key(), newReq(req), e, hash)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if c := currentState().cache; c.peek(newReq(0x1001), now) == nil || c.peek(newReq(0x1002), now) != nil {
+		t.Error("cached the responses of the wrong CRLs")
+	}
+}
+
+func TestPassiveStandby(t *testing.T) {
+	newReq := benchState(t, defaultConfig().Cache)
+	atomic.StoreInt32(&standby.passive, 1)
+	defer atomic.StoreInt32(&standby.passive, 0)
+	w := httptest.NewRecorder()
+	ocspHandler(w, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(newReq(0x1001))))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("a passive standby answered %d, want 503", w.Code)
+	}
+	if s := currentStandbyStatus(&Config{Standby: StandbyConfig{Role: "standby"}}); !s.Passive {
+		t.Errorf("status %+v, want passive", s)
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkkemp/GoOCSPResponder/responder"
+)
+
+// StaplesConfig exports pre-signed responses as files, for TLS servers
+// that load OCSP staples from disk rather than fetch them.
+type StaplesConfig struct {
+	// Certs are glob patterns of PEM server certificates; the first
+	// certificate in each file is stapled. Certificates of issuers that are
+	// not served are listed in the manifest and skipped.
+	Certs []string `yaml:"certs"`
+	// Dir is where staples are written; empty writes each next to its
+	// certificate.
+	Dir string `yaml:"dir"`
+	// Format names the staples: haproxy appends .ocsp to the certificate
+	// file name (cert.pem.ocsp), apache replaces its extension
+	// (cert.ocsp).
+	Format string `yaml:"format"`
+	// Interval is how often the staples are refreshed.
+	Interval time.Duration `yaml:"interval"`
+	// Manifest is where the outcome of the last export is written as
+	// JSON; it defaults to staples.json in Dir, or nowhere without Dir.
+	Manifest string `yaml:"manifest"`
+}
+
+func (c StaplesConfig) enabled() bool {
+	return len(c.Certs) > 0
+}
+
+func (c StaplesConfig) validate() error {
+	if !c.enabled() {
+		return nil
+	}
+	switch {
+	case c.Format != "haproxy" && c.Format != "apache":
+		return fmt.Errorf("staples: format %q is neither haproxy nor apache", c.Format)
+	case c.Interval < time.Minute:
+		return errors.New("staples.interval must be at least 1m")
+	}
+	for _, pattern := range c.Certs {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("staples: %q: %v", pattern, err)
+		}
+	}
+	return nil
+}
+
+// staplePath returns where the staple of the certificate at certPath goes.
+func (c StaplesConfig) staplePath(certPath string) string {
+	dir, name := filepath.Split(certPath)
+	if c.Dir != "" {
+		dir = c.Dir
+	}
+	if c.Format == "apache" {
+		name = strings.TrimSuffix(name, filepath.Ext(name)) + ".ocsp"
+	} else {
+		name += ".ocsp"
+	}
+	return filepath.Join(dir, name)
+}
+
+func (c StaplesConfig) manifestPath() string {
+	if c.Manifest != "" || c.Dir == "" {
+		return c.Manifest
+	}
+	return filepath.Join(c.Dir, "staples.json")
+}
+
+// exportedStaple is the manifest entry of one certificate.
+type exportedStaple struct {
+	Certificate string    `json:"certificate"`
+	Staple      string    `json:"staple,omitempty"`
+	Issuer      string    `json:"issuer,omitempty"`
+	Serial      string    `json:"serial,omitempty"`
+	Status      string    `json:"status,omitempty"`
+	ThisUpdate  time.Time `json:"this_update,omitempty"`
+	NextUpdate  time.Time `json:"next_update,omitempty"`
+	// Updated is set when the staple was written by this export, rather
+	// than left as it was.
+	Updated bool   `json:"updated"`
+	Error   string `json:"error,omitempty"`
+}
+
+// stapleManifest is what an export writes to the manifest.
+type stapleManifest struct {
+	ExportedAt time.Time        `json:"exported_at"`
+	Updated    int              `json:"updated"`
+	Staples    []exportedStaple `json:"staples"`
+}
+
+// stapleWake cuts the exporter's wait short; see wakeStapleExporter.
+var stapleWake = make(chan struct{}, 1)
+
+// wakeStapleExporter has the staples exported now rather than at the end
+// of the interval.
+func wakeStapleExporter() {
+	select {
+	case stapleWake <- struct{}{}:
+	default:
+	}
+}
+
+// runStapleExporter exports the staples of the current configuration
+// every staples.interval, starting now, and whenever it is woken.
+func runStapleExporter(hb heartbeat) {
+	for {
+		st := currentState()
+		if !st.cfg.Staples.enabled() {
+			// Disabled; a reload may enable it.
+			if !hb.sleep(time.Minute) {
+				return
+			}
+			continue
+		}
+		m := st.exportStaples(time.Now())
+		for _, s := range m.Staples {
+			if s.Error != "" {
+				log.Printf("staples: %s: %s", s.Certificate, s.Error)
+			}
+		}
+		if !hb.beat(st.cfg.Staples.Interval) {
+			return
+		}
+		select {
+		case <-time.After(st.cfg.Staples.Interval):
+		case <-stapleWake:
+		}
+	}
+}
+
+// exportStaples writes a fresh staple for every configured certificate
+// whose staple changed, replacing each file atomically, and then the
+// manifest.
+func (st *state) exportStaples(now time.Time) stapleManifest {
+	cfg := st.cfg.Staples
+	m := stapleManifest{ExportedAt: now.UTC(), Staples: []exportedStaple{}}
+	for _, pattern := range cfg.Certs {
+		paths, _ := filepath.Glob(pattern)
+		for _, path := range paths {
+			s := st.exportStaple(cfg, path, now)
+			if s.Updated {
+				m.Updated++
+			}
+			m.Staples = append(m.Staples, s)
+		}
+	}
+	if path := cfg.manifestPath(); path != "" {
+		data, _ := json.MarshalIndent(m, "", "  ")
+		if err := writeFileAtomic(path, append(data, '\n'), 0644); err != nil {
+			log.Printf("staples: manifest: %v", err)
+		}
+	}
+	return m
+}
+
+// exportStaple answers for the certificate at path and writes the staple
+// if it differs from the one on disk.
+func (st *state) exportStaple(cfg StaplesConfig, path string, now time.Time) exportedStaple {
+	s := exportedStaple{Certificate: path}
+	certs, err := readCertificates(path)
+	if err != nil {
+		s.Error = err.Error()
+		return s
+	}
+	if len(certs) == 0 {
+		s.Error = "no certificate"
+		return s
+	}
+	leaf := certs[0]
+	s.Serial = fmt.Sprintf("%x", leaf.SerialNumber)
+	crl, ok := st.issuerOf(leaf)
+	if !ok {
+		s.Error = "issuer " + issuerDN(leaf) + " is not served"
+		return s
+	}
+	s.Issuer = crl.key()
+
+	req, err := certIDRequest(crl, leaf.SerialNumber)
+	if err != nil {
+		s.Error = err.Error()
+		return s
+	}
+	der := st.answer(req, now)
+	resp, err := responder.ParseResponse(der)
+	switch {
+	case err != nil:
+		s.Error = err.Error()
+		return s
+	case resp.Status != responder.Successful || len(resp.Responses) != 1:
+		s.Error = fmt.Sprintf("the responder answered %v", resp.Status)
+		return s
+	}
+	single := resp.Responses[0]
+	s.Status, s.ThisUpdate, s.NextUpdate = single.Status.String(), single.ThisUpdate, single.NextUpdate
+	if single.Status == responder.Unknown {
+		// Clients reject an unknown staple, and the handshake with it.
+		s.Error = "the certificate's status is unknown"
+		return s
+	}
+
+	s.Staple = cfg.staplePath(path)
+	if old, err := os.ReadFile(s.Staple); err == nil && bytes.Equal(old, der) {
+		return s
+	}
+	// Staples are public, and read by the TLS server's user.
+	if err := writeFileAtomic(s.Staple, der, 0644); err != nil {
+		s.Error = err.Error()
+		return s
+	}
+	s.Updated = true
+	return s
+}
+
+// issuerOf returns the served CRL of the CA that issued cert.
+func (st *state) issuerOf(cert *x509.Certificate) (CRLInfo, bool) {
+	for _, crl := range st.crls {
+		if bytes.Equal(cert.RawIssuer, crl.CA.RawSubject) && cert.CheckSignatureFrom(crl.CA) == nil {
+			return crl, true
+		}
+	}
+	return CRLInfo{}, false
+}
+
+// certIDRequest returns a DER OCSP request for serial under the CA of
+// crl, with SHA-1 issuer hashes as clients send them.
+func certIDRequest(crl CRLInfo, serial *big.Int) ([]byte, error) {
+	nameHash, keyHash, err := responder.IssuerHashes(crl.CA, crypto.SHA1)
+	if err != nil {
+		return nil, err
+	}
+	return responder.CreateRequest(responder.CertID{HashAlgorithm: crypto.SHA1, NameHash: nameHash, KeyHash: keyHash, SerialNumber: serial})
+}
+
+// answer returns the response to the DER request body, from the cache or
+// signed on the slow path, as a client would get it.
+func (st *state) answer(body []byte, now time.Time) []byte {
+	if e := st.cache.get(body, "", now); e != nil {
+		return e.response(st.servingNext(now))
+	}
+	rec := &derRecorder{header: make(http.Header)}
+	st.slowPath(rec, body, "")
+	return rec.body.Bytes()
+}
+
+// derRecorder is the http.ResponseWriter answer passes to the slow path.
+type derRecorder struct {
+	header http.Header
+	body   bytes.Buffer
+}
+
+func (r *derRecorder) Header() http.Header         { return r.header }
+func (r *derRecorder) WriteHeader(int)             {}
+func (r *derRecorder) Write(p []byte) (int, error) { return r.body.Write(p) }
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// StartupConfig bounds how long startup waits for CRLs. Without a
+// deadline the responder starts serving once every issuer's CRL is fetched
+// and indexed, and one that fails is fatal, so a single slow distribution
+// point stalls everything. It is read at startup only.
+type StartupConfig struct {
+	// Deadline is how long startup waits for the CRLs. Past it the
+	// responder starts serving the issuers that loaded, answers tryLater
+	// for the others and keeps loading them in the background. 0 waits for
+	// all of them.
+	Deadline time.Duration `yaml:"deadline"`
+	// RetryInterval is the pause before an issuer whose CRL failed to load
+	// is tried again, with a deadline.
+	RetryInterval time.Duration `yaml:"retry_interval"`
+}
+
+func (c StartupConfig) validate() error {
+	if c.Deadline < 0 {
+		return errors.New("startup.deadline must not be negative")
+	}
+	if c.Deadline > 0 && c.RetryInterval <= 0 {
+		return errors.New("startup.retry_interval must be positive")
+	}
+	return nil
+}
+
+// startupLoads bounds the CRLs fetched and indexed at once under a
+// deadline, so a slow one does not hold up the rest; downloads still share
+// downloadLimiter.
+const startupLoads = 4
+
+// notLoadedReason is the quarantine reason of the placeholder index an
+// issuer gets when serving starts before its CRL loaded.
+const notLoadedReason = "CRL not loaded yet"
+
+// issuerReadiness is the startup progress of one issuer.
+type issuerReadiness struct {
+	// State is loading, failed (and being retried) or ready.
+	State string `json:"state"`
+	// Error is the last failure, and Failures counts them.
+	Error    string     `json:"error,omitempty"`
+	Failures int        `json:"failures,omitempty"`
+	ReadyAt  *time.Time `json:"ready_at,omitempty"`
+}
+
+// startup tracks the issuers loaded under a startup deadline.
+var startup = struct {
+	sync.Mutex
+	// partial is set when serving started before every issuer loaded.
+	partial bool
+	issuers map[string]*issuerReadiness
+}{issuers: make(map[string]*issuerReadiness)}
+
+func setReadiness(key, state string, err error) {
+	startup.Lock()
+	defer startup.Unlock()
+	r := startup.issuers[key]
+	if r == nil {
+		r = &issuerReadiness{}
+		startup.issuers[key] = r
+	}
+	r.State, r.Error = state, ""
+	switch state {
+	case "failed":
+		r.Failures++
+		r.Error = err.Error()
+	case "ready":
+		now := time.Now().UTC()
+		r.ReadyAt = &now
+	}
+}
+
+// loadedIssuer is the outcome of loading one issuer's CRL: its index, or
+// ok false if the issuer was dropped or loaded otherwise meanwhile.
+type loadedIssuer struct {
+	crl    CRLInfo
+	filter CRLBloomFilter
+	ok     bool
+}
+
+// startState is buildState bounded by startup.deadline. Issuers that have
+// not loaded by the deadline are served from a placeholder index and keep
+// loading; run the returned function once the state is current to install
+// them as they load. It is nil when every issuer loaded in time.
+func startState(cfg *Config, bundle CertificateBundle, refetch bool) (*state, func(), error) {
+	if cfg.Startup.Deadline <= 0 {
+		st, err := buildState(cfg, bundle, refetch)
+		return st, nil, err
+	}
+	issuers, err := selectIssuers(cfg, bundle)
+	if err != nil {
+		return nil, nil, err
+	}
+	configureGlobals(cfg)
+	loaded := make(chan loadedIssuer, len(issuers))
+	slots := make(chan struct{}, startupLoads)
+	for _, cert := range issuers {
+		setReadiness(CRLInfo{FileName: registry.crlFile(cert)}.key(), "loading", nil)
+		go loadIssuer(cfg, cert, refetch, slots, loaded)
+	}
+
+	filters := make(map[string]CRLBloomFilter, len(issuers))
+	deadline := time.NewTimer(cfg.Startup.Deadline)
+	defer deadline.Stop()
+wait:
+	for len(filters) < len(issuers) {
+		select {
+		case l := <-loaded:
+			filters[l.crl.key()] = l.filter
+		case <-deadline.C:
+			break wait
+		}
+	}
+
+	crls := make([]CRLInfo, 0, len(issuers))
+	pending := 0
+	for _, cert := range issuers {
+		crl := CRLInfo{CA: cert, FileName: registry.crlFile(cert)}
+		if f, ok := filters[crl.key()]; ok {
+			crls = append(crls, f.crlInfo)
+			continue
+		}
+		filters[crl.key()] = CRLBloomFilter{crlInfo: crl, quarantine: notLoadedReason, pending: true, loadedAt: time.Now()}
+		crls = append(crls, crl)
+		pending++
+	}
+	st, err := assembleState(cfg, bundle, crls, filters)
+	if err != nil || pending == 0 {
+		return st, nil, err
+	}
+	log.Printf("startup: deadline of %v passed with %d of %d issuers loaded; serving them and loading the rest", cfg.Startup.Deadline, len(issuers)-pending, len(issuers))
+	startup.Lock()
+	startup.partial = true
+	startup.Unlock()
+	return st, func() {
+		for ; pending > 0; pending-- {
+			installLoadedIssuer(<-loaded)
+		}
+		log.Printf("startup: every issuer is loaded")
+	}, nil
+}
+
+// loadIssuer fetches and indexes the CRL of cert, retrying every
+// startup.retry_interval until it loads, and sends the outcome to loaded.
+// It gives up once serving started if the issuer was dropped by a reload
+// or loaded by a refresh meanwhile.
+func loadIssuer(cfg *Config, cert *x509.Certificate, refetch bool, slots chan struct{}, loaded chan<- loadedIssuer) {
+	key := CRLInfo{FileName: registry.crlFile(cert)}.key()
+	for {
+		if st, _ := current.Load().(*state); st != nil {
+			if f, ok := st.filters[key]; !ok || !f.pending {
+				loaded <- loadedIssuer{}
+				return
+			}
+		}
+		slots <- struct{}{}
+		crl, err := fetchCRL(cfg, cert, refetch)
+		var filter CRLBloomFilter
+		var lerr *crlLimitError
+		switch {
+		case err == nil:
+			filter, err = ConstructBloomFilter(cfg, crl)
+		case errors.As(err, &lerr):
+			// Retrying would download it again; the refresher will.
+			alert(cfg, "quarantined %s: %s", key, lerr.reason)
+			crl = CRLInfo{CA: cert, FileName: registry.crlFile(cert)}
+			filter = CRLBloomFilter{crlInfo: crl, quarantine: lerr.reason, loadedAt: time.Now()}
+			err = nil
+		}
+		<-slots
+		if err == nil {
+			loaded <- loadedIssuer{crl: crl, filter: filter, ok: true}
+			return
+		}
+		setReadiness(key, "failed", err)
+		log.Printf("startup: %s: %v; retrying in %v", key, err, cfg.Startup.RetryInterval)
+		time.Sleep(cfg.Startup.RetryInterval)
+	}
+}
+
+// installLoadedIssuer swaps in the index of an issuer that loaded after
+// serving started, as a refresh would.
+func installLoadedIssuer(l loadedIssuer) {
+	if !l.ok {
+		return
+	}
+	if err := archiveCRL(currentState().cfg, l.filter); err != nil {
+		log.Printf("archive %s: %v", l.crl.FileName, err)
+	}
+	if ok, err := installFilter(l.crl, l.filter); !ok {
+		if err != nil {
+			log.Printf("startup: %s: %v", l.crl.key(), err)
+		}
+		return
+	}
+	setReadiness(l.crl.key(), "ready", nil)
+	log.Printf("startup: loaded %s: %d bytes, %d entries", l.crl.FileName, l.crl.Size, l.filter.size())
+	standbyStreams.publishCRL(l.crl)
+}
+
+// startupStatus is the readiness of the served issuers.
+type startupStatus struct {
+	Ready   int `json:"ready"`
+	Issuers int `json:"issuers"`
+	// Partial is set when serving started at the startup deadline, before
+	// every issuer loaded.
+	Partial   bool                       `json:"partial,omitempty"`
+	Readiness map[string]issuerReadiness `json:"readiness"`
+}
+
+func currentStartupStatus(st *state) startupStatus {
+	startup.Lock()
+	defer startup.Unlock()
+	s := startupStatus{Issuers: len(st.crls), Partial: startup.partial, Readiness: make(map[string]issuerReadiness, len(st.crls))}
+	for _, crl := range st.crls {
+		r := issuerReadiness{State: "ready"}
+		if t, ok := startup.issuers[crl.key()]; ok {
+			r = *t
+		}
+		if st.filters[crl.key()].pending {
+			if r.State == "ready" {
+				r.State = "loading"
+			}
+		} else {
+			r.State, r.Error = "ready", ""
+			s.Ready++
+		}
+		s.Readiness[crl.key()] = r
+	}
+	return s
+}
+
+// parseMinReady parses the min parameter of /readyz: a number of issuers,
+// or a percentage of them with a % suffix. Empty means all of them.
+func parseMinReady(s string, total int) (int, error) {
+	if s == "" {
+		return total, nil
+	}
+	if p := strings.TrimSuffix(s, "%"); p != s {
+		pct, err := strconv.ParseFloat(p, 64)
+		if err != nil || pct < 0 || pct > 100 {
+			return 0, fmt.Errorf("min %q is not a percentage", s)
+		}
+		n := int(pct * float64(total) / 100)
+		if float64(n)*100 < pct*float64(total) {
+			n++
+		}
+		return n, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("min %q is not a number of issuers", s)
+	}
+	return n, nil
+}
+
+// readyzHandler serves GET /readyz: 200 when at least min issuers are
+// loaded, every one by default, and 503 otherwise, with the readiness of
+// each, so an orchestrator can choose the coverage it accepts.
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	st := currentState()
+	s := currentStartupStatus(st)
+	want, err := parseMinReady(r.URL.Query().Get("min"), s.Issuers)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	code := http.StatusOK
+	if s.Ready < want || standbyPassive() {
+		code = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(s)
+}
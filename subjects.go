@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unsafe"
+)
+
+// subjectRecord is one certificate from a CA database export.
+type subjectRecord struct {
+	issuer  CRLInfo
+	serial  *big.Int
+	subject string
+	upn     string
+}
+
+// subjectIndex maps normalized subject identifiers (EDIPI, UPN, common
+// name) to the certificates issued to that subject. Revocation status is
+// always taken from the live CRL index, never from the export.
+type subjectIndex struct {
+	records map[string][]subjectRecord
+}
+
+// bytes estimates the memory the index holds, for the dashboard.
+func (idx *subjectIndex) bytes() uint64 {
+	var n uint64
+	for k, recs := range idx.records {
+		n += uint64(len(k)) + 16 + 24
+		for _, r := range recs {
+			n += uint64(unsafe.Sizeof(r)) + uint64(len(r.subject)+len(r.upn)) + 16
+		}
+	}
+	return n
+}
+
+// edipi returns the 10-digit DoD EDIPI that ends a DoD common name
+// (LAST.FIRST.MIDDLE.1234567890) or starts a UPN (1234567890@mil), or "".
+func edipi(s string) string {
+	if i := strings.IndexByte(s, '@'); i >= 0 {
+		s = s[:i]
+	} else if i := strings.LastIndexByte(s, '.'); i >= 0 {
+		s = s[i+1:]
+	}
+	if len(s) != 10 {
+		return ""
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return ""
+		}
+	}
+	return s
+}
+
+// keys returns the index keys a record is reachable under.
+func (r subjectRecord) keys() []string {
+	cn := r.subject
+	if i := strings.LastIndex(cn, "CN="); i >= 0 {
+		cn = cn[i+3:]
+		if j := strings.IndexAny(cn, ",/+"); j >= 0 {
+			cn = cn[:j]
+		}
+	}
+	keys := []string{"cn:" + strings.ToLower(cn)}
+	if r.upn != "" {
+		keys = append(keys, "upn:"+strings.ToLower(r.upn))
+	}
+	if id := edipi(cn); id != "" {
+		keys = append(keys, "edipi:"+id)
+	} else if id := edipi(r.upn); id != "" {
+		keys = append(keys, "edipi:"+id)
+	}
+	return keys
+}
+
+// queryKey normalizes a lookup the same way keys does.
+func queryKey(q string) string {
+	q = strings.TrimSpace(q)
+	if id := edipi(q); id != "" && (len(q) == 10 || strings.Contains(q, "@")) {
+		return "edipi:" + id
+	}
+	if strings.Contains(q, "@") {
+		return "upn:" + strings.ToLower(q)
+	}
+	return "cn:" + strings.ToLower(strings.TrimPrefix(q, "CN="))
+}
+
+func buildSubjectIndex(st *state) (*subjectIndex, error) {
+	idx := &subjectIndex{records: make(map[string][]subjectRecord)}
+	for _, export := range st.cfg.SubjectIndex.Exports {
+		issuer, _, ok := st.findIssuer(export.Issuer)
+		if !ok {
+			return nil, fmt.Errorf("subject_index: issuer %q is not served", export.Issuer)
+		}
+		records, err := readSubjectExport(export.Path, issuer)
+		if err != nil {
+			return nil, fmt.Errorf("subject_index: %v", err)
+		}
+		for _, r := range records {
+			for _, k := range r.keys() {
+				idx.records[k] = append(idx.records[k], r)
+			}
+		}
+	}
+	return idx, nil
+}
+
+func readSubjectExport(path string, issuer CRLInfo) ([]subjectRecord, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var records []subjectRecord
+	if strings.EqualFold(filepath.Ext(path), ".csv") {
+		records, err = readSubjectCSV(f, issuer)
+	} else {
+		records, err = readOpenSSLIndex(f, issuer)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return records, nil
+}
+
+// readOpenSSLIndex reads an openssl ca index.txt: status, expiry,
+// revocation, serial (hex), file name and subject, separated by tabs.
+func readOpenSSLIndex(r io.Reader, issuer CRLInfo) ([]subjectRecord, error) {
+	var records []subjectRecord
+	s := bufio.NewScanner(r)
+	for line := 1; s.Scan(); line++ {
+		if s.Text() == "" {
+			continue
+		}
+		fields := strings.Split(s.Text(), "\t")
+		if len(fields) != 6 {
+			return nil, fmt.Errorf("line %d: want 6 fields, got %d", line, len(fields))
+		}
+		serial, ok := new(big.Int).SetString(fields[3], 16)
+		if !ok {
+			return nil, fmt.Errorf("line %d: bad serial %q", line, fields[3])
+		}
+		records = append(records, subjectRecord{issuer: issuer, serial: serial, subject: fields[5]})
+	}
+	return records, s.Err()
+}
+
+// readSubjectCSV reads a CSV export with a header row naming at least the
+// serial (hex) and subject columns, and optionally upn.
+func readSubjectCSV(r io.Reader, issuer CRLInfo) ([]subjectRecord, error) {
+	cr := csv.NewReader(r)
+	header, err := cr.Read()
+	if err != nil {
+		return nil, err
+	}
+	col := map[string]int{"serial": -1, "subject": -1, "upn": -1}
+	for i, name := range header {
+		if _, ok := col[strings.ToLower(strings.TrimSpace(name))]; ok {
+			col[strings.ToLower(strings.TrimSpace(name))] = i
+		}
+	}
+	if col["serial"] < 0 || col["subject"] < 0 {
+		return nil, fmt.Errorf("header must name serial and subject columns")
+	}
+	var records []subjectRecord
+	for {
+		row, err := cr.Read()
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		serial, ok := parseSerial("0x" + strings.Replace(row[col["serial"]], ":", "", -1))
+		if !ok {
+			return nil, fmt.Errorf("bad serial %q", row[col["serial"]])
+		}
+		rec := subjectRecord{issuer: issuer, serial: serial, subject: row[col["subject"]]}
+		if col["upn"] >= 0 {
+			rec.upn = row[col["upn"]]
+		}
+		records = append(records, rec)
+	}
+}
+
+// subjectMatch is one revoked certificate returned by the subject lookup.
+type subjectMatch struct {
+	Issuer    string    `json:"issuer"`
+	Serial    string    `json:"serial"`
+	Subject   string    `json:"subject"`
+	UPN       string    `json:"upn,omitempty"`
+	RevokedAt time.Time `json:"revoked_at"`
+	Reason    int       `json:"reason"`
+	// Quarantine is set instead of the revocation for an issuer whose CRL
+	// is quarantined: the certificate's status is unknown.
+	Quarantine string `json:"quarantine,omitempty"`
+}
+
+// revokedForSubject returns the certificates of the subject named by q
+// that are on their issuer's current CRL, and those whose issuer's CRL is
+// quarantined.
+func (st *state) revokedForSubject(q string) []subjectMatch {
+	matches := []subjectMatch{}
+	for _, r := range st.subjects.records[queryKey(q)] {
+		f := st.filters[r.issuer.key()]
+		if f.quarantine != "" {
+			matches = append(matches, subjectMatch{
+				Issuer:     r.issuer.CA.Subject.CommonName,
+				Serial:     fmt.Sprintf("%x", r.serial),
+				Subject:    r.subject,
+				UPN:        r.upn,
+				Quarantine: f.quarantine,
+			})
+			continue
+		}
+		l := f.lookup(r.serial)
+		if !l.revoked {
+			continue
+		}
+		matches = append(matches, subjectMatch{
+			Issuer:    r.issuer.CA.Subject.CommonName,
+			Serial:    fmt.Sprintf("%x", r.serial),
+			Subject:   r.subject,
+			UPN:       r.upn,
+			RevokedAt: l.entry.RevokedAt,
+			Reason:    l.entry.Reason,
+		})
+	}
+	return matches
+}
+
+// subjectsHandler serves /admin/v1/subjects?q=…, where q is an EDIPI, a
+// UPN or a common name.
+func subjectsHandler(w http.ResponseWriter, r *http.Request) {
+	st := currentState()
+	if st.subjects == nil {
+		http.Error(w, "subject index is disabled", http.StatusNotFound)
+		return
+	}
+	q := r.URL.Query().Get("q")
+	if q == "" {
+		http.Error(w, "q is required", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(st.revokedForSubject(q))
+}
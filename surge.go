@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// SurgeConfig reacts to revocation surges: a new CRL that adds far more
+// revocations than the issuer's CRLs usually do, as a CA incident would.
+// The issuer is then refreshed every interval instead of every
+// refresh.interval until duration has passed without another surge, ahead
+// of the issuers due at the same time; the responses cached from it and
+// from the CAs it certified are dropped, staples are exported again at
+// once, and a critical alert is raised. Fast refreshes still share the
+// download rate limit.
+type SurgeConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// MinRevocations is the smallest batch of new revocations that is a
+	// surge.
+	MinRevocations int `yaml:"min_revocations"`
+	// Factor is how many times its usual batch an issuer's new
+	// revocations must be to be a surge. The usual batch is a moving
+	// average over its CRLs since startup; until there is one, a batch
+	// must reach factor times min_revocations.
+	Factor float64 `yaml:"factor"`
+	// Interval is how often a surging issuer is refreshed.
+	Interval time.Duration `yaml:"interval"`
+	// Duration is how long a surge lasts after the last CRL that was one.
+	Duration time.Duration `yaml:"duration"`
+}
+
+func (c SurgeConfig) validate(refresh time.Duration) error {
+	if !c.Enabled {
+		return nil
+	}
+	switch {
+	case c.MinRevocations < 1 || c.Factor < 1:
+		return errors.New("refresh.surge: min_revocations and factor must be at least 1")
+	case c.Interval < time.Minute || c.Interval > refresh:
+		return errors.New("refresh.surge.interval must be at least 1m and at most refresh.interval")
+	case c.Duration < c.Interval:
+		return errors.New("refresh.surge.duration must be at least refresh.surge.interval")
+	}
+	return nil
+}
+
+// surgeWeight is the weight of the latest CRL in an issuer's usual batch.
+const surgeWeight = 0.2
+
+// issuerSurge is the revocation history of one issuer.
+type issuerSurge struct {
+	Issuer string `json:"issuer"`
+	// Usual is the moving average of new revocations per CRL; it is
+	// unset until a CRL was diffed.
+	Usual *float64 `json:"usual,omitempty"`
+	// Last is the number of new revocations of the latest CRL.
+	Last int `json:"last"`
+	// Active is set while the issuer is refreshed every surge interval.
+	Active bool `json:"active"`
+	// StartedAt is when the latest surge began, Until when it ends unless
+	// another CRL extends it, and Revocations the largest batch seen
+	// during it.
+	StartedAt   *time.Time `json:"started_at,omitempty"`
+	Until       *time.Time `json:"until,omitempty"`
+	Revocations int        `json:"revocations,omitempty"`
+}
+
+// surgeTracker follows the issuers' revocation batches. It is kept across
+// reloads, so a surge outlives a configuration change.
+type surgeTracker struct {
+	mu      sync.Mutex
+	issuers map[string]*issuerSurge
+}
+
+var surges = &surgeTracker{issuers: make(map[string]*issuerSurge)}
+
+// observe records that a CRL of key added revocations, and reports whether
+// it is a surge and whether it started one rather than extending one.
+func (t *surgeTracker) observe(cfg SurgeConfig, key string, added int, now time.Time) (surge, started bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := t.issuers[key]
+	if s == nil {
+		s = &issuerSurge{Issuer: key}
+		t.issuers[key] = s
+	}
+	s.Last = added
+	usual := float64(cfg.MinRevocations)
+	if s.Usual != nil {
+		usual = *s.Usual
+	}
+	// A lasting change of pace becomes the usual within a few CRLs,
+	// surges included.
+	next := float64(added)
+	if s.Usual != nil {
+		next = usual + surgeWeight*(next-usual)
+	}
+	s.Usual = &next
+	if added < cfg.MinRevocations || float64(added) < cfg.Factor*usual {
+		return false, false
+	}
+	if !s.Active {
+		started = true
+		s.Active, s.StartedAt, s.Revocations = true, &now, 0
+	}
+	until := now.Add(cfg.Duration)
+	s.Until = &until
+	if added > s.Revocations {
+		s.Revocations = added
+	}
+	return true, started
+}
+
+// active reports whether key is surging at now, and logs the end of a
+// surge the first time it is past.
+func (t *surgeTracker) active(cfg SurgeConfig, key string, now time.Time) bool {
+	if !cfg.Enabled {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := t.issuers[key]
+	if s == nil || !s.Active {
+		return false
+	}
+	if !now.Before(*s.Until) {
+		s.Active = false
+		log.Printf("refresh: the revocation surge of %s is over; back to refresh.interval", key)
+		return false
+	}
+	return true
+}
+
+// prioritize returns crls with the surging issuers first, in their order.
+func (t *surgeTracker) prioritize(cfg SurgeConfig, crls []CRLInfo, now time.Time) []CRLInfo {
+	out := append([]CRLInfo(nil), crls...)
+	surging := make(map[string]bool)
+	for _, crl := range crls {
+		surging[crl.key()] = t.active(cfg, crl.key(), now)
+	}
+	sort.SliceStable(out, func(i, j int) bool { return surging[out[i].key()] && !surging[out[j].key()] })
+	return out
+}
+
+// addedRevocations counts the events of serials new on a CRL.
+func addedRevocations(evs []revocationEvent) int {
+	n := 0
+	for _, ev := range evs {
+		if ev.Type == "revoked" {
+			n++
+		}
+	}
+	return n
+}
+
+// observeSurge judges the CRL of crl just installed, which added
+// revocations, and reacts if it is a surge.
+func observeSurge(cfg *Config, crl CRLInfo, added int) {
+	c := cfg.Refresh.Surge
+	surge, started := surges.observe(c, crl.key(), added, time.Now())
+	if !surge {
+		return
+	}
+	dropped := dropSurgeResponses(crl)
+	wakeStapleExporter()
+	if !started {
+		log.Printf("refresh: revocation surge of %s continues with %d new revocations; dropped the cached responses of %d issuers", crl.key(), added, dropped)
+		return
+	}
+	criticalAlert(cfg, "revocation surge at %s: %d new revocations in one CRL; refreshing it every %s for %s and dropped the cached responses of %d issuers",
+		crl.key(), added, c.Interval, c.Duration, dropped)
+}
+
+// dropSurgeResponses drops the cached responses of crl and of the served
+// CAs it certified, whose CRLs may follow, and returns how many issuers
+// that was.
+func dropSurgeResponses(crl CRLInfo) int {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	old := currentState()
+	next := *old
+	n := 0
+	for _, c := range old.crls {
+		if c.key() == crl.key() || (bytes.Equal(c.CA.RawIssuer, crl.CA.RawSubject) && c.CA.CheckSignatureFrom(crl.CA) == nil) {
+			next.cache = next.cache.without(c.key())
+			n++
+		}
+	}
+	current.Store(&next)
+	return n
+}
+
+// surgesHandler lists the issuers' revocation batches and surges.
+func surgesHandler(w http.ResponseWriter, r *http.Request) {
+	st := currentState()
+	now := time.Now()
+	out := []issuerSurge{}
+	for _, crl := range st.crls {
+		active := surges.active(st.cfg.Refresh.Surge, crl.key(), now)
+		surges.mu.Lock()
+		if s := surges.issuers[crl.key()]; s != nil {
+			c := *s
+			c.Active = active
+			out = append(out, c)
+		}
+		surges.mu.Unlock()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(out)
+}
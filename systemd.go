@@ -0,0 +1,364 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// systemdOptions are the choices goocsp systemd leaves to its flags.
+type systemdOptions struct {
+	name, binary, configPath, cache string
+	legacyAPI                       string
+	readOnly, sockets               bool
+	group                           string
+}
+
+// systemdListener is a listener the service binds, by the name listen
+// gives it and socket activation passes it under.
+type systemdListener struct {
+	name, addr string
+}
+
+func (o systemdOptions) listeners(cfg *Config) []systemdListener {
+	ls := []systemdListener{{"ocsp", cfg.Listen}}
+	if cfg.Dashboard.Listen != "" {
+		ls = append(ls, systemdListener{"dashboard", cfg.Dashboard.Listen})
+	}
+	if cfg.SignedRequests.Listen != "" {
+		ls = append(ls, systemdListener{"signed", cfg.SignedRequests.Listen})
+	}
+	if cfg.Standby.Role == "primary" {
+		ls = append(ls, systemdListener{"standby", cfg.Standby.Listen})
+	}
+	if o.legacyAPI != "" {
+		ls = append(ls, systemdListener{"legacy", o.legacyAPI})
+	}
+	return ls
+}
+
+// listenStream turns a listen address into a ListenStream= value, which
+// takes IP addresses but no host names.
+func listenStream(addr string) (string, int, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", 0, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return "", 0, fmt.Errorf("%s: port %q is not a number", addr, portStr)
+	}
+	switch {
+	case host == "":
+		return portStr, port, nil
+	case host == "localhost":
+		host = "127.0.0.1"
+	case net.ParseIP(host) == nil:
+		return "", 0, fmt.Errorf("%s: systemd listens on IP addresses, not host names", addr)
+	}
+	return net.JoinHostPort(host, portStr), port, nil
+}
+
+// writablePaths returns the directories the service writes, besides the
+// cache: everything else is read-only under ProtectSystem=strict.
+func writablePaths(cfg *Config, cache string) []string {
+	var dirs []string
+	if cfg.Archive.Enabled && cfg.Archive.Dir != "" {
+		dirs = append(dirs, cfg.Archive.Dir)
+	}
+	if cfg.Events.Bus != "" && cfg.Events.Spool != "" {
+		dirs = append(dirs, cfg.Events.Spool)
+	}
+	if cfg.Blocklist.enabled() {
+		// The list is replaced through a temporary file next to it.
+		dirs = append(dirs, filepath.Dir(cfg.Blocklist.File))
+	}
+	if cfg.Staples.enabled() {
+		if cfg.Staples.Dir != "" {
+			dirs = append(dirs, cfg.Staples.Dir)
+		} else {
+			for _, pattern := range cfg.Staples.Certs {
+				dirs = append(dirs, filepath.Dir(pattern))
+			}
+		}
+		if m := cfg.Staples.manifestPath(); m != "" {
+			dirs = append(dirs, filepath.Dir(m))
+		}
+	}
+	seen := map[string]bool{}
+	var out []string
+	for _, d := range dirs {
+		d = filepath.Clean(d)
+		if seen[d] || d == cache || strings.HasPrefix(d, cache+"/") {
+			continue
+		}
+		seen[d] = true
+		out = append(out, d)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// readPaths returns the files the configuration names for the service to
+// read, which the dynamic user must be able to.
+func readPaths(cfg *Config) []string {
+	files := []string{
+		cfg.Roots, cfg.Signer.Cert, cfg.Signer.Key, cfg.Signer.Next.Cert, cfg.Signer.Next.Key,
+		cfg.Admin.TokenFile, cfg.Dashboard.TLS.Cert, cfg.Dashboard.TLS.Key, cfg.Dashboard.TLS.ClientCA,
+		cfg.Dashboard.OIDC.ClientSecretFile, cfg.Dashboard.OIDC.SessionKeyFile,
+		cfg.Events.TokenFile, cfg.Events.TLS.CA, cfg.Events.TLS.Cert, cfg.Events.TLS.Key,
+		cfg.Storage.GCS.CredentialsFile, cfg.Region.TokenFile, cfg.Attestation.Cert, cfg.Attestation.Key,
+		cfg.Standby.TLS.Cert, cfg.Standby.TLS.Key, cfg.Standby.TLS.CA,
+		cfg.SignedRequests.TrustStore, cfg.Blocklist.TrustStore,
+	}
+	for _, e := range cfg.SubjectIndex.Exports {
+		files = append(files, e.Path)
+	}
+	var out []string
+	for _, f := range files {
+		if f != "" {
+			out = append(out, f)
+		}
+	}
+	return out
+}
+
+// writableDirective places a directory the service writes. Under
+// DynamicUser only directories systemd creates for the unit are writable
+// by it, so those under /var/lib and /var/cache become StateDirectory= and
+// CacheDirectory=; any other is only made writable, and must be writable
+// by the group already.
+func writableDirective(dir string) (string, bool) {
+	for _, d := range []struct{ base, directive string }{{"/var/lib/", "StateDirectory"}, {"/var/cache/", "CacheDirectory"}} {
+		if rel := strings.TrimPrefix(dir, d.base); rel != dir && rel != "" {
+			return d.directive + "=" + rel, true
+		}
+	}
+	return "ReadWritePaths=" + dir, false
+}
+
+// systemdUnits returns the service unit and, with socket activation, a
+// socket unit per listener, by file name, with warnings about what the
+// units cannot arrange by themselves.
+func systemdUnits(cfg *Config, o systemdOptions) (map[string]string, []string, error) {
+	units := map[string]string{}
+	var warnings []string
+	service := o.name + ".service"
+
+	exec := []string{o.binary, "--cache", o.cache + "/"}
+	if o.configPath != "" {
+		exec = append(exec, "--config", o.configPath)
+	}
+	if o.legacyAPI != "" {
+		exec = append(exec, "--legacy-api", o.legacyAPI)
+	}
+	if o.readOnly {
+		exec = append(exec, "--read-only")
+	}
+
+	var sockets []string
+	lowPort := false
+	for _, l := range o.listeners(cfg) {
+		stream, port, err := listenStream(l.addr)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s listener: %v", l.name, err)
+		}
+		if !o.sockets || port == 0 {
+			if port == 0 {
+				warnings = append(warnings, fmt.Sprintf("the %s listener is on port 0, so the service binds it itself", l.name))
+			}
+			lowPort = lowPort || (port > 0 && port < 1024)
+			continue
+		}
+		socket := o.name + "-" + l.name + ".socket"
+		sockets = append(sockets, socket)
+		units[socket] = fmt.Sprintf(`[Unit]
+Description=GoOCSPResponder %s listener
+
+[Socket]
+ListenStream=%s
+FileDescriptorName=%s
+Service=%s
+
+[Install]
+WantedBy=sockets.target
+`, l.name, stream, l.name, service)
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "[Unit]\nDescription=GoOCSPResponder OCSP responder\nWants=network-online.target\nAfter=network-online.target")
+	for _, s := range sockets {
+		fmt.Fprintf(&b, " %s", s)
+	}
+	b.WriteString("\n")
+	if len(sockets) > 0 {
+		fmt.Fprintf(&b, "Requires=%s\n", strings.Join(sockets, " "))
+	}
+	fmt.Fprintf(&b, "\n[Service]\nType=simple\nExecStart=%s\nRestart=on-failure\nRestartSec=5s\n", strings.Join(exec, " "))
+	if len(sockets) > 0 {
+		fmt.Fprintf(&b, "Sockets=%s\n", strings.Join(sockets, " "))
+	}
+
+	b.WriteString("\n# Sandbox\nDynamicUser=yes\n")
+	if o.group != "" {
+		fmt.Fprintf(&b, "SupplementaryGroups=%s\n", o.group)
+	}
+	b.WriteString("UMask=0027\nProtectSystem=strict\n")
+	home := "yes"
+	reads := readPaths(cfg)
+	if o.configPath != "" {
+		reads = append([]string{o.configPath}, reads...)
+	}
+	for _, f := range append(reads, writablePaths(cfg, o.cache)...) {
+		if !filepath.IsAbs(f) {
+			warnings = append(warnings, fmt.Sprintf("%s is relative, so the service looks for it under /", f))
+		}
+		if strings.HasPrefix(f, "/home/") || strings.HasPrefix(f, "/root/") {
+			home = "read-only"
+		}
+	}
+	fmt.Fprintf(&b, "ProtectHome=%s\n", home)
+	b.WriteString(`PrivateTmp=yes
+PrivateDevices=yes
+ProtectKernelTunables=yes
+ProtectKernelModules=yes
+ProtectKernelLogs=yes
+ProtectControlGroups=yes
+ProtectClock=yes
+ProtectHostname=yes
+NoNewPrivileges=yes
+RestrictNamespaces=yes
+RestrictRealtime=yes
+RestrictSUIDSGID=yes
+LockPersonality=yes
+MemoryDenyWriteExecute=yes
+RestrictAddressFamilies=AF_INET AF_INET6 AF_UNIX
+SystemCallArchitectures=native
+SystemCallFilter=@system-service
+SystemCallErrorNumber=EPERM
+`)
+	if lowPort {
+		b.WriteString("AmbientCapabilities=CAP_NET_BIND_SERVICE\nCapabilityBoundingSet=CAP_NET_BIND_SERVICE\n")
+	} else {
+		b.WriteString("CapabilityBoundingSet=\n")
+	}
+
+	b.WriteString("\n# Written at runtime\n")
+	for _, dir := range append([]string{o.cache}, writablePaths(cfg, o.cache)...) {
+		directive, managed := writableDirective(dir)
+		fmt.Fprintln(&b, directive)
+		if !managed {
+			warnings = append(warnings, fmt.Sprintf("%s is outside /var/lib and /var/cache: it must exist and be writable by the service's group", dir))
+		}
+	}
+
+	b.WriteString("\n# Read at runtime; they must be readable by the dynamic user")
+	if o.group != "" {
+		fmt.Fprintf(&b, ", through group %s", o.group)
+	}
+	b.WriteString(":\n")
+	for _, f := range reads {
+		fmt.Fprintf(&b, "#   %s\n", f)
+	}
+	if len(reads) > 0 && o.group == "" {
+		warnings = append(warnings, "the configuration names files to read: give them a group and pass it as --group")
+	}
+
+	b.WriteString("\n[Install]\nWantedBy=multi-user.target\n")
+	units[service] = b.String()
+	return units, warnings, nil
+}
+
+// systemdCommand writes a systemd service unit for the configuration, with
+// a sandbox that only opens the paths and listeners the configuration
+// uses, and socket units to activate the listeners.
+func systemdCommand(args []string) int {
+	fs := flag.NewFlagSet("systemd", flag.ContinueOnError)
+	o := systemdOptions{}
+	fs.StringVar(&o.configPath, "config", "", "YAML configuration the service runs with")
+	fs.StringVar(&o.cache, "cache", "/var/lib/goocsp", "CRL cache directory of the service")
+	fs.StringVar(&o.name, "name", "goocsp", "unit name")
+	fs.StringVar(&o.binary, "binary", "", "path of the goocsp binary; defaults to this one")
+	fs.StringVar(&o.legacyAPI, "legacy-api", "", "address of the deprecated plaintext API listener, as for the server")
+	fs.BoolVar(&o.readOnly, "read-only", false, "run the service with --read-only")
+	fs.BoolVar(&o.sockets, "sockets", true, "activate the listeners with socket units")
+	fs.StringVar(&o.group, "group", "", "group that can read the key, certificate and token files")
+	out := fs.String("out", "", "directory to write the units to instead of printing them")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: goocsp systemd [--config file] [--cache dir] [--out dir] [flags]")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 0 {
+		fs.Usage()
+		return 2
+	}
+	err := o.resolve()
+	var cfg *Config
+	if err == nil {
+		cfg, err = loadConfig(o.configPath)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "systemd:", err)
+		return 2
+	}
+	units, warnings, err := systemdUnits(cfg, o)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "systemd:", err)
+		return 1
+	}
+	names := make([]string, 0, len(units))
+	for name := range units {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if *out == "" {
+			fmt.Printf("# %s\n%s\n", name, units[name])
+			continue
+		}
+		path := filepath.Join(*out, name)
+		if err := os.WriteFile(path, []byte(units[name]), 0o644); err != nil {
+			fmt.Fprintln(os.Stderr, "systemd:", err)
+			return 1
+		}
+		fmt.Fprintln(os.Stderr, "wrote", path)
+	}
+	for _, w := range warnings {
+		fmt.Fprintln(os.Stderr, "warning:", w)
+	}
+	return 0
+}
+
+// resolve makes the paths of o absolute, as units need them.
+func (o *systemdOptions) resolve() error {
+	if o.binary == "" {
+		exe, err := os.Executable()
+		if err != nil {
+			return err
+		}
+		o.binary = exe
+	}
+	for _, p := range []*string{&o.binary, &o.configPath, &o.cache} {
+		if *p == "" {
+			continue
+		}
+		abs, err := filepath.Abs(*p)
+		if err != nil {
+			return err
+		}
+		*p = abs
+	}
+	if strings.ContainsAny(o.binary+o.configPath+o.cache, " \t\"'") {
+		return errors.New("paths with spaces or quotes cannot go into a unit unquoted")
+	}
+	return nil
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TLSCheckConfig checks the certificates HTTPS clients are presented, on
+// the dashboard listener and on whatever fronts the responder, so a
+// mis-issued or swapped certificate is noticed. A certificate passes if it
+// matches a pin, or if it chains to a public root and appears in
+// Certificate Transparency logs; anything else is alerted on, as is a
+// change to a certificate that does not pass.
+type TLSCheckConfig struct {
+	// Interval is the pause between checks, the first of which runs at
+	// startup. 0 disables the checker.
+	Interval time.Duration `yaml:"interval"`
+	// Targets are host:port addresses to check besides the dashboard
+	// listener, such as the load balancer fronting the responder.
+	Targets []string `yaml:"targets"`
+	// Pins are the SHA-256 fingerprints, in hex, of internal certificates
+	// or of their public keys (SubjectPublicKeyInfo), which pass without
+	// CT; a key pin survives renewals with the same key.
+	Pins []string `yaml:"pins"`
+	// CTSearchURL looks a certificate up in CT logs by serial number, %s
+	// being its hex serial; it must answer a JSON array of entries with
+	// serial_number, not_before and not_after, as crt.sh does.
+	CTSearchURL string `yaml:"ct_search_url"`
+}
+
+func (c TLSCheckConfig) validate() error {
+	if c.Interval < 0 {
+		return errors.New("tls_check.interval must not be negative")
+	}
+	for _, t := range c.Targets {
+		if _, _, err := net.SplitHostPort(t); err != nil {
+			return fmt.Errorf("tls_check: target %q: %v", t, err)
+		}
+	}
+	for _, p := range c.Pins {
+		if b, err := hex.DecodeString(normalizePin(p)); err != nil || len(b) != sha256.Size {
+			return fmt.Errorf("tls_check: pin %q is not a hex SHA-256", p)
+		}
+	}
+	if u, err := url.Parse(c.CTSearchURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || !strings.Contains(c.CTSearchURL, "%s") {
+		return fmt.Errorf("tls_check: ct_search_url %q must be an http(s) URL with %%s for the serial", c.CTSearchURL)
+	}
+	return nil
+}
+
+// normalizePin accepts fingerprints as tools print them, with colons and
+// in either case.
+func normalizePin(p string) string {
+	return strings.ToLower(strings.ReplaceAll(p, ":", ""))
+}
+
+// ctGrace is how long a new certificate with embedded SCTs may be missing
+// from CT search: the maximum merge delay logs promise.
+const ctGrace = 24 * time.Hour
+
+// oidSCTList is the embedded SCT list extension (RFC 6962 section 3.3).
+var oidSCTList = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11129, 2, 4, 2}
+
+var ctClient = &http.Client{Timeout: 30 * time.Second}
+
+// tlsCheck is the outcome of the last check of one target.
+type tlsCheck struct {
+	CheckedAt time.Time `json:"checked_at"`
+	Subject   string    `json:"subject,omitempty"`
+	Issuer    string    `json:"issuer,omitempty"`
+	Serial    string    `json:"serial,omitempty"`
+	SHA256    string    `json:"sha256,omitempty"`
+	NotAfter  time.Time `json:"not_after,omitempty"`
+	// Verdict is pinned or logged when the certificate passes, pending
+	// while a new public certificate may not be searchable yet, and
+	// unpinned (neither pinned nor publicly trusted), unlogged or error
+	// otherwise.
+	Verdict string `json:"verdict"`
+	Error   string `json:"error,omitempty"`
+	// ChangedAt is when the certificate last changed since startup.
+	ChangedAt *time.Time `json:"changed_at,omitempty"`
+}
+
+func (c *tlsCheck) passed() bool {
+	return c.Verdict == "pinned" || c.Verdict == "logged" || c.Verdict == "pending"
+}
+
+// tlsChecks holds the last check per target.
+var tlsChecks = struct {
+	sync.Mutex
+	last map[string]*tlsCheck
+}{last: make(map[string]*tlsCheck)}
+
+// runTLSChecker checks every target of the current configuration per
+// tls_check.interval, starting now.
+func runTLSChecker(hb heartbeat) {
+	for {
+		cfg := currentState().cfg
+		if cfg.TLSCheck.Interval <= 0 {
+			// Disabled; a reload may enable it.
+			if !hb.sleep(time.Minute) {
+				return
+			}
+			continue
+		}
+		for _, target := range tlsCheckTargets(cfg) {
+			recordTLSCheck(cfg, target, checkTLSTarget(cfg.TLSCheck, target, time.Now()))
+		}
+		if !hb.sleep(cfg.TLSCheck.Interval) {
+			return
+		}
+	}
+}
+
+// tlsCheckTargets returns the configured targets and the dashboard
+// listener when it serves TLS, reached over loopback if it is bound to
+// every address.
+func tlsCheckTargets(cfg *Config) []string {
+	targets := append([]string(nil), cfg.TLSCheck.Targets...)
+	if cfg.Dashboard.TLS.Cert == "" {
+		return targets
+	}
+	boundListeners.Lock()
+	addr, ok := boundListeners.addrs["dashboard"]
+	boundListeners.Unlock()
+	if !ok {
+		return targets
+	}
+	host, port, _ := net.SplitHostPort(addr)
+	if ip := net.ParseIP(host); ip == nil || ip.IsUnspecified() {
+		host = "localhost"
+	}
+	return append(targets, net.JoinHostPort(host, port))
+}
+
+// checkTLSTarget fetches the certificate target presents and judges it.
+func checkTLSTarget(cfg TLSCheckConfig, target string, now time.Time) *tlsCheck {
+	c := &tlsCheck{CheckedAt: now.UTC(), Verdict: "error"}
+	chain, err := presentedChain(target)
+	if err != nil {
+		c.Error = err.Error()
+		return c
+	}
+	leaf := chain[0]
+	fp := sha256.Sum256(leaf.Raw)
+	c.Subject, c.Issuer, c.Serial = subjectDN(leaf), issuerDN(leaf), fmt.Sprintf("%x", leaf.SerialNumber)
+	c.SHA256, c.NotAfter = hex.EncodeToString(fp[:]), leaf.NotAfter
+
+	keyFP := sha256.Sum256(leaf.RawSubjectPublicKeyInfo)
+	for _, p := range cfg.Pins {
+		if pin := normalizePin(p); pin == c.SHA256 || pin == hex.EncodeToString(keyFP[:]) {
+			c.Verdict = "pinned"
+			return c
+		}
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range chain[1:] {
+		intermediates.AddCert(cert)
+	}
+	if _, err := leaf.Verify(x509.VerifyOptions{Intermediates: intermediates, CurrentTime: now}); err != nil {
+		c.Verdict, c.Error = "unpinned", "not pinned and not publicly trusted: "+err.Error()
+		return c
+	}
+	logged, err := inCTLogs(cfg.CTSearchURL, leaf)
+	switch {
+	case err != nil:
+		c.Error = "CT search: " + err.Error()
+	case logged:
+		c.Verdict = "logged"
+	case hasEmbeddedSCTs(leaf) && now.Sub(leaf.NotBefore) < ctGrace:
+		c.Verdict = "pending"
+	default:
+		c.Verdict, c.Error = "unlogged", "publicly trusted but not found in CT logs"
+	}
+	return c
+}
+
+// presentedChain completes a TLS handshake with target far enough to get
+// its certificate chain, without verifying it. A listener that requires a
+// client certificate still presents its own first.
+func presentedChain(target string) ([]*x509.Certificate, error) {
+	host, _, _ := net.SplitHostPort(target)
+	var raw [][]byte
+	tc := &tls.Config{
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(certs [][]byte, _ [][]*x509.Certificate) error {
+			raw = certs
+			return nil
+		},
+	}
+	if net.ParseIP(host) == nil {
+		tc.ServerName = host
+	}
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 10 * time.Second}, "tcp", target, tc)
+	if conn != nil {
+		conn.Close()
+	}
+	if len(raw) == 0 {
+		if err == nil {
+			err = errors.New("no certificate presented")
+		}
+		return nil, err
+	}
+	chain := make([]*x509.Certificate, 0, len(raw))
+	for _, der := range raw {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, cert)
+	}
+	return chain, nil
+}
+
+func hasEmbeddedSCTs(cert *x509.Certificate) bool {
+	for _, ext := range cert.Extensions {
+		if ext.Id.Equal(oidSCTList) {
+			return true
+		}
+	}
+	return false
+}
+
+// ctEntry is the part of a CT search result a certificate is matched on.
+type ctEntry struct {
+	SerialNumber string `json:"serial_number"`
+	NotBefore    string `json:"not_before"`
+	NotAfter     string `json:"not_after"`
+}
+
+// inCTLogs reports whether the CT search finds cert, or its precertificate,
+// by serial number and validity.
+func inCTLogs(searchURL string, cert *x509.Certificate) (bool, error) {
+	serial := fmt.Sprintf("%x", cert.SerialNumber)
+	resp, err := ctClient.Get(fmt.Sprintf(searchURL, url.QueryEscape(serial)))
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("%s", resp.Status)
+	}
+	var entries []ctEntry
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return false, err
+	}
+	const layout = "2006-01-02T15:04:05"
+	for _, e := range entries {
+		if strings.TrimLeft(strings.ToLower(e.SerialNumber), "0") == strings.TrimLeft(serial, "0") &&
+			e.NotBefore == cert.NotBefore.UTC().Format(layout) && e.NotAfter == cert.NotAfter.UTC().Format(layout) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// recordTLSCheck keeps c as the last check of target, logs a change of
+// certificate, and alerts when a certificate that does not pass is first
+// seen.
+func recordTLSCheck(cfg *Config, target string, c *tlsCheck) {
+	tlsChecks.Lock()
+	prev := tlsChecks.last[target]
+	if prev != nil {
+		c.ChangedAt = prev.ChangedAt
+		if c.SHA256 != "" && prev.SHA256 != "" && c.SHA256 != prev.SHA256 {
+			at := c.CheckedAt
+			c.ChangedAt = &at
+			log.Printf("tls check: %s: certificate changed from %s to %s (%s)", target, prev.SHA256, c.SHA256, c.Verdict)
+		}
+	}
+	tlsChecks.last[target] = c
+	tlsChecks.Unlock()
+
+	switch {
+	case c.Verdict == "error":
+		log.Printf("tls check: %s: %s", target, c.Error)
+	case !c.passed() && (prev == nil || prev.SHA256 != c.SHA256 || prev.passed()):
+		alert(cfg, "tls check: %s presents %s (serial %s, issuer %s, sha256 %s): %s", target, c.Subject, c.Serial, c.Issuer, c.SHA256, c.Error)
+	}
+}
+
+// tlsCheckHandler serves GET /admin/v1/tls-check, the last check of each
+// target.
+func tlsCheckHandler(w http.ResponseWriter, r *http.Request) {
+	tlsChecks.Lock()
+	report := make(map[string]tlsCheck, len(tlsChecks.last))
+	for t, c := range tlsChecks.last {
+		report[t] = *c
+	}
+	tlsChecks.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(report)
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// TLSPolicy is the protocol policy of a TLS listener: the dashboard's and
+// the standby stream's, on both of its sides. tls_policy is the default of
+// every listener, and a listener's tls.policy replaces it as a whole.
+type TLSPolicy struct {
+	// Profile is default (TLS 1.2 and 1.3 with Go's cipher suites) or
+	// tls13, which only offers TLS 1.3.
+	Profile string `yaml:"profile"`
+	// MinVersion and MaxVersion are 1.2 or 1.3; nothing older is offered.
+	MinVersion string `yaml:"min_version"`
+	MaxVersion string `yaml:"max_version"`
+	// CipherSuites are the TLS 1.2 suites offered, by IANA name, in place
+	// of Go's. TLS 1.3 suites are not configurable.
+	CipherSuites []string `yaml:"cipher_suites"`
+	// Curves are the key exchange groups, preferred first: X25519, P-256,
+	// P-384 or P-521.
+	Curves []string `yaml:"curves"`
+	// SessionTickets is on (the default) or off.
+	SessionTickets string `yaml:"session_tickets"`
+	// TicketRotation replaces the session ticket key this often, keeping
+	// the previous one for resumption. 0 leaves rotation to Go, daily.
+	TicketRotation time.Duration `yaml:"ticket_rotation"`
+}
+
+var tlsVersions = map[string]uint16{"1.2": tls.VersionTLS12, "1.3": tls.VersionTLS13}
+
+var tlsCurves = map[string]tls.CurveID{
+	"X25519": tls.X25519,
+	"P-256":  tls.CurveP256,
+	"P-384":  tls.CurveP384,
+	"P-521":  tls.CurveP521,
+}
+
+func (p TLSPolicy) validate(name string) error {
+	_, err := p.config()
+	if err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	return nil
+}
+
+// config returns the tls.Config of p, without certificates.
+func (p TLSPolicy) config() (*tls.Config, error) {
+	tc := &tls.Config{MinVersion: tls.VersionTLS12}
+	switch p.Profile {
+	case "", "default":
+	case "tls13":
+		tc.MinVersion = tls.VersionTLS13
+		if p.MinVersion != "" || p.MaxVersion != "" || len(p.CipherSuites) > 0 {
+			return nil, errors.New("the tls13 profile sets the versions and leaves no cipher suites to choose")
+		}
+	default:
+		return nil, fmt.Errorf("unknown profile %q (want default or tls13)", p.Profile)
+	}
+	for _, v := range []struct {
+		name string
+		to   *uint16
+	}{{p.MinVersion, &tc.MinVersion}, {p.MaxVersion, &tc.MaxVersion}} {
+		if v.name == "" {
+			continue
+		}
+		version, ok := tlsVersions[v.name]
+		if !ok {
+			return nil, fmt.Errorf("TLS version %q is neither 1.2 nor 1.3", v.name)
+		}
+		*v.to = version
+	}
+	if tc.MaxVersion != 0 && tc.MaxVersion < tc.MinVersion {
+		return nil, errors.New("max_version is below min_version")
+	}
+	if len(p.CipherSuites) > 0 && tc.MinVersion == tls.VersionTLS13 {
+		return nil, errors.New("cipher_suites only apply to TLS 1.2, which min_version rules out")
+	}
+	for _, name := range p.CipherSuites {
+		id, ok := cipherSuiteID(name)
+		if !ok {
+			return nil, fmt.Errorf("cipher suite %q is unknown or insecure", name)
+		}
+		if !supportsTLS12(id) {
+			return nil, fmt.Errorf("cipher suite %s is not a TLS 1.2 suite", name)
+		}
+		tc.CipherSuites = append(tc.CipherSuites, id)
+	}
+	for _, name := range p.Curves {
+		id, ok := tlsCurves[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown curve %q (want X25519, P-256, P-384 or P-521)", name)
+		}
+		tc.CurvePreferences = append(tc.CurvePreferences, id)
+	}
+	switch p.SessionTickets {
+	case "", "on":
+	case "off":
+		tc.SessionTicketsDisabled = true
+		if p.TicketRotation != 0 {
+			return nil, errors.New("ticket_rotation needs session tickets")
+		}
+	default:
+		return nil, fmt.Errorf("session_tickets: %q is neither on nor off", p.SessionTickets)
+	}
+	if p.TicketRotation < 0 || (p.TicketRotation > 0 && p.TicketRotation < time.Minute) {
+		return nil, errors.New("ticket_rotation must be at least a minute")
+	}
+	return tc, nil
+}
+
+// cipherSuiteID returns the ID of the secure suite named name.
+func cipherSuiteID(name string) (uint16, bool) {
+	for _, s := range tls.CipherSuites() {
+		if s.Name == name {
+			return s.ID, true
+		}
+	}
+	return 0, false
+}
+
+func supportsTLS12(id uint16) bool {
+	for _, s := range tls.CipherSuites() {
+		if s.ID != id {
+			continue
+		}
+		for _, v := range s.SupportedVersions {
+			if v == tls.VersionTLS12 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// tlsPolicyFor returns the policy of a listener whose own policy is own,
+// if it has one.
+func (c *Config) tlsPolicyFor(own *TLSPolicy) TLSPolicy {
+	if own != nil {
+		return *own
+	}
+	return c.TLSPolicy
+}
+
+// serverTLSConfig returns the tls.Config of the TLS listener name under
+// policy p and records it for GET /admin/v1/tls. With ticket_rotation, it
+// starts rotating the session ticket keys.
+func serverTLSConfig(name string, p TLSPolicy) (*tls.Config, error) {
+	tc, err := p.config()
+	if err != nil {
+		return nil, err
+	}
+	if p.TicketRotation > 0 {
+		rotateTicketKeys(name, tc, p.TicketRotation)
+	}
+	tlsListeners.Lock()
+	tlsListeners.byName[name] = p
+	tlsListeners.Unlock()
+	return tc, nil
+}
+
+// tlsListeners are the policies of the TLS listeners served, by name.
+var tlsListeners = struct {
+	sync.Mutex
+	byName map[string]TLSPolicy
+}{byName: make(map[string]TLSPolicy)}
+
+// rotateTicketKeys replaces the session ticket key of tc every period.
+// The key it replaces still decrypts tickets for another period, so
+// sessions resume across a rotation.
+func rotateTicketKeys(name string, tc *tls.Config, period time.Duration) {
+	superviseLoop("tls-tickets-"+name, func(hb heartbeat) {
+		var keys [][32]byte
+		for {
+			var key [32]byte
+			if _, err := rand.Read(key[:]); err != nil {
+				log.Printf("tls %s: session ticket key: %v", name, err)
+			} else {
+				keys = append([][32]byte{key}, keys...)
+				if len(keys) > 2 {
+					keys = keys[:2]
+				}
+				tc.SetSessionTicketKeys(keys)
+			}
+			if !hb.sleep(period) {
+				return
+			}
+		}
+	})
+}
+
+// tlsReport is one listener in GET /admin/v1/tls.
+type tlsReport struct {
+	Listener string `json:"listener"`
+	Address  string `json:"address,omitempty"`
+	// Versions, CipherSuites and Curves are what the listener offers;
+	// TLS 1.3 suites are always Go's.
+	Versions       []string `json:"versions"`
+	CipherSuites   []string `json:"cipher_suites"`
+	Curves         []string `json:"curves"`
+	SessionTickets bool     `json:"session_tickets"`
+	TicketRotation string   `json:"ticket_rotation,omitempty"`
+}
+
+// tlsReports describes the policy of every TLS listener served.
+func tlsReports() []tlsReport {
+	addrs := currentListeners().Listeners
+	tlsListeners.Lock()
+	defer tlsListeners.Unlock()
+	out := make([]tlsReport, 0, len(tlsListeners.byName))
+	for name, p := range tlsListeners.byName {
+		tc, _ := p.config()
+		r := tlsReport{Listener: name, Address: addrs[name], SessionTickets: !tc.SessionTicketsDisabled}
+		if p.TicketRotation > 0 {
+			r.TicketRotation = p.TicketRotation.String()
+		}
+		for _, v := range []string{"1.2", "1.3"} {
+			if id := tlsVersions[v]; id >= tc.MinVersion && (tc.MaxVersion == 0 || id <= tc.MaxVersion) {
+				r.Versions = append(r.Versions, "TLS "+v)
+			}
+		}
+		for _, s := range tls.CipherSuites() {
+			if offersSuite(tc, s) {
+				r.CipherSuites = append(r.CipherSuites, s.Name)
+			}
+		}
+		if len(p.Curves) > 0 {
+			r.Curves = p.Curves
+		} else {
+			r.Curves = []string{"X25519", "P-256", "P-384", "P-521"}
+		}
+		out = append(out, r)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Listener < out[j].Listener })
+	return out
+}
+
+// offersSuite reports whether a listener under tc negotiates suite s with
+// a client that offers it.
+func offersSuite(tc *tls.Config, s *tls.CipherSuite) bool {
+	for _, v := range s.SupportedVersions {
+		if v < tc.MinVersion || (tc.MaxVersion != 0 && v > tc.MaxVersion) {
+			continue
+		}
+		if v == tls.VersionTLS13 || tc.CipherSuites == nil {
+			return true
+		}
+		for _, id := range tc.CipherSuites {
+			if id == s.ID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// tlsHandler serves GET /admin/v1/tls.
+func tlsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(tlsReports())
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/pkkemp/GoOCSPResponder/responder"
+)
+
+// CRLs are parsed strictly, as x509.ParseDERCRL does, so a CRL with an
+// encoding quirk fails to load and its issuer goes unserved.
+// tolerant_parsing names the issuers whose CRLs are parsed with
+// responder.ScanCRLTolerant instead, which accepts the quirks of CAs seen
+// in the wild and reports each one. The signature is checked all the same.
+
+// tolerantParsing reports whether the CRL crl is parsed tolerantly:
+// tolerant_parsing names it by CRL name or common name, or holds "*".
+func (c *Config) tolerantParsing(crl CRLInfo) bool {
+	for _, name := range c.TolerantParsing {
+		if name == "*" || strings.EqualFold(name, crl.key()) || (crl.CA != nil && strings.EqualFold(name, crl.CA.Subject.CommonName)) {
+			return true
+		}
+	}
+	return false
+}
+
+// scanCRLFor scans der, the CRL crl, for indexing as scanCRLDER does, or
+// tolerantly if tolerant_parsing says so, warning of the quirks accepted.
+func scanCRLFor(cfg *Config, crl CRLInfo, der []byte) (*responder.ScannedCRL, error) {
+	if !cfg.tolerantParsing(crl) {
+		return scanCRLDER(crl.FileName, der)
+	}
+	scanned, err := responder.ScanCRLTolerant(der)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", crl.FileName, err)
+	}
+	if len(scanned.Quirks) > 0 {
+		log.Printf("tolerant parsing %s: accepted %s", crl.FileName, strings.Join(scanned.Quirks, ", "))
+	}
+	return scanned, nil
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkkemp/GoOCSPResponder/responder"
+)
+
+// Requests for issuers the responder does not serve are answered
+// unauthorized, but counted by CertID issuer hashes, so operators can see
+// which CAs their clients need before enabling them. Hashes are resolved
+// against the whole CA bundle, served or not, when reported.
+
+// maxUnknownIssuers bounds the hashes tracked. Once full, a new hash
+// replaces the least requested one and inherits its count, as in the
+// space-saving algorithm: the most requested hashes are kept, and a count
+// overstates its hash's requests by at most what it inherited.
+const maxUnknownIssuers = 256
+
+// unknownIssuer counts the requests for one issuer hash pair.
+type unknownIssuer struct {
+	hash                crypto.Hash
+	nameHash, keyHash   []byte
+	requests, overEst   int64
+	firstSeen, lastSeen time.Time
+}
+
+var unknownIssuers = struct {
+	sync.Mutex
+	byKey map[string]*unknownIssuer
+	total int64
+}{byKey: make(map[string]*unknownIssuer)}
+
+// recordUnknownIssuer counts a request for the issuer of id, which is not
+// served.
+func recordUnknownIssuer(id responder.CertID, now time.Time) {
+	var buf [1 + 2*64]byte
+	key := appendCertIDKey(buf[:0], id.HashAlgorithm, id.NameHash, id.KeyHash)
+	unknownIssuers.Lock()
+	defer unknownIssuers.Unlock()
+	unknownIssuers.total++
+	if u, ok := unknownIssuers.byKey[string(key)]; ok {
+		u.requests++
+		u.lastSeen = now
+		return
+	}
+	u := &unknownIssuer{
+		hash:      id.HashAlgorithm,
+		nameHash:  append([]byte(nil), id.NameHash...),
+		keyHash:   append([]byte(nil), id.KeyHash...),
+		requests:  1,
+		firstSeen: now,
+		lastSeen:  now,
+	}
+	if len(unknownIssuers.byKey) >= maxUnknownIssuers {
+		var minKey string
+		var min *unknownIssuer
+		for k, v := range unknownIssuers.byKey {
+			if min == nil || v.requests < min.requests {
+				minKey, min = k, v
+			}
+		}
+		delete(unknownIssuers.byKey, minKey)
+		u.requests += min.requests
+		u.overEst = min.requests
+	}
+	unknownIssuers.byKey[string(key)] = u
+}
+
+// unknownIssuerReport is the JSON form of one tracked hash.
+type unknownIssuerReport struct {
+	HashAlgorithm string `json:"hash_algorithm"`
+	NameHash      string `json:"issuer_name_hash"`
+	KeyHash       string `json:"issuer_key_hash"`
+	// CA is the common name of the bundle CA the hashes belong to, which
+	// is what issuers takes to serve it; empty if the bundle has none.
+	CA      string `json:"ca,omitempty"`
+	Subject string `json:"subject,omitempty"`
+	// KeyMatches is the served issuer whose key hash matches, which
+	// cert_id.lenient_name_hash would answer for.
+	KeyMatches string `json:"key_matches,omitempty"`
+	// Requests may count up to Overestimate requests for hashes it
+	// replaced once the table was full.
+	Requests     int64     `json:"requests"`
+	Overestimate int64     `json:"overestimate,omitempty"`
+	FirstSeen    time.Time `json:"first_seen"`
+	LastSeen     time.Time `json:"last_seen"`
+}
+
+// unknownIssuerReports returns the tracked hashes, most requested first,
+// at most limit of them if limit is positive, and the number of requests
+// for unknown issuers since startup.
+func unknownIssuerReports(limit int) ([]unknownIssuerReport, int64) {
+	unknownIssuers.Lock()
+	reports := make([]unknownIssuerReport, 0, len(unknownIssuers.byKey))
+	keys := make([]string, 0, len(unknownIssuers.byKey))
+	for k, u := range unknownIssuers.byKey {
+		reports = append(reports, unknownIssuerReport{
+			HashAlgorithm: u.hash.String(),
+			NameHash:      hex.EncodeToString(u.nameHash),
+			KeyHash:       hex.EncodeToString(u.keyHash),
+			Requests:      u.requests,
+			Overestimate:  u.overEst,
+			FirstSeen:     u.firstSeen,
+			LastSeen:      u.lastSeen,
+		})
+		keys = append(keys, k)
+	}
+	total := unknownIssuers.total
+	unknownIssuers.Unlock()
+
+	bundle := bundleByCertIDKey()
+	keyHashes := currentState().keyHashes
+	for i := range reports {
+		if ca, ok := bundle[keys[i]]; ok {
+			reports[i].CA, reports[i].Subject = ca.Subject.CommonName, subjectDN(ca)
+		}
+		reports[i].KeyMatches = keyHashes[certIDKeyHash(keys[i])]
+	}
+	sort.Slice(reports, func(i, j int) bool {
+		if reports[i].Requests != reports[j].Requests {
+			return reports[i].Requests > reports[j].Requests
+		}
+		return reports[i].KeyHash < reports[j].KeyHash
+	})
+	if limit > 0 && len(reports) > limit {
+		reports = reports[:limit]
+	}
+	return reports, total
+}
+
+// bundleByCertIDKey maps the issuer index keys of every CA in the cached
+// bundle to it; see certIDKeys.
+func bundleByCertIDKey() map[string]*x509.Certificate {
+	certs, err := readCertificates(rootDir + bundleFile())
+	if err != nil {
+		return nil
+	}
+	byKey := make(map[string]*x509.Certificate, len(certs)*len(certIDHashes))
+	for _, ca := range certs {
+		for _, k := range certIDKeys(ca) {
+			byKey[k] = ca
+		}
+	}
+	return byKey
+}
+
+// unknownIssuersHandler serves GET /admin/v1/unknown-issuers.
+func unknownIssuersHandler(w http.ResponseWriter, r *http.Request) {
+	reports, total := unknownIssuerReports(0)
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(struct {
+		Requests int64                 `json:"requests"`
+		Issuers  []unknownIssuerReport `json:"issuers"`
+	}{total, reports})
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkkemp/GoOCSPResponder/responder"
+)
+
+// timeLayouts are the layouts accepted by --at, most specific first.
+var timeLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04Z07:00",
+	"2006-01-02T15:04",
+	"2006-01-02",
+}
+
+func parseTime(s string) (time.Time, error) {
+	for _, layout := range timeLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unrecognized time %q (want RFC 3339, e.g. 2023-06-01T00:00Z)", s)
+}
+
+// readCertificates loads every certificate from a PEM or DER file.
+func readCertificates(path string) ([]*x509.Certificate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		cert, err := x509.ParseCertificate(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: no certificates found", path)
+		}
+		certs = append(certs, cert)
+	}
+	return certs, nil
+}
+
+// readResponse loads an OCSP response stored as DER, PEM or base64.
+func readResponse(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if block, _ := pem.Decode(data); block != nil {
+		return block.Bytes, nil
+	}
+	if len(data) > 0 && data[0] == 0x30 {
+		return data, nil
+	}
+	der, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, errors.New("response is neither DER, PEM nor base64")
+	}
+	return der, nil
+}
+
+func verifyResponseCommand(args []string) int {
+	fs := flag.NewFlagSet("verify-response", flag.ContinueOnError)
+	responsePath := fs.String("response", "", "OCSP response to verify (DER, PEM or base64)")
+	issuerPath := fs.String("issuer", "", "PEM certificate of the CA the response is about")
+	responderPath := fs.String("responder", "", "optional PEM certificates of locally trusted responders")
+	atFlag := fs.String("at", "", "point in time to validate at (RFC 3339); defaults to now")
+	skew := fs.Duration("skew", 0, "clock skew tolerated around the validity window")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *responsePath == "" || *issuerPath == "" {
+		fmt.Fprintln(os.Stderr, "verify-response: --response and --issuer are required")
+		fs.Usage()
+		return 2
+	}
+
+	opts := responder.VerifyOptions{Skew: *skew}
+	if *atFlag != "" {
+		at, err := parseTime(*atFlag)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "verify-response:", err)
+			return 2
+		}
+		opts.At = at
+	}
+
+	issuers, err := readCertificates(*issuerPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "verify-response:", err)
+		return 2
+	}
+	if *responderPath != "" {
+		opts.TrustedResponders, err = readCertificates(*responderPath)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "verify-response:", err)
+			return 2
+		}
+	}
+	der, err := readResponse(*responsePath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "verify-response:", err)
+		return 2
+	}
+	resp, err := responder.ParseResponse(der)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "verify-response:", err)
+		return 1
+	}
+
+	printResponse(resp)
+	signer, err := responder.Verify(resp, issuers[0], opts)
+	if signer != nil {
+		fmt.Printf("Signed by:     %s\n", signer.Subject)
+	}
+	if err != nil {
+		fmt.Printf("Result:        INVALID: %v\n", err)
+		return 1
+	}
+	at := opts.At
+	if at.IsZero() {
+		at = time.Now()
+	}
+	fmt.Printf("Result:        valid at %s\n", at.UTC().Format(time.RFC3339))
+	return 0
+}
+
+func printResponse(resp *responder.Response) {
+	fmt.Printf("Status:        %s\n", resp.Status)
+	if resp.Status != responder.Successful {
+		return
+	}
+	fmt.Printf("Produced at:   %s\n", resp.ProducedAt.UTC().Format(time.RFC3339))
+	for _, sr := range resp.Responses {
+		fmt.Printf("Serial %x: %s", sr.SerialNumber, sr.Status)
+		if sr.Status == responder.Revoked {
+			fmt.Printf(" at %s (reason %d)", sr.RevokedAt.UTC().Format(time.RFC3339), sr.RevocationReason)
+		}
+		fmt.Printf(", this update %s", sr.ThisUpdate.UTC().Format(time.RFC3339))
+		if !sr.NextUpdate.IsZero() {
+			fmt.Printf(", next update %s", sr.NextUpdate.UTC().Format(time.RFC3339))
+		}
+		fmt.Println()
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestVerifyResponseCommand(t *testing.T) {
+	newReq := benchState(t, defaultConfig().Cache)
+	der := currentState().answer(newReq(0x1001), time.Now())
+
+	dir := t.TempDir()
+	write := func(name string, data []byte) string {
+		t.Helper()
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	issuer := write("issuer.pem", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: currentState().signer.Cert.Raw}))
+	other := testCA(t, "Bench CA-1", time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	otherIssuer := write("other.pem", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: other.Cert.Raw}))
+	good := write("good.der", der)
+	tampered := append([]byte(nil), der...)
+	tampered[len(tampered)-1] ^= 1
+	bad := write("tampered.der", tampered)
+
+	for _, tc := range []struct {
+		name string
+		args []string
+		want int
+	}{
+		{"good", []string{"--response", good, "--issuer", issuer}, 0},
+		{"tampered", []string{"--response", bad, "--issuer", issuer}, 1},
+		{"another issuer of the same name", []string{"--response", good, "--issuer", otherIssuer}, 1},
+		{"expired", []string{"--response", good, "--issuer", issuer, "--at", time.Now().Add(48 * time.Hour).Format(time.RFC3339)}, 1},
+		{"no issuer", []string{"--response", good}, 2},
+	} {
+		if got := verifyResponseCommand(tc.args); got != tc.want {
+			t.Errorf("%s: exited %d, want %d", tc.name, got, tc.want)
+		}
+	}
+}
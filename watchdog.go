@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"runtime"
+	"runtime/pprof"
+	"sort"
+	"sync"
+	"time"
+)
+
+// WatchdogConfig watches the responder for goroutine leaks, deadlocks and
+// background loops that stopped making progress. The background loops
+// (CRL refresh, staple export, consistency, peer and TLS checks, the
+// issuer registry) report before every sleep how long they mean to sleep;
+// one that is more than stall late is reported with a goroutine dump and,
+// with restart, started again. The stuck goroutine cannot be stopped, but
+// it exits if it ever wakes up. The process itself is never restarted.
+type WatchdogConfig struct {
+	Enabled  bool          `yaml:"enabled"`
+	Interval time.Duration `yaml:"interval"`
+	// MaxGoroutines is the goroutine count above which a leak is reported.
+	MaxGoroutines int `yaml:"max_goroutines"`
+	// Stall is how late a background loop may be.
+	Stall time.Duration `yaml:"stall"`
+	// LockWait is how long the state lock may be held, by reloads and
+	// refreshes swapping the state, before a deadlock is reported.
+	LockWait time.Duration `yaml:"lock_wait"`
+	Restart  bool          `yaml:"restart"`
+}
+
+func (c WatchdogConfig) validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	switch {
+	case c.Interval < time.Second:
+		return errors.New("watchdog.interval must be at least 1s")
+	case c.MaxGoroutines < 100:
+		return errors.New("watchdog.max_goroutines must be at least 100")
+	case c.Stall < time.Minute:
+		return errors.New("watchdog.stall must be at least 1m")
+	case c.LockWait < c.Interval:
+		return errors.New("watchdog.lock_wait must be at least watchdog.interval")
+	}
+	return nil
+}
+
+// watchdogDumpFile keeps the last goroutine dump in the cache directory.
+const watchdogDumpFile = "watchdog-stacks.txt"
+
+// minDumpInterval spaces goroutine dumps, which stop the world.
+const minDumpInterval = 10 * time.Minute
+
+// heartbeat is handed to a supervised loop; gen tells a restarted loop's
+// instances apart.
+type heartbeat struct {
+	name string
+	gen  uint64
+}
+
+// supervisedLoop is the progress of one background loop.
+type supervisedLoop struct {
+	Name string `json:"name"`
+	// LastBeat is when the loop last reported; it is late past Due.
+	LastBeat time.Time `json:"last_beat"`
+	Due      time.Time `json:"due"`
+	Stalled  bool      `json:"stalled"`
+	Restarts int       `json:"restarts"`
+	gen      uint64
+	run      func(hb heartbeat)
+}
+
+var loops = struct {
+	sync.Mutex
+	byName map[string]*supervisedLoop
+}{byName: make(map[string]*supervisedLoop)}
+
+// superviseLoop starts run in a goroutine as the background loop name,
+// replacing any earlier instance.
+func superviseLoop(name string, run func(hb heartbeat)) {
+	loops.Lock()
+	defer loops.Unlock()
+	l := loops.byName[name]
+	if l == nil {
+		l = &supervisedLoop{Name: name}
+		loops.byName[name] = l
+	}
+	l.run = run
+	l.start(time.Now())
+}
+
+// start runs a new instance of l; loops must be held.
+func (l *supervisedLoop) start(now time.Time) {
+	l.gen++
+	l.LastBeat, l.Due, l.Stalled = now, now, false
+	go l.run(heartbeat{l.Name, l.gen})
+}
+
+// beat reports that the loop is about to wait for up to d. It returns
+// false if the loop was restarted meanwhile; the caller must then return.
+func (hb heartbeat) beat(d time.Duration) bool {
+	loops.Lock()
+	defer loops.Unlock()
+	l := loops.byName[hb.name]
+	if l == nil || l.gen != hb.gen {
+		log.Printf("watchdog: %s: a replaced instance woke up and exits", hb.name)
+		return false
+	}
+	now := time.Now()
+	if l.Stalled {
+		log.Printf("watchdog: %s is making progress again", hb.name)
+		l.Stalled = false
+	}
+	l.LastBeat, l.Due = now, now.Add(d)
+	return true
+}
+
+// sleep beats and sleeps for d, and reports whether the loop should go on.
+func (hb heartbeat) sleep(d time.Duration) bool {
+	if !hb.beat(d) {
+		return false
+	}
+	time.Sleep(d)
+	return hb.beat(0)
+}
+
+// watchdog is the state of the checks that span several rounds.
+var watchdog = struct {
+	sync.Mutex
+	// probe is closed once the watchdog got hold of the state lock, which
+	// it asked for at probeAt; nil when no probe is pending.
+	probe     chan struct{}
+	probeAt   time.Time
+	lockStuck bool
+	leaking   bool
+	saturated int
+	lastDump  time.Time
+}{}
+
+// runWatchdog checks the responder every watchdog.interval.
+func runWatchdog() {
+	for {
+		cfg := currentState().cfg.Watchdog
+		if !cfg.Enabled {
+			// Disabled; a reload may enable it.
+			time.Sleep(time.Minute)
+			continue
+		}
+		checkWatchdog(cfg, time.Now())
+		time.Sleep(cfg.Interval)
+	}
+}
+
+func checkWatchdog(cfg WatchdogConfig, now time.Time) {
+	st := currentState()
+	var reasons []string
+
+	loops.Lock()
+	for _, l := range loops.byName {
+		if l.Stalled || !now.After(l.Due.Add(cfg.Stall)) {
+			continue
+		}
+		late := now.Sub(l.Due).Round(time.Second)
+		l.Stalled = true
+		if cfg.Restart {
+			l.Restarts++
+			criticalAlert(st.cfg, "watchdog: %s is %s late; starting it again", l.Name, late)
+			l.start(now)
+		} else {
+			criticalAlert(st.cfg, "watchdog: %s is %s late", l.Name, late)
+		}
+		reasons = append(reasons, l.Name+" stalled")
+	}
+	loops.Unlock()
+
+	watchdog.Lock()
+	defer watchdog.Unlock()
+	n := runtime.NumGoroutine()
+	switch {
+	case n > cfg.MaxGoroutines && !watchdog.leaking:
+		watchdog.leaking = true
+		alert(st.cfg, "watchdog: %d goroutines, over watchdog.max_goroutines (%d)", n, cfg.MaxGoroutines)
+		reasons = append(reasons, "goroutine leak")
+	case n <= cfg.MaxGoroutines && watchdog.leaking:
+		watchdog.leaking = false
+		log.Printf("watchdog: back to %d goroutines", n)
+	}
+
+	if watchdog.probe == nil {
+		probe := make(chan struct{})
+		watchdog.probe, watchdog.probeAt = probe, now
+		go func() {
+			stateMu.Lock()
+			stateMu.Unlock()
+			close(probe)
+		}()
+	}
+	select {
+	case <-watchdog.probe:
+		watchdog.probe = nil
+		if watchdog.lockStuck {
+			watchdog.lockStuck = false
+			log.Printf("watchdog: the state lock was released")
+		}
+	default:
+		if held := now.Sub(watchdog.probeAt); held > cfg.LockWait && !watchdog.lockStuck {
+			watchdog.lockStuck = true
+			criticalAlert(st.cfg, "watchdog: the state lock has been held for over %s; reloads and refreshes are stuck", held.Round(time.Second))
+			reasons = append(reasons, "state lock held")
+		}
+	}
+
+	// Requests wait for a slow path slot at most cache.slow_path_wait;
+	// slots taken round after round mean signing stopped keeping up.
+	if len(st.slow) == cap(st.slow) {
+		watchdog.saturated++
+		if watchdog.saturated == 3 {
+			log.Printf("watchdog: all %d slow path slots busy for 3 rounds", cap(st.slow))
+		}
+	} else {
+		watchdog.saturated = 0
+	}
+
+	if len(reasons) > 0 && now.Sub(watchdog.lastDump) >= minDumpInterval {
+		watchdog.lastDump = now
+		dump := goroutineDump()
+		if readOnly {
+			log.Printf("watchdog: %v; goroutines:\n%s", reasons, dump)
+		} else if err := writeFileAtomic(rootDir+watchdogDumpFile, dump, 0644); err != nil {
+			log.Printf("watchdog: %v", err)
+		} else {
+			log.Printf("watchdog: %v; goroutines dumped to %s", reasons, rootDir+watchdogDumpFile)
+		}
+	}
+}
+
+// goroutineDump returns the stacks of every goroutine, as a crash shows
+// them.
+func goroutineDump() []byte {
+	var buf bytes.Buffer
+	pprof.Lookup("goroutine").WriteTo(&buf, 2)
+	return buf.Bytes()
+}
+
+// watchdogHandler serves GET /admin/v1/watchdog.
+func watchdogHandler(w http.ResponseWriter, r *http.Request) {
+	st := currentState()
+	type report struct {
+		Goroutines    int              `json:"goroutines"`
+		MaxGoroutines int              `json:"max_goroutines"`
+		SlowPathBusy  int              `json:"slow_path_busy"`
+		SlowPathSlots int              `json:"slow_path_slots"`
+		StateLock     string           `json:"state_lock"`
+		Loops         []supervisedLoop `json:"loops"`
+		LastDump      *time.Time       `json:"last_dump,omitempty"`
+	}
+	out := report{
+		Goroutines:    runtime.NumGoroutine(),
+		MaxGoroutines: st.cfg.Watchdog.MaxGoroutines,
+		SlowPathBusy:  len(st.slow),
+		SlowPathSlots: cap(st.slow),
+		StateLock:     "ok",
+		Loops:         []supervisedLoop{},
+	}
+	watchdog.Lock()
+	if watchdog.lockStuck {
+		out.StateLock = "held since before " + watchdog.probeAt.UTC().Format(time.RFC3339)
+	}
+	if !watchdog.lastDump.IsZero() {
+		t := watchdog.lastDump.UTC()
+		out.LastDump = &t
+	}
+	watchdog.Unlock()
+	loops.Lock()
+	for _, l := range loops.byName {
+		out.Loops = append(out.Loops, *l)
+	}
+	loops.Unlock()
+	sort.Slice(out.Loops, func(i, j int) bool { return out.Loops[i].Name < out.Loops[j].Name })
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(out)
+}
+
+// stacksHandler serves GET /admin/v1/watchdog/stacks: the stacks of every
+// goroutine now.
+func stacksHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write(goroutineDump())
+}